@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// batchWorkers bounds how many containers a batch command works on at once.
+const batchWorkers = 8
+
+// batchFlags are the flags of commands accepting several containers.
+type batchFlags struct {
+	all    bool
+	status []string
+}
+
+func (f *batchFlags) register(cmd *cobra.Command, what string) {
+	cmd.Flags().BoolVarP(&f.all, "all", "a", false, what)
+	cmd.Flags().StringSliceVar(&f.status, "status", nil, "with --all, only containers with one of these statuses (created, running, stopped)")
+}
+
+// targets returns the containers named by args, or with --all those with
+// the given statuses, defaulting to defaultStatus.
+func (f *batchFlags) targets(args []string, defaultStatus ...container.Status) ([]string, error) {
+	if !f.all {
+		if len(f.status) > 0 {
+			return nil, fmt.Errorf("--status requires --all")
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("requires at least one container id, or --all")
+		}
+		return args, nil
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("container ids can't be combined with --all")
+	}
+
+	filter := container.StateFilter{Status: defaultStatus}
+	if len(f.status) > 0 {
+		filter.Status = nil
+		for _, name := range f.status {
+			st, err := container.ParseStatus(name)
+			if err != nil {
+				return nil, err
+			}
+			filter.Status = append(filter.Status, st)
+		}
+	}
+	rt, err := container.New()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := rt.Find(filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(containers))
+	for i, c := range containers {
+		ids[i] = c.Id
+	}
+	return ids, nil
+}
+
+// runBatch applies op to every container in ids, batchWorkers at a time,
+// each resolved first as container.ResolveID does. A single container fails
+// like any other command. Otherwise each container is reported, as given
+// on success or with its error, and the command exits with a failure if
+// any container failed: with the code of their errors if they agree, 1 if
+// not.
+func runBatch(ids []string, op func(id string) error) {
+	resolved := op
+	op = func(ref string) error {
+		id, err := container.ResolveID(ref)
+		if err != nil {
+			return err
+		}
+		return resolved(id)
+	}
+	if len(ids) == 1 {
+		if err := op(ids[0]); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, batchWorkers)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = op(id)
+		}()
+	}
+	wg.Wait()
+	reportBatch(ids, errs)
+}
+
+// reportBatch reports the outcome of a batch command, errs holding the
+// error of each container of ids, and exits as runBatch does.
+func reportBatch(ids []string, errs []error) {
+	code := 0
+	for i, id := range ids {
+		if errs[i] == nil {
+			fmt.Println(id)
+			continue
+		}
+		fmt.Printf("Error: %s: %v\n", id, errs[i])
+		switch c := exitCode(errs[i]); {
+		case code == 0:
+			code = c
+		case code != c:
+			code = exitError
+		}
+	}
+	if code != 0 {
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	benchBundle     string
+	benchConfig     string
+	benchImage      string
+	benchIterations int
+	benchCPUProfile string
+	benchMemProfile string
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure the performance of the runtime",
+}
+
+var benchStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Time the startup of containers, phase by phase",
+	Long: `Run containers from the bundle, or an image, one after the other and destroy
+each once its process has executed, then print the 50th and 95th percentile of
+how long each phase of their startup took:
+
+  rootfs    preparing the rootfs of an image, or populating an empty one
+  create    starting the init stages, of which
+  clone       forking the child stage into the container namespaces
+  mounts      mounting the filesystems of the container
+  pivot       moving into its root and finishing its setup
+  network   connecting the container
+  start     letting the container process run
+  exec      from then until the container process has executed
+  startup   the whole of it, from the start of the run
+  destroy   killing and deleting the container
+
+The CPU and memory profiles are those of the runtime, not of the init stages.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		var opts []container.CreateOption
+		if benchImage != "" {
+			opts = append(opts, container.WithImage(benchImage))
+		}
+		specPath := benchConfig
+		if !filepath.IsAbs(specPath) {
+			specPath = filepath.Join(benchBundle, specPath)
+		}
+		opts = append(opts, container.WithBundle(benchBundle))
+
+		if benchCPUProfile != "" {
+			f, err := os.Create(benchCPUProfile)
+			if err != nil {
+				exitWithError(err)
+			}
+			defer f.Close()
+			if err := pprof.StartCPUProfile(f); err != nil {
+				exitWithError(err)
+			}
+		}
+		result, err := rt.BenchStart(cmd.Context(), specPath, benchIterations, opts...)
+		if benchCPUProfile != "" {
+			pprof.StopCPUProfile()
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		if benchMemProfile != "" {
+			if err := writeHeapProfile(benchMemProfile); err != nil {
+				exitWithError(err)
+			}
+		}
+
+		fmt.Printf("%d iterations\n", result.Iterations)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PHASE\tP50\tP95")
+		for _, p := range result.Phases {
+			fmt.Fprintf(w, "%s\t%v\t%v\n", p.Name, p.P50.Round(time.Microsecond), p.P95.Round(time.Microsecond))
+		}
+		w.Flush()
+	},
+}
+
+// writeHeapProfile writes a profile of the memory allocated so far to path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	runtime.GC()
+	return pprof.WriteHeapProfile(f)
+}
+
+func init() {
+	benchStartCmd.Flags().IntVarP(&benchIterations, "iterations", "n", 10, "how many containers to start")
+	benchStartCmd.Flags().StringVarP(&benchBundle, "bundle", "b", ".", "path to the bundle directory holding config.json and, when relative, the rootfs")
+	benchStartCmd.Flags().StringVarP(&benchConfig, "config", "c", "config.json", "path to OCI config file, relative to the bundle")
+	benchStartCmd.Flags().StringVar(&benchImage, "image", "", "run the containers from this image")
+	benchStartCmd.Flags().StringVar(&benchCPUProfile, "cpuprofile", "", "write a CPU profile of the runtime to this file")
+	benchStartCmd.Flags().StringVar(&benchMemProfile, "memprofile", "", "write a memory profile of the runtime to this file")
+	benchCmd.AddCommand(benchStartCmd)
+}
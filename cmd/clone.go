@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var cloneCmd = &cobra.Command{
+	Use:   "clone <src-id> <new-id>",
+	Short: "Create a container as a copy of another",
+	Long: `Create a container as a copy of another: from the same bundle, with the same
+options and a copy of its root filesystem as it is now, left created for start
+to run. The copy shares what it can with the source, the image layers of an
+overlay rootfs and the blocks of files on filesystems with reflinks such as
+btrfs. A running source is frozen while it is copied when its cgroup has a
+freezer. Named volumes are shared, not copied.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		c, err := rt.Clone(cmd.Context(), resolveID(args[0]), args[1])
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Contain-ish: Cloned '%v' into '%v', start it with: containish start %v\n", args[0], c.Id, c.Id)
+	},
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"containish/daemon"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	coordinatorListen    string
+	coordinatorTokenFile string
+	coordinatorTLS       daemon.ClusterTLS
+)
+
+var coordinatorCmd = &cobra.Command{
+	Use:   "coordinator",
+	Short: "Schedule containers on the daemons of several hosts",
+	Long: `Serve a coordinator that daemons started with --coordinator register with as
+agents, and that "remote run" schedules containers through. It serves gRPC
+over TLS with --tls-cert, and agents and clients must present a certificate
+of the --tls-ca of the cluster and the token in --token-file, shared by the
+cluster. Agents and tasks are only kept in memory.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		token, err := daemon.ReadClusterToken(coordinatorTokenFile)
+		if err != nil {
+			exitWithError(err)
+		}
+		if err := daemon.RunCoordinator(coordinatorListen, token, coordinatorTLS); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	coordinatorCmd.Flags().StringVar(&coordinatorListen, "listen", daemon.DefaultCoordinatorAddress, "TCP address to serve the coordinator on, e.g. 0.0.0.0:7070 for other hosts")
+	coordinatorCmd.Flags().StringVar(&coordinatorTokenFile, "token-file", daemon.DefaultClusterTokenFile, "file holding the token of the cluster")
+	coordinatorCmd.Flags().StringVar(&coordinatorTLS.CAFile, "tls-ca", daemon.DefaultClusterCAFile, "CA the certificates of agents and clients must be signed by")
+	coordinatorCmd.Flags().StringVar(&coordinatorTLS.CertFile, "tls-cert", daemon.DefaultClusterCertFile, "certificate of the coordinator")
+	coordinatorCmd.Flags().StringVar(&coordinatorTLS.KeyFile, "tls-key", daemon.DefaultClusterKeyFile, "key of the certificate of the coordinator")
+}
@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var restorePattern bool
+
+var coresCmd = &cobra.Command{
+	Use:   "cores <container-id>",
+	Short: "List the core dumps of a container",
+	Long: `List the core dumps captured from the processes of a container run with
+--core-dumps, the last 5, with the signal that killed each process and its
+executable. The cores are in the cores dir of the state dir of the container.
+
+Running a container with --core-dumps makes containish the core_pattern helper
+of the host, which drops the cores of processes outside such containers;
+--restore-pattern puts back the core_pattern it replaced.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if restorePattern {
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if restorePattern {
+			pattern, err := container.RestoreCorePattern()
+			if err != nil {
+				exitWithError(err)
+			}
+			if pattern == "" {
+				fmt.Println("No core_pattern to restore")
+				return
+			}
+			fmt.Printf("Restored core_pattern %s\n", pattern)
+			return
+		}
+		id := resolveID(args[0])
+		cores, err := container.ListCores(id)
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewCoresOutput(id, cores))
+			return
+		}
+
+		dir := container.CoresDir(id)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tPID\tSIGNAL\tEXECUTABLE\tSIZE\tFILE")
+		for _, c := range cores {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", c.Time.Local().Format(time.RFC3339), c.Pid, c.Signal, c.Executable, container.FormatBytes(c.Size), filepath.Join(dir, c.File))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	coresCmd.Flags().BoolVar(&restorePattern, "restore-pattern", false, "put back the core_pattern of the host that --core-dumps replaced")
+	supportsJSON(coresCmd)
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"containish/container"
+	"containish/daemon"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	daemonSocket      string
+	daemonDebug       bool
+	daemonDebugSocket string
+	daemonOptions     daemon.Options
+	daemonStopTimeout int
+	daemonTokenFile   string
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run the containish API daemon",
+	Long: `Run the containish API daemon. Run by systemd at boot, --restore-on-boot and
+--shutdown-containers make it stop the running containers when the host shuts
+down and start them again once it is back, like shutdown-all and restore-all.
+With --coordinator it also runs the containers a coordinator schedules on the
+host, registering as --agent-name, as long as their bundle is under
+--bundle-root.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var debugSocket string
+		if daemonDebug {
+			debugSocket = daemonDebugSocket
+		}
+		daemonOptions.StopTimeout = time.Duration(daemonStopTimeout) * time.Second
+		if daemonOptions.Coordinator != "" {
+			token, err := daemon.ReadClusterToken(daemonTokenFile)
+			if err != nil {
+				exitWithError(err)
+			}
+			daemonOptions.ClusterToken = token
+		}
+		if err := daemon.Run(daemonSocket, debugSocket, daemonOptions); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	daemonCmd.Flags().StringVar(&daemonSocket, "socket", daemon.DefaultSocket, "unix socket to serve the API on")
+	daemonCmd.Flags().BoolVar(&daemonDebug, "debug", false, "serve pprof, expvar and debug dumps on the debug socket")
+	daemonCmd.Flags().StringVar(&daemonDebugSocket, "debug-socket", daemon.DefaultDebugSocket, "unix socket, only accessible to root, to serve the debug endpoints on")
+	daemonCmd.Flags().BoolVar(&daemonOptions.RestoreOnBoot, "restore-on-boot", false, "start again the containers stopped by the last shutdown once serving")
+	daemonCmd.Flags().BoolVar(&daemonOptions.ShutdownContainers, "shutdown-containers", false, "stop every running container when asked to stop, recording them for --restore-on-boot")
+	daemonCmd.Flags().IntVar(&daemonStopTimeout, "stop-timeout", int(container.DefaultStopTimeout/time.Second), "with --shutdown-containers, seconds to wait for each init process to exit before killing it")
+	daemonCmd.Flags().DurationVar(&daemonOptions.HistoryInterval, "history-interval", container.HistoryInterval, "how often to record the usage of running containers for stats --history and recommend, negative to record none")
+	hostname, _ := os.Hostname()
+	daemonCmd.Flags().StringVar(&daemonOptions.Coordinator, "coordinator", "", "address of a coordinator to run containers for, e.g. coordinator:7070")
+	daemonCmd.Flags().StringVar(&daemonOptions.AgentName, "agent-name", hostname, "name to register with the coordinator as")
+	daemonCmd.Flags().StringVar(&daemonTokenFile, "token-file", daemon.DefaultClusterTokenFile, "with --coordinator, file holding the token of the cluster")
+	daemonCmd.Flags().StringVar(&daemonOptions.ClusterTLS.CAFile, "tls-ca", daemon.DefaultClusterCAFile, "with --coordinator, CA the certificate of the coordinator must be signed by")
+	daemonCmd.Flags().StringVar(&daemonOptions.ClusterTLS.CertFile, "tls-cert", daemon.DefaultClusterCertFile, "with --coordinator, certificate to present to the coordinator")
+	daemonCmd.Flags().StringVar(&daemonOptions.ClusterTLS.KeyFile, "tls-key", daemon.DefaultClusterKeyFile, "with --coordinator, key of the certificate to present to the coordinator")
+	daemonCmd.Flags().StringVar(&daemonOptions.BundleRoot, "bundle-root", daemon.DefaultBundleRoot, "with --coordinator, directory the bundles it runs must be under")
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	debugToolbox string
+	debugTty     bool
+)
+
+var debugCmd = &cobra.Command{
+	Use:   "debug [flags] <container-id> [command [args...]]",
+	Short: "Open a shell in a running container's namespaces with tools from the host",
+	Long: `Open a shell in a running container's namespaces with tools from the host.
+
+The shell shares the container's processes, network, hostname and IPC but
+runs on the host root filesystem, or on the directory given with --toolbox.
+The container's filesystem is available as /proc/1/root ($CONTAINER_ROOT).`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		tty := debugTty
+		if !cmd.Flags().Changed("tty") {
+			_, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS)
+			tty = err == nil
+		}
+		id, err := container.ResolveID(args[0])
+		code := 0
+		if err == nil {
+			code, err = container.DebugContainer(cmd.Context(), id, container.DebugOptions{
+				Toolbox: debugToolbox,
+				Args:    args[1:],
+				Tty:     tty,
+			})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(execExitCode(err))
+		}
+		os.Exit(code)
+	},
+}
+
+func init() {
+	debugCmd.Flags().SetInterspersed(false)
+	debugCmd.Flags().StringVar(&debugToolbox, "toolbox", "", "root filesystem providing the tools (default: the host root)")
+	debugCmd.Flags().BoolVarP(&debugTty, "tty", "t", false, "allocate a pseudo terminal (default: when stdin is a terminal)")
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"containish/daemon"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	debugDumpSocket string
+	debugDumpOutput string
+)
+
+var debugDumpCmd = &cobra.Command{
+	Use:   "debug-dump",
+	Short: "Save a snapshot of a daemon running with --debug",
+	Long: `Save a snapshot of a daemon running with --debug: the stacks of its goroutines,
+its expvar variables, including Go memory statistics and API request counts,
+and the containers it knows about, as JSON. Profiles are served by the same
+socket under /debug/pprof/, e.g. for "go tool pprof".`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var w io.Writer = os.Stdout
+		if debugDumpOutput != "" && debugDumpOutput != "-" {
+			f, err := os.OpenFile(debugDumpOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+			if err != nil {
+				exitWithError(err)
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := daemon.FetchDump(cmd.Context(), debugDumpSocket, w); err != nil {
+			exitWithError(err)
+		}
+		if w != os.Stdout {
+			fmt.Fprintf(os.Stderr, "Debug dump saved to %s\n", debugDumpOutput)
+		}
+	},
+}
+
+func init() {
+	debugDumpCmd.Flags().StringVar(&debugDumpSocket, "socket", daemon.DefaultDebugSocket, "debug socket of the daemon")
+	debugDumpCmd.Flags().StringVarP(&debugDumpOutput, "output", "o", "", "file to save the dump to (default stdout)")
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Repair container state left behind by crashes",
+	Long: `Repair container state left behind by crashes: containers recorded as running
+whose init process is gone or was replaced, state dirs without a container,
+mounts left under stopped containers, and veth links and NAT tables nothing
+uses anymore. The daemon does the same when it starts.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		repairs, err := container.Reconcile()
+		if len(repairs) == 0 && err == nil {
+			fmt.Println("Nothing to repair")
+			return
+		}
+		if len(repairs) > 0 {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tNAME\tACTION")
+			for _, r := range repairs {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", r.Kind, r.Name, r.Action)
+			}
+			w.Flush()
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+	},
+}
@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"containish/container"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Exit codes for runtime failures, so scripts can tell them apart.
+const (
+	exitError       = 1
+	exitNotFound    = 3
+	exitNotRunning  = 4
+	exitExists      = 5
+	exitPermission  = 6
+	exitNoResources = 7
+	exitAmbiguous   = 8
+)
+
+// Exit codes of exec, which otherwise exits with the status of the command.
+// They follow the shell conventions also used by docker and podman.
+const (
+	exitExecFailed         = 125
+	exitCommandNotRunnable = 126
+	exitCommandNotFound    = 127
+)
+
+// exitCode maps an error returned by the container package to the exit
+// code of a command.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, container.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, container.ErrNotRunning):
+		return exitNotRunning
+	case errors.Is(err, container.ErrExists):
+		return exitExists
+	case errors.Is(err, container.ErrPermission):
+		return exitPermission
+	case errors.Is(err, container.ErrInsufficientResources):
+		return exitNoResources
+	case errors.Is(err, container.ErrAmbiguous):
+		return exitAmbiguous
+	}
+	return exitError
+}
+
+// execExitCode maps an error starting an exec'd command to the exit code
+// of exec.
+func execExitCode(err error) int {
+	switch {
+	case errors.Is(err, container.ErrCommandNotFound):
+		return exitCommandNotFound
+	case errors.Is(err, container.ErrNotExecutable):
+		return exitCommandNotRunnable
+	}
+	return exitExecFailed
+}
+
+// exitWithError prints err to stderr, keeping stdout to output scripts
+// consume, and exits with the code matching its kind.
+func exitWithError(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(exitCode(err))
+}
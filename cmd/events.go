@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"cmp"
+	"containish/container"
+	"containish/daemon"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	eventsSocket string
+	eventsTypes  []string
+)
+
+var eventsCmd = &cobra.Command{
+	Use:   "events [container-id...]",
+	Short: "Follow the events of containers from the daemon",
+	Long: `Follow the events the daemon sees, the creation, start, health changes, OOM
+kills, stop and deletion of containers, as they happen and until the command
+is interrupted: those of every container, or of the containers given. An id
+no container has yet is followed as given, for a container to be created.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		types := make([]container.EventType, len(eventsTypes))
+		for i, t := range eventsTypes {
+			types[i] = container.EventType(t)
+		}
+		ids := make([]string, len(args))
+		for i, ref := range args {
+			id, err := container.ResolveID(ref)
+			if err != nil && !errors.Is(err, container.ErrNotFound) {
+				exitWithError(err)
+			}
+			ids[i] = cmp.Or(id, ref)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		err := daemon.StreamEvents(ctx, eventsSocket, types, ids, func(ev *container.Event) {
+			if jsonOutput() {
+				enc.Encode(container.NewEventOutput(ev))
+				return
+			}
+			detail := ""
+			switch {
+			case ev.Health != "":
+				detail = ev.Health
+			case ev.Pid != 0:
+				detail = fmt.Sprintf("pid %d", ev.Pid)
+			}
+			fmt.Printf("%s  %-7s  %-20s  %s\n", ev.Time.Format("2006-01-02T15:04:05.000"), ev.Type, ev.Id, detail)
+		})
+		if err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	eventsCmd.Flags().StringVar(&eventsSocket, "socket", daemon.DefaultSocket, "socket of the daemon")
+	eventsCmd.Flags().StringSliceVar(&eventsTypes, "type", nil, "only events of these types (create, start, health_status, oom, stop, delete)")
+	supportsJSON(eventsCmd)
+}
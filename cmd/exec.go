@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	execEnv      []string
+	execEnvFiles []string
+	execUser     string
+	execWorkdir  string
+	execTty      bool
+	execDetach   bool
+)
+
+var execCmd = &cobra.Command{
+	Use:   "exec [flags] <container-id> <command> [args...]",
+	Short: "Run a command in a running container",
+	Long: `Run a command in a running container. execs lists the commands exec'd in
+a container.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		env, err := readEnvFiles(execEnvFiles)
+		if err != nil {
+			exitWithError(err)
+		}
+		// Failing to find the container is a failure of exec like any
+		// other.
+		id, err := container.ResolveID(args[0])
+		var p *container.ExecProcess
+		if err == nil {
+			p, err = container.ExecContainer(cmd.Context(), id, container.ExecOptions{
+				Args:    args[1:],
+				Env:     append(env, execEnv...),
+				User:    execUser,
+				Workdir: execWorkdir,
+				Tty:     execTty,
+				Detach:  execDetach,
+			})
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(execExitCode(err))
+		}
+		if execDetach {
+			fmt.Println(p.ID)
+			return
+		}
+		os.Exit(p.ExitCode)
+	},
+}
+
+var execsCmd = &cobra.Command{
+	Use:   "execs <container-id> [exec-id]",
+	Short: "List the commands exec'd in a container, or show one of them",
+	Long: `List the commands exec'd in a container, with their pid, status, exit code
+and start time, or show the one with exec-id. With --output json, the
+records are printed as JSON: the list, or the record of exec-id.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 2 {
+			p, err := container.LoadExec(resolveID(args[0]), args[1])
+			if err != nil {
+				exitWithError(err)
+			}
+			if jsonOutput() {
+				printJSON(p)
+				return
+			}
+			printExecs([]*container.ExecProcess{p})
+			return
+		}
+		execs, err := container.ListExecs(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			if execs == nil {
+				execs = []*container.ExecProcess{}
+			}
+			printJSON(execs)
+			return
+		}
+		printExecs(execs)
+	},
+}
+
+func printExecs(execs []*container.ExecProcess) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPID\tSTATUS\tEXIT CODE\tSTARTED\tCOMMAND")
+	for _, p := range execs {
+		exit, started := "-", "-"
+		if p.Status == container.ExecExited {
+			exit = fmt.Sprint(p.ExitCode)
+		}
+		if !p.StartedAt.IsZero() {
+			started = p.StartedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", p.ID, p.Pid, p.Status, exit, started, strings.Join(p.Options.Args, " "))
+	}
+	w.Flush()
+}
+
+func init() {
+	// Flags after the container id belong to the command.
+	execCmd.Flags().SetInterspersed(false)
+	execCmd.Flags().StringArrayVarP(&execEnv, "env", "e", nil, "set an environment variable (KEY=VALUE, or KEY to copy it from the caller)")
+	execCmd.Flags().StringArrayVar(&execEnvFiles, "env-file", nil, "read environment variables from a file of KEY=VALUE lines")
+	execCmd.Flags().StringVarP(&execUser, "user", "u", "", "user to run as, <user>[:<group>] by name or id (default root)")
+	execCmd.Flags().StringVarP(&execWorkdir, "workdir", "w", "", "working directory of the command (default /)")
+	execCmd.Flags().BoolVarP(&execTty, "tty", "t", false, "allocate a pseudo terminal")
+	execCmd.Flags().BoolVarP(&execDetach, "detach", "d", false, "run the command in the background and print its exec id")
+	supportsJSON(execsCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestExecArgs(t *testing.T) {
+	// exec has no subcommands: containers named like one and flags before
+	// the container id are parsed as such.
+	for _, args := range [][]string{
+		{"ls", "/bin/true"},
+		{"inspect", "/bin/true"},
+		{"-u", "root", "ls", "web"},
+	} {
+		cmd, rest, err := execCmd.Find(args)
+		if err != nil || cmd != execCmd {
+			t.Errorf("Find(%q) = %s, %v, want exec", args, cmd.Name(), err)
+			continue
+		}
+		if err := cmd.ParseFlags(rest); err != nil {
+			t.Errorf("exec %q: %v", rest, err)
+		}
+	}
+	execUser = ""
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	imagePlatform string
+	imageProgress string
+	prewarmNoPin  bool
+)
+
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manage images",
+}
+
+var imagePullCmd = &cobra.Command{
+	Use:   "pull <image>",
+	Short: "Pull an image from its registry",
+	Long: `Pull an image from its registry, printing its reference and digest.
+With --progress=json, one JSON event per line reports the pull instead, each
+layer with the bytes downloaded of it, as for run.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var progress container.ProgressFunc
+		switch imageProgress {
+		case "plain":
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			progress = func(e container.ProgressEvent) {
+				_ = enc.Encode(e)
+			}
+		default:
+			exitWithError(fmt.Errorf("invalid --progress %q, must be plain or json", imageProgress))
+		}
+		img, err := container.PullImage(cmd.Context(), args[0], platformArch(), progress)
+		if err != nil {
+			exitWithError(err)
+		}
+		if progress == nil {
+			fmt.Printf("%s@%s\n", img.Ref, img.Digest)
+		}
+	},
+}
+
+var imagePushCmd = &cobra.Command{
+	Use:   "push <image> [destination]",
+	Short: "Push an image to a registry",
+	Long: `Push an image of the store to its registry, or as the destination reference.
+Credentials are read from the auth file of the registry settings, by default
+the Docker client's config.json.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var dest string
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		ref, err := container.PushImage(cmd.Context(), args[0], dest)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(ref)
+	},
+}
+
+var imageLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List pulled images",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := container.ListImages()
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "REFERENCE\tID\tPLATFORM\tSIZE\tPINNED")
+		for _, img := range images {
+			id := strings.TrimPrefix(img.ID, "sha256:")
+			fmt.Fprintf(w, "%s\t%.12s\t%s/%s\t%d\t%t\n", img.Ref, id, img.OS, img.Architecture, img.Size, img.Pinned)
+		}
+		w.Flush()
+	},
+}
+
+var imagePrewarmCmd = &cobra.Command{
+	Use:   "prewarm <image>...",
+	Short: "Pull, unpack and pin images ahead of their first container",
+	Long: `Pull the images that aren't in the store yet and unpack them, so the first
+container run from each only mounts or copies its rootfs, and pin them so
+image prune keeps them. Every image is tried; the command fails if one did.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		arch := platformArch()
+		failed := false
+		for _, ref := range args {
+			img, err := container.PrewarmImage(cmd.Context(), ref, arch, !prewarmNoPin)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", ref, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("%s@%s\n", img.Ref, img.Digest)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+var imagePinCmd = &cobra.Command{
+	Use:   "pin <image>...",
+	Short: "Keep images from image prune and image rm",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, ref := range args {
+			if err := container.PinImage(ref, true); err != nil {
+				exitWithError(err)
+			}
+		}
+	},
+}
+
+var imageUnpinCmd = &cobra.Command{
+	Use:   "unpin <image>...",
+	Short: "Let image prune and image rm remove images again",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, ref := range args {
+			if err := container.PinImage(ref, false); err != nil {
+				exitWithError(err)
+			}
+		}
+	},
+}
+
+var imagePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove the images that aren't pinned and no container was created from",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		pruned, err := container.PruneImages()
+		if err != nil {
+			exitWithError(err)
+		}
+		for _, ref := range pruned {
+			fmt.Println(ref)
+		}
+	},
+}
+
+var imageRmCmd = &cobra.Command{
+	Use:   "rm <image>",
+	Short: "Remove an image no container was created from",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := container.RemoveImage(args[0]); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+var imageInspectCmd = &cobra.Command{
+	Use:   "inspect <image>",
+	Short: "Show a pulled image",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		img, err := container.LoadImage(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(img); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+// platformArch returns the architecture of --platform, empty for that of
+// the host.
+func platformArch() string {
+	if imagePlatform == "" {
+		return ""
+	}
+	arch, err := container.ParsePlatform(imagePlatform)
+	if err != nil {
+		exitWithError(err)
+	}
+	return arch
+}
+
+func init() {
+	imagePullCmd.Flags().StringVar(&imagePlatform, "platform", "", "platform to pull, linux/<arch> (default the host's)")
+	imagePullCmd.Flags().StringVar(&imageProgress, "progress", "plain", "progress output: plain or json")
+	imagePrewarmCmd.Flags().StringVar(&imagePlatform, "platform", "", "platform to pull, linux/<arch> (default the host's)")
+	imagePrewarmCmd.Flags().BoolVar(&prewarmNoPin, "no-pin", false, "don't pin the images")
+	imageCmd.AddCommand(imagePullCmd, imagePushCmd, imageLsCmd, imageRmCmd, imageInspectCmd, imagePrewarmCmd, imagePinCmd, imageUnpinCmd, imagePruneCmd)
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <container-id>",
+	Short: "Show the details of a container",
+	Long: `Show the details of a container, with the last results of its health probes
+if it has a health check. Once it has stopped, this includes what it
+consumed over its life: CPU time, peak memory and block I/O.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		c, err := rt.State(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewContainerOutput(c))
+			return
+		}
+
+		fmt.Printf("ID:         %s\n", c.Id)
+		if c.Name != "" {
+			fmt.Printf("Name:       %s\n", c.Name)
+		}
+		fmt.Printf("Status:     %s\n", c.StatusName())
+		fmt.Printf("Created:    %s\n", c.CreatedAt.Format(time.RFC3339))
+		fmt.Printf("Bundle:     %s\n", c.Bundle)
+		if c.MachineID != "" {
+			fmt.Printf("Machine ID: %s\n", c.MachineID)
+		}
+		if o := c.Options; o != nil && o.Isolation != "" {
+			fmt.Printf("Isolation:  %s\n", o.Isolation)
+		}
+		if o := c.Options; o != nil && o.ClonedFrom != "" {
+			fmt.Printf("Cloned:     from %s, rootfs %s\n", o.ClonedFrom, c.Rootfs)
+		}
+		if c.Status != container.Stopped && c.InitNsPid != 0 {
+			fmt.Printf("Pid:        %d (%d in the container)\n", c.InitProcessPiD, c.InitNsPid)
+		} else if c.Status != container.Stopped {
+			fmt.Printf("Pid:        %d\n", c.InitProcessPiD)
+		}
+		if c.PidNamespace != "" {
+			fmt.Printf("PID ns:     %s\n", c.PidNamespace)
+		}
+		if c.ReadyAt != nil {
+			fmt.Printf("Ready:      %s\n", c.ReadyAt.Format(time.RFC3339))
+		}
+		if c.ExitCode != nil && c.FinishedAt != nil {
+			fmt.Printf("Exit code:  %d (finished %s)\n", *c.ExitCode, c.FinishedAt.Format(time.RFC3339))
+		}
+		if o := c.Options; o != nil && (o.Restart.Name != "" || c.RestartCount > 0) {
+			fmt.Printf("Restart:    %s (%d restarts)\n", o.Restart, c.RestartCount)
+		}
+		if l := c.CrashLoop; l != nil {
+			fmt.Printf("Crash loop: since %s, restarting at %s\n", l.Since.Format(time.RFC3339), l.RestartAt.Format(time.RFC3339))
+		}
+		for i, e := range c.Exits {
+			label := ""
+			if i == 0 {
+				label = "Exits:"
+			}
+			oom := ""
+			if e.OOMKilled {
+				oom = ", OOM killed"
+			}
+			fmt.Printf("%-12s%d after %s (finished %s%s)\n", label, e.ExitCode, e.FinishedAt.Sub(e.StartedAt).Round(time.Millisecond), e.FinishedAt.Format(time.RFC3339), oom)
+		}
+		if h := c.Health; h != nil {
+			fmt.Printf("Health:     %s (%d failing)\n", h.Status, h.FailingStreak)
+		}
+		if c.CgroupPath != "" {
+			fmt.Printf("Cgroup:     %s\n", c.CgroupPath)
+		}
+		if c.LogPath != "" {
+			fmt.Printf("Log:        %s\n", c.LogPath)
+		}
+		if q := c.Storage; q != nil {
+			fmt.Printf("Storage:    %d of %d bytes (project %d)\n", q.Used, q.Size, q.Project)
+		}
+		if s := c.Security; s != nil {
+			fmt.Printf("Class:      %s\n", s.Class)
+			fmt.Printf("Masked:     %s\n", pathList(s.MaskedPaths))
+			fmt.Printf("Read-only:  %s\n", pathList(s.ReadonlyPaths))
+			if len(s.WritablePaths) > 0 {
+				fmt.Printf("Writable:   %s\n", pathList(s.WritablePaths))
+			}
+		}
+
+		if u := c.Usage; u != nil {
+			fmt.Println()
+			fmt.Printf("CPU time:   %.2fs (user %.2fs, system %.2fs)\n",
+				float64(u.CPUUsageUsec)/1e6, float64(u.CPUUserUsec)/1e6, float64(u.CPUSystemUsec)/1e6)
+			fmt.Printf("Peak mem:   %d bytes\n", u.MemoryPeak)
+			fmt.Printf("Peak swap:  %d bytes\n", u.SwapPeak)
+			fmt.Printf("Block I/O:  %d bytes read, %d bytes written\n", u.IOReadBytes, u.IOWriteBytes)
+		}
+
+		if len(c.AuxStatus) > 0 {
+			fmt.Println()
+			fmt.Println("Aux processes:")
+			for _, a := range c.AuxStatus {
+				switch {
+				case a.Status == container.ExecRunning:
+					fmt.Printf("  %-12s running, pid %d (%d restarts)\n", a.Name, a.Pid, a.Restarts)
+				case a.Error != "":
+					fmt.Printf("  %-12s failed to start: %s\n", a.Name, a.Error)
+				case a.ExitCode != nil:
+					fmt.Printf("  %-12s exited with code %d (%d restarts)\n", a.Name, *a.ExitCode, a.Restarts)
+				}
+			}
+		}
+
+		if h := c.Health; h != nil && len(h.Log) > 0 {
+			fmt.Println()
+			fmt.Println("Last health probes:")
+			for _, r := range h.Log {
+				fmt.Printf("  %s  exit %d  %v  %s\n", r.Start.Format(time.RFC3339), r.ExitCode, r.End.Sub(r.Start).Round(time.Millisecond), firstLine(r.Output))
+			}
+		}
+	},
+}
+
+func init() {
+	supportsJSON(inspectCmd)
+}
+
+// pathList formats paths, or - for none.
+func pathList(paths []string) string {
+	if len(paths) == 0 {
+		return "-"
+	}
+	return strings.Join(paths, " ")
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// The create, start, state, kill and delete commands follow the OCI
+// runtime command line, so containish can be driven by tools expecting an
+// OCI runtime.
+
+var (
+	bundle        string
+	consoleSocket string
+	pidFile       string
+	deleteForce   bool
+	killSignal    string
+	killFlags     batchFlags
+	deleteFlags   batchFlags
+	// featuresKernel prints the kernel features rather than the OCI ones.
+	featuresKernel bool
+)
+
+var createCmd = &cobra.Command{
+	Use:   "create [flags] <container-id>",
+	Short: "Create a container from a bundle, ready to be started",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New(container.WithCgroupManager(cgroupManager))
+		if err != nil {
+			exitWithError(err)
+		}
+		var opts []container.CreateOption
+		if consoleSocket != "" {
+			opts = append(opts, container.WithConsoleSocket(consoleSocket))
+		}
+		if runStopSignal != "" {
+			opts = append(opts, container.WithDefaultStopSignal(runStopSignal))
+		}
+		if notify {
+			opts = append(opts, container.WithNotify())
+		}
+		if metadata {
+			opts = append(opts, container.WithMetadata())
+		}
+		if strictSpec {
+			opts = append(opts, container.WithStrictSpec())
+		}
+		if privileged {
+			opts = append(opts, container.WithPrivileged())
+		}
+		if securityClass != "" {
+			opts = append(opts, container.WithSecurityClass(securityClass))
+		}
+		if containerName != "" {
+			opts = append(opts, container.WithName(containerName))
+		}
+		if integrity {
+			opts = append(opts, container.WithIntegrity())
+		}
+		if exitFd >= 0 {
+			f, err := container.OpenExitFd(exitFd)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithExitFile(f))
+		}
+		if pidNamespace != "" {
+			id, err := container.ParsePidNamespace(pidNamespace)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithPidContainer(id))
+		}
+		patches, err := readSpecPatches(specPatches)
+		if err != nil {
+			exitWithError(err)
+		}
+		opts = append(opts, patches...)
+		if noNewKeyring {
+			opts = append(opts, container.WithoutNewKeyring())
+		}
+		if force {
+			opts = append(opts, container.WithForce())
+		}
+		c, err := rt.Create(cmd.Context(), args[0], filepath.Join(bundle, "config.json"), opts...)
+		if err != nil {
+			exitWithError(err)
+		}
+		if pidFile != "" {
+			if err := writePidFile(pidFile, c.InitProcessPiD); err != nil {
+				exitWithError(err)
+			}
+		}
+	},
+}
+
+var startCmd = &cobra.Command{
+	Use:   "start <container-id>...",
+	Short: "Start the process of created containers, or run stopped ones again",
+	Long: `Start the process of created containers, or run stopped ones again.
+
+A stopped container runs again detached, from its bundle and with the options
+it was last run with. The containers a container requires, with run --requires
+or the ` + container.AnnotationDependsOn + ` annotation, are started before it if
+they aren't running; containers that don't depend on each other are started in
+parallel.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		ids := make([]string, len(args))
+		for i, ref := range args {
+			ids[i] = resolveID(ref)
+		}
+		results, err := rt.StartOrdered(cmd.Context(), ids)
+		if err != nil {
+			exitWithError(err)
+		}
+		if len(results) == 1 {
+			if err := results[0].Err; err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		reportResults(results)
+	},
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state <container-id>",
+	Short: "Print the OCI state of a container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		c, err := rt.State(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		data, err := json.MarshalIndent(c.OCIState(), "", "  ")
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(string(data))
+	},
+}
+
+var featuresCmd = &cobra.Command{
+	Use:   "features",
+	Short: "Print the OCI features document of the runtime",
+	Long: `Print what of the runtime spec containish implements, in the format of the
+OCI features document: the namespaces, mount options, capabilities and seccomp
+actions it supports, and in the containish.resources annotation the
+linux.resources settings it applies. A spec setting anything else is run with
+a warning that it is ignored, or rejected with --strict-spec.
+
+With --kernel it prints instead what the kernel of the host supports of what
+containers use, as probed: the cgroup v2 controllers, overlayfs and overlayfs
+in user namespaces, idmapped mounts, time namespaces and seccomp user
+notification.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var doc any = container.Features()
+		if featuresKernel {
+			doc = container.Kernel()
+		}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(string(data))
+	},
+}
+
+var killCmd = &cobra.Command{
+	Use:   "kill [flags] <container-id>... [signal]",
+	Short: "Send a signal to the init process of containers (default SIGTERM)",
+	Long: `Send a signal to the init process of containers (default SIGTERM).
+
+As with other OCI runtimes, the signal may follow a single container id or
+--all; two arguments that aren't an id and a signal are two ids. With
+several ids it is given with --signal instead.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		args, sig, err := killArgs(args, killSignal, killFlags.all)
+		if err != nil {
+			exitWithError(err)
+		}
+		ids, err := killFlags.targets(args, container.Running, container.Starting, container.Created)
+		if err != nil {
+			exitWithError(err)
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		runBatch(ids, func(id string) error {
+			return rt.Kill(cmd.Context(), id, sig)
+		})
+	},
+}
+
+// killArgs splits the arguments of kill into the container ids and the
+// signal, given with --signal as signal, or else after a single id or
+// --all if it parses as one.
+func killArgs(args []string, signal string, all bool) ([]string, unix.Signal, error) {
+	if signal != "" {
+		sig, err := container.ParseSignal(signal)
+		return args, sig, err
+	}
+	if n := len(args); n == 2 && !all || n == 1 && all {
+		sig, err := container.ParseSignal(args[n-1])
+		if err == nil {
+			return args[:n-1], sig, nil
+		}
+		if all {
+			// no ids go with --all
+			return nil, 0, err
+		}
+	}
+	return args, unix.SIGTERM, nil
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete [flags] <container-id>...",
+	Short: "Delete containers that aren't running",
+	Run: func(cmd *cobra.Command, args []string) {
+		statuses := []container.Status{container.Stopped}
+		if deleteForce {
+			statuses = nil
+		}
+		ids, err := deleteFlags.targets(args, statuses...)
+		if err != nil {
+			exitWithError(err)
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		runBatch(ids, func(id string) error {
+			if deleteForce {
+				if c, err := rt.State(id); err == nil && (c.Status == container.Running || c.Status == container.Starting) {
+					if err := rt.Stop(cmd.Context(), id, container.WithStopTimeout(0)); err != nil {
+						return err
+					}
+				}
+			}
+			return rt.Delete(id)
+		})
+	},
+}
+
+// writePidFile writes pid to path atomically, as tools polling for the
+// file expect it complete once it appears.
+func writePidFile(path string, pid int) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(pid)), 0o644); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	createCmd.Flags().StringVarP(&bundle, "bundle", "b", ".", "path to the bundle directory holding config.json")
+	createCmd.Flags().StringVar(&consoleSocket, "console-socket", "", "unix socket receiving the master of the container's pseudo terminal")
+	createCmd.Flags().StringVar(&pidFile, "pid-file", "", "file to write the container init process id to")
+	createCmd.Flags().StringVar(&runStopSignal, "stop-signal", "", "signal stop sends the init process first (default the "+container.AnnotationStopSignal+" annotation, or SIGTERM)")
+	createCmd.Flags().BoolVar(&notify, "notify", false, "mount a notify socket at $NOTIFY_SOCKET and keep the container starting until its workload sends READY=1 to it")
+	createCmd.Flags().BoolVar(&metadata, "metadata", false, "serve the metadata of the container, its id, labels, limits and network, over HTTP on a unix socket at /run/containish/metadata.sock in it")
+	createCmd.Flags().IntVar(&exitFd, "exit-fd", -1, "file descriptor, such as a pipe, the monitor of the container writes the exit code of its process to, a line each time it exits")
+	createCmd.Flags().StringVar(&pidNamespace, "pid", "", "join the pid namespace of another container, container:<id>, whose processes it then sees and which it dies with")
+	createCmd.Flags().StringArrayVar(&specPatches, "spec-patch", nil, "apply a JSON merge patch (object) or JSON patch (array of operations) file to the spec, in the order given")
+	createCmd.Flags().BoolVar(&noNewKeyring, "no-new-keyring", false, "keep the container process in the session keyring of the runtime rather than creating one for it")
+	createCmd.Flags().BoolVar(&force, "force", false, "create the container even if the host lacks the memory or CPUs of its limits, given what other containers reserve")
+	createCmd.Flags().BoolVar(&privileged, "privileged", false, "run the container with every capability, no seccomp filter, /proc and /sys unmasked, /sys read-write and the devices of the host")
+	createCmd.Flags().BoolVar(&integrity, "integrity", false, "record a hash manifest of the image when the container is created, which verify checks its rootfs against")
+	createCmd.Flags().StringVar(&containerName, "name", "", "a name to refer to the container by in place of its id, unique among containers")
+	createCmd.Flags().StringVar(&securityClass, "security-class", "", "the class deciding what the container sees of /proc and /sys, default or hardened")
+	createCmd.Flags().BoolVar(&strictSpec, "strict-spec", false, "fail if the spec sets what the runtime doesn't support, see features, rather than warn that it is ignored")
+	createCmd.Flags().StringVar(&cgroupManager, "cgroup-manager", container.CgroupfsManager, "cgroup manager to use (cgroupfs or systemd)")
+	deleteCmd.Flags().BoolVarP(&deleteForce, "force", "f", false, "kill running containers first")
+	deleteFlags.register(deleteCmd, "delete every stopped container, or with --force every container")
+	featuresCmd.Flags().BoolVar(&featuresKernel, "kernel", false, "print what the kernel of the host supports of what containers use")
+	killCmd.Flags().StringVarP(&killSignal, "signal", "s", "", "signal to send, by name or number")
+	killFlags.register(killCmd, "signal every running or created container")
+	// They print JSON anyway, in the formats of the OCI.
+	supportsJSON(stateCmd)
+	supportsJSON(featuresCmd)
+}
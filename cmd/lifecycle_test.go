@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestKillArgs(t *testing.T) {
+	for _, tc := range []struct {
+		args   []string
+		signal string
+		all    bool
+		ids    []string
+		sig    unix.Signal
+	}{
+		{[]string{"web"}, "", false, []string{"web"}, unix.SIGTERM},
+		{[]string{"web", "KILL"}, "", false, []string{"web"}, unix.SIGKILL},
+		{[]string{"web", "9"}, "", false, []string{"web"}, unix.SIGKILL},
+		{[]string{"web", "db"}, "", false, []string{"web", "db"}, unix.SIGTERM},
+		{[]string{"web", "db", "cache"}, "", false, []string{"web", "db", "cache"}, unix.SIGTERM},
+		{[]string{"web", "db"}, "HUP", false, []string{"web", "db"}, unix.SIGHUP},
+		{[]string{"SIGINT"}, "", true, []string{}, unix.SIGINT},
+		{nil, "", true, nil, unix.SIGTERM},
+	} {
+		ids, sig, err := killArgs(tc.args, tc.signal, tc.all)
+		if err != nil || !slices.Equal(ids, tc.ids) || sig != tc.sig {
+			t.Errorf("killArgs(%q, %q, %v) = %q, %v, %v, want %q, %v", tc.args, tc.signal, tc.all, ids, sig, err, tc.ids, tc.sig)
+		}
+	}
+	if _, _, err := killArgs([]string{"web"}, "BOGUS", false); err == nil {
+		t.Error("expected an invalid --signal to be rejected")
+	}
+	if _, _, err := killArgs([]string{"db"}, "", true); err == nil {
+		t.Error("expected an invalid signal after --all to be rejected")
+	}
+}
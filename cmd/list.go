@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"cmp"
+	"containish/container"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var listStatus []string
+
+var listCmd = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls", "ps"},
+	Short:   "List containers",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var filter container.StateFilter
+		for _, name := range listStatus {
+			st, err := container.ParseStatus(name)
+			if err != nil {
+				exitWithError(err)
+			}
+			filter.Status = append(filter.Status, st)
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		containers, err := rt.Find(filter)
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewContainerListOutput(containers))
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSTATUS\tPID\tCREATED\tBUNDLE")
+		for _, c := range containers {
+			pid := "-"
+			if c.Status != container.Stopped {
+				pid = fmt.Sprint(c.InitProcessPiD)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Id, cmp.Or(c.Name, "-"), c.StatusName(), pid, c.CreatedAt.Format(time.RFC3339), c.Bundle)
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	listCmd.Flags().StringSliceVar(&listStatus, "status", nil, "only containers with one of these statuses (created, running, stopped)")
+	supportsJSON(listCmd)
+}
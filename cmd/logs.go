@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"containish/container"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	followLogs    bool
+	logTimestamps bool
+	logSince      string
+	logTail       int
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <container-id>",
+	Short: "Print the output of a detached container",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		opts := container.LogOptions{Follow: followLogs, Timestamps: logTimestamps, Tail: logTail}
+		if logSince != "" {
+			since, err := container.ParseLogSince(logSince, time.Now())
+			if err != nil {
+				exitWithError(err)
+			}
+			opts.Since = since
+		}
+		if err := container.ReadLogs(resolveID(args[0]), opts, os.Stdout, os.Stderr); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&followLogs, "follow", "f", false, "keep printing new output until the container stops")
+	logsCmd.Flags().BoolVarP(&logTimestamps, "timestamps", "t", false, "prefix each line with the time it was logged")
+	logsCmd.Flags().StringVar(&logSince, "since", "", "only print lines logged after an RFC 3339 time or a duration ago, e.g. 10m")
+	logsCmd.Flags().IntVarP(&logTail, "tail", "n", -1, "only print the last N lines logged so far (-1 for all)")
+}
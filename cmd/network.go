@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	networkSubnet  string
+	networkGateway string
+	diagnoseName   string
+	diagnoseJSON   bool
+)
+
+var networkCmd = &cobra.Command{
+	Use:   "network",
+	Short: "Manage bridge networks",
+}
+
+var networkCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a bridge network",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := container.CreateNetwork(args[0], networkSubnet, networkGateway)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(n.Name)
+	},
+}
+
+var networkLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List networks",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		networks, err := container.ListNetworks()
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tSUBNET\tGATEWAY\tBRIDGE")
+		for _, n := range networks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", n.Name, n.Subnet, n.Gateway, n.Bridge)
+		}
+		w.Flush()
+	},
+}
+
+var networkRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a network with no running containers",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := container.RemoveNetwork(args[0]); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+var networkInspectCmd = &cobra.Command{
+	Use:   "inspect <name>",
+	Short: "Show a network, the containers attached to it and its address leases",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := container.LoadNetwork(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		attached, err := container.NetworkContainers(n.Name)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		leases, err := container.NetworkLeases(n.Name)
+		if err != nil {
+			exitWithError(err)
+		}
+
+		containers := map[string]string{}
+		for _, c := range attached {
+			containers[c.Id] = c.Network.Address
+		}
+		// Leases of stopped containers keep their addresses for them.
+		leased := map[string]string{}
+		for _, l := range leases {
+			leased[l.Address] = l.Container
+		}
+		out := struct {
+			*container.Network
+			Containers map[string]string `json:"containers"`
+			Leases     map[string]string `json:"leases"`
+		}{n, containers, leased}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+var networkDiagnoseCmd = &cobra.Command{
+	Use:   "diagnose <container-id>",
+	Short: "Check the network of a running container",
+	Long: `Check the network of a running container from inside its network namespace:
+the state of its links, its address and default route, whether its gateway
+answers pings and its nameservers resolve a name, and from the host whether
+the TCP ports its image exposes accept connections. Exits with 1 if a check
+failed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d, err := container.DiagnoseNetwork(cmd.Context(), resolveID(args[0]), diagnoseName)
+		if err != nil {
+			exitWithError(err)
+		}
+		if diagnoseJSON || jsonOutput() {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(d); err != nil {
+				exitWithError(err)
+			}
+		} else {
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "CHECK\tSTATUS\tDETAIL")
+			for _, c := range d.Checks {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", c.Name, c.Status, c.Detail)
+			}
+			w.Flush()
+		}
+		if d.Failed() {
+			os.Exit(exitError)
+		}
+	},
+}
+
+func init() {
+	networkDiagnoseCmd.Flags().StringVar(&diagnoseName, "resolve", "", "name the DNS check resolves (default the container id on bridge networks, example.com on others)")
+	networkDiagnoseCmd.Flags().BoolVar(&diagnoseJSON, "json", false, "print the report as JSON, as --output json does")
+	supportsJSON(networkDiagnoseCmd)
+	networkCreateCmd.Flags().StringVar(&networkSubnet, "subnet", "", "subnet in CIDR notation (default: a free 10.89.x.0/24)")
+	networkCreateCmd.Flags().StringVar(&networkGateway, "gateway", "", "gateway address (default: first address of the subnet)")
+	networkCmd.AddCommand(networkCreateCmd, networkLsCmd, networkRmCmd, networkInspectCmd, networkDiagnoseCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// The global --output flag selects between the text meant for people and
+// the JSON of the types of container/output.go, meant for tools. Commands
+// able to print JSON say so with the outputAnnotation, so that the flag is
+// rejected by the others rather than ignored.
+
+// Output formats.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputAnnotation marks the commands supporting --output json.
+const outputAnnotation = "containish.output"
+
+var outputFormat string
+
+// supportsJSON marks cmd as supporting --output json.
+func supportsJSON(cmd *cobra.Command) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[outputAnnotation] = outputJSON
+}
+
+// checkOutput validates --output for cmd.
+func checkOutput(cmd *cobra.Command) error {
+	switch outputFormat {
+	case outputText:
+		return nil
+	case outputJSON:
+		if cmd.Annotations[outputAnnotation] != outputJSON {
+			return fmt.Errorf("%s doesn't support --output %s", cmd.CommandPath(), outputJSON)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid --output %q, must be %s or %s", outputFormat, outputText, outputJSON)
+}
+
+// jsonOutput reports whether the command prints JSON.
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+// printJSON prints v as a JSON document.
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		exitWithError(err)
+	}
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var preset container.Preset
+
+var presetCmd = &cobra.Command{
+	Use:   "preset",
+	Short: "Manage run presets",
+	Long: `Manage run presets, named run configurations containers are run from with
+run --preset <name> <container-id>. Flags given to run override those of the
+preset.`,
+}
+
+var presetCreateCmd = &cobra.Command{
+	Use:   "create [flags] <name>",
+	Short: "Save a run configuration as a preset",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p := preset
+		p.Name = args[0]
+		bundle, err := filepath.Abs(p.Bundle)
+		if err != nil {
+			exitWithError(err)
+		}
+		p.Bundle = bundle
+		if err := container.CreatePreset(&p); err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(p.Name)
+	},
+}
+
+var presetLsCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List presets",
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		presets, err := container.ListPresets()
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tBUNDLE\tNETWORK\tMEMORY\tCPUS")
+		for _, p := range presets {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Name, p.Bundle, orDash(p.Network), orDash(p.Memory), orDash(p.CPUs))
+		}
+		w.Flush()
+	},
+}
+
+var presetRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a preset",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := container.RemovePreset(args[0]); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+var presetInspectCmd = &cobra.Command{
+	Use:   "inspect <name>",
+	Short: "Show a preset",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		p, err := container.LoadPreset(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(p); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+// applyPreset sets the run flags of cmd that weren't given on the command
+// line to the values of the named preset.
+func applyPreset(cmd *cobra.Command, name string) error {
+	p, err := container.LoadPreset(name)
+	if err != nil {
+		return err
+	}
+	var detached []string
+	if p.Detach {
+		detached = []string{"true"}
+	}
+	flags := []struct {
+		name   string
+		values []string
+	}{
+		{"bundle", []string{p.Bundle}},
+		{"config", nonEmpty(p.Config)},
+		{"volume", p.Volumes},
+		{"tmpfs", p.Tmpfs},
+		{"env", p.Env},
+		{"memory", nonEmpty(p.Memory)},
+		{"cpus", nonEmpty(p.CPUs)},
+		{"storage-size", nonEmpty(p.StorageSize)},
+		{"network", nonEmpty(p.Network)},
+		{"detach", detached},
+		{"restart", nonEmpty(p.Restart)},
+	}
+	for _, f := range flags {
+		if cmd.Flags().Changed(f.name) {
+			continue
+		}
+		for _, v := range f.values {
+			if err := cmd.Flags().Set(f.name, v); err != nil {
+				return fmt.Errorf("invalid %s of preset %s: %w", f.name, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func nonEmpty(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func init() {
+	f := presetCreateCmd.Flags()
+	f.StringVarP(&preset.Bundle, "bundle", "b", ".", "path to the bundle directory containers are created from")
+	f.StringVarP(&preset.Config, "config", "c", "", "path to the OCI config file, relative to the bundle (default config.json)")
+	f.StringArrayVarP(&preset.Volumes, "volume", "v", nil, "mount a named volume, <name>:<path>[:ro]")
+	f.StringArrayVar(&preset.Tmpfs, "tmpfs", nil, "mount a tmpfs, <path>[:<options>]")
+	f.StringArrayVarP(&preset.Env, "env", "e", nil, "set an environment variable of the container process, KEY=VALUE")
+	f.StringVar(&preset.Memory, "memory", "", "limit the memory of the container, e.g. 512m")
+	f.StringVar(&preset.CPUs, "cpus", "", "limit the CPU time of the container to a number of CPUs, e.g. 1.5")
+	f.StringVar(&preset.StorageSize, "storage-size", "", "limit the space the container can use in its rootfs, e.g. 1g")
+	f.StringVar(&preset.Network, "network", "", "network mode, as for run")
+	f.BoolVarP(&preset.Detach, "detach", "d", false, "run containers in background")
+	f.StringVar(&preset.Restart, "restart", "", "restart policy of detached containers, no, on-failure[:<max retries>] or always")
+	presetCmd.AddCommand(presetCreateCmd, presetLsCmd, presetRmCmd, presetInspectCmd)
+}
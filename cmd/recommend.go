@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var recommendCmd = &cobra.Command{
+	Use:   "recommend <container-id>",
+	Short: "Suggest memory and CPU limits from the usage history of a container",
+	Long: `Suggest memory and CPU limits for a container from the usage the daemon
+recorded, see stats --history: the 95th percentile of the memory it used and of
+the CPUs it used between samples, plus 25% of headroom. The limits the
+container runs with, if any, are shown alongside.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := container.Recommend(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewRecommendationOutput(r))
+			return
+		}
+
+		fmt.Printf("Based on %d samples from %s to %s\n\n", r.Samples,
+			r.Since.Local().Format(time.DateTime), r.Until.Local().Format(time.DateTime))
+		memoryLimit, cpusLimit := "-", "-"
+		if r.CurrentMemory > 0 {
+			memoryLimit = container.FormatBytes(r.CurrentMemory)
+		}
+		if r.CurrentCPUs > 0 {
+			cpusLimit = fmt.Sprintf("%.2f", r.CurrentCPUs)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "\tP95\tPEAK\tLIMIT\tRECOMMENDED")
+		fmt.Fprintf(w, "memory\t%s\t%s\t%s\t%s\n", container.FormatBytes(int64(r.MemoryP95)),
+			container.FormatBytes(int64(r.MemoryPeak)), memoryLimit, container.FormatBytes(r.Memory))
+		fmt.Fprintf(w, "cpus\t%.2f\t%.2f\t%s\t%.2f\n", r.CPUsP95, r.CPUsPeak, cpusLimit, r.CPUs)
+		w.Flush()
+		fmt.Printf("\nRun with --memory %dm --cpus %s\n", r.Memory>>20, strconv.FormatFloat(r.CPUs, 'f', -1, 64))
+	},
+}
+
+func init() {
+	supportsJSON(recommendCmd)
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"containish/container"
+	"containish/daemon"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	remoteCoordinator string
+	remoteTokenFile   string
+	remoteTLS         daemon.ClusterTLS
+	remoteHost        string
+	remoteBundle      string
+	remoteImage       string
+	remoteEnv         []string
+	remoteMemory      string
+	remoteCPUs        string
+	remoteForce       bool
+	remoteWait        time.Duration
+)
+
+var remoteCmd = &cobra.Command{
+	Use:   "remote",
+	Short: "Run containers on the hosts of a coordinator",
+}
+
+var remoteRunCmd = &cobra.Command{
+	Use:   "run [flags] <container-id>",
+	Short: "Run a detached container on a host of the cluster",
+	Long: `Run a detached container on a host of the cluster, as "run --detach" would on
+it: on the host given with --host, or else on the one running the fewest
+containers. The bundle is a directory on that host, under the bundle root of
+its daemon. Waits for the container
+to run, up to --wait, then prints the host it runs on.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := daemon.RunRequest{Host: remoteHost, ID: args[0], Image: remoteImage, Force: remoteForce}
+		if remoteBundle != "" {
+			if !filepath.IsAbs(remoteBundle) {
+				exitWithError(fmt.Errorf("--bundle %q must be an absolute path on the host", remoteBundle))
+			}
+			req.Bundle = remoteBundle
+		}
+		if req.Bundle == "" && req.Image == "" {
+			exitWithError(fmt.Errorf("a --bundle or an --image is required"))
+		}
+		if remoteImage != "" {
+			if _, err := container.ParseImageRef(remoteImage); err != nil {
+				exitWithError(err)
+			}
+		}
+		for _, e := range remoteEnv {
+			if _, err := container.ParseEnv(e); err != nil {
+				exitWithError(err)
+			}
+		}
+		req.Env = remoteEnv
+		var err error
+		if remoteMemory != "" {
+			if req.Memory, err = container.ParseMemory(remoteMemory); err != nil {
+				exitWithError(err)
+			}
+		}
+		if remoteCPUs != "" {
+			if req.CPUs, err = container.ParseCPUs(remoteCPUs); err != nil {
+				exitWithError(err)
+			}
+		}
+
+		client := clusterClient()
+		task, err := client.Run(cmd.Context(), req, remoteWait)
+		if err != nil {
+			exitWithError(err)
+		}
+		switch task.Status {
+		case daemon.TaskDone:
+			fmt.Printf("%s running on %s\n", task.Run.ID, task.Host)
+		case daemon.TaskFailed:
+			exitWithError(fmt.Errorf("%s failed on %s: %s", task.Run.ID, task.Host, task.Error))
+		default:
+			exitWithError(fmt.Errorf("%s is still %s on %s after %v", task.Run.ID, task.Status, task.Host, remoteWait))
+		}
+	},
+}
+
+var remoteHostsCmd = &cobra.Command{
+	Use:   "hosts",
+	Short: "List the hosts registered with the coordinator",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		agents, err := clusterClient().Agents(cmd.Context())
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tRUNNING\tLAST SEEN\tSTATUS")
+		for _, a := range agents {
+			status := "ready"
+			if a.Lost {
+				status = "lost"
+			}
+			seen := time.Since(a.LastSeen).Round(time.Second)
+			fmt.Fprintf(w, "%s\t%d\t%v ago\t%s\n", a.Name, a.Running, seen, status)
+		}
+		w.Flush()
+	},
+}
+
+// clusterClient returns the client of the coordinator given by the remote
+// flags.
+func clusterClient() *daemon.ClusterClient {
+	if remoteCoordinator == "" {
+		exitWithError(fmt.Errorf("--coordinator is required"))
+	}
+	token, err := daemon.ReadClusterToken(remoteTokenFile)
+	if err != nil {
+		exitWithError(err)
+	}
+	client, err := daemon.NewClusterClient(remoteCoordinator, token, remoteTLS)
+	if err != nil {
+		exitWithError(err)
+	}
+	return client
+}
+
+func init() {
+	remoteCmd.PersistentFlags().StringVar(&remoteCoordinator, "coordinator", os.Getenv("CONTAINISH_COORDINATOR"), "address of the coordinator, e.g. coordinator:7070 (default $CONTAINISH_COORDINATOR)")
+	remoteCmd.PersistentFlags().StringVar(&remoteTokenFile, "token-file", daemon.DefaultClusterTokenFile, "file holding the token of the cluster")
+	remoteCmd.PersistentFlags().StringVar(&remoteTLS.CAFile, "tls-ca", daemon.DefaultClusterCAFile, "CA the certificate of the coordinator must be signed by")
+	remoteCmd.PersistentFlags().StringVar(&remoteTLS.CertFile, "tls-cert", daemon.DefaultClusterCertFile, "certificate to present to the coordinator")
+	remoteCmd.PersistentFlags().StringVar(&remoteTLS.KeyFile, "tls-key", daemon.DefaultClusterKeyFile, "key of the certificate to present to the coordinator")
+	remoteRunCmd.Flags().StringVar(&remoteHost, "host", "", "run the container on this host (default: the one running the fewest containers)")
+	remoteRunCmd.Flags().StringVarP(&remoteBundle, "bundle", "b", "", "absolute path to the bundle directory on the host")
+	remoteRunCmd.Flags().StringVar(&remoteImage, "image", "", "run the container from an image, pulled on the host unless it was already")
+	remoteRunCmd.Flags().StringArrayVarP(&remoteEnv, "env", "e", nil, "set an environment variable KEY=VALUE in the container")
+	remoteRunCmd.Flags().StringVar(&remoteMemory, "memory", "", "limit the memory of the container, e.g. 512m")
+	remoteRunCmd.Flags().StringVar(&remoteCPUs, "cpus", "", "limit the CPU time of the container to a number of CPUs, e.g. 1.5")
+	remoteRunCmd.Flags().BoolVar(&remoteForce, "force", false, "run the container even if the host lacks the memory or CPUs of its limits")
+	remoteRunCmd.Flags().DurationVar(&remoteWait, "wait", time.Minute, "how long to wait for the container to run")
+	remoteCmd.AddCommand(remoteRunCmd, remoteHostsCmd)
+}
@@ -0,0 +1,17 @@
+package cmd
+
+import "containish/container"
+
+// Commands take containers by id, name or unambiguous id prefix, see
+// container.ResolveID: those taking one resolve it with resolveID, and
+// runBatch resolves each of those it works on.
+
+// resolveID returns the id of the container ref refers to, exiting on
+// failure.
+func resolveID(ref string) string {
+	id, err := container.ResolveID(ref)
+	if err != nil {
+		exitWithError(err)
+	}
+	return id
+}
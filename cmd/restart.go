@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var restartTimeout int
+
+var restartCmd = &cobra.Command{
+	Use:   "restart [flags] <container-id>",
+	Short: "Stop a container and start it again",
+	Long: `Stop a container like stop, then run it again detached, from its bundle and
+with the options it was last run with. A stopped container is only started.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if restartTimeout < 0 {
+			exitWithError(fmt.Errorf("invalid --time %d", restartTimeout))
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Printf("Contain-ish: Restarting '%v'\n", args[0])
+		if err := rt.Restart(cmd.Context(), resolveID(args[0]), container.WithStopTimeout(time.Duration(restartTimeout)*time.Second)); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	restartCmd.Flags().IntVarP(&restartTimeout, "time", "t", int(container.DefaultStopTimeout/time.Second), "seconds to wait for the init process to exit before killing it")
+}
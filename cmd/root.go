@@ -1,16 +1,52 @@
 package cmd
 
 import (
+	"containish/container"
 	"fmt"
 	"os"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	stateStore string
+	rootDir    string
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "containish",
 	Short: "Contain-ish is a naive containerization system",
 	Long:  `Contain-ish is a simplistic containerization system built for educational purposes.`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := checkOutput(cmd); err != nil {
+			return err
+		}
+		// Flags win over the environment, which wins over the files:
+		// the user's own, then the host-wide one.
+		cfg, err := container.LoadConfigFiles(container.ConfigPaths()...)
+		if err != nil {
+			return err
+		}
+		if root := os.Getenv(container.RootEnv); root != "" {
+			cfg.StateDir = root
+		}
+		if rootDir != "" {
+			cfg.StateDir = rootDir
+		}
+		if err := container.Configure(cfg); err != nil {
+			return err
+		}
+
+		if stateStore == "" {
+			return nil
+		}
+		s, err := container.OpenStateStore(stateStore)
+		if err != nil {
+			return err
+		}
+		container.SetStateStore(s)
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Contain-ish: A naive containerization system. Use 'containish --help' for more information.")
 	},
@@ -19,10 +55,52 @@ var rootCmd = &cobra.Command{
 // Execute runs the root command and adds child commands
 func Execute() {
 	rootCmd.AddCommand(runCmd)
+	rootCmd.AddCommand(runBatchCmd)
 	rootCmd.AddCommand(stopCmd)
+	rootCmd.AddCommand(shutdownAllCmd)
+	rootCmd.AddCommand(restoreAllCmd)
+	rootCmd.AddCommand(daemonCmd)
+	rootCmd.AddCommand(coordinatorCmd)
+	rootCmd.AddCommand(remoteCmd)
+	rootCmd.AddCommand(debugDumpCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(recommendCmd)
+	rootCmd.AddCommand(traceCmd)
+	rootCmd.AddCommand(coresCmd)
+	rootCmd.AddCommand(eventsCmd)
+	rootCmd.AddCommand(uiCmd)
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(networkCmd)
+	rootCmd.AddCommand(volumeCmd)
+	rootCmd.AddCommand(presetCmd)
+	rootCmd.AddCommand(imageCmd)
+	rootCmd.AddCommand(snapshotCmd)
+	rootCmd.AddCommand(storageCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(logsCmd)
+	rootCmd.AddCommand(execCmd)
+	rootCmd.AddCommand(execsCmd)
+	rootCmd.AddCommand(debugCmd)
+	rootCmd.AddCommand(createCmd)
+	rootCmd.AddCommand(startCmd)
+	rootCmd.AddCommand(restartCmd)
+	rootCmd.AddCommand(cloneCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(stateCmd)
+	rootCmd.AddCommand(featuresCmd)
+	rootCmd.AddCommand(killCmd)
+	rootCmd.AddCommand(deleteCmd)
+	rootCmd.AddCommand(waitCmd)
+
+	rootCmd.PersistentFlags().StringVar(&rootDir, "root", "", "directory holding the state of containers (default $"+container.RootEnv+", state_dir in the configuration, or /run/miniruntime)")
+	rootCmd.PersistentFlags().StringVar(&rootDir, "state-dir", "", "alias for --root")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputText, "output format, text or json (versioned documents for tools, on the commands supporting it)")
+	rootCmd.PersistentFlags().StringVar(&stateStore, "state-store", "", "container state backend, dir or bolt (default $"+container.StateStoreEnv+", or dir)")
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
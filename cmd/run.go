@@ -2,33 +2,631 @@ package cmd
 
 import (
 	"containish/container"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	configPath string
-	detach     bool
+	configPath    string
+	detach        bool
+	cgroupManager string
+	network       string
+	ipAddress     string
+	gateway       string
+	egress        string
+	egressAllow   []string
+	volumes       []string
+	tmpfs         []string
+	secrets       []string
+	logOpts       []string
+	logDriver     string
+	trace         string
+	coreDumps     bool
+	dryRun        bool
+	runStopSignal string
+	quiet         bool
+	progress      string
+	storageSize   string
+	devices       []string
+	gpus          string
+	platform      string
+	copyEmulator  bool
+	restart       string
+	health        container.HealthCheck
+	healthCmd     string
+	healthAction  string
+	runRequires   []string
+	requiresCond  string
+	requiresWait  time.Duration
+	envs          []string
+	envFiles      []string
+	specPatches   []string
+	cidFile       string
+	memory        string
+	memorySwap    string
+	cpus          string
+	presetName    string
+	image         string
+	entrypoint    string
+	workdir       string
+	user          string
+	notify        bool
+	metadata      bool
+	pidNamespace  string
+	noNewKeyring  bool
+	force         bool
+	timezone      string
+	hostLocale    bool
+	monotonicOff  time.Duration
+	fakeDate      string
+	noRTC         bool
+	rootfsFlag    string
+	runtimeName   string
+	isolation     string
+	osRelease     bool
+	exitFd        int
+	strictSpec    bool
+	privileged    bool
+	securityClass string
+	containerName string
+	integrity     bool
 )
 
 var runCmd = &cobra.Command{
-	Use:   "run <container-id>",
+	Use:   "run [flags] <container-id> [image [command...]]",
 	Short: "Run a command inside a new container",
-	Args:  cobra.ExactArgs(1),
+	Long: `Run a command inside a new container, from the bundle or from an image.
+
+An image, given with --image or after the container id, is pulled unless it
+was already. Its config gives the process of the container when the bundle
+has no config.json, with the command given after the image, --entrypoint,
+--workdir, --user and --env overriding its settings as with docker run. Give
+a command with flags of its own after --.`,
+	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		id := args[0]
-		fmt.Printf("Contain-ish: Running '%v' inside a container.\n", id)
+		id, command := args[0], args[1:]
+		if image == "" && len(command) > 0 {
+			image, command = command[0], command[1:]
+		}
+		if presetName != "" {
+			if err := applyPreset(cmd, presetName); err != nil {
+				exitWithError(err)
+			}
+		}
+		if progress != "plain" && progress != "json" {
+			exitWithError(fmt.Errorf("invalid --progress %q, must be plain or json", progress))
+		}
+		if progress == "json" && jsonOutput() || dryRun && jsonOutput() {
+			exitWithError(fmt.Errorf("--output json can't be combined with --progress json or --dry-run"))
+		}
+		// JSON progress or output takes the place of the runtime messages
+		// on stdout, and a detached run prints only the container id there.
+		if progress == "json" || jsonOutput() || detach && !dryRun {
+			quiet = true
+		}
+		if cidFile != "" && !dryRun {
+			if _, err := os.Lstat(cidFile); err == nil {
+				exitWithError(fmt.Errorf("container id file %s exists, remove it or give another", cidFile))
+			}
+		}
+		if !dryRun && !quiet {
+			fmt.Printf("Contain-ish: Running '%v' inside a container.\n", id)
+		}
+
+		rt, err := container.New(container.WithCgroupManager(cgroupManager))
+		if err != nil {
+			exitWithError(err)
+		}
+
+		var opts []container.CreateOption
+		if detach {
+			opts = append(opts, container.Detached())
+		}
+		// Without --network the container joins the configured network.
+		cfg := &container.NetworkConfig{}
+		if network != "" {
+			if cfg, err = container.ParseNetwork(network); err != nil {
+				exitWithError(err)
+			}
+		}
+		cfg.Address = ipAddress
+		cfg.Gateway = gateway
+		opts = append(opts, container.WithNetwork(cfg))
+
+		policy, err := parseEgress(egress, egressAllow)
+		if err != nil {
+			exitWithError(err)
+		}
+		opts = append(opts, container.WithEgress(policy))
+
+		for _, v := range volumes {
+			m, err := container.ParseVolumeMount(v)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithVolumes(m))
+		}
+
+		for _, t := range tmpfs {
+			m, err := container.ParseTmpfs(t)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithTmpfs(m))
+		}
+
+		for _, s := range secrets {
+			secret, err := container.ParseSecret(s)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithSecrets(secret))
+		}
+
+		if storageSize != "" {
+			size, err := container.ParseStorageSize(storageSize)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithStorageSize(size))
+		}
+		patches, err := readSpecPatches(specPatches)
+		if err != nil {
+			exitWithError(err)
+		}
+		opts = append(opts, patches...)
+		// Variables given with -e override those of the env files.
+		env, err := readEnvFiles(envFiles)
+		if err != nil {
+			exitWithError(err)
+		}
+		for _, e := range envs {
+			if _, err := container.ParseEnv(e); err != nil {
+				exitWithError(err)
+			}
+		}
+		if env = append(env, envs...); len(env) > 0 {
+			opts = append(opts, container.WithEnv(env...))
+		}
+		tz, err := container.ParseTimezone(timezone)
+		if err != nil {
+			exitWithError(err)
+		}
+		if tz != "" {
+			opts = append(opts, container.WithTimezone(tz))
+		}
+		if hostLocale {
+			opts = append(opts, container.WithHostLocale())
+		}
+		if monotonicOff != 0 {
+			opts = append(opts, container.WithMonotonicOffset(monotonicOff))
+		}
+		if fakeDate != "" {
+			date, err := container.ParseFakeDate(fakeDate)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithFakeDate(date))
+		}
+		if noRTC {
+			opts = append(opts, container.WithNoRTC())
+		}
+		if osRelease {
+			opts = append(opts, container.WithOSRelease())
+		}
+		if memory != "" || cpus != "" {
+			var limit int64
+			var n float64
+			if memory != "" {
+				if limit, err = container.ParseMemory(memory); err != nil {
+					exitWithError(err)
+				}
+			}
+			if cpus != "" {
+				if n, err = container.ParseCPUs(cpus); err != nil {
+					exitWithError(err)
+				}
+			}
+			opts = append(opts, container.WithLimits(limit, n))
+		}
+		if memorySwap != "" {
+			limit, err := container.ParseMemorySwap(memorySwap)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithMemorySwap(limit))
+		}
+		if image != "" {
+			if _, err := container.ParseImageRef(image); err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithImage(image))
+		}
+		runtime, err := container.ParseRuntime(runtimeName)
+		if err != nil {
+			exitWithError(err)
+		}
+		if runtime != "" {
+			opts = append(opts, container.WithRuntime(runtime))
+		}
+		sandbox, err := container.ParseIsolation(isolation)
+		if err != nil {
+			exitWithError(err)
+		}
+		if sandbox != "" {
+			opts = append(opts, container.WithIsolation(sandbox))
+		}
+		if rootfsFlag != "" {
+			path := rootfsFlag
+			if path != container.RootfsHost {
+				if path, err = filepath.Abs(path); err != nil {
+					exitWithError(err)
+				}
+			}
+			opts = append(opts, container.WithRootfs(path))
+		}
+		if cmd.Flags().Changed("entrypoint") {
+			opts = append(opts, container.WithEntrypoint(entrypoint))
+		}
+		if len(command) > 0 {
+			opts = append(opts, container.WithCmd(command...))
+		}
+		if workdir != "" {
+			opts = append(opts, container.WithWorkdir(workdir))
+		}
+		if user != "" {
+			opts = append(opts, container.WithUser(user))
+		}
+		if restart != "" {
+			policy, err := container.ParseRestartPolicy(restart)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithRestart(policy))
+		}
+		if healthCmd != "" {
+			if health.Cmd, err = container.ParseHealthCmd(healthCmd); err != nil {
+				exitWithError(err)
+			}
+			if health.Action, health.Signal, err = container.ParseHealthAction(healthAction); err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithHealthCheck(health))
+		}
+		if len(runRequires) > 0 {
+			ids := make([]string, len(runRequires))
+			for i, ref := range runRequires {
+				ids[i] = resolveID(ref)
+			}
+			opts = append(opts, container.WithRequires(ids...))
+		}
+		if requiresCond != "" {
+			opts = append(opts, container.WithRequiresCondition(requiresCond, requiresWait))
+		}
+		for _, d := range devices {
+			if strings.HasPrefix(d, "/") {
+				dev, err := container.ParseHostDevice(d)
+				if err != nil {
+					exitWithError(err)
+				}
+				opts = append(opts, container.WithHostDevices(dev))
+				continue
+			}
+			name, err := container.ParseCDIDevice(d)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithCDIDevices(name))
+		}
+		if gpus != "" {
+			ids, err := container.ParseGPUs(gpus)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithGPUs(ids...))
+		}
+		if platform != "" || copyEmulator {
+			var arch string
+			if platform != "" {
+				if arch, err = container.ParsePlatform(platform); err != nil {
+					exitWithError(err)
+				}
+			}
+			opts = append(opts, container.WithPlatform(arch, copyEmulator))
+		}
 
-		if err := container.RunContainer(id, configPath, detach); err != nil {
-			fmt.Println("Error:", err)
-			os.Exit(1)
+		logCfg, err := container.ParseLogOpts(logOpts)
+		if err != nil {
+			exitWithError(err)
+		}
+		logCfg.Driver = logDriver
+		opts = append(opts, container.WithLogConfig(logCfg))
+		if runStopSignal != "" {
+			opts = append(opts, container.WithDefaultStopSignal(runStopSignal))
+		}
+		if trace != "" {
+			opts = append(opts, container.WithTrace(trace))
+		}
+		if coreDumps {
+			opts = append(opts, container.WithCoreDumps())
+		}
+		if consoleSocket != "" {
+			opts = append(opts, container.WithConsoleSocket(consoleSocket))
+		}
+		if notify {
+			opts = append(opts, container.WithNotify())
+		}
+		if metadata {
+			opts = append(opts, container.WithMetadata())
+		}
+		if strictSpec {
+			opts = append(opts, container.WithStrictSpec())
+		}
+		if privileged {
+			opts = append(opts, container.WithPrivileged())
+		}
+		if securityClass != "" {
+			opts = append(opts, container.WithSecurityClass(securityClass))
+		}
+		if containerName != "" {
+			opts = append(opts, container.WithName(containerName))
+		}
+		if integrity {
+			opts = append(opts, container.WithIntegrity())
+		}
+		if exitFd >= 0 {
+			f, err := container.OpenExitFd(exitFd)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithExitFile(f))
+		}
+		if pidNamespace != "" {
+			id, err := container.ParsePidNamespace(pidNamespace)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithPidContainer(id))
+		}
+		if noNewKeyring {
+			opts = append(opts, container.WithoutNewKeyring())
+		}
+		if force {
+			opts = append(opts, container.WithForce())
+		}
+		if quiet {
+			opts = append(opts, container.Quiet())
+		}
+		var progressFuncs []container.ProgressFunc
+		if progress == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			progressFuncs = append(progressFuncs, func(e container.ProgressEvent) {
+				_ = enc.Encode(e)
+			})
+		}
+		// The id file is written once the container exists. Scripts rely
+		// on it, so failing to write it aborts the run.
+		ctx, abort := context.WithCancel(cmd.Context())
+		defer abort()
+		var cidErr error
+		if cidFile != "" {
+			progressFuncs = append(progressFuncs, func(e container.ProgressEvent) {
+				if e.Phase != container.PhaseCreate || e.Status != container.ProgressDone || cidErr != nil {
+					return
+				}
+				if cidErr = writeCIDFile(cidFile, id); cidErr != nil {
+					abort()
+				}
+			})
+		}
+		if len(progressFuncs) > 0 {
+			opts = append(opts, container.WithProgress(func(e container.ProgressEvent) {
+				for _, fn := range progressFuncs {
+					fn(e)
+				}
+			}))
+		}
+		// A relative config is relative to the bundle.
+		specPath := configPath
+		if !filepath.IsAbs(specPath) {
+			specPath = filepath.Join(bundle, specPath)
+		}
+		opts = append(opts, container.WithBundle(bundle))
+		if dryRun {
+			plan, err := rt.Plan(id, specPath, opts...)
+			if err != nil {
+				exitWithError(err)
+			}
+			if err := plan.Write(os.Stdout); err != nil {
+				exitWithError(err)
+			}
+			return
+		}
+		if err := rt.Run(ctx, id, specPath, opts...); err != nil {
+			if cidErr != nil {
+				if derr := rt.Delete(id); derr != nil {
+					fmt.Fprintf(os.Stderr, "warning: %v\n", derr)
+				}
+				exitWithError(cidErr)
+			}
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			c, err := rt.State(id)
+			if err != nil {
+				exitWithError(err)
+			}
+			printJSON(container.NewContainerOutput(c))
+			return
+		}
+		if detach && progress != "json" {
+			fmt.Println(id)
 		}
 	},
 }
 
+// writeCIDFile writes the container id to path, which must not exist. The
+// id is linked into place from a temporary file, so tools polling for the
+// file see it complete once it appears, and a file created meanwhile isn't
+// overwritten.
+func writeCIDFile(path, id string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write container id file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(id)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write container id file: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("container id file %s exists, remove it or give another", path)
+		}
+		return fmt.Errorf("failed to write container id file: %w", err)
+	}
+	return nil
+}
+
+// readEnvFiles returns the variables of the env files, in order.
+func readEnvFiles(paths []string) ([]string, error) {
+	var env []string
+	for _, path := range paths {
+		e, err := container.ReadEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, e...)
+	}
+	return env, nil
+}
+
+// readSpecPatches reads the spec patch files at paths, to be applied in
+// order.
+func readSpecPatches(paths []string) ([]container.CreateOption, error) {
+	var opts []container.CreateOption
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spec patch: %w", err)
+		}
+		patch, err := container.ParseSpecPatch(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		opts = append(opts, container.WithSpecPatch(patch))
+	}
+	return opts, nil
+}
+
+// parseEgress builds the egress policy from the --egress and --egress-allow
+// flags. It returns nil when egress is unrestricted.
+func parseEgress(mode string, allow []string) (*container.EgressPolicy, error) {
+	switch mode {
+	case "allow":
+		if len(allow) > 0 {
+			return nil, fmt.Errorf("--egress-allow requires --egress deny")
+		}
+		return nil, nil
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid --egress %q: expected allow or deny", mode)
+	}
+
+	policy := &container.EgressPolicy{Deny: true}
+	for _, a := range allow {
+		r, err := container.ParseEgressRule(a)
+		if err != nil {
+			return nil, err
+		}
+		policy.Allow = append(policy.Allow, r)
+	}
+	return policy, nil
+}
+
 func init() {
-	runCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "path to OCI config file")
-	runCmd.Flags().BoolVarP(&detach, "detach", "d", false, "run container in background")
+	supportsJSON(runCmd)
+	runCmd.Flags().StringVar(&presetName, "preset", "", "run the container from a preset, see preset create; other flags override its settings")
+	runCmd.Flags().StringVar(&image, "image", "", "run the container from an image, e.g. alpine:3.20, pulled unless it was already")
+	runCmd.Flags().StringVar(&entrypoint, "entrypoint", "", "replace the entrypoint of the image, and drop its command; empty clears it")
+	runCmd.Flags().StringVarP(&workdir, "workdir", "w", "", "working directory of the process, in place of that of the image")
+	runCmd.Flags().StringVarP(&user, "user", "u", "", "run the process as <user>[:<group>], names of the rootfs or ids, in place of the user of the image")
+	runCmd.Flags().StringVar(&isolation, "isolation", container.IsolationProcess, "how the container process is isolated: process, userns to also map it to subordinate ids in a user namespace, or vm to run it in a QEMU microVM, experimental")
+	runCmd.Flags().StringVar(&runtimeName, "runtime", container.RuntimeNative, "how the container process is executed: native, or wasm to run a WebAssembly (WASI) module with the embedded engine, experimental")
+	runCmd.Flags().StringVar(&rootfsFlag, "rootfs", "", "root filesystem of the container in place of root.path of the spec, a directory, or host to run a program of the host with no pivot_root, only isolated by namespaces, cgroup, seccomp and capabilities")
+	runCmd.Flags().StringVarP(&bundle, "bundle", "b", ".", "path to the bundle directory holding config.json and, when relative, the rootfs")
+	runCmd.Flags().StringVarP(&configPath, "config", "c", "config.json", "path to OCI config file, relative to the bundle")
+	runCmd.Flags().BoolVarP(&detach, "detach", "d", false, "run container in background, printing only its id once it runs (runtime messages go to runtime.log in the state dir)")
+	runCmd.Flags().StringVar(&cgroupManager, "cgroup-manager", container.CgroupfsManager, "cgroup manager to use (cgroupfs or systemd)")
+	runCmd.Flags().StringVar(&network, "network", "", "network mode: none, host, bridge, a network name, or a driver such as macvlan:eth0 (default network in the configuration, or none)")
+	runCmd.Flags().StringVar(&ipAddress, "ip", "", "static container address (CIDR for macvlan/ipvlan, default: DHCP or allocated)")
+	runCmd.Flags().StringVar(&gateway, "gateway", "", "default gateway for a static address")
+	runCmd.Flags().StringVar(&egress, "egress", "allow", "default egress policy (allow or deny)")
+	runCmd.Flags().StringArrayVarP(&volumes, "volume", "v", nil, "mount a named volume, <name>:<path>[:ro]")
+	runCmd.Flags().StringArrayVar(&tmpfs, "tmpfs", nil, "mount a tmpfs, <path>[:<options>] e.g. /tmp:size=64m,mode=1777")
+	runCmd.Flags().StringArrayVar(&secrets, "secret", nil, "expose a host file on a private tmpfs, src=<file>[,target=<path under /run/secrets>][,env=<name>]")
+	runCmd.Flags().StringArrayVarP(&envs, "env", "e", nil, "set an environment variable of the container process, KEY=VALUE")
+	runCmd.Flags().StringArrayVar(&specPatches, "spec-patch", nil, "apply a JSON merge patch (object) or JSON patch (array of operations) file to the spec, in the order given")
+	runCmd.Flags().StringArrayVar(&envFiles, "env-file", nil, "read environment variables of the container process from a file of KEY=VALUE lines")
+	runCmd.Flags().StringVar(&timezone, "tz", container.TimezoneHost, "timezone of the container, a zone such as Europe/Lisbon, host, or none to leave it to the rootfs")
+	runCmd.Flags().BoolVar(&hostLocale, "host-locale", false, "pass the locale variables of the host, LANG, LANGUAGE and LC_*, on to the container process")
+	runCmd.Flags().DurationVar(&monotonicOff, "monotonic-offset", 0, "shift the monotonic and boot time clocks of the container, e.g. 240h, in a time namespace of its own")
+	runCmd.Flags().StringVar(&fakeDate, "fake-date", "", "the date the container process is told it is, e.g. 2020-01-01 or @1577836800, through SOURCE_DATE_EPOCH and libfaketime when the rootfs has it")
+	runCmd.Flags().BoolVar(&noRTC, "no-rtc", false, "take the RTC devices, /dev/rtc*, away from the container, even a privileged one")
+	runCmd.Flags().BoolVar(&osRelease, "os-release", false, "mount the os-release of the image rootfs with IMAGE_ID and IMAGE_VERSION set from the image, its title and version labels or its reference")
+	runCmd.Flags().StringVar(&memory, "memory", "", "limit the memory of the container, e.g. 512m, with memory.max")
+	runCmd.Flags().StringVar(&memorySwap, "memory-swap", "", "limit the memory and swap of the container together, e.g. 1g with --memory 512m for 512m of swap, or -1 for unlimited swap, with memory.swap.max")
+	runCmd.Flags().StringVar(&cpus, "cpus", "", "limit the CPU time of the container to a number of CPUs, e.g. 1.5, with cpu.max")
+	runCmd.Flags().BoolVar(&privileged, "privileged", false, "run the container with every capability, no seccomp filter, /proc and /sys unmasked, /sys read-write and the devices of the host")
+	runCmd.Flags().BoolVar(&integrity, "integrity", false, "record a hash manifest of the image when the container is created, which verify checks its rootfs against")
+	runCmd.Flags().StringVar(&containerName, "name", "", "a name to refer to the container by in place of its id, unique among containers")
+	runCmd.Flags().StringVar(&securityClass, "security-class", "", "the class deciding what the container sees of /proc and /sys, default or hardened")
+	runCmd.Flags().BoolVar(&strictSpec, "strict-spec", false, "fail if the spec sets what the runtime doesn't support, see features, rather than warn that it is ignored")
+	runCmd.Flags().BoolVar(&force, "force", false, "run the container even if the host lacks the memory or CPUs of its limits, given what other containers reserve")
+	runCmd.Flags().StringVar(&storageSize, "storage-size", "", "limit the space the container can use in its rootfs, e.g. 1g, with a project quota")
+	runCmd.Flags().StringArrayVar(&devices, "device", nil, "inject a CDI device, <vendor>/<class>=<name> e.g. nvidia.com/gpu=0, or pass a host device through, <path>[:<permissions>] e.g. /dev/ttyUSB0:rw")
+	runCmd.Flags().StringVar(&gpus, "gpus", "", "pass GPUs through to the container, all or a comma-separated list of GPU indexes or UUIDs")
+	runCmd.Flags().StringVar(&platform, "platform", "", "architecture the rootfs must be for, linux/<arch>[/<variant>] e.g. linux/arm64 (default any the host runs or emulates)")
+	runCmd.Flags().BoolVar(&copyEmulator, "copy-emulator", false, "copy the qemu emulator of a foreign-architecture rootfs into it when its binfmt_misc handler lacks the F flag")
+	runCmd.Flags().StringVar(&logDriver, "log-driver", "", "log driver for detached containers, json-file, none, or syslog, fluentd or http to also forward to a collector (default log_driver in the configuration, or json-file)")
+	runCmd.Flags().StringArrayVar(&logOpts, "log-opt", nil, "log option for detached containers, max-size=<size> or max-file=<n>, and for forwarding address=<address>, tag=<tag>, tls-ca=<file>, tls-skip-verify=true or buffer=<lines> (default log_opts in the configuration)")
+	runCmd.Flags().StringVar(&trace, "trace", "", "trace the container's system calls to trace.log in its state dir, log or summary")
+	runCmd.Flags().Lookup("trace").NoOptDefVal = container.TraceLog
+	runCmd.Flags().BoolVar(&coreDumps, "core-dumps", false, "capture the core dumps of the container's processes in its state dir, see cores, making containish the core_pattern helper of the host")
+	runCmd.Flags().StringVar(&restart, "restart", "", "restart policy of a detached container once it exits, no, on-failure[:<max retries>] or always")
+	runCmd.Flags().StringVar(&healthCmd, "health-cmd", "", `probe run in a detached container to check its health, a shell command or a JSON array such as '["curl", "-f", "localhost"]'`)
+	runCmd.Flags().DurationVar(&health.Interval, "health-interval", container.DefaultHealthInterval, "time between health probes")
+	runCmd.Flags().DurationVar(&health.Timeout, "health-timeout", container.DefaultHealthTimeout, "time a health probe may run before it fails")
+	runCmd.Flags().DurationVar(&health.StartPeriod, "health-start-period", 0, "time the container has to pass its first health probe, failures meanwhile not counting")
+	runCmd.Flags().IntVar(&health.Retries, "health-retries", container.DefaultHealthRetries, "failed health probes in a row making the container unhealthy")
+	runCmd.Flags().StringVar(&healthAction, "health-action", container.HealthActionNone, "liveness action once unhealthy, none, restart or signal:<signal>")
+	runCmd.Flags().StringSliceVar(&runRequires, "requires", nil, "containers this one depends on, which must be running for it to run; start starts them first and stop stops them after it")
+	runCmd.Flags().StringVar(&requiresCond, "requires-condition", "", "wait for the required containers to be ready or healthy, rather than only running")
+	runCmd.Flags().DurationVar(&requiresWait, "requires-timeout", container.DefaultRequiresTimeout, "how long to wait for the required containers to meet --requires-condition")
+	runCmd.Flags().StringVar(&runStopSignal, "stop-signal", "", "signal stop sends the init process first (default the "+container.AnnotationStopSignal+" annotation, or SIGTERM)")
+	runCmd.Flags().StringVar(&consoleSocket, "console-socket", "", "unix socket receiving the master of the container's pseudo terminal (requires process.terminal)")
+	runCmd.Flags().BoolVar(&notify, "notify", false, "mount a notify socket at $NOTIFY_SOCKET and keep the container starting until its workload sends READY=1 to it")
+	runCmd.Flags().BoolVar(&metadata, "metadata", false, "serve the metadata of the container, its id, labels, limits and network, over HTTP on a unix socket at /run/containish/metadata.sock in it")
+	runCmd.Flags().IntVar(&exitFd, "exit-fd", -1, "file descriptor, such as a pipe, the monitor of a detached container writes the exit code of its process to, a line each time it exits")
+	runCmd.Flags().StringVar(&pidNamespace, "pid", "", "join the pid namespace of another container, container:<id>, whose processes it then sees and which it dies with")
+	runCmd.Flags().BoolVar(&noNewKeyring, "no-new-keyring", false, "keep the container process in the session keyring of the runtime rather than creating one for it")
+	runCmd.Flags().StringVar(&cidFile, "cidfile", "", "write the container id to a file once the container is created; the file must not exist")
+	runCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "write runtime messages to runtime.log in the state dir, leaving stdout and stderr to the container")
+	runCmd.Flags().StringVar(&progress, "progress", "plain", "progress output, plain or json (one event per line on stdout, implies --quiet)")
+	runCmd.Flags().BoolVar(&dryRun, "dry-run", false, "print what running the container would do without creating anything")
+	runCmd.Flags().StringArrayVar(&egressAllow, "egress-allow", nil, "allow egress to <cidr>[:<port>[/<proto>]] when --egress is deny")
 }
@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteCIDFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.cid")
+	if err := writeCIDFile(path, "web"); err != nil {
+		t.Fatalf("writeCIDFile failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "web" {
+		t.Fatalf("container id file holds %q, %v", data, err)
+	}
+	// An existing file is refused and left as it is.
+	if err := writeCIDFile(path, "db"); err == nil {
+		t.Fatal("expected an existing container id file to be refused")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "web" {
+		t.Fatalf("container id file overwritten with %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("temporary files left behind: %v", entries)
+	}
+}
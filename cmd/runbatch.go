@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"bytes"
+	"containish/container"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	batchFile     string
+	batchParallel int
+)
+
+var runBatchCmd = &cobra.Command{
+	Use:   "run-batch -f <file>",
+	Short: "Run the containers of a batch file, several at a time",
+	Long: `Run the containers listed in a YAML batch file, detached, several at a time,
+then print how each start went. The images of the file are pulled first, once,
+and the containers run from one share its unpacked rootfs through the storage
+driver. Containers run from the same bundle share its rootfs.
+
+  parallel: 4
+  containers:
+    - id: web
+      image: nginx:1.27
+      replicas: 3        # web-1, web-2 and web-3
+      env: [MODE=demo]
+    - id: worker
+      bundle: ./worker   # relative to the file
+      preset: small
+      memory: 256m
+      requires: [web]    # web-1, web-2 and web-3 first
+
+Each container takes the settings of the run flags of the same names: preset,
+image, command, bundle, config, volumes, tmpfs, env, memory, cpus,
+storageSize, network, restart, requires, requiresCondition and
+requiresTimeout. The containers of the file another requires are run before
+it, and it isn't run if one of them failed to.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		b, err := container.LoadBatch(batchFile)
+		if err != nil {
+			exitWithError(err)
+		}
+		parallel := batchWorkers
+		if b.Parallel > 0 {
+			parallel = b.Parallel
+		}
+		if cmd.Flags().Changed("parallel") {
+			if batchParallel < 1 {
+				exitWithError(fmt.Errorf("invalid --parallel %d", batchParallel))
+			}
+			parallel = batchParallel
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			exitWithError(err)
+		}
+
+		// Pulled once here rather than by every container.
+		pulled := map[string]bool{}
+		for _, c := range b.Containers {
+			if c.Image == "" || pulled[c.Image] {
+				continue
+			}
+			pulled[c.Image] = true
+			if _, err := container.LoadImage(c.Image); !errors.Is(err, container.ErrNotFound) {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Pulling %s...\n", c.Image)
+			if _, err := container.PullImage(cmd.Context(), c.Image, "", nil); err != nil {
+				exitWithError(err)
+			}
+		}
+
+		levels, err := b.Levels()
+		if err != nil {
+			exitWithError(err)
+		}
+		index := map[string]int{}
+		for i, c := range b.Containers {
+			index[c.ID] = i
+		}
+		start := time.Now()
+		results := make([]batchResult, len(b.Containers))
+		sem := make(chan struct{}, parallel)
+		// The containers of a level are run once those of the previous
+		// ones, which they may require, are.
+		for _, level := range levels {
+			var wg sync.WaitGroup
+			for _, c := range level {
+				r := &results[index[c.ID]]
+				if failed := failedRequirement(c, index, results); failed != "" {
+					r.err = fmt.Errorf("not started, as %s it requires failed to", failed)
+					continue
+				}
+				wg.Add(1)
+				sem <- struct{}{}
+				go func() {
+					defer wg.Done()
+					defer func() { <-sem }()
+					began := time.Now()
+					r.err = runBatchContainer(exe, c)
+					r.took = time.Since(began)
+				}()
+			}
+			wg.Wait()
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "CONTAINER\tRESULT\tTIME\tERROR")
+		failed := 0
+		for i, c := range b.Containers {
+			r := results[i]
+			if r.err != nil {
+				failed++
+				fmt.Fprintf(tw, "%s\tfailed\t%s\t%v\n", c.ID, r.took.Round(time.Millisecond), r.err)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\tstarted\t%s\t\n", c.ID, r.took.Round(time.Millisecond))
+		}
+		tw.Flush()
+		fmt.Printf("\n%d started, %d failed in %s, %d at a time\n",
+			len(b.Containers)-failed, failed, time.Since(start).Round(time.Millisecond), parallel)
+		if failed > 0 {
+			os.Exit(exitError)
+		}
+	},
+}
+
+// batchResult is how the start of a container of a batch went.
+type batchResult struct {
+	err  error
+	took time.Duration
+}
+
+// failedRequirement returns the container of the batch c requires that
+// failed to start, if any, index giving the results of those of the batch.
+func failedRequirement(c container.BatchContainer, index map[string]int, results []batchResult) string {
+	for _, id := range c.Requires {
+		if i, ok := index[id]; ok && results[i].err != nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// runBatchContainer runs c detached with the run command of exe, returning
+// the error it printed if it failed.
+func runBatchContainer(exe string, c container.BatchContainer) error {
+	args := []string{"run", "--detach"}
+	if rootDir != "" {
+		args = append(args, "--root", rootDir)
+	}
+	if stateStore != "" {
+		args = append(args, "--state-store", stateStore)
+	}
+	flags := []struct {
+		name   string
+		values []string
+	}{
+		{"preset", nonEmpty(c.Preset)},
+		{"image", nonEmpty(c.Image)},
+		{"bundle", nonEmpty(c.Bundle)},
+		{"config", nonEmpty(c.Config)},
+		{"volume", c.Volumes},
+		{"tmpfs", c.Tmpfs},
+		{"env", c.Env},
+		{"memory", nonEmpty(c.Memory)},
+		{"cpus", nonEmpty(c.CPUs)},
+		{"storage-size", nonEmpty(c.StorageSize)},
+		{"network", nonEmpty(c.Network)},
+		{"restart", nonEmpty(c.Restart)},
+		{"requires", c.Requires},
+		{"requires-condition", nonEmpty(c.RequiresCondition)},
+		{"requires-timeout", nonEmpty(c.RequiresTimeout)},
+	}
+	for _, f := range flags {
+		for _, v := range f.values {
+			args = append(args, "--"+f.name+"="+v)
+		}
+	}
+	args = append(args, "--", c.ID)
+	args = append(args, c.Command...)
+
+	var stderr bytes.Buffer
+	run := exec.Command(exe, args...)
+	run.Stderr = &stderr
+	if err := run.Run(); err != nil {
+		// The error is the last line the run printed.
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		if msg := strings.TrimPrefix(lines[len(lines)-1], "Error: "); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+func init() {
+	runBatchCmd.Flags().StringVarP(&batchFile, "file", "f", "", "YAML file listing the containers to run")
+	runBatchCmd.Flags().IntVarP(&batchParallel, "parallel", "p", batchWorkers, "how many containers to start at once (default parallel in the file, or 8)")
+	_ = runBatchCmd.MarkFlagRequired("file")
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var shutdownTimeout int
+
+var shutdownAllCmd = &cobra.Command{
+	Use:   "shutdown-all",
+	Short: "Stop every running container before the host shuts down",
+	Long: `Stop every running container as stop does, and record them so restore-all
+starts them again once the host is back. A container requiring others, with
+run --requires or in its ` + container.AnnotationDependsOn + ` annotation, separated by
+commas, is stopped before them; the others are stopped in parallel. A frozen container is thawed first.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if shutdownTimeout < 0 {
+			exitWithError(fmt.Errorf("invalid --time %d", shutdownTimeout))
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		results, err := rt.ShutdownAll(cmd.Context(), container.WithStopTimeout(time.Duration(shutdownTimeout)*time.Second))
+		if err != nil {
+			exitWithError(err)
+		}
+		reportResults(results)
+	},
+}
+
+var restoreAllCmd = &cobra.Command{
+	Use:   "restore-all",
+	Short: "Start again the containers shutdown-all stopped",
+	Long: `Start again the containers the last shutdown-all stopped, those they depend on
+first, running them from their spec and options if their state is gone with
+a reboot. A container whose dependency failed to start isn't started.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		results, err := rt.RestoreAll(cmd.Context())
+		if err != nil {
+			exitWithError(err)
+		}
+		reportResults(results)
+	},
+}
+
+// reportResults reports results like a batch command.
+func reportResults(results []container.ContainerResult) {
+	ids := make([]string, len(results))
+	errs := make([]error, len(results))
+	for i, r := range results {
+		ids[i], errs[i] = r.Id, r.Err
+	}
+	reportBatch(ids, errs)
+}
+
+func init() {
+	shutdownAllCmd.Flags().IntVarP(&shutdownTimeout, "time", "t", int(container.DefaultStopTimeout/time.Second), "seconds to wait for each init process to exit before killing it")
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Capture and roll back the root filesystem of containers",
+}
+
+var snapshotCreateCmd = &cobra.Command{
+	Use:   "create <container-id> [name]",
+	Short: "Snapshot the root filesystem of a container",
+	Long: `Snapshot the root filesystem of a container, named after the current time
+unless a name is given. Only files are captured, so stop a running container
+first for a consistent snapshot.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var name string
+		if len(args) == 2 {
+			name = args[1]
+		}
+		s, err := container.CreateSnapshot(resolveID(args[0]), name)
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(s.Name)
+	},
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:     "list <container-id>",
+	Aliases: []string{"ls"},
+	Short:   "List the snapshots of a container",
+	Args:    cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		snapshots, err := container.ListSnapshots(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCREATED\tSIZE")
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", s.Name, s.CreatedAt.Format(time.RFC3339), s.Size)
+		}
+		w.Flush()
+	},
+}
+
+var snapshotRestoreCmd = &cobra.Command{
+	Use:   "restore <container-id> <name>",
+	Short: "Roll the root filesystem of a stopped container back to a snapshot",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := container.RestoreSnapshot(resolveID(args[0]), args[1]); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	snapshotCmd.AddCommand(snapshotCreateCmd, snapshotListCmd, snapshotRestoreCmd)
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var statsHistory bool
+
+var statsCmd = &cobra.Command{
+	Use:   "stats <container-id>",
+	Short: "Show resource usage and pressure of a container",
+	Long: `Show the resource usage and pressure of a running container. With --history,
+show instead the usage the daemon recorded every --history-interval, 30s by
+default, over the last day, with the CPUs used since the sample before.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if statsHistory {
+			printUsageHistory(resolveID(args[0]))
+			return
+		}
+		s, err := container.GetStats(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewStatsOutput(s))
+			return
+		}
+
+		fmt.Printf("CPU time:   %.2fs\n", float64(s.CPUUsageUsec)/1e6)
+		fmt.Printf("Memory:     %d bytes\n", s.MemoryCurrent)
+		fmt.Printf("Swap:       %d bytes\n", s.SwapCurrent)
+		fmt.Printf("Processes:  %d\n", s.PidsCurrent)
+		fmt.Println()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PRESSURE\tSOME AVG10\tSOME AVG60\tFULL AVG10\tFULL AVG60")
+		for _, p := range []struct {
+			name string
+			psi  *container.PSIStats
+		}{
+			{"cpu", s.Pressure.CPU},
+			{"memory", s.Pressure.Memory},
+			{"io", s.Pressure.IO},
+		} {
+			if p.psi == nil {
+				fmt.Fprintf(w, "%s\t-\t-\t-\t-\n", p.name)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%.2f%%\t%.2f%%\t%.2f%%\t%.2f%%\n", p.name,
+				p.psi.Some.Avg10, p.psi.Some.Avg60, p.psi.Full.Avg10, p.psi.Full.Avg60)
+		}
+		w.Flush()
+	},
+}
+
+// printUsageHistory prints the usage history of container id.
+func printUsageHistory(id string) {
+	samples, err := container.UsageHistory(id)
+	if err != nil {
+		exitWithError(err)
+	}
+	if jsonOutput() {
+		printJSON(container.NewUsageHistoryOutput(id, samples))
+		return
+	}
+	if len(samples) == 0 {
+		fmt.Printf("No usage history of %s yet: the daemon records it while it runs\n", id)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tCPUS\tMEMORY\tSWAP\tPIDS")
+	for _, s := range samples {
+		cpus := "-"
+		if s.CPUs != nil {
+			cpus = fmt.Sprintf("%.2f", *s.CPUs)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", s.Time.Local().Format(time.DateTime), cpus,
+			container.FormatBytes(int64(s.MemoryCurrent)), container.FormatBytes(int64(s.SwapCurrent)), s.PidsCurrent)
+	}
+	w.Flush()
+}
+
+func init() {
+	statsCmd.Flags().BoolVar(&statsHistory, "history", false, "show the usage history the daemon recorded rather than the current usage")
+	supportsJSON(statsCmd)
+}
@@ -3,21 +3,66 @@ package cmd
 import (
 	"containish/container"
 	"fmt"
-	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	stopFlags   batchFlags
+	stopTimeout int
+	stopSignal  string
+)
+
 var stopCmd = &cobra.Command{
-	Use:   "stop <container-id>",
-	Short: "Stop a running container",
-	Args:  cobra.ExactArgs(1),
+	Use:   "stop [flags] <container-id>...",
+	Short: "Stop running containers",
+	Long: `Stop running containers. Each container's init process is sent its stop
+signal, SIGTERM unless set otherwise when it was run, and killed with SIGKILL
+if it hasn't exited after --time seconds. Containers requiring others, with
+run --requires or the ` + container.AnnotationDependsOn + ` annotation, are stopped
+before them.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		id := args[0]
-		fmt.Printf("Contain-ish: Stopping '%v'\n", id)
-		if err := container.StopContainer(id); err != nil {
-			fmt.Println("Error:", err)
-			os.Exit(1)
+		if stopTimeout < 0 {
+			exitWithError(fmt.Errorf("invalid --time %d", stopTimeout))
+		}
+		ids, err := stopFlags.targets(args, container.Running, container.Starting, container.Created)
+		if err != nil {
+			exitWithError(err)
+		}
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
 		}
+		opts := []container.StopOption{container.WithStopTimeout(time.Duration(stopTimeout) * time.Second)}
+		if stopSignal != "" {
+			sig, err := container.ParseSignal(stopSignal)
+			if err != nil {
+				exitWithError(err)
+			}
+			opts = append(opts, container.WithStopSignal(sig))
+		}
+		if len(ids) > 1 {
+			resolved := make([]string, len(ids))
+			for i, ref := range ids {
+				resolved[i] = resolveID(ref)
+			}
+			results, err := rt.StopOrdered(cmd.Context(), resolved, opts...)
+			if err != nil {
+				exitWithError(err)
+			}
+			reportResults(results)
+			return
+		}
+		runBatch(ids, func(id string) error {
+			fmt.Printf("Contain-ish: Stopping '%v'\n", id)
+			return rt.Stop(cmd.Context(), id, opts...)
+		})
 	},
 }
+
+func init() {
+	stopFlags.register(stopCmd, "stop every running or created container")
+	stopCmd.Flags().StringVarP(&stopSignal, "signal", "s", "", "signal asking the init process to exit, instead of the container's stop signal")
+	stopCmd.Flags().IntVarP(&stopTimeout, "time", "t", int(container.DefaultStopTimeout/time.Second), "seconds to wait for the init process to exit before killing it")
+}
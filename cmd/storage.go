@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	migrateFrom string
+	migrateTo   string
+)
+
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Manage the storage of containers run from images",
+}
+
+var storageMigrateCmd = &cobra.Command{
+	Use:   "migrate --to <driver> [--from <driver>] [container-id...]",
+	Short: "Move the rootfs of stopped containers to another storage driver",
+	Long: `Move the rootfs of stopped containers run from images to another storage
+driver, overlay or vfs, keeping the changes they made: those given, or every
+stopped container using the --from driver. They must stay stopped until it
+is done. New containers still get the storage_driver of the configuration.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ids := args
+		if len(ids) == 0 {
+			if migrateFrom == "" {
+				exitWithError(fmt.Errorf("requires container ids, or --from to migrate every stopped container using a driver"))
+			}
+			rt, err := container.New()
+			if err != nil {
+				exitWithError(err)
+			}
+			containers, err := rt.Find(container.StateFilter{Status: []container.Status{container.Stopped}})
+			if err != nil {
+				exitWithError(err)
+			}
+			for _, c := range containers {
+				if c.Image != nil && c.Image.Driver == migrateFrom {
+					ids = append(ids, c.Id)
+				}
+			}
+			if len(ids) == 0 {
+				return
+			}
+		}
+		runBatch(ids, func(id string) error {
+			if migrateFrom != "" {
+				c, err := container.LoadState(id)
+				if err != nil {
+					return err
+				}
+				if c.Image == nil || c.Image.Driver != migrateFrom {
+					return fmt.Errorf("container %s doesn't use the %s storage driver", id, migrateFrom)
+				}
+			}
+			return container.MigrateStorage(id, migrateTo)
+		})
+	},
+}
+
+func init() {
+	storageMigrateCmd.Flags().StringVar(&migrateFrom, "from", "", "only containers using this storage driver, overlay or vfs")
+	storageMigrateCmd.Flags().StringVar(&migrateTo, "to", "", "storage driver to move to, overlay or vfs")
+	_ = storageMigrateCmd.MarkFlagRequired("to")
+	storageCmd.AddCommand(storageMigrateCmd)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+var traceJSON bool
+
+var traceCmd = &cobra.Command{
+	Use:   "trace <container-id>",
+	Short: "Follow the execs, file opens and connections of a running container",
+	Long: `Follow the programs executed, the files opened and the connections made by
+the processes of a running container as they happen, with eBPF programs
+attached to the cgroup of the container, until it stops or the command is
+interrupted. Unlike run --trace, the container needn't have been started
+traced and runs at full speed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		enc := json.NewEncoder(os.Stdout)
+		header := false
+		err := container.TraceEvents(ctx, resolveID(args[0]), func(e container.TraceEvent) {
+			if traceJSON || jsonOutput() {
+				enc.Encode(e)
+				return
+			}
+			if !header {
+				fmt.Printf("%-12s  %-7s  %-15s  %-7s  %s\n", "TIME", "PID", "COMM", "EVENT", "DETAIL")
+				header = true
+			}
+			detail := e.Path
+			switch e.Type {
+			case container.TraceOpen:
+				detail = fmt.Sprintf("%s (%s)", e.Path, e.Flags)
+			case container.TraceConnect:
+				detail = e.Address
+			}
+			fmt.Printf("%-12s  %-7d  %-15s  %-7s  %s\n", e.Time.Format("15:04:05.000"), e.Pid, e.Comm, e.Type, detail)
+		})
+		if err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	traceCmd.Flags().BoolVar(&traceJSON, "json", false, "print each event as a JSON line, as --output json does")
+	supportsJSON(traceCmd)
+}
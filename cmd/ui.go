@@ -0,0 +1,501 @@
+package cmd
+
+import (
+	"bytes"
+	"cmp"
+	"containish/container"
+	"containish/daemon"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+// The dashboard is drawn with ANSI escape sequences on the alternate screen
+// of a terminal in raw mode, the whole screen again whenever something
+// changes. It follows the daemon rather than the state of the containers:
+// each event fetches the list of the containers again, and each sample of
+// the stats stream extends the sparklines of those running. The logs and
+// details of the selected container are read from the host the daemon
+// runs on, as the other commands do.
+
+var (
+	uiSocket   string
+	uiInterval time.Duration
+	uiShell    string
+)
+
+var uiCmd = &cobra.Command{
+	Use:   "ui",
+	Short: "Watch and manage containers in a terminal dashboard",
+	Long: `Show the containers the daemon sees in a terminal dashboard: their status,
+kept current by the event stream of the daemon, sparklines of the CPU and
+memory use of those running, from its stats stream, and the tail of the logs
+of the selected container.
+
+Keys: j and k or the arrows select a container, s stops it, x runs a shell
+in it, i shows its details in place of its logs and back, q quits.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := runDashboard(ctx); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	uiCmd.Flags().StringVar(&uiSocket, "socket", daemon.DefaultSocket, "socket of the daemon")
+	uiCmd.Flags().DurationVar(&uiInterval, "interval", time.Second, "how often the stats are sampled")
+	uiCmd.Flags().StringVar(&uiShell, "shell", "/bin/sh", "command the x key runs in the selected container")
+}
+
+// sparkWidth is how many samples a sparkline shows.
+const sparkWidth = 20
+
+// sparkBars are the bars of a sparkline, from the lowest to the highest.
+var sparkBars = []rune("▁▂▃▄▅▆▇█")
+
+// usage is the recent resource use of a running container.
+type usage struct {
+	// cpu is the CPU used between samples, in percent of a core, and mem
+	// the memory in use, in bytes, the oldest first.
+	cpu, mem []float64
+	lastUsec uint64
+	lastAt   time.Time
+}
+
+// add records the sample s taken at at.
+func (u *usage) add(at time.Time, s *container.Stats) {
+	if !u.lastAt.IsZero() && at.After(u.lastAt) && s.CPUUsageUsec >= u.lastUsec {
+		elapsed := float64(at.Sub(u.lastAt).Microseconds())
+		u.cpu = appendSample(u.cpu, float64(s.CPUUsageUsec-u.lastUsec)/elapsed*100)
+	}
+	u.lastUsec, u.lastAt = s.CPUUsageUsec, at
+	u.mem = appendSample(u.mem, float64(s.MemoryCurrent))
+}
+
+// appendSample appends v to samples, keeping the last sparkWidth.
+func appendSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	return samples[max(0, len(samples)-sparkWidth):]
+}
+
+// sparkline draws samples sparkWidth wide, the newest on the right, scaled
+// to the highest of them or ceiling if that is higher.
+func sparkline(samples []float64, ceiling float64) string {
+	scale := ceiling
+	for _, v := range samples {
+		scale = max(scale, v)
+	}
+	var b strings.Builder
+	b.WriteString(strings.Repeat(" ", sparkWidth-len(samples)))
+	for _, v := range samples {
+		i := 0
+		if scale > 0 {
+			i = int(v/scale*float64(len(sparkBars)-1) + 0.5)
+		}
+		b.WriteRune(sparkBars[i])
+	}
+	return b.String()
+}
+
+// dashboard is the state of the ui command.
+type dashboard struct {
+	ctx context.Context
+	rt  *container.Runtime
+
+	// mu guards what the streams update.
+	mu         sync.Mutex
+	containers []*container.Container
+	usage      map[string]*usage
+	message    string
+
+	// selected is the id of the selected container, and details whether
+	// its details are shown rather than its logs.
+	selected string
+	details  bool
+
+	// redraw asks for the screen to be drawn again.
+	redraw chan struct{}
+	// stdin is held by the key reader while it reads the terminal, and
+	// while a shell has it.
+	stdin sync.Mutex
+	// restore puts the terminal back in the mode it had.
+	restore func()
+}
+
+// runDashboard runs the dashboard until q is pressed or ctx is done.
+func runDashboard(ctx context.Context) error {
+	for _, f := range []*os.File{os.Stdin, os.Stdout} {
+		if _, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS); err != nil {
+			return fmt.Errorf("the dashboard needs a terminal")
+		}
+	}
+	rt, err := container.New()
+	if err != nil {
+		return err
+	}
+	containers, err := daemon.FetchContainers(ctx, uiSocket)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := &dashboard{ctx: ctx, rt: rt, containers: containers, usage: map[string]*usage{}, redraw: make(chan struct{}, 1)}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	go func() {
+		err := daemon.StreamEvents(ctx, uiSocket, nil, nil, func(*container.Event) { d.refresh() })
+		d.notify("event stream ended: %v", cmp.Or(err, errors.New("the daemon stopped")))
+	}()
+	go func() {
+		err := daemon.StreamStats(ctx, uiSocket, uiInterval, d.addStats)
+		d.notify("stats stream ended: %v", cmp.Or(err, errors.New("the daemon stopped")))
+	}()
+	keys := make(chan string)
+	go d.readKeys(keys)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	d.draw()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-d.redraw:
+		case <-winch:
+		case input := <-keys:
+			for _, key := range splitKeys(input) {
+				if !d.handleKey(key) {
+					return nil
+				}
+			}
+		}
+		d.draw()
+	}
+}
+
+// enter puts the terminal in raw mode and switches to its alternate screen
+// with the cursor hidden.
+func (d *dashboard) enter() error {
+	restore, err := container.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return fmt.Errorf("failed to set the terminal to raw mode: %w", err)
+	}
+	d.restore = restore
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	return nil
+}
+
+// leave undoes enter.
+func (d *dashboard) leave() {
+	os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+	d.restore()
+}
+
+// changed asks for the screen to be drawn again, unless it already is.
+func (d *dashboard) changed() {
+	select {
+	case d.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// notify shows a message at the bottom of the screen.
+func (d *dashboard) notify(format string, args ...any) {
+	d.mu.Lock()
+	d.message = fmt.Sprintf(format, args...)
+	d.mu.Unlock()
+	d.changed()
+}
+
+// refresh fetches the containers again and forgets the usage of those no
+// longer running.
+func (d *dashboard) refresh() {
+	containers, err := daemon.FetchContainers(d.ctx, uiSocket)
+	if err != nil {
+		d.notify("%v", err)
+		return
+	}
+	d.mu.Lock()
+	d.containers = containers
+	for id := range d.usage {
+		if !slices.ContainsFunc(containers, func(c *container.Container) bool {
+			return c.Id == id && (c.Status == container.Running || c.Status == container.Starting)
+		}) {
+			delete(d.usage, id)
+		}
+	}
+	d.mu.Unlock()
+	d.changed()
+}
+
+// addStats records the stats of the running containers sampled at at.
+func (d *dashboard) addStats(at time.Time, stats []*container.Stats) {
+	d.mu.Lock()
+	for _, s := range stats {
+		u := d.usage[s.Id]
+		if u == nil {
+			u = &usage{}
+			d.usage[s.Id] = u
+		}
+		u.add(at, s)
+	}
+	d.mu.Unlock()
+	d.changed()
+}
+
+// readKeys sends what is typed to keys until the dashboard is done. It
+// polls so as to let go of the terminal every now and then.
+func (d *dashboard) readKeys(keys chan<- string) {
+	fds := []unix.PollFd{{Fd: int32(os.Stdin.Fd()), Events: unix.POLLIN}}
+	buf := make([]byte, 64)
+	for d.ctx.Err() == nil {
+		d.stdin.Lock()
+		n := 0
+		if ready, err := unix.Poll(fds, 100); err == nil && ready > 0 {
+			n, _ = os.Stdin.Read(buf)
+		}
+		d.stdin.Unlock()
+		if n == 0 {
+			continue
+		}
+		select {
+		case keys <- string(buf[:n]):
+		case <-d.ctx.Done():
+		}
+	}
+}
+
+// splitKeys splits what was read from the terminal into keys, an escape
+// sequence such as that of an arrow being one.
+func splitKeys(input string) []string {
+	var keys []string
+	for input != "" {
+		n := 1
+		if strings.HasPrefix(input, "\x1b[") && len(input) >= 3 {
+			n = 3
+		}
+		keys = append(keys, input[:n])
+		input = input[n:]
+	}
+	return keys
+}
+
+// handleKey acts on key and reports whether the dashboard goes on.
+func (d *dashboard) handleKey(key string) bool {
+	d.mu.Lock()
+	ids := make([]string, len(d.containers))
+	var selected *container.Container
+	for i, c := range d.containers {
+		ids[i] = c.Id
+		if c.Id == d.selected {
+			selected = c
+		}
+	}
+	d.mu.Unlock()
+	i := slices.Index(ids, d.selected)
+	switch key {
+	case "q", "\x03":
+		return false
+	case "j", "\x1b[B":
+		if i+1 < len(ids) {
+			d.selected = ids[i+1]
+		}
+	case "k", "\x1b[A":
+		if i > 0 {
+			d.selected = ids[i-1]
+		}
+	case "i":
+		d.details = !d.details
+	case "\x1b":
+		d.details = false
+	case "s":
+		if selected == nil {
+			break
+		}
+		id := selected.Id
+		d.notify("stopping %s", id)
+		go func() {
+			if err := d.rt.Stop(d.ctx, id); err != nil {
+				d.notify("%v", err)
+				return
+			}
+			d.notify("stopped %s", id)
+		}()
+	case "x":
+		if selected != nil {
+			d.shell(selected.Id)
+		}
+	}
+	return true
+}
+
+// shell runs uiShell in container id with the terminal, and comes back to
+// the dashboard once it exits.
+func (d *dashboard) shell(id string) {
+	d.stdin.Lock()
+	defer d.stdin.Unlock()
+	d.leave()
+	fmt.Printf("Contain-ish: Running %s in '%s', exit it to return to the dashboard\n", uiShell, id)
+	p, err := container.ExecContainer(d.ctx, id, container.ExecOptions{Args: []string{uiShell}, Tty: true})
+	if err := d.enter(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if err != nil {
+		d.notify("%v", err)
+		return
+	}
+	d.notify("%s exited with code %d", uiShell, p.ExitCode)
+}
+
+// draw draws the screen for the size of the terminal.
+func (d *dashboard) draw() {
+	width, height := 80, 24
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && ws.Col > 0 && ws.Row > 0 {
+		width, height = int(ws.Col), int(ws.Row)
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, line := range d.render(width, height) {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	os.Stdout.WriteString(b.String())
+}
+
+// render returns the lines of the screen: the containers, above the logs
+// or details of the selected one, between a title and the keys.
+func (d *dashboard) render(width, height int) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !slices.ContainsFunc(d.containers, func(c *container.Container) bool { return c.Id == d.selected }) {
+		d.selected = ""
+		if len(d.containers) > 0 {
+			d.selected = d.containers[0].Id
+		}
+	}
+
+	lines := []string{reverse(fit(fmt.Sprintf(" containish ui  %d containers  %s", len(d.containers), uiSocket), width))}
+	lines = append(lines, fit(fmt.Sprintf("%-12s  %-16s  %-8s  %6s  %-*s  %9s  %-*s", "ID", "NAME", "STATUS", "CPU%", sparkWidth, "CPU", "MEM", sparkWidth, "MEMORY"), width))
+	rows := max(1, (height-4)/2)
+	first := 0
+	var selected *container.Container
+	for i, c := range d.containers {
+		if c.Id == d.selected {
+			selected = c
+			first = max(0, i-rows+1)
+		}
+	}
+	for _, c := range d.containers[first:min(len(d.containers), first+rows)] {
+		cpu, mem, cpuLine, memLine := "-", "-", "", ""
+		if u := d.usage[c.Id]; u != nil {
+			if len(u.cpu) > 0 {
+				cpu = fmt.Sprintf("%.1f", u.cpu[len(u.cpu)-1])
+			}
+			if len(u.mem) > 0 {
+				mem = container.FormatBytes(int64(u.mem[len(u.mem)-1]))
+			}
+			cpuLine, memLine = sparkline(u.cpu, 100), sparkline(u.mem, 0)
+		}
+		line := fit(fmt.Sprintf("%-12.12s  %-16.16s  %-8s  %6s  %-*s  %9s  %-*s", c.Id, cmp.Or(c.Name, "-"), c.Status, cpu, sparkWidth, cpuLine, mem, sparkWidth, memLine), width)
+		if c == selected {
+			line = reverse(line)
+		}
+		lines = append(lines, line)
+	}
+
+	pane := max(0, height-len(lines)-2)
+	switch {
+	case selected == nil:
+		lines = append(lines, rule("no containers", width))
+	case d.details:
+		lines = append(lines, rule("details of "+selected.Id, width))
+		out, _ := json.MarshalIndent(container.NewContainerOutput(selected), "", "  ")
+		lines = append(lines, paneLines(string(out), pane, width, false)...)
+	default:
+		lines = append(lines, rule("logs of "+selected.Id, width))
+		var out bytes.Buffer
+		if err := container.ReadLogs(selected.Id, container.LogOptions{Tail: pane}, &out, &out); err != nil {
+			out.Reset()
+			out.WriteString(err.Error())
+		}
+		lines = append(lines, paneLines(out.String(), pane, width, true)...)
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	footer := " j/k select  s stop  x shell  i details  q quit"
+	if d.message != "" {
+		footer += "  |  " + d.message
+	}
+	return append(lines[:height-1], reverse(fit(footer, width)))
+}
+
+// paneLines returns the lines of text fitting a pane of height lines of
+// width, its last ones if tail is set, else its first ones.
+func paneLines(text string, height, width int, tail bool) []string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	if len(lines) > height {
+		if tail {
+			lines = lines[len(lines)-height:]
+		} else {
+			lines = lines[:height]
+		}
+	}
+	for i, l := range lines {
+		lines[i] = fit(printable(l), width)
+	}
+	return lines
+}
+
+// printable replaces the tabs of s with spaces and drops the other control
+// characters, which would move the cursor.
+func printable(s string) string {
+	s = strings.ReplaceAll(s, "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// fit pads or cuts s to width characters.
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		return string(r[:width])
+	}
+	return s + strings.Repeat(" ", width-len(r))
+}
+
+// rule returns a horizontal line of width titled title.
+func rule(title string, width int) string {
+	return fit("── "+title+" "+strings.Repeat("─", width), width)
+}
+
+// reverse shows s in reverse video.
+func reverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[m"
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"containish/container"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify <container-id>",
+	Short: "Check the rootfs of a container against the hash manifest of its image",
+	Long: `Check the rootfs of a container run from an image with --integrity against
+the hash manifest recorded when it was created: the changes to the image it
+runs on, which nothing should make, are reported as tampering, apart from the
+changes the container made in its writable layer. Exits with 1 if the image
+was tampered with.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r, err := container.Verify(resolveID(args[0]))
+		if err != nil {
+			exitWithError(err)
+		}
+		if jsonOutput() {
+			printJSON(container.NewIntegrityOutput(r))
+		} else {
+			printChanges("Base (tampering)", r.Base)
+			printChanges("Writable layer", r.Layer)
+		}
+		if r.Tampered() {
+			os.Exit(exitError)
+		}
+	},
+}
+
+// printChanges prints the changes of a part of a rootfs under title.
+func printChanges(title string, changes []container.IntegrityChange) {
+	fmt.Printf("%s: %d changes\n", title, len(changes))
+	for _, c := range changes {
+		if c.Detail != "" {
+			fmt.Printf("  %-8s  /%s (%s)\n", c.Kind, c.Path, c.Detail)
+		} else {
+			fmt.Printf("  %-8s  /%s\n", c.Kind, c.Path)
+		}
+	}
+}
+
+func init() {
+	supportsJSON(verifyCmd)
+}
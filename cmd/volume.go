@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"containish/container"
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "Manage named volumes",
+}
+
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create a named volume",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := container.CreateVolume(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		fmt.Println(v.Name)
+	},
+}
+
+var volumeLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List volumes",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		volumes, err := container.ListVolumes()
+		if err != nil {
+			exitWithError(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tREFS\tMOUNTPOINT")
+		for _, v := range volumes {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", v.Name, len(v.Refs), v.Mountpoint)
+		}
+		w.Flush()
+	},
+}
+
+var volumeRmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a volume that no container uses",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := container.RemoveVolume(args[0]); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+var volumeInspectCmd = &cobra.Command{
+	Use:   "inspect <name>",
+	Short: "Show a volume",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		v, err := container.LoadVolume(args[0])
+		if err != nil {
+			exitWithError(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			exitWithError(err)
+		}
+	},
+}
+
+func init() {
+	volumeCmd.AddCommand(volumeCreateCmd, volumeLsCmd, volumeRmCmd, volumeInspectCmd)
+}
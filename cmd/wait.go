@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"containish/container"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	waitCondition string
+	waitTimeout   time.Duration
+)
+
+var waitCmd = &cobra.Command{
+	Use:   "wait [flags] <container-id>",
+	Short: "Wait for a container to stop or be ready",
+	Long: `Wait for a container to meet a condition. With --condition=stopped, the
+default, wait blocks until the init process exits and prints its exit code.
+With --condition=ready, it blocks until the container is running: a container
+run with --notify is only once its workload sent READY=1 to $NOTIFY_SOCKET.
+With --condition=healthy, it also blocks until a container with a health check
+passes it. Waiting for readiness or health fails if the container stops first.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		rt, err := container.New()
+		if err != nil {
+			exitWithError(err)
+		}
+		ctx := cmd.Context()
+		if waitTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, waitTimeout)
+			defer cancel()
+		}
+		c, err := rt.Wait(ctx, resolveID(args[0]), waitCondition)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("container %s isn't %s after %v", args[0], waitCondition, waitTimeout)
+		}
+		if err != nil {
+			exitWithError(err)
+		}
+		if waitCondition == container.WaitStopped && c.ExitCode != nil {
+			fmt.Println(*c.ExitCode)
+		}
+	},
+}
+
+func init() {
+	waitCmd.Flags().StringVar(&waitCondition, "condition", container.WaitStopped, "condition to wait for: stopped, ready or healthy")
+	waitCmd.Flags().DurationVar(&waitTimeout, "timeout", 0, "give up after this long, 0 waits forever")
+}
@@ -0,0 +1,193 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A container with a memory or CPU limit reserves that much of the host, as
+// recorded in its state, for as long as it is created or running. Before
+// running one the runtime checks the host has it: the memory must be free
+// and not reserved by other containers, and the CPUs not reserved by them,
+// unless RunOptions.Force is set. Two containers started at the same time
+// may both be admitted.
+
+// meminfoPath is read for the memory of the host. It is a variable so tests
+// can override it.
+var meminfoPath = "/proc/meminfo"
+
+// Reservation is what a container reserves of the host.
+type Reservation struct {
+	// Memory is its memory.max, in bytes, zero without a limit.
+	Memory int64 `json:"memory,omitempty"`
+	// CPUs is its cpu.max quota over the period, zero without a limit.
+	CPUs float64 `json:"cpus,omitempty"`
+}
+
+// hostResources is what the host has for containers.
+type hostResources struct {
+	MemTotal     int64
+	MemAvailable int64
+	CPUs         float64
+}
+
+// specReservation returns what a container of spec reserves, from the
+// memory.max and cpu.max its cgroup is given, or nil if neither is limited.
+func specReservation(spec *specs.Spec) (*Reservation, error) {
+	if spec.Linux == nil || spec.Linux.Resources == nil {
+		return nil, nil
+	}
+	var r Reservation
+	unified := spec.Linux.Resources.Unified
+	if v, ok := unified["memory.max"]; ok && v != "max" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid memory.max %q", v)
+		}
+		r.Memory = n
+	}
+	if v, ok := unified["cpu.max"]; ok {
+		quota, period, _ := strings.Cut(v, " ")
+		if quota != "max" {
+			q, err := strconv.ParseInt(quota, 10, 64)
+			p := int64(cpuPeriod)
+			if period != "" && err == nil {
+				p, err = strconv.ParseInt(period, 10, 64)
+			}
+			if err != nil || q <= 0 || p <= 0 {
+				return nil, fmt.Errorf("invalid cpu.max %q", v)
+			}
+			r.CPUs = float64(q) / float64(p)
+		}
+	}
+	if r == (Reservation{}) {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// readHostResources returns the memory of the host and the CPUs the runtime
+// may run on, which its containers inherit.
+func readHostResources() (hostResources, error) {
+	var h hostResources
+	data, err := os.ReadFile(meminfoPath)
+	if err != nil {
+		return h, fmt.Errorf("failed to read host memory: %w", err)
+	}
+	if h.MemTotal, h.MemAvailable, err = parseMeminfo(data); err != nil {
+		return h, err
+	}
+	var set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &set); err != nil {
+		return h, fmt.Errorf("failed to read host CPUs: %w", err)
+	}
+	h.CPUs = float64(set.Count())
+	return h, nil
+}
+
+// parseMeminfo returns the MemTotal and MemAvailable of /proc/meminfo, in
+// bytes.
+func parseMeminfo(data []byte) (total, available int64, err error) {
+	found := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok || key != "MemTotal" && key != "MemAvailable" {
+			continue
+		}
+		kb, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s in %s: %q", key, meminfoPath, value)
+		}
+		if key == "MemTotal" {
+			total = kb << 10
+		} else {
+			available = kb << 10
+		}
+		found++
+	}
+	if found != 2 {
+		return 0, 0, fmt.Errorf("%s lacks MemTotal or MemAvailable", meminfoPath)
+	}
+	return total, available, nil
+}
+
+// reservedByOthers sums the reservations of the containers other than id
+// that are created or running.
+func reservedByOthers(id string) (Reservation, error) {
+	var sum Reservation
+	containers, err := FindContainers(StateFilter{Status: []Status{Created, Running, Starting}})
+	if err != nil {
+		return sum, err
+	}
+	for _, c := range containers {
+		refreshStatus(c)
+		if c.Id == id || c.Reservation == nil || c.Status == Stopped {
+			continue
+		}
+		sum.Memory += c.Reservation.Memory
+		sum.CPUs += c.Reservation.CPUs
+	}
+	return sum, nil
+}
+
+// admit checks that the host has what container id reserves, given what
+// the other containers reserve, returning an error wrapping
+// ErrInsufficientResources if not.
+func admit(id string, r *Reservation) error {
+	if r == nil {
+		return nil
+	}
+	host, err := readHostResources()
+	if err != nil {
+		return err
+	}
+	others, err := reservedByOthers(id)
+	if err != nil {
+		return err
+	}
+	return checkAdmission(id, *r, host, others)
+}
+
+// checkAdmission is admit with the host resources and reservations of the
+// other containers given.
+func checkAdmission(id string, r Reservation, host hostResources, others Reservation) error {
+	if r.Memory > 0 {
+		if left := host.MemTotal - others.Memory; r.Memory > left {
+			return fmt.Errorf("%w: container %s reserves %s of memory, but only %s of the host's %s isn't reserved by other containers",
+				ErrInsufficientResources, id, FormatBytes(r.Memory), FormatBytes(max(left, 0)), FormatBytes(host.MemTotal))
+		}
+		if r.Memory > host.MemAvailable {
+			return fmt.Errorf("%w: container %s reserves %s of memory, but only %s is available",
+				ErrInsufficientResources, id, FormatBytes(r.Memory), FormatBytes(host.MemAvailable))
+		}
+	}
+	if r.CPUs > 0 {
+		if left := host.CPUs - others.CPUs; r.CPUs > left+1e-9 {
+			return fmt.Errorf("%w: container %s reserves %g CPUs, but only %g of the host's %g aren't reserved by other containers",
+				ErrInsufficientResources, id, r.CPUs, max(left, 0), host.CPUs)
+		}
+	}
+	return nil
+}
+
+// FormatBytes formats n bytes with a binary unit, such as 1.5GiB.
+func FormatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1<<10 {
+		return fmt.Sprintf("%dB", n)
+	}
+	v, i := float64(n)/(1<<10), 0
+	for v >= 1<<10 && i < len(units)-1 {
+		v /= 1 << 10
+		i++
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(v, 'f', 1, 64), ".0") + string(units[i]) + "iB"
+}
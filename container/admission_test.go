@@ -0,0 +1,101 @@
+package container
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSpecReservation(t *testing.T) {
+	unified := func(u map[string]string) *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{Unified: u}}}
+	}
+	limited := &specs.Spec{}
+	limitResources(limited, 512<<20, 1.5)
+	for _, tt := range []struct {
+		name string
+		spec *specs.Spec
+		want *Reservation
+	}{
+		{"none", &specs.Spec{}, nil},
+		{"limits", limited, &Reservation{Memory: 512 << 20, CPUs: 1.5}},
+		{"unlimited", unified(map[string]string{"memory.max": "max", "cpu.max": "max 100000"}), nil},
+		{"quota only", unified(map[string]string{"cpu.max": "50000"}), &Reservation{CPUs: 0.5}},
+	} {
+		got, err := specReservation(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	for _, bad := range []map[string]string{{"memory.max": "lots"}, {"cpu.max": "1000 0"}} {
+		if _, err := specReservation(unified(bad)); err == nil {
+			t.Errorf("specReservation(%v) succeeded, expected an error", bad)
+		}
+	}
+}
+
+func TestParseMeminfo(t *testing.T) {
+	total, available, err := parseMeminfo([]byte("MemTotal:       16384 kB\nMemFree:         1024 kB\nMemAvailable:    8192 kB\n"))
+	if err != nil || total != 16<<20 || available != 8<<20 {
+		t.Errorf("got %d, %d, %v", total, available, err)
+	}
+	if _, _, err := parseMeminfo([]byte("MemTotal:       16384 kB\n")); err == nil {
+		t.Error("meminfo without MemAvailable succeeded, expected an error")
+	}
+}
+
+func TestCheckAdmission(t *testing.T) {
+	host := hostResources{MemTotal: 8 << 30, MemAvailable: 4 << 30, CPUs: 4}
+	for _, tt := range []struct {
+		name   string
+		r      Reservation
+		others Reservation
+		ok     bool
+	}{
+		{"fits", Reservation{Memory: 2 << 30, CPUs: 2}, Reservation{Memory: 4 << 30, CPUs: 2}, true},
+		{"memory reserved", Reservation{Memory: 2 << 30}, Reservation{Memory: 7 << 30}, false},
+		{"memory not free", Reservation{Memory: 5 << 30}, Reservation{}, false},
+		{"cpus reserved", Reservation{CPUs: 1.5}, Reservation{CPUs: 3}, false},
+		{"all cpus", Reservation{CPUs: 0.3}, Reservation{CPUs: 3.7}, true},
+	} {
+		err := checkAdmission("web", tt.r, host, tt.others)
+		if (err == nil) != tt.ok || err != nil && !errors.Is(err, ErrInsufficientResources) {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+}
+
+func TestReservedByOthers(t *testing.T) {
+	tempImages(t)
+	for _, c := range []*Container{
+		{Id: "db", Status: Created, Reservation: &Reservation{Memory: 1 << 30, CPUs: 1}},
+		{Id: "web", Status: Created, Reservation: &Reservation{Memory: 1 << 29}},
+		{Id: "old", Status: Stopped, Reservation: &Reservation{Memory: 1 << 30}},
+		{Id: "free", Status: Created},
+	} {
+		if _, err := createStateDir(c.Id); err != nil {
+			t.Fatal(err)
+		}
+		if err := saveState(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := reservedByOthers("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Reservation{Memory: 1 << 30, CPUs: 1}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{512: "512B", 1536: "1.5KiB", 512 << 20: "512MiB", 8 << 30: "8GiB"} {
+		if got := FormatBytes(n); got != want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
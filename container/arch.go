@@ -0,0 +1,21 @@
+package container
+
+// What differs between the architectures the runtime runs on is kept in
+// arch_<goarch>.go, with arch_other.go for the rest:
+//
+//   - nativeAuditArch is the audit architecture of the system calls
+//     seccomp filters by name and the tracer names, and nativeSeccompArch
+//     its name in linux.seccomp. It is zero where seccomp isn't supported.
+//   - x32Syscalls is set where the system calls of the x32 ABI share the
+//     native audit architecture, told apart by x32SyscallBit.
+//   - bigEndian is set where seccomp_data holds the high word of each
+//     64-bit argument first.
+//   - cloneFlagsArg is the argument of clone holding its flags, the
+//     second on s390x, which swaps the first two.
+//   - linux32 is set where the LINUX32 personality switches to a 32-bit
+//     execution domain.
+//
+// The system call names of the architectures seccomp supports are in
+// syscalls_<goarch>.go, generated by mksyscalls.go.
+
+//go:generate go run mksyscalls.go
@@ -0,0 +1,15 @@
+//go:build !amd64 && !arm64 && !ppc64le && !riscv64 && !s390x
+
+package container
+
+import "github.com/opencontainers/runtime-spec/specs-go"
+
+// See arch.go. Without a system call table seccomp isn't supported.
+const (
+	nativeAuditArch   = 0
+	nativeSeccompArch = specs.Arch("")
+	x32Syscalls       = false
+	bigEndian         = false
+	cloneFlagsArg     = 0
+	linux32           = false
+)
@@ -0,0 +1,16 @@
+package container
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// See arch.go.
+const (
+	nativeAuditArch   = unix.AUDIT_ARCH_PPC64LE
+	nativeSeccompArch = specs.ArchPPC64LE
+	x32Syscalls       = false
+	bigEndian         = false
+	cloneFlagsArg     = 0
+	linux32           = true
+)
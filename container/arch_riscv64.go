@@ -0,0 +1,16 @@
+package container
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// See arch.go.
+const (
+	nativeAuditArch   = unix.AUDIT_ARCH_RISCV64
+	nativeSeccompArch = specs.ArchRISCV64
+	x32Syscalls       = false
+	bigEndian         = false
+	cloneFlagsArg     = 0
+	linux32           = false
+)
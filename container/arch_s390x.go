@@ -0,0 +1,16 @@
+package container
+
+import (
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// See arch.go.
+const (
+	nativeAuditArch   = unix.AUDIT_ARCH_S390X
+	nativeSeccompArch = specs.ArchS390X
+	x32Syscalls       = false
+	bigEndian         = true
+	cloneFlagsArg     = 1
+	linux32           = true
+)
@@ -0,0 +1,273 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A bundle may define auxiliary processes in processes.json, next to
+// config.json: sidecars such as log shippers, started in the namespaces and
+// cgroup of the container once its init process runs, as exec starts a
+// process. The runtime supervising the container, its monitor when it is
+// detached, starts them in order, restarts them by their restart policy,
+// and stops them in reverse order before the init process when the
+// container is stopped. Those still running die with the container.
+
+// auxProcessesFile is the file of a bundle defining auxiliary processes.
+const auxProcessesFile = "processes.json"
+
+// AuxProcess is an auxiliary process defined by a bundle.
+type AuxProcess struct {
+	// Name identifies the process, and names its log, aux-<name>.log in
+	// the state dir.
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	// Env, User and Cwd are as the Env, User and Workdir of ExecOptions.
+	Env  []string `json:"env,omitempty"`
+	User string   `json:"user,omitempty"`
+	Cwd  string   `json:"cwd,omitempty"`
+	// Restart is a restart policy, as given to --restart, applied when
+	// the process exits. Empty means always.
+	Restart string `json:"restart,omitempty"`
+}
+
+// AuxProcessState is the state of an auxiliary process of a container.
+type AuxProcessState struct {
+	Name string `json:"name"`
+	// Status is ExecRunning or ExecExited.
+	Status    string     `json:"status"`
+	Pid       int        `json:"pid,omitempty"`
+	StartTime uint64     `json:"startTime,omitempty"`
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	ExitCode  *int       `json:"exitCode,omitempty"`
+	// Restarts is how many times the restart policy started it again.
+	Restarts int `json:"restarts,omitempty"`
+	// Error is why it failed to start.
+	Error string `json:"error,omitempty"`
+}
+
+// loadAuxProcesses returns the auxiliary processes of the bundle at dir,
+// none if it has no processes.json.
+func loadAuxProcesses(dir string) ([]AuxProcess, error) {
+	path := filepath.Join(dir, auxProcessesFile)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auxiliary processes: %w", err)
+	}
+	var procs []AuxProcess
+	if err := json.Unmarshal(data, &procs); err != nil {
+		return nil, fmt.Errorf("invalid auxiliary processes %s: %w", path, err)
+	}
+	if err := validateAuxProcesses(procs); err != nil {
+		return nil, fmt.Errorf("invalid auxiliary processes %s: %w", path, err)
+	}
+	return procs, nil
+}
+
+func validateAuxProcesses(procs []AuxProcess) error {
+	var names []string
+	for _, p := range procs {
+		if !objectNameRe.MatchString(p.Name) {
+			return fmt.Errorf("invalid process name %q", p.Name)
+		}
+		if slices.Contains(names, p.Name) {
+			return fmt.Errorf("process %s defined twice", p.Name)
+		}
+		names = append(names, p.Name)
+		if len(p.Args) == 0 || p.Args[0] == "" {
+			return fmt.Errorf("process %s: no command given", p.Name)
+		}
+		if _, err := execEnv(p.execOptions(), "/root"); err != nil {
+			return fmt.Errorf("process %s: %w", p.Name, err)
+		}
+		if _, err := p.restartPolicy(); err != nil {
+			return fmt.Errorf("process %s: %w", p.Name, err)
+		}
+	}
+	return nil
+}
+
+func (p AuxProcess) execOptions() ExecOptions {
+	return ExecOptions{Args: p.Args, Env: p.Env, User: p.User, Workdir: p.Cwd}
+}
+
+func (p AuxProcess) restartPolicy() (RestartPolicy, error) {
+	if p.Restart == "" {
+		return RestartPolicy{Name: RestartAlways}, nil
+	}
+	return ParseRestartPolicy(p.Restart)
+}
+
+// restartsAux reports whether policy starts again a process that exited
+// with code after restarts restarts.
+func restartsAux(policy RestartPolicy, code, restarts int) bool {
+	switch policy.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return code != 0 && (policy.MaxRetries == 0 || restarts < policy.MaxRetries)
+	}
+	return false
+}
+
+// superviseAuxProcesses starts the auxiliary processes of c in order once
+// it runs, and supervises them until ctx is done, when they are killed.
+func superviseAuxProcesses(ctx context.Context, c *Container) {
+	if len(c.AuxProcesses) == 0 {
+		return
+	}
+	if c = waitRunning(ctx, c); c == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, p := range c.AuxProcesses {
+		started := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			superviseAux(ctx, c, p, started)
+		}()
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// superviseAux runs p in c until its restart policy leaves it exited, the
+// container is stopped or ctx is done. started is closed once p has been
+// started, or failed to.
+func superviseAux(ctx context.Context, c *Container, p AuxProcess, started chan struct{}) {
+	defer func() {
+		if started != nil {
+			close(started)
+		}
+	}()
+	policy, _ := p.restartPolicy()
+	log, err := os.OpenFile(filepath.Join(StateDir(c.Id), "aux-"+p.Name+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to open the log of %s: %v\n", p.Name, err)
+		return
+	}
+	defer log.Close()
+
+	for restarts := 0; ; restarts++ {
+		cmd, _, err := startExec(c, p.execOptions(), nil, log, log)
+		if err != nil {
+			recordAux(c, p.Name, func(s *AuxProcessState) {
+				s.Status, s.Pid, s.Error = ExecExited, 0, err.Error()
+			})
+			fmt.Fprintf(os.Stderr, "warning: failed to start %s in %s: %v\n", p.Name, c.Id, err)
+			return
+		}
+		now := time.Now()
+		startTime, _ := processStartTime(cmd.Process.Pid)
+		recordAux(c, p.Name, func(s *AuxProcessState) {
+			s.Status, s.Pid, s.StartTime, s.StartedAt = ExecRunning, cmd.Process.Pid, startTime, &now
+			s.ExitCode, s.Restarts, s.Error = nil, restarts, ""
+		})
+		fmt.Fprintf(stageOut, "MONITOR: Started %s in %s, pid %d\n", p.Name, c.Id, cmd.Process.Pid)
+		if started != nil {
+			close(started)
+			started = nil
+		}
+
+		stopKill := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+		code, _ := exitCode(cmd.Wait())
+		stopKill()
+		recordAux(c, p.Name, func(s *AuxProcessState) {
+			s.Status, s.ExitCode = ExecExited, &code
+		})
+		if ctx.Err() != nil || !restartsAux(policy, code, restarts) || stopping(c) {
+			return
+		}
+		fmt.Fprintf(stageOut, "MONITOR: %s of %s exited with code %d, restarting\n", p.Name, c.Id, code)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay(restarts)):
+		}
+	}
+}
+
+// recordAux applies update to the state of the auxiliary process name of c,
+// unless c was started again meanwhile.
+func recordAux(c *Container, name string, update func(*AuxProcessState)) {
+	err := updateState(c.Id, func(s *Container) error {
+		if s.InitProcessPiD != c.InitProcessPiD {
+			return nil
+		}
+		i := slices.IndexFunc(s.AuxStatus, func(st AuxProcessState) bool { return st.Name == name })
+		if i < 0 {
+			s.AuxStatus = append(s.AuxStatus, AuxProcessState{Name: name})
+			i = len(s.AuxStatus) - 1
+		}
+		update(&s.AuxStatus[i])
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
+
+// stopping reports whether c is being stopped, or already has been.
+func stopping(c *Container) bool {
+	s, err := LoadState(c.Id)
+	return err != nil || s.ManuallyStopped || !s.Status.running() || s.InitProcessPiD != c.InitProcessPiD
+}
+
+// waitRunning waits until the init process of c, which may only have been
+// created, runs, and returns the state then. It returns nil if c stops or
+// is started again first, or ctx is done.
+func waitRunning(ctx context.Context, c *Container) *Container {
+	for {
+		s, err := LoadState(c.Id)
+		if err != nil || s.InitProcessPiD != c.InitProcessPiD || s.Status == Stopped {
+			return nil
+		}
+		if s.Status.running() {
+			return s
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// stopAuxProcesses stops the running auxiliary processes of c, last
+// started first, giving each timeout to exit after SIGTERM.
+func stopAuxProcesses(ctx context.Context, c *Container, timeout time.Duration) {
+	for i := len(c.AuxStatus) - 1; i >= 0; i-- {
+		st := c.AuxStatus[i]
+		if st.Status != ExecRunning {
+			continue
+		}
+		pidfd, err := unix.PidfdOpen(st.Pid, 0)
+		if err != nil {
+			continue
+		}
+		// A pid reused since isn't the process.
+		if start, err := processStartTime(st.Pid); err == nil && start == st.StartTime {
+			if _, err := terminate(ctx, pidfd, unix.SIGTERM, timeout); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to stop %s of %s: %v\n", st.Name, c.Id, err)
+			}
+		}
+		unix.Close(pidfd)
+	}
+}
@@ -0,0 +1,63 @@
+package container
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuxProcesses(t *testing.T) {
+	dir := t.TempDir()
+	if procs, err := loadAuxProcesses(dir); err != nil || procs != nil {
+		t.Fatalf("got %v, %v for a bundle without processes", procs, err)
+	}
+
+	path := filepath.Join(dir, auxProcessesFile)
+	writeFile(t, path, `[{"name": "shipper", "args": ["/bin/vector"], "env": ["A=1"], "restart": "on-failure:3"}, {"name": "cron", "args": ["/bin/crond", "-f"]}]`, 0o644)
+	procs, err := loadAuxProcesses(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procs) != 2 || procs[0].Name != "shipper" || procs[1].Args[1] != "-f" {
+		t.Fatalf("got %+v", procs)
+	}
+	if policy, _ := procs[1].restartPolicy(); policy.Name != RestartAlways {
+		t.Errorf("default restart policy = %v, want always", policy)
+	}
+
+	for _, bad := range []string{
+		`{"name": "shipper"}`,
+		`[{"name": "a b", "args": ["/x"]}]`,
+		`[{"name": "a", "args": []}]`,
+		`[{"name": "a", "args": ["/x"]}, {"name": "a", "args": ["/y"]}]`,
+		`[{"name": "a", "args": ["/x"], "restart": "sometimes"}]`,
+		`[{"name": "a", "args": ["/x"], "env": ["=1"]}]`,
+	} {
+		writeFile(t, path, bad, 0o644)
+		if _, err := loadAuxProcesses(dir); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func TestRestartsAux(t *testing.T) {
+	for _, tt := range []struct {
+		policy         string
+		code, restarts int
+		want           bool
+	}{
+		{"always", 0, 10, true},
+		{"no", 1, 0, false},
+		{"on-failure", 0, 0, false},
+		{"on-failure", 1, 100, true},
+		{"on-failure:2", 1, 1, true},
+		{"on-failure:2", 1, 2, false},
+	} {
+		policy, err := ParseRestartPolicy(tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := restartsAux(policy, tt.code, tt.restarts); got != tt.want {
+			t.Errorf("restartsAux(%s, %d, %d) = %v", tt.policy, tt.code, tt.restarts, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package container
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A batch file lists containers to run at once with run-batch, for load
+// testing or demos:
+//
+//	parallel: 4
+//	containers:
+//	  - id: web
+//	    image: nginx:1.27
+//	    replicas: 3 # web-1, web-2 and web-3
+//	    env: [MODE=demo]
+//	  - id: worker
+//	    bundle: ./worker
+//	    preset: small
+//	    requires: [web]
+//
+// As in presets, the settings of a container are the values of the run
+// flags they stand for. Relative bundles are resolved against the
+// directory of the file. A container of the batch that others require is
+// run before them, and one with replicas stands for all of them.
+
+// Batch is a batch file.
+type Batch struct {
+	// Parallel bounds how many containers are started at once, if set.
+	Parallel   int              `yaml:"parallel"`
+	Containers []BatchContainer `yaml:"containers"`
+}
+
+// BatchContainer is a container of a batch file.
+type BatchContainer struct {
+	ID string `yaml:"id"`
+	// Replicas runs that many containers, <id>-1 to <id>-<n>, rather than
+	// one named id.
+	Replicas int `yaml:"replicas,omitempty"`
+	// Preset is a --preset value, whose settings the others override.
+	Preset string `yaml:"preset,omitempty"`
+	// Image is an --image value, and Command the command replacing that of
+	// the image.
+	Image   string   `yaml:"image,omitempty"`
+	Command []string `yaml:"command,omitempty"`
+	// Bundle and Config are --bundle and --config values.
+	Bundle string `yaml:"bundle,omitempty"`
+	Config string `yaml:"config,omitempty"`
+	// Volumes, Tmpfs and Env are -v, --tmpfs and -e values.
+	Volumes []string `yaml:"volumes,omitempty"`
+	Tmpfs   []string `yaml:"tmpfs,omitempty"`
+	Env     []string `yaml:"env,omitempty"`
+	// Memory, CPUs, StorageSize, Network and Restart are the values of
+	// the run flags of the same names.
+	Memory      string `yaml:"memory,omitempty"`
+	CPUs        string `yaml:"cpus,omitempty"`
+	StorageSize string `yaml:"storageSize,omitempty"`
+	Network     string `yaml:"network,omitempty"`
+	Restart     string `yaml:"restart,omitempty"`
+	// Requires, RequiresCondition and RequiresTimeout are the --requires,
+	// --requires-condition and --requires-timeout values.
+	Requires          []string `yaml:"requires,omitempty"`
+	RequiresCondition string   `yaml:"requiresCondition,omitempty"`
+	RequiresTimeout   string   `yaml:"requiresTimeout,omitempty"`
+}
+
+// LoadBatch reads the batch file at path, with its replicas expanded into
+// containers of their own.
+func LoadBatch(path string) (*Batch, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch file: %w", err)
+	}
+	var b Batch
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&b); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid batch file %s: %w", path, err)
+	}
+	if err := b.expand(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("invalid batch file %s: %w", path, err)
+	}
+	return &b, nil
+}
+
+// expand checks b, expands its replicas and resolves its bundles against
+// dir.
+func (b *Batch) expand(dir string) error {
+	if b.Parallel < 0 {
+		return fmt.Errorf("invalid parallel %d", b.Parallel)
+	}
+	if len(b.Containers) == 0 {
+		return fmt.Errorf("no containers")
+	}
+	var containers []BatchContainer
+	seen := map[string]bool{}
+	// replicas are the ids of the containers of the entries with replicas.
+	replicas := map[string][]string{}
+	for _, c := range b.Containers {
+		if c.Replicas < 0 {
+			return fmt.Errorf("invalid replicas %d of %s", c.Replicas, c.ID)
+		}
+		if len(c.Command) > 0 && c.Image == "" {
+			return fmt.Errorf("the command of %s requires an image", c.ID)
+		}
+		if c.RequiresCondition != "" && c.RequiresCondition != WaitReady && c.RequiresCondition != WaitHealthy {
+			return fmt.Errorf("invalid requiresCondition %q of %s", c.RequiresCondition, c.ID)
+		}
+		if c.RequiresTimeout != "" {
+			if _, err := time.ParseDuration(c.RequiresTimeout); err != nil {
+				return fmt.Errorf("invalid requiresTimeout %q of %s", c.RequiresTimeout, c.ID)
+			}
+		}
+		if c.Bundle != "" && !filepath.IsAbs(c.Bundle) {
+			c.Bundle = filepath.Join(dir, c.Bundle)
+		}
+		ids := []string{c.ID}
+		if c.Replicas > 0 {
+			ids = ids[:0]
+			for i := 1; i <= c.Replicas; i++ {
+				ids = append(ids, c.ID+"-"+strconv.Itoa(i))
+			}
+			replicas[c.ID] = ids
+		}
+		for _, id := range ids {
+			if !objectNameRe.MatchString(id) {
+				return fmt.Errorf("invalid container id %q", id)
+			}
+			if seen[id] {
+				return fmt.Errorf("container %s is listed twice", id)
+			}
+			seen[id] = true
+			r := c
+			r.ID, r.Replicas = id, 0
+			containers = append(containers, r)
+		}
+	}
+	for i, c := range containers {
+		var requires []string
+		for _, id := range c.Requires {
+			if ids, ok := replicas[id]; ok {
+				requires = append(requires, ids...)
+			} else {
+				requires = append(requires, id)
+			}
+		}
+		containers[i].Requires = requires
+	}
+	b.Containers = containers
+	if _, err := b.Levels(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Levels orders the containers of b so each comes in a level after those
+// of the batch it requires.
+func (b *Batch) Levels() ([][]BatchContainer, error) {
+	ids := make([]string, len(b.Containers))
+	byID := map[string]BatchContainer{}
+	deps := map[string][]string{}
+	for i, c := range b.Containers {
+		ids[i] = c.ID
+		byID[c.ID] = c
+		deps[c.ID] = c.Requires
+	}
+	idLevels, err := dependencyLevels(ids, deps)
+	if err != nil {
+		return nil, err
+	}
+	levels := make([][]BatchContainer, len(idLevels))
+	for i, level := range idLevels {
+		for _, id := range level {
+			levels[i] = append(levels[i], byID[id])
+		}
+	}
+	return levels, nil
+}
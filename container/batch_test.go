@@ -0,0 +1,69 @@
+package container
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadBatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "batch.yaml")
+	writeFile(t, path, `parallel: 2
+containers:
+  - id: web
+    image: alpine:3.20
+    command: [sleep, "60"]
+    replicas: 2
+    env: [MODE=demo]
+  - id: worker
+    bundle: worker
+    memory: 64m
+    requires: [web, db]
+    requiresCondition: healthy
+`, 0o644)
+
+	b, err := LoadBatch(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Parallel != 2 {
+		t.Errorf("Parallel = %d, want 2", b.Parallel)
+	}
+	want := []BatchContainer{
+		{ID: "web-1", Image: "alpine:3.20", Command: []string{"sleep", "60"}, Env: []string{"MODE=demo"}},
+		{ID: "web-2", Image: "alpine:3.20", Command: []string{"sleep", "60"}, Env: []string{"MODE=demo"}},
+		{ID: "worker", Bundle: filepath.Join(dir, "worker"), Memory: "64m", Requires: []string{"web-1", "web-2", "db"}, RequiresCondition: WaitHealthy},
+	}
+	if !reflect.DeepEqual(b.Containers, want) {
+		t.Errorf("Containers = %+v, want %+v", b.Containers, want)
+	}
+	levels, err := b.Levels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || !reflect.DeepEqual(levels[0], want[:2]) || !reflect.DeepEqual(levels[1], want[2:]) {
+		t.Errorf("Levels = %+v, want the replicas of web, then worker", levels)
+	}
+
+	for name, data := range map[string]string{
+		"empty":      ``,
+		"unknown":    "containers:\n  - id: a\n    memroy: 1g\n",
+		"parallel":   "parallel: -1\ncontainers:\n  - id: a\n",
+		"replicas":   "containers:\n  - id: a\n    replicas: -2\n",
+		"command":    "containers:\n  - id: a\n    command: [sh]\n",
+		"id":         "containers:\n  - id: a/b\n",
+		"noid":       "containers:\n  - bundle: /b\n",
+		"duplicate":  "containers:\n  - id: a\n  - id: a\n",
+		"replicated": "containers:\n  - id: a-1\n  - id: a\n    replicas: 2\n",
+		"cycle":      "containers:\n  - id: a\n    requires: [b]\n  - id: b\n    requires: [a]\n",
+		"condition":  "containers:\n  - id: a\n    requiresCondition: stopped\n",
+		"timeout":    "containers:\n  - id: a\n    requiresTimeout: soon\n",
+	} {
+		path := filepath.Join(dir, name+".yaml")
+		writeFile(t, path, data, 0o644)
+		if _, err := LoadBatch(path); err == nil {
+			t.Errorf("LoadBatch(%s) succeeded, expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package container
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The start bench times the startup of containers, to evaluate changes to the
+// storage or the handshake of the init stages: it runs containers one after
+// the other, detached, and destroys each once its process has executed,
+// taking the Duration of each phase from their progress events. Three more
+// are timed by the bench itself:
+//
+//	exec     from PhaseStart starting until the container process executes
+//	startup  from the start of Run until then
+//	destroy  killing and deleting the container
+
+// Phases of BenchStart besides those of the progress events.
+const (
+	BenchExec    = "exec"
+	BenchStartup = "startup"
+	BenchDestroy = "destroy"
+)
+
+// benchPhases are the phases of a BenchResult, in order.
+var benchPhases = []string{PhaseRootfs, PhaseCreate, PhaseClone, PhaseMounts, PhasePivot, PhaseNetwork, PhaseStart, BenchExec, BenchStartup, BenchDestroy}
+
+// benchExecTimeout bounds the wait for the process of a container to
+// execute.
+const benchExecTimeout = 10 * time.Second
+
+// BenchResult is what BenchStart measured.
+type BenchResult struct {
+	Iterations int `json:"iterations"`
+	// Phases are those that were seen, in the order containers go through
+	// them.
+	Phases []BenchPhase `json:"phases"`
+}
+
+// BenchPhase is how long a phase took over the iterations of a bench.
+type BenchPhase struct {
+	Name    string          `json:"name"`
+	Samples []time.Duration `json:"samples"`
+	P50     time.Duration   `json:"p50"`
+	P95     time.Duration   `json:"p95"`
+}
+
+// BenchStart runs iterations containers from the spec at specPath with
+// opts, one at a time, named bench-<pid>-<n>, and returns how long their
+// phases took. A container that fails to start ends the bench.
+func (r *Runtime) BenchStart(ctx context.Context, specPath string, iterations int, opts ...CreateOption) (*BenchResult, error) {
+	if iterations <= 0 {
+		return nil, fmt.Errorf("invalid iteration count %d: must be positive", iterations)
+	}
+	samples := map[string][]time.Duration{}
+	for i := 1; i <= iterations; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		id := fmt.Sprintf("bench-%d-%d", os.Getpid(), i)
+		durations, err := r.benchOnce(ctx, id, specPath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("iteration %d: %w", i, err)
+		}
+		for phase, d := range durations {
+			samples[phase] = append(samples[phase], d)
+		}
+	}
+	result := &BenchResult{Iterations: iterations}
+	for _, name := range benchPhases {
+		if s := samples[name]; len(s) > 0 {
+			result.Phases = append(result.Phases, BenchPhase{Name: name, Samples: s, P50: percentile(s, 50), P95: percentile(s, 95)})
+		}
+	}
+	return result, nil
+}
+
+// benchOnce runs and destroys container id, returning how long its phases
+// took.
+func (r *Runtime) benchOnce(ctx context.Context, id, specPath string, opts []CreateOption) (map[string]time.Duration, error) {
+	var mu sync.Mutex
+	durations := map[string]time.Duration{}
+	var released time.Time
+	progress := func(e ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case e.Phase == PhaseStart && e.Status == ProgressStarted:
+			released = e.Time
+		case e.Status == ProgressDone && e.Duration > 0:
+			durations[e.Phase] = e.Duration
+		}
+	}
+	opts = append(opts[:len(opts):len(opts)], Detached(), Quiet(), WithProgress(progress))
+
+	start := time.Now()
+	runErr := r.Run(ctx, id, specPath, opts...)
+	var pid int
+	if c, err := LoadState(id); err == nil {
+		pid = c.InitProcessPiD
+	} else if runErr == nil {
+		runErr = err
+	}
+	if runErr == nil {
+		runErr = waitExec(pid, benchExecTimeout)
+	}
+	executed := time.Now()
+
+	destroyStart := time.Now()
+	if err := r.benchDestroy(id); err != nil && runErr == nil {
+		runErr = err
+	}
+	if runErr != nil {
+		return nil, runErr
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !released.IsZero() {
+		durations[BenchExec] = executed.Sub(released)
+	}
+	durations[BenchStartup] = executed.Sub(start)
+	durations[BenchDestroy] = time.Since(destroyStart)
+	return durations, nil
+}
+
+// benchDestroy kills and deletes container id, if it got as far as having a
+// state.
+func (r *Runtime) benchDestroy(id string) error {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil
+	}
+	if c.Status != Stopped {
+		if err := stopContainer(context.Background(), id, unix.SIGKILL, time.Second); err != nil {
+			return err
+		}
+	}
+	return r.Delete(id)
+}
+
+// waitExec waits up to timeout for process pid, a child stage, to execute
+// the container process, which it does when its executable is no longer
+// ours. A process that is gone already did.
+func waitExec(pid int, timeout time.Duration) error {
+	self, err := os.Stat("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		exe, err := os.Stat(fmt.Sprintf("/proc/%d/exe", pid))
+		if err != nil || !os.SameFile(exe, self) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container process didn't execute within %v", timeout)
+		}
+		time.Sleep(200 * time.Microsecond)
+	}
+}
+
+// percentile returns the p-th percentile of samples, by nearest rank.
+func percentile[T cmp.Ordered](samples []T, p int) T {
+	if len(samples) == 0 {
+		var zero T
+		return zero
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	rank := (p*len(sorted) + 99) / 100
+	return sorted[max(rank, 1)-1]
+}
@@ -0,0 +1,58 @@
+package container
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var samples []time.Duration
+	for i := 20; i >= 1; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	for _, c := range []struct {
+		p    int
+		want time.Duration
+	}{
+		{50, 10 * time.Millisecond},
+		{95, 19 * time.Millisecond},
+		{100, 20 * time.Millisecond},
+		{0, time.Millisecond},
+	} {
+		if got := percentile(samples, c.p); got != c.want {
+			t.Errorf("percentile(%d) = %v, want %v", c.p, got, c.want)
+		}
+	}
+	if samples[0] != 20*time.Millisecond {
+		t.Errorf("percentile sorted the samples given")
+	}
+	if got := percentile([]time.Duration{3 * time.Millisecond}, 95); got != 3*time.Millisecond {
+		t.Errorf("percentile of one sample = %v", got)
+	}
+	if got := percentile[time.Duration](nil, 50); got != 0 {
+		t.Errorf("percentile of no samples = %v", got)
+	}
+}
+
+func TestWaitExec(t *testing.T) {
+	// This process hasn't executed anything else.
+	if err := waitExec(os.Getpid(), 10*time.Millisecond); err == nil {
+		t.Errorf("waitExec of ourselves succeeded")
+	}
+	// A process that is gone did.
+	if err := waitExec(1<<22+1, time.Second); err != nil {
+		t.Errorf("waitExec of a missing process: %v", err)
+	}
+}
+
+func TestBenchStartIterations(t *testing.T) {
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.BenchStart(context.Background(), "config.json", 0); err == nil {
+		t.Errorf("expected error for no iterations")
+	}
+}
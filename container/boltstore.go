@@ -0,0 +1,403 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The bolt store keeps the state of every container as JSON, keyed by id,
+// in the containers bucket. Two index buckets map to ids without values:
+// status holds "<status>\x00<id>" keys and annotations holds
+// "<key>\x00<value>\x00<id>" keys, so containers with a status or an
+// annotation are found with a prefix scan. The names bucket maps the name
+// of each named container to its id, and the leases bucket each leased
+// address, as "<network>\x00<address>", to the id of its holder.
+
+// stateDBName is the database of BoltStateStore in the base state dir.
+const stateDBName = "state.db"
+
+// stateDBTimeout bounds how long to wait for another process holding the
+// database. The database is opened for each operation, so the lock is only
+// held briefly.
+const stateDBTimeout = 5 * time.Second
+
+var (
+	containersBucket  = []byte("containers")
+	statusBucket      = []byte("status")
+	annotationsBucket = []byte("annotations")
+	namesBucket       = []byte("names")
+	leasesBucket      = []byte("leases")
+)
+
+// boltStore is BoltStateStore.
+type boltStore struct{}
+
+func (boltStore) path() string {
+	return filepath.Join(baseStateDir, stateDBName)
+}
+
+// update runs fn in a read-write transaction, creating the database and
+// its buckets on first use.
+func (s boltStore) update(fn func(*bolt.Tx) error) error {
+	if err := os.MkdirAll(baseStateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+	db, err := bolt.Open(s.path(), 0o600, &bolt.Options{Timeout: stateDBTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to open state database: %w", err)
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{containersBucket, statusBucket, annotationsBucket, namesBucket, leasesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", name, err)
+			}
+		}
+		return fn(tx)
+	})
+}
+
+// view runs fn in a read-only transaction. fn isn't called when there is
+// no database yet.
+func (s boltStore) view(fn func(*bolt.Tx) error) error {
+	// A read-only open doesn't fail on a missing database, it tries to
+	// initialise one.
+	if _, err := os.Stat(s.path()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := bolt.Open(s.path(), 0o600, &bolt.Options{Timeout: stateDBTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to open state database: %w", err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(containersBucket) == nil {
+			return nil
+		}
+		return fn(tx)
+	})
+}
+
+func (s boltStore) Load(id string) (*Container, error) {
+	var c *Container
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		c, err = getContainer(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, fmt.Errorf("container %s %w", id, ErrNotFound)
+	}
+	return c, nil
+}
+
+func (s boltStore) Save(c *Container) error {
+	return s.update(func(tx *bolt.Tx) error {
+		old, err := getContainer(tx, c.Id)
+		if err != nil {
+			return err
+		}
+		return putContainer(tx, old, c)
+	})
+}
+
+func (s boltStore) Update(id string, fn func(*Container) error) error {
+	return s.update(func(tx *bolt.Tx) error {
+		old, err := getContainer(tx, id)
+		if err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("container %s %w", id, ErrNotFound)
+		}
+		// fn gets its own copy, as old is needed to drop stale index
+		// entries.
+		c, err := getContainer(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+		return putContainer(tx, old, c)
+	})
+}
+
+func (s boltStore) Delete(id string) error {
+	if _, err := os.Stat(s.path()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return s.update(func(tx *bolt.Tx) error {
+		old, err := getContainer(tx, id)
+		if err != nil || old == nil {
+			return err
+		}
+		if err := deleteIndexes(tx, old); err != nil {
+			return err
+		}
+		return tx.Bucket(containersBucket).Delete([]byte(id))
+	})
+}
+
+func (s boltStore) IDs(prefix string) ([]string, error) {
+	var ids []string
+	err := s.view(func(tx *bolt.Tx) error {
+		c := tx.Bucket(containersBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s boltStore) NameID(name string) (string, error) {
+	var id string
+	err := s.view(func(tx *bolt.Tx) error {
+		// A database from before names has no names bucket.
+		if b := tx.Bucket(namesBucket); b != nil {
+			id = string(b.Get([]byte(name)))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", fmt.Errorf("container name %s %w", name, ErrNotFound)
+	}
+	return id, nil
+}
+
+func (s boltStore) Leases(network string) ([]AddressLease, error) {
+	var leases []AddressLease
+	err := s.view(func(tx *bolt.Tx) error {
+		// A database from before leases has no leases bucket.
+		if b := tx.Bucket(leasesBucket); b != nil {
+			leases = scanLeases(b, network)
+		}
+		return nil
+	})
+	return leases, err
+}
+
+func (s boltStore) Lease(l AddressLease) error {
+	return s.update(func(tx *bolt.Tx) error {
+		key := leaseKey(l.Network, l.Address)
+		b := tx.Bucket(leasesBucket)
+		if id := b.Get(key); id != nil && string(id) != l.Container && tx.Bucket(containersBucket).Get(id) != nil {
+			return fmt.Errorf("address %s of network %s %w, container %s holds it", l.Address, l.Network, ErrExists, id)
+		}
+		if err := b.Put(key, []byte(l.Container)); err != nil {
+			return fmt.Errorf("failed to lease address %s: %w", l.Address, err)
+		}
+		return nil
+	})
+}
+
+func (s boltStore) Release(id string) ([]AddressLease, error) {
+	if _, err := os.Stat(s.path()); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	var released []AddressLease
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(leasesBucket)
+		for _, l := range scanLeases(b, "") {
+			if l.Container != id {
+				continue
+			}
+			if err := b.Delete(leaseKey(l.Network, l.Address)); err != nil {
+				return fmt.Errorf("failed to release address %s: %w", l.Address, err)
+			}
+			released = append(released, l)
+		}
+		return nil
+	})
+	return released, err
+}
+
+// scanLeases returns the leases of b on network, or every network when it
+// is empty.
+func scanLeases(b *bolt.Bucket, network string) []AddressLease {
+	var prefix []byte
+	if network != "" {
+		prefix = append([]byte(network), 0)
+	}
+	var leases []AddressLease
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		n, addr, _ := bytes.Cut(k, []byte{0})
+		leases = append(leases, AddressLease{Network: string(n), Address: string(addr), Container: string(v)})
+	}
+	return leases
+}
+
+func leaseKey(network, address string) []byte {
+	return []byte(network + "\x00" + address)
+}
+
+// List uses the indexes to find the containers matching filter, and only
+// decodes those.
+func (s boltStore) List(filter StateFilter) ([]*Container, error) {
+	var containers []*Container
+	err := s.view(func(tx *bolt.Tx) error {
+		ids, all := filteredIds(tx, filter)
+		if all {
+			return tx.Bucket(containersBucket).ForEach(func(k, v []byte) error {
+				c, err := decodeContainer(k, v)
+				if err != nil {
+					return err
+				}
+				containers = append(containers, c)
+				return nil
+			})
+		}
+		for _, id := range ids {
+			c, err := getContainer(tx, id)
+			if err != nil {
+				return err
+			}
+			if c != nil && filter.Match(c) {
+				containers = append(containers, c)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// filteredIds returns the sorted ids of the containers matching filter
+// according to the indexes, or all if filter matches every container.
+func filteredIds(tx *bolt.Tx, filter StateFilter) (ids []string, all bool) {
+	var sets [][]string
+	if len(filter.Status) > 0 {
+		var set []string
+		for _, st := range filter.Status {
+			set = append(set, scanIndex(tx.Bucket(statusBucket), statusPrefix(st))...)
+		}
+		sets = append(sets, set)
+	}
+	for k, v := range filter.Annotations {
+		sets = append(sets, scanIndex(tx.Bucket(annotationsBucket), annotationPrefix(k, v)))
+	}
+	if len(sets) == 0 {
+		return nil, true
+	}
+
+	ids = sets[0]
+	for _, set := range sets[1:] {
+		ids = slices.DeleteFunc(ids, func(id string) bool { return !slices.Contains(set, id) })
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), false
+}
+
+// scanIndex returns the ids of the index keys starting with prefix.
+func scanIndex(b *bolt.Bucket, prefix []byte) []string {
+	var ids []string
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, string(k[len(prefix):]))
+	}
+	return ids
+}
+
+func statusPrefix(st Status) []byte {
+	return []byte(st.String() + "\x00")
+}
+
+func annotationPrefix(key, value string) []byte {
+	return []byte(key + "\x00" + value + "\x00")
+}
+
+// getContainer returns the state of the container with id, or nil if
+// there is none.
+func getContainer(tx *bolt.Tx, id string) (*Container, error) {
+	v := tx.Bucket(containersBucket).Get([]byte(id))
+	if v == nil {
+		return nil, nil
+	}
+	return decodeContainer([]byte(id), v)
+}
+
+func decodeContainer(id, v []byte) (*Container, error) {
+	var c Container
+	if err := json.Unmarshal(v, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode state of %s: %w", id, err)
+	}
+	return &c, nil
+}
+
+// putContainer saves c and moves its index entries from those of old,
+// which is nil for a new container.
+func putContainer(tx *bolt.Tx, old, c *Container) error {
+	if old != nil {
+		if err := deleteIndexes(tx, old); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode container state: %w", err)
+	}
+	if c.Name != "" {
+		names := tx.Bucket(namesBucket)
+		if id := names.Get([]byte(c.Name)); id != nil && string(id) != c.Id {
+			return fmt.Errorf("container name %s %w, container %s has it", c.Name, ErrExists, id)
+		}
+		if err := names.Put([]byte(c.Name), []byte(c.Id)); err != nil {
+			return fmt.Errorf("failed to index %s: %w", c.Id, err)
+		}
+	}
+	if err := tx.Bucket(containersBucket).Put([]byte(c.Id), data); err != nil {
+		return fmt.Errorf("failed to save state of %s: %w", c.Id, err)
+	}
+	for _, k := range indexKeys(c) {
+		if err := tx.Bucket(k.bucket).Put(k.key, nil); err != nil {
+			return fmt.Errorf("failed to index %s: %w", c.Id, err)
+		}
+	}
+	return nil
+}
+
+func deleteIndexes(tx *bolt.Tx, c *Container) error {
+	for _, k := range indexKeys(c) {
+		if err := tx.Bucket(k.bucket).Delete(k.key); err != nil {
+			return fmt.Errorf("failed to unindex %s: %w", c.Id, err)
+		}
+	}
+	if names := tx.Bucket(namesBucket); c.Name != "" && string(names.Get([]byte(c.Name))) == c.Id {
+		if err := names.Delete([]byte(c.Name)); err != nil {
+			return fmt.Errorf("failed to unindex %s: %w", c.Id, err)
+		}
+	}
+	return nil
+}
+
+type indexKey struct {
+	bucket []byte
+	key    []byte
+}
+
+// indexKeys returns the index entries of c.
+func indexKeys(c *Container) []indexKey {
+	keys := []indexKey{{statusBucket, append(statusPrefix(c.Status), c.Id...)}}
+	for k, v := range c.Annotations {
+		keys = append(keys, indexKey{annotationsBucket, append(annotationPrefix(k, v), c.Id...)})
+	}
+	return keys
+}
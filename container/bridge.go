@@ -0,0 +1,155 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// ipForwardPath is the sysctl enabling IPv4 forwarding for NAT.
+var ipForwardPath = "/proc/sys/net/ipv4/ip_forward"
+
+// natTablePrefix starts the names of the host NAT tables of networks.
+const natTablePrefix = "containish-"
+
+// natTable is the host nftables table masquerading the traffic of a network.
+func natTable(n *Network) string {
+	return natTablePrefix + n.Bridge
+}
+
+// natRuleset renders the host table that masquerades traffic leaving the
+// network's subnet. Declaring and deleting the table first makes loading it
+// idempotent.
+func natRuleset(n *Network) string {
+	t := natTable(n)
+	return fmt.Sprintf(`table ip %[1]s
+delete table ip %[1]s
+table ip %[1]s {
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr %[2]s ip daddr != %[2]s masquerade
+	}
+}
+`, t, n.Subnet)
+}
+
+// ensureBridge creates the bridge device of a network with its gateway
+// address and NAT rules, if they are missing. It is called on every attach
+// since none of it survives a reboot.
+func ensureBridge(n *Network) error {
+	_, ipnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return fmt.Errorf("network %s has an invalid subnet: %w", n.Name, err)
+	}
+	if _, err := exec.LookPath(nftBinary); err != nil {
+		return fmt.Errorf("nftables is required for bridge networks: %w", err)
+	}
+
+	if _, err := net.InterfaceByName(n.Bridge); err != nil {
+		if err := linkAdd(n.Bridge, attrNested(unix.IFLA_LINKINFO, attrString(unix.IFLA_INFO_KIND, "bridge"))); err != nil {
+			return err
+		}
+		gw := &net.IPNet{IP: net.ParseIP(n.Gateway), Mask: ipnet.Mask}
+		if err := addrAdd(n.Bridge, gw); err != nil && !errors.Is(err, unix.EEXIST) {
+			_ = linkDel(n.Bridge)
+			return err
+		}
+	}
+	if err := linkSetUp(n.Bridge); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(ipForwardPath, []byte("1"), 0o644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %w", err)
+	}
+	return runNft(natRuleset(n))
+}
+
+// removeBridge deletes the bridge device and NAT table of a network.
+func removeBridge(n *Network) error {
+	if _, err := net.InterfaceByName(n.Bridge); err == nil {
+		if err := linkDel(n.Bridge); err != nil {
+			return err
+		}
+	}
+	t := natTable(n)
+	return runNft(fmt.Sprintf("table ip %[1]s\ndelete table ip %[1]s\n", t))
+}
+
+// setupBridge attaches container id, whose init process is pid, to the
+// bridge network named in cfg through a veth pair, leasing its address and
+// pointing its resolver at the network's DNS server.
+func setupBridge(id string, pid int, rootfs string, cfg *NetworkConfig) error {
+	n, err := LoadNetwork(cfg.Name)
+	if err != nil {
+		return err
+	}
+	if cfg.Address, err = leaseAddress(n, id, cfg.Address); err != nil {
+		return err
+	}
+	cfg.Gateway = n.Gateway
+
+	if err := ensureBridge(n); err != nil {
+		return err
+	}
+	bridge, err := net.InterfaceByName(n.Bridge)
+	if err != nil {
+		return fmt.Errorf("bridge %s not found: %w", n.Bridge, err)
+	}
+
+	suffix, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	hostVeth := "veth" + suffix
+	// Create the pair with its peer already inside the container namespace.
+	peer := nlAttr{
+		typ:  vethInfoPeer,
+		data: ifInfoMsg(0, 0, 0),
+		children: []nlAttr{
+			attrString(unix.IFLA_IFNAME, containerIfname),
+			attrUint32(unix.IFLA_NET_NS_PID, uint32(pid)),
+		},
+	}
+	if err := linkAdd(hostVeth, attrNested(unix.IFLA_LINKINFO,
+		attrString(unix.IFLA_INFO_KIND, "veth"),
+		attrNested(unix.IFLA_INFO_DATA, peer),
+	)); err != nil {
+		return err
+	}
+	if err := linkModify(hostVeth, attrUint32(unix.IFLA_MASTER, uint32(bridge.Index))); err != nil {
+		_ = linkDel(hostVeth)
+		return err
+	}
+	if err := linkSetUp(hostVeth); err != nil {
+		_ = linkDel(hostVeth)
+		return err
+	}
+
+	err = withNetns(pid, func() error {
+		if err := linkSetUp(containerIfname); err != nil {
+			return err
+		}
+		ip, ipnet, err := net.ParseCIDR(cfg.Address)
+		if err != nil {
+			return err
+		}
+		if err := addrAdd(containerIfname, &net.IPNet{IP: ip, Mask: ipnet.Mask}); err != nil {
+			return err
+		}
+		return routeAddDefault(containerIfname, net.ParseIP(cfg.Gateway))
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDNSServer(n); err != nil {
+		return err
+	}
+	cfg.DNS = []string{n.Gateway}
+	return writeResolvConf(rootfs, cfg.DNS)
+}
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// process.capabilities is applied by the child stage around the switch to
+// process.user: the bounding set is dropped and the permitted set kept
+// across the uid change while the process is still root, then the
+// effective, permitted, inheritable and ambient sets are set. The ambient
+// set is what lets a non-root container process keep capabilities across
+// the exec of a program without file capabilities. Capabilities are per
+// thread, so all of it happens on the thread executing the container
+// process. Without process.capabilities the process keeps those of root.
+
+var capabilityNames = map[string]uintptr{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// capSet is a set of capabilities, one bit per capability.
+type capSet uint64
+
+func (s capSet) has(c uintptr) bool { return s&(1<<c) != 0 }
+
+// parseCapabilities returns the set of capability names.
+func parseCapabilities(names []string) (capSet, error) {
+	var s capSet
+	for _, name := range names {
+		c, ok := capabilityNames[strings.ToUpper(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+		s |= 1 << c
+	}
+	return s, nil
+}
+
+// processCaps are the parsed sets of process.capabilities.
+type processCaps struct {
+	bounding, effective, permitted, inheritable, ambient capSet
+}
+
+func parseProcessCapabilities(caps *specs.LinuxCapabilities) (*processCaps, error) {
+	var pc processCaps
+	for _, set := range []struct {
+		name  string
+		names []string
+		dst   *capSet
+	}{
+		{"bounding", caps.Bounding, &pc.bounding},
+		{"effective", caps.Effective, &pc.effective},
+		{"permitted", caps.Permitted, &pc.permitted},
+		{"inheritable", caps.Inheritable, &pc.inheritable},
+		{"ambient", caps.Ambient, &pc.ambient},
+	} {
+		s, err := parseCapabilities(set.names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s capabilities: %w", set.name, err)
+		}
+		*set.dst = s
+	}
+	return &pc, nil
+}
+
+// lastCap returns the highest capability the kernel knows. Capabilities
+// above it are left out of every set.
+func lastCap() uintptr {
+	data, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uintptr(n)
+}
+
+// ownCapabilities returns the names of the capabilities in the bounding
+// set of the runtime, the most a container process can have.
+func ownCapabilities() []string {
+	var names []string
+	for _, name := range sortedKeys(capabilityNames) {
+		if ok, err := unix.PrctlRetInt(unix.PR_CAPBSET_READ, capabilityNames[name], 0, 0, 0); err == nil && ok == 1 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dropBoundingSet locks the calling thread, drops the capabilities outside
+// the bounding set and keeps the permitted set across the coming uid
+// change. It needs the privileges of root.
+func (pc *processCaps) dropBoundingSet() error {
+	runtime.LockOSThread()
+	last := lastCap()
+	for c := uintptr(0); c <= last; c++ {
+		if pc.bounding.has(c) {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, err)
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to keep capabilities: %w", err)
+	}
+	return nil
+}
+
+// apply sets the capabilities of the calling thread once it runs as the
+// process user.
+func (pc *processCaps) apply() error {
+	last := lastCap()
+	mask := capSet(1<<(last+1) - 1)
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	for i := range data {
+		data[i] = unix.CapUserData{
+			Effective:   uint32(pc.effective & mask >> (32 * i)),
+			Permitted:   uint32(pc.permitted & mask >> (32 * i)),
+			Inheritable: uint32(pc.inheritable & mask >> (32 * i)),
+		}
+	}
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return fmt.Errorf("failed to set capabilities: %w", err)
+	}
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", err)
+	}
+	for c := uintptr(0); c <= last; c++ {
+		if !pc.ambient.has(c) {
+			continue
+		}
+		// Ambient capabilities must be permitted and inheritable.
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, c, 0, 0); err != nil {
+			return fmt.Errorf("failed to raise ambient capability %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// sessionKeyringPrefix names the session keyring of a container.
+const sessionKeyringPrefix = "_ses."
+
+// keyUserSearch lets the user owning a key search it.
+const keyUserSearch = 0x080000
+
+// joinSessionKeyring gives the calling process a session keyring of its
+// own, so the container can't reach the keys of the host's session, which
+// the container user may search once the process has switched to it. A
+// kernel without keyrings is left alone.
+func joinSessionKeyring(containerId string) error {
+	id, err := unix.KeyctlJoinSessionKeyring(sessionKeyringPrefix + containerId)
+	if errors.Is(err, unix.ENOSYS) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create session keyring: %w", err)
+	}
+	// The description is "<type>;<uid>;<gid>;<perm>;<name>".
+	desc, err := unix.KeyctlString(unix.KEYCTL_DESCRIBE, id)
+	if err != nil {
+		return fmt.Errorf("failed to describe session keyring: %w", err)
+	}
+	fields := strings.SplitN(desc, ";", 5)
+	if len(fields) < 5 {
+		return fmt.Errorf("unexpected session keyring description %q", desc)
+	}
+	perm, err := strconv.ParseUint(fields[3], 16, 32)
+	if err != nil {
+		return fmt.Errorf("unexpected session keyring permissions %q", fields[3])
+	}
+	if err := unix.KeyctlSetperm(id, uint32(perm)|keyUserSearch); err != nil {
+		return fmt.Errorf("failed to set session keyring permissions: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseProcessCapabilities(t *testing.T) {
+	caps, err := parseProcessCapabilities(&specs.LinuxCapabilities{
+		Bounding:  []string{"CAP_NET_BIND_SERVICE", "cap_chown"},
+		Permitted: []string{"CAP_NET_BIND_SERVICE"},
+		Ambient:   []string{"CAP_NET_BIND_SERVICE"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caps.bounding.has(unix.CAP_CHOWN) || !caps.bounding.has(unix.CAP_NET_BIND_SERVICE) || caps.bounding.has(unix.CAP_SYS_ADMIN) {
+		t.Fatalf("unexpected bounding set %#x", caps.bounding)
+	}
+	if caps.ambient != 1<<unix.CAP_NET_BIND_SERVICE || caps.effective != 0 {
+		t.Fatalf("unexpected sets %+v", caps)
+	}
+	if _, err := parseProcessCapabilities(&specs.LinuxCapabilities{Effective: []string{"CAP_NOPE"}}); err == nil || !strings.Contains(err.Error(), "effective") {
+		t.Fatalf("expected an error naming the effective set, got %v", err)
+	}
+	if len(capabilityNames) != unix.CAP_LAST_CAP+1 {
+		t.Fatalf("%d capability names for %d capabilities", len(capabilityNames), unix.CAP_LAST_CAP+1)
+	}
+}
+
+func TestCapabilitiesSpec(t *testing.T) {
+	spec := filepath.Join(t.TempDir(), "config.json")
+	write := func(caps string) {
+		data := `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"cwd": "/", "args": ["sh"], "capabilities": ` + caps + `}}`
+		if err := os.WriteFile(spec, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"permitted": ["CAP_KILL"], "inheritable": ["CAP_KILL"], "ambient": ["CAP_KILL"]}`)
+	if _, err := loadRunSpec(spec, nil, &RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	write(`{"permitted": ["CAP_KILL"], "ambient": ["CAP_KILL"]}`)
+	if _, err := loadRunSpec(spec, nil, &RunOptions{}); err == nil || !strings.Contains(err.Error(), "ambient") {
+		t.Fatalf("expected an error for an ambient capability that isn't inheritable, got %v", err)
+	}
+	write(`{"bounding": ["CAP_FLY"]}`)
+	if _, err := loadRunSpec(spec, nil, &RunOptions{}); err == nil {
+		t.Fatal("expected an error for an unknown capability")
+	}
+}
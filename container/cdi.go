@@ -0,0 +1,261 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// CDI (Container Device Interface) specs describe how to expose a device,
+// such as a GPU, FPGA or NIC, to containers: the device nodes to create,
+// the mounts to add and the environment to set. Vendors install them in
+// the CDI spec dirs, as JSON or YAML, and a device is referred to by its
+// fully qualified name, "<vendor>/<class>=<name>" such as
+// nvidia.com/gpu=0. Its edits, and those common to the devices of its
+// spec, are added to the container spec before it starts.
+
+// cdiSpecDirs are searched for CDI specs. A device in a later directory
+// overrides one of the same name in an earlier directory.
+var cdiSpecDirs = []string{"/etc/cdi", "/var/run/cdi"}
+
+// cdiNameRe matches a fully qualified CDI device name.
+var cdiNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*\.[a-z]+/[a-zA-Z0-9][a-zA-Z0-9_.-]*=[a-zA-Z0-9][a-zA-Z0-9_.:-]*$`)
+
+// cdiSpec is a CDI spec file. Only the fields containish uses are decoded.
+type cdiSpec struct {
+	Version        string            `yaml:"cdiVersion"`
+	Kind           string            `yaml:"kind"`
+	Devices        []cdiDevice       `yaml:"devices"`
+	ContainerEdits cdiContainerEdits `yaml:"containerEdits"`
+}
+
+type cdiDevice struct {
+	Name           string            `yaml:"name"`
+	ContainerEdits cdiContainerEdits `yaml:"containerEdits"`
+}
+
+// cdiContainerEdits are the changes CDI makes to a container.
+type cdiContainerEdits struct {
+	Env         []string        `yaml:"env"`
+	DeviceNodes []cdiDeviceNode `yaml:"deviceNodes"`
+	Mounts      []cdiMount      `yaml:"mounts"`
+	Hooks       []yaml.Node     `yaml:"hooks"`
+}
+
+// cdiDeviceNode is a device node to create in the container. Its type
+// and numbers are those of the host node, unless given.
+type cdiDeviceNode struct {
+	Path        string       `yaml:"path"`
+	HostPath    string       `yaml:"hostPath"`
+	Type        string       `yaml:"type"`
+	Major       int64        `yaml:"major"`
+	Minor       int64        `yaml:"minor"`
+	Permissions string       `yaml:"permissions"`
+	FileMode    *os.FileMode `yaml:"fileMode"`
+	UID         *uint32      `yaml:"uid"`
+	GID         *uint32      `yaml:"gid"`
+}
+
+// cdiMount is a mount to add to the container, a read-only bind mount
+// unless given a type or options.
+type cdiMount struct {
+	HostPath      string   `yaml:"hostPath"`
+	ContainerPath string   `yaml:"containerPath"`
+	Type          string   `yaml:"type"`
+	Options       []string `yaml:"options"`
+}
+
+// cdiDevices are the devices of the CDI specs of the host.
+type cdiDevices struct {
+	// devices and specs are the devices by qualified name and the spec
+	// defining each. names are the qualified names in the order found.
+	devices map[string]cdiDevice
+	specs   map[string]*cdiSpec
+	names   []string
+}
+
+// ParseCDIDevice checks a --device value is a fully qualified CDI device
+// name, "<vendor>/<class>=<name>".
+func ParseCDIDevice(name string) (string, error) {
+	if !cdiNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid CDI device %q: expected <vendor>/<class>=<name>, e.g. nvidia.com/gpu=0", name)
+	}
+	return name, nil
+}
+
+// loadCDIDevices loads the devices of the CDI specs in cdiSpecDirs.
+func loadCDIDevices() (*cdiDevices, error) {
+	r := &cdiDevices{devices: map[string]cdiDevice{}, specs: map[string]*cdiSpec{}}
+	for _, dir := range cdiSpecDirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list CDI specs: %w", err)
+		}
+		for _, e := range entries {
+			switch filepath.Ext(e.Name()) {
+			case ".json", ".yaml", ".yml":
+			default:
+				continue
+			}
+			s, err := loadCDISpec(filepath.Join(dir, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range s.Devices {
+				name := s.Kind + "=" + d.Name
+				if _, ok := r.devices[name]; !ok {
+					r.names = append(r.names, name)
+				}
+				r.devices[name], r.specs[name] = d, s
+			}
+		}
+	}
+	return r, nil
+}
+
+// loadCDISpec reads the CDI spec at path.
+func loadCDISpec(path string) (*cdiSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CDI spec: %w", err)
+	}
+	s := &cdiSpec{}
+	// JSON is YAML, so both formats decode the same way.
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid CDI spec %s: %w", path, err)
+	}
+	vendor, class, ok := strings.Cut(s.Kind, "/")
+	if !ok || vendor == "" || class == "" {
+		return nil, fmt.Errorf("invalid CDI spec %s: invalid kind %q", path, s.Kind)
+	}
+	return s, nil
+}
+
+// edits returns the edits of the devices names, with those common to the
+// devices of a spec first and once.
+func (r *cdiDevices) edits(names []string) ([]cdiContainerEdits, error) {
+	var edits []cdiContainerEdits
+	used := map[*cdiSpec]bool{}
+	for _, name := range names {
+		d, ok := r.devices[name]
+		if !ok {
+			return nil, fmt.Errorf("CDI device %s not found in %s", name, strings.Join(cdiSpecDirs, " or "))
+		}
+		if s := r.specs[name]; !used[s] {
+			used[s] = true
+			edits = append(edits, s.ContainerEdits)
+		}
+		edits = append(edits, d.ContainerEdits)
+	}
+	return edits, nil
+}
+
+// injectCDIDevices adds the edits of the CDI devices names to spec.
+func injectCDIDevices(spec *specs.Spec, names []string) error {
+	r, err := loadCDIDevices()
+	if err != nil {
+		return err
+	}
+	edits, err := r.edits(names)
+	if err != nil {
+		return err
+	}
+	return applyContainerEdits(spec, edits)
+}
+
+// applyContainerEdits adds edits to spec: device nodes are created in the
+// container and allowed by its device cgroup, if it has one, and mounts
+// are added to the spec mounts.
+func applyContainerEdits(spec *specs.Spec, edits []cdiContainerEdits) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	// Without a cgroup hierarchy containers have no device cgroup to allow
+	// the devices in.
+	cgroups := cgroupsAvailable()
+	if cgroups && spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	hooks := false
+	for _, e := range edits {
+		hooks = hooks || len(e.Hooks) > 0
+		if spec.Process != nil {
+			spec.Process.Env = append(spec.Process.Env, e.Env...)
+		}
+		for _, n := range e.DeviceNodes {
+			d, err := cdiLinuxDevice(n)
+			if err != nil {
+				return err
+			}
+			spec.Linux.Devices = append(spec.Linux.Devices, d)
+			if !cgroups {
+				continue
+			}
+			access := n.Permissions
+			if access == "" {
+				access = "rwm"
+			}
+			spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+				Allow: true, Type: d.Type, Major: &d.Major, Minor: &d.Minor, Access: access,
+			})
+		}
+		for _, m := range e.Mounts {
+			mount := specs.Mount{Destination: m.ContainerPath, Type: m.Type, Source: m.HostPath, Options: m.Options}
+			if mount.Type == "" {
+				mount.Type = "bind"
+			}
+			if mount.Type == "bind" && len(mount.Options) == 0 {
+				mount.Options = []string{"ro", "nosuid", "nodev", "bind"}
+			}
+			spec.Mounts = append(spec.Mounts, mount)
+		}
+	}
+	if hooks {
+		fmt.Fprintf(os.Stderr, "warning: ignoring the hooks of the CDI specs, run ldconfig in the container if it can't find the device libraries\n")
+	}
+	return nil
+}
+
+// cdiLinuxDevice returns the spec device of n.
+func cdiLinuxDevice(n cdiDeviceNode) (specs.LinuxDevice, error) {
+	d := specs.LinuxDevice{
+		Path:     n.Path,
+		Type:     n.Type,
+		Major:    n.Major,
+		Minor:    n.Minor,
+		FileMode: n.FileMode,
+		UID:      n.UID,
+		GID:      n.GID,
+	}
+	if d.Type != "" && d.Major != 0 {
+		return d, nil
+	}
+	host := n.HostPath
+	if host == "" {
+		host = n.Path
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(host, &st); err != nil {
+		return specs.LinuxDevice{}, fmt.Errorf("device %s: %w", host, err)
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFCHR:
+		d.Type = "c"
+	case unix.S_IFBLK:
+		d.Type = "b"
+	default:
+		return specs.LinuxDevice{}, fmt.Errorf("device %s is not a device node", host)
+	}
+	d.Major, d.Minor = int64(unix.Major(uint64(st.Rdev))), int64(unix.Minor(uint64(st.Rdev)))
+	return d, nil
+}
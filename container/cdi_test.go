@@ -0,0 +1,91 @@
+package container
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseCDIDevice(t *testing.T) {
+	for name, ok := range map[string]bool{
+		"nvidia.com/gpu=0":                       true,
+		"vendor.com/fpga=GPU-4c2f1e9":            true,
+		"example.org/nic=eth0:1":                 true,
+		"nvidia.com/gpu":                         false,
+		"gpu=0":                                  false,
+		"nvidia.com/gpu=":                        false,
+		"/dev/nvidia0":                           false,
+		"nvidia.com/gpu=0,nvidia.com/gpu=1":      false,
+		"../../etc/cdi/vendor.com/fpga=whatever": false,
+	} {
+		if _, err := ParseCDIDevice(name); (err == nil) != ok {
+			t.Errorf("ParseCDIDevice(%q) = %v, want ok %v", name, err, ok)
+		}
+	}
+}
+
+func TestInjectCDIDevices(t *testing.T) {
+	origDirs, origCgroup := cdiSpecDirs, cgroupRoot
+	cdiSpecDirs = []string{t.TempDir(), t.TempDir()}
+	cgroupRoot = t.TempDir()
+	defer func() { cdiSpecDirs, cgroupRoot = origDirs, origCgroup }()
+	writeFile(t, filepath.Join(cgroupRoot, "cgroup.controllers"), "", 0o644)
+
+	writeFile(t, filepath.Join(cdiSpecDirs[0], "fpga.json"), `{
+  "cdiVersion": "0.6.0",
+  "kind": "vendor.com/fpga",
+  "devices": [
+    {"name": "a", "containerEdits": {"deviceNodes": [{"path": "/dev/fpga0", "type": "c", "major": 245, "minor": 0}]}},
+    {"name": "b", "containerEdits": {"deviceNodes": [{"path": "/dev/fpga1", "type": "c", "major": 245, "minor": 1}]}}
+  ],
+  "containerEdits": {
+    "env": ["FPGA_SDK=/opt/fpga"],
+    "mounts": [{"containerPath": "/opt/fpga/cache", "type": "tmpfs", "options": ["size=1m"]}]
+  }
+}`, 0o644)
+	// The later directory overrides device b.
+	writeFile(t, filepath.Join(cdiSpecDirs[1], "fpga-b.yaml"), `cdiVersion: 0.6.0
+kind: vendor.com/fpga
+devices:
+- name: b
+  containerEdits:
+    env: [FPGA_B=1]
+    deviceNodes:
+    - path: /dev/fpga1
+      hostPath: /dev/null
+      permissions: rw
+`, 0o644)
+
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"sh"}}}
+	if err := injectCDIDevices(spec, []string{"vendor.com/fpga=a", "vendor.com/fpga=b"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"FPGA_SDK=/opt/fpga", "FPGA_B=1"}; !reflect.DeepEqual(spec.Process.Env, want) {
+		t.Fatalf("unexpected env %q", spec.Process.Env)
+	}
+	if want := []specs.LinuxDevice{
+		{Path: "/dev/fpga0", Type: "c", Major: 245, Minor: 0},
+		{Path: "/dev/fpga1", Type: "c", Major: 1, Minor: 3},
+	}; !reflect.DeepEqual(spec.Linux.Devices, want) {
+		t.Fatalf("unexpected devices %+v", spec.Linux.Devices)
+	}
+	rules := spec.Linux.Resources.Devices
+	if len(rules) != 2 || *rules[0].Major != 245 || rules[0].Access != "rwm" || *rules[1].Minor != 3 || rules[1].Access != "rw" {
+		t.Fatalf("unexpected device rules %+v", rules)
+	}
+	if want := []specs.Mount{{Destination: "/opt/fpga/cache", Type: "tmpfs", Options: []string{"size=1m"}}}; !reflect.DeepEqual(spec.Mounts, want) {
+		t.Fatalf("unexpected mounts %+v", spec.Mounts)
+	}
+
+	err := injectCDIDevices(&specs.Spec{}, []string{"vendor.com/fpga=c"})
+	if err == nil || !strings.Contains(err.Error(), "vendor.com/fpga=c not found") {
+		t.Fatalf("expected an unknown device, got %v", err)
+	}
+	writeFile(t, filepath.Join(cdiSpecDirs[1], "broken.json"), `{"kind": "fpga"}`, 0o644)
+	if err := injectCDIDevices(&specs.Spec{}, []string{"vendor.com/fpga=a"}); err == nil || !strings.Contains(err.Error(), "invalid kind") {
+		t.Fatalf("expected an invalid spec, got %v", err)
+	}
+}
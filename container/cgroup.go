@@ -0,0 +1,501 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is the mount point of the unified (v2) cgroup hierarchy. It is a
+// variable so tests can point it at a temporary directory.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupParent is the cgroup, relative to cgroupRoot, under which every
+// container cgroup is created.
+var cgroupParent = "containish"
+
+// sysDevBlock is where the kernel exposes block devices by major:minor. It is
+// used to validate the devices referenced by blockIO rules.
+var sysDevBlock = "/sys/dev/block"
+
+// cgroupControllers are enabled in the parent cgroup so container cgroups can
+// be configured through them.
+var cgroupControllers = []string{"cpu", "io", "memory", "pids"}
+
+// CgroupPath returns the absolute cgroup directory for a container.
+func CgroupPath(id string) string {
+	return filepath.Join(cgroupRoot, cgroupParent, id)
+}
+
+// cgroupsAvailable reports whether cgroupRoot is a unified (v2) hierarchy.
+func cgroupsAvailable() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// createCgroup creates the container cgroup and enables the controllers it
+// needs in the parent. It returns the path of the new cgroup.
+func createCgroup(id string) (string, error) {
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cgroup parent %s: %w", parent, err)
+	}
+
+	// Controllers must be enabled on every level between the root and the
+	// container cgroup. Controllers the kernel doesn't offer are skipped.
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := enableControllers(dir); err != nil {
+			return "", err
+		}
+	}
+
+	path := CgroupPath(id)
+	if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create cgroup %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// enableControllers writes "+<controller>" into dir's cgroup.subtree_control
+// for every wanted controller listed in dir's cgroup.controllers.
+func enableControllers(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return fmt.Errorf("failed to read controllers of %s: %w", dir, err)
+	}
+	available := strings.Fields(string(data))
+
+	var enable []string
+	for _, want := range cgroupControllers {
+		for _, have := range available {
+			if want == have {
+				enable = append(enable, "+"+want)
+			}
+		}
+	}
+	if len(enable) == 0 {
+		return nil
+	}
+
+	if err := writeCgroupFile(dir, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+		return err
+	}
+	return nil
+}
+
+// removeCgroup deletes the container cgroup. The cgroup must no longer
+// contain any processes.
+func removeCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cgroup %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeCgroupFile writes a single value into a cgroup interface file.
+func writeCgroupFile(dir, file, value string) error {
+	p := filepath.Join(dir, file)
+	if err := os.WriteFile(p, []byte(value), 0o644); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %w", value, p, err)
+	}
+	return nil
+}
+
+// thawCgroup thaws the cgroup at path if it is frozen, as the processes of
+// a frozen cgroup don't act on a signal until then, so stopping it would
+// only time out. A cgroup without a freezer is left alone.
+func thawCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.freeze"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read freezer state of %s: %w", path, err)
+	}
+	if strings.TrimSpace(string(data)) != "1" {
+		return nil
+	}
+	return writeCgroupFile(path, "cgroup.freeze", "0")
+}
+
+// cgroupFreezeTimeout bounds the wait for a cgroup to report it is frozen.
+const cgroupFreezeTimeout = 5 * time.Second
+
+// freezeCgroup freezes the cgroup at path, unless it has no freezer or is
+// frozen already, and returns a function thawing what it froze.
+func freezeCgroup(path string) (thaw func(), err error) {
+	thaw = func() {}
+	if path == "" {
+		return thaw, nil
+	}
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.freeze"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return thaw, nil
+		}
+		return nil, fmt.Errorf("failed to read freezer state of %s: %w", path, err)
+	}
+	if strings.TrimSpace(string(data)) == "1" {
+		return thaw, nil
+	}
+	if err := writeCgroupFile(path, "cgroup.freeze", "1"); err != nil {
+		return nil, err
+	}
+	thaw = func() {
+		if err := thawCgroup(path); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	// Freezing completes once every process has stopped, which
+	// cgroup.events reports.
+	deadline := time.Now().Add(cgroupFreezeTimeout)
+	for {
+		events, err := os.ReadFile(filepath.Join(path, "cgroup.events"))
+		if err != nil || strings.Contains(string(events), "frozen 1") {
+			return thaw, nil
+		}
+		if time.Now().After(deadline) {
+			thaw()
+			return nil, fmt.Errorf("cgroup %s didn't freeze within %v", path, cgroupFreezeTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// killCgroup kills every process in the cgroup at path, with cgroup.kill
+// where the kernel has it (5.14 and later) and else one by one. It is for
+// the processes a container leaves behind in a pid namespace it shares,
+// which outlive its init.
+func killCgroup(path string) error {
+	if path == "" {
+		return nil
+	}
+	if writeCgroupFile(path, "cgroup.kill", "1") == nil {
+		return nil
+	}
+	// Processes may fork while they are being killed, so go on until
+	// none is left.
+	for i := 0; i < 10; i++ {
+		data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list the processes of %s: %w", path, err)
+		}
+		pids := strings.Fields(string(data))
+		if len(pids) == 0 {
+			return nil
+		}
+		for _, p := range pids {
+			if pid, err := strconv.Atoi(p); err == nil {
+				_ = unix.Kill(pid, unix.SIGKILL)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to kill the processes of cgroup %s", path)
+}
+
+// applyResources writes the spec's resource limits into the cgroup at path.
+// The device filter is always installed, even when the spec has no
+// resources section, so containers only get the default device set.
+func applyResources(path string, r *specs.LinuxResources) error {
+	var devices []specs.LinuxDeviceCgroup
+	if r != nil {
+		devices = r.Devices
+	}
+	if err := applyDevices(path, devices); err != nil {
+		return err
+	}
+
+	if r == nil {
+		return nil
+	}
+	if err := applyBlockIO(path, r.BlockIO); err != nil {
+		return err
+	}
+	// Unified entries go last so they can refine the structured settings.
+	if err := applyUnified(path, r.Unified); err != nil {
+		return err
+	}
+	return nil
+}
+
+// cpuPeriod is the cpu.max period, in microseconds, of the --cpus limit.
+const cpuPeriod = 100000
+
+// ParseMemory parses a --memory value, a size such as 512m or 2g.
+func ParseMemory(value string) (int64, error) {
+	size, err := parseByteSize(value)
+	if err != nil || size < 1<<20 {
+		return 0, fmt.Errorf("invalid memory limit %q: expected at least 1m", value)
+	}
+	return size, nil
+}
+
+// MemorySwapUnlimited as RunOptions.MemorySwap lets the container swap
+// without limit.
+const MemorySwapUnlimited = -1
+
+// ParseMemorySwap parses a --memory-swap value, the limit of memory and
+// swap together such as 1g, or -1 for MemorySwapUnlimited.
+func ParseMemorySwap(value string) (int64, error) {
+	if value == "-1" {
+		return MemorySwapUnlimited, nil
+	}
+	size, err := parseByteSize(value)
+	if err != nil || size < 1<<20 {
+		return 0, fmt.Errorf("invalid memory and swap limit %q: expected at least 1m, or -1 for unlimited swap", value)
+	}
+	return size, nil
+}
+
+// ParseCPUs parses a --cpus value, a number of CPUs such as 1.5.
+func ParseCPUs(value string) (float64, error) {
+	cpus, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(cpus >= 0.01) || math.IsInf(cpus, 1) {
+		return 0, fmt.Errorf("invalid cpus %q: expected a number of CPUs of at least 0.01", value)
+	}
+	return cpus, nil
+}
+
+// limitResources adds a memory limit of memory bytes and a CPU limit of
+// cpus CPUs, if not zero, to the unified resources of spec, where they
+// override the structured settings.
+func limitResources(spec *specs.Spec, memory int64, cpus float64) {
+	if memory == 0 && cpus == 0 {
+		return
+	}
+	unified := unifiedResources(spec)
+	if memory > 0 {
+		unified["memory.max"] = strconv.FormatInt(memory, 10)
+	}
+	if cpus > 0 {
+		unified["cpu.max"] = fmt.Sprintf("%d %d", int64(cpus*cpuPeriod), cpuPeriod)
+	}
+}
+
+// limitSwap sets the memory.swap.max of spec from memorySwap, the limit of
+// memory and swap together as with docker, given a memory limit of memory
+// bytes: the swap allowed is what memorySwap leaves above memory, none if
+// they are equal. Zero keeps the limit of the spec, by default the kernel's
+// of no limit.
+func limitSwap(spec *specs.Spec, memory, memorySwap int64) error {
+	switch {
+	case memorySwap == 0:
+		return nil
+	case memorySwap == MemorySwapUnlimited:
+		unifiedResources(spec)["memory.swap.max"] = "max"
+		return nil
+	case memory == 0:
+		return fmt.Errorf("a limit of memory and swap together requires a memory limit")
+	case memorySwap < memory:
+		return fmt.Errorf("the limit of memory and swap together, %s, is below the memory limit, %s", FormatBytes(memorySwap), FormatBytes(memory))
+	}
+	unifiedResources(spec)["memory.swap.max"] = strconv.FormatInt(memorySwap-memory, 10)
+	return nil
+}
+
+// unifiedResources returns the unified resources of spec, adding them if
+// it has none.
+func unifiedResources(spec *specs.Spec) map[string]string {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	r := spec.Linux.Resources
+	if r.Unified == nil {
+		r.Unified = map[string]string{}
+	}
+	return r.Unified
+}
+
+// applyUnified writes linux.resources.unified entries verbatim into the
+// cgroup interface files they name, in key order.
+func applyUnified(path string, unified map[string]string) error {
+	settings, err := unifiedSettings(unified)
+	if err != nil {
+		return err
+	}
+	for _, st := range settings {
+		// Interface files only exist while their controller is enabled.
+		if _, err := os.Stat(filepath.Join(path, st.File)); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				controller, _, _ := strings.Cut(st.File, ".")
+				return fmt.Errorf("unified key %q is not available: is the %s controller enabled?", st.File, controller)
+			}
+			return fmt.Errorf("failed to stat unified key %q: %w", st.File, err)
+		}
+		if err := writeCgroupFile(path, st.File, st.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unifiedSettings validates the unified keys and returns them in key order.
+func unifiedSettings(unified map[string]string) ([]CgroupSetting, error) {
+	keys := make([]string, 0, len(unified))
+	for k := range unified {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	settings := make([]CgroupSetting, 0, len(keys))
+	for _, k := range keys {
+		if strings.ContainsRune(k, '/') || !strings.Contains(k, ".") {
+			return nil, fmt.Errorf("invalid unified key %q: must be a cgroup interface file name", k)
+		}
+		if k == "cgroup.procs" || k == "cgroup.threads" {
+			return nil, fmt.Errorf("invalid unified key %q: moving processes is not allowed", k)
+		}
+		settings = append(settings, CgroupSetting{k, unified[k]})
+	}
+	return settings, nil
+}
+
+// CgroupSetting is a value written into a cgroup interface file.
+type CgroupSetting struct {
+	File  string `json:"file"`
+	Value string `json:"value"`
+}
+
+// applyBlockIO translates linux.resources.blockIO into the io.weight and
+// io.max files of the cgroup v2 io controller.
+func applyBlockIO(path string, b *specs.LinuxBlockIO) error {
+	settings, err := blockIOSettings(b)
+	if err != nil {
+		return err
+	}
+	for _, st := range settings {
+		if err := writeCgroupFile(path, st.File, st.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockIOSettings returns the writes applyBlockIO makes, in order.
+func blockIOSettings(b *specs.LinuxBlockIO) ([]CgroupSetting, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	var settings []CgroupSetting
+	if b.Weight != nil {
+		w, err := blkioToIOWeight(*b.Weight)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, CgroupSetting{"io.weight", fmt.Sprintf("default %d", w)})
+	}
+
+	for _, wd := range b.WeightDevice {
+		if err := validateBlockDevice(wd.Major, wd.Minor); err != nil {
+			return nil, err
+		}
+		if wd.Weight == nil {
+			continue
+		}
+		w, err := blkioToIOWeight(*wd.Weight)
+		if err != nil {
+			return nil, err
+		}
+		settings = append(settings, CgroupSetting{"io.weight", fmt.Sprintf("%d:%d %d", wd.Major, wd.Minor, w)})
+	}
+
+	lines, err := ioMaxLines(b)
+	if err != nil {
+		return nil, err
+	}
+	// io.max accepts one device per write.
+	for _, l := range lines {
+		settings = append(settings, CgroupSetting{"io.max", l})
+	}
+	return settings, nil
+}
+
+// ioMaxLines groups the throttle rules by device and renders one io.max line
+// per device, e.g. "8:0 rbps=1048576 wiops=100".
+func ioMaxLines(b *specs.LinuxBlockIO) ([]string, error) {
+	type dev struct{ major, minor int64 }
+	var order []dev
+	limits := map[dev][]string{}
+
+	add := func(key string, rules []specs.LinuxThrottleDevice) error {
+		for _, r := range rules {
+			if err := validateBlockDevice(r.Major, r.Minor); err != nil {
+				return err
+			}
+			d := dev{r.Major, r.Minor}
+			if _, ok := limits[d]; !ok {
+				order = append(order, d)
+			}
+			limits[d] = append(limits[d], fmt.Sprintf("%s=%d", key, r.Rate))
+		}
+		return nil
+	}
+
+	if err := add("rbps", b.ThrottleReadBpsDevice); err != nil {
+		return nil, err
+	}
+	if err := add("wbps", b.ThrottleWriteBpsDevice); err != nil {
+		return nil, err
+	}
+	if err := add("riops", b.ThrottleReadIOPSDevice); err != nil {
+		return nil, err
+	}
+	if err := add("wiops", b.ThrottleWriteIOPSDevice); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, len(order))
+	for _, d := range order {
+		lines = append(lines, fmt.Sprintf("%d:%d %s", d.major, d.minor, strings.Join(limits[d], " ")))
+	}
+	return lines, nil
+}
+
+// validateBlockDevice ensures major:minor refers to a block device known to
+// the host, so typos fail early with a clear message instead of EINVAL from
+// the kernel.
+func validateBlockDevice(major, minor int64) error {
+	if major < 0 || minor < 0 {
+		return fmt.Errorf("invalid block device %d:%d: negative device number", major, minor)
+	}
+	p := filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", major, minor))
+	if _, err := os.Stat(p); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("invalid block device %d:%d: no such device", major, minor)
+		}
+		return fmt.Errorf("failed to stat block device %d:%d: %w", major, minor, err)
+	}
+	return nil
+}
+
+// blkioToIOWeight converts a cgroup v1 blkio weight (10-1000), which is what
+// the runtime-spec uses, to the cgroup v2 io.weight range (1-10000).
+func blkioToIOWeight(w uint16) (uint64, error) {
+	if w < 10 || w > 1000 {
+		return 0, fmt.Errorf("invalid blkio weight %d: must be between 10 and 1000", w)
+	}
+	return 1 + (uint64(w)-10)*9999/990, nil
+}
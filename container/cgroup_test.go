@@ -0,0 +1,251 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeBlockDevices points sysDevBlock at a temporary directory containing the
+// given major:minor entries.
+func fakeBlockDevices(t *testing.T, devs ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, d := range devs {
+		if err := os.WriteFile(filepath.Join(dir, d), nil, 0o644); err != nil {
+			t.Fatalf("failed to create fake device %s: %v", d, err)
+		}
+	}
+	old := sysDevBlock
+	sysDevBlock = dir
+	t.Cleanup(func() { sysDevBlock = old })
+}
+
+func TestApplyBlockIO(t *testing.T) {
+	fakeBlockDevices(t, "8:0", "8:16")
+	cg := t.TempDir()
+
+	weight := uint16(500)
+	b := &specs.LinuxBlockIO{
+		Weight: &weight,
+		ThrottleReadBpsDevice: []specs.LinuxThrottleDevice{
+			{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 0}, Rate: 1048576},
+		},
+		ThrottleWriteIOPSDevice: []specs.LinuxThrottleDevice{
+			{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 0}, Rate: 100},
+			{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 8, Minor: 16}, Rate: 50},
+		},
+	}
+
+	lines, err := ioMaxLines(b)
+	if err != nil {
+		t.Fatalf("ioMaxLines failed: %v", err)
+	}
+	want := []string{"8:0 rbps=1048576 wiops=100", "8:16 wiops=50"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected io.max lines %q, want %q", lines, want)
+	}
+
+	if err := applyBlockIO(cg, b); err != nil {
+		t.Fatalf("applyBlockIO failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(cg, "io.weight"))
+	if err != nil {
+		t.Fatalf("io.weight not written: %v", err)
+	}
+	if string(data) != "default 4950" {
+		t.Fatalf("unexpected io.weight %q", data)
+	}
+}
+
+func TestApplyBlockIOInvalidDevice(t *testing.T) {
+	fakeBlockDevices(t, "8:0")
+
+	b := &specs.LinuxBlockIO{
+		ThrottleReadBpsDevice: []specs.LinuxThrottleDevice{
+			{LinuxBlockIODevice: specs.LinuxBlockIODevice{Major: 259, Minor: 3}, Rate: 1},
+		},
+	}
+	if err := applyBlockIO(t.TempDir(), b); err == nil {
+		t.Fatalf("expected error for unknown device 259:3")
+	}
+}
+
+func TestBlkioToIOWeight(t *testing.T) {
+	for in, want := range map[uint16]uint64{10: 1, 1000: 10000} {
+		got, err := blkioToIOWeight(in)
+		if err != nil || got != want {
+			t.Fatalf("blkioToIOWeight(%d) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := blkioToIOWeight(5); err == nil {
+		t.Fatalf("expected error for out of range weight")
+	}
+}
+
+func TestApplyUnified(t *testing.T) {
+	cg := t.TempDir()
+	for _, f := range []string{"memory.high", "cpu.idle"} {
+		if err := os.WriteFile(filepath.Join(cg, f), nil, 0o644); err != nil {
+			t.Fatalf("failed to create %s: %v", f, err)
+		}
+	}
+
+	unified := map[string]string{"memory.high": "67108864", "cpu.idle": "1"}
+	if err := applyUnified(cg, unified); err != nil {
+		t.Fatalf("applyUnified failed: %v", err)
+	}
+	for f, want := range unified {
+		data, err := os.ReadFile(filepath.Join(cg, f))
+		if err != nil || string(data) != want {
+			t.Fatalf("%s = %q, %v; want %q", f, data, err, want)
+		}
+	}
+
+	for _, bad := range []map[string]string{
+		{"../memory.max": "1"},
+		{"cgroup.procs": "1"},
+		{"hugetlb.2MB.max": "0"},
+	} {
+		if err := applyUnified(cg, bad); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+}
+
+func TestLimitResources(t *testing.T) {
+	if _, err := ParseMemory("512k"); err == nil {
+		t.Fatal("expected a memory limit under 1m to be refused")
+	}
+	memory, err := ParseMemory("64m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"0", "0.001", "-1", "x", "NaN", "inf"} {
+		if _, err := ParseCPUs(v); err == nil {
+			t.Errorf("ParseCPUs(%q) succeeded, expected an error", v)
+		}
+	}
+	cpus, err := ParseCPUs("1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &specs.Spec{}
+	limitResources(spec, 0, 0)
+	if spec.Linux != nil {
+		t.Fatalf("expected no resources without limits, got %+v", spec.Linux)
+	}
+	limitResources(spec, memory, cpus)
+	want := map[string]string{"memory.max": "67108864", "cpu.max": "150000 100000"}
+	for k, v := range want {
+		if got := spec.Linux.Resources.Unified[k]; got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestLimitSwap(t *testing.T) {
+	for _, v := range []string{"0", "512k", "-2", "x"} {
+		if _, err := ParseMemorySwap(v); err == nil {
+			t.Errorf("ParseMemorySwap(%q) succeeded, expected an error", v)
+		}
+	}
+	if n, err := ParseMemorySwap("-1"); err != nil || n != MemorySwapUnlimited {
+		t.Errorf("ParseMemorySwap(-1) = %d, %v, want MemorySwapUnlimited", n, err)
+	}
+
+	for _, tt := range []struct {
+		memory, memorySwap int64
+		want               string
+	}{
+		{64 << 20, 0, ""},
+		{64 << 20, 64 << 20, "0"},
+		{64 << 20, 96 << 20, "33554432"},
+		{0, MemorySwapUnlimited, "max"},
+		{64 << 20, MemorySwapUnlimited, "max"},
+	} {
+		spec := &specs.Spec{}
+		if err := limitSwap(spec, tt.memory, tt.memorySwap); err != nil {
+			t.Errorf("limitSwap(%d, %d): %v", tt.memory, tt.memorySwap, err)
+			continue
+		}
+		got := ""
+		if spec.Linux != nil {
+			got = spec.Linux.Resources.Unified["memory.swap.max"]
+		}
+		if got != tt.want {
+			t.Errorf("limitSwap(%d, %d) set memory.swap.max %q, want %q", tt.memory, tt.memorySwap, got, tt.want)
+		}
+	}
+	for _, tt := range []struct{ memory, memorySwap int64 }{
+		{0, 64 << 20},
+		{64 << 20, 32 << 20},
+	} {
+		if err := limitSwap(&specs.Spec{}, tt.memory, tt.memorySwap); err == nil {
+			t.Errorf("limitSwap(%d, %d) succeeded, expected an error", tt.memory, tt.memorySwap)
+		}
+	}
+}
+
+func TestFreezeCgroup(t *testing.T) {
+	dir := t.TempDir()
+	thaw, err := freezeCgroup(dir)
+	if err != nil {
+		t.Fatalf("freezeCgroup without a freezer: %v", err)
+	}
+	thaw()
+
+	writeFile(t, filepath.Join(dir, "cgroup.freeze"), "0\n", 0o644)
+	writeFile(t, filepath.Join(dir, "cgroup.events"), "populated 1\nfrozen 1\n", 0o644)
+	if thaw, err = freezeCgroup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "cgroup.freeze")); string(data) != "1" {
+		t.Errorf("cgroup.freeze is %q, want 1", data)
+	}
+	thaw()
+	if data, _ := os.ReadFile(filepath.Join(dir, "cgroup.freeze")); string(data) != "0" {
+		t.Errorf("cgroup.freeze is %q after thawing, want 0", data)
+	}
+
+	// A cgroup frozen already is left frozen.
+	writeFile(t, filepath.Join(dir, "cgroup.freeze"), "1\n", 0o644)
+	if thaw, err = freezeCgroup(dir); err != nil {
+		t.Fatal(err)
+	}
+	thaw()
+	if data, _ := os.ReadFile(filepath.Join(dir, "cgroup.freeze")); string(data) != "1\n" {
+		t.Errorf("cgroup.freeze is %q, want it left frozen", data)
+	}
+}
+
+func TestKillCgroup(t *testing.T) {
+	if err := killCgroup(""); err != nil {
+		t.Fatalf("killCgroup without a cgroup: %v", err)
+	}
+	if err := killCgroup(filepath.Join(t.TempDir(), "gone")); err != nil {
+		t.Fatalf("killCgroup of a removed cgroup: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := killCgroup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "cgroup.kill")); string(data) != "1" {
+		t.Errorf("cgroup.kill is %q, want 1", data)
+	}
+
+	// Without cgroup.kill, the processes are killed one by one.
+	dir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "cgroup.kill"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "cgroup.procs"), "", 0o644)
+	if err := killCgroup(dir); err != nil {
+		t.Fatalf("killCgroup of an empty cgroup: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A container reads the clocks of the host. RunOptions.MonotonicOffset, or
+// linux.timeOffsets in the spec, gives it a time namespace shifting
+// CLOCK_MONOTONIC and CLOCK_BOOTTIME: the parent stage unshares it on a
+// thread of its own and sets its offsets before forking the child stage
+// into it. CLOCK_REALTIME can't be namespaced, so RunOptions.FakeDate sets
+// SOURCE_DATE_EPOCH, which reproducible builds honour, and FAKETIME with
+// libfaketime preloaded when the rootfs has it. Processes exec'd into the
+// container keep the clocks of the host, as joining a time namespace takes
+// a single threaded process. RunOptions.NoRTC takes the RTC devices away
+// from the container, which a privileged one otherwise gets from the host.
+
+// timeOffsetClocks are the clocks a time namespace offsets.
+var timeOffsetClocks = []string{"monotonic", "boottime"}
+
+// faketimeLibs are where libfaketime is looked up in the rootfs.
+var faketimeLibs = []string{
+	"/usr/lib/faketime/libfaketime.so.1",
+	"/usr/lib/*/faketime/libfaketime.so.1",
+	"/usr/lib64/faketime/libfaketime.so.1",
+	"/usr/local/lib/faketime/libfaketime.so.1",
+}
+
+// procDevices lists the device majors of the host. It is a variable so
+// tests can override it.
+var procDevices = "/proc/devices"
+
+// ParseFakeDate parses a --fake-date value, an RFC 3339 time such as
+// 2020-01-01T00:00:00Z, a date such as 2020-01-01, taken as UTC midnight,
+// or @ followed by seconds since the epoch.
+func ParseFakeDate(value string) (time.Time, error) {
+	if secs, ok := strings.CutPrefix(value, "@"); ok {
+		n, err := strconv.ParseInt(secs, 10, 64)
+		if err != nil || n < 0 {
+			return time.Time{}, fmt.Errorf("invalid date %q: expected @ followed by seconds since the epoch", value)
+		}
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			if t.Unix() < 0 {
+				break
+			}
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q: expected an RFC 3339 time, a date such as 2020-01-01 or @<seconds since the epoch> after 1970", value)
+}
+
+// timeOffset returns d as a time namespace offset, whose nanoseconds are
+// never negative.
+func timeOffset(d time.Duration) specs.LinuxTimeOffset {
+	secs, nsecs := int64(d/time.Second), int64(d%time.Second)
+	if nsecs < 0 {
+		secs, nsecs = secs-1, nsecs+int64(time.Second)
+	}
+	return specs.LinuxTimeOffset{Secs: secs, Nanosecs: uint32(nsecs)}
+}
+
+// applyClock applies the offset of the monotonic clocks of options to spec,
+// unless the spec sets them, and its fake date.
+func applyClock(spec *specs.Spec, options *RunOptions) error {
+	if options.MonotonicOffset != 0 {
+		if spec.Linux == nil {
+			spec.Linux = &specs.Linux{}
+		}
+		l := spec.Linux
+		if l.TimeOffsets == nil {
+			l.TimeOffsets = map[string]specs.LinuxTimeOffset{}
+		}
+		for _, clock := range timeOffsetClocks {
+			if _, ok := l.TimeOffsets[clock]; !ok {
+				l.TimeOffsets[clock] = timeOffset(options.MonotonicOffset)
+			}
+		}
+	}
+	if l := spec.Linux; l != nil && len(l.TimeOffsets) > 0 && !timeNamespace(spec) {
+		l.Namespaces = append(l.Namespaces, specs.LinuxNamespace{Type: specs.TimeNamespace})
+	}
+	if !options.FakeDate.IsZero() {
+		if spec.Process == nil || len(spec.Process.Args) == 0 {
+			return fmt.Errorf("a fake date requires process.args in the spec")
+		}
+		date := options.FakeDate.UTC()
+		env := []string{
+			"SOURCE_DATE_EPOCH=" + strconv.FormatInt(date.Unix(), 10),
+			"FAKETIME=@" + date.Format(time.DateTime),
+		}
+		if err := setEnv(spec, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// timeNamespace reports whether the container of spec has a time namespace.
+func timeNamespace(spec *specs.Spec) bool {
+	return spec != nil && spec.Linux != nil && slices.ContainsFunc(spec.Linux.Namespaces, func(ns specs.LinuxNamespace) bool {
+		return ns.Type == specs.TimeNamespace
+	})
+}
+
+// validateTimeNamespace checks the time offsets of spec, which need a time
+// namespace of its own and the kernel to have them.
+func validateTimeNamespace(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		return nil
+	}
+	for _, clock := range sortedKeys(spec.Linux.TimeOffsets) {
+		if !slices.Contains(timeOffsetClocks, clock) {
+			return fmt.Errorf("invalid linux.timeOffsets clock %q: must be %s", clock, strings.Join(timeOffsetClocks, " or "))
+		}
+		if spec.Linux.TimeOffsets[clock].Nanosecs >= uint32(time.Second) {
+			return fmt.Errorf("invalid linux.timeOffsets %s: nanosecs must be below a second", clock)
+		}
+	}
+	if !timeNamespace(spec) {
+		if len(spec.Linux.TimeOffsets) > 0 {
+			return fmt.Errorf("linux.timeOffsets requires a time namespace")
+		}
+		return nil
+	}
+	if k := Kernel(); !k.TimeNamespace {
+		return fmt.Errorf("a time namespace requires kernel support, which kernel %s lacks (Linux 5.6 or later has it)", k.Release)
+	}
+	return nil
+}
+
+// unshareTime moves the children the calling thread forks from now on to a
+// new time namespace with offsets. The thread must be locked and discarded
+// afterwards.
+func unshareTime(offsets map[string]specs.LinuxTimeOffset) error {
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		return fmt.Errorf("failed to create time namespace: %w", err)
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	for _, clock := range sortedKeys(offsets) {
+		fmt.Fprintf(&b, "%s %d %d\n", clock, offsets[clock].Secs, offsets[clock].Nanosecs)
+	}
+	// The offsets are those of the namespace of the children of the task,
+	// a thread, which /proc/<tid> names.
+	path := fmt.Sprintf("/proc/%d/timens_offsets", unix.Gettid())
+	if err := os.WriteFile(path, []byte(b.String()), 0); err != nil {
+		return fmt.Errorf("failed to set the clock offsets of the time namespace: %w", err)
+	}
+	return nil
+}
+
+// removeRTC drops the RTC devices, /dev/rtc and /dev/rtcN, from spec and
+// denies the container access to the RTC major of the host.
+func removeRTC(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	spec.Linux.Devices = slices.DeleteFunc(spec.Linux.Devices, func(d specs.LinuxDevice) bool {
+		return isRTCDevice(d.Path)
+	})
+	major, err := rtcMajor()
+	if err != nil || major < 0 || !cgroupsAvailable() {
+		return err
+	}
+	if spec.Linux.Resources == nil {
+		spec.Linux.Resources = &specs.LinuxResources{}
+	}
+	spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{
+		Allow: false, Type: "c", Major: int64Ptr(major), Minor: int64Ptr(wildcardDevice), Access: "rwm",
+	})
+	return nil
+}
+
+// isRTCDevice reports whether path is that of an RTC device.
+func isRTCDevice(path string) bool {
+	name, ok := strings.CutPrefix(filepath.Clean(path), "/dev/rtc")
+	if !ok {
+		return false
+	}
+	_, err := strconv.Atoi(name)
+	return name == "" || err == nil
+}
+
+// rtcMajor returns the major of the RTC character devices of the host, or
+// -1 if it has none.
+func rtcMajor() (int64, error) {
+	f, err := os.Open(procDevices)
+	if err != nil {
+		return -1, fmt.Errorf("failed to read the device majors of the host: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "Block devices:" {
+			break
+		}
+		major, name, ok := strings.Cut(line, " ")
+		if !ok || name != "rtc" {
+			continue
+		}
+		return strconv.ParseInt(major, 10, 64)
+	}
+	return -1, scanner.Err()
+}
+
+// preloadFaketime prepends libfaketime, if the rootfs the calling process
+// pivoted to has it, to the LD_PRELOAD of env, and reports whether it did.
+func preloadFaketime(env []string) ([]string, bool) {
+	for _, pattern := range faketimeLibs {
+		matches, _ := filepath.Glob(pattern)
+		if len(matches) == 0 {
+			continue
+		}
+		preload := matches[0]
+		for i, e := range env {
+			if value, ok := strings.CutPrefix(e, "LD_PRELOAD="); ok {
+				if value != "" {
+					preload += ":" + value
+				}
+				env = slices.Delete(env, i, i+1)
+				break
+			}
+		}
+		return append(env, "LD_PRELOAD="+preload), true
+	}
+	return env, false
+}
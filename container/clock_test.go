@@ -0,0 +1,134 @@
+package container
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseFakeDate(t *testing.T) {
+	want := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2020-01-01", "2020-01-01T00:00:00Z", "2020-01-01T01:00:00+01:00", "@1577836800"} {
+		got, err := ParseFakeDate(value)
+		if err != nil || !got.Equal(want) {
+			t.Errorf("ParseFakeDate(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "yesterday", "@", "@-1", "1969-12-31", "2020-13-01"} {
+		if _, err := ParseFakeDate(value); err == nil {
+			t.Errorf("ParseFakeDate(%q) succeeded", value)
+		}
+	}
+}
+
+func TestTimeOffset(t *testing.T) {
+	for d, want := range map[time.Duration]specs.LinuxTimeOffset{
+		240 * time.Hour:          {Secs: 864000},
+		1500 * time.Millisecond:  {Secs: 1, Nanosecs: 500000000},
+		-1500 * time.Millisecond: {Secs: -2, Nanosecs: 500000000},
+		-time.Hour:               {Secs: -3600},
+	} {
+		if got := timeOffset(d); got != want {
+			t.Errorf("timeOffset(%v) = %+v, want %+v", d, got, want)
+		}
+	}
+}
+
+func TestApplyClock(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{Args: []string{"make"}, Env: []string{"SOURCE_DATE_EPOCH=1"}},
+		Linux:   &specs.Linux{TimeOffsets: map[string]specs.LinuxTimeOffset{"boottime": {Secs: 5}}},
+	}
+	date := time.Date(2020, 1, 1, 12, 30, 0, 0, time.FixedZone("", 3600))
+	if err := applyClock(spec, &RunOptions{MonotonicOffset: time.Hour, FakeDate: date}); err != nil {
+		t.Fatal(err)
+	}
+	// The spec's own offset is kept.
+	want := map[string]specs.LinuxTimeOffset{"monotonic": {Secs: 3600}, "boottime": {Secs: 5}}
+	for clock, offset := range want {
+		if spec.Linux.TimeOffsets[clock] != offset {
+			t.Errorf("offset of %s = %+v, want %+v", clock, spec.Linux.TimeOffsets[clock], offset)
+		}
+	}
+	if !timeNamespace(spec) {
+		t.Error("no time namespace")
+	}
+	env := []string{"SOURCE_DATE_EPOCH=1577878200", "FAKETIME=@2020-01-01 11:30:00"}
+	if !slices.Equal(spec.Process.Env, env) {
+		t.Errorf("env = %q, want %q", spec.Process.Env, env)
+	}
+	if err := validateTimeNamespace(spec); err != nil && Kernel().TimeNamespace {
+		t.Error(err)
+	}
+
+	// Without clock options the spec is left alone.
+	spec = &specs.Spec{}
+	if err := applyClock(spec, &RunOptions{}); err != nil || spec.Linux != nil {
+		t.Errorf("applyClock = %v, linux %+v", err, spec.Linux)
+	}
+	if err := applyClock(spec, &RunOptions{FakeDate: date}); err == nil {
+		t.Error("a fake date without process.args succeeded")
+	}
+}
+
+func TestValidateTimeNamespace(t *testing.T) {
+	withKernel(t, KernelFeatures{Release: "6.1.0", TimeNamespace: true})
+	timens := []specs.LinuxNamespace{{Type: specs.TimeNamespace}}
+	for _, tc := range []struct {
+		name  string
+		linux specs.Linux
+		ok    bool
+	}{
+		{"namespace", specs.Linux{Namespaces: timens}, true},
+		{"offsets", specs.Linux{Namespaces: timens, TimeOffsets: map[string]specs.LinuxTimeOffset{"monotonic": {Secs: -60}}}, true},
+		{"no namespace", specs.Linux{TimeOffsets: map[string]specs.LinuxTimeOffset{"monotonic": {Secs: 60}}}, false},
+		{"unknown clock", specs.Linux{Namespaces: timens, TimeOffsets: map[string]specs.LinuxTimeOffset{"realtime": {Secs: 60}}}, false},
+		{"nanosecs", specs.Linux{Namespaces: timens, TimeOffsets: map[string]specs.LinuxTimeOffset{"boottime": {Nanosecs: 1e9}}}, false},
+	} {
+		if err := validateTimeNamespace(&specs.Spec{Linux: &tc.linux}); (err == nil) != tc.ok {
+			t.Errorf("%s: validateTimeNamespace = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+
+	withKernel(t, KernelFeatures{Release: "5.4.0"})
+	if err := validateTimeNamespace(&specs.Spec{Linux: &specs.Linux{Namespaces: timens}}); err == nil {
+		t.Error("a time namespace without kernel support succeeded")
+	}
+}
+
+func TestRemoveRTC(t *testing.T) {
+	origDevices, origCgroup := procDevices, cgroupRoot
+	procDevices = filepath.Join(t.TempDir(), "devices")
+	cgroupRoot = t.TempDir()
+	defer func() { procDevices, cgroupRoot = origDevices, origCgroup }()
+	writeFile(t, filepath.Join(cgroupRoot, "cgroup.controllers"), "", 0o644)
+	writeFile(t, procDevices, "Character devices:\n  1 mem\n  5 /dev/tty\n252 rtc\n\nBlock devices:\n 7 loop\n", 0o644)
+
+	spec := &specs.Spec{Linux: &specs.Linux{Devices: []specs.LinuxDevice{
+		{Path: "/dev/rtc0"}, {Path: "/dev/null"}, {Path: "/dev/rtc"}, {Path: "/dev/rtcx"},
+	}}}
+	if err := removeRTC(spec); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, d := range spec.Linux.Devices {
+		paths = append(paths, d.Path)
+	}
+	if want := []string{"/dev/null", "/dev/rtcx"}; !slices.Equal(paths, want) {
+		t.Errorf("devices = %q, want %q", paths, want)
+	}
+	rules := spec.Linux.Resources.Devices
+	if len(rules) != 1 || rules[0].Allow || rules[0].Type != "c" || *rules[0].Major != 252 || *rules[0].Minor != wildcardDevice {
+		t.Errorf("device rules = %+v, want a deny of major 252", rules)
+	}
+
+	// A host without RTC devices has no major to deny.
+	writeFile(t, procDevices, "Character devices:\n  1 mem\n\nBlock devices:\n252 rtc\n", 0o644)
+	spec = &specs.Spec{}
+	if err := removeRTC(spec); err != nil || spec.Linux.Resources != nil {
+		t.Errorf("removeRTC = %v, resources %+v", err, spec.Linux.Resources)
+	}
+}
@@ -0,0 +1,155 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A clone is a new container copied from another: created from the same
+// bundle with the same options, and with a copy of its root filesystem as
+// it is at the time, so an environment can be branched off without
+// rebuilding it. The copy is cheap where the storage allows. The overlay
+// rootfs of a container run from an image shares the layers of the image,
+// so only its writable layer is copied, and copies are reflinks on
+// filesystems such as btrfs or xfs. Any other rootfs is copied to
+// <containersDir>/<id>/rootfs, which the clone runs from instead of the
+// root.path of its spec, and which goes away when the clone is deleted.
+
+// Clone creates container newId from container srcId and leaves it Created,
+// detached, as Create does. A running source is frozen while its rootfs is
+// copied, when its cgroup has a freezer; without one, files it writes
+// meanwhile may be copied half way. Named volumes are shared, not copied,
+// and neither are snapshots.
+func (r *Runtime) Clone(ctx context.Context, srcId, newId string) (*Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if !objectNameRe.MatchString(newId) {
+		return nil, fmt.Errorf("invalid container id %q", newId)
+	}
+	src, err := r.State(srcId)
+	if err != nil {
+		return nil, err
+	}
+	if src.hostRootfs() {
+		return nil, fmt.Errorf("container %s runs on the host rootfs, which can't be cloned", srcId)
+	}
+	if src.Options == nil || src.SpecPath == "" || src.Rootfs == "" {
+		return nil, fmt.Errorf("container %s has no saved configuration to clone, run it again first", srcId)
+	}
+	if _, err := LoadState(newId); err == nil {
+		return nil, fmt.Errorf("container %s %w", newId, ErrExists)
+	}
+	if err := checkName(newId, ""); err != nil {
+		return nil, err
+	}
+	options, err := cloneOptions(*src.Options)
+	if err != nil {
+		return nil, err
+	}
+	// Nobody is attached to a clone.
+	options.Detach = true
+	options.ConsoleSocket = ""
+	options.ClonedFrom = srcId
+	// Names are unique, a clone goes by its id until given one.
+	options.Name = ""
+	options.create = true
+
+	if err := cloneRootfs(src, newId, options); err != nil {
+		return nil, err
+	}
+	if err := runContainer(ctx, newId, src.SpecPath, *options); err != nil {
+		// A container that got as far as its state keeps its rootfs
+		// until it is deleted.
+		if _, serr := LoadState(newId); serr != nil {
+			removeClonedRootfs(newId)
+		}
+		return nil, err
+	}
+	return LoadState(newId)
+}
+
+// cloneRootfs copies the rootfs of src for container id, pointing options
+// at the copy unless it is an image rootfs, prepared again from the copy of
+// its storage.
+func cloneRootfs(src *Container, id string, options *RunOptions) error {
+	if src.Image != nil {
+		// The writable layer only applies to the image it was made on.
+		img, err := LoadImage(options.Image)
+		if err != nil {
+			return err
+		}
+		if img.ID != src.Image.ID {
+			return fmt.Errorf("image %s has changed since container %s was created, so its rootfs can't be cloned", options.Image, src.Id)
+		}
+	}
+	if err := os.MkdirAll(containersDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create containers dir: %w", err)
+	}
+	dir := filepath.Join(containersDir, id)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("the storage of container %s %w at %s", id, ErrExists, dir)
+		}
+		return fmt.Errorf("failed to create the storage of %s: %w", id, err)
+	}
+
+	err := func() error {
+		if src.Status.running() {
+			thaw, err := freezeCgroup(src.CgroupPath)
+			if err != nil {
+				return err
+			}
+			defer thaw()
+		}
+		if src.Image == nil {
+			rootfs := imageContainerRootfs(id)
+			if err := os.Mkdir(rootfs, 0o755); err != nil {
+				return fmt.Errorf("failed to create the rootfs of %s: %w", id, err)
+			}
+			options.Rootfs = rootfs
+			return copyTree(src.Rootfs, rootfs)
+		}
+		return cloneImageStorage(src, dir)
+	}()
+	if err != nil {
+		removeClonedRootfs(id)
+		return fmt.Errorf("failed to clone the rootfs of %s: %w", src.Id, err)
+	}
+	return nil
+}
+
+// cloneImageStorage copies the storage of the image rootfs of src, its
+// writable layer and anonymous volumes, into dir. The overlay work dir and
+// mount point are made anew.
+func cloneImageStorage(src *Container, dir string) error {
+	from := filepath.Join(containersDir, src.Id)
+	entries, err := os.ReadDir(from)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if name == "work" || name == "rootfs" && src.Image.Driver == StorageOverlay || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		cmd := exec.Command("cp", "-a", "--reflink=auto", filepath.Join(from, name), filepath.Join(dir, name))
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error copying %s: %w", filepath.Join(from, name), err)
+		}
+	}
+	return nil
+}
+
+// removeClonedRootfs removes the storage made for clone id.
+func removeClonedRootfs(id string) {
+	if err := os.RemoveAll(filepath.Join(containersDir, id)); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to remove the rootfs of %s: %v\n", id, err)
+	}
+}
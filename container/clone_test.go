@@ -0,0 +1,90 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneRootfs(t *testing.T) {
+	tempImages(t)
+	rootfs := t.TempDir()
+	writeFile(t, filepath.Join(rootfs, "notes"), "mid-experiment\n", 0o600)
+	src := &Container{Id: "src", Status: Stopped, Rootfs: rootfs}
+
+	var options RunOptions
+	if err := cloneRootfs(src, "copy", &options); err != nil {
+		t.Fatal(err)
+	}
+	if want := imageContainerRootfs("copy"); options.Rootfs != want {
+		t.Errorf("rootfs is %q, want %q", options.Rootfs, want)
+	}
+	data, err := os.ReadFile(filepath.Join(options.Rootfs, "notes"))
+	if err != nil || string(data) != "mid-experiment\n" {
+		t.Errorf("copied file is %q (%v)", data, err)
+	}
+
+	// The storage of another container isn't written over.
+	if err := cloneRootfs(src, "copy", &RunOptions{}); !errors.Is(err, ErrExists) {
+		t.Errorf("cloning over existing storage: %v, want ErrExists", err)
+	}
+}
+
+func TestCloneImageStorage(t *testing.T) {
+	tempImages(t)
+	from := filepath.Join(containersDir, "src")
+	for _, d := range []string{"upper/etc", "work/work", "rootfs/etc"} {
+		if err := os.MkdirAll(filepath.Join(from, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(from, "driver"), StorageOverlay, 0o600)
+	writeFile(t, filepath.Join(from, "upper/etc/motd"), "changed\n", 0o644)
+	src := &Container{Id: "src", Image: &ImageRootfs{Driver: StorageOverlay}}
+
+	dir := filepath.Join(containersDir, "copy")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloneImageStorage(src, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "upper/etc/motd")); err != nil || string(data) != "changed\n" {
+		t.Errorf("writable layer not copied: %q (%v)", data, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "driver")); string(data) != StorageOverlay {
+		t.Errorf("driver is %q, want %q", data, StorageOverlay)
+	}
+	for _, d := range []string{"work", "rootfs"} {
+		if _, err := os.Stat(filepath.Join(dir, d)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was copied: %v", d, err)
+		}
+	}
+}
+
+func TestCloneChecks(t *testing.T) {
+	tempImages(t)
+	rt := &Runtime{}
+	ctx := context.Background()
+	if _, err := rt.Clone(ctx, "src", "bad/id"); err == nil {
+		t.Error("cloning to an invalid id succeeded")
+	}
+	if _, err := rt.Clone(ctx, "missing", "copy"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("cloning a missing container: %v, want ErrNotFound", err)
+	}
+	if err := saveState(&Container{Id: "bare", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Clone(ctx, "bare", "copy"); err == nil {
+		t.Error("cloning a container without its configuration succeeded")
+	}
+	src := &Container{Id: "src", Status: Stopped, Rootfs: t.TempDir(), SpecPath: "/bundle/config.json", Options: &RunOptions{}}
+	if err := saveState(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Clone(ctx, "src", "bare"); !errors.Is(err, ErrExists) {
+		t.Errorf("cloning over a container: %v, want ErrExists", err)
+	}
+}
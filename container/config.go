@@ -0,0 +1,353 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// The host-wide settings of containish live in /etc/containish/config.toml,
+// and each user can override them in ~/.config/containish/config.toml:
+//
+//	state_dir = "/run/containish"
+//	storage_dir = "/srv/containish"
+//	cgroup_parent = "machine/containish"
+//	network = "bridge"
+//	seccomp_profile = "/etc/containish/seccomp.json"
+//	log_driver = "json-file"
+//	log_opts = ["max-size=10m", "max-file=3"]
+//	plugin_dir = "/etc/containish/plugins.d"
+//	storage_driver = "overlay"
+//
+//	[path_policy.hardened]
+//	masked = ["/proc/cmdline"]
+//	passthrough = ["/proc/sys/net"]
+//
+//	[registry]
+//	mirrors = ["https://mirror.example.com"]
+//	insecure = ["registry.lan:5000"]
+//	auth_file = "/etc/containish/auth.json"
+//
+//	[vm]
+//	kernel = "/srv/containish/vm/vmlinux"
+//	hypervisor = "/usr/local/bin/qemu-system-x86_64"
+//
+// The command line loads them with LoadConfigFiles, lets flags and the
+// environment override them and applies the result with Configure before
+// doing anything else. Configure also hands them down to the helper
+// processs containish re-executes, which would otherwise fall back to the
+// defaults.
+
+// DefaultConfigPath is the host-wide configuration file.
+const DefaultConfigPath = "/etc/containish/config.toml"
+
+// userConfigPath is the configuration file of a user, relative to their
+// configuration dir.
+const userConfigPath = "containish/config.toml"
+
+// RootEnv overrides the state dir of the configuration file.
+const RootEnv = "CONTAINISH_ROOT"
+
+// configEnv passes the applied configuration to re-executed helpers.
+const configEnv = "_CONTAINISH_CONFIG"
+
+// Config holds the host-wide settings. Empty fields keep their default.
+type Config struct {
+	// StateDir holds the state of containers, /run/miniruntime by
+	// default.
+	StateDir string `toml:"state_dir" json:"stateDir,omitempty"`
+	// StorageDir holds volumes, networks, images and the rootfs of
+	// containers run from images, /var/lib/containish by default.
+	StorageDir string `toml:"storage_dir" json:"storageDir,omitempty"`
+	// CgroupParent is the cgroup, relative to the cgroup v2 root, the
+	// cgroupfs manager creates container cgroups under, containish by
+	// default.
+	CgroupParent string `toml:"cgroup_parent" json:"cgroupParent,omitempty"`
+	// Network is the network of containers that don't select one, in the
+	// form of ParseNetwork, NoneNetwork by default.
+	Network string `toml:"network" json:"network,omitempty"`
+	// SeccompProfile is a JSON file holding the linux.seccomp of specs
+	// that don't have one, or SeccompUnconfined to run them without a
+	// filter. By default they get a built-in allowlist.
+	SeccompProfile string `toml:"seccomp_profile" json:"seccompProfile,omitempty"`
+	// Capabilities are the capabilities of processes whose spec sets
+	// none, by default those Docker gives containers.
+	Capabilities []string `toml:"capabilities" json:"capabilities,omitempty"`
+	// LogDriver is the log driver of detached containers that don't
+	// select one, LogDriverJSONFile by default.
+	LogDriver string `toml:"log_driver" json:"logDriver,omitempty"`
+	// LogOpts are the --log-opt rotation options of detached containers
+	// logging to a file without any of their own, and the collector of
+	// those using the log driver of the configuration without an address.
+	LogOpts []string `toml:"log_opts" json:"logOpts,omitempty"`
+	// PluginDir holds the plugins run at the extension points of the
+	// runtime, /etc/containish/plugins.d by default.
+	PluginDir string `toml:"plugin_dir" json:"pluginDir,omitempty"`
+	// StorageDriver prepares the rootfs of containers run from images,
+	// StorageOverlay by default.
+	StorageDriver string `toml:"storage_driver" json:"storageDriver,omitempty"`
+	// Registry configures the registries images are pulled from and
+	// pushed to.
+	Registry RegistryConfig `toml:"registry" json:"registry"`
+	// PathPolicies extend the built-in path policies of the security
+	// classes, by class.
+	PathPolicies map[string]PathPolicy `toml:"path_policy" json:"pathPolicies,omitempty"`
+	// VM configures the microVMs of the vm isolation.
+	VM VMConfig `toml:"vm" json:"vm"`
+}
+
+// VMConfig holds the settings of the microVMs of the vm isolation.
+type VMConfig struct {
+	// Kernel is the kernel image they boot, vm/vmlinux in the storage dir
+	// by default.
+	Kernel string `toml:"kernel" json:"kernel,omitempty"`
+	// Hypervisor is the QEMU system emulator running them,
+	// qemu-system-<arch> on PATH by default.
+	Hypervisor string `toml:"hypervisor" json:"hypervisor,omitempty"`
+}
+
+// RegistryConfig holds the settings of image registries.
+type RegistryConfig struct {
+	// Mirrors are http or https URLs tried before Docker Hub.
+	Mirrors []string `toml:"mirrors" json:"mirrors,omitempty"`
+	// Insecure are host[:port] registries reached without TLS
+	// verification.
+	Insecure []string `toml:"insecure" json:"insecure,omitempty"`
+	// AuthFile holds the credentials for registries, in the format of the
+	// Docker client's config.json, by default that of the Docker client.
+	AuthFile string `toml:"auth_file" json:"authFile,omitempty"`
+}
+
+// ConfigPaths returns the configuration files in the order they are
+// layered: the host-wide file, then the file of the user if they have a
+// configuration dir.
+func ConfigPaths() []string {
+	paths := []string{DefaultConfigPath}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, userConfigPath))
+	}
+	return paths
+}
+
+// LoadConfig reads the configuration file at path. A missing file is an
+// empty configuration; an unknown setting is an error.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	md, err := toml.DecodeFile(path, &cfg)
+	if errors.Is(err, os.ErrNotExist) {
+		return Config{}, nil
+	}
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to load %s: %w", path, err)
+	}
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return Config{}, fmt.Errorf("unknown setting %q in %s", keys[0].String(), path)
+	}
+	return cfg, nil
+}
+
+// LoadConfigFiles reads the configuration files at paths and layers them,
+// the settings of each file overriding those of the files before it.
+func LoadConfigFiles(paths ...string) (Config, error) {
+	var cfg Config
+	for _, path := range paths {
+		c, err := LoadConfig(path)
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.merge(c)
+	}
+	return cfg, nil
+}
+
+// merge overrides the settings of cfg with those set in o.
+func (cfg *Config) merge(o Config) {
+	set := func(dst *string, src string) {
+		if src != "" {
+			*dst = src
+		}
+	}
+	set(&cfg.StateDir, o.StateDir)
+	set(&cfg.StorageDir, o.StorageDir)
+	set(&cfg.CgroupParent, o.CgroupParent)
+	set(&cfg.Network, o.Network)
+	set(&cfg.SeccompProfile, o.SeccompProfile)
+	set(&cfg.LogDriver, o.LogDriver)
+	set(&cfg.PluginDir, o.PluginDir)
+	set(&cfg.StorageDriver, o.StorageDriver)
+	if o.LogOpts != nil {
+		cfg.LogOpts = o.LogOpts
+	}
+	if o.Capabilities != nil {
+		cfg.Capabilities = o.Capabilities
+	}
+	if o.Registry.Mirrors != nil {
+		cfg.Registry.Mirrors = o.Registry.Mirrors
+	}
+	if o.Registry.Insecure != nil {
+		cfg.Registry.Insecure = o.Registry.Insecure
+	}
+	set(&cfg.Registry.AuthFile, o.Registry.AuthFile)
+	set(&cfg.VM.Kernel, o.VM.Kernel)
+	set(&cfg.VM.Hypervisor, o.VM.Hypervisor)
+	for class, p := range o.PathPolicies {
+		if cfg.PathPolicies == nil {
+			cfg.PathPolicies = make(map[string]PathPolicy)
+		}
+		cfg.PathPolicies[class] = p
+	}
+}
+
+// Validate checks the settings of cfg.
+func (cfg Config) Validate() error {
+	for _, dir := range []struct{ name, path string }{
+		{"state dir", cfg.StateDir},
+		{"storage dir", cfg.StorageDir},
+		{"plugin dir", cfg.PluginDir},
+		{"registry auth file", cfg.Registry.AuthFile},
+		{"vm kernel", cfg.VM.Kernel},
+		{"vm hypervisor", cfg.VM.Hypervisor},
+	} {
+		if dir.path != "" && !filepath.IsAbs(dir.path) {
+			return fmt.Errorf("%s %q must be an absolute path", dir.name, dir.path)
+		}
+	}
+	if p := cfg.SeccompProfile; p != "" && p != SeccompUnconfined && !filepath.IsAbs(p) {
+		return fmt.Errorf("seccomp profile %q must be an absolute path or %s", p, SeccompUnconfined)
+	}
+	if _, err := parseCapabilities(cfg.Capabilities); err != nil {
+		return fmt.Errorf("invalid capabilities: %w", err)
+	}
+	if p := cfg.CgroupParent; p != "" {
+		if filepath.IsAbs(p) || filepath.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("cgroup parent %q must be a clean path relative to the cgroup root", p)
+		}
+	}
+	if cfg.Network != "" {
+		if _, err := ParseNetwork(cfg.Network); err != nil {
+			return fmt.Errorf("invalid default network: %w", err)
+		}
+	}
+	if err := validateLogDriver(cfg.LogDriver); err != nil {
+		return err
+	}
+	if d := cfg.StorageDriver; d != "" && d != StorageOverlay && d != StorageVFS {
+		return fmt.Errorf("unknown storage driver %q, must be %s or %s", d, StorageOverlay, StorageVFS)
+	}
+	logCfg, err := ParseLogOpts(cfg.LogOpts)
+	if err != nil {
+		return fmt.Errorf("invalid log_opts: %w", err)
+	}
+	if logCfg.Driver = cfg.LogDriver; logCfg.Driver == "" {
+		logCfg.Driver = LogDriverJSONFile
+	}
+	if err := validateLogConfig(logCfg); err != nil {
+		return fmt.Errorf("invalid log_opts: %w", err)
+	}
+	for _, m := range cfg.Registry.Mirrors {
+		u, err := url.Parse(m)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("registry mirror %q must be an http or https URL", m)
+		}
+	}
+	for _, h := range cfg.Registry.Insecure {
+		if h == "" || strings.ContainsAny(h, "/ ") {
+			return fmt.Errorf("insecure registry %q must be a host[:port]", h)
+		}
+	}
+	for _, class := range sortedKeys(cfg.PathPolicies) {
+		if err := validatePathPolicy(class, cfg.PathPolicies[class]); err != nil {
+			return fmt.Errorf("invalid path_policy: %w", err)
+		}
+	}
+	return nil
+}
+
+// Configure validates cfg and makes every runtime in the process, and in
+// the helper processes it starts, use it.
+func Configure(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.Setenv(configEnv, string(data)); err != nil {
+		return err
+	}
+	applyConfig(cfg)
+	return nil
+}
+
+// applyConfig sets the package defaults overridden by cfg.
+func applyConfig(cfg Config) {
+	if cfg.StateDir != "" {
+		baseStateDir = cfg.StateDir
+	}
+	if cfg.StorageDir != "" {
+		volumesDir = filepath.Join(cfg.StorageDir, "volumes")
+		networksDir = filepath.Join(cfg.StorageDir, "networks")
+		imagesDir = filepath.Join(cfg.StorageDir, "images")
+		containersDir = filepath.Join(cfg.StorageDir, "containers")
+		rootfsCacheDir = filepath.Join(cfg.StorageDir, "rootfs-cache")
+		shutdownRecordPath = filepath.Join(cfg.StorageDir, "shutdown.json")
+		vmKernel = filepath.Join(cfg.StorageDir, "vm", "vmlinux")
+	}
+	if cfg.VM.Kernel != "" {
+		vmKernel = cfg.VM.Kernel
+	}
+	if cfg.VM.Hypervisor != "" {
+		vmHypervisor = cfg.VM.Hypervisor
+	}
+	if cfg.CgroupParent != "" {
+		cgroupParent = cfg.CgroupParent
+	}
+	if cfg.Network != "" {
+		defaultNetwork = cfg.Network
+	}
+	if cfg.SeccompProfile != "" {
+		defaultSeccompProfile = cfg.SeccompProfile
+	}
+	if cfg.Capabilities != nil {
+		defaultCapabilities = cfg.Capabilities
+	}
+	if cfg.LogDriver != "" {
+		defaultLogDriver = cfg.LogDriver
+	}
+	if cfg.PluginDir != "" {
+		pluginDir = cfg.PluginDir
+	}
+	if cfg.StorageDriver != "" {
+		storageDriver = cfg.StorageDriver
+	}
+	registryConfig = cfg.Registry
+	if cfg.PathPolicies != nil {
+		pathPolicies = cfg.PathPolicies
+	}
+	if cfg.LogOpts != nil {
+		// Validate has parsed them already.
+		defaultLogConfig, _ = ParseLogOpts(cfg.LogOpts)
+	}
+}
+
+// inheritConfig applies the configuration of the process that re-executed
+// this one.
+func inheritConfig() error {
+	data := os.Getenv(configEnv)
+	if data == "" {
+		return nil
+	}
+	var cfg Config
+	if err := json.Unmarshal([]byte(data), &cfg); err != nil {
+		return fmt.Errorf("invalid $%s: %w", configEnv, err)
+	}
+	applyConfig(cfg)
+	return nil
+}
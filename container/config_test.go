@@ -0,0 +1,216 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := LoadConfig(filepath.Join(dir, "missing.toml"))
+	if err != nil || !reflect.DeepEqual(cfg, Config{}) {
+		t.Fatalf("LoadConfig of a missing file = %+v, %v", cfg, err)
+	}
+
+	path := filepath.Join(dir, "config.toml")
+	writeFile(t, path, "state_dir = \"/run/ci\"\nstorage_dir = \"/srv/ci\"\ncgroup_parent = \"ci/containish\"\nlog_driver = \"none\"\n", 0o644)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{StateDir: "/run/ci", StorageDir: "/srv/ci", CgroupParent: "ci/containish", LogDriver: LogDriverNone}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("LoadConfig = %+v, want %+v", cfg, want)
+	}
+
+	writeFile(t, path, "state_dir = \"/run/ci\"\nstate_dri = \"/run/typo\"\n", 0o644)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "state_dri") {
+		t.Fatalf("expected an error naming the unknown setting, got %v", err)
+	}
+	writeFile(t, path, "state_dir = /run/ci\n", 0o644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected an error for invalid TOML")
+	}
+
+	for _, cfg := range []Config{
+		{StateDir: "run/ci"},
+		{StorageDir: "srv"},
+		{CgroupParent: "/containish"},
+		{CgroupParent: "../escape"},
+		{LogDriver: "syslog"},
+		{StorageDriver: "btrfs"},
+		{Network: "macvlan"},
+		{SeccompProfile: "seccomp.json"},
+		{Capabilities: []string{"CAP_CHOWN", "CAP_NOPE"}},
+		{LogOpts: []string{"max-file=3"}},
+		{Registry: RegistryConfig{Mirrors: []string{"mirror.example.com"}}},
+		{Registry: RegistryConfig{Insecure: []string{"http://registry.lan"}}},
+		{Registry: RegistryConfig{AuthFile: "auth.json"}},
+		{VM: VMConfig{Kernel: "vmlinux"}},
+		{PathPolicies: map[string]PathPolicy{"relaxed": {}}},
+		{PathPolicies: map[string]PathPolicy{ClassDefault: {Masked: []string{"/etc/shadow"}}}},
+		{PathPolicies: map[string]PathPolicy{ClassHardened: {Passthrough: []string{"/proc/sys/kernel"}}}},
+	} {
+		if err := cfg.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestLoadConfigFiles(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "system.toml")
+	user := filepath.Join(dir, "user.toml")
+	writeFile(t, system, `state_dir = "/run/ci"
+network = "bridge"
+log_opts = ["max-size=10m", "max-file=3"]
+capabilities = ["CAP_CHOWN", "CAP_KILL"]
+
+[registry]
+mirrors = ["https://mirror.example.com"]
+insecure = ["registry.lan:5000"]
+
+[vm]
+kernel = "/srv/vmlinux"
+`, 0o644)
+	writeFile(t, user, `network = "none"
+log_opts = []
+
+[registry]
+insecure = []
+auth_file = "/etc/containish/auth.json"
+`, 0o644)
+
+	cfg, err := LoadConfigFiles(system, user, filepath.Join(dir, "missing.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{
+		StateDir:     "/run/ci",
+		Network:      NoneNetwork,
+		LogOpts:      []string{},
+		Capabilities: []string{"CAP_CHOWN", "CAP_KILL"},
+		Registry:     RegistryConfig{Mirrors: []string{"https://mirror.example.com"}, Insecure: []string{}, AuthFile: "/etc/containish/auth.json"},
+		VM:           VMConfig{Kernel: "/srv/vmlinux"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Fatalf("LoadConfigFiles = %+v, want %+v", cfg, want)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, user, "netwrok = \"bridge\"\n", 0o644)
+	if _, err := LoadConfigFiles(system, user); err == nil || !strings.Contains(err.Error(), user) {
+		t.Fatalf("expected an error naming %s, got %v", user, err)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	origNetwork, origProfile, origLog := defaultNetwork, defaultSeccompProfile, defaultLogConfig
+	defer func() { defaultNetwork, defaultSeccompProfile, defaultLogConfig = origNetwork, origProfile, origLog }()
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	t.Setenv(configEnv, "")
+
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "seccomp.json")
+	writeFile(t, profile, `{"defaultAction": "SCMP_ACT_ALLOW", "syscalls": [{"names": ["ptrace"], "action": "SCMP_ACT_ERRNO"}]}`, 0o644)
+	if err := Configure(Config{Network: HostNetwork, SeccompProfile: profile, LogOpts: []string{"max-size=1m"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	specPath := filepath.Join(dir, "config.json")
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"cwd": "/", "args": ["sh"]}}`, 0o644)
+	options := RunOptions{Detach: true}
+	spec, err := loadRunSpec(specPath, nil, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Network.Driver != HostNetwork {
+		t.Errorf("network = %+v, want the configured %s", options.Network, HostNetwork)
+	}
+	if spec.Linux == nil || spec.Linux.Seccomp == nil || spec.Linux.Seccomp.DefaultAction != "SCMP_ACT_ALLOW" {
+		t.Errorf("seccomp profile not applied: %+v", spec.Linux)
+	}
+	if options.Log.MaxSize != 1<<20 || options.Log.MaxFile != 1 {
+		t.Errorf("log config = %+v, want the configured rotation", options.Log)
+	}
+
+	// What the container sets wins over the configuration.
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "linux": {"seccomp": {"defaultAction": "SCMP_ACT_LOG"}}}`, 0o644)
+	options = RunOptions{Detach: true, Network: &NetworkConfig{Driver: NoneNetwork}, Log: LogConfig{MaxSize: 2 << 20, MaxFile: 2}}
+	if spec, err = loadRunSpec(specPath, nil, &options); err != nil {
+		t.Fatal(err)
+	}
+	if options.Network.Driver != NoneNetwork || spec.Linux.Seccomp.DefaultAction != "SCMP_ACT_LOG" || options.Log.MaxFile != 2 {
+		t.Errorf("the configuration overrode the container: %+v %+v %+v", options.Network, spec.Linux.Seccomp, options.Log)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	origState, origVolumes, origNetworks := baseStateDir, volumesDir, networksDir
+	origParent, origDriver := cgroupParent, defaultLogDriver
+	defer func() {
+		baseStateDir, volumesDir, networksDir = origState, origVolumes, origNetworks
+		cgroupParent, defaultLogDriver = origParent, origDriver
+	}()
+	t.Setenv(configEnv, "")
+
+	if err := Configure(Config{StateDir: "/run/ci", StorageDir: "/srv/ci", LogDriver: LogDriverNone}); err != nil {
+		t.Fatal(err)
+	}
+	if StateDir("c1") != "/run/ci/c1" || volumesDir != "/srv/ci/volumes" || networksDir != "/srv/ci/networks" {
+		t.Fatalf("dirs not configured: %s %s %s", StateDir("c1"), volumesDir, networksDir)
+	}
+	if cgroupParent != origParent || defaultLogDriver != LogDriverNone {
+		t.Fatalf("unexpected cgroup parent %q and log driver %q", cgroupParent, defaultLogDriver)
+	}
+
+	// A re-executed helper starts with the defaults and picks the
+	// configuration up from its environment.
+	baseStateDir, volumesDir, networksDir, defaultLogDriver = origState, origVolumes, origNetworks, origDriver
+	if err := inheritConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if StateDir("c1") != "/run/ci/c1" || defaultLogDriver != LogDriverNone {
+		t.Fatalf("configuration not inherited: %s %q", StateDir("c1"), defaultLogDriver)
+	}
+
+	if err := Configure(Config{CgroupParent: "/abs"}); err == nil {
+		t.Fatal("expected an invalid configuration to be rejected")
+	}
+}
+
+func TestLogDriverNone(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	specPath := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"cwd": "/", "args": ["sh"]}}`, 0o644)
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := rt.Plan("quiet", specPath, Detached(), WithLogConfig(LogConfig{Driver: LogDriverNone}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LogPath != "" {
+		t.Fatalf("a container without logs has log path %s", p.LogPath)
+	}
+	if _, err := rt.Plan("quiet", specPath, Detached(), WithLogConfig(LogConfig{Driver: LogDriverNone, MaxSize: 1 << 20, MaxFile: 1})); err == nil {
+		t.Fatal("expected log rotation without a log file to be rejected")
+	}
+	if _, err := rt.Plan("quiet", specPath, WithLogConfig(LogConfig{Driver: LogDriverNone})); err == nil {
+		t.Fatal("expected a log driver for a foreground container to be rejected")
+	}
+	if _, err := os.Stat(StateDir("quiet")); !os.IsNotExist(err) {
+		t.Fatalf("Plan created the state dir: %v", err)
+	}
+}
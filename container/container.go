@@ -1,23 +1,27 @@
 package container
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sys/unix"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-const ParentStage = "PARENT_STAGE"
-const ChildStage = "CHILD_STAGE"
+const parentStage = "PARENT_STAGE"
+const childStage = "CHILD_STAGE"
 
 type Status int
 
@@ -25,23 +29,405 @@ const (
 	Created Status = iota
 	Running
 	Stopped
+	// Starting is a container run with RunOptions.Notify whose process
+	// runs but hasn't sent READY=1 to its notify socket yet. It is
+	// running as far as the OCI state goes.
+	Starting
 )
 
 type Container struct {
-	Id             string    `json:"id"`
-	InitProcessPiD int       `json:"initProcessPiD"`
-	CreatedAt      time.Time `json:"createdAt"`
-	Status         Status    `json:"status"`
-	Bundle         string    `json:"bundle"`
+	Id             string         `json:"id"`
+	InitProcessPiD int            `json:"initProcessPiD"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	Status         Status         `json:"status"`
+	Bundle         string         `json:"bundle"`
+	CgroupPath     string         `json:"cgroupPath,omitempty"`
+	CgroupManager  string         `json:"cgroupManager,omitempty"`
+	IntelRdtPath   string         `json:"intelRdtPath,omitempty"`
+	Network        *NetworkConfig `json:"network,omitempty"`
+	Egress         *EgressPolicy  `json:"egress,omitempty"`
+	Volumes        []VolumeMount  `json:"volumes,omitempty"`
+	// Name is the name of a container run with RunOptions.Name, which
+	// the state store indexes, see ResolveID.
+	Name string `json:"name,omitempty"`
+	// Integrity is the digest of the hash manifest of a container run
+	// with RunOptions.Integrity.
+	Integrity string `json:"integrity,omitempty"`
+	// LogPath is the log file of a detached container.
+	LogPath string `json:"logPath,omitempty"`
+	// TracePath is the system call trace of a container run with Trace.
+	TracePath string `json:"tracePath,omitempty"`
+	// Annotations are those of the spec.
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// StopSignal is the signal stopping the container sends first,
+	// SIGTERM if empty.
+	StopSignal string `json:"stopSignal,omitempty"`
+	// Rootfs is the root filesystem of the container.
+	Rootfs string `json:"rootfs,omitempty"`
+	// Image is the image the rootfs was prepared from, for a container
+	// run from one.
+	Image *ImageRootfs `json:"image,omitempty"`
+	// SpecPath is the spec the container was run from.
+	SpecPath string `json:"specPath,omitempty"`
+	// Options are the options the container was run with.
+	Options *RunOptions `json:"options,omitempty"`
+	// Graceful records whether the init process exited on the stop
+	// signal when the container was last stopped, rather than having to
+	// be killed. It is nil if the container wasn't stopped with
+	// StopContainer.
+	Graceful *bool `json:"graceful,omitempty"`
+	// Usage is what the container consumed, recorded when it stopped.
+	Usage *Usage `json:"usage,omitempty"`
+	// InitStartTime is when the init process started, in clock ticks
+	// since boot, to notice its pid being reused.
+	InitStartTime uint64 `json:"initStartTime,omitempty"`
+	// InitNsPid is the pid of the init process in the pid namespace of
+	// the container, 1 unless it shares another one.
+	InitNsPid int `json:"initNsPid,omitempty"`
+	// MonitorPid is the pid of the monitor of a detached container, and
+	// MonitorStartTime its start time, until the monitor is done with
+	// the exit of the init process, see waitMonitor.
+	MonitorPid       int    `json:"monitorPid,omitempty"`
+	MonitorStartTime uint64 `json:"monitorStartTime,omitempty"`
+	// PidNamespace is the pid namespace the container joined,
+	// container:<id> or a path, empty if it has its own.
+	PidNamespace string `json:"pidNamespace,omitempty"`
+	// Emulation is how the container runs when its rootfs is for another
+	// architecture than the host.
+	Emulation *Emulation `json:"emulation,omitempty"`
+	// Storage is the storage quota of the rootfs, if it has one.
+	Storage *StorageQuota `json:"storage,omitempty"`
+	// Reservation is what the container reserves of the host while it
+	// is created or running, if it has memory or CPU limits.
+	Reservation *Reservation `json:"reservation,omitempty"`
+	// ExitCode and FinishedAt record how and when the init process of a
+	// detached container exited, once its monitor has seen it.
+	ExitCode   *int       `json:"exitCode,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// ManuallyStopped records that the container was stopped or killed
+	// on request, so its restart policy doesn't start it again.
+	ManuallyStopped bool `json:"manuallyStopped,omitempty"`
+	// RestartCount is how many times the restart policy has started the
+	// container again since it was last started by hand.
+	RestartCount int `json:"restartCount,omitempty"`
+	// Exits are the last exits of the init process of a detached
+	// container, the oldest first, and CrashLoop the crash loop its
+	// restart policy backs off, if any, see monitorContainer.
+	Exits     []ExitRecord `json:"exits,omitempty"`
+	CrashLoop *CrashLoop   `json:"crashLoop,omitempty"`
+	// MachineID is the /etc/machine-id of the container, kept across its
+	// runs.
+	MachineID string `json:"machineID,omitempty"`
+	// ReadyAt is when the process of a container run with
+	// RunOptions.Notify sent READY=1.
+	ReadyAt *time.Time `json:"readyAt,omitempty"`
+	// Health is the health of a container run with
+	// RunOptions.HealthCheck, once its monitor has started probing it.
+	Health *Health `json:"health,omitempty"`
+	// AuxProcesses are the auxiliary processes of the bundle, and
+	// AuxStatus the state of those started, in the order they were.
+	AuxProcesses []AuxProcess      `json:"auxProcesses,omitempty"`
+	AuxStatus    []AuxProcessState `json:"auxStatus,omitempty"`
+	// Security is what the container sees of /proc and /sys, as the
+	// policy of its class decided.
+	Security *SecurityProfile `json:"security,omitempty"`
+	// Process is the security context of the container process, which
+	// the processes exec'd in the container get too.
+	Process *ProcessSecurity `json:"process,omitempty"`
+}
+
+// RunOptions controls how RunContainer starts a container. They are saved
+// with the container so it can be started again once stopped.
+type RunOptions struct {
+	// Name is a name the container can be referred to by in place of its
+	// id, unique among containers, see ResolveID.
+	Name string `json:"name,omitempty"`
+	// Bundle is the absolute path of the bundle directory, against which
+	// a relative root, bind mount source or aux process file resolves.
+	// It is the directory holding the spec when empty.
+	Bundle string `json:"bundle,omitempty"`
+	// Detach makes RunContainer return once the container init process
+	// is running instead of waiting for it to exit.
+	Detach bool `json:"detach,omitempty"`
+	// CgroupManager selects how the container cgroup is created, either
+	// CgroupfsManager (the default) or SystemdManager.
+	CgroupManager string `json:"cgroupManager,omitempty"`
+	// Network selects the container network. When nil or without a
+	// driver the container joins the network of the configuration, by
+	// default a namespace of its own with only loopback (NoneNetwork).
+	Network *NetworkConfig `json:"network,omitempty"`
+	// Egress restricts outbound traffic from the container.
+	Egress *EgressPolicy `json:"egress,omitempty"`
+	// Volumes are named volumes to mount, created on first use.
+	Volumes []VolumeMount `json:"volumes,omitempty"`
+	// Tmpfs are extra tmpfs mounts, appended to the spec mounts.
+	Tmpfs []specs.Mount `json:"tmpfs,omitempty"`
+	// Secrets are host files exposed under /run/secrets or in the
+	// environment of the container process. They are read every time the
+	// container starts.
+	Secrets []Secret `json:"secrets,omitempty"`
+	// Devices are CDI devices to inject, by fully qualified name such as
+	// vendor.com/fpga=0.
+	Devices []string `json:"devices,omitempty"`
+	// HostDevices are host device nodes passed through to the container.
+	HostDevices []HostDevice `json:"hostDevices,omitempty"`
+	// GPUs are the GPUs passed through to the container, GPUsAll or
+	// their indexes or UUIDs.
+	GPUs []string `json:"gpus,omitempty"`
+	// Image is the reference of an image to run the container from,
+	// pulled unless in the store. Its config gives the process of the
+	// container when the bundle has no config.json.
+	Image string `json:"image,omitempty"`
+	// Entrypoint, Cmd, Workdir and User override those of the image
+	// config in the process generated from it. A non-nil empty Entrypoint
+	// clears that of the image, and an Entrypoint given also drops the
+	// command of the image.
+	Entrypoint *string  `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	Workdir    string   `json:"workdir,omitempty"`
+	User       string   `json:"user,omitempty"`
+	// Runtime executes the container process: empty for an ELF binary, or
+	// RuntimeWasm for a WebAssembly module, see execWasm.
+	Runtime string `json:"runtime,omitempty"`
+	// Isolation selects the sandbox the container process runs in: empty
+	// for the namespaces of the container, IsolationUserns to add a user
+	// namespace mapped to subordinate ids, or IsolationVM for a microVM.
+	Isolation string `json:"isolation,omitempty"`
+	// Platform is the architecture, as a GOARCH, the rootfs must be for.
+	// When empty any architecture the host can run or emulate is accepted.
+	Platform string `json:"platform,omitempty"`
+	// CopyEmulator copies the qemu emulator of a foreign rootfs into it
+	// when its binfmt_misc handler looks the emulator up in the container.
+	CopyEmulator bool `json:"copyEmulator,omitempty"`
+	// Rootfs replaces the root.path of the spec. A clone runs from the
+	// copy of the rootfs it was given. RootfsHost runs the container on
+	// the filesystem of the host.
+	Rootfs string `json:"rootfs,omitempty"`
+	// ClonedFrom is the container a clone was copied from, see Clone.
+	ClonedFrom string `json:"clonedFrom,omitempty"`
+	// StorageSize limits the space the container can use in its rootfs,
+	// in bytes, with a project quota. Zero means no limit.
+	StorageSize int64 `json:"storageSize,omitempty"`
+	// Env sets variables in the environment of the container process, as
+	// KEY=VALUE, replacing those of the spec with the same key.
+	Env []string `json:"env,omitempty"`
+	// Timezone is the timezone of the container, a zone such as
+	// Europe/Lisbon or TimezoneHost. Empty leaves it to the rootfs.
+	Timezone string `json:"timezone,omitempty"`
+	// HostLocale passes the locale variables of the runtime on to the
+	// container process, ahead of Env.
+	HostLocale bool `json:"hostLocale,omitempty"`
+	// MonotonicOffset shifts CLOCK_MONOTONIC and CLOCK_BOOTTIME of the
+	// container, which gets a time namespace, unless the spec sets their
+	// linux.timeOffsets.
+	MonotonicOffset time.Duration `json:"monotonicOffset,omitempty"`
+	// FakeDate is the date the container process is told it is, through
+	// SOURCE_DATE_EPOCH and libfaketime when the rootfs has it.
+	FakeDate time.Time `json:"fakeDate,omitempty"`
+	// NoRTC takes the RTC devices of the host away from the container.
+	NoRTC bool `json:"noRTC,omitempty"`
+	// OSRelease mounts the os-release of the rootfs of a container run
+	// from an image with IMAGE_ID and IMAGE_VERSION set from the image.
+	OSRelease bool `json:"osRelease,omitempty"`
+	// Memory limits the memory of the container, in bytes, with
+	// memory.max. Zero keeps the limits of the spec.
+	Memory int64 `json:"memory,omitempty"`
+	// CPUs limits the CPU time of the container, in CPUs, with cpu.max.
+	// Zero keeps the limits of the spec.
+	CPUs float64 `json:"cpus,omitempty"`
+	// MemorySwap limits the memory and swap of the container together, in
+	// bytes, with memory.swap.max: the swap it may use is what is left
+	// above Memory, which it requires. MemorySwapUnlimited lifts the limit
+	// on swap, and zero keeps the limits of the spec.
+	MemorySwap int64 `json:"memorySwap,omitempty"`
+	// Restart is the restart policy of a detached container, applied by
+	// its monitor when the init process exits.
+	Restart RestartPolicy `json:"restart,omitempty"`
+	// HealthCheck is probed by the monitor of a detached container, see
+	// HealthCheck.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// Log controls rotation of the log file of a detached container.
+	Log LogConfig `json:"log,omitempty"`
+	// Trace traces the system calls of the container processes to a file
+	// in the state dir, either TraceLog or TraceSummary. Empty disables
+	// tracing.
+	Trace string `json:"trace,omitempty"`
+	// CoreDumps captures the core dumps of the container processes in the
+	// state dir, see ListCores, making the runtime the core_pattern helper
+	// of the host.
+	CoreDumps bool `json:"coreDumps,omitempty"`
+	// ConsoleSocket is a unix socket the master of the container's pseudo
+	// terminal is sent to. It requires process.terminal in the spec.
+	ConsoleSocket string `json:"consoleSocket,omitempty"`
+	// StopSignal is the signal stopping the container sends first. It
+	// defaults to the AnnotationStopSignal annotation, then SIGTERM.
+	StopSignal string `json:"stopSignal,omitempty"`
+	// Requires are the ids of containers the container depends on, added
+	// to its AnnotationDependsOn annotation, which must be running for it
+	// to run.
+	Requires []string `json:"requires,omitempty"`
+	// RequiresCondition, WaitReady or WaitHealthy, makes the container wait
+	// for those it depends on to be ready or healthy rather than only
+	// running, up to RequiresTimeout, DefaultRequiresTimeout if zero.
+	RequiresCondition string        `json:"requiresCondition,omitempty"`
+	RequiresTimeout   time.Duration `json:"requiresTimeout,omitempty"`
+	// Notify gives the container process a notify socket, at
+	// NOTIFY_SOCKET, and keeps the container Starting until the process
+	// sends READY=1 to it.
+	Notify bool `json:"notify,omitempty"`
+	// Metadata gives the container a socket to ask about itself, see
+	// Metadata.
+	Metadata bool `json:"metadata,omitempty"`
+	// PidContainer is the container whose pid namespace the container
+	// joins, rather than getting one of its own.
+	PidContainer string `json:"pidContainer,omitempty"`
+	// SpecPatches are JSON merge patches or JSON patches applied in order
+	// to the spec, see ParseSpecPatch.
+	SpecPatches []json.RawMessage `json:"specPatches,omitempty"`
+	// NoNewKeyring keeps the container process in the session keyring of
+	// the runtime rather than giving it one of its own.
+	NoNewKeyring bool `json:"noNewKeyring,omitempty"`
+	// Force runs the container even if the host lacks the memory or CPUs
+	// it reserves.
+	Force bool `json:"force,omitempty"`
+	// Privileged runs the container process with every capability and no
+	// seccomp filter, /proc and /sys unmasked, /sys read-write and the
+	// devices of the host, rather than with the seccomp profile and
+	// capabilities of the configuration.
+	Privileged bool `json:"privileged,omitempty"`
+	// SecurityClass is the class of the container, ClassDefault or
+	// ClassHardened, deciding what it sees of /proc and /sys, see
+	// PathPolicy. A privileged container is of ClassPrivileged.
+	SecurityClass string `json:"securityClass,omitempty"`
+	// StrictSpec rejects a spec setting what the runtime doesn't support,
+	// see Features, rather than warning that it is ignored.
+	StrictSpec bool `json:"strictSpec,omitempty"`
+	// Integrity records a hash manifest of the image of a container run
+	// from one when it is first created, for Verify.
+	Integrity bool `json:"integrity,omitempty"`
+	// Quiet writes the messages of the runtime to runtime.log in the
+	// state dir rather than stdout, leaving the terminal to the output of
+	// the container.
+	Quiet bool `json:"quiet,omitempty"`
+	// Progress receives the progress of setting the container up.
+	Progress ProgressFunc `json:"-"`
+	// ExitFile receives the exit code of the container process, see
+	// OpenExitFd. It requires a detached container.
+	ExitFile *os.File `json:"-"`
+
+	// create stops the start once the container is set up, with its init
+	// process waiting on the exec fifo.
+	create bool
+	// restartCount is the RestartCount of a container started again by
+	// its restart policy.
+	restartCount int
+	// security is set by loadRunSpec.
+	security *SecurityProfile
+	// fakeStages runs the container through the fake child stage, see
+	// WithFakeStages.
+	fakeStages bool
+}
+
+// cloneOptions returns a deep copy of options.
+func cloneOptions(options RunOptions) (*RunOptions, error) {
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode run options: %w", err)
+	}
+	var clone RunOptions
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("failed to decode run options: %w", err)
+	}
+	return &clone, nil
 }
 
 // stageOptions represents configuration passed from the runtime to the parent
 // stage through the init pipe.
 type stageOptions struct {
-	Detach bool   `json:"detach"`
-	Rootfs string `json:"rootfs"`
+	ContainerId string `json:"containerId"`
+	Detach      bool   `json:"detach"`
+	Rootfs      string `json:"rootfs"`
+	CgroupPath  string `json:"cgroupPath"`
+	// Spec is the full runtime spec, forwarded to the child stage so it
+	// can set up the container filesystem.
+	Spec *specs.Spec `json:"spec"`
+	// NotifySocket is the host path of the sd_notify relay socket to
+	// expose inside the container, if any.
+	NotifySocket string `json:"notifySocket,omitempty"`
+	// MetadataSocket is the host path of the metadata socket to expose
+	// inside the container, if any.
+	MetadataSocket string `json:"metadataSocket,omitempty"`
+	// Wasm runs the process of the spec as a WebAssembly module.
+	Wasm bool `json:"wasm,omitempty"`
+	// HostRootfs runs the container on the filesystem of the host, with
+	// Rootfs /, see RootfsHost.
+	HostRootfs bool `json:"hostRootfs,omitempty"`
+	// HostsFile is the host path of the hosts file to mount at /etc/hosts,
+	// if any.
+	HostsFile string `json:"hostsFile,omitempty"`
+	// MachineIDFile is the host path of the machine ID to mount at
+	// /etc/machine-id, if any.
+	MachineIDFile string `json:"machineIDFile,omitempty"`
+	// HostNetwork keeps the container in the host network namespace.
+	HostNetwork bool `json:"hostNetwork,omitempty"`
+	// Privileged is RunOptions.Privileged.
+	Privileged bool `json:"privileged,omitempty"`
+	// Mounts are bind mounted into the rootfs before pivot_root.
+	Mounts []stageMount `json:"mounts,omitempty"`
+	// MaskedPaths are hidden and ReadonlyPaths made read-only after
+	// pivot_root. The spec loses an empty list on the way, which asks for
+	// none rather than the defaults.
+	MaskedPaths   []string `json:"maskedPaths"`
+	ReadonlyPaths []string `json:"readonlyPaths"`
+	// WritablePaths are then bound writable below the read-only paths.
+	WritablePaths []string `json:"writablePaths,omitempty"`
+	// InheritStdio gives a detached container the stdio of the runtime
+	// rather than the logger's.
+	InheritStdio bool `json:"inheritStdio,omitempty"`
+	// ExecFifo is opened for writing by the container init before it
+	// executes the container process, which blocks until the container is
+	// started.
+	ExecFifo string `json:"execFifo,omitempty"`
+	// SeccompState is the container state sent to the seccomp agent with
+	// the notify fd, when the spec has a seccomp listenerPath. The child
+	// stage fills in its pid.
+	SeccompState *specs.State `json:"seccompState,omitempty"`
+	// Secrets are written to a tmpfs on /run/secrets after pivot_root,
+	// and SecretEnv added to the environment of the container process.
+	Secrets   []stageSecret `json:"secrets,omitempty"`
+	SecretEnv []string      `json:"secretEnv,omitempty"`
+	// NoNewKeyring is RunOptions.NoNewKeyring.
+	NoNewKeyring bool `json:"noNewKeyring,omitempty"`
+	// PidNamespace is the pid namespace the child stage joins, passed
+	// to the parent stage as PIDNS_FD, rather than creating one.
+	PidNamespace string `json:"pidNamespace,omitempty"`
+	// Faketime preloads libfaketime into the container process for
+	// RunOptions.FakeDate.
+	Faketime bool `json:"faketime,omitempty"`
+	// CoreDumps lifts RLIMIT_CORE for RunOptions.CoreDumps.
+	CoreDumps bool `json:"coreDumps,omitempty"`
+	// Fake has the parent stage fork the fake child stage, in no
+	// namespace, see WithFakeStages.
+	Fake bool `json:"fake,omitempty"`
+	// Isolation selects the sandbox running the container process, see
+	// RunOptions.Isolation.
+	Isolation string `json:"isolation,omitempty"`
+	// KeepRoot leaves the child stage on the root of the host, with the
+	// rootfs set up where it is, for a sandbox that doesn't run the
+	// process in it itself.
+	KeepRoot bool `json:"keepRoot,omitempty"`
+	// VM is the microVM of the vm isolation.
+	VM *vmStage `json:"vm,omitempty"`
+	// Exec is the process the exec process stage starts, with the
+	// resource limits Rlimits of the container init process.
+	Exec    *ExecOptions `json:"exec,omitempty"`
+	Rlimits []execRlimit `json:"rlimits,omitempty"`
 }
 
+// initProcessPath is the program the child stage executes as the container
+// init process.
+const initProcessPath = "/bin/sh"
+
 // baseStateDir is where container state directories are created. It is a
 // variable so tests can override it.
 var baseStateDir = "/run/miniruntime"
@@ -51,44 +437,6 @@ func StateDir(id string) string {
 	return filepath.Join(baseStateDir, id)
 }
 
-func SaveState(stateDir string, s *Container) error {
-	if err := os.MkdirAll(stateDir, 0o700); err != nil {
-		return fmt.Errorf("failed to create state dir: %w", err)
-	}
-
-	f, err := os.Create(filepath.Join(stateDir, "state.json"))
-	if err != nil {
-		return fmt.Errorf("failed to create state.json: %w", err)
-	}
-	defer f.Close()
-
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", " ")
-	if err := enc.Encode(s); err != nil {
-		return fmt.Errorf("failed to enconde container state: %w", err)
-	}
-
-	if err := f.Sync(); err != nil {
-		return fmt.Errorf("failed to sync state.json: %w", err)
-	}
-
-	return nil
-}
-
-func LoadState(stateDir string) (*Container, error) {
-	f, err := os.Open(filepath.Join(stateDir, "state.json"))
-	if err != nil {
-		return nil, fmt.Errorf("failed to open state.json: %w", err)
-	}
-	defer f.Close()
-
-	var s Container
-	if err := json.NewDecoder(f).Decode(&s); err != nil {
-		return nil, fmt.Errorf("failed to decode state.json: %w", err)
-	}
-	return &s, nil
-}
-
 // LoadSpec loads a runtime-spec config from the given path.
 func LoadSpec(configPath string) (*specs.Spec, error) {
 	f, err := os.Open(configPath)
@@ -104,7 +452,7 @@ func LoadSpec(configPath string) (*specs.Spec, error) {
 	return &spec, nil
 }
 
-func CreateStateDir(containerId string) (string, error) {
+func createStateDir(containerId string) (string, error) {
 	stateDir := StateDir(containerId)
 	if err := os.MkdirAll(stateDir, 0700); err != nil {
 		return "", fmt.Errorf("failed to create container state dir: %w", err)
@@ -112,42 +460,604 @@ func CreateStateDir(containerId string) (string, error) {
 	return stateDir, nil
 }
 
-// RunContainer prepares, forks, and executes the container process.
-// RunContainer prepares, forks, and executes the container process. If detach is
-// true, the function returns once the container init process is running.
-func RunContainer(containerId, specPath string, detach bool) error {
-	spec, err := LoadSpec(specPath)
+// bundleDir returns the bundle of a container run from the spec at
+// specPath: options.Bundle or else the directory holding the spec.
+func (o *RunOptions) bundleDir(specPath string) string {
+	if o.Bundle != "" {
+		return o.Bundle
+	}
+	return filepath.Dir(specPath)
+}
+
+// loadRunSpec fills in the defaults of options, validates them, and loads
+// and validates the spec at specPath. A relative root and relative bind
+// mount sources are resolved against the bundle, see RunOptions.Bundle.
+// With img, the container is run from that image, see loadImageSpec.
+func loadRunSpec(specPath string, img *Image, options *RunOptions) (*specs.Spec, error) {
+	if options.CgroupManager == "" {
+		options.CgroupManager = CgroupfsManager
+	}
+	if options.CgroupManager != CgroupfsManager && options.CgroupManager != SystemdManager {
+		return nil, fmt.Errorf("unknown cgroup manager %q", options.CgroupManager)
+	}
+
+	// A network without a driver only sets the address of the default
+	// network.
+	if options.Network == nil {
+		options.Network = &NetworkConfig{}
+	}
+	if options.Network.Driver == "" {
+		network, err := ParseNetwork(defaultNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default network: %w", err)
+		}
+		network.Address, network.Gateway = options.Network.Address, options.Network.Gateway
+		options.Network = network
+	}
+	if err := validateNetwork(options.Network); err != nil {
+		return nil, err
+	}
+	if err := validateEgress(options.Egress, options.Network); err != nil {
+		return nil, err
+	}
+	if err := validateVolumeMounts(options.Volumes); err != nil {
+		return nil, err
+	}
+	if options.StopSignal != "" {
+		if _, err := ParseSignal(options.StopSignal); err != nil {
+			return nil, fmt.Errorf("invalid stop signal: %w", err)
+		}
+	}
+	if err := validateTraceMode(options.Trace); err != nil {
+		return nil, err
+	}
+	if err := validateRuntime(options); err != nil {
+		return nil, err
+	}
+	if err := validateRequiresCondition(options); err != nil {
+		return nil, err
+	}
+	if !options.Detach && options.Log != (LogConfig{}) {
+		return nil, fmt.Errorf("log options require a detached container")
+	}
+	if !options.Detach && !options.create && options.Restart.restarts() {
+		return nil, fmt.Errorf("a restart policy requires a detached container")
+	}
+	if err := validateHealthCheck(options.HealthCheck); err != nil {
+		return nil, err
+	}
+	if !options.Detach && !options.create && options.HealthCheck != nil {
+		return nil, fmt.Errorf("a health check requires a detached container")
+	}
+	if !options.Detach && !options.create && options.ExitFile != nil {
+		return nil, fmt.Errorf("an exit fd requires a detached container")
+	}
+	if err := validateLogDriver(options.Log.Driver); err != nil {
+		return nil, err
+	}
+	if options.Detach && options.Log.Driver == "" {
+		options.Log.Driver = defaultLogDriver
+	}
+	// The forwarding drivers log to the file too.
+	if options.Log.Driver != LogDriverNone && options.Log.Driver != "" && options.Log.MaxSize == 0 {
+		options.Log.MaxSize, options.Log.MaxFile = defaultLogConfig.MaxSize, defaultLogConfig.MaxFile
+	}
+	if options.Log.Driver == defaultLogDriver && options.Log.Address == "" && remoteLogDriver(options.Log.Driver) {
+		d := defaultLogConfig
+		options.Log.Address, options.Log.Tag, options.Log.TLSCA, options.Log.TLSSkipVerify, options.Log.BufferSize = d.Address, d.Tag, d.TLSCA, d.TLSSkipVerify, d.BufferSize
+	}
+	if options.Log.Driver == LogDriverNone && options.Log.MaxSize > 0 {
+		return nil, fmt.Errorf("log rotation requires a log driver writing the log file")
+	}
+	if err := validateLogConfig(options.Log); err != nil {
+		return nil, err
+	}
+
+	var spec *specs.Spec
+	var err error
+	if img != nil {
+		spec, err = loadImageSpec(specPath, img, options)
+	} else if options.Entrypoint != nil || len(options.Cmd) > 0 || options.Workdir != "" || options.User != "" {
+		return nil, fmt.Errorf("an entrypoint, command, working directory or user requires an image")
+	} else {
+		spec, err = LoadSpec(specPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading spec: %w", err)
+	}
+	if spec, err = patchSpec(spec, options.SpecPatches); err != nil {
+		return nil, err
+	}
+	// A relative root is relative to the bundle.
+	if spec.Root != nil && spec.Root.Path != "" && !filepath.IsAbs(spec.Root.Path) {
+		spec.Root.Path = filepath.Join(options.bundleDir(specPath), spec.Root.Path)
+	}
+	if err := checkSpecFeatures(spec, options.StrictSpec); err != nil {
+		return nil, err
+	}
+	class, err := securityClass(options)
+	if err != nil {
+		return nil, err
+	}
+	terminal := spec.Process != nil && spec.Process.Terminal
+	if options.ConsoleSocket != "" && !terminal {
+		return nil, fmt.Errorf("a console socket requires process.terminal")
+	}
+	if options.create && terminal && options.ConsoleSocket == "" && !options.Detach {
+		return nil, fmt.Errorf("process.terminal requires a console socket when creating a container")
+	}
+	spec.Mounts = append(spec.Mounts, options.Tmpfs...)
+	if len(options.Devices) > 0 {
+		if err := injectCDIDevices(spec, options.Devices); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.HostDevices) > 0 {
+		if err := applyHostDevices(spec, options.HostDevices); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.GPUs) > 0 {
+		if err := applyGPUs(spec, options.GPUs); err != nil {
+			return nil, err
+		}
+	}
+	if options.Timezone != "" {
+		if err := applyTimezone(spec, options.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyClock(spec, options); err != nil {
+		return nil, err
+	}
+	if env := hostLocaleEnv(); options.HostLocale && len(env) > 0 && spec.Process != nil && len(spec.Process.Args) > 0 {
+		if err := setEnv(spec, env); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Env) > 0 {
+		if err := setEnv(spec, options.Env); err != nil {
+			return nil, err
+		}
+	}
+	limitResources(spec, options.Memory, options.CPUs)
+	if err := limitSwap(spec, options.Memory, options.MemorySwap); err != nil {
+		return nil, err
+	}
+	// Relative bind sources are relative to the bundle.
+	for i, m := range spec.Mounts {
+		if isBindMount(m) && !filepath.IsAbs(m.Source) {
+			spec.Mounts[i].Source = filepath.Join(options.bundleDir(specPath), m.Source)
+			if spec.Mounts[i].Source, err = filepath.Abs(spec.Mounts[i].Source); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := validateSpecMounts(spec.Mounts); err != nil {
+		return nil, err
+	}
+	rootPropagation, err := rootfsPropagationFlags(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSecrets(options.Secrets); err != nil {
+		return nil, err
+	}
+	// Secrets must not be propagated to the mount namespace of the host.
+	if len(options.Secrets) > 0 && rootPropagation&unix.MS_SHARED != 0 {
+		return nil, fmt.Errorf("secrets cannot be used with %s rootfs propagation", spec.Linux.RootfsPropagation)
+	}
+	sandbox, err := sandboxFor(options.Isolation)
+	if err != nil {
+		return nil, err
+	}
+	if err := sandbox.configure(spec, options); err != nil {
+		return nil, err
+	}
+	if err := validateUserNamespace(spec); err != nil {
+		return nil, err
+	}
+	if err := validateHostRootfs(spec, options); err != nil {
+		return nil, err
+	}
+	if err := validatePidNamespace(spec, options); err != nil {
+		return nil, err
+	}
+	if err := validateTimeNamespace(spec); err != nil {
+		return nil, err
+	}
+	if _, err := loadWebhooks(spec.Annotations); err != nil {
+		return nil, err
+	}
+	if options.Privileged {
+		err = applyPrivileged(spec)
+	} else {
+		err = applyDefaultSecurity(spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// After applyPrivileged, which passes the devices of the host.
+	if options.NoRTC {
+		if err := removeRTC(spec); err != nil {
+			return nil, err
+		}
+	}
+	options.security = applyPathPolicy(spec, class)
+	if spec.Linux != nil && spec.Linux.Seccomp != nil {
+		if _, err := compileSeccomp(spec.Linux.Seccomp); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkKernelFeatures(spec, options.StrictSpec); err != nil {
+		return nil, err
+	}
+	if spec.Process != nil && spec.Process.Capabilities != nil {
+		caps, err := parseProcessCapabilities(spec.Process.Capabilities)
+		if err != nil {
+			return nil, err
+		}
+		if caps.ambient&^(caps.permitted&caps.inheritable) != 0 {
+			return nil, fmt.Errorf("ambient capabilities must also be permitted and inheritable")
+		}
+	}
+	if err := validateEgressCaps(options.Egress, spec); err != nil {
+		return nil, err
+	}
+	if err := validateProcessAttrs(spec); err != nil {
+		return nil, err
+	}
+	applyRequires(spec, options)
+	if options.StopSignal == "" && spec.Annotations[AnnotationStopSignal] != "" {
+		options.StopSignal = spec.Annotations[AnnotationStopSignal]
+		if _, err := ParseSignal(options.StopSignal); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", AnnotationStopSignal, err)
+		}
+	}
+	return spec, nil
+}
+
+// runContainer prepares, forks, and executes the container process. If
+// options.Detach is true, the function returns once the container init
+// process is running. Cancelling ctx before then kills the stages and
+// releases what was set up; in the foreground it also kills the container.
+// With options.create it returns once the container is set up, leaving it
+// Created until startContainer lets its process run.
+func runContainer(ctx context.Context, containerId, specPath string, options RunOptions) (err error) {
+	detach := options.Detach || options.create
+	// Keep the options as given, as the setup fills in and changes them.
+	saved, err := cloneOptions(options)
+	if err != nil {
+		return err
+	}
+	report := newProgressReporter(containerId, options.Progress)
+	var container *Container
+	var img *Image
+	if options.Image != "" {
+		arch := options.Platform
+		if arch == "" && options.Runtime == RuntimeWasm {
+			arch = wasmArch
+		}
+		if img, err = resolveImage(ctx, options.Image, arch, report); err != nil {
+			return err
+		}
+	}
+	if options.Integrity && img == nil {
+		return fmt.Errorf("integrity checking requires a container run from an image")
+	}
+	if options.OSRelease && img == nil {
+		return fmt.Errorf("os-release requires a container run from an image")
+	}
+	spec, err := loadRunSpec(specPath, img, &options)
 	if err != nil {
-		return fmt.Errorf("loading spec: %w", err)
+		return err
+	}
+	if err := checkRequires(ctx, containerId, dependsOn(spec.Annotations), &options); err != nil {
+		return err
+	}
+	if options.CoreDumps {
+		if err := installCoreHelper(); err != nil {
+			return err
+		}
+	}
+	reservation, err := specReservation(spec)
+	if err != nil {
+		return err
+	}
+	aux, err := loadAuxProcesses(options.bundleDir(specPath))
+	if err != nil {
+		return err
+	}
+	pidns, err := openPidNamespace(spec, &options)
+	if err != nil {
+		return err
+	}
+	if pidns != nil {
+		defer pidns.Close()
+	}
+	if !options.Force {
+		if err := admit(containerId, reservation); err != nil {
+			return err
+		}
 	}
 
+	hostRootfs := options.Rootfs == RootfsHost
 	rootfs := spec.Root.Path
-	if rootfs == "" {
+	if hostRootfs {
+		rootfs = "/"
+	} else if img != nil {
+		rootfs = imageContainerRootfs(containerId)
+	} else if options.Rootfs != "" {
+		rootfs = options.Rootfs
+	} else if rootfs == "" {
 		rootfs = "/alpine"
 	}
 
-	// Copy the local Alpine root filesystem into the location specified by the spec.
-	if err := cpAlpineFS(rootfs); err != nil {
-		return fmt.Errorf("failed to copy alpine FS: %w", err)
-	}
-
-	stateDir, err := CreateStateDir(containerId)
+	stateDir, err := createStateDir(containerId)
 	if err != nil {
 		return err
 	}
 
-	container := &Container{
+	// The messages of the runtime and its init stages go to stdout, or to
+	// the runtime log of a quiet container.
+	progress := os.Stdout
+	if options.Quiet {
+		f, err := os.OpenFile(filepath.Join(stateDir, runtimeLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fmt.Errorf("failed to open runtime log: %w", err)
+		}
+		defer f.Close()
+		progress = f
+	}
+
+	var image *ImageRootfs
+	var integrity string
+	if img != nil {
+		report.started(PhaseRootfs)
+		if image, err = prepareImageRootfs(containerId, img); err != nil {
+			return err
+		}
+		if options.Integrity {
+			if integrity, err = recordManifest(containerId, imageRootfsDir(img.ID)); err != nil {
+				return err
+			}
+		}
+		report.done(PhaseRootfs)
+		// Until the state records it, nothing else would release it.
+		defer func() {
+			if err != nil && container == nil {
+				if rerr := releaseImageRootfs(containerId, image); rerr != nil {
+					fmt.Fprintf(os.Stderr, "warning: %v\n", rerr)
+				}
+			}
+		}()
+		fmt.Fprintf(progress, "PARENT: Prepared the rootfs from %s with the %s driver\n", img.Ref, image.Driver)
+		if err := resolveImageUser(spec, imageContainerRootfs(containerId)); err != nil {
+			return err
+		}
+		volumes := imageVolumes(containerId, img, spec, options.Volumes)
+		if err := populateImageVolumes(img, volumes); err != nil {
+			return err
+		}
+		spec.Mounts = append(spec.Mounts, volumes...)
+	}
+
+	// Populate an empty root filesystem from the local Alpine image.
+	if img == nil && !hostRootfs && rootfsEmpty(rootfs) {
+		if err := cpAlpineFS(rootfs, report); err != nil {
+			return fmt.Errorf("failed to copy alpine FS: %w", err)
+		}
+		fmt.Fprintf(progress, "PARENT: Populated %s from the Alpine image\n", rootfs)
+	}
+	var emulation *Emulation
+	if !hostRootfs {
+		if rootfs, err = resolveRootfs(rootfs, spec); err != nil {
+			return err
+		}
+		// WebAssembly modules run on any host.
+		if options.Runtime != RuntimeWasm {
+			if emulation, err = checkPlatform(rootfs, spec, options.Platform, options.CopyEmulator); err != nil {
+				return err
+			}
+		}
+	}
+	if emulation != nil && emulation.Copy {
+		if err := installEmulator(rootfs, emulation); err != nil {
+			return err
+		}
+		fmt.Fprintf(progress, "PARENT: Copied %s into %s\n", emulation.Interpreter, rootfs)
+	}
+	var storage *StorageQuota
+	if options.StorageSize > 0 {
+		if storage, err = applyStorageQuota(containerId, rootfs, options.StorageSize); err != nil {
+			return err
+		}
+	}
+
+	// The exit history and the machine ID outlive the runs of the
+	// container.
+	var exits []ExitRecord
+	var machineID string
+	if prev, err := LoadState(containerId); err == nil {
+		exits, machineID = prev.Exits, prev.MachineID
+	}
+	// The host rootfs has the machine ID of the host.
+	var machineIDPath string
+	if !hostRootfs {
+		if machineID == "" {
+			if machineID, err = newMachineID(); err != nil {
+				return err
+			}
+		}
+		if machineIDPath, err = writeMachineID(spec, stateDir, machineID); err != nil {
+			return err
+		}
+	}
+	if options.OSRelease {
+		if err := applyOSRelease(spec, stateDir, rootfs, img); err != nil {
+			return err
+		}
+	}
+	containerRootfs := rootfs
+	if hostRootfs {
+		containerRootfs = ""
+	}
+	container = &Container{
 		Id:             containerId,
+		Name:           options.Name,
+		Integrity:      integrity,
 		InitProcessPiD: 0,
 		Status:         Created,
 		CreatedAt:      time.Now(),
-		Bundle:         "",
+		Bundle:         options.bundleDir(specPath),
+		Annotations:    spec.Annotations,
+		StopSignal:     options.StopSignal,
+		Rootfs:         containerRootfs,
+		Image:          image,
+		SpecPath:       specPath,
+		Options:        saved,
+		Emulation:      emulation,
+		Storage:        storage,
+		Reservation:    reservation,
+		RestartCount:   options.restartCount,
+		Exits:          exits,
+		MachineID:      machineID,
+		AuxProcesses:   aux,
+		PidNamespace:   pidNamespaceName(spec, &options),
+		Security:       options.security,
+		Process:        processSecurity(spec),
+	}
+	if err := saveState(container); err != nil {
+		return err
 	}
 
-	if err := SaveState(stateDir, container); err != nil {
+	// Until the container runs, failures kill whatever stages were
+	// started and give back what the container held.
+	var cmd *exec.Cmd
+	var initPid atomic.Int64
+	defer func() {
+		if err == nil || container.Status != Created {
+			return
+		}
+		if ctx.Err() != nil {
+			err = fmt.Errorf("container start aborted: %w (%v)", ctx.Err(), err)
+		}
+		if pid := initPid.Load(); pid != 0 {
+			_ = unix.Kill(int(pid), unix.SIGKILL)
+		}
+		if cmd != nil && cmd.Process != nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+		container.Status = Stopped
+		if serr := saveState(container); serr != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", serr)
+		}
+		releaseResources(container)
+	}()
+
+	var mounts []stageMount
+	if len(options.Volumes) > 0 {
+		var uid, gid int
+		if spec.Process != nil {
+			uid, gid = int(spec.Process.User.UID), int(spec.Process.User.GID)
+		}
+		sources, err := acquireVolumes(containerId, options.Volumes, uid, gid)
+		if err != nil {
+			return err
+		}
+		for i, v := range options.Volumes {
+			mounts = append(mounts, stageMount{Source: sources[i], Target: v.Target, ReadOnly: v.ReadOnly})
+		}
+		container.Volumes = options.Volumes
+	}
+	if err := runPlugins(ctx, newPluginEvent(PluginPostStoragePrepare, container)); err != nil {
 		return err
 	}
 
+	var resources *specs.LinuxResources
+	var cgroupsPath string
+	if spec.Linux != nil {
+		resources = spec.Linux.Resources
+		cgroupsPath = spec.Linux.CgroupsPath
+	}
+	var cgroupPath string
+	if options.fakeStages {
+		// Fake containers run on the host, in the cgroup of the runtime.
+	} else if options.CgroupManager == SystemdManager {
+		// The scope is created once the parent stage is running, since
+		// systemd needs a process to put into it.
+		if !cgroupsAvailable() {
+			return fmt.Errorf("the systemd cgroup manager requires a cgroup v2 hierarchy at %s", cgroupRoot)
+		}
+		container.CgroupManager = SystemdManager
+	} else if cgroupsAvailable() {
+		container.CgroupManager = CgroupfsManager
+		if cgroupPath, err = createCgroup(containerId); err != nil {
+			return err
+		}
+		container.CgroupPath = cgroupPath
+		if err := applyResources(cgroupPath, resources); err != nil {
+			return fmt.Errorf("failed to apply resources: %w", err)
+		}
+	} else if resources != nil {
+		return fmt.Errorf("linux.resources requires a cgroup v2 hierarchy at %s", cgroupRoot)
+	}
+
+	var rdt *rdtGroup
+	if spec.Linux != nil && spec.Linux.IntelRdt != nil {
+		if rdt, err = setupIntelRdt(containerId, spec.Linux.IntelRdt); err != nil {
+			return err
+		}
+		if rdt.created {
+			container.IntelRdtPath = rdt.path
+		}
+	}
+
+	// The notify socket forwards the messages of the container to the
+	// service manager of the runtime and, with options.Notify, tells when
+	// it is ready. Messages wait in it until the state is saved.
+	var hostSocket, notifySocket string
+	var notifyConn *net.UnixConn
+	if spec.Annotations[AnnotationSdNotify] == "true" {
+		hostSocket = os.Getenv("NOTIFY_SOCKET")
+		switch {
+		case hostSocket == "":
+			fmt.Fprintf(os.Stderr, "warning: %s is set but NOTIFY_SOCKET is not, ignoring\n", AnnotationSdNotify)
+		case detach:
+			fmt.Fprintf(os.Stderr, "warning: %s requires the container to run in the foreground, ignoring\n", AnnotationSdNotify)
+			hostSocket = ""
+		case hostRootfs:
+			fmt.Fprintf(os.Stderr, "warning: %s requires a rootfs, not the host's, ignoring\n", AnnotationSdNotify)
+			hostSocket = ""
+		}
+	}
+	if hostSocket != "" || options.Notify {
+		notifySocket = filepath.Join(stateDir, "notify.sock")
+		if notifyConn, err = listenNotify(notifySocket); err != nil {
+			return err
+		}
+		defer notifyConn.Close()
+	}
+
+	var metadataSocket string
+	var metadataListener *net.UnixListener
+	if options.Metadata {
+		metadataSocket = filepath.Join(stateDir, metadataSocketName)
+		if metadataListener, err = listenMetadata(metadataSocket); err != nil {
+			return err
+		}
+		defer metadataListener.Close()
+	}
+
+	var hostsPath string
+	if options.Network.Driver != HostNetwork && !hostRootfs && !hasMountAt(spec, containerHostsFile) {
+		hostsPath = filepath.Join(stateDir, hostsFileName)
+		if err := writeHostsFile(hostsPath, spec.Hostname, ""); err != nil {
+			return err
+		}
+	}
+
 	// Create a socket pair used for simple one-byte notifications
 	// between the parent and child processes.
 	parent, child, err := initSocketPair("init", unix.SOCK_CLOEXEC)
@@ -157,51 +1067,319 @@ func RunContainer(containerId, specPath string, detach bool) error {
 	defer parent.Close()
 
 	// Prepare the parent-stage command—essentially re-invoking our own binary with "init PARENT_STAGE".
-	cmd := exec.Command("/proc/self/exe", "init", ParentStage)
+	cmd = exec.Command("/proc/self/exe", "init", parentStage)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if detach {
+		// The parent stage stays behind as the monitor of the container,
+		// so keep it out of our session's hangups.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	}
 
 	// The child side of the socket pair becomes the ExtraFile with FD=3 (or next available).
 	cmd.ExtraFiles = append(cmd.ExtraFiles, child)
 	// We inform the child process which FD to use via the environment.
 	cmd.Env = append(cmd.Env, "INIT_PIPE="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	if cfg, ok := os.LookupEnv(configEnv); ok {
+		// The monitor works on the state of our configuration.
+		cmd.Env = append(cmd.Env, configEnv+"="+cfg)
+	}
+
+	if options.ConsoleSocket != "" {
+		// The container gets a pseudo terminal whose master goes to
+		// whoever listens on the console socket.
+		master, slave, err := openPty()
+		if err != nil {
+			_ = child.Close()
+			return err
+		}
+		err = sendConsole(options.ConsoleSocket, master)
+		master.Close()
+		if err != nil {
+			slave.Close()
+			_ = child.Close()
+			return err
+		}
+		defer slave.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, slave)
+		cmd.Env = append(cmd.Env, "CONSOLE_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	} else if options.Detach && options.Log.Driver == LogDriverNone {
+		devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			_ = child.Close()
+			return err
+		}
+		defer devNull.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, devNull, devNull)
+		cmd.Env = append(cmd.Env, "LOG_PIPE="+strconv.Itoa(3+len(cmd.ExtraFiles)-2))
+	} else if options.Detach {
+		// The output of a detached container goes to its log file, through
+		// a logger process that outlives us.
+		logPath := filepath.Join(stateDir, logFileName)
+		logCfg := options.Log
+		if logCfg.Tag == "" {
+			logCfg.Tag = containerId
+		}
+		logOut, logErr, err := startLogger(logPath, logCfg)
+		if err != nil {
+			_ = child.Close()
+			return err
+		}
+		defer logOut.Close()
+		defer logErr.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, logOut, logErr)
+		cmd.Env = append(cmd.Env, "LOG_PIPE="+strconv.Itoa(3+len(cmd.ExtraFiles)-2))
+		container.LogPath = logPath
+	}
 
-	fmt.Println("PARENT: Forking /proc/self/exe with PARENT_STAGE")
+	if notifyConn != nil && detach {
+		// The monitor serves the notify socket once it is handed over.
+		f, err := notifyConn.File()
+		if err != nil {
+			_ = child.Close()
+			return fmt.Errorf("failed to pass notify socket: %w", err)
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		cmd.Env = append(cmd.Env, "NOTIFY_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	}
+	if metadataListener != nil && detach {
+		// So is the metadata socket.
+		f, err := metadataListener.File()
+		if err != nil {
+			_ = child.Close()
+			return fmt.Errorf("failed to pass metadata socket: %w", err)
+		}
+		defer f.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f)
+		cmd.Env = append(cmd.Env, "METADATA_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	}
+	if pidns != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, pidns)
+		cmd.Env = append(cmd.Env, "PIDNS_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	}
+	if options.ExitFile != nil {
+		// The monitor writes the exit code to it.
+		cmd.ExtraFiles = append(cmd.ExtraFiles, options.ExitFile)
+		cmd.Env = append(cmd.Env, "EXIT_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	}
+	if progress != os.Stdout {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, progress)
+		cmd.Env = append(cmd.Env, "PROGRESS_FD="+strconv.Itoa(3+len(cmd.ExtraFiles)-1))
+	}
+
+	report.started(PhaseCreate)
+	fmt.Fprintln(progress, "PARENT: Forking /proc/self/exe with PARENT_STAGE")
 	if err := cmd.Start(); err != nil {
 		_ = child.Close() // best effort
 		return fmt.Errorf("failed to start parent-stage process: %w", err)
 	}
 	_ = child.Close() // Close child side in parent
 
-	// Send runtime options to the parent stage through the pipe
-	opts := stageOptions{Detach: detach, Rootfs: rootfs}
-	if err := json.NewEncoder(parent).Encode(&opts); err != nil {
+	// Cancelling ctx kills the stages. The child stage dies with the parent
+	// stage until it is released, and is killed directly once its PID is
+	// known.
+	stopAbort := context.AfterFunc(ctx, func() {
+		if pid := initPid.Load(); pid != 0 {
+			_ = unix.Kill(int(pid), unix.SIGKILL)
+		}
 		_ = cmd.Process.Kill()
-		_ = cmd.Wait()
-		return fmt.Errorf("failed to send stage options: %w", err)
+	})
+	defer stopAbort()
+
+	if rdt != nil {
+		// The child stage is forked from the parent stage and inherits
+		// its resctrl group.
+		if err := rdt.addTask(cmd.Process.Pid); err != nil {
+			return err
+		}
+	}
+
+	if container.CgroupManager == SystemdManager {
+		unit, err := parseSystemdCgroupsPath(containerId, cgroupsPath)
+		if err == nil {
+			cgroupPath, err = startSystemdScope(unit, cmd.Process.Pid, resources)
+		}
+		if err == nil {
+			// systemd applies the resources; the device filter is ours.
+			var devices []specs.LinuxDeviceCgroup
+			if resources != nil {
+				devices = resources.Devices
+			}
+			err = applyDevices(cgroupPath, devices)
+		}
+		if err == nil && resources != nil {
+			err = applyUnified(cgroupPath, resources.Unified)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create systemd scope: %w", err)
+		}
+		container.CgroupPath = cgroupPath
+	}
+
+	// Send runtime options to the parent stage through the pipe
+	opts := stageOptions{
+		ContainerId:    containerId,
+		Detach:         detach,
+		Rootfs:         rootfs,
+		HostRootfs:     hostRootfs,
+		Wasm:           options.Runtime == RuntimeWasm,
+		CgroupPath:     cgroupPath,
+		Spec:           spec,
+		NotifySocket:   notifySocket,
+		MetadataSocket: metadataSocket,
+		HostsFile:      hostsPath,
+		MachineIDFile:  machineIDPath,
+		HostNetwork:    options.Network.Driver == HostNetwork,
+		Privileged:     options.Privileged,
+		Mounts:         mounts,
+		MaskedPaths:    maskedPaths(spec),
+		ReadonlyPaths:  readonlyPaths(spec),
+		WritablePaths:  options.security.WritablePaths,
+		InheritStdio:   options.create && !options.Detach,
+		NoNewKeyring:   options.NoNewKeyring,
+		PidNamespace:   container.PidNamespace,
+		Faketime:       !options.FakeDate.IsZero(),
+		CoreDumps:      options.CoreDumps,
+		Fake:           options.fakeStages,
+		Isolation:      options.Isolation,
+	}
+	if options.create {
+		if opts.ExecFifo, err = createExecFifo(stateDir); err != nil {
+			return err
+		}
+	}
+	if opts.Secrets, opts.SecretEnv, err = readSecrets(options.Secrets); err != nil {
+		return err
+	}
+	if spec.Linux != nil && spec.Linux.Seccomp != nil && spec.Linux.Seccomp.ListenerPath != "" {
+		opts.SeccompState = &specs.State{
+			Version:     specs.Version,
+			ID:          containerId,
+			Status:      specs.StateCreating,
+			Bundle:      container.Bundle,
+			Annotations: spec.Annotations,
+		}
+	}
+	sandbox, err := sandboxFor(options.Isolation)
+	if err != nil {
+		return err
+	}
+	if err := sandbox.prepare(stateDir, &options, &opts); err != nil {
+		return err
+	}
+	if err := writeStageMsg(parent, stageMsg{Type: msgOptions, Options: &opts}); err != nil {
+		return err
 	}
 
 	// Wait for the child to signal readiness and report its PID
-	fmt.Println("PARENT: Waiting for child setup signal...")
-	childPID, err := readInitInfo(parent)
+	fmt.Fprintln(progress, "PARENT: Waiting for child setup signal...")
+	ready, err := expectStageMsg(parent, msgReady, "init stages", handshakeTimeout)
 	if err != nil {
-		// if there's an error from the child, let's wait on cmd to ensure no zombie
-		_ = cmd.Wait()
-		return fmt.Errorf("child setup failed: %w", err)
+		return fmt.Errorf("container setup failed: %w", err)
+	}
+	childPID := ready.Pid
+	initPid.Store(int64(childPID))
+	fmt.Fprintln(progress, "PARENT: Child setup done.")
+	report.send(ProgressEvent{Phase: PhaseCreate, Status: ProgressDone, Pid: childPID})
+	report.stagesDone(ready.Timings)
+
+	event := newPluginEvent(PluginPreNetwork, container)
+	event.Pid, event.Network = childPID, options.Network
+	if err := runPlugins(ctx, event); err != nil {
+		return err
+	}
+
+	report.started(PhaseNetwork)
+	fmt.Fprintf(progress, "PARENT: Configuring %s network\n", options.Network.Driver)
+	if err := setupNetwork(containerId, childPID, rootfs, options.Network); err != nil {
+		return fmt.Errorf("failed to set up network: %w", err)
+	}
+	container.Network = options.Network
+	if ip := networkIP(options.Network); hostsPath != "" && ip != "" {
+		if err := writeHostsFile(hostsPath, spec.Hostname, ip); err != nil {
+			return err
+		}
+	}
+	report.done(PhaseNetwork)
+
+	if err := setupFirewall(childPID, container, options.Egress); err != nil {
+		return fmt.Errorf("failed to set up firewall: %w", err)
+	}
+	container.Egress = options.Egress
+
+	if options.Trace != "" {
+		tracePath := filepath.Join(stateDir, traceFileName)
+		if err := startTracer(childPID, tracePath, options.Trace); err != nil {
+			return err
+		}
+		container.TracePath = tracePath
+	}
+
+	// A detached container outlives ctx once it is released.
+	if detach && !stopAbort() {
+		return fmt.Errorf("child setup failed: %w", ctx.Err())
+	}
+	if !options.create {
+		event := newPluginEvent(PluginPreExec, container)
+		event.Pid = childPID
+		if err := runPlugins(ctx, event); err != nil {
+			return err
+		}
+		report.started(PhaseStart)
+	}
+	// Let the container process start now that the host side is ready.
+	if err := writeStageMsg(parent, stageMsg{Type: msgGo}); err != nil {
+		return fmt.Errorf("failed to release container process: %w", err)
+	}
+	if _, err := expectStageMsg(parent, msgStarted, "init stages", handshakeTimeout); err != nil {
+		return fmt.Errorf("failed to release container process: %w", err)
 	}
-	fmt.Println("PARENT: Child setup done.")
 
 	container.InitProcessPiD = childPID
-	container.Status = Running
-	if err := SaveState(stateDir, container); err != nil {
+	if container.InitStartTime, err = processStartTime(childPID); err != nil {
+		return fmt.Errorf("failed to read the start time of the init process: %w", err)
+	}
+	// Only for diagnostics: kernels before 4.1 don't report it.
+	if nsPid, err := processNsPid(childPID); err == nil {
+		container.InitNsPid = nsPid
+	}
+	if detach {
+		container.MonitorPid = cmd.Process.Pid
+		if container.MonitorStartTime, err = processStartTime(cmd.Process.Pid); err != nil {
+			return fmt.Errorf("failed to read the start time of the monitor: %w", err)
+		}
+	}
+	if !options.create {
+		container.Status = Running
+		if options.Notify {
+			container.Status = Starting
+		}
+	}
+	if err := saveState(container); err != nil {
 		return err
 	}
+	if notifyConn != nil && !detach {
+		go serveNotify(notifyConn, containerId, hostSocket, options.Notify)
+	}
+	if metadataListener != nil && !detach {
+		go serveMetadata(metadataListener, containerId)
+	}
+	if !options.create {
+		report.done(PhaseStart)
+	}
+	// The container runs whatever happens to its webhooks.
+	if err := startWebhooks(container, !options.create); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
 
 	if detach {
-		// In detached mode we release the parent-stage process so it can
-		// be reaped by the OS and return immediately after the init
-		// process has started and the state has been saved.
+		// In detached mode the parent stage monitors the container from
+		// now on. Hand it over now that the state is saved and return.
+		if err := writeStageMsg(parent, stageMsg{Type: msgHandover}); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to hand the container over to its monitor: %v\n", err)
+		}
 		if err := cmd.Process.Release(); err != nil {
 			return fmt.Errorf("failed to release parent-stage: %w", err)
 		}
@@ -209,47 +1387,260 @@ func RunContainer(containerId, specPath string, detach bool) error {
 	}
 
 	// Optionally, wait for the parent-stage to complete fully.
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("error waiting for parent-stage cmd: %w", err)
-	}
-
-	container.Status = Stopped
-	if err := SaveState(stateDir, container); err != nil {
+	auxCtx, stopAux := context.WithCancel(context.Background())
+	go superviseAuxProcesses(auxCtx, container)
+	waitErr := cmd.Wait()
+	stopAux()
+
+	// The container is gone either way, so record it and free what it
+	// held, unless a stop did already.
+	c, release, err := markStopped(containerId, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return err
 	}
+	if release {
+		releaseResources(c)
+	}
 
+	if waitErr != nil {
+		return fmt.Errorf("error waiting for parent-stage cmd: %w", waitErr)
+	}
 	return nil
 }
 
-// StopContainer terminates the container's init process and updates its state
-// to Stopped.
-func StopContainer(containerId string) error {
-	stateDir := StateDir(containerId)
-	c, err := LoadState(stateDir)
+// DefaultStopTimeout is how long a stopped container's init process gets
+// to exit after SIGTERM before it is killed.
+const DefaultStopTimeout = 10 * time.Second
+
+// StopContainer sends the container's stop signal, SIGTERM unless set
+// otherwise, to its init process, kills it if it hasn't exited within
+// timeout, and updates its state to Stopped.
+func StopContainer(containerId string, timeout time.Duration) error {
+	return stopContainer(context.Background(), containerId, 0, timeout)
+}
+
+// stopContainer is StopContainer sending sig first, or the container's
+// stop signal if sig is 0, with cancelling ctx cutting the timeout short.
+func stopContainer(ctx context.Context, containerId string, sig unix.Signal, timeout time.Duration) error {
+	// Mark the stop before signalling, so the monitor of a detached
+	// container doesn't apply the restart policy when it sees the exit.
+	var c *Container
+	err := updateState(containerId, func(s *Container) error {
+		if !s.Status.running() && s.Status != Created {
+			return fmt.Errorf("container %s is %w", containerId, ErrNotRunning)
+		}
+		s.ManuallyStopped = true
+		c = s
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	if c.Status != Running {
-		return fmt.Errorf("container %s is not running", containerId)
+
+	if sig == 0 {
+		sig = stopSignal(c)
+	}
+	if err := thawCgroup(c.CgroupPath); err != nil {
+		return err
+	}
+	stopAuxProcesses(ctx, c, timeout)
+	// An init process that is gone, or whose pid another process has
+	// taken since, exited on its own.
+	graceful := true
+	pidfd, err := openInit(c)
+	if err == nil {
+		graceful, err = terminate(ctx, pidfd, sig, timeout)
+		unix.Close(pidfd)
+	}
+	if err != nil && !errors.Is(err, ErrNotRunning) {
+		return err
 	}
 
-	proc, err := os.FindProcess(c.InitProcessPiD)
+	// Whoever waits on the container may have recorded the exit already,
+	// in which case it also released what the container held.
+	c, release, err := markStopped(containerId, func(s *Container) {
+		s.Graceful = &graceful
+	})
 	if err != nil {
-		return fmt.Errorf("cannot find process: %w", err)
+		return err
 	}
-	if err := proc.Signal(syscall.SIGKILL); err != nil {
-		return fmt.Errorf("failed to kill process: %w", err)
+	if release {
+		releaseResources(c)
 	}
-
-	c.Status = Stopped
-	if err := SaveState(stateDir, c); err != nil {
+	// The monitor of a detached container records the exit too, and
+	// must be done with the state dir before it can be removed.
+	if err := waitMonitor(ctx, containerId, monitorTimeout); err != nil {
 		return err
 	}
 	return nil
 }
 
-// cpAlpineFS copies the local Alpine filesystem from /vagrant/alpine to dst.
-func cpAlpineFS(dst string) error {
+// monitorTimeout is how long stopping or deleting a container waits for
+// its monitor to be done with the exit of its init process.
+var monitorTimeout = 10 * time.Second
+
+// waitMonitor waits up to timeout, or until ctx is done, for the monitor
+// of container id, if any, to be done with the exit of its init process,
+// which it is once it has cleared MonitorPid or exited.
+func waitMonitor(ctx context.Context, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		c, err := LoadState(id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// A restarted container is monitored by a new monitor, started
+		// by the one we wait for.
+		if c.MonitorPid == 0 || c.MonitorPid == os.Getpid() {
+			return nil
+		}
+		pidfd, err := openProcess(c.MonitorPid, c.MonitorStartTime)
+		if errors.Is(err, ErrNotRunning) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		exited := waitExit(ctx, pidfd, min(time.Until(deadline), 100*time.Millisecond))
+		unix.Close(pidfd)
+		if exited {
+			return nil
+		}
+		if ctx.Err() != nil || time.Now().After(deadline) {
+			return fmt.Errorf("the monitor of container %s, pid %d, is still handling its exit", id, c.MonitorPid)
+		}
+	}
+}
+
+// markStopped records that container id is Stopped, applying update to its
+// state, and reports whether it wasn't already, in which case the caller
+// releases what the container held.
+func markStopped(id string, update func(*Container)) (c *Container, release bool, err error) {
+	err = updateState(id, func(s *Container) error {
+		release = s.Status != Stopped
+		s.Status = Stopped
+		if update != nil {
+			update(s)
+		}
+		c = s
+		return nil
+	})
+	return c, release, err
+}
+
+// terminate sends sig to the process of pidfd and SIGKILL once timeout has
+// passed, or ctx is done, without it exiting. It reports whether sig was
+// enough.
+func terminate(ctx context.Context, pidfd int, sig unix.Signal, timeout time.Duration) (graceful bool, err error) {
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		if errors.Is(err, unix.ESRCH) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to signal process: %w", err)
+	}
+	if waitExit(ctx, pidfd, timeout) {
+		return true, nil
+	}
+	if err := unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0); err != nil && !errors.Is(err, unix.ESRCH) {
+		return false, fmt.Errorf("failed to kill process: %w", err)
+	}
+	return false, nil
+}
+
+// waitExit waits up to timeout for the process of pidfd to exit, or until
+// ctx is done, and reports whether it did.
+func waitExit(ctx context.Context, pidfd int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		// Poll in short steps to notice ctx being done.
+		left := time.Until(deadline)
+		if left <= 0 || ctx.Err() != nil {
+			return false
+		}
+		fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(min(left, 100*time.Millisecond).Milliseconds())+1)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return false
+		}
+		if n > 0 {
+			return true
+		}
+	}
+}
+
+// releaseResources frees the host resources held by a stopped container.
+// Failures are reported as warnings since the container is already gone.
+func releaseResources(c *Container) {
+	recordUsage(c)
+
+	// The kernel only kills what is left of a container when the pid 1
+	// of its namespace exits, so a container sharing one is killed
+	// through its cgroup.
+	if c.PidNamespace != "" {
+		if err := killCgroup(c.CgroupPath); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
+	// systemd garbage collects empty scopes on its own
+	if c.CgroupManager != SystemdManager {
+		// A killed process leaves its cgroup asynchronously, so give the
+		// kernel a moment before removing it.
+		var err error
+		for i := 0; i < 10; i++ {
+			if err = removeCgroup(c.CgroupPath); err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+
+	if err := removeRdtGroup(c.IntelRdtPath); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	removeFromPeers(c)
+	releaseVolumes(c.Id, c.Volumes)
+	if err := releaseImageRootfs(c.Id, c.Image); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
+
+// recordUsage saves the usage summary of a stopped container while its
+// cgroup is still around.
+func recordUsage(c *Container) {
+	if c.CgroupPath == "" {
+		return
+	}
+	u, err := readUsage(c.CgroupPath)
+	// systemd may have removed the scope already.
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to record usage: %v\n", err)
+		return
+	}
+	c.Usage = u
+	err = updateState(c.Id, func(s *Container) error {
+		s.Usage = u
+		return nil
+	})
+	// A container that failed to start may have no state yet.
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		fmt.Fprintf(os.Stderr, "warning: failed to record usage: %v\n", err)
+	}
+}
+
+// cpAlpineFS copies the local Alpine filesystem from /vagrant/alpine to dst,
+// through the rootfs cache, reporting the bytes copied.
+func cpAlpineFS(dst string, report *progressReporter) error {
 	src := "/vagrant/alpine"
 	if _, err := os.Stat(src); os.IsNotExist(err) {
 		// fallback to local alpine directory when running outside the VM
@@ -269,14 +1660,24 @@ func cpAlpineFS(dst string) error {
 		return fmt.Errorf("failed to create rootfs dir %s: %w", dst, err)
 	}
 
-	// Copy the contents of src into dst rather than nesting the directory
-	cmd := exec.Command("cp", "-a", src+"/.", dst)
-	cmd.Stderr = os.Stderr
+	// The copy is made from the cache, which is made first if needed.
+	if cached, err := cachedRootfs(src); err == nil {
+		src = cached
+	} else {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error copying directory from %s to %s: %w", src, dst, err)
+	var total int64
+	if report.enabled() {
+		total = treeSize(src)
+	}
+	stop := report.watchCopy(dst, total)
+	err := copyTree(src, dst)
+	stop()
+	if err != nil {
+		return err
 	}
-	fmt.Printf("Directory copied successfully from %s to %s\n", src, dst)
+	report.send(ProgressEvent{Phase: PhaseRootfs, Status: ProgressDone, Current: total, Total: total})
 	return nil
 }
 
@@ -292,11 +1693,65 @@ func initSocketPair(name string, flags int) (parent, child *os.File, err error)
 	return parent, child, nil
 }
 
+// runtimeLogName is the file in the state dir receiving the messages of the
+// runtime for a quiet container.
+const runtimeLogName = "runtime.log"
+
+// stageOut receives the messages of an init stage: its stdout, or the
+// runtime log passed as PROGRESS_FD for a quiet container.
+var stageOut = os.Stdout
+
+// openStageOut points stageOut at the runtime log if one was passed. The
+// descriptor is closed on exec so the container process doesn't get it.
+func openStageOut() error {
+	v := os.Getenv("PROGRESS_FD")
+	if v == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid PROGRESS_FD: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	stageOut = os.NewFile(uintptr(fd), "runtime-log")
+	return nil
+}
+
 // handleParentStage is called from init() if we detect we're in the parent stage.
 // It spawns a child process (with new namespaces) and notifies the actual parent
 // once the child has started.
-func handleParentStage() error {
-	fmt.Println("INIT: Inside parent stage of the new child process")
+func handleParentStage() (err error) {
+	if err := openStageOut(); err != nil {
+		return err
+	}
+	fmt.Fprintln(stageOut, "INIT: Inside parent stage of the new child process")
+	// The notify and metadata sockets are served by the monitor, not the
+	// container.
+	for _, v := range []string{"NOTIFY_FD", "METADATA_FD"} {
+		if fd, err := strconv.Atoi(os.Getenv(v)); err == nil {
+			unix.CloseOnExec(fd)
+		}
+	}
+	var exitFile *os.File
+	if v := os.Getenv("EXIT_FD"); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid EXIT_FD: %w", err)
+		}
+		unix.CloseOnExec(fd)
+		exitFile = os.NewFile(uintptr(fd), "exit-fd")
+		defer exitFile.Close()
+	}
+	var pidns *os.File
+	if v := os.Getenv("PIDNS_FD"); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid PIDNS_FD: %w", err)
+		}
+		unix.CloseOnExec(fd)
+		pidns = os.NewFile(uintptr(fd), "pid-namespace")
+		defer pidns.Close()
+	}
 
 	fd, err := strconv.Atoi(os.Getenv("INIT_PIPE"))
 	if err != nil {
@@ -305,44 +1760,69 @@ func handleParentStage() error {
 	initComm := os.NewFile(uintptr(fd), "init-pipe")
 	defer initComm.Close()
 
-	var opts stageOptions
-	if err := json.NewDecoder(initComm).Decode(&opts); err != nil {
-		return fmt.Errorf("failed to read stage options: %w", err)
-	}
+	// Until the container process has started, failures are reported to
+	// the runtime, which shows them.
+	reporting := true
+	defer func() {
+		if err != nil && reporting && reportStageError(initComm, "parent", err) {
+			err = errStageReported
+		}
+	}()
 
-	// Notify the real parent that we've made it into the child.
-	fmt.Println("INIT (parent-stage): Notifying real parent we are ready")
-	if _, err := initComm.Write([]byte{0}); err != nil {
-		return fmt.Errorf("failed to write init setup byte: %w", err)
+	m, err := expectStageMsg(initComm, msgOptions, "runtime", handshakeTimeout)
+	if err != nil {
+		return err
 	}
+	if m.Options == nil {
+		return fmt.Errorf("missing stage options")
+	}
+	opts := *m.Options
 
 	// create a pipe used for the child stage to notify when setup is
 	// complete. This must remain open across exec so we don't set CLOEXEC.
-	notifyParent, notifyChild, err := initSocketPair("stage", 0)
+	notifyParent, notifyChild, err := initSocketPair("stage", unix.SOCK_CLOEXEC)
 	if err != nil {
 		return fmt.Errorf("failed to create stage pipe: %w", err)
 	}
 	defer notifyParent.Close()
 
 	detach := opts.Detach
-	rootfs := opts.Rootfs
-	if rootfs == "" {
-		rootfs = "/alpine"
+	if opts.Rootfs == "" {
+		opts.Rootfs = "/alpine"
 	}
 
 	// Now spawn the *second* stage: a new process in new namespaces.
-	fmt.Println("INIT (parent-stage): Spawning the child-stage in new namespaces")
-	childCmd := exec.Command("/proc/self/exe", "init", ChildStage)
+	fmt.Fprintln(stageOut, "INIT (parent-stage): Spawning the child-stage in new namespaces")
+	stage := childStage
+	if opts.Fake {
+		stage = fakeChildStage
+	}
+	childCmd := exec.Command("/proc/self/exe", "init", stage)
 	childExtraFiles := []*os.File{notifyChild}
 	childCmd.ExtraFiles = append(childCmd.ExtraFiles, childExtraFiles...)
 
 	// FD number for the notify pipe inside the child
 	notifyFD := 3 + len(childCmd.ExtraFiles) - 1
 	childCmd.Env = append(os.Environ(),
-		"ROOTFS_PATH="+rootfs,
 		fmt.Sprintf("STAGE_PIPE=%d", notifyFD),
 	)
-	if detach {
+	if stageOut != os.Stdout {
+		childCmd.ExtraFiles = append(childCmd.ExtraFiles, stageOut)
+		childCmd.Env = append(childCmd.Env, fmt.Sprintf("PROGRESS_FD=%d", 3+len(childCmd.ExtraFiles)-1))
+	}
+	var console *os.File
+	var stdinForwarded bool
+	if v := os.Getenv("CONSOLE_FD"); v != "" {
+		consoleFd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid CONSOLE_FD: %w", err)
+		}
+		console = os.NewFile(uintptr(consoleFd), "console")
+		defer console.Close()
+	}
+	if console != nil {
+		childCmd.Stdin, childCmd.Stdout, childCmd.Stderr = console, console, console
+	} else if detach && !opts.InheritStdio {
 		// Detach the child from our terminal for output. If something is
 		// piped into the runtime's stdin, forward it through a pipe so
 		// the container can still read the script without holding the
@@ -354,59 +1834,180 @@ func handleParentStage() error {
 		childCmd.Stdin = pr
 		childCmd.Stdout = nil
 		childCmd.Stderr = nil
+		// Output goes to the logger pipes (stdout, then stderr) when the
+		// runtime passed them.
+		if v := os.Getenv("LOG_PIPE"); v != "" {
+			logFd, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid LOG_PIPE FD: %w", err)
+			}
+			logOut := os.NewFile(uintptr(logFd), "log-stdout")
+			logErr := os.NewFile(uintptr(logFd+1), "log-stderr")
+			defer logOut.Close()
+			defer logErr.Close()
+			childCmd.Stdout = logOut
+			childCmd.Stderr = logErr
+		}
 
-		go func() {
-			_, _ = io.Copy(pw, os.Stdin)
+		// A terminal isn't forwarded, as the monitor would keep reading
+		// it after the runtime has returned.
+		if isTerminal(os.Stdin) {
 			pw.Close()
-		}()
+		} else {
+			stdinForwarded = true
+			go func() {
+				_, _ = io.Copy(pw, os.Stdin)
+				pw.Close()
+			}()
+		}
 	} else {
 		childCmd.Stdin = os.Stdin
 		childCmd.Stdout = os.Stdout
 		childCmd.Stderr = os.Stderr
 	}
 
-	// Note: removed the duplicate CLONE_NEWPID
-	childCmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: unix.CLONE_NEWUTS |
-			unix.CLONE_NEWPID |
-			unix.CLONE_NEWNET |
-			unix.CLONE_NEWNS |
-			unix.CLONE_NEWCGROUP,
+	childCmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: childCloneFlags(&opts)}
+	userns := userNamespace(opts.Spec) && !opts.Fake
+	if userns {
+		childCmd.SysProcAttr.UidMappings = idMappings(opts.Spec.Linux.UIDMappings)
+		childCmd.SysProcAttr.GidMappings = idMappings(opts.Spec.Linux.GIDMappings)
+		childCmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		// Become the namespace's root; our host uid is not mapped in it.
+		childCmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
+	}
+	if opts.CgroupPath != "" {
+		// Start the child directly inside the container cgroup so limits
+		// apply before any container code runs.
+		cgroupDir, err := os.Open(opts.CgroupPath)
+		if err != nil {
+			return inStep("cgroup", opts.CgroupPath, fmt.Errorf("failed to open cgroup %s: %w", opts.CgroupPath, err))
+		}
+		defer cgroupDir.Close()
+		childCmd.SysProcAttr.UseCgroupFD = true
+		childCmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
 	}
 	if detach {
 		// Ensure the container does not receive a SIGHUP when the
 		// runtime process exits.
 		childCmd.SysProcAttr.Setsid = true
 	}
-
-	if err := childCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start child stage: %w", err)
+	if console != nil {
+		childCmd.SysProcAttr.Setsid = true
+		childCmd.SysProcAttr.Setctty = true
+		childCmd.SysProcAttr.Ctty = 0
+	}
+	// If we are killed before releasing the child stage, for instance
+	// because the runtime gave up on the start, take it down with us.
+	// A child stage forked into a pid namespace it joins sets that up
+	// itself: its parent is outside the namespace, which exec.Cmd takes
+	// for the parent having died already. It is forked from a thread of
+	// its own, which the parent death signal is tied to until cleared.
+	releaseThread := func() {}
+	if opts.Fake {
+		// The fake child stage joins no namespace.
+		pidns = nil
+	}
+	cloneStart := time.Now()
+	if timens := timeNamespace(opts.Spec) && !opts.Fake; pidns != nil || timens {
+		if pidns != nil {
+			childCmd.Env = append(childCmd.Env, "STAGE_PDEATHSIG=1")
+		} else {
+			childCmd.SysProcAttr.Pdeathsig = unix.SIGKILL
+		}
+		releaseThread, err = startOnThread(childCmd, func() error {
+			if pidns != nil {
+				if err := unix.Setns(int(pidns.Fd()), unix.CLONE_NEWPID); err != nil {
+					return fmt.Errorf("failed to join pid namespace: %w", err)
+				}
+			}
+			if timens {
+				return unshareTime(opts.Spec.Linux.TimeOffsets)
+			}
+			return nil
+		})
+	} else {
+		childCmd.SysProcAttr.Pdeathsig = unix.SIGKILL
+		err = childCmd.Start()
+	}
+	if err != nil {
+		return inStep("clone", "", fmt.Errorf("failed to start child stage: %w", err))
 	}
+	cloneTime := time.Since(cloneStart)
 
 	// close our copy of the child end after the fork
 	_ = notifyChild.Close()
 
-	// wait for the child stage to signal successful setup
-	b := make([]byte, 1)
-	if _, err := notifyParent.Read(b); err != nil {
-		return fmt.Errorf("failed waiting for child setup: %w", err)
+	// hand the stage options to the child stage before it starts setup
+	if err := writeStageMsg(notifyParent, stageMsg{Type: msgOptions, Options: &opts}); err != nil {
+		return err
+	}
+
+	if userns {
+		// The rootfs and bind mounts are idmapped to the child's user
+		// namespace rather than chowned, which needs our privileges.
+		if _, err := expectStageMsg(notifyParent, msgIdmap, "child stage", handshakeTimeout); err != nil {
+			return err
+		}
+		if err := sendIdmappedMounts(notifyParent, childCmd.Process.Pid, idmapSources(&opts)); err != nil {
+			return inStep("idmap", "", err)
+		}
 	}
-	if b[0] != 0 {
-		return fmt.Errorf("unexpected stage byte %d", b[0])
+
+	// wait for the child stage to signal successful setup
+	ready, err := expectStageMsg(notifyParent, msgReady, "child stage", handshakeTimeout)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Child-stage PID (host) = %d\n", childCmd.Process.Pid)
+	fmt.Fprintf(stageOut, "Child-stage PID (host) = %d\n", childCmd.Process.Pid)
+
+	// Report the child's PID so the runtime can configure its namespaces,
+	// with how long the stages took to set it up.
+	timings := ready.Timings
+	if timings == nil {
+		timings = map[string]time.Duration{}
+	}
+	timings[PhaseClone] = cloneTime
+	if err := writeStageMsg(initComm, stageMsg{Type: msgReady, Pid: childCmd.Process.Pid, Timings: timings}); err != nil {
+		return err
+	}
 
-	// Optionally write the child's PID to our parent (not strictly necessary).
-	if _, err := initComm.Write([]byte(fmt.Sprintf("pid:%d\n", childCmd.Process.Pid))); err != nil {
-		fmt.Fprintf(os.Stderr, "warning: failed to write child's PID: %v\n", err)
+	// Relay the runtime's go-ahead to the child stage. The runtime may
+	// take its time setting up the network.
+	if _, err := expectStageMsg(initComm, msgGo, "runtime", 0); err != nil {
+		return err
 	}
+	if err := writeStageMsg(notifyParent, stageMsg{Type: msgGo}); err != nil {
+		return err
+	}
+	// The child stage dies with us until it has cleared its parent death
+	// signal, which it acknowledges.
+	if _, err := expectStageMsg(notifyParent, msgStarted, "child stage", handshakeTimeout); err != nil {
+		return err
+	}
+	releaseThread()
+	if err := writeStageMsg(initComm, stageMsg{Type: msgStarted}); err != nil {
+		return err
+	}
+	reporting = false
 
 	if detach {
-		if err := childCmd.Process.Release(); err != nil {
-			return fmt.Errorf("failed to release child: %w", err)
+		// The runtime hands the container over once it has saved the
+		// state, leaving us to monitor it.
+		if _, err := readStageMsg(initComm, 0); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed waiting for runtime: %w", err)
 		}
-		return nil
+		if v := os.Getenv("NOTIFY_FD"); v != "" {
+			if err := serveNotifyFd(v, opts.ContainerId); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+		if v := os.Getenv("METADATA_FD"); v != "" {
+			if err := serveMetadataFd(v, opts.ContainerId); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+		return monitorContainer(opts.ContainerId, childCmd, stdinForwarded, exitFile)
 	}
 
 	// Wait for the child stage to exit (so we don't leak a child).
@@ -417,58 +2018,432 @@ func handleParentStage() error {
 	return nil
 }
 
+// childCloneFlags returns the namespaces the child stage is created in.
+func childCloneFlags(opts *stageOptions) uintptr {
+	if opts.Fake {
+		return 0
+	}
+	flags := uintptr(unix.CLONE_NEWUTS | unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWNS | unix.CLONE_NEWCGROUP)
+	if opts.HostNetwork {
+		flags &^= unix.CLONE_NEWNET
+	}
+	if opts.PidNamespace != "" {
+		flags &^= unix.CLONE_NEWPID
+	}
+	if userNamespace(opts.Spec) {
+		flags |= unix.CLONE_NEWUSER
+	}
+	return flags
+}
+
 // handleChildStage is called if we detect we're in the "init child" stage
 // that is run inside the new namespaces.
-func handleChildStage() error {
-	fmt.Println("INIT: Entering child stage")
-	fmt.Printf("INIT (child-stage): process pid on the host = %d\n", unix.Getpid())
-
-	stageFDStr := os.Getenv("STAGE_PIPE")
-	var stagePipe *os.File
-	if stageFDStr != "" {
-		fd, err := strconv.Atoi(stageFDStr)
-		if err != nil {
-			return fmt.Errorf("invalid STAGE_PIPE fd: %w", err)
+func handleChildStage() (err error) {
+	if err := openStageOut(); err != nil {
+		return err
+	}
+	fmt.Fprintln(stageOut, "INIT: Entering child stage")
+	fmt.Fprintf(stageOut, "INIT (child-stage): process pid on the host = %d\n", unix.Getpid())
+
+	if os.Getenv("STAGE_PDEATHSIG") != "" {
+		if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGKILL), 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set parent death signal: %w", err)
 		}
-		stagePipe = os.NewFile(uintptr(fd), "stage-pipe")
-		defer stagePipe.Close()
 	}
 
-	rootfs := os.Getenv("ROOTFS_PATH")
+	fd, err := strconv.Atoi(os.Getenv("STAGE_PIPE"))
+	if err != nil {
+		return fmt.Errorf("invalid STAGE_PIPE fd: %w", err)
+	}
+	stagePipe := os.NewFile(uintptr(fd), "stage-pipe")
+	defer stagePipe.Close()
+
+	// Until the container process is released, failures are reported to
+	// the parent stage, which relays them to the runtime.
+	reporting := true
+	defer func() {
+		if err != nil && reporting && reportStageError(stagePipe, "child", err) {
+			err = errStageReported
+		}
+	}()
+
+	m, err := expectStageMsg(stagePipe, msgOptions, "parent stage", handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	if m.Options == nil {
+		return fmt.Errorf("missing stage options")
+	}
+	opts := *m.Options
+	rootfs := opts.Rootfs
 	if rootfs == "" {
 		rootfs = "/alpine"
 	}
+	// Loopback is up in a network namespace of its own before anything,
+	// hooks included, runs in it.
+	if !opts.HostNetwork {
+		if err := linkSetUp("lo"); err != nil {
+			return inStep("network", "lo", err)
+		}
+	}
+	mountsStart := time.Now()
+
+	// Apply the rootfs propagation to / (private by default) so our mounts
+	// only reach the host when the spec asks for it.
+	rootPropagation, err := rootfsPropagationFlags(opts.Spec)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount("", "/", "", rootPropagation, ""); err != nil {
+		return inStep("propagation", "/", fmt.Errorf("failed to set the propagation of /: %w", err))
+	}
+	if err := makeParentMountPrivate(rootfs); err != nil {
+		return inStep("propagation", rootfs, err)
+	}
+
+	// In a user namespace the rootfs and bind mounts come idmapped from the
+	// parent stage, in idmapSources order.
+	userns := userNamespace(opts.Spec)
+	var trees []int
+	if userns {
+		if trees, err = recvIdmappedMounts(stagePipe, len(idmapSources(&opts))); err != nil {
+			return inStep("idmap", "", err)
+		}
+	}
+	nextTree := func() int {
+		if len(trees) == 0 {
+			return -1
+		}
+		fd := trees[0]
+		trees = trees[1:]
+		return fd
+	}
+
+	// Bind-mount the rootfs to itself so we can pivot-root later, through
+	// a descriptor opened without following symlinks or crossing mounts.
+	// The host rootfs stays where it is, without the mounts and devices
+	// of the spec.
+	root := -1
+	if !opts.HostRootfs {
+		if root, err = openRootfs(rootfs); err != nil {
+			return inStep("rootfs", rootfs, err)
+		}
+		defer unix.Close(root)
+		rootPath := fmt.Sprintf("/proc/self/fd/%d", root)
+		if tree := nextTree(); tree >= 0 {
+			if err := attachTree(tree, rootPath); err != nil {
+				return inStep("mount", rootfs, err)
+			}
+		} else if err := unix.Mount(rootPath, rootPath, "bind", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return inStep("mount", rootfs, fmt.Errorf("failed to bind %s: %w", rootfs, err))
+		}
+	}
+
+	var tmpfsMounts, bindMounts []specs.Mount
+	if opts.Spec != nil && !opts.HostRootfs {
+		for _, m := range opts.Spec.Mounts {
+			if isBindMount(m) {
+				bindMounts = append(bindMounts, m)
+				continue
+			}
+			if m.Type != "tmpfs" {
+				continue
+			}
+			// A tmpfs /dev must be in place before the device nodes are
+			// created in it; every other tmpfs is mounted after pivot_root.
+			if filepath.Clean(m.Destination) == "/dev" {
+				if err := mountTmpfs(rootfs, m); err != nil {
+					return inStep("mount", m.Destination, err)
+				}
+				continue
+			}
+			tmpfsMounts = append(tmpfsMounts, m)
+		}
+	}
+
+	if opts.Spec != nil && opts.Spec.Linux != nil && !opts.HostRootfs {
+		create := createDevices
+		if userns {
+			create = bindDevices
+		}
+		if err := create(rootfs, opts.Spec.Linux.Devices); err != nil {
+			return inStep("devices", "/dev", err)
+		}
+	}
+
+	// Bind mounts need the host paths, so they happen before pivot_root.
+	for _, m := range bindMounts {
+		if err := mountBind(rootfs, m, nextTree()); err != nil {
+			return inStep("mount", m.Destination, err)
+		}
+	}
+	for _, m := range opts.Mounts {
+		if err := bindMount(rootfs, m, nextTree()); err != nil {
+			return inStep("mount", m.Target, err)
+		}
+	}
+
+	if opts.NotifySocket != "" {
+		if err := bindFile(rootfs, opts.NotifySocket, mountTarget{path: containerNotifySocket}, nil); err != nil {
+			return inStep("mount", containerNotifySocket, fmt.Errorf("failed to mount notify socket: %w", err))
+		}
+	}
+	if opts.MetadataSocket != "" {
+		if err := bindFile(rootfs, opts.MetadataSocket, mountTarget{path: containerMetadataSocket}, nil); err != nil {
+			return inStep("mount", containerMetadataSocket, fmt.Errorf("failed to mount metadata socket: %w", err))
+		}
+	}
+	// A read-only rootfs without an /etc/hosts or /etc/machine-id to mount
+	// over goes without.
+	if opts.HostsFile != "" {
+		err := bindFile(rootfs, opts.HostsFile, mountTarget{path: containerHostsFile, noSymlink: true}, nil)
+		if err != nil && !errors.Is(err, unix.EROFS) {
+			return inStep("mount", containerHostsFile, fmt.Errorf("failed to mount hosts file: %w", err))
+		}
+	}
+	if opts.MachineIDFile != "" {
+		err := bindFile(rootfs, opts.MachineIDFile, mountTarget{path: containerMachineIDFile}, remountReadOnly)
+		if err != nil && !errors.Is(err, unix.EROFS) {
+			return inStep("mount", containerMachineIDFile, fmt.Errorf("failed to mount machine ID: %w", err))
+		}
+	}
+
+	// The exec fifo lives in the state dir on the host, so hold on to it
+	// across pivot_root.
+	execFifo := -1
+	if opts.ExecFifo != "" {
+		if execFifo, err = unix.Open(opts.ExecFifo, unix.O_PATH|unix.O_CLOEXEC, 0); err != nil {
+			return inStep("exec-fifo", opts.ExecFifo, fmt.Errorf("failed to open exec fifo: %w", err))
+		}
+		defer unix.Close(execFifo)
+	}
+
+	// Mount a new /proc in this PID namespace and a /sys for the network
+	// namespace. It happens before pivot_root because a user namespace may
+	// only mount proc and sysfs while the host's are still visible.
+	var specMounts []specs.Mount
+	if opts.Spec != nil {
+		specMounts = opts.Spec.Mounts
+	}
+	procData, err := procMountData(specMounts)
+	if err != nil {
+		return inStep("mount", "/proc", err)
+	}
+	if err := mountProc(rootfs, procData); err != nil {
+		return inStep("mount", "/proc", err)
+	}
+	if !hasMountAt(opts.Spec, "/sys") {
+		cgroup := opts.CgroupPath != "" && !hasMountAt(opts.Spec, "/sys/fs/cgroup")
+		if err := mountSys(rootfs, sysWritable(userns, opts.HostNetwork, opts.Privileged), cgroup); err != nil {
+			return inStep("mount", "/sys", err)
+		}
+	}
+
+	// Masked files get the host's /dev/null.
+	devNulls, err := devNullTrees(len(opts.MaskedPaths))
+	if err != nil {
+		return inStep("masked-paths", "/dev/null", err)
+	}
+	defer closeAll(devNulls)
+
+	// The seccomp agent listens on the host, which is out of reach once
+	// the root has been pivoted.
+	var seccompConn *net.UnixConn
+	if opts.SeccompState != nil {
+		if opts.SeccompState.Pid, err = hostPid(); err != nil {
+			return err
+		}
+		if seccompConn, err = dialSeccompListener(opts.Spec.Linux.Seccomp.ListenerPath); err != nil {
+			return inStep("seccomp", opts.Spec.Linux.Seccomp.ListenerPath, err)
+		}
+		defer seccompConn.Close()
+	}
+
+	pivotStart := time.Now()
+	// A sandbox keeping the root of the host runs the rootfs where it is,
+	// with the secrets mounted in it. Its kernel, with a /proc and /sys
+	// of its own, mounts the tmpfs mounts and has no paths to mask.
+	newRoot := "/"
+	if opts.KeepRoot {
+		newRoot = rootfs
+	} else if !opts.HostRootfs {
+		if err := pivotRootfs(rootfs, root, rootPropagation); err != nil {
+			return err
+		}
+	}
+
+	if !opts.KeepRoot {
+		for _, m := range tmpfsMounts {
+			if err := mountTmpfs("/", m); err != nil {
+				return inStep("mount", m.Destination, err)
+			}
+		}
+		if err := makeReadonly(opts.ReadonlyPaths); err != nil {
+			return inStep("readonly-paths", "", err)
+		}
+		if err := makeWritable(opts.WritablePaths); err != nil {
+			return inStep("writable-paths", "", err)
+		}
+		if err := maskPaths(opts.MaskedPaths, devNulls); err != nil {
+			return inStep("masked-paths", "", err)
+		}
+	}
+	if len(opts.Secrets) > 0 {
+		var uid, gid int
+		if opts.Spec != nil && opts.Spec.Process != nil {
+			uid, gid = int(opts.Spec.Process.User.UID), int(opts.Spec.Process.User.GID)
+		}
+		if err := mountSecrets(newRoot, opts.Secrets, uid, gid); err != nil {
+			return inStep("secrets", secretsDir, err)
+		}
+	}
+
+	// signal the parent-stage that setup succeeded
+	timings := map[string]time.Duration{
+		PhaseMounts: pivotStart.Sub(mountsStart),
+		PhasePivot:  time.Since(pivotStart),
+	}
+	if err := writeStageMsg(stagePipe, stageMsg{Type: msgReady, Timings: timings}); err != nil {
+		return err
+	}
+
+	// wait until the runtime has finished configuring our namespaces
+	if _, err := expectStageMsg(stagePipe, msgGo, "parent stage", 0); err != nil {
+		return err
+	}
+	// From here on the container outlives the parent stage.
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear parent death signal: %w", err)
+	}
+	if err := writeStageMsg(stagePipe, stageMsg{Type: msgStarted}); err != nil {
+		return err
+	}
+	reporting = false
+
+	if opts.Spec != nil && opts.Spec.Hostname != "" {
+		if err := unix.Sethostname([]byte(opts.Spec.Hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+	if execFifo >= 0 {
+		if err := waitExecFifo(execFifo); err != nil {
+			return err
+		}
+	}
+	if !opts.NoNewKeyring {
+		if err := joinSessionKeyring(opts.ContainerId); err != nil {
+			return err
+		}
+	}
+	sandbox, err := sandboxFor(opts.Isolation)
+	if err != nil {
+		return err
+	}
+	return sandbox.exec(&opts, seccompConn)
+}
+
+// execProcess executes the process of the container, once set up, in place
+// of the calling stage.
+func execProcess(opts *stageOptions, seccompConn *net.UnixConn) error {
+	if opts.Spec != nil && opts.Spec.Linux != nil && opts.Spec.Linux.Personality != nil {
+		if err := setPersonality(opts.Spec.Linux.Personality); err != nil {
+			return err
+		}
+	}
+	var process *specs.Process
+	if opts.Spec != nil {
+		process = opts.Spec.Process
+	}
+	unix.Umask(processUmask(process))
+	if opts.CoreDumps {
+		if err := raiseCoreLimit(); err != nil {
+			return err
+		}
+	}
 
-	// Make / a private mount point so we don't propagate changes.
-	if err := unix.Mount("", "/", "", unix.MS_PRIVATE|unix.MS_REC, ""); err != nil {
-		return fmt.Errorf("failed to make / a private mount: %w", err)
+	var seccomp *specs.LinuxSeccomp
+	if opts.Spec != nil && opts.Spec.Linux != nil {
+		seccomp = opts.Spec.Linux.Seccomp
+	}
+	noNewPrivileges := process != nil && process.NoNewPrivileges
+	// Without no_new_privs loading a filter takes privileges the process
+	// loses to its user, so load it first; with it load it as late as
+	// possible, so it only applies to the container process.
+	if seccomp != nil && !noNewPrivileges {
+		if err := loadSeccomp(seccomp, seccompConn, opts.SeccompState); err != nil {
+			return err
+		}
+	}
+	if process != nil {
+		if err := setupProcess(process); err != nil {
+			return err
+		}
+	}
+	if noNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+		if seccomp != nil {
+			if err := loadSeccomp(seccomp, seccompConn, opts.SeccompState); err != nil {
+				return err
+			}
+		}
+	}
+	argv, env := initProcess(opts.Spec, opts.NotifySocket != "")
+	env = append(env, opts.SecretEnv...)
+	if opts.Wasm {
+		return execWasm("/", argv, env)
+	}
+	if opts.Faketime {
+		var preloaded bool
+		if env, preloaded = preloadFaketime(env); !preloaded {
+			fmt.Fprintln(stageOut, "INIT (child-stage): no libfaketime in the rootfs, only SOURCE_DATE_EPOCH sets the fake date")
+		}
+	}
+	path, err := lookExecPath(argv[0], envValue(env, "PATH"))
+	if err != nil {
+		return err
 	}
 
-	// Bind-mount the rootfs to itself so we can pivot-root later.
-	if err := unix.Mount(rootfs, rootfs, "bind", unix.MS_BIND|unix.MS_REC, ""); err != nil {
-		return fmt.Errorf("failed to bind %s: %w", rootfs, err)
+	fmt.Fprintf(stageOut, "INIT (child-stage): Replacing current process with %s...\n", argv[0])
+	// Exec into the container process. If this fails, we can't continue.
+	if err := unix.Exec(path, argv, env); err != nil {
+		return startError(argv[0], err)
 	}
+	return nil
+}
 
+// pivotRootfs makes rootfs, bind mounted on itself and opened as root, the
+// root of the mount namespace, detaches the old root and gives the new one
+// rootPropagation.
+func pivotRootfs(rootfs string, root int, rootPropagation uintptr) error {
 	oldroot, err := unix.Open("/", unix.O_DIRECTORY|unix.O_RDONLY, 0)
 	if err != nil {
 		return fmt.Errorf("error opening old root '/': %w", err)
 	}
 	defer unix.Close(oldroot)
 
-	newroot, err := unix.Open(rootfs, unix.O_DIRECTORY|unix.O_RDONLY, 0)
+	newroot, err := unix.Openat2(unix.AT_FDCWD, rootfs, &unix.OpenHow{
+		Flags:   unix.O_DIRECTORY | unix.O_RDONLY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	})
 	if err != nil {
-		return fmt.Errorf("error opening new root '%s': %w", rootfs, err)
+		return inStep("pivot_root", rootfs, fmt.Errorf("error opening new root '%s': %w", rootfs, err))
 	}
 	defer unix.Close(newroot)
+	// The bind mount on the path must be of the directory checked above.
+	if same, err := sameFile(newroot, root); err != nil || !same {
+		return inStep("pivot_root", rootfs, fmt.Errorf("new root %s changed while being set up", rootfs))
+	}
 
 	// Move into the new root so pivot_root operates on "."
 	if err := unix.Fchdir(newroot); err != nil {
 		return fmt.Errorf("failed to fchdir to new root: %w", err)
 	}
 
-	fmt.Printf("INIT (child-stage): pivot_root into %s ...\n", rootfs)
+	fmt.Fprintf(stageOut, "INIT (child-stage): pivot_root into %s ...\n", rootfs)
 	if err := unix.PivotRoot(".", "."); err != nil {
-		return fmt.Errorf("failed to pivot_root: %w", err)
+		return inStep("pivot_root", rootfs, fmt.Errorf("failed to pivot_root: %w", err))
 	}
 
 	// Move back to the old root's directory.
@@ -488,33 +2463,117 @@ func handleChildStage() error {
 
 	// Unmount old root. MNT_DETACH means we detach the old mount tree.
 	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
-		return fmt.Errorf("failed to unmount old root: %w", err)
+		return inStep("pivot_root", "/", fmt.Errorf("failed to unmount old root: %w", err))
+	}
+	// The working directory was the old root, so move to the new one and
+	// make sure nothing of the old one is left.
+	if err := unix.Chdir("/"); err != nil {
+		return fmt.Errorf("failed to chdir('/'): %w", err)
+	}
+	if err := checkOldRootDetached(newroot); err != nil {
+		return inStep("pivot_root", "/", err)
 	}
 
-	// Mount a new /proc in this PID namespace.
-	if err := unix.Mount("proc", "/proc", "proc", 0, ""); err != nil {
-		return fmt.Errorf("failed to mount /proc in child: %w", err)
+	// pivot_root needed the new root private; give it the requested
+	// propagation back.
+	if rootPropagation&unix.MS_PRIVATE == 0 {
+		if err := unix.Mount("", "/", "", rootPropagation, ""); err != nil {
+			return fmt.Errorf("failed to set the propagation of the new root: %w", err)
+		}
 	}
+	return nil
+}
 
-	// signal the parent-stage that setup succeeded
-	if stagePipe != nil {
-		if _, err := stagePipe.Write([]byte{0}); err != nil {
-			return fmt.Errorf("failed to signal parent: %w", err)
+// ParseEnv parses an --env value, KEY=VALUE.
+func ParseEnv(value string) (string, error) {
+	key, _, ok := strings.Cut(value, "=")
+	if !ok || key == "" || strings.ContainsAny(key, " \t\n") {
+		return "", fmt.Errorf("invalid environment variable %q: expected KEY=VALUE", value)
+	}
+	return value, nil
+}
+
+// setEnv sets the KEY=VALUE variables env in the environment of the process
+// of spec, replacing those with the same key.
+func setEnv(spec *specs.Spec, env []string) error {
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return fmt.Errorf("setting the environment requires process.args in the spec")
+	}
+	for _, e := range env {
+		if _, err := ParseEnv(e); err != nil {
+			return err
 		}
+		key, _, _ := strings.Cut(e, "=")
+		spec.Process.Env = slices.DeleteFunc(spec.Process.Env, func(cur string) bool {
+			k, _, _ := strings.Cut(cur, "=")
+			return k == key
+		})
+		spec.Process.Env = append(spec.Process.Env, e)
 	}
+	return nil
+}
 
-	fmt.Println("INIT (child-stage): Replacing current process with /bin/sh...")
-	shellPath := "/bin/sh"
-	argv := []string{shellPath}
-	env := os.Environ()
+// initProcess returns the arguments and environment of the container init
+// process: process.args and process.env of the spec, or a shell when the
+// spec has no process.
+func initProcess(spec *specs.Spec, notify bool) (argv, env []string) {
+	argv = []string{initProcessPath}
+	if spec != nil && spec.Process != nil && len(spec.Process.Args) > 0 {
+		argv = spec.Process.Args
+		env = append(env, spec.Process.Env...)
+	}
+	if notify {
+		env = append(env, "NOTIFY_SOCKET="+containerNotifySocket)
+	}
+	return argv, env
+}
 
-	// Exec into /bin/sh. If this fails, we can't continue.
-	if err := unix.Exec(shellPath, argv, env); err != nil {
-		return fmt.Errorf("exec /bin/sh failed: %w", err)
+// setupProcess moves to the working directory of the container process and
+// switches to its user, with its capabilities when the spec sets them.
+func setupProcess(p *specs.Process) error {
+	if p.Cwd != "" {
+		if err := unix.Chdir(p.Cwd); err != nil {
+			return fmt.Errorf("failed to change to working directory %s: %w", p.Cwd, err)
+		}
+	}
+	var caps *processCaps
+	if p.Capabilities != nil {
+		var err error
+		if caps, err = parseProcessCapabilities(p.Capabilities); err != nil {
+			return err
+		}
+		if err := caps.dropBoundingSet(); err != nil {
+			return err
+		}
+	}
+	// The syscall package changes the credentials of every thread.
+	groups := make([]int, len(p.User.AdditionalGids))
+	for i, g := range p.User.AdditionalGids {
+		groups[i] = int(g)
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setresgid(int(p.User.GID), int(p.User.GID), int(p.User.GID)); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", p.User.GID, err)
+	}
+	if err := syscall.Setresuid(int(p.User.UID), int(p.User.UID), int(p.User.UID)); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", p.User.UID, err)
+	}
+	if caps != nil {
+		return caps.apply()
 	}
 	return nil
 }
 
+// bindFile bind-mounts the file src onto the mount point t of rootfs,
+// created as needed, and calls after, if set, with the path of the mount.
+func bindFile(rootfs, src string, t mountTarget, after func(target string) error) error {
+	return mountInRoot(rootfs, t, func(dst string) error {
+		return unix.Mount(src, dst, "", unix.MS_BIND, "")
+	}, after)
+}
+
 // joinNamespace is an example of how you might join a particular namespace (UTS below).
 // Not currently used in the main flow, but can be handy for debugging or advanced usage.
 func joinNamespace(pid int, namespace string) {
@@ -531,50 +2590,120 @@ func joinNamespace(pid int, namespace string) {
 	fmt.Printf("Joined %s namespace of PID %d\n", namespace, pid)
 }
 
-// readInitInfo reads the setup handshake from the init process and returns the
-// PID of the child stage. The protocol is a single 0 byte followed by
-// "pid:<num>\n".
-func readInitInfo(r io.Reader) (int, error) {
-	br := bufio.NewReader(r)
-
-	b, err := br.ReadByte()
-	if err != nil {
-		return 0, err
-	}
-	if b != 0 {
-		return 0, fmt.Errorf("unexpected handshake byte %d != 0", b)
-	}
-
-	line, err := br.ReadString('\n')
-	if err != nil {
-		return 0, err
-	}
-	if !strings.HasPrefix(line, "pid:") {
-		return 0, fmt.Errorf("unexpected init message %q", strings.TrimSpace(line))
-	}
-	pidStr := strings.TrimSpace(strings.TrimPrefix(line, "pid:"))
-	pid, err := strconv.Atoi(pidStr)
-	if err != nil {
-		return 0, fmt.Errorf("invalid pid %q: %w", pidStr, err)
-	}
-	return pid, nil
-}
-
 // init is called automatically when this package is loaded (i.e., before main()).
 // We detect whether we are in PARENT_STAGE or CHILD_STAGE and invoke the corresponding handler.
 func init() {
 	if len(os.Args) > 2 && os.Args[1] == "init" {
+		if err := inheritConfig(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error in init: %v\n", err)
+			os.Exit(1)
+		}
 		stage := os.Args[2]
 		switch stage {
-		case ParentStage:
+		case parentStage:
 			if err := handleParentStage(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error in parent stage: %v\n", err)
+				if !errors.Is(err, errStageReported) {
+					fmt.Fprintf(os.Stderr, "Error in parent stage: %v\n", err)
+				}
 				os.Exit(1)
 			}
 			os.Exit(0)
-		case ChildStage:
+		case childStage:
 			if err := handleChildStage(); err != nil {
-				fmt.Fprintf(os.Stderr, "Error in child stage: %v\n", err)
+				if !errors.Is(err, errStageReported) {
+					fmt.Fprintf(os.Stderr, "Error in child stage: %v\n", err)
+				}
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case logStage:
+			if len(os.Args) < 5 {
+				fmt.Fprintln(os.Stderr, "Error in logger: missing log path or config")
+				os.Exit(1)
+			}
+			if err := runLogger(os.Args[3], os.Args[4]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in logger: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case execStage:
+			if len(os.Args) < 5 {
+				fmt.Fprintln(os.Stderr, "Error in exec monitor: missing container or exec id")
+				os.Exit(1)
+			}
+			if err := runExecMonitor(os.Args[3], os.Args[4]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in exec monitor: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case debugStage:
+			if len(os.Args) < 5 {
+				fmt.Fprintln(os.Stderr, "Error in debug shell: missing toolbox or command")
+				os.Exit(1)
+			}
+			err := runDebugStage(os.Args[3], os.Args[4:])
+			fmt.Fprintf(os.Stderr, "Error in debug shell: %v\n", err)
+			os.Exit(debugStageExitCode(err))
+		case webhookStage:
+			if err := runWebhooks(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in webhook process: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case traceStage:
+			if len(os.Args) < 6 {
+				fmt.Fprintln(os.Stderr, "Error in tracer: missing pid, trace path or mode")
+				os.Exit(1)
+			}
+			pid, err := strconv.Atoi(os.Args[3])
+			if err == nil {
+				err = runTracer(pid, os.Args[4], os.Args[5])
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error in tracer: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case fakeChildStage:
+			if err := handleFakeChildStage(); err != nil {
+				if !errors.Is(err, errStageReported) {
+					fmt.Fprintf(os.Stderr, "Error in fake child stage: %v\n", err)
+				}
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case coreStage:
+			if err := runCoreHelper(os.Args[3:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in core dump helper: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case vmGuestStage:
+			if err := runVMGuest(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in VM guest: %v\n", err)
+			}
+			vmPowerOff()
+		case execProcessStage:
+			if err := handleExecProcessStage(); err != nil {
+				if !errors.Is(err, errStageReported) {
+					fmt.Fprintf(os.Stderr, "Error in exec process stage: %v\n", err)
+				}
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case vmProcessStage:
+			if err := handleVMProcessStage(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in VM process stage: %v\n", err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		case dnsStage:
+			if len(os.Args) < 4 {
+				fmt.Fprintln(os.Stderr, "Error in DNS server: missing network name")
+				os.Exit(1)
+			}
+			if err := runDNSServer(os.Args[3]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error in DNS server: %v\n", err)
 				os.Exit(1)
 			}
 			os.Exit(0)
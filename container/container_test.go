@@ -1,16 +1,25 @@
 package container
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
 )
 
 func TestSaveLoadState(t *testing.T) {
-	dir := t.TempDir()
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
 
 	c := &Container{
 		Id:             "test123",
@@ -20,16 +29,16 @@ func TestSaveLoadState(t *testing.T) {
 		Bundle:         "mybundle",
 	}
 
-	if err := SaveState(dir, c); err != nil {
-		t.Fatalf("SaveState failed: %v", err)
+	if err := saveState(c); err != nil {
+		t.Fatalf("saveState failed: %v", err)
 	}
 
 	// ensure file exists
-	if _, err := os.Stat(filepath.Join(dir, "state.json")); err != nil {
+	if _, err := os.Stat(filepath.Join(StateDir(c.Id), "state.json")); err != nil {
 		t.Fatalf("state.json not created: %v", err)
 	}
 
-	loaded, err := LoadState(dir)
+	loaded, err := LoadState(c.Id)
 	if err != nil {
 		t.Fatalf("LoadState failed: %v", err)
 	}
@@ -42,8 +51,9 @@ func TestSaveLoadState(t *testing.T) {
 }
 
 func TestSaveStateCreatesDir(t *testing.T) {
-	base := t.TempDir()
-	dir := filepath.Join(base, "a", "b")
+	orig := baseStateDir
+	baseStateDir = filepath.Join(t.TempDir(), "a", "b")
+	defer func() { baseStateDir = orig }()
 
 	c := &Container{
 		Id:        "dirtest",
@@ -51,11 +61,11 @@ func TestSaveStateCreatesDir(t *testing.T) {
 		Status:    Created,
 	}
 
-	if err := SaveState(dir, c); err != nil {
-		t.Fatalf("SaveState failed: %v", err)
+	if err := saveState(c); err != nil {
+		t.Fatalf("saveState failed: %v", err)
 	}
 
-	if _, err := os.Stat(filepath.Join(dir, "state.json")); err != nil {
+	if _, err := os.Stat(filepath.Join(StateDir(c.Id), "state.json")); err != nil {
 		t.Fatalf("state.json not created: %v", err)
 	}
 }
@@ -88,16 +98,15 @@ func TestStopContainer(t *testing.T) {
 		t.Fatalf("failed to start dummy process: %v", err)
 	}
 
-	stateDir, err := CreateStateDir(id)
-	if err != nil {
+	if _, err := createStateDir(id); err != nil {
 		t.Fatalf("failed to create state dir: %v", err)
 	}
 	c := &Container{Id: id, InitProcessPiD: cmd.Process.Pid, CreatedAt: time.Now(), Status: Running}
-	if err := SaveState(stateDir, c); err != nil {
+	if err := saveState(c); err != nil {
 		t.Fatalf("failed to save state: %v", err)
 	}
 
-	if err := StopContainer(id); err != nil {
+	if err := StopContainer(id, 5*time.Second); err != nil {
 		t.Fatalf("StopContainer failed: %v", err)
 	}
 
@@ -105,16 +114,116 @@ func TestStopContainer(t *testing.T) {
 	_ = cmd.Wait()
 
 	// process should be gone
-	err = cmd.Process.Signal(syscall.Signal(0))
+	err := cmd.Process.Signal(syscall.Signal(0))
 	if err == nil {
 		t.Fatalf("process still running after StopContainer")
 	}
 
-	loaded, err := LoadState(stateDir)
+	loaded, err := LoadState(id)
 	if err != nil {
 		t.Fatalf("failed to load state: %v", err)
 	}
 	if loaded.Status != Stopped {
 		t.Fatalf("expected status Stopped, got %v", loaded.Status)
 	}
+	if loaded.Graceful == nil || !*loaded.Graceful {
+		t.Fatalf("expected a graceful stop, got %v", loaded.Graceful)
+	}
+	if err := StopContainer(id, 0); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("stopping a stopped container: expected ErrNotRunning, got %v", err)
+	}
+	if err := StopContainer("missing", 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("stopping a missing container: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStopContainerKillsAfterTimeout(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	// An init process ignoring SIGTERM.
+	cmd := exec.Command("sh", "-c", `trap "" TERM; exec sleep 30`)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	exited := make(chan struct{})
+	go func() { cmd.Wait(); close(exited) }()
+	// Give the shell time to install the trap.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := saveState(&Container{Id: "stubborn", InitProcessPiD: cmd.Process.Pid, Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := StopContainer("stubborn", 300*time.Millisecond); err != nil {
+		t.Fatalf("StopContainer failed: %v", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Fatalf("killed after %v, before the timeout", d)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process still running after StopContainer")
+	}
+
+	c, err := LoadState("stubborn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Status != Stopped || c.Graceful == nil || *c.Graceful {
+		t.Fatalf("expected a forced stop, got status %v graceful %v", c.Status, c.Graceful)
+	}
+}
+
+func TestOpenStageOut(t *testing.T) {
+	defer func() { stageOut = os.Stdout }()
+	t.Setenv("PROGRESS_FD", "")
+	if err := openStageOut(); err != nil || stageOut != os.Stdout {
+		t.Fatalf("without PROGRESS_FD stage messages go to %v, %v", stageOut, err)
+	}
+
+	log, err := os.Create(filepath.Join(t.TempDir(), runtimeLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(log.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	t.Setenv("PROGRESS_FD", strconv.Itoa(fd))
+	if err := openStageOut(); err != nil {
+		t.Fatal(err)
+	}
+	defer stageOut.Close()
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	if err != nil || flags&unix.FD_CLOEXEC == 0 {
+		t.Fatalf("the runtime log would leak into the container process: %#x, %v", flags, err)
+	}
+	fmt.Fprintln(stageOut, "INIT: Entering child stage")
+	if data, _ := os.ReadFile(log.Name()); string(data) != "INIT: Entering child stage\n" {
+		t.Fatalf("runtime log holds %q", data)
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	for _, v := range []string{"FOO", "=bar", "A B=c"} {
+		if _, err := ParseEnv(v); err == nil {
+			t.Errorf("ParseEnv(%q) succeeded, expected an error", v)
+		}
+	}
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"/app"}, Env: []string{"PATH=/bin", "MODE=prod"}}}
+	if err := setEnv(spec, []string{"MODE=dev", "EMPTY="}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"PATH=/bin", "MODE=dev", "EMPTY="}
+	if strings.Join(spec.Process.Env, " ") != strings.Join(want, " ") {
+		t.Fatalf("env = %q, want %q", spec.Process.Env, want)
+	}
+	if err := setEnv(&specs.Spec{}, []string{"MODE=dev"}); err == nil {
+		t.Fatal("expected a spec without a process to be refused")
+	}
 }
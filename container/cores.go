@@ -0,0 +1,316 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The kernel writes core dumps where the core_pattern of the host says,
+// whatever the namespaces of the process dumping, so a container run with
+// RunOptions.CoreDumps makes the runtime the core_pattern pipe helper of
+// the host, after saving the pattern it replaces. The kernel runs the
+// helper, the coreStage of this binary, on the host with the core on its
+// stdin; it finds the container of the dumping process by its pid
+// namespace and files the core in the cores dir of its state dir with
+// what crashed, keeping the last keptCores. Cores of other processes are
+// dropped while it is installed, until RestoreCorePattern puts the saved
+// pattern back. The container process gets an unlimited RLIMIT_CORE.
+
+// coreStage is the init stage the kernel runs as the core_pattern helper.
+const coreStage = "CORE"
+
+// coresDirName is the dir of the state dir of a container holding its
+// core dumps.
+const coresDirName = "cores"
+
+// keptCores is how many core dumps of a container are kept.
+const keptCores = 5
+
+// savedCorePatternName is the file of the base state dir holding the
+// core_pattern the helper replaced.
+const savedCorePatternName = ".core_pattern"
+
+// corePatternPath is the core_pattern of the host. It is a variable so
+// tests can override it.
+var corePatternPath = "/proc/sys/kernel/core_pattern"
+
+// maxCorePattern is the longest core_pattern the kernel takes.
+const maxCorePattern = 127
+
+// CoreDump is a core dump of a process of a container.
+type CoreDump struct {
+	// File is the name of the core in the cores dir of the container.
+	File string    `json:"file"`
+	Time time.Time `json:"time"`
+	// Pid is the pid of the process on the host, and NsPid in the
+	// container.
+	Pid   int `json:"pid"`
+	NsPid int `json:"nsPid,omitempty"`
+	// Signal is the signal that killed it, such as SIGSEGV.
+	Signal string `json:"signal"`
+	// Executable is the path of its executable in the container, or its
+	// command name if that is gone.
+	Executable string `json:"executable"`
+	Size       int64  `json:"size"`
+}
+
+// CoresDir returns the dir holding the core dumps of container id.
+func CoresDir(id string) string {
+	return filepath.Join(StateDir(id), coresDirName)
+}
+
+// ListCores returns the core dumps of container id, the oldest first.
+func ListCores(id string) ([]CoreDump, error) {
+	if _, err := LoadState(id); err != nil {
+		return nil, err
+	}
+	dir := CoresDir(id)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cores []CoreDump
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var core CoreDump
+		if err := json.Unmarshal(data, &core); err != nil {
+			return nil, fmt.Errorf("invalid core dump record %s: %w", e.Name(), err)
+		}
+		cores = append(cores, core)
+	}
+	slices.SortFunc(cores, func(a, b CoreDump) int { return a.Time.Compare(b.Time) })
+	return cores, nil
+}
+
+// corePattern returns the core_pattern making exe the helper filing the
+// cores of the containers under the base state dir, whose state is kept
+// in the state store backend named store.
+func corePattern(exe, store string) (string, error) {
+	if strings.ContainsAny(exe+baseStateDir, " \t\n%") {
+		return "", fmt.Errorf("the core dump helper %s can't take a state dir %s with spaces or %%", exe, baseStateDir)
+	}
+	pattern := fmt.Sprintf("|%s init %s %s %s %%P %%s %%t %%e", exe, coreStage, store, baseStateDir)
+	if len(pattern) > maxCorePattern {
+		return "", fmt.Errorf("the core_pattern of the core dump helper, %s, is longer than the %d bytes the kernel takes", pattern, maxCorePattern)
+	}
+	return pattern, nil
+}
+
+// isCoreHelper reports whether pattern is that of the core dump helper of
+// a containish binary.
+func isCoreHelper(pattern string) bool {
+	return strings.HasPrefix(pattern, "|") && strings.Contains(pattern, " init "+coreStage+" ")
+}
+
+// installCoreHelper makes the runtime the core_pattern helper of the host,
+// saving the pattern it replaces unless that of another containish.
+func installCoreHelper() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	store := DirStateStore
+	if _, ok := s.(boltStore); ok {
+		store = BoltStateStore
+	}
+	pattern, err := corePattern(exe, store)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(corePatternPath)
+	if err != nil {
+		return fmt.Errorf("failed to read core_pattern: %w", err)
+	}
+	current := strings.TrimSpace(string(data))
+	if current == pattern {
+		return nil
+	}
+	if !isCoreHelper(current) {
+		if err := os.MkdirAll(baseStateDir, 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(baseStateDir, savedCorePatternName), []byte(current+"\n"), 0o600); err != nil {
+			return fmt.Errorf("failed to save core_pattern: %w", err)
+		}
+	}
+	if err := os.WriteFile(corePatternPath, []byte(pattern), 0o644); err != nil {
+		return fmt.Errorf("failed to install the core dump helper in core_pattern: %w", err)
+	}
+	return nil
+}
+
+// RestoreCorePattern puts back the core_pattern the core dump helper
+// replaced, and returns it. Without one saved it does nothing and returns
+// an empty string.
+func RestoreCorePattern() (string, error) {
+	saved := filepath.Join(baseStateDir, savedCorePatternName)
+	data, err := os.ReadFile(saved)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	pattern := strings.TrimSpace(string(data))
+	if err := os.WriteFile(corePatternPath, []byte(pattern), 0o644); err != nil {
+		return "", fmt.Errorf("failed to restore core_pattern: %w", err)
+	}
+	return pattern, os.Remove(saved)
+}
+
+// raiseCoreLimit lifts the RLIMIT_CORE of the calling process, which its
+// children inherit.
+func raiseCoreLimit() error {
+	limit := unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &limit); err != nil {
+		return fmt.Errorf("failed to lift RLIMIT_CORE: %w", err)
+	}
+	return nil
+}
+
+// runCoreHelper files the core dump on stdin of the process pid killed by
+// signal at the epoch time, exe its command name, as the kernel runs the
+// coreStage with the arguments of core_pattern: the kernel gives it no
+// environment, so the state store and the base state dir come first.
+func runCoreHelper(args []string) error {
+	if len(args) < 6 {
+		return fmt.Errorf("missing state store, state dir, pid, signal, time or executable")
+	}
+	s, err := OpenStateStore(args[0])
+	if err != nil {
+		return err
+	}
+	SetStateStore(s)
+	baseStateDir, args = args[1], args[2:]
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid pid %q", args[0])
+	}
+	sig, err := strconv.Atoi(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid signal %q", args[1])
+	}
+	secs, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid time %q", args[2])
+	}
+	c, err := coreContainer(pid)
+	if err != nil || c == nil {
+		// Not a process of a container capturing its cores.
+		return err
+	}
+	core := CoreDump{
+		Time:       time.Unix(secs, 0).UTC(),
+		Pid:        pid,
+		NsPid:      nsPid(pid),
+		Signal:     unix.SignalName(unix.Signal(sig)),
+		Executable: strings.Join(args[3:], " "),
+	}
+	if path, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid)); err == nil {
+		core.Executable = path
+	}
+	return saveCore(c.Id, core, os.Stdin)
+}
+
+// coreContainer returns the running container capturing its cores whose
+// pid namespace process pid is in, or nil if there is none.
+func coreContainer(pid int) (*Container, error) {
+	ns, err := os.Stat(fmt.Sprintf("/proc/%d/ns/pid", pid))
+	if err != nil {
+		return nil, err
+	}
+	containers, err := FindContainers(StateFilter{Status: []Status{Running, Starting}})
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range containers {
+		if c.Options == nil || !c.Options.CoreDumps || c.InitProcessPiD <= 0 {
+			continue
+		}
+		if initNs, err := os.Stat(fmt.Sprintf("/proc/%d/ns/pid", c.InitProcessPiD)); err == nil && os.SameFile(ns, initNs) {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// nsPid returns the pid of process pid in its own pid namespace, or 0 if
+// unknown.
+func nsPid(pid int) int {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				return 0
+			}
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			return n
+		}
+	}
+	return 0
+}
+
+// saveCore writes the core r holds to the cores dir of container id with
+// its record, then removes the oldest beyond keptCores.
+func saveCore(id string, core CoreDump, r io.Reader) error {
+	dir := CoresDir(id)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("core.%s.%d", core.Time.Format("20060102T150405Z"), core.Pid)
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	core.Size, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write core dump: %w", err)
+	}
+	core.File = name
+	data, err := json.MarshalIndent(core, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), data, 0o600); err != nil {
+		return err
+	}
+	cores, err := ListCores(id)
+	if err != nil {
+		return err
+	}
+	for _, old := range cores[:max(0, len(cores)-keptCores)] {
+		os.Remove(filepath.Join(dir, old.File))
+		os.Remove(filepath.Join(dir, old.File+".json"))
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorePattern(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = "/var/lib/containish"
+
+	pattern, err := corePattern("/usr/bin/containish", BoltStateStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "|/usr/bin/containish init CORE bolt /var/lib/containish %P %s %t %e"; pattern != want {
+		t.Errorf("pattern = %q, want %q", pattern, want)
+	}
+	if !isCoreHelper(pattern) || isCoreHelper("core") || isCoreHelper("|/usr/lib/systemd/systemd-coredump %P") {
+		t.Error("isCoreHelper doesn't tell the helper apart")
+	}
+	if _, err := corePattern("/opt/my tools/containish", DirStateStore); err == nil {
+		t.Error("a helper path with a space succeeded")
+	}
+	if _, err := corePattern("/"+strings.Repeat("x", maxCorePattern), DirStateStore); err == nil {
+		t.Error("a pattern longer than the kernel takes succeeded")
+	}
+}
+
+func TestInstallCoreHelper(t *testing.T) {
+	orig, origPath := baseStateDir, corePatternPath
+	defer func() { baseStateDir, corePatternPath = orig, origPath }()
+	baseStateDir = t.TempDir()
+	corePatternPath = filepath.Join(t.TempDir(), "core_pattern")
+	writeFile(t, corePatternPath, "core\n", 0o644)
+
+	for range 2 {
+		if err := installCoreHelper(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(corePatternPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isCoreHelper(string(data)) {
+		t.Errorf("core_pattern = %q, want the helper", data)
+	}
+
+	pattern, err := RestoreCorePattern()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(corePatternPath); pattern != "core" || string(data) != "core" {
+		t.Errorf("restored %q, core_pattern %q, want core", pattern, data)
+	}
+	if pattern, err := RestoreCorePattern(); pattern != "" || err != nil {
+		t.Errorf("restoring again = %q, %v, want nothing", pattern, err)
+	}
+}
+
+func TestCoreContainer(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = t.TempDir()
+	init := exec.Command("sleep", "60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	go init.Wait()
+	if err := saveState(&Container{Id: "plain", Status: Running, InitProcessPiD: init.Process.Pid, Options: &RunOptions{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := coreContainer(os.Getpid())
+	if err != nil || c != nil {
+		t.Errorf("container of a process of a container not capturing cores = %v, %v", c, err)
+	}
+	if err := saveState(&Container{Id: "app", Status: Running, InitProcessPiD: init.Process.Pid, Options: &RunOptions{CoreDumps: true}}); err != nil {
+		t.Fatal(err)
+	}
+	// The test shares the pid namespace of the "container".
+	if c, err := coreContainer(os.Getpid()); err != nil || c == nil || c.Id != "app" {
+		t.Errorf("container = %v, %v, want app", c, err)
+	}
+	if got := nsPid(os.Getpid()); got == 0 {
+		t.Error("no pid in the namespace of the test")
+	}
+}
+
+func TestSaveCore(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = t.TempDir()
+	if err := saveState(&Container{Id: "app", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	if cores, err := ListCores("app"); err != nil || len(cores) != 0 {
+		t.Errorf("cores before any = %v, %v", cores, err)
+	}
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range keptCores + 2 {
+		core := CoreDump{Time: start.Add(time.Duration(i) * time.Second), Pid: 100 + i, Signal: "SIGSEGV", Executable: "/app"}
+		if err := saveCore("app", core, strings.NewReader(fmt.Sprint("core ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cores, err := ListCores("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cores) != keptCores || cores[0].Pid != 102 || cores[keptCores-1].Pid != 106 {
+		t.Fatalf("cores = %+v, want the last %d", cores, keptCores)
+	}
+	last := cores[keptCores-1]
+	data, err := os.ReadFile(filepath.Join(CoresDir("app"), last.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "core 6" || last.Size != 6 || last.File != "core.20260102T030411Z.106" {
+		t.Errorf("last core %+v holds %q", last, data)
+	}
+	entries, _ := os.ReadDir(CoresDir("app"))
+	if len(entries) != 2*keptCores {
+		t.Errorf("%d files in the cores dir, want %d", len(entries), 2*keptCores)
+	}
+
+	if _, err := ListCores("missing"); err == nil {
+		t.Error("listing the cores of a missing container succeeded")
+	}
+}
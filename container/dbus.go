@@ -0,0 +1,332 @@
+package container
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// This file implements just enough of the D-Bus wire protocol to call
+// methods on systemd: SASL EXTERNAL authentication, marshalling of method
+// calls and parsing of replies. Everything is little-endian.
+
+// dbusSystemBus is the default address of the system bus socket.
+const dbusSystemBus = "/run/dbus/system_bus_socket"
+
+// D-Bus message types.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+)
+
+// D-Bus header field codes.
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSignature   = 8
+)
+
+// dbusConn is a connection to a message bus.
+type dbusConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	serial uint32
+}
+
+// dialSystemBus connects and authenticates to the system bus, honouring
+// DBUS_SYSTEM_BUS_ADDRESS when it names a unix socket path.
+func dialSystemBus() (*dbusConn, error) {
+	path := dbusSystemBus
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); strings.HasPrefix(addr, "unix:path=") {
+		path = strings.SplitN(strings.TrimPrefix(addr, "unix:path="), ",", 2)[0]
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+	c := &dbusConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if err := c.auth(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// Every connection must say Hello before calling anything else.
+	if _, err := c.call("org.freedesktop.DBus", "/org/freedesktop/DBus",
+		"org.freedesktop.DBus", "Hello", "", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// auth performs SASL EXTERNAL authentication with our uid.
+func (c *dbusConn) auth() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return fmt.Errorf("failed to authenticate to system bus: %w", err)
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to authenticate to system bus: %w", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("system bus rejected authentication: %s", strings.TrimSpace(line))
+	}
+	if _, err := io.WriteString(c.conn, "BEGIN\r\n"); err != nil {
+		return fmt.Errorf("failed to authenticate to system bus: %w", err)
+	}
+	return nil
+}
+
+// call sends a method call and waits for its reply. body must already be
+// marshalled according to sig. The reply body is returned undecoded.
+func (c *dbusConn) call(dest, path, iface, member, sig string, body []byte) ([]byte, error) {
+	c.serial++
+	serial := c.serial
+
+	var h dbusEncoder
+	h.byte('l')
+	h.byte(dbusMethodCall)
+	h.byte(0) // flags
+	h.byte(1) // protocol version
+	h.uint32(uint32(len(body)))
+	h.uint32(serial)
+	h.array(8, func() {
+		h.field(dbusFieldPath, "o", func() { h.string(path) })
+		h.field(dbusFieldInterface, "s", func() { h.string(iface) })
+		h.field(dbusFieldMember, "s", func() { h.string(member) })
+		h.field(dbusFieldDestination, "s", func() { h.string(dest) })
+		if sig != "" {
+			h.field(dbusFieldSignature, "g", func() { h.signature(sig) })
+		}
+	})
+	h.align(8)
+
+	if _, err := c.conn.Write(append(h.buf, body...)); err != nil {
+		return nil, fmt.Errorf("failed to send %s.%s: %w", iface, member, err)
+	}
+
+	for {
+		msg, err := readDbusMessage(c.r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read reply to %s.%s: %w", iface, member, err)
+		}
+		if msg.replySerial != serial {
+			// signals such as NameAcquired are of no interest to us
+			continue
+		}
+		if msg.typ == dbusError {
+			d := dbusDecoder{buf: msg.body}
+			text := ""
+			if strings.HasPrefix(msg.signature, "s") {
+				text = d.string()
+			}
+			return nil, fmt.Errorf("%s.%s failed: %s: %s", iface, member, msg.errorName, text)
+		}
+		return msg.body, nil
+	}
+}
+
+// dbusMessage is the subset of an incoming message we care about.
+type dbusMessage struct {
+	typ         byte
+	replySerial uint32
+	errorName   string
+	signature   string
+	body        []byte
+}
+
+func readDbusMessage(r io.Reader) (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+	if fixed[0] != 'l' {
+		return nil, fmt.Errorf("unsupported endianness %q", fixed[0])
+	}
+	bodyLen := binary.LittleEndian.Uint32(fixed[4:8])
+	fieldsLen := binary.LittleEndian.Uint32(fixed[12:16])
+	headerLen := 16 + int(fieldsLen)
+	padded := (headerLen + 7) &^ 7
+
+	rest := make([]byte, padded-16+int(bodyLen))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	msg := &dbusMessage{typ: fixed[1], body: rest[padded-16:]}
+	d := dbusDecoder{buf: append(fixed, rest[:padded-16]...), off: 16}
+	for d.off < headerLen {
+		d.align(8)
+		code := d.byte()
+		sig := d.signature()
+		switch sig {
+		case "s", "o":
+			v := d.string()
+			if code == dbusFieldErrorName {
+				msg.errorName = v
+			}
+		case "u":
+			v := d.uint32()
+			if code == dbusFieldReplySerial {
+				msg.replySerial = v
+			}
+		case "g":
+			v := d.signature()
+			if code == dbusFieldSignature {
+				msg.signature = v
+			}
+		default:
+			return nil, fmt.Errorf("unexpected header field type %q", sig)
+		}
+	}
+	return msg, nil
+}
+
+// dbusEncoder marshals values into the D-Bus wire format. Alignment is
+// relative to the start of buf, which must start at a message or body
+// boundary.
+type dbusEncoder struct {
+	buf []byte
+}
+
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *dbusEncoder) byte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+func (e *dbusEncoder) bool(b bool) {
+	var v uint32
+	if b {
+		v = 1
+	}
+	e.uint32(v)
+}
+
+func (e *dbusEncoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *dbusEncoder) uint64(v uint64) {
+	e.align(8)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *dbusEncoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+func (e *dbusEncoder) signature(s string) {
+	e.byte(byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// array writes an array whose elements are produced by fn. elemAlign is the
+// alignment of the element type (8 for structs and dict entries).
+func (e *dbusEncoder) array(elemAlign int, fn func()) {
+	e.uint32(0)
+	lenOff := len(e.buf) - 4
+	e.align(elemAlign)
+	start := len(e.buf)
+	fn()
+	binary.LittleEndian.PutUint32(e.buf[lenOff:], uint32(len(e.buf)-start))
+}
+
+// structure aligns to 8 and writes the struct fields produced by fn.
+func (e *dbusEncoder) structure(fn func()) {
+	e.align(8)
+	fn()
+}
+
+// variant writes the signature of a single complete type followed by the
+// value produced by fn.
+func (e *dbusEncoder) variant(sig string, fn func()) {
+	e.signature(sig)
+	fn()
+}
+
+// field writes a header field: a (byte, variant) struct.
+func (e *dbusEncoder) field(code byte, sig string, fn func()) {
+	e.structure(func() {
+		e.byte(code)
+		e.variant(sig, fn)
+	})
+}
+
+// dbusDecoder reads the handful of basic types found in message headers and
+// error replies.
+type dbusDecoder struct {
+	buf []byte
+	off int
+}
+
+func (d *dbusDecoder) align(n int) {
+	d.off = (d.off + n - 1) &^ (n - 1)
+}
+
+func (d *dbusDecoder) byte() byte {
+	if d.off >= len(d.buf) {
+		return 0
+	}
+	b := d.buf[d.off]
+	d.off++
+	return b
+}
+
+func (d *dbusDecoder) uint32() uint32 {
+	d.align(4)
+	if d.off+4 > len(d.buf) {
+		d.off = len(d.buf)
+		return 0
+	}
+	v := binary.LittleEndian.Uint32(d.buf[d.off:])
+	d.off += 4
+	return v
+}
+
+func (d *dbusDecoder) string() string {
+	n := int(d.uint32())
+	if d.off+n+1 > len(d.buf) {
+		d.off = len(d.buf)
+		return ""
+	}
+	s := string(d.buf[d.off : d.off+n])
+	d.off += n + 1
+	return s
+}
+
+func (d *dbusDecoder) signature() string {
+	n := int(d.byte())
+	if d.off+n+1 > len(d.buf) {
+		d.off = len(d.buf)
+		return ""
+	}
+	s := string(d.buf[d.off : d.off+n])
+	d.off += n + 1
+	return s
+}
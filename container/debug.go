@@ -0,0 +1,183 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// A debug shell joins every namespace of a container except the mount
+// namespace. It runs in a mount namespace of its own whose root is a toolbox
+// directory from the host, with a /proc of the container's PID namespace
+// mounted on it, so the container filesystem is reachable as /proc/1/root
+// even when the image has no shell or tools.
+
+// debugStage is the init stage that sets up the filesystem of a debug
+// shell and executes it.
+const debugStage = "DEBUG"
+
+// debugContainerRoot is where the container's root is seen from a debug
+// shell.
+const debugContainerRoot = "/proc/1/root"
+
+// DebugOptions describes a debug shell.
+type DebugOptions struct {
+	// Toolbox is a root filesystem on the host providing the tools.
+	// Defaults to the host root.
+	Toolbox string
+	// Args is the command to run, /bin/sh by default.
+	Args []string
+	// Tty gives the shell a pseudo terminal attached to ours.
+	Tty bool
+}
+
+// DebugContainer runs a debug shell for a running container with our stdio
+// and returns its exit code. The shell is killed if ctx is cancelled.
+func DebugContainer(ctx context.Context, containerId string, opts DebugOptions) (int, error) {
+	c, err := LoadState(containerId)
+	if err != nil {
+		return -1, err
+	}
+	if !c.Status.running() {
+		return -1, fmt.Errorf("container %s is %w", containerId, ErrNotRunning)
+	}
+	if len(opts.Args) == 0 {
+		opts.Args = []string{"/bin/sh"}
+	}
+	toolbox := "/"
+	if opts.Toolbox != "" {
+		if toolbox, err = filepath.Abs(opts.Toolbox); err != nil {
+			return -1, err
+		}
+		if fi, err := os.Stat(filepath.Join(toolbox, "proc")); err != nil || !fi.IsDir() {
+			return -1, fmt.Errorf("toolbox %s has no /proc directory", toolbox)
+		}
+	}
+
+	nsFiles, nsFlags, err := containerNamespaces(c.InitProcessPiD, unix.CLONE_NEWNS)
+	if err != nil {
+		return -1, err
+	}
+	defer closeFiles(nsFiles)
+	var cgroupDir *os.File
+	if c.CgroupPath != "" {
+		if cgroupDir, err = os.Open(c.CgroupPath); err != nil {
+			return -1, fmt.Errorf("failed to open cgroup %s: %w", c.CgroupPath, err)
+		}
+		defer cgroupDir.Close()
+	}
+	var master, slave *os.File
+	if opts.Tty {
+		if master, slave, err = openPty(); err != nil {
+			return -1, err
+		}
+		defer master.Close()
+		defer slave.Close()
+	}
+
+	args := append([]string{"init", debugStage, toolbox}, opts.Args...)
+	cmd, err := inNamespaces(nsFiles, nsFlags, func() (*exec.Cmd, error) {
+		cmd := exec.Command("/proc/self/exe", args...)
+		cmd.Env = []string{
+			"PATH=" + defaultExecPath,
+			"HOME=/root",
+			"PS1=debug(" + containerId + ")# ",
+			"CONTAINER_ROOT=" + debugContainerRoot,
+		}
+		if term := os.Getenv("TERM"); term != "" {
+			cmd.Env = append(cmd.Env, "TERM="+term)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: unix.CLONE_NEWNS}
+		if cgroupDir != nil {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+		}
+		if slave != nil {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+			cmd.SysProcAttr.Setsid = true
+			cmd.SysProcAttr.Setctty = true
+			cmd.SysProcAttr.Ctty = 0
+		} else {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start debug shell: %w", err)
+		}
+		return cmd, nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	stopKill := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	defer stopKill()
+
+	var detachPty func()
+	if master != nil {
+		slave.Close()
+		detachPty = attachPty(master)
+	}
+	waitErr := cmd.Wait()
+	if detachPty != nil {
+		detachPty()
+	}
+	return exitCode(waitErr)
+}
+
+// runDebugStage prepares the mount namespace of a debug shell, rooted at
+// toolbox, and executes argv.
+func runDebugStage(toolbox string, argv []string) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+	if toolbox != "/" {
+		if err := unix.Mount(toolbox, toolbox, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind toolbox %s: %w", toolbox, err)
+		}
+		// The host /dev, so the tools have a terminal and null device.
+		if fi, err := os.Stat(filepath.Join(toolbox, "dev")); err == nil && fi.IsDir() {
+			if err := unix.Mount("/dev", filepath.Join(toolbox, "dev"), "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+				return fmt.Errorf("failed to bind /dev into toolbox: %w", err)
+			}
+		}
+	}
+	// We are in the container's PID namespace, so this /proc shows its
+	// processes and /proc/1/root is its filesystem.
+	if err := unix.Mount("proc", filepath.Join(toolbox, "proc"), "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+	if toolbox != "/" {
+		if err := unix.Chroot(toolbox); err != nil {
+			return fmt.Errorf("failed to enter toolbox: %w", err)
+		}
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+
+	path, err := lookExecPath(argv[0], os.Getenv("PATH"))
+	if err != nil {
+		return err
+	}
+	if err := unix.Exec(path, argv, os.Environ()); err != nil {
+		return startError(argv[0], err)
+	}
+	return nil
+}
+
+// debugStageExitCode is the exit code of a debug stage that failed to run
+// its command, following the shell conventions.
+func debugStageExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrCommandNotFound):
+		return 127
+	case errors.Is(err, ErrNotExecutable):
+		return 126
+	}
+	return 125
+}
@@ -0,0 +1,48 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDebugContainerValidation(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	ctx := context.Background()
+
+	if _, err := DebugContainer(ctx, "missing", DebugOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := saveState(&Container{Id: "stopped", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DebugContainer(ctx, "stopped", DebugOptions{}); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning, got %v", err)
+	}
+	if err := saveState(&Container{Id: "running", Status: Running, InitProcessPiD: os.Getpid()}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := DebugContainer(ctx, "running", DebugOptions{Toolbox: t.TempDir()})
+	if err == nil || !strings.Contains(err.Error(), "no /proc") {
+		t.Fatalf("expected a toolbox without /proc to be rejected, got %v", err)
+	}
+}
+
+func TestDebugStageExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{startError("sh", os.ErrNotExist), 127},
+		{startError("sh", os.ErrPermission), 126},
+		{errors.New("mount failed"), 125},
+	} {
+		if got := debugStageExitCode(tc.err); got != tc.want {
+			t.Errorf("debugStageExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
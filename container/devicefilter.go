@@ -0,0 +1,298 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Cgroup v2 has no devices.allow/devices.deny files. Device access is instead
+// decided by a BPF_PROG_TYPE_CGROUP_DEVICE program attached to the cgroup,
+// which the kernel runs on every open/mknod of a device node. The program
+// receives a struct bpf_cgroup_dev_ctx:
+//
+//	struct bpf_cgroup_dev_ctx {
+//		__u32 access_type; /* (access << 16) | type */
+//		__u32 major;
+//		__u32 minor;
+//	};
+//
+// and returns 1 to allow the access or 0 to deny it.
+
+// wildcardDevice matches any major or minor number in a device rule.
+const wildcardDevice = -1
+
+func int64Ptr(i int64) *int64 { return &i }
+
+// defaultDeviceRules deny everything and then allow the devices every
+// container gets in /dev. Rules from the spec are appended after these, so
+// they can extend or revoke them.
+var defaultDeviceRules = []specs.LinuxDeviceCgroup{
+	{Allow: false, Access: "rwm"},
+	{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(3), Access: "rwm"},                // /dev/null
+	{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(5), Access: "rwm"},                // /dev/zero
+	{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(7), Access: "rwm"},                // /dev/full
+	{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(8), Access: "rwm"},                // /dev/random
+	{Allow: true, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(9), Access: "rwm"},                // /dev/urandom
+	{Allow: true, Type: "c", Major: int64Ptr(5), Minor: int64Ptr(0), Access: "rwm"},                // /dev/tty
+	{Allow: true, Type: "c", Major: int64Ptr(5), Minor: int64Ptr(1), Access: "rwm"},                // /dev/console
+	{Allow: true, Type: "c", Major: int64Ptr(5), Minor: int64Ptr(2), Access: "rwm"},                // /dev/ptmx
+	{Allow: true, Type: "c", Major: int64Ptr(136), Minor: int64Ptr(wildcardDevice), Access: "rwm"}, // /dev/pts/*
+}
+
+// bpfInsn mirrors struct bpf_insn.
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst in the low nibble, src in the high nibble
+	off  int16
+	imm  int32
+}
+
+// eBPF opcodes used by the device filter.
+const (
+	bpfLdxMemW  = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_W
+	bpfAndK     = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	bpfRshK     = unix.BPF_ALU | unix.BPF_RSH | unix.BPF_K
+	bpfMovK     = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_K
+	bpfMovX     = unix.BPF_ALU | unix.BPF_MOV | unix.BPF_X
+	bpfJneK     = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_K
+	bpfJneX     = unix.BPF_JMP | unix.BPF_JNE | unix.BPF_X
+	bpfExit     = unix.BPF_JMP | unix.BPF_EXIT
+	bpfJumpNext = -1 // placeholder patched to the start of the next rule
+)
+
+func insn(code uint8, dst, src uint8, off int16, imm int32) bpfInsn {
+	return bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm}
+}
+
+// compileDeviceFilter turns device cgroup rules into an eBPF program. Rules
+// are evaluated last to first and the first match decides, which gives the
+// OCI semantics of later rules overriding earlier ones. An access no rule
+// matches is denied.
+func compileDeviceFilter(rules []specs.LinuxDeviceCgroup) ([]bpfInsn, error) {
+	// r2 = type, r3 = access, r4 = major, r5 = minor
+	prog := []bpfInsn{
+		insn(bpfLdxMemW, 2, 1, 0, 0),
+		insn(bpfAndK, 2, 0, 0, 0xffff),
+		insn(bpfLdxMemW, 3, 1, 0, 0),
+		insn(bpfRshK, 3, 0, 0, 16),
+		insn(bpfLdxMemW, 4, 1, 4, 0),
+		insn(bpfLdxMemW, 5, 1, 8, 0),
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		block, err := compileDeviceRule(rules[i])
+		if err != nil {
+			return nil, err
+		}
+		// Point every placeholder jump past the end of this block.
+		conditional := false
+		for j := range block {
+			if block[j].off == bpfJumpNext {
+				block[j].off = int16(len(block) - j - 1)
+				conditional = true
+			}
+		}
+		prog = append(prog, block...)
+		// A rule matching every device ends the program; the verifier
+		// rejects anything after it as unreachable.
+		if !conditional {
+			return prog, nil
+		}
+	}
+
+	return append(prog,
+		insn(bpfMovK, 0, 0, 0, 0),
+		insn(bpfExit, 0, 0, 0, 0),
+	), nil
+}
+
+// compileDeviceRule emits the checks for a single rule followed by the
+// verdict. Failed checks jump to the next rule.
+func compileDeviceRule(r specs.LinuxDeviceCgroup) ([]bpfInsn, error) {
+	var block []bpfInsn
+
+	switch r.Type {
+	case "", "a":
+	case "c":
+		block = append(block, insn(bpfJneK, 2, 0, bpfJumpNext, unix.BPF_DEVCG_DEV_CHAR))
+	case "b":
+		block = append(block, insn(bpfJneK, 2, 0, bpfJumpNext, unix.BPF_DEVCG_DEV_BLOCK))
+	default:
+		return nil, fmt.Errorf("invalid device rule type %q", r.Type)
+	}
+
+	access, err := deviceAccessMask(r.Access)
+	if err != nil {
+		return nil, err
+	}
+	if access != unix.BPF_DEVCG_ACC_MKNOD|unix.BPF_DEVCG_ACC_READ|unix.BPF_DEVCG_ACC_WRITE {
+		// Match only when every requested access bit is covered by the rule.
+		block = append(block,
+			insn(bpfMovX, 1, 3, 0, 0),
+			insn(bpfAndK, 1, 0, 0, access),
+			insn(bpfJneX, 1, 3, bpfJumpNext, 0),
+		)
+	}
+
+	if r.Major != nil && *r.Major != wildcardDevice {
+		block = append(block, insn(bpfJneK, 4, 0, bpfJumpNext, int32(*r.Major)))
+	}
+	if r.Minor != nil && *r.Minor != wildcardDevice {
+		block = append(block, insn(bpfJneK, 5, 0, bpfJumpNext, int32(*r.Minor)))
+	}
+
+	verdict := int32(0)
+	if r.Allow {
+		verdict = 1
+	}
+	return append(block,
+		insn(bpfMovK, 0, 0, 0, verdict),
+		insn(bpfExit, 0, 0, 0, 0),
+	), nil
+}
+
+// deviceAccessMask converts an access string such as "rw" to BPF_DEVCG_ACC_*
+// bits. An empty string means all accesses.
+func deviceAccessMask(access string) (int32, error) {
+	if access == "" {
+		access = "rwm"
+	}
+	var mask int32
+	for _, c := range access {
+		switch c {
+		case 'r':
+			mask |= unix.BPF_DEVCG_ACC_READ
+		case 'w':
+			mask |= unix.BPF_DEVCG_ACC_WRITE
+		case 'm':
+			mask |= unix.BPF_DEVCG_ACC_MKNOD
+		default:
+			return 0, fmt.Errorf("invalid device access %q", access)
+		}
+	}
+	return mask, nil
+}
+
+// bpfProgLoadAttr is the BPF_PROG_LOAD member of union bpf_attr.
+type bpfProgLoadAttr struct {
+	progType           uint32
+	insnCnt            uint32
+	insns              uint64
+	license            uint64
+	logLevel           uint32
+	logSize            uint32
+	logBuf             uint64
+	kernVersion        uint32
+	progFlags          uint32
+	progName           [16]byte
+	progIfindex        uint32
+	expectedAttachType uint32
+}
+
+// bpfProgAttachAttr is the BPF_PROG_ATTACH member of union bpf_attr.
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (uintptr, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return fd, nil
+}
+
+// loadBPFProgram loads prog into the kernel under license and returns its
+// fd. The error carries the log of the verifier.
+func loadBPFProgram(progType, attachType uint32, name, license string, prog []bpfInsn) (int, error) {
+	code := make([]byte, 0, len(prog)*8)
+	for _, in := range prog {
+		code = append(code, in.code, in.regs)
+		code = binary.NativeEndian.AppendUint16(code, uint16(in.off))
+		code = binary.NativeEndian.AppendUint32(code, uint32(in.imm))
+	}
+	licenseBuf := append([]byte(license), 0)
+	logBuf := make([]byte, 64*1024)
+
+	attr := bpfProgLoadAttr{
+		progType:           progType,
+		insnCnt:            uint32(len(prog)),
+		insns:              uint64(uintptr(unsafe.Pointer(&code[0]))),
+		license:            uint64(uintptr(unsafe.Pointer(&licenseBuf[0]))),
+		logLevel:           1,
+		logSize:            uint32(len(logBuf)),
+		logBuf:             uint64(uintptr(unsafe.Pointer(&logBuf[0]))),
+		expectedAttachType: attachType,
+	}
+	copy(attr.progName[:], name)
+
+	fd, err := bpf(unix.BPF_PROG_LOAD, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(code)
+	runtime.KeepAlive(licenseBuf)
+	if err != nil {
+		return -1, fmt.Errorf("%w: %s", err, cString(logBuf))
+	}
+	return int(fd), nil
+}
+
+// loadDeviceFilter loads the program into the kernel and returns its fd.
+func loadDeviceFilter(prog []bpfInsn) (int, error) {
+	fd, err := loadBPFProgram(unix.BPF_PROG_TYPE_CGROUP_DEVICE, unix.BPF_CGROUP_DEVICE, "containish_dev", "Apache", prog)
+	if err != nil {
+		return -1, fmt.Errorf("failed to load device filter: %w", err)
+	}
+	return fd, nil
+}
+
+// applyDevices compiles the default rules plus the spec's device rules and
+// attaches the resulting program to the cgroup at path.
+func applyDevices(path string, rules []specs.LinuxDeviceCgroup) error {
+	all := append(append([]specs.LinuxDeviceCgroup{}, defaultDeviceRules...), rules...)
+	prog, err := compileDeviceFilter(all)
+	if err != nil {
+		return err
+	}
+
+	progFd, err := loadDeviceFilter(prog)
+	if err != nil {
+		return err
+	}
+	// The attachment keeps the program alive once our fd is closed.
+	defer unix.Close(progFd)
+
+	dir, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open cgroup %s: %w", path, err)
+	}
+	defer dir.Close()
+
+	attr := bpfProgAttachAttr{
+		targetFd:    uint32(dir.Fd()),
+		attachBpfFd: uint32(progFd),
+		attachType:  unix.BPF_CGROUP_DEVICE,
+		attachFlags: unix.BPF_F_ALLOW_MULTI,
+	}
+	if _, err := bpf(unix.BPF_PROG_ATTACH, unsafe.Pointer(&attr), unsafe.Sizeof(attr)); err != nil {
+		return fmt.Errorf("failed to attach device filter to %s: %w", path, err)
+	}
+	return nil
+}
+
+// cString returns the NUL-terminated string at the start of b.
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,93 @@
+package container
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// runDeviceFilter interprets the small eBPF subset emitted by
+// compileDeviceFilter against a single device access.
+func runDeviceFilter(t *testing.T, prog []bpfInsn, devType, access, major, minor uint32) bool {
+	t.Helper()
+	ctx := [3]uint32{access<<16 | devType, major, minor}
+	var r [11]uint64
+
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		dst, src := in.regs&0xf, in.regs>>4
+		switch in.code {
+		case bpfLdxMemW:
+			r[dst] = uint64(ctx[in.off/4])
+		case bpfAndK:
+			r[dst] = uint64(uint32(r[dst]) & uint32(in.imm))
+		case bpfRshK:
+			r[dst] = uint64(uint32(r[dst]) >> uint32(in.imm))
+		case bpfMovK:
+			r[dst] = uint64(uint32(in.imm))
+		case bpfMovX:
+			r[dst] = uint64(uint32(r[src]))
+		case bpfJneK:
+			if r[dst] != uint64(int64(in.imm)) {
+				pc += int(in.off)
+			}
+		case bpfJneX:
+			if r[dst] != r[src] {
+				pc += int(in.off)
+			}
+		case bpfExit:
+			return r[0] == 1
+		default:
+			t.Fatalf("unexpected opcode %#x at %d", in.code, pc)
+		}
+	}
+	t.Fatalf("program fell off the end")
+	return false
+}
+
+func TestCompileDeviceFilter(t *testing.T) {
+	rules := append(append([]specs.LinuxDeviceCgroup{}, defaultDeviceRules...),
+		specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: int64Ptr(10), Minor: int64Ptr(200), Access: "rw"},
+		specs.LinuxDeviceCgroup{Allow: false, Type: "c", Major: int64Ptr(1), Minor: int64Ptr(9)},
+	)
+	prog, err := compileDeviceFilter(rules)
+	if err != nil {
+		t.Fatalf("compileDeviceFilter failed: %v", err)
+	}
+
+	const (
+		char  = unix.BPF_DEVCG_DEV_CHAR
+		block = unix.BPF_DEVCG_DEV_BLOCK
+		read  = unix.BPF_DEVCG_ACC_READ
+		write = unix.BPF_DEVCG_ACC_WRITE
+		mknod = unix.BPF_DEVCG_ACC_MKNOD
+	)
+	cases := []struct {
+		name                          string
+		devType, access, major, minor uint32
+		allow                         bool
+	}{
+		{"null", char, read | write, 1, 3, true},
+		{"pts wildcard", char, read, 136, 7, true},
+		{"tun read/write", char, read | write, 10, 200, true},
+		{"tun mknod", char, mknod, 10, 200, false},
+		{"urandom revoked", char, read, 1, 9, false},
+		{"host disk", block, read, 8, 0, false},
+		{"block with char numbers", block, read, 1, 3, false},
+	}
+	for _, c := range cases {
+		if got := runDeviceFilter(t, prog, c.devType, c.access, c.major, c.minor); got != c.allow {
+			t.Errorf("%s: allowed=%v, want %v", c.name, got, c.allow)
+		}
+	}
+}
+
+func TestCompileDeviceFilterInvalid(t *testing.T) {
+	if _, err := compileDeviceFilter([]specs.LinuxDeviceCgroup{{Type: "x"}}); err == nil {
+		t.Fatalf("expected error for invalid type")
+	}
+	if _, err := compileDeviceFilter([]specs.LinuxDeviceCgroup{{Access: "rx"}}); err == nil {
+		t.Fatalf("expected error for invalid access")
+	}
+}
@@ -0,0 +1,231 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// createDevices creates the device nodes listed in linux.devices under the
+// container rootfs. It runs in the child stage before pivot_root, so paths
+// are resolved in rootfs.
+func createDevices(rootfs string, devices []specs.LinuxDevice) error {
+	root, err := openRootDir(rootfs)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	for _, d := range devices {
+		if err := createDevice(root, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createDevice creates a single device node with the requested mode and
+// ownership in root, replacing whatever already exists at that path.
+func createDevice(root int, d specs.LinuxDevice) error {
+	mode, err := deviceMode(d)
+	if err != nil {
+		return err
+	}
+	parent, name, err := replaceDevice(root, d.Path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+
+	dev := int(unix.Mkdev(uint32(d.Major), uint32(d.Minor)))
+	if err := unix.Mknodat(parent, name, mode, dev); err != nil {
+		return fmt.Errorf("failed to create device %s: %w", d.Path, err)
+	}
+	// mknod is subject to the umask, so set the permissions explicitly.
+	if err := unix.Fchmodat(parent, name, mode&0o7777, 0); err != nil {
+		return fmt.Errorf("failed to chmod device %s: %w", d.Path, err)
+	}
+
+	uid, gid := -1, -1
+	if d.UID != nil {
+		uid = int(*d.UID)
+	}
+	if d.GID != nil {
+		gid = int(*d.GID)
+	}
+	if err := unix.Fchownat(parent, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return fmt.Errorf("failed to chown device %s: %w", d.Path, err)
+	}
+	return nil
+}
+
+// bindDevices bind mounts the host nodes at the paths listed in
+// linux.devices under rootfs. Device nodes cannot be created inside a user
+// namespace, so user namespaced containers get the host's instead.
+func bindDevices(rootfs string, devices []specs.LinuxDevice) error {
+	root, err := openRootDir(rootfs)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	for _, d := range devices {
+		if err := bindDevice(root, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindDevice bind mounts the host node d.Path at the same path in root.
+func bindDevice(root int, d specs.LinuxDevice) error {
+	parent, name, err := replaceDevice(root, d.Path)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	fd, err := unix.Openat(parent, name, unix.O_RDONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create mount point for device %s: %w", d.Path, err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Mount(d.Path, fdPath(fd), "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind device %s: %w", d.Path, err)
+	}
+	return nil
+}
+
+// replaceDevice removes what is at the device path p of root, returning
+// its parent directory, created as needed, and its name there.
+func replaceDevice(root int, p string) (int, string, error) {
+	path, err := devicePath(p)
+	if err != nil {
+		return -1, "", err
+	}
+	parent, err := mkdirAllInRoot(root, filepath.Dir(path), 0o755)
+	if err != nil {
+		return -1, "", fmt.Errorf("failed to create parent dir for device %s: %w", p, err)
+	}
+	name := filepath.Base(path)
+	err = unix.Unlinkat(parent, name, 0)
+	if errors.Is(err, unix.EISDIR) {
+		err = unix.Unlinkat(parent, name, unix.AT_REMOVEDIR)
+	}
+	if err != nil && !errors.Is(err, unix.ENOENT) {
+		unix.Close(parent)
+		return -1, "", fmt.Errorf("failed to remove existing %s: %w", p, err)
+	}
+	return parent, name, nil
+}
+
+// devicePath returns the clean path of a spec device, which must be an
+// absolute path below /dev.
+func devicePath(p string) (string, error) {
+	clean := filepath.Clean(p)
+	if !filepath.IsAbs(p) || !strings.HasPrefix(clean, "/dev/") {
+		return "", fmt.Errorf("invalid device path %q: must be an absolute path under /dev", p)
+	}
+	return clean, nil
+}
+
+// deviceMode builds the mknod mode (file type plus permissions) for d.
+func deviceMode(d specs.LinuxDevice) (uint32, error) {
+	perm := uint32(0o666)
+	if d.FileMode != nil {
+		perm = uint32(d.FileMode.Perm())
+	}
+
+	switch d.Type {
+	case "c", "u":
+		return unix.S_IFCHR | perm, nil
+	case "b":
+		return unix.S_IFBLK | perm, nil
+	case "p":
+		return unix.S_IFIFO | perm, nil
+	default:
+		return 0, fmt.Errorf("invalid type %q for device %s", d.Type, d.Path)
+	}
+}
+
+// HostDevice is a device node of the host passed through to the container
+// at the same path, see ParseHostDevice.
+type HostDevice struct {
+	Path string `json:"path"`
+	// Permissions are the device cgroup access, a combination of r, w
+	// and m, rwm by default.
+	Permissions string `json:"permissions,omitempty"`
+}
+
+// ParseHostDevice parses a --device value naming a host device,
+// <path>[:<permissions>] such as /dev/ttyUSB0:rw.
+func ParseHostDevice(value string) (HostDevice, error) {
+	path, perm, _ := strings.Cut(value, ":")
+	if _, err := devicePath(path); err != nil {
+		return HostDevice{}, err
+	}
+	if perm != "" && (strings.Trim(perm, "rwm") != "" || len(perm) > 3) {
+		return HostDevice{}, fmt.Errorf("invalid device permissions %q: expected a combination of r, w and m", perm)
+	}
+	return HostDevice{Path: filepath.Clean(path), Permissions: perm}, nil
+}
+
+// applyHostDevices adds the host devices to spec, as CDI device nodes are.
+func applyHostDevices(spec *specs.Spec, devices []HostDevice) error {
+	var edits cdiContainerEdits
+	for _, d := range devices {
+		edits.DeviceNodes = append(edits.DeviceNodes, cdiDeviceNode{Path: d.Path, Permissions: d.Permissions})
+	}
+	return applyContainerEdits(spec, []cdiContainerEdits{edits})
+}
+
+// hostDeviceSkipped are the entries of the host /dev a privileged container
+// doesn't get, as it has its own.
+var hostDeviceSkipped = map[string]bool{"pts": true, "shm": true, "mqueue": true, "fd": true, "console": true}
+
+// hostDevices returns the device nodes under dir, the host /dev.
+func hostDevices(dir string) ([]specs.LinuxDevice, error) {
+	var devices []specs.LinuxDevice
+	err := filepath.WalkDir(dir, func(path string, e os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && hostDeviceSkipped[e.Name()] && filepath.Dir(path) == dir {
+			if e.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if e.Type()&(os.ModeDevice|os.ModeCharDevice) == 0 {
+			return nil
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		d := specs.LinuxDevice{
+			Path:  filepath.Join("/dev", strings.TrimPrefix(path, dir)),
+			Type:  "b",
+			Major: int64(unix.Major(uint64(st.Rdev))),
+			Minor: int64(unix.Minor(uint64(st.Rdev))),
+			UID:   &st.Uid,
+			GID:   &st.Gid,
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFCHR {
+			d.Type = "c"
+		}
+		mode := os.FileMode(st.Mode & 0o777)
+		d.FileMode = &mode
+		devices = append(devices, d)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the host devices: %w", err)
+	}
+	return devices, nil
+}
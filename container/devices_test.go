@@ -0,0 +1,115 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestDevicePath(t *testing.T) {
+	got, err := devicePath("/dev/net/../net/tun")
+	if err != nil || got != "/dev/net/tun" {
+		t.Fatalf("devicePath = %q, %v", got, err)
+	}
+
+	for _, p := range []string{"dev/fuse", "/etc/passwd", "/dev/../etc/shadow", "/dev"} {
+		if _, err := devicePath(p); err == nil {
+			t.Errorf("expected error for %q", p)
+		}
+	}
+}
+
+func TestDeviceMode(t *testing.T) {
+	mode := os.FileMode(0o600)
+	got, err := deviceMode(specs.LinuxDevice{Path: "/dev/fuse", Type: "c", FileMode: &mode})
+	if err != nil {
+		t.Fatalf("deviceMode failed: %v", err)
+	}
+	if got != unix.S_IFCHR|0o600 {
+		t.Fatalf("unexpected mode %o", got)
+	}
+
+	if _, err := deviceMode(specs.LinuxDevice{Path: "/dev/x", Type: "z"}); err == nil {
+		t.Fatalf("expected error for invalid type")
+	}
+}
+
+func TestCreateDevicesFifo(t *testing.T) {
+	rootfs := t.TempDir()
+
+	// FIFOs can be created without privileges, which lets us exercise the
+	// whole path including parent directory creation.
+	devices := []specs.LinuxDevice{{Path: "/dev/pipes/p0", Type: "p"}}
+	if err := createDevices(rootfs, devices); err != nil {
+		t.Fatalf("createDevices failed: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(rootfs, "dev/pipes/p0"))
+	if err != nil {
+		t.Fatalf("device not created: %v", err)
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 || fi.Mode().Perm() != 0o666 {
+		t.Fatalf("unexpected mode %v", fi.Mode())
+	}
+
+	// A /dev of the image linking out of it is followed within the
+	// rootfs, and an existing node at the path is replaced, not followed.
+	host := t.TempDir()
+	writeFile(t, filepath.Join(host, "p1"), "host", 0o644)
+	if err := os.RemoveAll(filepath.Join(rootfs, "dev")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(rootfs, "dev")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, host), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(host, "p1"), filepath.Join(rootfs, host, "p1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := createDevices(rootfs, []specs.LinuxDevice{{Path: "/dev/p1", Type: "p"}}); err != nil {
+		t.Fatalf("createDevices failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(host, "p1")); err != nil || string(data) != "host" {
+		t.Fatalf("createDevices touched the host: %q, %v", data, err)
+	}
+	fi, err = os.Lstat(filepath.Join(rootfs, host, "p1"))
+	if err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+		t.Fatalf("device not created in the rootfs: %v, %v", fi, err)
+	}
+}
+
+func TestHostDevices(t *testing.T) {
+	d, err := ParseHostDevice("/dev/null:rw")
+	if err != nil || d != (HostDevice{Path: "/dev/null", Permissions: "rw"}) {
+		t.Fatalf("ParseHostDevice = %+v, %v", d, err)
+	}
+	for _, v := range []string{"/etc/passwd", "dev/null", "/dev/null:rx", "/dev/null:rwmr"} {
+		if _, err := ParseHostDevice(v); err == nil {
+			t.Errorf("expected an error for %q", v)
+		}
+	}
+
+	origCgroup := cgroupRoot
+	cgroupRoot = t.TempDir()
+	defer func() { cgroupRoot = origCgroup }()
+	writeFile(t, filepath.Join(cgroupRoot, "cgroup.controllers"), "", 0o644)
+	spec := &specs.Spec{}
+	if err := applyHostDevices(spec, []HostDevice{d, {Path: "/dev/zero"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Linux.Devices) != 2 || spec.Linux.Devices[1] != (specs.LinuxDevice{Path: "/dev/zero", Type: "c", Major: 1, Minor: 5}) {
+		t.Fatalf("devices = %+v", spec.Linux.Devices)
+	}
+	rules := spec.Linux.Resources.Devices
+	if len(rules) != 2 || rules[0].Access != "rw" || rules[1].Access != "rwm" {
+		t.Errorf("device rules = %+v, want the permissions given", rules)
+	}
+	if err := applyHostDevices(&specs.Spec{}, []HostDevice{{Path: "/dev/missing"}}); err == nil {
+		t.Error("expected an error for a missing device")
+	}
+}
@@ -0,0 +1,218 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A minimal DHCPv4 client (RFC 2131): DISCOVER, OFFER, REQUEST, ACK on a
+// freshly created interface. It runs inside the container network namespace
+// and asks the server to broadcast its replies, since the interface has no
+// address yet. Leases are acquired once and not renewed.
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+
+	dhcpOptSubnetMask  = 1
+	dhcpOptRouter      = 3
+	dhcpOptDNS         = 6
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptParamList   = 55
+	dhcpOptEnd         = 255
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+// dhcpAttempts is how many times each request is sent before giving up.
+var dhcpAttempts = 4
+
+// dhcpLease is the configuration handed out by a DHCP server.
+type dhcpLease struct {
+	Address   *net.IPNet
+	Gateway   net.IP
+	DNS       []net.IP
+	ServerID  net.IP
+	LeaseTime time.Duration
+}
+
+// dhcpMessage is a decoded DHCP reply.
+type dhcpMessage struct {
+	xid     uint32
+	msgType byte
+	yiaddr  net.IP
+	options map[byte][]byte
+}
+
+// dhcpAcquire obtains a lease for the named interface, which must already
+// be up in the current network namespace.
+func dhcpAcquire(ifname string, mac net.HardwareAddr, timeout time.Duration) (*dhcpLease, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dhcp socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	for _, opt := range []int{unix.SO_REUSEADDR, unix.SO_BROADCAST} {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, 1); err != nil {
+			return nil, fmt.Errorf("failed to configure dhcp socket: %w", err)
+		}
+	}
+	if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifname); err != nil {
+		return nil, fmt.Errorf("failed to bind dhcp socket to %s: %w", ifname, err)
+	}
+	tv := unix.NsecToTimeval(int64(timeout / time.Duration(dhcpAttempts)))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, fmt.Errorf("failed to configure dhcp socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrInet4{Port: dhcpClientPort}); err != nil {
+		return nil, fmt.Errorf("failed to bind dhcp socket: %w", err)
+	}
+
+	var xidBytes [4]byte
+	if _, err := rand.Read(xidBytes[:]); err != nil {
+		return nil, err
+	}
+	xid := binary.BigEndian.Uint32(xidBytes[:])
+
+	offer, err := dhcpExchange(fd, xid, dhcpOffer, buildDHCPPacket(xid, mac, dhcpDiscover, nil, nil))
+	if err != nil {
+		return nil, fmt.Errorf("no DHCP offer on %s: %w", ifname, err)
+	}
+	serverID := net.IP(offer.options[dhcpOptServerID])
+
+	ack, err := dhcpExchange(fd, xid, dhcpAck, buildDHCPPacket(xid, mac, dhcpRequest, offer.yiaddr, serverID))
+	if err != nil {
+		return nil, fmt.Errorf("DHCP request on %s failed: %w", ifname, err)
+	}
+	return leaseFromAck(ack)
+}
+
+// dhcpExchange broadcasts pkt and waits for a reply of type want, resending
+// on timeouts.
+func dhcpExchange(fd int, xid uint32, want byte, pkt []byte) (*dhcpMessage, error) {
+	dst := &unix.SockaddrInet4{Port: dhcpServerPort, Addr: [4]byte{255, 255, 255, 255}}
+	buf := make([]byte, 1500)
+
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		if err := unix.Sendto(fd, pkt, 0, dst); err != nil {
+			return nil, fmt.Errorf("failed to send: %w", err)
+		}
+		for {
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				break // timed out, resend
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to receive: %w", err)
+			}
+			msg, err := parseDHCPPacket(buf[:n])
+			if err != nil || msg.xid != xid {
+				continue
+			}
+			if msg.msgType == dhcpNak {
+				return nil, fmt.Errorf("server refused the request")
+			}
+			if msg.msgType == want {
+				return msg, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("timed out")
+}
+
+// buildDHCPPacket encodes a BOOTREQUEST. requested and server are only set
+// in DHCPREQUEST messages.
+func buildDHCPPacket(xid uint32, mac net.HardwareAddr, msgType byte, requested, server net.IP) []byte {
+	p := make([]byte, 240)
+	p[0] = 1 // BOOTREQUEST
+	p[1] = 1 // ethernet
+	p[2] = 6 // hardware address length
+	binary.BigEndian.PutUint32(p[4:], xid)
+	binary.BigEndian.PutUint16(p[10:], 0x8000) // ask for broadcast replies
+	copy(p[28:44], mac)
+	copy(p[236:240], dhcpMagic)
+
+	p = append(p, dhcpOptMessageType, 1, msgType)
+	if requested != nil {
+		p = append(p, dhcpOptRequestedIP, 4)
+		p = append(p, requested.To4()...)
+	}
+	if server != nil {
+		p = append(p, dhcpOptServerID, 4)
+		p = append(p, server.To4()...)
+	}
+	p = append(p, dhcpOptParamList, 4, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS, dhcpOptLeaseTime)
+	return append(p, dhcpOptEnd)
+}
+
+// parseDHCPPacket decodes a BOOTREPLY and its options.
+func parseDHCPPacket(p []byte) (*dhcpMessage, error) {
+	if len(p) < 240 || p[0] != 2 || string(p[236:240]) != string(dhcpMagic) {
+		return nil, fmt.Errorf("not a DHCP reply")
+	}
+	msg := &dhcpMessage{
+		xid:     binary.BigEndian.Uint32(p[4:8]),
+		yiaddr:  net.IP(append([]byte{}, p[16:20]...)),
+		options: map[byte][]byte{},
+	}
+
+	opts := p[240:]
+	for len(opts) > 0 {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == 0 { // pad
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || len(opts) < 2+int(opts[1]) {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		msg.options[code] = opts[2 : 2+int(opts[1])]
+		opts = opts[2+int(opts[1]):]
+	}
+
+	if t := msg.options[dhcpOptMessageType]; len(t) == 1 {
+		msg.msgType = t[0]
+	}
+	return msg, nil
+}
+
+// leaseFromAck extracts the interface configuration from a DHCPACK.
+func leaseFromAck(ack *dhcpMessage) (*dhcpLease, error) {
+	mask := ack.options[dhcpOptSubnetMask]
+	if len(mask) != 4 {
+		return nil, fmt.Errorf("DHCP server did not provide a subnet mask")
+	}
+	lease := &dhcpLease{
+		Address:  &net.IPNet{IP: ack.yiaddr.To4(), Mask: net.IPMask(mask)},
+		ServerID: net.IP(ack.options[dhcpOptServerID]),
+	}
+	if r := ack.options[dhcpOptRouter]; len(r) >= 4 {
+		lease.Gateway = net.IP(r[:4])
+	}
+	for d := ack.options[dhcpOptDNS]; len(d) >= 4; d = d[4:] {
+		lease.DNS = append(lease.DNS, net.IP(d[:4]))
+	}
+	if t := ack.options[dhcpOptLeaseTime]; len(t) == 4 {
+		lease.LeaseTime = time.Duration(binary.BigEndian.Uint32(t)) * time.Second
+	}
+	return lease, nil
+}
@@ -0,0 +1,82 @@
+package container
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// dhcpReply turns a request built by buildDHCPPacket into a server reply
+// carrying the given options.
+func dhcpReply(req []byte, yiaddr net.IP, opts ...[]byte) []byte {
+	p := append([]byte{}, req[:240]...)
+	p[0] = 2 // BOOTREPLY
+	copy(p[16:20], yiaddr.To4())
+	for _, o := range opts {
+		p = append(p, o...)
+	}
+	return append(p, dhcpOptEnd)
+}
+
+func TestDHCPPacketRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	req := buildDHCPPacket(0xdeadbeef, mac, dhcpRequest, net.IPv4(192, 168, 1, 50), net.IPv4(192, 168, 1, 1))
+	if binary.BigEndian.Uint32(req[4:8]) != 0xdeadbeef {
+		t.Fatalf("xid not encoded")
+	}
+	if net.HardwareAddr(req[28:34]).String() != mac.String() {
+		t.Fatalf("chaddr not encoded")
+	}
+	if _, err := parseDHCPPacket(req); err == nil {
+		t.Fatalf("a BOOTREQUEST must not parse as a reply")
+	}
+
+	reply := dhcpReply(req, net.IPv4(192, 168, 1, 50),
+		[]byte{dhcpOptMessageType, 1, dhcpAck},
+		[]byte{dhcpOptSubnetMask, 4, 255, 255, 255, 0},
+		[]byte{dhcpOptRouter, 4, 192, 168, 1, 1},
+		[]byte{dhcpOptDNS, 8, 1, 1, 1, 1, 8, 8, 8, 8},
+		[]byte{dhcpOptLeaseTime, 4, 0, 0, 0x0e, 0x10},
+		[]byte{dhcpOptServerID, 4, 192, 168, 1, 1},
+	)
+	msg, err := parseDHCPPacket(reply)
+	if err != nil {
+		t.Fatalf("parseDHCPPacket failed: %v", err)
+	}
+	if msg.xid != 0xdeadbeef || msg.msgType != dhcpAck {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	lease, err := leaseFromAck(msg)
+	if err != nil {
+		t.Fatalf("leaseFromAck failed: %v", err)
+	}
+	if lease.Address.String() != "192.168.1.50/24" {
+		t.Errorf("address = %s", lease.Address)
+	}
+	if !lease.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("gateway = %s", lease.Gateway)
+	}
+	if len(lease.DNS) != 2 || !lease.DNS[1].Equal(net.IPv4(8, 8, 8, 8)) {
+		t.Errorf("dns = %v", lease.DNS)
+	}
+	if lease.LeaseTime != time.Hour {
+		t.Errorf("lease time = %s", lease.LeaseTime)
+	}
+}
+
+func TestLeaseFromAckWithoutMask(t *testing.T) {
+	msg := &dhcpMessage{yiaddr: net.IPv4(10, 0, 0, 2), options: map[byte][]byte{}}
+	if _, err := leaseFromAck(msg); err == nil {
+		t.Fatalf("expected error without a subnet mask")
+	}
+}
+
+func TestParseDHCPPacketTruncatedOption(t *testing.T) {
+	req := buildDHCPPacket(1, nil, dhcpDiscover, nil, nil)
+	reply := append(dhcpReply(req, net.IPv4zero)[:240], dhcpOptRouter, 4, 10)
+	if _, err := parseDHCPPacket(reply); err == nil {
+		t.Fatalf("expected error for truncated option")
+	}
+}
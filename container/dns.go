@@ -0,0 +1,264 @@
+package container
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Every bridge network gets a small DNS server listening on its gateway
+// address. It answers A queries for the names of the containers running on
+// the network and forwards everything else to the host's resolvers. The
+// server is a re-exec of containish ("init DNS_SERVER <network>") that lives
+// until the network is removed.
+
+// dnsStage is the init stage running a network's DNS server.
+const dnsStage = "DNS_SERVER"
+
+// hostResolvConf is where the upstream resolvers are read from.
+var hostResolvConf = "/etc/resolv.conf"
+
+const (
+	dnsTypeA   = 1
+	dnsTypeANY = 255
+	dnsClassIN = 1
+
+	dnsRcodeServFail = 2
+
+	// dnsTTL is short since containers come and go.
+	dnsTTL = 5
+)
+
+func dnsPidFile(n *Network) string {
+	return filepath.Join(networksDir, n.Name+".dns.pid")
+}
+
+// ensureDNSServer starts the DNS server of a network unless it is running.
+func ensureDNSServer(n *Network) error {
+	if data, err := os.ReadFile(dnsPidFile(n)); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			if syscall.Kill(pid, 0) == nil {
+				return nil
+			}
+		}
+	}
+
+	cmd := exec.Command("/proc/self/exe", "init", dnsStage, n.Name)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start DNS server for network %s: %w", n.Name, err)
+	}
+	defer cmd.Process.Release()
+	if err := os.WriteFile(dnsPidFile(n), []byte(strconv.Itoa(cmd.Process.Pid)), 0o644); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("failed to record DNS server pid: %w", err)
+	}
+	return nil
+}
+
+// stopDNSServer terminates the DNS server of a network, if any.
+func stopDNSServer(n *Network) {
+	data, err := os.ReadFile(dnsPidFile(n))
+	if err != nil {
+		return
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+		_ = syscall.Kill(pid, syscall.SIGTERM)
+	}
+	_ = os.Remove(dnsPidFile(n))
+}
+
+// runDNSServer serves DNS for the named network until the process is killed.
+func runDNSServer(name string) error {
+	n, err := LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+	conn, err := listenDNS(net.ParseIP(n.Gateway))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lookup := func(host string) (net.IP, bool) {
+		attached, err := NetworkContainers(n.Name)
+		if err != nil {
+			return nil, false
+		}
+		for _, c := range attached {
+			if strings.EqualFold(c.Id, host) {
+				return net.ParseIP(networkIP(c.Network)), true
+			}
+		}
+		return nil, false
+	}
+
+	buf := make([]byte, 512)
+	for {
+		size, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("failed to read DNS query: %w", err)
+		}
+		query := append([]byte{}, buf[:size]...)
+		go func() {
+			resp, ok := answerDNS(query, lookup)
+			if !ok {
+				resp = forwardDNS(query, hostNameservers())
+			}
+			if resp != nil {
+				_, _ = conn.WriteToUDP(resp, client)
+			}
+		}()
+	}
+}
+
+// listenDNS binds port 53 on the gateway, waiting briefly for the address
+// to appear on a freshly created bridge.
+func listenDNS(ip net.IP) (*net.UDPConn, error) {
+	var err error
+	for i := 0; i < 20; i++ {
+		var conn *net.UDPConn
+		if conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: 53}); err == nil {
+			return conn, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("failed to listen on %s:53: %w", ip, err)
+}
+
+// hostNameservers returns the nameservers of the host resolv.conf.
+func hostNameservers() []string {
+	return resolvConfNameservers(hostResolvConf)
+}
+
+// resolvConfNameservers returns the nameservers of the resolv.conf at path.
+func resolvConfNameservers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var servers []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// parseDNSQuestion returns the lowercased name and type of the single
+// question in a standard query.
+func parseDNSQuestion(msg []byte) (name string, qtype uint16, end int, err error) {
+	if len(msg) < 12 {
+		return "", 0, 0, errors.New("short DNS message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 != 0 || (flags>>11)&0xf != 0 {
+		return "", 0, 0, errors.New("not a standard query")
+	}
+	if binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return "", 0, 0, errors.New("expected exactly one question")
+	}
+
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, errors.New("truncated question")
+		}
+		l := int(msg[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l > 63 || off+l > len(msg) {
+			return "", 0, 0, errors.New("invalid label")
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+l])))
+		off += l
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, errors.New("truncated question")
+	}
+	qtype = binary.BigEndian.Uint16(msg[off:])
+	if binary.BigEndian.Uint16(msg[off+2:]) != dnsClassIN {
+		return "", 0, 0, errors.New("unsupported class")
+	}
+	return strings.Join(labels, "."), qtype, off + 4, nil
+}
+
+// answerDNS answers a query for a container name. It returns false when the
+// name is not a container on the network and the query must be forwarded.
+func answerDNS(query []byte, lookup func(string) (net.IP, bool)) ([]byte, bool) {
+	name, qtype, end, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil, false
+	}
+	ip, ok := lookup(name)
+	if !ok || ip.To4() == nil {
+		return nil, false
+	}
+
+	resp := dnsResponseHeader(query, 0)
+	resp = append(resp, query[12:end]...)
+	if qtype == dnsTypeA || qtype == dnsTypeANY {
+		binary.BigEndian.PutUint16(resp[6:8], 1)
+		resp = append(resp, 0xc0, 12) // pointer to the question name
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeA)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassIN)
+		resp = binary.BigEndian.AppendUint32(resp, dnsTTL)
+		resp = binary.BigEndian.AppendUint16(resp, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp, true
+}
+
+// dnsResponseHeader builds a response header for query with one question
+// and no records.
+func dnsResponseHeader(query []byte, rcode uint16) []byte {
+	h := make([]byte, 12)
+	copy(h[0:2], query[0:2])
+	rd := binary.BigEndian.Uint16(query[2:4]) & 0x0100
+	// QR, AA and RA set, recursion desired echoed back.
+	binary.BigEndian.PutUint16(h[2:4], 0x8000|0x0400|0x0080|rd|rcode)
+	binary.BigEndian.PutUint16(h[4:6], 1)
+	return h
+}
+
+// forwardDNS relays a query to the first upstream that answers, replying
+// SERVFAIL when none does.
+func forwardDNS(query []byte, upstreams []string) []byte {
+	for _, u := range upstreams {
+		conn, err := net.DialTimeout("udp", net.JoinHostPort(u, "53"), 2*time.Second)
+		if err != nil {
+			continue
+		}
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 4096)
+		_, err = conn.Write(query)
+		if err == nil {
+			var size int
+			if size, err = conn.Read(buf); err == nil {
+				conn.Close()
+				return buf[:size]
+			}
+		}
+		conn.Close()
+	}
+	if _, _, end, err := parseDNSQuestion(query); err == nil {
+		return append(dnsResponseHeader(query, dnsRcodeServFail), query[12:end]...)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package container
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// dnsQuery builds a standard recursive query for name.
+func dnsQuery(name string, qtype uint16) []byte {
+	q := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, l := range splitLabels(name) {
+		q = append(q, byte(len(l)))
+		q = append(q, l...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+func splitLabels(name string) []string {
+	var labels []string
+	start := 0
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || name[i] == '.' {
+			labels = append(labels, name[start:i])
+			start = i + 1
+		}
+	}
+	return labels
+}
+
+func TestAnswerDNS(t *testing.T) {
+	lookup := func(name string) (net.IP, bool) {
+		if name == "web" {
+			return net.IPv4(10, 89, 0, 2), true
+		}
+		return nil, false
+	}
+
+	query := dnsQuery("WEB", dnsTypeA)
+	resp, ok := answerDNS(query, lookup)
+	if !ok {
+		t.Fatalf("container name not answered")
+	}
+	if resp[0] != 0xab || resp[1] != 0xcd {
+		t.Fatalf("id not echoed")
+	}
+	if flags := binary.BigEndian.Uint16(resp[2:4]); flags&0x8000 == 0 || flags&0x0100 == 0 || flags&0xf != 0 {
+		t.Fatalf("unexpected flags %#x", flags)
+	}
+	if binary.BigEndian.Uint16(resp[6:8]) != 1 {
+		t.Fatalf("expected one answer")
+	}
+	if got := net.IP(resp[len(resp)-4:]); !got.Equal(net.IPv4(10, 89, 0, 2)) {
+		t.Fatalf("answer = %s", got)
+	}
+
+	resp, ok = answerDNS(dnsQuery("web", 28), lookup) // AAAA
+	if !ok || binary.BigEndian.Uint16(resp[6:8]) != 0 {
+		t.Fatalf("AAAA for a container must be answered with no records")
+	}
+
+	if _, ok := answerDNS(dnsQuery("example.com", dnsTypeA), lookup); ok {
+		t.Fatalf("unknown names must be forwarded")
+	}
+	if _, ok := answerDNS(query[:14], lookup); ok {
+		t.Fatalf("truncated query answered")
+	}
+}
+
+func TestForwardDNSWithoutUpstream(t *testing.T) {
+	resp := forwardDNS(dnsQuery("example.com", dnsTypeA), nil)
+	if resp == nil || binary.BigEndian.Uint16(resp[2:4])&0xf != dnsRcodeServFail {
+		t.Fatalf("expected SERVFAIL, got %v", resp)
+	}
+}
+
+func TestHostNameservers(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "resolv.conf")
+	data := "# comment\nsearch lan\nnameserver 127.0.0.53\nnameserver bogus\nnameserver 1.1.1.1\n"
+	if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := hostResolvConf
+	hostResolvConf = p
+	t.Cleanup(func() { hostResolvConf = old })
+
+	if got := hostNameservers(); !reflect.DeepEqual(got, []string{"127.0.0.53", "1.1.1.1"}) {
+		t.Fatalf("hostNameservers() = %v", got)
+	}
+}
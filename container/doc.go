@@ -0,0 +1,22 @@
+// Package container implements the containish runtime. Programs embedding
+// it create a Runtime with New and manage containers through its methods:
+//
+//	rt, err := container.New(container.WithCgroupManager(container.SystemdManager))
+//	if err != nil {
+//		return err
+//	}
+//	if err := rt.Run(ctx, "web", "/bundles/web/config.json", container.Detached()); err != nil {
+//		return err
+//	}
+//	defer rt.Delete("web")
+//	defer rt.Stop(ctx, "web")
+//
+// Containers are set up by re-executing the current binary (/proc/self/exe)
+// with "init <stage>" arguments, which this package's init function handles
+// before main runs. Embedding programs must therefore not use "init" as
+// their first argument for anything else.
+//
+// Container state lives under /run/miniruntime, so runtimes in different
+// processes see the same containers. It is kept by a StateStore, either a
+// state.json per container or a BoltDB database, see SetStateStore.
+package container
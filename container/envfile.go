@@ -0,0 +1,110 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// An env file holds KEY=VALUE lines, so variables such as credentials can
+// be given to run and exec without showing in the shell history or the
+// spec. Blank lines and lines starting with # are skipped, and a leading
+// "export " is allowed. A value is taken as is unless quoted: in single
+// quotes literally, in double quotes with the \", \\, \$, \n and \t escapes.
+// A # after whitespace starts a comment, outside quotes.
+
+// ReadEnvFile returns the KEY=VALUE variables of the env file at path.
+func ReadEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open env file: %w", err)
+	}
+	defer f.Close()
+	var env []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseEnvLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		env = append(env, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read env file: %w", err)
+	}
+	return env, nil
+}
+
+// parseEnvLine parses a KEY=VALUE line of an env file.
+func parseEnvLine(line string) (string, error) {
+	line = strings.TrimPrefix(line, "export ")
+	key, raw, ok := strings.Cut(line, "=")
+	key = strings.TrimSpace(key)
+	if !ok || !envKeyValid(key) {
+		return "", fmt.Errorf("invalid line %q: expected KEY=VALUE", line)
+	}
+	raw = strings.TrimLeft(raw, " \t")
+
+	var value strings.Builder
+	var rest string
+	switch {
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote in the value of %s", key)
+		}
+		value.WriteString(raw[1 : end+1])
+		rest = raw[end+2:]
+	case strings.HasPrefix(raw, `"`):
+		i := 1
+		for ; i < len(raw) && raw[i] != '"'; i++ {
+			if raw[i] != '\\' || i+1 == len(raw) {
+				value.WriteByte(raw[i])
+				continue
+			}
+			i++
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case '"', '\\', '$':
+				value.WriteByte(raw[i])
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(raw[i])
+			}
+		}
+		if i == len(raw) {
+			return "", fmt.Errorf("unterminated double quote in the value of %s", key)
+		}
+		rest = raw[i+1:]
+	default:
+		if i := strings.Index(raw, " #"); i >= 0 {
+			raw = raw[:i]
+		} else if i := strings.Index(raw, "\t#"); i >= 0 {
+			raw = raw[:i]
+		}
+		value.WriteString(strings.TrimRight(raw, " \t"))
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after the quoted value of %s", rest, key)
+	}
+	return key + "=" + value.String(), nil
+}
+
+// envKeyValid reports whether key is a valid variable name for an env file:
+// letters, digits and underscores, not starting with a digit.
+func envKeyValid(key string) bool {
+	for i, c := range key {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return key != ""
+}
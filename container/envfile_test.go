@@ -0,0 +1,70 @@
+package container
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	writeFile(t, path, `# database
+DB_HOST=db.lan
+DB_PORT = 5432
+export DB_USER=app
+DB_PASSWORD='p@ss w#rd $HOME'
+GREETING="hello \"world\"\n\tbye \$USER" # a comment
+PLAIN=value # a comment
+HASH=a#b
+EMPTY=
+QUOTED_EMPTY=""
+
+WITH_EQUALS=a=b
+`, 0o600)
+	env, err := ReadEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"DB_HOST=db.lan",
+		"DB_PORT=5432",
+		"DB_USER=app",
+		"DB_PASSWORD=p@ss w#rd $HOME",
+		"GREETING=hello \"world\"\n\tbye $USER",
+		"PLAIN=value",
+		"HASH=a#b",
+		"EMPTY=",
+		"QUOTED_EMPTY=",
+		"WITH_EQUALS=a=b",
+	}
+	if !slices.Equal(env, want) {
+		t.Errorf("ReadEnvFile = %q, want %q", env, want)
+	}
+}
+
+func TestReadEnvFileErrors(t *testing.T) {
+	for _, line := range []string{
+		"NO_VALUE",
+		"=value",
+		"1KEY=value",
+		"BAD-KEY=value",
+		"KEY='unterminated",
+		`KEY="unterminated`,
+		`KEY="a" b`,
+	} {
+		path := filepath.Join(t.TempDir(), "bad.env")
+		writeFile(t, path, "OK=1\n"+line+"\n", 0o600)
+		_, err := ReadEnvFile(path)
+		if err == nil {
+			t.Errorf("expected an error for %q", line)
+			continue
+		}
+		if !strings.Contains(err.Error(), path+":2:") {
+			t.Errorf("expected the error for %q to give its line, got %v", line, err)
+		}
+	}
+	if _, err := ReadEnvFile(filepath.Join(t.TempDir(), "missing.env")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,32 @@
+package container
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// Errors returned by the package wrap one of these when the failure has a
+// kind callers may want to react to. Match them with errors.Is.
+var (
+	// ErrNotFound reports a container, exec, network, volume or preset that
+	// doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNotRunning reports an operation that needs a running container.
+	ErrNotRunning = errors.New("not running")
+	// ErrExists reports a name that is already taken.
+	ErrExists = errors.New("already exists")
+	// ErrAmbiguous reports a container id prefix matching several
+	// containers.
+	ErrAmbiguous = errors.New("ambiguous container id prefix")
+	// ErrPermission is fs.ErrPermission, so it also matches the EPERM and
+	// EACCES errors of failed system calls.
+	ErrPermission = fs.ErrPermission
+	// ErrInsufficientResources reports a container the host lacks the
+	// memory or CPUs for, given what other containers reserve.
+	ErrInsufficientResources = errors.New("insufficient resources")
+
+	// ErrCommandNotFound reports an exec whose command doesn't exist.
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrNotExecutable reports an exec whose command can't be executed.
+	ErrNotExecutable = errors.New("command not executable")
+)
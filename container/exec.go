@@ -0,0 +1,927 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Processes started in a running container with ExecContainer are recorded
+// in <state dir>/execs/<exec id>.json. A detached exec is supervised by a
+// re-exec of containish ("init EXEC <container> <exec id>") that waits for
+// the process and records how it exited.
+
+// execStage is the init stage supervising a detached exec.
+const execStage = "EXEC"
+
+// execProcessStage is the init stage executing an exec'd process, as the
+// child stage executes the container process: in the namespaces and cgroup
+// of the container and with the security context of its process, which
+// the runtime keeps in Container.Process. Capabilities, seccomp and
+// no_new_privs can only be set by the process itself, between the fork
+// and the exec of the command.
+const execProcessStage = "EXEC_PROCESS"
+
+// Exec process states.
+const (
+	ExecCreated = "created"
+	ExecRunning = "running"
+	ExecExited  = "exited"
+)
+
+// defaultExecPath is used unless the exec environment sets PATH.
+const defaultExecPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// execNamespaces are joined by exec'd processes, in order. The mount
+// namespace comes last since it changes how /proc paths resolve: the exec
+// process stage joins it itself, once started from the binary of the
+// host.
+var execNamespaces = []struct {
+	name string
+	flag int
+}{
+	{"ipc", unix.CLONE_NEWIPC},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"cgroup", unix.CLONE_NEWCGROUP},
+	{"pid", unix.CLONE_NEWPID},
+	{"mnt", unix.CLONE_NEWNS},
+}
+
+// ExecOptions describes a process to start in a running container.
+type ExecOptions struct {
+	Args []string `json:"args"`
+	// Env holds KEY=VALUE pairs added to the default environment. A bare
+	// KEY takes its value from the caller's environment.
+	Env []string `json:"env,omitempty"`
+	// User is "<user>[:<group>]", by name or id. Names are looked up in
+	// the container's /etc/passwd and /etc/group. Defaults to root.
+	User string `json:"user,omitempty"`
+	// Workdir defaults to /.
+	Workdir string `json:"workdir,omitempty"`
+	// Tty gives the process a pseudo terminal attached to ours.
+	Tty bool `json:"tty,omitempty"`
+	// Detach returns once the process started instead of waiting for it.
+	Detach bool `json:"detach,omitempty"`
+}
+
+// ExecProcess is the record of a process started with ExecContainer.
+type ExecProcess struct {
+	ID         string      `json:"id"`
+	Pid        int         `json:"pid,omitempty"`
+	Options    ExecOptions `json:"options"`
+	Status     string      `json:"status"`
+	ExitCode   int         `json:"exitCode"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+}
+
+func execDir(containerId string) string {
+	return filepath.Join(StateDir(containerId), "execs")
+}
+
+func saveExec(containerId string, p *ExecProcess) error {
+	if err := os.MkdirAll(execDir(containerId), 0o700); err != nil {
+		return fmt.Errorf("failed to create exec dir: %w", err)
+	}
+	data, err := json.MarshalIndent(p, "", " ")
+	if err != nil {
+		return err
+	}
+	// Write and rename so readers never see a partial record.
+	path := filepath.Join(execDir(containerId), p.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("failed to save exec %s: %w", p.ID, err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadExec returns the record of an exec in a container.
+func LoadExec(containerId, execId string) (*ExecProcess, error) {
+	if !objectNameRe.MatchString(execId) {
+		return nil, fmt.Errorf("invalid exec id %q", execId)
+	}
+	data, err := os.ReadFile(filepath.Join(execDir(containerId), execId+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("exec %s %w in container %s", execId, ErrNotFound, containerId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p ExecProcess
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode exec %s: %w", execId, err)
+	}
+	return &p, nil
+}
+
+// ListExecs returns the execs of a container, oldest first.
+func ListExecs(containerId string) ([]*ExecProcess, error) {
+	entries, err := os.ReadDir(execDir(containerId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var execs []*ExecProcess
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		p, err := LoadExec(containerId, id)
+		if err != nil {
+			continue
+		}
+		execs = append(execs, p)
+	}
+	sort.Slice(execs, func(i, j int) bool { return execs[i].StartedAt.Before(execs[j].StartedAt) })
+	return execs, nil
+}
+
+// ExecContainer starts a process in a running container. Unless detached, it
+// waits for the process and returns its record with the exit code.
+// Cancelling ctx kills an attached process, or aborts the start of a
+// detached one.
+func ExecContainer(ctx context.Context, containerId string, opts ExecOptions) (*ExecProcess, error) {
+	c, err := LoadState(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Status.running() {
+		return nil, fmt.Errorf("container %s is %w", containerId, ErrNotRunning)
+	}
+	if c.inVM() {
+		return nil, errExecVM(c)
+	}
+	if len(opts.Args) == 0 {
+		return nil, fmt.Errorf("no command given")
+	}
+	if opts.Tty && opts.Detach {
+		return nil, fmt.Errorf("a detached exec cannot have a tty")
+	}
+	if _, err := execEnv(opts, "/root"); err != nil {
+		return nil, err
+	}
+
+	id, err := randomHex(12)
+	if err != nil {
+		return nil, err
+	}
+	p := &ExecProcess{ID: id, Options: opts, Status: ExecCreated}
+	event := newPluginEvent(PluginPreExec, c)
+	event.ExecID, event.Exec = id, &opts
+	if err := runPlugins(ctx, event); err != nil {
+		return nil, err
+	}
+	if opts.Detach {
+		return p, startExecMonitor(ctx, c, p)
+	}
+	return p, runExec(ctx, c, p, os.Stdin, os.Stdout, os.Stderr, nil)
+}
+
+// runExec starts p, records it and waits for it to exit. started, if not
+// nil, is called once the process is running. The process is killed if ctx
+// is cancelled.
+func runExec(ctx context.Context, c *Container, p *ExecProcess, stdin io.Reader, stdout, stderr io.Writer, started func(pid int)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cmd, master, err := startExec(c, p.Options, stdin, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	stopKill := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	defer stopKill()
+	p.Pid = cmd.Process.Pid
+	p.Status = ExecRunning
+	p.StartedAt = time.Now()
+	if err := saveExec(c.Id, p); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if started != nil {
+		started(p.Pid)
+	}
+
+	var detachPty func()
+	if master != nil {
+		defer master.Close()
+		detachPty = attachPty(master)
+	}
+	waitErr := cmd.Wait()
+	if detachPty != nil {
+		detachPty()
+	}
+
+	p.Status = ExecExited
+	p.FinishedAt = time.Now()
+	p.ExitCode, err = exitCode(waitErr)
+	if serr := saveExec(c.Id, p); serr != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", serr)
+	}
+	return err
+}
+
+// exitCode converts the result of Wait to a shell style exit code.
+func exitCode(err error) (int, error) {
+	var ee *exec.ExitError
+	if err == nil {
+		return 0, nil
+	}
+	if !errors.As(err, &ee) {
+		return -1, err
+	}
+	if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), nil
+	}
+	return ee.ExitCode(), nil
+}
+
+// startError classifies a failure to start the exec'd command name.
+func startError(name string, err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fmt.Errorf("%s: %w: %w", name, ErrCommandNotFound, err)
+	case errors.Is(err, os.ErrPermission), errors.Is(err, unix.ENOEXEC), errors.Is(err, unix.EISDIR):
+		return fmt.Errorf("%s: %w: %w", name, ErrNotExecutable, err)
+	}
+	return fmt.Errorf("failed to start %s: %w", name, err)
+}
+
+// startExecMonitor starts the process supervising a detached exec and waits
+// until the exec is running.
+func startExecMonitor(ctx context.Context, c *Container, p *ExecProcess) error {
+	if err := saveExec(c.Id, p); err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command("/proc/self/exe", "init", execStage, c.Id, p.ID)
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to start exec monitor: %w", err)
+	}
+	w.Close()
+	defer cmd.Process.Release()
+
+	// Killing the monitor closes the pipe and ends the read below.
+	stopKill := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	defer stopKill()
+	pid, err := readExecStart(r)
+	if err == nil && !stopKill() {
+		// The monitor is gone, so nothing would supervise the process.
+		_ = unix.Kill(pid, unix.SIGKILL)
+		err = ctx.Err()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("exec start aborted: %w", ctx.Err())
+		}
+		_ = os.Remove(filepath.Join(execDir(c.Id), p.ID+".json"))
+		return err
+	}
+	p.Pid = pid
+	p.Status = ExecRunning
+	return nil
+}
+
+// execStartErrors are the kinds of start failures the exec monitor reports
+// by name, so they survive the trip through the pipe.
+var execStartErrors = map[string]error{
+	"notfound": ErrCommandNotFound,
+	"noexec":   ErrNotExecutable,
+}
+
+// execStartError is a start failure reported by the exec monitor.
+type execStartError struct {
+	msg  string
+	kind error
+}
+
+func (e *execStartError) Error() string { return e.msg }
+func (e *execStartError) Unwrap() error { return e.kind }
+
+// readExecStart reads the "pid:<pid>" or "error:<kind>:<message>" line
+// the exec monitor reports once the process started.
+func readExecStart(r io.Reader) (int, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("exec monitor exited: %w", err)
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "error:") {
+		return 0, parseExecStartError(line)
+	}
+	pid, err := strconv.Atoi(strings.TrimPrefix(line, "pid:"))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected exec monitor message %q", line)
+	}
+	return pid, nil
+}
+
+// parseExecStartError parses an "error:<kind>:<message>" line.
+func parseExecStartError(line string) error {
+	msg, ok := strings.CutPrefix(line, "error:")
+	if !ok {
+		return fmt.Errorf("unexpected exec start message %q", line)
+	}
+	kind, msg, _ := strings.Cut(msg, ":")
+	return &execStartError{msg: msg, kind: execStartErrors[kind]}
+}
+
+// execStartKind returns the name of the kind of start failure err is in
+// execStartErrors, if any.
+func execStartKind(err error) string {
+	for k, kindErr := range execStartErrors {
+		if errors.Is(err, kindErr) {
+			return k
+		}
+	}
+	return ""
+}
+
+// runExecMonitor runs a detached exec, reporting its start on fd 3.
+func runExecMonitor(containerId, execId string) error {
+	report := os.NewFile(3, "exec-report")
+	defer report.Close()
+
+	c, err := LoadState(containerId)
+	if err == nil {
+		var p *ExecProcess
+		if p, err = LoadExec(containerId, execId); err == nil {
+			err = runExec(context.Background(), c, p, nil, nil, nil, func(pid int) {
+				fmt.Fprintf(report, "pid:%d\n", pid)
+				report.Close()
+			})
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(report, "error:%s:%v\n", execStartKind(err), err)
+	}
+	return err
+}
+
+// execUser is the identity an exec'd process runs as.
+type execUser struct {
+	uid, gid uint32
+	home     string
+}
+
+// lookupUser resolves a "<user>[:<group>]" spec against the passwd and
+// group files under root.
+func lookupUser(root, spec string) (execUser, error) {
+	u := execUser{home: "/root"}
+	if spec == "" {
+		return u, nil
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+
+	found := false
+	err := scanColonFile(filepath.Join(root, "etc/passwd"), func(f []string) bool {
+		// name:password:uid:gid:gecos:home:shell
+		if len(f) < 6 || (f[0] != name && f[2] != name) {
+			return true
+		}
+		uid, err1 := strconv.ParseUint(f[2], 10, 32)
+		gid, err2 := strconv.ParseUint(f[3], 10, 32)
+		if err1 != nil || err2 != nil {
+			return true
+		}
+		u = execUser{uid: uint32(uid), gid: uint32(gid), home: f[5]}
+		found = true
+		return false
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return u, err
+	}
+	if !found {
+		uid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			return u, fmt.Errorf("user %q not found in the container", name)
+		}
+		u = execUser{uid: uint32(uid), home: "/"}
+	}
+
+	if !hasGroup {
+		return u, nil
+	}
+	found = false
+	err = scanColonFile(filepath.Join(root, "etc/group"), func(f []string) bool {
+		// name:password:gid:members
+		if len(f) < 3 || (f[0] != group && f[2] != group) {
+			return true
+		}
+		if gid, err := strconv.ParseUint(f[2], 10, 32); err == nil {
+			u.gid = uint32(gid)
+			found = true
+			return false
+		}
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return u, err
+	}
+	if !found {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			return u, fmt.Errorf("group %q not found in the container", group)
+		}
+		u.gid = uint32(gid)
+	}
+	return u, nil
+}
+
+// scanColonFile calls fn with the fields of each line of a passwd style
+// file until it returns false.
+func scanColonFile(path string, fn func([]string) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !fn(strings.Split(line, ":")) {
+			break
+		}
+	}
+	return s.Err()
+}
+
+// execEnv builds the environment of an exec'd process: PATH and HOME, TERM
+// with a tty, then opts.Env, later entries replacing earlier ones.
+func execEnv(opts ExecOptions, home string) ([]string, error) {
+	env := []string{"PATH=" + defaultExecPath, "HOME=" + home}
+	if opts.Tty {
+		env = append(env, "TERM=xterm")
+	}
+	for _, e := range callerEnv(opts.Env) {
+		key, _, _ := strings.Cut(e, "=")
+		if key == "" {
+			return nil, fmt.Errorf("invalid environment variable %q", e)
+		}
+		env = removeEnv(env, key)
+		env = append(env, e)
+	}
+	return env, nil
+}
+
+// callerEnv returns env with each bare KEY given its value in our
+// environment, or left out if it has none.
+func callerEnv(env []string) []string {
+	var out []string
+	for _, e := range env {
+		if key, _, ok := strings.Cut(e, "="); !ok && key != "" {
+			val, set := os.LookupEnv(key)
+			if !set {
+				continue
+			}
+			e = key + "=" + val
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func removeEnv(env []string, key string) []string {
+	out := env[:0]
+	for _, e := range env {
+		if !strings.HasPrefix(e, key+"=") {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// envValue returns the value of key in env.
+func envValue(env []string, key string) string {
+	for _, e := range env {
+		if v, ok := strings.CutPrefix(e, key+"="); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// lookExecPath finds file in the directories of path, like exec.LookPath
+// but without reading our own PATH.
+func lookExecPath(file, path string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	for _, dir := range filepath.SplitList(path) {
+		p := filepath.Join(dir, file)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() && fi.Mode()&0o111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s: %w in $PATH", file, ErrCommandNotFound)
+}
+
+// containerNamespaces opens the namespaces of pid that exec'd processes
+// join, skipping those we already share and those in skip.
+func containerNamespaces(pid int, skip int) ([]*os.File, []int, error) {
+	user, err := sameNamespace(pid, "user")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user {
+		return nil, nil, fmt.Errorf("joining user namespaced containers is not supported")
+	}
+	var files []*os.File
+	var flags []int
+	for _, ns := range execNamespaces {
+		if ns.flag&skip != 0 {
+			continue
+		}
+		same, err := sameNamespace(pid, ns.name)
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		if same {
+			continue
+		}
+		f, err := os.Open(fmt.Sprintf("/proc/%d/ns/%s", pid, ns.name))
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("failed to open %s namespace: %w", ns.name, err)
+		}
+		files = append(files, f)
+		flags = append(flags, ns.flag)
+	}
+	return files, flags, nil
+}
+
+func sameNamespace(pid int, name string) (bool, error) {
+	theirs, err := os.Stat(fmt.Sprintf("/proc/%d/ns/%s", pid, name))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s namespace of %d: %w", name, pid, err)
+	}
+	ours, err := os.Stat("/proc/self/ns/" + name)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(theirs, ours), nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// startExec starts opts.Args inside the namespaces and cgroup of c, with
+// the security context and resource limits of its process. With a tty it
+// also returns the pty master, otherwise the process uses the given stdio,
+// /dev/null where nil.
+func startExec(c *Container, opts ExecOptions, stdin io.Reader, stdout, stderr io.Writer) (*exec.Cmd, *os.File, error) {
+	if c.inVM() {
+		return nil, nil, errExecVM(c)
+	}
+	nsFiles, nsFlags, err := containerNamespaces(c.InitProcessPiD, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeFiles(nsFiles)
+	var mntNs *os.File
+	if n := len(nsFlags); n > 0 && nsFlags[n-1] == unix.CLONE_NEWNS {
+		mntNs, nsFiles, nsFlags = nsFiles[n-1], nsFiles[:n-1], nsFlags[:n-1]
+	}
+	stageOpts, err := execStageOptions(c, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cgroupDir *os.File
+	if c.CgroupPath != "" {
+		if cgroupDir, err = os.Open(c.CgroupPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to open cgroup %s: %w", c.CgroupPath, err)
+		}
+		defer cgroupDir.Close()
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer devNull.Close()
+	var master, slave *os.File
+	if opts.Tty {
+		if master, slave, err = openPty(); err != nil {
+			return nil, nil, err
+		}
+		defer slave.Close()
+	}
+	closeMaster := func() {
+		if master != nil {
+			master.Close()
+		}
+	}
+	parent, child, err := initSocketPair("exec", unix.SOCK_CLOEXEC)
+	if err != nil {
+		closeMaster()
+		return nil, nil, err
+	}
+	defer parent.Close()
+
+	cmd, err := inNamespaces(nsFiles, nsFlags, func() (*exec.Cmd, error) {
+		cmd := exec.Command("/proc/self/exe", "init", execProcessStage)
+		cmd.ExtraFiles = []*os.File{child}
+		cmd.Env = []string{"STAGE_PIPE=3"}
+		if mntNs != nil {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, mntNs)
+			cmd.Env = append(cmd.Env, "MNTNS_FD=4")
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+		if cgroupDir != nil {
+			cmd.SysProcAttr.UseCgroupFD = true
+			cmd.SysProcAttr.CgroupFD = int(cgroupDir.Fd())
+		}
+		if slave != nil {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+			cmd.SysProcAttr.Setsid = true
+			cmd.SysProcAttr.Setctty = true
+			cmd.SysProcAttr.Ctty = 0
+		} else {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, devNull, devNull
+			if stdin != nil {
+				cmd.Stdin = stdin
+			}
+			if stdout != nil {
+				cmd.Stdout = stdout
+			}
+			if stderr != nil {
+				cmd.Stderr = stderr
+			}
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start the exec process stage: %w", err)
+		}
+		return cmd, nil
+	})
+	child.Close()
+	if err != nil {
+		closeMaster()
+		return nil, nil, err
+	}
+	err = writeStageMsg(parent, stageMsg{Type: msgOptions, Options: stageOpts})
+	if err == nil {
+		err = readExecProcessStart(parent)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		closeMaster()
+		return nil, nil, err
+	}
+	return cmd, master, nil
+}
+
+// execStageOptions returns the options of the exec process stage starting
+// opts in c.
+func execStageOptions(c *Container, opts ExecOptions) (*stageOptions, error) {
+	rlimits, err := processRlimits(c.InitProcessPiD)
+	if err != nil {
+		return nil, err
+	}
+	// Bare variables take their value from our environment, which the
+	// stage doesn't have.
+	opts.Env = callerEnv(opts.Env)
+	sec := c.Process
+	if sec == nil && (c.Options == nil || !c.Options.Privileged) {
+		// The state of a container created before the runtime kept the
+		// security context has none: give the defaults of the
+		// configuration, as the container process got.
+		def := &specs.Spec{}
+		if err := applyDefaultSecurity(def); err != nil {
+			return nil, err
+		}
+		sec = processSecurity(def)
+	}
+	spec := &specs.Spec{Process: &specs.Process{}, Linux: &specs.Linux{}}
+	if sec != nil {
+		spec.Process.Capabilities = sec.Capabilities
+		spec.Process.NoNewPrivileges = sec.NoNewPrivileges
+		spec.Process.User.Umask = sec.Umask
+		spec.Linux.Seccomp = sec.Seccomp
+		spec.Linux.Personality = sec.Personality
+	}
+	stageOpts := &stageOptions{ContainerId: c.Id, Spec: spec, Exec: &opts, Rlimits: rlimits}
+	if spec.Linux.Seccomp != nil && spec.Linux.Seccomp.ListenerPath != "" {
+		stageOpts.SeccompState = &specs.State{
+			Version:     specs.Version,
+			ID:          c.Id,
+			Status:      specs.StateRunning,
+			Bundle:      c.Bundle,
+			Annotations: c.Annotations,
+		}
+	}
+	return stageOpts, nil
+}
+
+// ProcessSecurity is the security context of the process of a container,
+// which the processes exec'd in it get too.
+type ProcessSecurity struct {
+	Capabilities    *specs.LinuxCapabilities `json:"capabilities,omitempty"`
+	NoNewPrivileges bool                     `json:"noNewPrivileges,omitempty"`
+	Umask           *uint32                  `json:"umask,omitempty"`
+	Seccomp         *specs.LinuxSeccomp      `json:"seccomp,omitempty"`
+	Personality     *specs.LinuxPersonality  `json:"personality,omitempty"`
+}
+
+// processSecurity returns the security context of the process of spec.
+func processSecurity(spec *specs.Spec) *ProcessSecurity {
+	s := &ProcessSecurity{}
+	if p := spec.Process; p != nil {
+		s.Capabilities, s.NoNewPrivileges, s.Umask = p.Capabilities, p.NoNewPrivileges, p.User.Umask
+	}
+	if l := spec.Linux; l != nil {
+		s.Seccomp, s.Personality = l.Seccomp, l.Personality
+	}
+	return s
+}
+
+// rlimitCount is the number of resource limits, RLIMIT_RTTIME being the
+// last.
+const rlimitCount = unix.RLIMIT_RTTIME + 1
+
+// execRlimit is a resource limit of the init process of a container.
+type execRlimit struct {
+	Resource int    `json:"resource"`
+	Cur      uint64 `json:"cur"`
+	Max      uint64 `json:"max"`
+}
+
+// processRlimits returns the resource limits of pid, which the spec
+// doesn't give but the core dumps of RunOptions.CoreDumps may have raised.
+func processRlimits(pid int) ([]execRlimit, error) {
+	var limits []execRlimit
+	for r := 0; r < rlimitCount; r++ {
+		var l unix.Rlimit
+		if err := unix.Prlimit(pid, r, nil, &l); err != nil {
+			return nil, fmt.Errorf("failed to read the resource limits of %d: %w", pid, err)
+		}
+		limits = append(limits, execRlimit{Resource: r, Cur: l.Cur, Max: l.Max})
+	}
+	return limits, nil
+}
+
+// readExecProcessStart waits for the exec process stage to execute the
+// command, which closes the stage pipe, or to report why it couldn't.
+func readExecProcessStart(f *os.File) error {
+	tv := unix.NsecToTimeval(handshakeTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(int(f.Fd()), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return fmt.Errorf("failed to set the handshake timeout: %w", err)
+	}
+	line, err := bufio.NewReader(f).ReadString('\n')
+	switch {
+	case line == "" && errors.Is(err, io.EOF):
+		return nil
+	case errors.Is(err, unix.EAGAIN):
+		return fmt.Errorf("timed out after %v waiting for the exec process stage", handshakeTimeout)
+	case err != nil:
+		return fmt.Errorf("exec process stage exited: %w", err)
+	}
+	return parseExecStartError(strings.TrimSpace(line))
+}
+
+// handleExecProcessStage executes the process of the options the runtime
+// sends in place of the stage, once in the mount namespace passed as
+// MNTNS_FD. A failure is reported on the stage pipe, which the exec
+// closes otherwise.
+func handleExecProcessStage() error {
+	fd, err := strconv.Atoi(os.Getenv("STAGE_PIPE"))
+	if err != nil {
+		return fmt.Errorf("invalid STAGE_PIPE fd: %w", err)
+	}
+	unix.CloseOnExec(fd)
+	stagePipe := os.NewFile(uintptr(fd), "stage-pipe")
+	m, err := expectStageMsg(stagePipe, msgOptions, "runtime", handshakeTimeout)
+	if err == nil && (m.Options == nil || m.Options.Exec == nil) {
+		err = fmt.Errorf("missing exec options")
+	}
+	if err == nil {
+		err = execInContainer(m.Options)
+	}
+	if _, werr := fmt.Fprintf(stagePipe, "error:%s:%v\n", execStartKind(err), err); werr != nil {
+		return err
+	}
+	return errStageReported
+}
+
+// execInContainer joins the mount namespace of the container and executes
+// opts.Exec there as execProcess does the container process.
+func execInContainer(opts *stageOptions) error {
+	// The thread joining the mount namespace executes the process.
+	runtime.LockOSThread()
+	// Our stdout is the process's.
+	var err error
+	if stageOut, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0); err != nil {
+		return err
+	}
+	// The seccomp agent listens on the host.
+	var seccompConn *net.UnixConn
+	if opts.SeccompState != nil {
+		if opts.SeccompState.Pid, err = hostPid(); err != nil {
+			return err
+		}
+		if seccompConn, err = dialSeccompListener(opts.Spec.Linux.Seccomp.ListenerPath); err != nil {
+			return err
+		}
+		defer seccompConn.Close()
+	}
+	if v := os.Getenv("MNTNS_FD"); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid MNTNS_FD: %w", err)
+		}
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			return fmt.Errorf("failed to unshare fs context: %w", err)
+		}
+		err = unix.Setns(fd, unix.CLONE_NEWNS)
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("failed to join mount namespace: %w", err)
+		}
+	}
+	for _, l := range opts.Rlimits {
+		if err := unix.Setrlimit(l.Resource, &unix.Rlimit{Cur: l.Cur, Max: l.Max}); err != nil {
+			return fmt.Errorf("failed to set resource limit %d: %w", l.Resource, err)
+		}
+	}
+
+	// We now see the container filesystem as /.
+	user, err := lookupUser("/", opts.Exec.User)
+	if err != nil {
+		return err
+	}
+	env, err := execEnv(*opts.Exec, user.home)
+	if err != nil {
+		return err
+	}
+	p := opts.Spec.Process
+	p.Args, p.Env, p.Cwd = opts.Exec.Args, env, opts.Exec.Workdir
+	if p.Cwd == "" {
+		p.Cwd = "/"
+	}
+	p.User.UID, p.User.GID = user.uid, user.gid
+	return execProcess(opts, seccompConn)
+}
+
+// inNamespaces joins the namespaces nsFiles, of the types in nsFlags, on a
+// thread of its own and calls start there. Processes started by start are
+// created in those namespaces.
+func inNamespaces(nsFiles []*os.File, nsFlags []int, start func() (*exec.Cmd, error)) (*exec.Cmd, error) {
+	type result struct {
+		cmd *exec.Cmd
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// setns into a mount namespace needs a thread with a filesystem
+		// context of its own. The thread is left locked so Go discards it
+		// when this goroutine returns instead of reusing it elsewhere.
+		runtime.LockOSThread()
+		cmd, err := func() (*exec.Cmd, error) {
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				return nil, fmt.Errorf("failed to unshare fs context: %w", err)
+			}
+			for i, f := range nsFiles {
+				if err := unix.Setns(int(f.Fd()), nsFlags[i]); err != nil {
+					return nil, fmt.Errorf("failed to join namespace %s: %w", f.Name(), err)
+				}
+			}
+			return start()
+		}()
+		done <- result{cmd, err}
+	}()
+	res := <-done
+	return res.cmd, res.err
+}
@@ -0,0 +1,201 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestLookupUser(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "root:x:0:0:root:/root:/bin/sh\n# comment\napp:x:1000:1000::/home/app:/bin/sh\n"
+	group := "root:x:0:\nstaff:x:50:app\n"
+	if err := os.WriteFile(filepath.Join(root, "etc/passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "etc/group"), []byte(group), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		spec string
+		want execUser
+	}{
+		{"", execUser{0, 0, "/root"}},
+		{"app", execUser{1000, 1000, "/home/app"}},
+		{"1000", execUser{1000, 1000, "/home/app"}},
+		{"app:staff", execUser{1000, 50, "/home/app"}},
+		{"app:7", execUser{1000, 7, "/home/app"}},
+		{"4242:4343", execUser{4242, 4343, "/"}},
+	} {
+		got, err := lookupUser(root, tc.spec)
+		if err != nil || got != tc.want {
+			t.Errorf("lookupUser(%q) = %+v, %v, want %+v", tc.spec, got, err, tc.want)
+		}
+	}
+	for _, bad := range []string{"nobody", "app:wheel"} {
+		if _, err := lookupUser(root, bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestExecEnv(t *testing.T) {
+	t.Setenv("EXEC_TEST_VAR", "from-host")
+	env, err := execEnv(ExecOptions{
+		Tty: true,
+		Env: []string{"FOO=bar", "PATH=/bin", "EXEC_TEST_VAR", "EXEC_TEST_UNSET"},
+	}, "/home/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HOME=/home/app", "TERM=xterm", "FOO=bar", "PATH=/bin", "EXEC_TEST_VAR=from-host"}
+	if !reflect.DeepEqual(env, want) {
+		t.Fatalf("execEnv = %v, want %v", env, want)
+	}
+	if _, err := execEnv(ExecOptions{Env: []string{"=x"}}, "/"); err == nil {
+		t.Fatal("expected error for an empty key")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		want   int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+	} {
+		code, err := exitCode(exec.Command("/bin/sh", "-c", tc.script).Run())
+		if err != nil || code != tc.want {
+			t.Errorf("%q: exitCode = %d, %v, want %d", tc.script, code, err, tc.want)
+		}
+	}
+}
+
+func TestReadExecStart(t *testing.T) {
+	if pid, err := readExecStart(strings.NewReader("pid:42\n")); err != nil || pid != 42 {
+		t.Fatalf("readExecStart = %d, %v", pid, err)
+	}
+	if _, err := readExecStart(strings.NewReader("error::no such file\n")); err == nil || err.Error() != "no such file" {
+		t.Fatalf("expected the monitor error, got %v", err)
+	}
+	_, err := readExecStart(strings.NewReader("error:notfound:sh: command not found in $PATH\n"))
+	if !errors.Is(err, ErrCommandNotFound) || err.Error() != "sh: command not found in $PATH" {
+		t.Fatalf("expected a command not found error, got %v", err)
+	}
+	if _, err := readExecStart(strings.NewReader("")); err == nil {
+		t.Fatal("expected error when the monitor exits early")
+	}
+}
+
+func TestExecStageOptions(t *testing.T) {
+	c := &Container{Id: "exec-test", InitProcessPiD: os.Getpid()}
+	t.Setenv("EXEC_TEST_VAR", "from-host")
+	opts, err := execStageOptions(c, ExecOptions{Args: []string{"sh"}, Env: []string{"EXEC_TEST_VAR"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(opts.Exec.Env, []string{"EXEC_TEST_VAR=from-host"}) {
+		t.Errorf("env = %v, want the caller's value", opts.Exec.Env)
+	}
+	if len(opts.Rlimits) != rlimitCount {
+		t.Errorf("got %d resource limits, want %d", len(opts.Rlimits), rlimitCount)
+	}
+	// A container without a recorded context gets the defaults.
+	p := opts.Spec.Process
+	if p.Capabilities == nil || !reflect.DeepEqual(p.Capabilities.Bounding, defaultCapabilities) || opts.Spec.Linux.Seccomp == nil {
+		t.Errorf("exec without a recorded context = %+v, %+v, want the defaults", p.Capabilities, opts.Spec.Linux.Seccomp)
+	}
+
+	umask := uint32(0o077)
+	c.Process = &ProcessSecurity{
+		Capabilities:    &specs.LinuxCapabilities{Bounding: []string{"CAP_KILL"}, Effective: []string{"CAP_KILL"}},
+		NoNewPrivileges: true,
+		Umask:           &umask,
+	}
+	if opts, err = execStageOptions(c, ExecOptions{Args: []string{"sh"}}); err != nil {
+		t.Fatal(err)
+	}
+	p = opts.Spec.Process
+	if p.Capabilities != c.Process.Capabilities || !p.NoNewPrivileges || p.User.Umask == nil || *p.User.Umask != umask || opts.Spec.Linux.Seccomp != nil {
+		t.Errorf("exec stage spec = %+v, want the recorded context %+v", p, c.Process)
+	}
+
+	c.Process, c.Options = nil, &RunOptions{Privileged: true}
+	if opts, err = execStageOptions(c, ExecOptions{Args: []string{"sh"}}); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Spec.Process.Capabilities != nil || opts.Spec.Linux.Seccomp != nil {
+		t.Errorf("privileged exec got a restricted context")
+	}
+}
+
+func TestStartError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		kind error
+	}{
+		{unix.ENOENT, ErrCommandNotFound},
+		{unix.EACCES, ErrNotExecutable},
+		{unix.ENOEXEC, ErrNotExecutable},
+		{unix.ENOMEM, nil},
+	} {
+		err := startError("app", tc.err)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%v: cause lost in %v", tc.err, err)
+		}
+		for _, kind := range []error{ErrCommandNotFound, ErrNotExecutable} {
+			if errors.Is(err, kind) != (kind == tc.kind) {
+				t.Errorf("%v: errors.Is(%v) = %v", tc.err, kind, !(kind == tc.kind))
+			}
+		}
+	}
+	if !errors.Is(startError("app", unix.EACCES), ErrPermission) {
+		t.Error("EACCES should also match ErrPermission")
+	}
+}
+
+func TestExecRecords(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	if execs, err := ListExecs("c1"); err != nil || len(execs) != 0 {
+		t.Fatalf("ListExecs on a fresh container = %v, %v", execs, err)
+	}
+	first := &ExecProcess{ID: "aaa", Status: ExecExited, ExitCode: 2, Options: ExecOptions{Args: []string{"false"}}}
+	first.StartedAt = first.StartedAt.AddDate(2026, 0, 0)
+	second := &ExecProcess{ID: "bbb", Status: ExecRunning, Pid: 7, StartedAt: first.StartedAt.AddDate(0, 0, 1)}
+	for _, p := range []*ExecProcess{second, first} {
+		if err := saveExec("c1", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := LoadExec("c1", "aaa")
+	if err != nil || !reflect.DeepEqual(got, first) {
+		t.Fatalf("LoadExec = %+v, %v", got, err)
+	}
+	execs, err := ListExecs("c1")
+	if err != nil || len(execs) != 2 || execs[0].ID != "aaa" || execs[1].ID != "bbb" {
+		t.Fatalf("ListExecs = %v, %v", execs, err)
+	}
+	if _, err := LoadExec("c1", "../state"); err == nil {
+		t.Fatal("expected error for an invalid exec id")
+	}
+	if _, err := LoadExec("c1", "ccc"); err == nil {
+		t.Fatal("expected error for a missing exec")
+	}
+}
@@ -0,0 +1,40 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// A supervisor can wait for a detached container to exit on a file
+// descriptor it passes the runtime, instead of polling its state: the
+// monitor writes the exit code of the container process to it as a decimal
+// line, after recording it in the state, each time the process exits. The
+// monitor of a container restarted by its policy keeps it, and closes it
+// when it exits for good, so the supervisor reads EOF after the last code.
+
+// OpenExitFd returns the file of fd, an open descriptor of this process to
+// write exit codes to, such as the write end of a pipe.
+func OpenExitFd(fd int) (*os.File, error) {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if errors.Is(err, unix.EBADF) {
+		return nil, fmt.Errorf("exit fd %d is not open", fd)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid exit fd %d: %w", fd, err)
+	}
+	if flags&unix.O_ACCMODE == unix.O_RDONLY {
+		return nil, fmt.Errorf("exit fd %d is not open for writing", fd)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("exit-fd-%d", fd)), nil
+}
+
+// writeExitCode writes code to the exit file f.
+func writeExitCode(f *os.File, code int) error {
+	if _, err := fmt.Fprintf(f, "%d\n", code); err != nil {
+		return fmt.Errorf("failed to write the exit code: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package container
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenExitFd(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := OpenExitFd(int(r.Fd())); err == nil {
+		t.Error("expected an error for the read end of a pipe")
+	}
+	// The file takes the descriptor over from w.
+	fd, err := unix.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	f, err := OpenExitFd(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{1, 137} {
+		if err := writeExitCode(f, code); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "1\n137\n" {
+		t.Errorf("read %q, %v, want the exit codes a line each", data, err)
+	}
+
+	if _, err := OpenExitFd(fd); err == nil {
+		t.Error("expected an error for a closed fd")
+	}
+}
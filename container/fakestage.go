@@ -0,0 +1,116 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Runtime made WithFakeStages sets containers up as ever, through the
+// runtime and the parent stage, but the parent stage forks the fake child
+// stage in place of the child stage, in no namespace and left in its
+// cgroup. The fake child stage answers the handshake like the child stage
+// and executes the container process on the host, in the rootfs as its
+// working directory, once released and, for a created container, started
+// through the exec fifo. It sets nothing up, so it runs as any user: tests
+// cover the state transitions, the handshake, the monitor and the cleanup
+// of failed starts with plain go test. A process it can't find fails the
+// setup, before ready, standing in for the mounts of the child stage. A
+// WebAssembly module runs in the fake child stage as in the child stage,
+// with the rootfs as its /.
+
+// fakeChildStage is the init stage standing in for the child stage.
+const fakeChildStage = "FAKE_CHILD_STAGE"
+
+// handleFakeChildStage is called from init() in the fake child stage.
+func handleFakeChildStage() (err error) {
+	if err := openStageOut(); err != nil {
+		return err
+	}
+	fmt.Fprintf(stageOut, "INIT (fake child-stage): process pid on the host = %d\n", unix.Getpid())
+
+	fd, err := strconv.Atoi(os.Getenv("STAGE_PIPE"))
+	if err != nil {
+		return fmt.Errorf("invalid STAGE_PIPE fd: %w", err)
+	}
+	stagePipe := os.NewFile(uintptr(fd), "stage-pipe")
+	defer stagePipe.Close()
+
+	reporting := true
+	defer func() {
+		if err != nil && reporting && reportStageError(stagePipe, "child", err) {
+			err = errStageReported
+		}
+	}()
+
+	m, err := expectStageMsg(stagePipe, msgOptions, "parent stage", handshakeTimeout)
+	if err != nil {
+		return err
+	}
+	if m.Options == nil {
+		return fmt.Errorf("missing stage options")
+	}
+	opts := *m.Options
+	argv, env := initProcess(opts.Spec, opts.NotifySocket != "")
+	env = append(env, opts.SecretEnv...)
+	var path string
+	if opts.Wasm {
+		path, err = wasmModule(opts.Rootfs, argv[0], envValue(env, "PATH"))
+	} else {
+		path, err = lookExecPath(argv[0], envValue(env, "PATH"))
+	}
+	if err != nil {
+		return inStep("exec", argv[0], err)
+	}
+	dir := opts.Rootfs
+	if opts.Spec != nil && opts.Spec.Process != nil && opts.Spec.Process.Cwd != "" {
+		cwd := filepath.Join(dir, opts.Spec.Process.Cwd)
+		if fi, err := os.Stat(cwd); err == nil && fi.IsDir() {
+			dir = cwd
+		}
+	}
+
+	if err := writeStageMsg(stagePipe, stageMsg{Type: msgReady}); err != nil {
+		return err
+	}
+	if _, err := expectStageMsg(stagePipe, msgGo, "parent stage", 0); err != nil {
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, 0, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to clear parent death signal: %w", err)
+	}
+	if err := writeStageMsg(stagePipe, stageMsg{Type: msgStarted}); err != nil {
+		return err
+	}
+	reporting = false
+
+	if opts.ExecFifo != "" {
+		f, err := os.OpenFile(opts.ExecFifo, os.O_WRONLY, 0)
+		if err != nil {
+			return fmt.Errorf("failed to open exec fifo: %w", err)
+		}
+		_, err = f.Write([]byte{0})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write exec fifo: %w", err)
+		}
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	if opts.Wasm {
+		code, err := runWasm(opts.Rootfs, path, argv, env)
+		if err != nil {
+			return err
+		}
+		os.Exit(code)
+	}
+	fmt.Fprintf(stageOut, "INIT (fake child-stage): Replacing current process with %s...\n", argv[0])
+	if err := unix.Exec(path, argv, env); err != nil {
+		return fmt.Errorf("exec %s failed: %w", argv[0], err)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBundle sets up the state dir of the runtime and its stages and a
+// bundle running args, returning a runtime with fake stages and the spec.
+func fakeBundle(t *testing.T, args ...string) (*Runtime, string) {
+	t.Helper()
+	orig, origWait := baseStateDir, waitInterval
+	t.Cleanup(func() { baseStateDir, waitInterval = orig, origWait })
+	baseStateDir, waitInterval = t.TempDir(), 10*time.Millisecond
+	t.Cleanup(func() { waitStages(t, baseStateDir) })
+	cfg, err := json.Marshal(Config{StateDir: baseStateDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnv, string(cfg))
+
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "rootfs", "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dir, "rootfs", "etc", "hostname"), "fake\n", 0o644)
+	spec := map[string]any{
+		"ociVersion": "1.0.2",
+		"root":       map[string]any{"path": "rootfs"},
+		"process":    map[string]any{"args": args, "cwd": "/etc", "env": []string{"PATH=" + os.Getenv("PATH")}},
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specPath := filepath.Join(dir, "config.json")
+	writeFile(t, specPath, string(data), 0o644)
+	rt, err := New(WithFakeStages())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rt, specPath
+}
+
+// waitStages waits for the processes holding files of dir open, such as
+// the monitors of detached containers, to exit.
+func waitStages(t *testing.T, dir string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+		open := slices.ContainsFunc(fds, func(fd string) bool {
+			target, err := os.Readlink(fd)
+			return err == nil && strings.HasPrefix(target, dir+"/")
+		})
+		if !open {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("processes still hold files of %s", dir)
+		}
+	}
+}
+
+// fakeOptions are the options of the fake containers of the tests.
+func fakeOptions(opts ...CreateOption) []CreateOption {
+	return append([]CreateOption{Quiet(), WithNetwork(&NetworkConfig{Driver: NoneNetwork})}, opts...)
+}
+
+func TestFakeStagesLifecycle(t *testing.T) {
+	rt, specPath := fakeBundle(t, "sh", "-c", "cat hostname > ../started; exec sleep 60")
+	ctx := context.Background()
+
+	c, err := rt.Create(ctx, "c1", specPath, fakeOptions()...)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if c.Status != Created || c.InitProcessPiD == 0 || !processAlive(c.InitProcessPiD) {
+		t.Fatalf("created container %+v", c)
+	}
+	started := filepath.Join(c.Rootfs, "started")
+	if _, err := os.Stat(started); !os.IsNotExist(err) {
+		t.Fatalf("the process of a created container ran: %v", err)
+	}
+
+	if err := rt.Start(ctx, "c1"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if st, err := rt.Wait(ctx, "c1", WaitReady); err != nil || st.Status != Running {
+		t.Fatalf("started container = %+v, %v", st, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(started)
+		if string(data) == "fake\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the container process didn't run in the rootfs, wrote %q", data)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := rt.Stop(ctx, "c1", WithStopTimeout(time.Second)); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	if st, _ := rt.State("c1"); st.Status != Stopped {
+		t.Fatalf("stopped container is %v", st.Status)
+	}
+	if err := rt.Delete("c1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := rt.State("c1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("state of a deleted container: %v", err)
+	}
+}
+
+func TestFakeStagesForegroundStop(t *testing.T) {
+	rt, specPath := fakeBundle(t, "sleep", "60")
+	ctx := context.Background()
+
+	errc := make(chan error, 1)
+	go func() { errc <- rt.Run(ctx, "c1", specPath, fakeOptions()...) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		st, err := rt.State("c1")
+		if err == nil && st.Status == Running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("running container = %+v, %v", st, err)
+		}
+	}
+	if err := rt.Stop(ctx, "c1", WithStopTimeout(time.Second)); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+	<-errc
+	// The run recording the exit keeps what the stop recorded.
+	st, err := rt.State("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Status != Stopped || !st.ManuallyStopped || st.Graceful == nil || !*st.Graceful {
+		t.Fatalf("stopped container %+v, want a graceful manual stop", st)
+	}
+}
+
+func TestFakeStagesMonitor(t *testing.T) {
+	rt, specPath := fakeBundle(t, "sh", "-c", "exit 3")
+	ctx := context.Background()
+
+	if err := rt.Run(ctx, "c1", specPath, fakeOptions(Detached(), WithLogConfig(LogConfig{Driver: LogDriverNone}))...); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	st, err := rt.Wait(wctx, "c1", WaitStopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The monitor records the exit once the process is gone.
+	for st.ExitCode == nil && wctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		st, _ = rt.State("c1")
+	}
+	if st.ExitCode == nil || *st.ExitCode != 3 || st.FinishedAt == nil {
+		t.Fatalf("stopped container %+v, want exit code 3", st)
+	}
+	machineID := st.MachineID
+	if data, _ := os.ReadFile(filepath.Join(StateDir("c1"), machineIDFileName)); machineID == "" || string(data) != machineID+"\n" {
+		t.Fatalf("machine ID %q, written %q", machineID, data)
+	}
+
+	// Starting it again runs it through the fake stages too.
+	if err := rt.Start(ctx, "c1"); err != nil {
+		t.Fatalf("Start of a stopped container failed: %v", err)
+	}
+	if st, err := rt.Wait(wctx, "c1", WaitStopped); err != nil || st.Status != Stopped {
+		t.Fatalf("container started again = %+v, %v", st, err)
+	}
+	// Its exit history outlives the runs.
+	for len(st.Exits) < 2 && wctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		st, _ = rt.State("c1")
+	}
+	if len(st.Exits) != 2 || st.Exits[1].ExitCode != 3 || st.CrashLoop != nil {
+		t.Fatalf("exits %+v, crash loop %+v, want 2 exits", st.Exits, st.CrashLoop)
+	}
+	if st.MachineID != machineID {
+		t.Fatalf("machine ID %q changed to %q", machineID, st.MachineID)
+	}
+}
+
+func TestFakeStagesForeground(t *testing.T) {
+	rt, specPath := fakeBundle(t, "sh", "-c", "exit 3")
+	if err := rt.Run(context.Background(), "c1", specPath, fakeOptions()...); err == nil {
+		t.Fatal("running a failing container in the foreground succeeded")
+	}
+	if st, err := rt.State("c1"); err != nil || st.Status != Stopped {
+		t.Fatalf("container run in the foreground = %+v, %v", st, err)
+	}
+}
+
+func TestFakeStagesSetupFailure(t *testing.T) {
+	rt, specPath := fakeBundle(t, "no-such-command")
+	_, err := rt.Create(context.Background(), "c1", specPath, fakeOptions()...)
+	var se *StageError
+	if !errors.As(err, &se) || se.Stage != "child" || se.Step != "exec" || !strings.Contains(se.Message, "no-such-command") {
+		t.Fatalf("Create = %v, want the error of the child stage", err)
+	}
+	st, err := rt.State("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Status != Stopped || st.InitProcessPiD != 0 {
+		t.Fatalf("container of a failed setup %+v, want it stopped", st)
+	}
+	if err := rt.Delete("c1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+}
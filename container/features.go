@@ -0,0 +1,156 @@
+package container
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/runtime-spec/specs-go/features"
+)
+
+// Features reports what of the spec the runtime implements, in the format
+// of the OCI features document. A spec asking for anything else gets a
+// warning when it is loaded, or is rejected with RunOptions.StrictSpec,
+// rather than having it silently ignored.
+
+// ociVersionMin is the oldest spec version the runtime recognizes.
+const ociVersionMin = "1.0.0"
+
+// AnnotationResources lists, in the features document, the
+// linux.resources settings applied to the cgroup of a container.
+const AnnotationResources = "containish.resources"
+
+// supportedNamespaces are the namespaces a container can have. Only a pid
+// namespace can be joined by path.
+var supportedNamespaces = []specs.LinuxNamespaceType{
+	specs.PIDNamespace, specs.NetworkNamespace, specs.MountNamespace,
+	specs.UTSNamespace, specs.UserNamespace, specs.CgroupNamespace,
+	specs.TimeNamespace,
+}
+
+// supportedResources are the linux.resources settings applied.
+var supportedResources = []string{"blockIO", "devices", "unified"}
+
+// Features returns the features document of the runtime.
+func Features() features.Features {
+	yes, no := true, false
+	_, seccomp := nativeAudit()
+	f := features.Features{
+		OCIVersionMin: ociVersionMin,
+		OCIVersionMax: specs.Version,
+		Hooks:         []string{},
+		MountOptions:  sortedKeys(mountFlags),
+		Linux: &features.Linux{
+			Capabilities: sortedKeys(capabilityNames),
+			Cgroup:       &features.Cgroup{V1: &no, V2: &yes, Systemd: &yes, SystemdUser: &no, Rdma: &no},
+			Seccomp:      &features.Seccomp{Enabled: &seccomp},
+			Apparmor:     &features.Apparmor{Enabled: &no},
+			Selinux:      &features.Selinux{Enabled: &no},
+			IntelRdt:     &features.IntelRdt{Enabled: &yes},
+			MountExtensions: &features.MountExtensions{
+				IDMap: &features.IDMap{Enabled: &yes},
+			},
+		},
+		Annotations: map[string]string{AnnotationResources: strings.Join(supportedResources, ",")},
+	}
+	f.MountOptions = append(f.MountOptions, sortedKeys(propagationFlags)...)
+	for _, ns := range supportedNamespaces {
+		f.Linux.Namespaces = append(f.Linux.Namespaces, string(ns))
+	}
+	if seccomp {
+		s := f.Linux.Seccomp
+		for _, a := range []specs.LinuxSeccompAction{
+			specs.ActKill, specs.ActKillProcess, specs.ActKillThread, specs.ActTrap,
+			specs.ActErrno, specs.ActTrace, specs.ActAllow, specs.ActLog, specs.ActNotify,
+		} {
+			s.Actions = append(s.Actions, string(a))
+		}
+		for _, op := range []specs.LinuxSeccompOperator{
+			specs.OpNotEqual, specs.OpLessThan, specs.OpLessEqual, specs.OpEqualTo,
+			specs.OpGreaterEqual, specs.OpGreaterThan, specs.OpMaskedEqual,
+		} {
+			s.Operators = append(s.Operators, string(op))
+		}
+		s.Archs = []string{string(nativeSeccompArch)}
+		for _, flag := range sortedKeys(seccompFlags) {
+			s.KnownFlags = append(s.KnownFlags, string(flag))
+		}
+		s.SupportedFlags = s.KnownFlags
+	}
+	return f
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// unsupportedSpecFeatures returns the settings of spec the runtime doesn't
+// implement, by their path in the spec.
+func unsupportedSpecFeatures(spec *specs.Spec) []string {
+	var unsupported []string
+	add := func(set bool, path string) {
+		if set {
+			unsupported = append(unsupported, path)
+		}
+	}
+	if h := spec.Hooks; h != nil {
+		// Prestart is deprecated, but still a hook.
+		add(len(h.Prestart)+len(h.CreateRuntime)+len(h.CreateContainer)+len(h.StartContainer)+len(h.Poststart)+len(h.Poststop) > 0, "hooks")
+	}
+	add(spec.Domainname != "", "domainname")
+	add(spec.Root != nil && spec.Root.Readonly, "root.readonly")
+	if p := spec.Process; p != nil {
+		add(len(p.Rlimits) > 0, "process.rlimits")
+		add(p.OOMScoreAdj != nil, "process.oomScoreAdj")
+		add(p.ApparmorProfile != "", "process.apparmorProfile")
+		add(p.SelinuxLabel != "", "process.selinuxLabel")
+		add(p.Scheduler != nil, "process.scheduler")
+		add(p.IOPriority != nil, "process.ioPriority")
+	}
+	l := spec.Linux
+	if l == nil {
+		return unsupported
+	}
+	for _, ns := range l.Namespaces {
+		if !slices.Contains(supportedNamespaces, ns.Type) {
+			unsupported = append(unsupported, fmt.Sprintf("linux.namespaces %s", ns.Type))
+		} else if ns.Path != "" && ns.Type != specs.PIDNamespace && ns.Type != specs.UserNamespace {
+			// Joining a user namespace is rejected by its validation.
+			unsupported = append(unsupported, fmt.Sprintf("linux.namespaces %s path", ns.Type))
+		}
+	}
+	add(len(l.Sysctl) > 0, "linux.sysctl")
+	add(l.MountLabel != "", "linux.mountLabel")
+	if r := l.Resources; r != nil {
+		add(r.Memory != nil, "linux.resources.memory")
+		add(r.CPU != nil, "linux.resources.cpu")
+		add(r.Pids != nil, "linux.resources.pids")
+		add(len(r.HugepageLimits) > 0, "linux.resources.hugepageLimits")
+		add(r.Network != nil, "linux.resources.network")
+		add(len(r.Rdma) > 0, "linux.resources.rdma")
+	}
+	return unsupported
+}
+
+// checkSpecFeatures warns about the settings of spec the runtime ignores,
+// or with strict fails on them.
+func checkSpecFeatures(spec *specs.Spec, strict bool) error {
+	unsupported := unsupportedSpecFeatures(spec)
+	if len(unsupported) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("the spec sets what the runtime doesn't support: %s", strings.Join(unsupported, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "warning: ignoring what the runtime doesn't support in the spec: %s\n", strings.Join(unsupported, ", "))
+	return nil
+}
@@ -0,0 +1,61 @@
+package container
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	f := Features()
+	if f.Linux == nil || !slices.Contains(f.Linux.Namespaces, "user") || slices.Contains(f.Linux.Namespaces, "ipc") {
+		t.Errorf("namespaces = %v, want user and not ipc", f.Linux.Namespaces)
+	}
+	if !slices.Contains(f.MountOptions, "nosuid") || !slices.Contains(f.MountOptions, "rslave") {
+		t.Errorf("mount options = %v, want the flags and propagation options", f.MountOptions)
+	}
+	if !slices.Contains(f.Linux.Capabilities, "CAP_SYS_ADMIN") {
+		t.Errorf("capabilities = %v, want CAP_SYS_ADMIN", f.Linux.Capabilities)
+	}
+	if s := f.Linux.Seccomp; *s.Enabled && (!slices.Contains(s.Actions, "SCMP_ACT_NOTIFY") || len(s.Archs) != 1) {
+		t.Errorf("seccomp = %+v, want the actions and the native architecture", s)
+	}
+	if f.Annotations[AnnotationResources] != "blockIO,devices,unified" {
+		t.Errorf("resources = %q", f.Annotations[AnnotationResources])
+	}
+}
+
+func TestUnsupportedSpecFeatures(t *testing.T) {
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "config.json")
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"cwd": "/", "args": ["sh"],
+		"rlimits": [{"type": "RLIMIT_NOFILE", "hard": 1024, "soft": 1024}]},
+		"linux": {"namespaces": [{"type": "pid"}, {"type": "ipc"}, {"type": "network", "path": "/run/netns/x"}],
+			"resources": {"pids": {"limit": 10}, "unified": {"pids.max": "10"}}, "sysctl": {"net.ipv4.ip_forward": "1"}}}`, 0o644)
+	spec, err := LoadSpec(specPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"process.rlimits", "linux.namespaces ipc", "linux.namespaces network path", "linux.sysctl", "linux.resources.pids"}
+	if got := unsupportedSpecFeatures(spec); !slices.Equal(got, want) {
+		t.Errorf("unsupportedSpecFeatures = %q, want %q", got, want)
+	}
+
+	options := RunOptions{Network: &NetworkConfig{Driver: NoneNetwork}}
+	if _, err := loadRunSpec(specPath, nil, &options); err != nil {
+		t.Errorf("loadRunSpec without strict mode = %v, want a warning only", err)
+	}
+	options = RunOptions{Network: &NetworkConfig{Driver: NoneNetwork}, StrictSpec: true}
+	if _, err := loadRunSpec(specPath, nil, &options); err == nil || !strings.Contains(err.Error(), "linux.namespaces ipc") {
+		t.Errorf("loadRunSpec in strict mode = %v, want an error naming the namespace", err)
+	}
+
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "linux": {"namespaces": [{"type": "pid", "path": "/proc/1/ns/pid"}]}}`, 0o644)
+	if spec, err = LoadSpec(specPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := unsupportedSpecFeatures(spec); len(got) > 0 {
+		t.Errorf("unsupportedSpecFeatures = %q for a supported spec", got)
+	}
+}
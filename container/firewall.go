@@ -0,0 +1,261 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Containers are firewalled from inside their own network namespace, so the
+// rules apply whichever driver attached them (macvlan traffic never crosses
+// the host's netfilter hooks). Each namespace gets an "inet containish" table
+// holding the set of peer addresses it must not talk to and the container's
+// egress policy. The table disappears with the namespace; only the entries
+// other containers hold about a stopped container need explicit cleanup.
+// CAP_NET_ADMIN in the namespace is enough to flush the table, so a
+// container that could get it is refused an egress policy.
+
+// nftTable is the table installed in every container network namespace.
+const nftTable = "containish"
+
+// nftBinary is the nft executable used to load rulesets.
+var nftBinary = "nft"
+
+// EgressPolicy restricts the outbound connections of a container.
+type EgressPolicy struct {
+	// Deny drops outbound traffic that no Allow rule matches. Replies to
+	// inbound connections and loopback traffic are always allowed.
+	Deny  bool         `json:"deny"`
+	Allow []EgressRule `json:"allow,omitempty"`
+}
+
+// EgressRule allows traffic to a destination network, optionally limited to
+// a port.
+type EgressRule struct {
+	CIDR string `json:"cidr"`
+	Port uint16 `json:"port,omitempty"`
+	// Proto is "tcp" or "udp". When empty with a port, both match.
+	Proto string `json:"proto,omitempty"`
+}
+
+// ParseEgressRule parses an --egress-allow value of the form
+// "<cidr>[:<port>[/<proto>]]", e.g. "10.0.0.0/8", "1.1.1.1:53/udp" or
+// "0.0.0.0/0:443". A bare address is treated as a /32.
+func ParseEgressRule(value string) (EgressRule, error) {
+	var r EgressRule
+	addr, port, hasPort := strings.Cut(value, ":")
+
+	if !strings.Contains(addr, "/") {
+		addr += "/32"
+	}
+	ip, ipnet, err := net.ParseCIDR(addr)
+	if err != nil || ip.To4() == nil {
+		return r, fmt.Errorf("invalid egress rule %q: expected an IPv4 address or CIDR", value)
+	}
+	r.CIDR = ipnet.String()
+
+	if !hasPort {
+		return r, nil
+	}
+	port, proto, hasProto := strings.Cut(port, "/")
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return r, fmt.Errorf("invalid egress rule %q: bad port %q", value, port)
+	}
+	r.Port = uint16(p)
+	if hasProto {
+		if proto != "tcp" && proto != "udp" {
+			return r, fmt.Errorf("invalid egress rule %q: protocol must be tcp or udp", value)
+		}
+		r.Proto = proto
+	}
+	return r, nil
+}
+
+// validateEgress checks that a policy can be enforced for the network.
+func validateEgress(policy *EgressPolicy, cfg *NetworkConfig) error {
+	if policy == nil {
+		return nil
+	}
+	if cfg.Driver == HostNetwork && (policy.Deny || len(policy.Allow) > 0) {
+		return fmt.Errorf("egress policies cannot be applied to host network containers")
+	}
+	if !policy.Deny && len(policy.Allow) > 0 {
+		return fmt.Errorf("egress allow rules require --egress deny")
+	}
+	return nil
+}
+
+// validateEgressCaps refuses a policy to a container whose process could
+// get CAP_NET_ADMIN, from the bounding set of spec, and remove it.
+func validateEgressCaps(policy *EgressPolicy, spec *specs.Spec) error {
+	if policy == nil || !policy.Deny {
+		return nil
+	}
+	if spec.Process != nil && spec.Process.Capabilities != nil {
+		bounding, err := parseCapabilities(spec.Process.Capabilities.Bounding)
+		if err != nil {
+			return fmt.Errorf("invalid bounding capabilities: %w", err)
+		}
+		if !bounding.has(unix.CAP_NET_ADMIN) {
+			return nil
+		}
+	}
+	return fmt.Errorf("egress policies cannot be applied to containers with CAP_NET_ADMIN, which could remove them")
+}
+
+// sharesNetwork reports whether two containers are attached to the same
+// user-defined network and may therefore talk to each other.
+func sharesNetwork(a, b *NetworkConfig) bool {
+	if a == nil || b == nil || a.Name == "" || a.Name == DefaultBridgeNetwork {
+		return false
+	}
+	return a.Name == b.Name
+}
+
+// networkIP returns the container address without its prefix length, or ""
+// when the container has no address of its own.
+func networkIP(cfg *NetworkConfig) string {
+	if cfg == nil || cfg.Driver == HostNetwork {
+		return ""
+	}
+	ip, _, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// isolatedPeers returns the running containers c must be isolated from.
+func isolatedPeers(c *Container, all []*Container) []*Container {
+	var peers []*Container
+	for _, o := range all {
+		if o.Id == c.Id || !o.Status.running() || networkIP(o.Network) == "" {
+			continue
+		}
+		if sharesNetwork(c.Network, o.Network) {
+			continue
+		}
+		peers = append(peers, o)
+	}
+	return peers
+}
+
+// containerRuleset renders the nftables table for a container namespace.
+func containerRuleset(policy *EgressPolicy, isolated []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "table inet %s {\n", nftTable)
+
+	b.WriteString("\tset isolated {\n\t\ttype ipv4_addr\n")
+	if len(isolated) > 0 {
+		fmt.Fprintf(&b, "\t\telements = { %s }\n", strings.Join(isolated, ", "))
+	}
+	b.WriteString("\t}\n\n")
+
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+	b.WriteString("\t\tip saddr @isolated drop\n")
+	b.WriteString("\t}\n\n")
+
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+	b.WriteString("\t\tip daddr @isolated drop\n")
+	if policy != nil && policy.Deny {
+		b.WriteString("\t\toifname \"lo\" accept\n")
+		b.WriteString("\t\tct state established,related accept\n")
+		for _, r := range policy.Allow {
+			fmt.Fprintf(&b, "\t\tip daddr %s", r.CIDR)
+			switch {
+			case r.Port == 0:
+			case r.Proto == "":
+				fmt.Fprintf(&b, " meta l4proto { tcp, udp } th dport %d", r.Port)
+			default:
+				fmt.Fprintf(&b, " %s dport %d", r.Proto, r.Port)
+			}
+			b.WriteString(" accept\n")
+		}
+		b.WriteString("\t\tdrop\n")
+	}
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+// runNft loads a ruleset in the current network namespace.
+func runNft(ruleset string) error {
+	cmd := exec.Command(nftBinary, "-f", "-")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("nft failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// nft runs nft with the given ruleset inside the network namespace of pid.
+func nft(pid int, ruleset string) error {
+	// The forked nft inherits the namespace of the locked thread.
+	return withNetns(pid, func() error { return runNft(ruleset) })
+}
+
+// setupFirewall installs the isolation and egress rules for c, whose init
+// process is pid, and adds c to the isolation sets of its running peers.
+func setupFirewall(pid int, c *Container, policy *EgressPolicy) error {
+	ip := networkIP(c.Network)
+	if ip == "" && (policy == nil || !policy.Deny) {
+		// Loopback only or host networking: nothing to filter.
+		return nil
+	}
+	if _, err := exec.LookPath(nftBinary); err != nil {
+		return fmt.Errorf("nftables is required to firewall containers: %w", err)
+	}
+
+	all, err := ListContainers()
+	if err != nil {
+		return err
+	}
+	peers := isolatedPeers(c, all)
+	var isolated []string
+	for _, p := range peers {
+		isolated = append(isolated, networkIP(p.Network))
+	}
+	if err := nft(pid, containerRuleset(policy, isolated)); err != nil {
+		return err
+	}
+
+	if ip == "" {
+		return nil
+	}
+	for _, p := range peers {
+		rule := fmt.Sprintf("add element inet %s isolated { %s }\n", nftTable, ip)
+		if err := nft(p.InitProcessPiD, rule); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to isolate %s from %s: %v\n", c.Id, p.Id, err)
+		}
+	}
+	return nil
+}
+
+// removeFromPeers drops a stopped container's address from the isolation
+// sets of the containers still running, so a new container reusing the
+// address is not blocked.
+func removeFromPeers(c *Container) {
+	ip := networkIP(c.Network)
+	if ip == "" {
+		return
+	}
+	all, err := ListContainers()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return
+	}
+	for _, p := range isolatedPeers(c, all) {
+		rule := fmt.Sprintf("delete element inet %s isolated { %s }\n", nftTable, ip)
+		if err := nft(p.InitProcessPiD, rule); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to update firewall of %s: %v\n", p.Id, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package container
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseEgressRule(t *testing.T) {
+	cases := map[string]EgressRule{
+		"10.0.0.0/8":            {CIDR: "10.0.0.0/8"},
+		"10.1.2.3/8":            {CIDR: "10.0.0.0/8"},
+		"1.1.1.1:53/udp":        {CIDR: "1.1.1.1/32", Port: 53, Proto: "udp"},
+		"0.0.0.0/0:443":         {CIDR: "0.0.0.0/0", Port: 443},
+		"192.168.1.0/24:22/tcp": {CIDR: "192.168.1.0/24", Port: 22, Proto: "tcp"},
+	}
+	for in, want := range cases {
+		got, err := ParseEgressRule(in)
+		if err != nil || got != want {
+			t.Errorf("ParseEgressRule(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"", "example.com", "fd00::/8", "10.0.0.0/8:0", "10.0.0.0/8:70000", "10.0.0.0/8:53/icmp"} {
+		if _, err := ParseEgressRule(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestValidateEgress(t *testing.T) {
+	host := &NetworkConfig{Driver: HostNetwork}
+	if err := validateEgress(&EgressPolicy{Deny: true}, host); err == nil {
+		t.Fatalf("expected error for host network")
+	}
+	none := &NetworkConfig{Driver: NoneNetwork}
+	if err := validateEgress(&EgressPolicy{Allow: []EgressRule{{CIDR: "0.0.0.0/0"}}}, none); err == nil {
+		t.Fatalf("expected error for allow rules without deny")
+	}
+	if err := validateEgress(nil, host); err != nil {
+		t.Fatalf("no policy must always be valid: %v", err)
+	}
+}
+
+func TestValidateEgressCaps(t *testing.T) {
+	deny := &EgressPolicy{Deny: true}
+	withCaps := func(caps ...string) *specs.Spec {
+		return &specs.Spec{Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: caps}}}
+	}
+	if err := validateEgressCaps(deny, withCaps(defaultCapabilities...)); err != nil {
+		t.Errorf("validateEgressCaps with the default capabilities: %v", err)
+	}
+	for what, spec := range map[string]*specs.Spec{
+		"CAP_NET_ADMIN":           withCaps("CAP_CHOWN", "CAP_NET_ADMIN"),
+		"no process.capabilities": {Process: &specs.Process{}},
+	} {
+		if err := validateEgressCaps(deny, spec); err == nil {
+			t.Errorf("expected an egress policy with %s to be refused", what)
+		}
+	}
+	if err := validateEgressCaps(nil, withCaps("CAP_NET_ADMIN")); err != nil {
+		t.Errorf("validateEgressCaps without a policy: %v", err)
+	}
+}
+
+func TestIsolatedPeers(t *testing.T) {
+	self := &Container{Id: "a", Network: &NetworkConfig{Driver: MacvlanDriver, Address: "192.168.1.10/24"}}
+	all := []*Container{
+		self,
+		{Id: "b", Status: Running, Network: &NetworkConfig{Driver: MacvlanDriver, Address: "192.168.1.11/24"}},
+		{Id: "c", Status: Stopped, Network: &NetworkConfig{Driver: MacvlanDriver, Address: "192.168.1.12/24"}},
+		{Id: "d", Status: Running, Network: &NetworkConfig{Driver: HostNetwork}},
+		{Id: "e", Status: Running, Network: &NetworkConfig{Driver: NoneNetwork}},
+		{Id: "f", Status: Running},
+	}
+
+	var ids []string
+	for _, p := range isolatedPeers(self, all) {
+		ids = append(ids, p.Id)
+	}
+	if strings.Join(ids, ",") != "b" {
+		t.Fatalf("isolated from %v, want [b]", ids)
+	}
+
+	self.Network.Name = "web"
+	all[1].Network.Name = "web"
+	if peers := isolatedPeers(self, all); len(peers) != 0 {
+		t.Fatalf("containers on the same network must not be isolated, got %d peers", len(peers))
+	}
+
+	self.Network.Name = DefaultBridgeNetwork
+	all[1].Network.Name = DefaultBridgeNetwork
+	if peers := isolatedPeers(self, all); len(peers) != 1 {
+		t.Fatalf("containers on the default bridge must be isolated, got %d peers", len(peers))
+	}
+}
+
+func TestContainerRuleset(t *testing.T) {
+	policy := &EgressPolicy{Deny: true, Allow: []EgressRule{
+		{CIDR: "10.0.0.0/8"},
+		{CIDR: "1.1.1.1/32", Port: 53},
+		{CIDR: "0.0.0.0/0", Port: 443, Proto: "tcp"},
+	}}
+	got := containerRuleset(policy, []string{"192.168.1.11", "192.168.1.12"})
+	want := `table inet containish {
+	set isolated {
+		type ipv4_addr
+		elements = { 192.168.1.11, 192.168.1.12 }
+	}
+
+	chain input {
+		type filter hook input priority filter; policy accept;
+		ip saddr @isolated drop
+	}
+
+	chain output {
+		type filter hook output priority filter; policy accept;
+		ip daddr @isolated drop
+		oifname "lo" accept
+		ct state established,related accept
+		ip daddr 10.0.0.0/8 accept
+		ip daddr 1.1.1.1/32 meta l4proto { tcp, udp } th dport 53 accept
+		ip daddr 0.0.0.0/0 tcp dport 443 accept
+		drop
+	}
+}
+`
+	if got != want {
+		t.Fatalf("unexpected ruleset:\n%s\nwant:\n%s", got, want)
+	}
+
+	open := containerRuleset(nil, nil)
+	if strings.Contains(open, "elements") || strings.Contains(open, "\t\tdrop\n") {
+		t.Fatalf("unrestricted ruleset must not drop egress:\n%s", open)
+	}
+}
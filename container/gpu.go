@@ -0,0 +1,178 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// GPUs are passed through to a container from the first source the host
+// has:
+//
+//   - a CDI spec of a GPU kind, such as the one "nvidia-ctk cdi generate"
+//     writes to /etc/cdi, see cdi.go;
+//   - nvidia-container-cli, whose "list" gives the device nodes, driver
+//     libraries and binaries and IPC sockets to expose, at the same paths;
+//   - the DRI nodes of /dev/dri, for all GPUs only.
+//
+// The device nodes are created in the container and allowed by its device
+// cgroup, if it has one; the rest is bind mounted read-only.
+
+// GPUsAll selects every GPU of the host.
+const GPUsAll = "all"
+
+// nvidiaContainerCLI is the nvidia-container-cli binary, looked up on the
+// PATH.
+var nvidiaContainerCLI = "nvidia-container-cli"
+
+// driDir holds the DRI device nodes of the host.
+var driDir = "/dev/dri"
+
+// ParseGPUs parses a --gpus value, "all" or a comma-separated list of GPU
+// indexes or UUIDs.
+func ParseGPUs(value string) ([]string, error) {
+	if value == GPUsAll {
+		return []string{GPUsAll}, nil
+	}
+	var ids []string
+	for _, id := range strings.Split(value, ",") {
+		if id == "" || id == GPUsAll {
+			return nil, fmt.Errorf("invalid --gpus %q: expected all or a list of GPU ids", value)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// applyGPUs passes the GPUs selected by ids through to the container of
+// spec.
+func applyGPUs(spec *specs.Spec, ids []string) error {
+	edits, err := cdiGPUEdits(ids)
+	if err == nil && edits == nil {
+		edits, err = nvidiaGPUEdits(ids)
+	}
+	if err == nil && edits == nil {
+		edits, err = driGPUEdits(ids)
+	}
+	if err != nil {
+		return err
+	}
+	if edits == nil {
+		return fmt.Errorf("no GPUs found: install the NVIDIA container toolkit, or a CDI spec for the GPUs in %s", strings.Join(cdiSpecDirs, " or "))
+	}
+	return applyContainerEdits(spec, edits)
+}
+
+// cdiGPUEdits returns the edits of the GPUs ids in the CDI specs of the
+// host, or nil if it has none for GPUs, those of a kind such as
+// nvidia.com/gpu.
+func cdiGPUEdits(ids []string) ([]cdiContainerEdits, error) {
+	r, err := loadCDIDevices()
+	if err != nil {
+		return nil, err
+	}
+	// GPUs by id, the name of their device.
+	gpus := map[string]string{}
+	var all []string
+	for _, name := range r.names {
+		kind, id, _ := strings.Cut(name, "=")
+		if !strings.HasSuffix(kind, "/gpu") {
+			continue
+		}
+		if _, ok := gpus[id]; !ok {
+			gpus[id] = name
+			if id != GPUsAll {
+				all = append(all, name)
+			}
+		}
+	}
+	if len(gpus) == 0 {
+		return nil, nil
+	}
+
+	var names []string
+	for _, id := range ids {
+		name, ok := gpus[id]
+		switch {
+		case ok:
+			names = append(names, name)
+		case id == GPUsAll:
+			names = append(names, all...)
+		default:
+			return nil, fmt.Errorf("GPU %q not found in the CDI specs", id)
+		}
+	}
+	return r.edits(names)
+}
+
+// nvidiaGPUEdits returns the edits exposing the GPUs ids as listed by
+// nvidia-container-cli, or nil if it isn't installed.
+func nvidiaGPUEdits(ids []string) ([]cdiContainerEdits, error) {
+	cli, err := exec.LookPath(nvidiaContainerCLI)
+	if err != nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cli, "list", "--device="+strings.Join(ids, ","))
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("nvidia-container-cli list failed: %w", err)
+	}
+
+	var e cdiContainerEdits
+	for _, path := range strings.Fields(string(out)) {
+		if strings.HasPrefix(path, "/dev/") {
+			e.DeviceNodes = append(e.DeviceNodes, cdiDeviceNode{Path: path})
+			continue
+		}
+		m := cdiMount{HostPath: path, ContainerPath: path}
+		// IPC sockets must stay writable.
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			m.Options = []string{"nosuid", "nodev", "noexec", "bind"}
+		}
+		e.Mounts = append(e.Mounts, m)
+	}
+	e.Env = []string{"NVIDIA_VISIBLE_DEVICES=" + strings.Join(ids, ",")}
+	return []cdiContainerEdits{e}, nil
+}
+
+// driGPUEdits returns the edits exposing the DRI nodes of the host, or nil
+// if it has none.
+func driGPUEdits(ids []string) ([]cdiContainerEdits, error) {
+	entries, err := os.ReadDir(driDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list DRI devices: %w", err)
+	}
+	var e cdiContainerEdits
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "card") && !strings.HasPrefix(name, "renderD") {
+			continue
+		}
+		e.DeviceNodes = append(e.DeviceNodes, cdiDeviceNode{Path: "/dev/dri/" + name, HostPath: filepath.Join(driDir, name)})
+	}
+	if len(e.DeviceNodes) == 0 {
+		return nil, nil
+	}
+	if ids[0] != GPUsAll {
+		return nil, fmt.Errorf("selecting GPUs by id needs a CDI spec or nvidia-container-cli, only --gpus all is supported with %s", driDir)
+	}
+	return []cdiContainerEdits{e}, nil
+}
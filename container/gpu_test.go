@@ -0,0 +1,136 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// noGPUs points the GPU sources at empty locations, on a host with a
+// cgroup hierarchy.
+func noGPUs(t *testing.T) {
+	t.Helper()
+	origCDI, origCLI, origDRI, origCgroup := cdiSpecDirs, nvidiaContainerCLI, driDir, cgroupRoot
+	cdiSpecDirs = []string{t.TempDir()}
+	nvidiaContainerCLI = filepath.Join(t.TempDir(), "nvidia-container-cli")
+	driDir = filepath.Join(t.TempDir(), "dri")
+	cgroupRoot = t.TempDir()
+	writeFile(t, filepath.Join(cgroupRoot, "cgroup.controllers"), "", 0o644)
+	t.Cleanup(func() {
+		cdiSpecDirs, nvidiaContainerCLI, driDir, cgroupRoot = origCDI, origCLI, origDRI, origCgroup
+	})
+}
+
+func TestParseGPUs(t *testing.T) {
+	for value, want := range map[string][]string{
+		"all":           {"all"},
+		"0":             {"0"},
+		"0,GPU-4c2f1e9": {"0", "GPU-4c2f1e9"},
+		"0,all":         nil,
+		"0,,1":          nil,
+		"":              nil,
+	} {
+		got, err := ParseGPUs(value)
+		if want == nil {
+			if err == nil {
+				t.Errorf("ParseGPUs(%q) = %q, expected an error", value, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseGPUs(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+}
+
+func TestApplyGPUsCDI(t *testing.T) {
+	noGPUs(t)
+	lib := filepath.Join(t.TempDir(), "libcuda.so.1")
+	writeFile(t, lib, "", 0o644)
+	writeFile(t, filepath.Join(cdiSpecDirs[0], "nvidia.yaml"), `cdiVersion: 0.5.0
+kind: nvidia.com/gpu
+devices:
+- name: "0"
+  containerEdits:
+    deviceNodes:
+    - path: /dev/nvidia0
+      hostPath: /dev/null
+- name: "1"
+  containerEdits:
+    deviceNodes:
+    - path: /dev/nvidia1
+      hostPath: /dev/zero
+      permissions: rw
+containerEdits:
+  env:
+  - NVIDIA_VISIBLE_DEVICES=void
+  mounts:
+  - hostPath: `+lib+`
+    containerPath: /usr/lib/libcuda.so.1
+    options: [ro, nosuid, nodev, bind]
+`, 0o644)
+	writeFile(t, filepath.Join(cdiSpecDirs[0], "README"), "not a spec", 0o644)
+
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"nvidia-smi"}}}
+	if err := applyGPUs(spec, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	major, minor := int64(1), int64(5)
+	if want := []specs.LinuxDevice{{Path: "/dev/nvidia1", Type: "c", Major: major, Minor: minor}}; !reflect.DeepEqual(spec.Linux.Devices, want) {
+		t.Fatalf("unexpected devices %+v", spec.Linux.Devices)
+	}
+	if want := []specs.LinuxDeviceCgroup{{Allow: true, Type: "c", Major: &major, Minor: &minor, Access: "rw"}}; !reflect.DeepEqual(spec.Linux.Resources.Devices, want) {
+		t.Fatalf("unexpected device rules %+v", spec.Linux.Resources.Devices)
+	}
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Source != lib || spec.Mounts[0].Destination != "/usr/lib/libcuda.so.1" {
+		t.Fatalf("unexpected mounts %+v", spec.Mounts)
+	}
+	if !reflect.DeepEqual(spec.Process.Env, []string{"NVIDIA_VISIBLE_DEVICES=void"}) {
+		t.Fatalf("unexpected env %q", spec.Process.Env)
+	}
+
+	spec = &specs.Spec{}
+	if err := applyGPUs(spec, []string{GPUsAll}); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Linux.Devices) != 2 || spec.Linux.Devices[0].Path != "/dev/nvidia0" || len(spec.Mounts) != 1 {
+		t.Fatalf("expected both GPUs and the driver once, got %+v and %+v", spec.Linux.Devices, spec.Mounts)
+	}
+	if err := applyGPUs(&specs.Spec{}, []string{"2"}); err == nil || !strings.Contains(err.Error(), `GPU "2" not found`) {
+		t.Fatalf("expected an unknown GPU, got %v", err)
+	}
+}
+
+func TestApplyGPUsNvidiaContainerCLI(t *testing.T) {
+	noGPUs(t)
+	args := filepath.Join(t.TempDir(), "args")
+	bin := filepath.Join(t.TempDir(), "nvidia-smi")
+	writeFile(t, bin, "", 0o755)
+	writeFile(t, nvidiaContainerCLI, "#!/bin/sh\necho \"$@\" > "+args+"\necho /dev/null\necho "+bin+"\n", 0o755)
+
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"nvidia-smi"}}}
+	if err := applyGPUs(spec, []string{"0", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(args)
+	if err != nil || string(data) != "list --device=0,1\n" {
+		t.Fatalf("unexpected arguments %q, %v", data, err)
+	}
+	if len(spec.Linux.Devices) != 1 || spec.Linux.Devices[0].Path != "/dev/null" {
+		t.Fatalf("unexpected devices %+v", spec.Linux.Devices)
+	}
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Destination != bin || spec.Mounts[0].Options[0] != "ro" {
+		t.Fatalf("unexpected mounts %+v", spec.Mounts)
+	}
+}
+
+func TestApplyGPUsNone(t *testing.T) {
+	noGPUs(t)
+	if err := applyGPUs(&specs.Spec{}, []string{GPUsAll}); err == nil || !strings.Contains(err.Error(), "no GPUs found") {
+		t.Fatalf("expected no GPUs, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package container
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The runtime and the init stages set a container up in lockstep, over the
+// init pipe between the runtime and the parent stage and the stage pipe
+// between the parent and child stages. Each message is a stageMsg encoded
+// as JSON, preceded by its length as 4 bytes big-endian:
+//
+//	runtime            parent stage        child stage
+//	options      ->
+//	                   options       ->
+//	                                 <-    idmap (user namespace only)
+//	                                 <-    ready
+//	             <-    ready (pid)
+//	go           ->    go            ->
+//	                                 <-    started
+//	             <-    started
+//	handover     ->                        (detached only)
+//
+// The parent stage answers idmap with the idmapped mounts, passed as a
+// single byte carrying their fds. A stage failing before the container
+// process is started sends an error message instead of the one expected,
+// the parent stage relaying those of the child stage, so the runtime can
+// tell which step failed rather than seeing the pipe close.
+
+// Types of stage messages.
+const (
+	msgOptions  = "options"
+	msgIdmap    = "idmap"
+	msgReady    = "ready"
+	msgGo       = "go"
+	msgStarted  = "started"
+	msgHandover = "handover"
+	msgError    = "error"
+)
+
+// maxStageMsg bounds the size of a stage message. The options carry the
+// whole spec.
+const maxStageMsg = 16 << 20
+
+// handshakeTimeout bounds how long the runtime and the parent stage wait
+// for the next stage to set up. It is a variable so tests can override it.
+var handshakeTimeout = 30 * time.Second
+
+// errStageReported is returned by a stage whose failure was sent to the
+// runtime, so it isn't printed twice.
+var errStageReported = errors.New("reported to the runtime")
+
+// stageMsg is a message of the handshake.
+type stageMsg struct {
+	Type    string        `json:"type"`
+	Options *stageOptions `json:"options,omitempty"`
+	// Pid is the init process of the container, in ready messages to
+	// the runtime.
+	Pid int `json:"pid,omitempty"`
+	// Timings are how long the stages took over stagePhases, in ready
+	// messages.
+	Timings map[string]time.Duration `json:"timings,omitempty"`
+	Error   *StageError              `json:"error,omitempty"`
+}
+
+// StageError is the failure of an init stage to set a container up, as
+// reported to the runtime.
+type StageError struct {
+	// Stage is the stage that failed, "parent" or "child".
+	Stage string `json:"stage"`
+	// Step is what the stage was doing, such as "mount" or "pivot_root",
+	// and Path the file it was doing it to, when known.
+	Step string `json:"step,omitempty"`
+	Path string `json:"path,omitempty"`
+	// Errno is the error of the system call that failed, if any.
+	Errno syscall.Errno `json:"errno,omitempty"`
+	// Message describes the failure.
+	Message string `json:"message"`
+}
+
+func (e *StageError) Error() string {
+	return e.Stage + " stage: " + e.Message
+}
+
+// Unwrap returns Errno, so the error matches the likes of ErrPermission.
+func (e *StageError) Unwrap() error {
+	if e.Errno == 0 {
+		return nil
+	}
+	return e.Errno
+}
+
+// stepError records the setup step an error happened in.
+type stepError struct {
+	step string
+	path string
+	err  error
+}
+
+func (e *stepError) Error() string { return e.err.Error() }
+func (e *stepError) Unwrap() error { return e.err }
+
+// inStep tags err, if not nil, with the step and path it happened in.
+func inStep(step, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stepError{step: step, path: path, err: err}
+}
+
+// newStageError describes err, a failure of stage. The errors of another
+// stage are kept as they are.
+func newStageError(stage string, err error) *StageError {
+	var se *StageError
+	if errors.As(err, &se) {
+		return se
+	}
+	e := &StageError{Stage: stage, Message: err.Error()}
+	var step *stepError
+	var pathErr *fs.PathError
+	if errors.As(err, &step) {
+		e.Step, e.Path = step.step, step.path
+	} else if errors.As(err, &pathErr) {
+		e.Step, e.Path = pathErr.Op, pathErr.Path
+	}
+	errors.As(err, &e.Errno)
+	return e
+}
+
+// writeStageMsg sends m on w.
+func writeStageMsg(w io.Writer, m stageMsg) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("failed to send %s message: %w", m.Type, err)
+	}
+	return nil
+}
+
+// readStageMsg reads the next message from f, waiting at most timeout if
+// it is not zero.
+func readStageMsg(f *os.File, timeout time.Duration) (stageMsg, error) {
+	var m stageMsg
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(int(f.Fd()), unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return m, fmt.Errorf("failed to set the handshake timeout: %w", err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(f, size[:]); err != nil {
+		return m, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxStageMsg {
+		return m, fmt.Errorf("stage message of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid stage message: %w", err)
+	}
+	return m, nil
+}
+
+// expectStageMsg reads the next message from peer, which must be of type
+// want. An error message is returned as its StageError.
+func expectStageMsg(f *os.File, want, peer string, timeout time.Duration) (stageMsg, error) {
+	m, err := readStageMsg(f, timeout)
+	switch {
+	case errors.Is(err, unix.EAGAIN):
+		return m, fmt.Errorf("timed out after %v waiting for the %s", timeout, peer)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, unix.ECONNRESET):
+		return m, fmt.Errorf("the %s exited before reporting %s", peer, want)
+	case err != nil:
+		return m, fmt.Errorf("failed waiting for the %s: %w", peer, err)
+	case m.Type == msgError && m.Error != nil:
+		return m, m.Error
+	case m.Type != want:
+		return m, fmt.Errorf("unexpected %s message from the %s, expected %s", m.Type, peer, want)
+	}
+	return m, nil
+}
+
+// reportStageError sends err, the failure of stage, on conn. It reports
+// whether the error was sent, in which case the receiving side shows it.
+func reportStageError(conn io.Writer, stage string, err error) bool {
+	return writeStageMsg(conn, stageMsg{Type: msgError, Error: newStageError(stage, err)}) == nil
+}
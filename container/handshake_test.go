@@ -0,0 +1,88 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func stagePair(t *testing.T) (parent, child *os.File) {
+	t.Helper()
+	parent, child, err := initSocketPair("test", unix.SOCK_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		parent.Close()
+		child.Close()
+	})
+	return parent, child
+}
+
+func TestStageMessages(t *testing.T) {
+	parent, child := stagePair(t)
+
+	opts := &stageOptions{ContainerId: "web", Rootfs: "/srv/web"}
+	if err := writeStageMsg(parent, stageMsg{Type: msgOptions, Options: opts}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStageMsg(parent, stageMsg{Type: msgReady, Pid: 42}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := expectStageMsg(child, msgOptions, "runtime", time.Second)
+	if err != nil || m.Options == nil || m.Options.ContainerId != "web" || m.Options.Rootfs != "/srv/web" {
+		t.Fatalf("unexpected options message %+v, %v", m, err)
+	}
+	if _, err := expectStageMsg(child, msgGo, "runtime", time.Second); err == nil || !strings.Contains(err.Error(), "unexpected ready message") {
+		t.Fatalf("expected an unexpected message, got %v", err)
+	}
+
+	// Nothing sent times out, and a closed pipe is reported as such.
+	if _, err := expectStageMsg(child, msgGo, "runtime", 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	parent.Close()
+	if _, err := expectStageMsg(child, msgGo, "runtime", time.Second); err == nil || !strings.Contains(err.Error(), "exited before reporting go") {
+		t.Fatalf("expected the runtime to be gone, got %v", err)
+	}
+}
+
+func TestStageErrors(t *testing.T) {
+	parent, child := stagePair(t)
+
+	// The child stage reports a failed mount, which the parent stage
+	// relays to the runtime as it is.
+	failure := inStep("mount", "/proc", fmt.Errorf("failed to mount /proc in child: %w", unix.EPERM))
+	if !reportStageError(child, "child", failure) {
+		t.Fatal("failed to report the error")
+	}
+	_, err := expectStageMsg(parent, msgReady, "child stage", time.Second)
+	if !reportStageError(parent, "parent", fmt.Errorf("relayed: %w", err)) {
+		t.Fatal("failed to relay the error")
+	}
+	_, err = expectStageMsg(child, msgReady, "init stages", time.Second)
+
+	var se *StageError
+	if !errors.As(err, &se) {
+		t.Fatalf("expected a StageError, got %v", err)
+	}
+	want := StageError{Stage: "child", Step: "mount", Path: "/proc", Errno: unix.EPERM, Message: "failed to mount /proc in child: operation not permitted"}
+	if *se != want {
+		t.Fatalf("got %+v, want %+v", *se, want)
+	}
+	if !errors.Is(err, ErrPermission) {
+		t.Fatalf("expected %v to match ErrPermission", err)
+	}
+
+	// Without a step, that of a path error is used.
+	_, statErr := os.Stat("/nonexistent")
+	se = newStageError("parent", fmt.Errorf("failed to open cgroup: %w", statErr))
+	if se.Step != "stat" || se.Path != "/nonexistent" || se.Errno != unix.ENOENT {
+		t.Fatalf("unexpected %+v", *se)
+	}
+}
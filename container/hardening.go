@@ -0,0 +1,205 @@
+package container
+
+import (
+	"slices"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A spec without linux.seccomp or process.capabilities isn't run with the
+// privileges of root: the container process gets the seccomp_profile of
+// the configuration, by default the allowlist below, and the capabilities
+// of the configuration, by default defaultCapabilities, as its bounding,
+// effective and permitted sets. The allowlist follows the default profile
+// of Docker, without the system calls it only allows with capabilities
+// outside the default set, such as mount and ptrace: calls it doesn't list
+// fail with EPERM.
+//
+// RunOptions.Privileged is the escape hatch: the process runs with every
+// capability of the runtime and no seccomp filter whatever its spec says,
+// /sys is read-write, and the container gets the devices of the host and
+// may use any device. The path policy of its class leaves /proc and /sys
+// unmasked.
+
+// SeccompUnconfined as the seccomp_profile of the configuration runs
+// containers without a filter when their spec has none.
+const SeccompUnconfined = "unconfined"
+
+// defaultCapabilities are the capabilities of a process whose spec has
+// none, see Config.
+var defaultCapabilities = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_FSETID", "CAP_FOWNER", "CAP_MKNOD",
+	"CAP_NET_RAW", "CAP_SETGID", "CAP_SETUID", "CAP_SETFCAP", "CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE", "CAP_SYS_CHROOT", "CAP_KILL", "CAP_AUDIT_WRITE",
+}
+
+// defaultSyscalls are allowed by the built-in seccomp profile. Names the
+// architecture doesn't have are skipped when it is compiled.
+var defaultSyscalls = []string{
+	"accept", "accept4", "access", "adjtimex", "alarm", "arch_prctl", "bind", "brk",
+	"cachestat", "capget", "capset", "chdir", "chmod", "chown", "chown32",
+	"clock_adjtime", "clock_adjtime64", "clock_getres", "clock_getres_time64",
+	"clock_gettime", "clock_gettime64", "clock_nanosleep", "clock_nanosleep_time64",
+	"close", "close_range", "connect", "copy_file_range", "creat", "dup", "dup2", "dup3",
+	"epoll_create", "epoll_create1", "epoll_ctl", "epoll_ctl_old", "epoll_pwait",
+	"epoll_pwait2", "epoll_wait", "epoll_wait_old", "eventfd", "eventfd2", "execve",
+	"execveat", "exit", "exit_group", "faccessat", "faccessat2", "fadvise64",
+	"fadvise64_64", "fallocate", "fanotify_mark", "fchdir", "fchmod", "fchmodat",
+	"fchmodat2", "fchown", "fchown32", "fchownat", "fcntl", "fcntl64", "fdatasync",
+	"fgetxattr", "flistxattr", "flock", "fork", "fremovexattr", "fsetxattr", "fstat",
+	"fstat64", "fstatat64", "fstatfs", "fstatfs64", "fsync", "ftruncate", "ftruncate64",
+	"futex", "futex_requeue", "futex_time64", "futex_wait", "futex_waitv", "futex_wake",
+	"futimesat", "getcpu", "getcwd", "getdents", "getdents64", "getegid", "getegid32",
+	"geteuid", "geteuid32", "getgid", "getgid32", "getgroups", "getgroups32",
+	"getitimer", "getpeername", "getpgid", "getpgrp", "getpid", "getppid",
+	"getpriority", "getrandom", "getresgid", "getresgid32", "getresuid", "getresuid32",
+	"getrlimit", "get_robust_list", "getrusage", "getsid", "getsockname", "getsockopt",
+	"get_thread_area", "gettid", "gettimeofday", "getuid", "getuid32", "getxattr",
+	"inotify_add_watch", "inotify_init", "inotify_init1", "inotify_rm_watch",
+	"io_cancel", "ioctl", "io_destroy", "io_getevents", "io_pgetevents",
+	"io_pgetevents_time64", "ioprio_get", "ioprio_set", "io_setup", "io_submit", "ipc",
+	"kill", "landlock_add_rule", "landlock_create_ruleset", "landlock_restrict_self",
+	"lchown", "lchown32", "lgetxattr", "link", "linkat", "listen", "listxattr",
+	"llistxattr", "_llseek", "lremovexattr", "lseek", "lsetxattr", "lstat", "lstat64",
+	"madvise", "map_shadow_stack", "membarrier", "memfd_create", "memfd_secret",
+	"mincore", "mkdir", "mkdirat", "mknod", "mknodat", "mlock", "mlock2", "mlockall",
+	"mmap", "mmap2", "mprotect", "mq_getsetattr", "mq_notify", "mq_open",
+	"mq_timedreceive", "mq_timedreceive_time64", "mq_timedsend", "mq_timedsend_time64",
+	"mq_unlink", "mremap", "msgctl", "msgget", "msgrcv", "msgsnd", "msync", "munlock",
+	"munlockall", "munmap", "name_to_handle_at", "nanosleep", "newfstatat", "_newselect",
+	"open", "openat", "openat2", "pause", "pidfd_open", "pidfd_send_signal", "pipe",
+	"pipe2", "pkey_alloc", "pkey_free", "pkey_mprotect", "poll", "ppoll", "ppoll_time64",
+	"prctl", "pread64", "preadv", "preadv2", "prlimit64", "process_mrelease", "pselect6",
+	"pselect6_time64", "pwrite64", "pwritev", "pwritev2", "read", "readahead",
+	"readlink", "readlinkat", "readv", "recv", "recvfrom", "recvmmsg",
+	"recvmmsg_time64", "recvmsg", "remap_file_pages", "removexattr", "rename",
+	"renameat", "renameat2", "restart_syscall", "rmdir", "rseq", "rt_sigaction",
+	"rt_sigpending", "rt_sigprocmask", "rt_sigqueueinfo", "rt_sigreturn",
+	"rt_sigsuspend", "rt_sigtimedwait", "rt_sigtimedwait_time64", "rt_tgsigqueueinfo",
+	"sched_getaffinity", "sched_getattr", "sched_getparam", "sched_get_priority_max",
+	"sched_get_priority_min", "sched_getscheduler", "sched_rr_get_interval",
+	"sched_rr_get_interval_time64", "sched_setaffinity", "sched_setattr",
+	"sched_setparam", "sched_setscheduler", "sched_yield", "seccomp", "select",
+	"semctl", "semget", "semop", "semtimedop", "semtimedop_time64", "send", "sendfile",
+	"sendfile64", "sendmmsg", "sendmsg", "sendto", "setfsgid", "setfsgid32", "setfsuid",
+	"setfsuid32", "setgid", "setgid32", "setgroups", "setgroups32", "setitimer",
+	"setpgid", "setpriority", "setregid", "setregid32", "setresgid", "setresgid32",
+	"setresuid", "setresuid32", "setreuid", "setreuid32", "setrlimit",
+	"set_robust_list", "setsid", "setsockopt", "set_thread_area", "set_tid_address",
+	"setuid", "setuid32", "setxattr", "shmat", "shmctl", "shmdt", "shmget", "shutdown",
+	"sigaltstack", "signalfd", "signalfd4", "sigprocmask", "sigreturn", "socketcall",
+	"socketpair", "splice", "stat", "stat64", "statfs", "statfs64", "statx", "symlink",
+	"symlinkat", "sync", "sync_file_range", "syncfs", "sysinfo", "tee", "tgkill", "time",
+	"timer_create", "timer_delete", "timer_getoverrun", "timer_gettime",
+	"timer_gettime64", "timer_settime", "timer_settime64", "timerfd_create",
+	"timerfd_gettime", "timerfd_gettime64", "timerfd_settime", "timerfd_settime64",
+	"times", "tkill", "truncate", "truncate64", "ugetrlimit", "umask", "uname", "unlink",
+	"unlinkat", "utime", "utimensat", "utimensat_time64", "utimes", "vfork", "vmsplice",
+	"wait4", "waitid", "waitpid", "write", "writev",
+}
+
+// cloneNamespaceFlags are the clone flags creating namespaces, which the
+// built-in profile doesn't allow.
+const cloneNamespaceFlags = unix.CLONE_NEWNS | unix.CLONE_NEWUTS | unix.CLONE_NEWIPC |
+	unix.CLONE_NEWUSER | unix.CLONE_NEWPID | unix.CLONE_NEWNET | unix.CLONE_NEWCGROUP
+
+// builtinSeccompProfile returns the seccomp profile of specs without one
+// when the configuration has none.
+func builtinSeccompProfile() *specs.LinuxSeccomp {
+	eperm, enosys := uint(unix.EPERM), uint(unix.ENOSYS)
+	s := &specs.LinuxSeccomp{
+		DefaultAction:   specs.ActErrno,
+		DefaultErrnoRet: &eperm,
+		Syscalls: []specs.LinuxSyscall{
+			{Names: defaultSyscalls, Action: specs.ActAllow},
+			// Threads and processes, but not namespaces. clone3 passes its
+			// flags in memory a filter can't read, so C libraries are made
+			// to fall back to clone.
+			{Names: []string{"clone"}, Action: specs.ActAllow, Args: []specs.LinuxSeccompArg{
+				{Index: cloneFlagsArg, Value: cloneNamespaceFlags, ValueTwo: 0, Op: specs.OpMaskedEqual},
+			}},
+			{Names: []string{"clone3"}, Action: specs.ActErrno, ErrnoRet: &enosys},
+			// Sockets of any family but vsock, which reaches the host.
+			{Names: []string{"socket"}, Action: specs.ActAllow, Args: []specs.LinuxSeccompArg{
+				{Index: 0, Value: unix.AF_VSOCK, Op: specs.OpNotEqual},
+			}},
+		},
+	}
+	// The execution domains the personality syscall may switch to, and
+	// querying it, but not turning address space randomization off.
+	for _, persona := range []uint64{perLinux, perLinux32, uname26, uname26 | perLinux32, 0xffffffff} {
+		s.Syscalls = append(s.Syscalls, specs.LinuxSyscall{
+			Names: []string{"personality"}, Action: specs.ActAllow,
+			Args: []specs.LinuxSeccompArg{{Index: 0, Value: persona, Op: specs.OpEqualTo}},
+		})
+	}
+	return s
+}
+
+// applyDefaultSecurity gives spec the seccomp profile and capabilities of
+// the configuration when it has none.
+func applyDefaultSecurity(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Linux.Seccomp == nil {
+		switch defaultSeccompProfile {
+		case SeccompUnconfined:
+		case "":
+			spec.Linux.Seccomp = builtinSeccompProfile()
+		default:
+			var err error
+			if spec.Linux.Seccomp, err = loadSeccompProfile(defaultSeccompProfile); err != nil {
+				return err
+			}
+		}
+	}
+	if spec.Process == nil {
+		// The default shell runs with them too.
+		spec.Process = &specs.Process{}
+	}
+	if spec.Process.Capabilities == nil {
+		caps := defaultCapabilities
+		spec.Process.Capabilities = &specs.LinuxCapabilities{
+			Bounding:  append([]string(nil), caps...),
+			Effective: append([]string(nil), caps...),
+			Permitted: append([]string(nil), caps...),
+		}
+	}
+	return nil
+}
+
+// applyPrivileged makes spec that of a privileged container.
+func applyPrivileged(spec *specs.Spec) error {
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	if spec.Process == nil {
+		spec.Process = &specs.Process{}
+	}
+	all := ownCapabilities()
+	spec.Process.Capabilities = &specs.LinuxCapabilities{
+		Bounding:  all,
+		Effective: all,
+		Permitted: all,
+	}
+	spec.Linux.Seccomp = nil
+
+	devices, err := hostDevices("/dev")
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if !slices.ContainsFunc(spec.Linux.Devices, func(o specs.LinuxDevice) bool { return o.Path == d.Path }) {
+			spec.Linux.Devices = append(spec.Linux.Devices, d)
+		}
+	}
+	if cgroupsAvailable() {
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, specs.LinuxDeviceCgroup{Allow: true, Access: "rwm"})
+	}
+	return nil
+}
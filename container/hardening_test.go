@@ -0,0 +1,91 @@
+package container
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyDefaultSecurity(t *testing.T) {
+	origProfile, origCaps := defaultSeccompProfile, defaultCapabilities
+	defer func() { defaultSeccompProfile, defaultCapabilities = origProfile, origCaps }()
+	defaultSeccompProfile = ""
+
+	spec := &specs.Spec{}
+	if err := applyDefaultSecurity(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Linux.Seccomp == nil || spec.Linux.Seccomp.DefaultAction != specs.ActErrno {
+		t.Fatalf("seccomp = %+v, want the built-in profile", spec.Linux.Seccomp)
+	}
+	f, err := compileSeccomp(spec.Linux.Seccomp)
+	if err != nil {
+		t.Skipf("can't compile seccomp filters here: %v", err)
+	}
+	// clone is filtered on the argument holding its flags.
+	arch, _ := nativeAudit()
+	args := make([]uint64, cloneFlagsArg+1)
+	args[cloneFlagsArg] = unix.CLONE_VM | unix.CLONE_THREAD
+	if got := runFilter(t, f, arch, syscallNumbers["clone"], args...); got != unix.SECCOMP_RET_ALLOW {
+		t.Errorf("cloning a thread: got %#x, want it allowed", got)
+	}
+	args[cloneFlagsArg] |= unix.CLONE_NEWUSER
+	if got := runFilter(t, f, arch, syscallNumbers["clone"], args...); got == unix.SECCOMP_RET_ALLOW {
+		t.Error("cloning into a user namespace was allowed")
+	}
+	caps := spec.Process.Capabilities
+	if caps == nil || !slices.Equal(caps.Bounding, defaultCapabilities) || !slices.Equal(caps.Effective, defaultCapabilities) || len(caps.Ambient) > 0 {
+		t.Errorf("capabilities = %+v, want the default set", caps)
+	}
+	if slices.Contains(caps.Bounding, "CAP_SYS_ADMIN") {
+		t.Error("the default capabilities include CAP_SYS_ADMIN")
+	}
+
+	// What the spec sets is kept.
+	own := &specs.LinuxSeccomp{DefaultAction: specs.ActAllow}
+	spec = &specs.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: []string{"CAP_KILL"}}},
+		Linux:   &specs.Linux{Seccomp: own},
+	}
+	if err := applyDefaultSecurity(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Linux.Seccomp != own || !slices.Equal(spec.Process.Capabilities.Bounding, []string{"CAP_KILL"}) {
+		t.Errorf("the defaults replaced the spec's own: %+v %+v", spec.Linux.Seccomp, spec.Process.Capabilities)
+	}
+
+	defaultSeccompProfile, defaultCapabilities = SeccompUnconfined, []string{"CAP_CHOWN"}
+	spec = &specs.Spec{}
+	if err := applyDefaultSecurity(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Linux.Seccomp != nil || !slices.Equal(spec.Process.Capabilities.Permitted, []string{"CAP_CHOWN"}) {
+		t.Errorf("the configuration wasn't applied: %+v %+v", spec.Linux.Seccomp, spec.Process.Capabilities)
+	}
+}
+
+func TestApplyPrivileged(t *testing.T) {
+	spec := &specs.Spec{
+		Process: &specs.Process{Capabilities: &specs.LinuxCapabilities{Bounding: []string{"CAP_KILL"}}},
+		Linux:   &specs.Linux{Seccomp: builtinSeccompProfile()},
+	}
+	if err := applyPrivileged(spec); err != nil {
+		t.Fatal(err)
+	}
+	if spec.Linux.Seccomp != nil {
+		t.Error("a privileged container kept its seccomp filter")
+	}
+	if caps := spec.Process.Capabilities; !slices.Contains(caps.Bounding, "CAP_SYS_ADMIN") || !slices.Contains(caps.Effective, "CAP_SYS_ADMIN") {
+		t.Errorf("capabilities = %+v, want all of them", caps)
+	}
+	if !slices.ContainsFunc(spec.Linux.Devices, func(d specs.LinuxDevice) bool {
+		return d.Path == "/dev/null" && d.Type == "c" && d.Major == 1 && d.Minor == 3
+	}) {
+		t.Errorf("devices = %+v, want those of the host", spec.Linux.Devices)
+	}
+	if slices.ContainsFunc(spec.Linux.Devices, func(d specs.LinuxDevice) bool { return d.Path == "/dev/console" }) {
+		t.Error("the host console was passed through")
+	}
+}
@@ -0,0 +1,345 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The monitor of a detached container run with a HealthCheck execs its
+// probe in the container every interval, as "containish exec" would, and
+// records the results in the state. A container failing Retries probes in
+// a row is unhealthy, and the liveness action of the check is taken: the
+// container is restarted, its init process signalled, or nothing more.
+
+// Health states of a container with a HealthCheck.
+const (
+	// HealthStarting is the state until the first probe succeeds or the
+	// probes fail Retries times in a row.
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+// Liveness actions taken when a container becomes unhealthy.
+const (
+	// HealthActionNone only marks the container unhealthy.
+	HealthActionNone = "none"
+	// HealthActionRestart stops the container as stop does and starts it
+	// again, whatever its restart policy.
+	HealthActionRestart = "restart"
+	// HealthActionSignal sends HealthCheck.Signal to the init process,
+	// again after each further Retries failures.
+	HealthActionSignal = "signal"
+)
+
+// Defaults of a HealthCheck.
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultHealthTimeout  = 30 * time.Second
+	DefaultHealthRetries  = 3
+)
+
+const (
+	// healthLogSize is how many probe results the state keeps.
+	healthLogSize = 5
+	// healthOutputLimit bounds the output kept of a probe.
+	healthOutputLimit = 4096
+)
+
+// HealthCheck is a probe run in a detached container to tell whether it is
+// healthy, and what to do when it is not.
+type HealthCheck struct {
+	// Cmd is the probe, run like an exec. It succeeds when it exits 0.
+	Cmd []string `json:"cmd"`
+	// Interval is the time between probes, DefaultHealthInterval if zero.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Timeout is how long a probe may run before it is killed and fails,
+	// DefaultHealthTimeout if zero.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// StartPeriod is how long a starting container has to pass its first
+	// probe. Probes failing meanwhile don't count.
+	StartPeriod time.Duration `json:"startPeriod,omitempty"`
+	// Retries is how many probes must fail in a row for the container to
+	// be unhealthy, DefaultHealthRetries if zero.
+	Retries int `json:"retries,omitempty"`
+	// Action is the liveness action, HealthActionNone if empty.
+	Action string `json:"action,omitempty"`
+	// Signal is the signal of HealthActionSignal.
+	Signal string `json:"signal,omitempty"`
+}
+
+// Health is the health of a container with a HealthCheck.
+type Health struct {
+	Status string `json:"status"`
+	// FailingStreak counts the probes that failed since the last one
+	// that passed, or since the last signal of HealthActionSignal.
+	FailingStreak int `json:"failingStreak"`
+	// Log holds the results of the last probes, oldest first.
+	Log []HealthResult `json:"log,omitempty"`
+}
+
+// HealthResult is the result of a probe.
+type HealthResult struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exitCode"`
+	// Output is the start of what the probe wrote to stdout and stderr.
+	Output string `json:"output,omitempty"`
+}
+
+// ParseHealthCmd parses a --health-cmd value: a JSON array run as is, or a
+// command run with /bin/sh -c.
+func ParseHealthCmd(value string) ([]string, error) {
+	if !strings.HasPrefix(strings.TrimSpace(value), "[") {
+		if strings.TrimSpace(value) == "" {
+			return nil, fmt.Errorf("invalid health command: empty")
+		}
+		return []string{"/bin/sh", "-c", value}, nil
+	}
+	var cmd []string
+	if err := json.Unmarshal([]byte(value), &cmd); err != nil || len(cmd) == 0 || cmd[0] == "" {
+		return nil, fmt.Errorf("invalid health command %s: expected a JSON array of strings", value)
+	}
+	return cmd, nil
+}
+
+// ParseHealthAction parses a --health-action value: none, restart or
+// signal:<signal>, returning the action and signal of a HealthCheck.
+func ParseHealthAction(value string) (action, signal string, err error) {
+	name, sig, hasSig := strings.Cut(value, ":")
+	switch name {
+	case HealthActionNone, HealthActionRestart:
+		if !hasSig {
+			return name, "", nil
+		}
+	case HealthActionSignal:
+		if _, err := ParseSignal(sig); hasSig && err == nil {
+			return name, sig, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid health action %q: expected none, restart or signal:<signal>", value)
+}
+
+// validateHealthCheck checks h, the HealthCheck of a container.
+func validateHealthCheck(h *HealthCheck) error {
+	if h == nil {
+		return nil
+	}
+	if len(h.Cmd) == 0 || h.Cmd[0] == "" {
+		return fmt.Errorf("invalid health check: no command given")
+	}
+	if h.Interval < 0 || h.Timeout < 0 || h.StartPeriod < 0 || h.Retries < 0 {
+		return fmt.Errorf("invalid health check: negative interval, timeout, start period or retries")
+	}
+	switch h.Action {
+	case "", HealthActionNone, HealthActionRestart:
+	case HealthActionSignal:
+		if _, err := ParseSignal(h.Signal); err != nil {
+			return fmt.Errorf("invalid health check signal: %w", err)
+		}
+	default:
+		return fmt.Errorf("invalid health action %q", h.Action)
+	}
+	return nil
+}
+
+// withDefaults returns h with the defaults of the fields left unset.
+func (h HealthCheck) withDefaults() HealthCheck {
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthTimeout
+	}
+	if h.Retries == 0 {
+		h.Retries = DefaultHealthRetries
+	}
+	if h.Action == "" {
+		h.Action = HealthActionNone
+	}
+	return h
+}
+
+// recordProbe adds res to h, given whether the container is still in the
+// start period of check, and reports whether the liveness action is due.
+func (h *Health) recordProbe(check HealthCheck, res HealthResult, starting bool) (act bool) {
+	h.Log = append(h.Log, res)
+	if len(h.Log) > healthLogSize {
+		h.Log = h.Log[len(h.Log)-healthLogSize:]
+	}
+	if res.ExitCode == 0 {
+		h.Status, h.FailingStreak = HealthHealthy, 0
+		return false
+	}
+	if starting && h.Status == HealthStarting {
+		return false
+	}
+	h.FailingStreak++
+	if h.FailingStreak < check.Retries {
+		return false
+	}
+	h.Status = HealthUnhealthy
+	if h.FailingStreak > check.Retries {
+		return false
+	}
+	if check.Action == HealthActionSignal {
+		// Count the next failures from the signal.
+		h.FailingStreak = 0
+	}
+	return check.Action != HealthActionNone
+}
+
+// runHealthChecks probes c, as its monitor, until ctx is done. It calls
+// restart when the container has to be restarted, and returns meanwhile.
+func runHealthChecks(ctx context.Context, c *Container, restart func()) {
+	check := c.Options.HealthCheck.withDefaults()
+	if c = waitRunning(ctx, c); c == nil {
+		return
+	}
+	started := time.Now()
+	if _, err := updateHealth(c, func(*Health) {}); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		res := probe(ctx, c, check)
+		if ctx.Err() != nil {
+			return
+		}
+		starting := time.Since(started) < check.StartPeriod
+		var act bool
+		health, err := updateHealth(c, func(h *Health) {
+			act = h.recordProbe(check, res, starting)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			continue
+		}
+		if health == nil {
+			// The container was started again meanwhile.
+			return
+		}
+		if !act {
+			continue
+		}
+		fmt.Fprintf(stageOut, "MONITOR: Container %s is unhealthy after %d failed probes, taking action %s\n", c.Id, check.Retries, check.Action)
+		switch check.Action {
+		case HealthActionRestart:
+			restart()
+			return
+		case HealthActionSignal:
+			sig, _ := ParseSignal(check.Signal)
+			if err := signalInit(c, sig); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+	}
+}
+
+// updateHealth applies record to the health of c, starting from
+// HealthStarting, and saves it. It returns the health then, or nil if c has
+// another init process by now. The health event is sent if the status
+// changed.
+func updateHealth(c *Container, record func(*Health)) (*Health, error) {
+	var health *Health
+	var prev string
+	var saved *Container
+	err := updateState(c.Id, func(s *Container) error {
+		if s.InitProcessPiD != c.InitProcessPiD || !s.Status.running() {
+			return nil
+		}
+		if s.Health == nil {
+			s.Health = &Health{Status: HealthStarting}
+		} else {
+			prev = s.Health.Status
+		}
+		record(s.Health)
+		health, saved = s.Health, s
+		return nil
+	})
+	if err != nil || health == nil {
+		return nil, err
+	}
+	if health.Status != prev {
+		fmt.Fprintf(stageOut, "MONITOR: Container %s is %s\n", c.Id, health.Status)
+		if err := sendWebhook(EventHealth, saved); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	return health, nil
+}
+
+// probe runs the probe of check in c, killing it after the timeout.
+func probe(ctx context.Context, c *Container, check HealthCheck) HealthResult {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+	res := HealthResult{Start: time.Now()}
+	var out cappedBuffer
+	cmd, _, err := startExec(c, ExecOptions{Args: check.Cmd}, nil, &out, &out)
+	if err != nil {
+		res.End, res.ExitCode, res.Output = time.Now(), probeStartCode(err), err.Error()
+		return res
+	}
+	// Don't wait on the output of processes the probe left behind.
+	cmd.WaitDelay = time.Second
+	stop := context.AfterFunc(ctx, func() { _ = cmd.Process.Kill() })
+	code, err := exitCode(cmd.Wait())
+	stop()
+	res.End, res.ExitCode, res.Output = time.Now(), code, strings.TrimSpace(string(out))
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.ExitCode, res.Output = -1, fmt.Sprintf("probe timed out after %v", check.Timeout)
+	case err != nil:
+		res.ExitCode, res.Output = -1, err.Error()
+	}
+	return res
+}
+
+// probeStartCode is the exit code of a probe that failed to start, as a
+// shell would report it.
+func probeStartCode(err error) int {
+	switch {
+	case errors.Is(err, ErrCommandNotFound):
+		return 127
+	case errors.Is(err, ErrNotExecutable):
+		return 126
+	}
+	return -1
+}
+
+// signalInit sends sig to the init process of c.
+func signalInit(c *Container, sig unix.Signal) error {
+	pidfd, err := openInit(c)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		return fmt.Errorf("failed to signal container %s: %w", c.Id, err)
+	}
+	return nil
+}
+
+// cappedBuffer keeps the first healthOutputLimit bytes written to it.
+type cappedBuffer []byte
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := healthOutputLimit - len(*b); n > 0 {
+		*b = append(*b, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,109 @@
+package container
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHealthCheck(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  []string
+	}{
+		{"curl -f localhost", []string{"/bin/sh", "-c", "curl -f localhost"}},
+		{`["/bin/probe", "--ready"]`, []string{"/bin/probe", "--ready"}},
+		{"", nil},
+		{"[]", nil},
+		{`["/bin/probe"`, nil},
+	} {
+		got, err := ParseHealthCmd(tt.value)
+		if (err == nil) != (tt.want != nil) || !slices.Equal(got, tt.want) {
+			t.Errorf("ParseHealthCmd(%q) = %q, %v, want %q", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ value, action, signal string }{
+		{"none", HealthActionNone, ""},
+		{"restart", HealthActionRestart, ""},
+		{"signal:HUP", HealthActionSignal, "HUP"},
+		{"signal", "", ""},
+		{"signal:BOGUS", "", ""},
+		{"restart:3", "", ""},
+		{"kill", "", ""},
+	} {
+		action, signal, err := ParseHealthAction(tt.value)
+		if (err == nil) != (tt.action != "") || action != tt.action || signal != tt.signal {
+			t.Errorf("ParseHealthAction(%q) = %q, %q, %v", tt.value, action, signal, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		check HealthCheck
+		ok    bool
+	}{
+		{HealthCheck{Cmd: []string{"/probe"}}, true},
+		{HealthCheck{Cmd: []string{"/probe"}, Action: HealthActionSignal, Signal: "USR1"}, true},
+		{HealthCheck{}, false},
+		{HealthCheck{Cmd: []string{"/probe"}, Interval: -time.Second}, false},
+		{HealthCheck{Cmd: []string{"/probe"}, Action: HealthActionSignal}, false},
+		{HealthCheck{Cmd: []string{"/probe"}, Action: "reboot"}, false},
+	} {
+		if err := validateHealthCheck(&tt.check); (err == nil) != tt.ok {
+			t.Errorf("validateHealthCheck(%+v) = %v", tt.check, err)
+		}
+	}
+}
+
+func TestRecordProbe(t *testing.T) {
+	probes := func(check HealthCheck, results string, starting int) string {
+		h := &Health{Status: HealthStarting}
+		var got []string
+		for i, r := range results {
+			code := 0
+			if r == 'x' {
+				code = 1
+			}
+			act := h.recordProbe(check.withDefaults(), HealthResult{ExitCode: code}, i < starting)
+			s := fmt.Sprintf("%s/%d", h.Status, h.FailingStreak)
+			if act {
+				s += "!"
+			}
+			got = append(got, s)
+		}
+		if len(h.Log) > healthLogSize {
+			t.Errorf("kept %d results", len(h.Log))
+		}
+		return strings.Join(got, " ")
+	}
+
+	restart := HealthCheck{Retries: 2, Action: HealthActionRestart}
+	if got, want := probes(restart, "xxxx", 0), "starting/1 unhealthy/2! unhealthy/3 unhealthy/4"; got != want {
+		t.Errorf("restart: got %s, want %s", got, want)
+	}
+	// Failures of the start period don't count until a probe passes.
+	if got, want := probes(restart, "xxx.xx", 3), "starting/0 starting/0 starting/0 healthy/0 healthy/1 unhealthy/2!"; got != want {
+		t.Errorf("start period: got %s, want %s", got, want)
+	}
+	signal := HealthCheck{Retries: 2, Action: HealthActionSignal, Signal: "HUP"}
+	if got, want := probes(signal, "xxxxx.", 0), "starting/1 unhealthy/0! unhealthy/1 unhealthy/0! unhealthy/1 healthy/0"; got != want {
+		t.Errorf("signal: got %s, want %s", got, want)
+	}
+	if got, want := probes(HealthCheck{}, "xxxx", 0), "starting/1 starting/2 unhealthy/3 unhealthy/4"; got != want {
+		t.Errorf("none: got %s, want %s", got, want)
+	}
+}
+
+func TestCappedBuffer(t *testing.T) {
+	var b cappedBuffer
+	for i := 0; i < 3; i++ {
+		if n, err := b.Write(make([]byte, healthOutputLimit/2+1)); err != nil || n != healthOutputLimit/2+1 {
+			t.Fatalf("Write = %d, %v", n, err)
+		}
+	}
+	if len(b) != healthOutputLimit {
+		t.Errorf("kept %d bytes, want %d", len(b), healthOutputLimit)
+	}
+}
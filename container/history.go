@@ -0,0 +1,236 @@
+package container
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// The daemon samples the cgroup of each running container every
+// HistoryInterval into a ring buffer file of its state dir, holding the
+// last historySamples samples of fixed size after a header giving the
+// capacity, the slot the next sample goes to and how many are held:
+//
+//	magic [4]byte | capacity uint32 | next uint32 | count uint32
+//	time int64 | cpu uint64 | memory uint64 | swap uint64 | pids uint64
+//
+// little endian, so a day of samples takes under 120KiB and writing one
+// rewrites a single slot and the header. Recommend derives limits from the
+// 95th percentile of the memory and CPU use the history holds, with
+// RecommendHeadroom on top.
+
+// HistoryInterval is how often the daemon samples the usage of containers
+// by default.
+const HistoryInterval = 30 * time.Second
+
+// historySamples is how many samples the history of a container holds, a
+// day at HistoryInterval.
+const historySamples = 2880
+
+// historyFileName is the usage history of the state dir of a container.
+const historyFileName = "usage.history"
+
+const (
+	historyMagic      = "CUH1"
+	historyHeaderSize = 16
+	historySampleSize = 40
+)
+
+// minRecommendSamples is how many samples Recommend needs.
+const minRecommendSamples = 10
+
+// RecommendHeadroom is what Recommend adds to the 95th percentile of the
+// usage of a container.
+const RecommendHeadroom = 0.25
+
+// UsageSample is a sample of the usage history of a container.
+type UsageSample struct {
+	Time          time.Time `json:"time"`
+	CPUUsageUsec  uint64    `json:"cpuUsageUsec"`
+	MemoryCurrent uint64    `json:"memoryCurrent"`
+	SwapCurrent   uint64    `json:"swapCurrent"`
+	PidsCurrent   uint64    `json:"pidsCurrent"`
+	// CPUs is the CPUs the container used since the sample before, unknown
+	// for the first and after its cgroup was created again, as when it
+	// restarted.
+	CPUs *float64 `json:"cpus,omitempty"`
+}
+
+// RecordUsage adds the sample s, taken at t, to the usage history of its
+// container, replacing the oldest once it is full.
+func RecordUsage(s *Stats, t time.Time) error {
+	f, err := os.OpenFile(filepath.Join(StateDir(s.Id), historyFileName), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, historyHeaderSize)
+	capacity, next, count := uint32(historySamples), uint32(0), uint32(0)
+	if n, err := f.ReadAt(header, 0); err == nil {
+		if capacity, next, count, err = parseHistoryHeader(header); err != nil {
+			return fmt.Errorf("invalid usage history of %s: %w", s.Id, err)
+		}
+	} else if n != 0 {
+		return fmt.Errorf("invalid usage history of %s: truncated header", s.Id)
+	}
+
+	sample := make([]byte, historySampleSize)
+	binary.LittleEndian.PutUint64(sample[0:], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(sample[8:], s.CPUUsageUsec)
+	binary.LittleEndian.PutUint64(sample[16:], s.MemoryCurrent)
+	binary.LittleEndian.PutUint64(sample[24:], s.SwapCurrent)
+	binary.LittleEndian.PutUint64(sample[32:], s.PidsCurrent)
+	if _, err := f.WriteAt(sample, historyHeaderSize+int64(next)*historySampleSize); err != nil {
+		return err
+	}
+	copy(header, historyMagic)
+	binary.LittleEndian.PutUint32(header[4:], capacity)
+	binary.LittleEndian.PutUint32(header[8:], (next+1)%capacity)
+	binary.LittleEndian.PutUint32(header[12:], min(count+1, capacity))
+	_, err = f.WriteAt(header, 0)
+	return err
+}
+
+// parseHistoryHeader returns the capacity, next slot and sample count of
+// a usage history header.
+func parseHistoryHeader(header []byte) (capacity, next, count uint32, err error) {
+	if string(header[:4]) != historyMagic {
+		return 0, 0, 0, errors.New("bad magic")
+	}
+	capacity = binary.LittleEndian.Uint32(header[4:])
+	next = binary.LittleEndian.Uint32(header[8:])
+	count = binary.LittleEndian.Uint32(header[12:])
+	if capacity == 0 || next >= capacity || count > capacity {
+		return 0, 0, 0, fmt.Errorf("bad header: capacity %d, next %d, count %d", capacity, next, count)
+	}
+	return capacity, next, count, nil
+}
+
+// UsageHistory returns the usage history of container id, the oldest
+// sample first. It is empty unless the daemon sampled the container.
+func UsageHistory(id string) ([]UsageSample, error) {
+	if _, err := LoadState(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(StateDir(id), historyFileName))
+	if errors.Is(err, os.ErrNotExist) || len(data) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < historyHeaderSize {
+		return nil, fmt.Errorf("invalid usage history of %s: truncated header", id)
+	}
+	capacity, next, count, err := parseHistoryHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid usage history of %s: %w", id, err)
+	}
+	samples := make([]UsageSample, 0, count)
+	for i := range count {
+		slot := (next + capacity - count + i) % capacity
+		off := historyHeaderSize + int(slot)*historySampleSize
+		if off+historySampleSize > len(data) {
+			return nil, fmt.Errorf("invalid usage history of %s: truncated sample", id)
+		}
+		b := data[off : off+historySampleSize]
+		samples = append(samples, UsageSample{
+			Time:          time.Unix(0, int64(binary.LittleEndian.Uint64(b[0:]))).UTC(),
+			CPUUsageUsec:  binary.LittleEndian.Uint64(b[8:]),
+			MemoryCurrent: binary.LittleEndian.Uint64(b[16:]),
+			SwapCurrent:   binary.LittleEndian.Uint64(b[24:]),
+			PidsCurrent:   binary.LittleEndian.Uint64(b[32:]),
+		})
+	}
+	setCPUs(samples)
+	return samples, nil
+}
+
+// setCPUs sets the CPUs of each sample of samples from the one before.
+func setCPUs(samples []UsageSample) {
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], &samples[i]
+		wall := cur.Time.Sub(prev.Time).Microseconds()
+		if wall <= 0 || cur.CPUUsageUsec < prev.CPUUsageUsec {
+			continue
+		}
+		cpus := float64(cur.CPUUsageUsec-prev.CPUUsageUsec) / float64(wall)
+		cur.CPUs = &cpus
+	}
+}
+
+// Recommendation is the limits Recommend suggests for a container.
+type Recommendation struct {
+	Id string `json:"id"`
+	// Samples is how many samples of the usage history, from Since to
+	// Until, it is based on.
+	Samples int       `json:"samples"`
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	// MemoryP95 and MemoryPeak are the 95th percentile and the highest
+	// memory use sampled, in bytes, and CPUsP95 and CPUsPeak those of the
+	// CPUs used between samples.
+	MemoryP95  uint64  `json:"memoryP95"`
+	MemoryPeak uint64  `json:"memoryPeak"`
+	CPUsP95    float64 `json:"cpusP95"`
+	CPUsPeak   float64 `json:"cpusPeak"`
+	// Memory and CPUs are the suggested limits, as for RunOptions.Memory
+	// and RunOptions.CPUs.
+	Memory int64   `json:"memory"`
+	CPUs   float64 `json:"cpus"`
+	// CurrentMemory and CurrentCPUs are the limits of the container, zero
+	// without one.
+	CurrentMemory int64   `json:"currentMemory,omitempty"`
+	CurrentCPUs   float64 `json:"currentCPUs,omitempty"`
+}
+
+// Recommend suggests memory and CPU limits for container id from its usage
+// history: the 95th percentile of its use with RecommendHeadroom on top,
+// the memory rounded up to a MiB and the CPUs to a hundredth.
+func Recommend(id string) (*Recommendation, error) {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := UsageHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) < minRecommendSamples {
+		return nil, fmt.Errorf("not enough usage history of container %s to recommend limits: %d samples, at least %d needed, which the daemon records while it runs", id, len(samples), minRecommendSamples)
+	}
+	r := recommend(samples)
+	r.Id = id
+	if c.Reservation != nil {
+		r.CurrentMemory, r.CurrentCPUs = c.Reservation.Memory, c.Reservation.CPUs
+	}
+	return r, nil
+}
+
+// recommend computes the recommendation of samples.
+func recommend(samples []UsageSample) *Recommendation {
+	r := &Recommendation{Samples: len(samples), Since: samples[0].Time, Until: samples[len(samples)-1].Time}
+	memory := make([]uint64, len(samples))
+	for i, s := range samples {
+		memory[i] = s.MemoryCurrent
+	}
+	var cpus []float64
+	for _, s := range samples {
+		if s.CPUs != nil {
+			cpus = append(cpus, *s.CPUs)
+		}
+	}
+	r.MemoryP95, r.MemoryPeak = percentile(memory, 95), slices.Max(memory)
+	const mib = 1 << 20
+	r.Memory = max(int64(math.Ceil(float64(r.MemoryP95)*(1+RecommendHeadroom)/mib)), 1) * mib
+	if len(cpus) > 0 {
+		r.CPUsP95, r.CPUsPeak = percentile(cpus, 95), slices.Max(cpus)
+	}
+	r.CPUs = max(math.Ceil(r.CPUsP95*(1+RecommendHeadroom)*100)/100, 0.01)
+	return r
+}
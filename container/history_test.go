@@ -0,0 +1,145 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUsageHistory(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = t.TempDir()
+	if err := saveState(&Container{Id: "web", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	if samples, err := UsageHistory("web"); err != nil || samples != nil {
+		t.Fatalf("history before any sample = %v, %v", samples, err)
+	}
+
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	record := func(i int, cpu uint64) {
+		t.Helper()
+		s := &Stats{Id: "web", CPUUsageUsec: cpu, MemoryCurrent: uint64(i) << 20, PidsCurrent: 2}
+		if err := RecordUsage(s, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record(0, 0)
+	record(1, 500000)
+	samples, err := UsageHistory("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 2 || !samples[1].Time.Equal(start.Add(time.Second)) || samples[1].MemoryCurrent != 1<<20 {
+		t.Fatalf("samples = %+v", samples)
+	}
+	if samples[0].CPUs != nil || samples[1].CPUs == nil || *samples[1].CPUs != 0.5 {
+		t.Errorf("CPUs of the samples = %v, %v, want none then 0.5", samples[0].CPUs, samples[1].CPUs)
+	}
+	info, err := os.Stat(filepath.Join(StateDir("web"), historyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(historyHeaderSize + 2*historySampleSize); info.Size() != want {
+		t.Errorf("history file of %d bytes, want %d", info.Size(), want)
+	}
+}
+
+func TestUsageHistoryWraps(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = t.TempDir()
+	if err := saveState(&Container{Id: "web", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	// A history of 3 samples.
+	path := filepath.Join(StateDir("web"), historyFileName)
+	writeFile(t, path, historyMagic+"\x03\x00\x00\x00"+strings.Repeat("\x00", 8), 0o600)
+
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		// The cgroup is created again at the fourth sample.
+		cpu := uint64(i) * 1000000
+		if i >= 3 {
+			cpu = uint64(i-3) * 1000000
+		}
+		if err := RecordUsage(&Stats{Id: "web", CPUUsageUsec: cpu, PidsCurrent: uint64(i)}, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	samples, err := UsageHistory("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pids []uint64
+	var cpus []string
+	for _, s := range samples {
+		pids = append(pids, s.PidsCurrent)
+		if s.CPUs == nil {
+			cpus = append(cpus, "-")
+		} else {
+			cpus = append(cpus, fmt.Sprint(*s.CPUs))
+		}
+	}
+	if fmt.Sprint(pids) != "[2 3 4]" || fmt.Sprint(cpus) != "[- - 1]" {
+		t.Errorf("samples of pids %v and CPUs %v, want the last 3 and no CPUs across the restart", pids, cpus)
+	}
+
+	writeFile(t, path, "junk", 0o600)
+	if _, err := UsageHistory("web"); err == nil {
+		t.Error("reading a corrupt history succeeded")
+	}
+	if err := RecordUsage(&Stats{Id: "web"}, start); err == nil {
+		t.Error("recording into a corrupt history succeeded")
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	orig := baseStateDir
+	defer func() { baseStateDir = orig }()
+	baseStateDir = t.TempDir()
+	if err := saveState(&Container{Id: "web", Status: Running, Reservation: &Reservation{Memory: 1 << 30, CPUs: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	var cpu uint64
+	for i := range 40 {
+		// 100MiB and a tenth of a CPU, but for a spike at the end.
+		memory, used := uint64(100<<20), uint64(100000)
+		if i == 39 {
+			memory, used = 400<<20, 2000000
+		}
+		cpu += used
+		if err := RecordUsage(&Stats{Id: "web", CPUUsageUsec: cpu, MemoryCurrent: memory}, start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if i == minRecommendSamples-2 {
+			if _, err := Recommend("web"); err == nil || !strings.Contains(err.Error(), "not enough usage history") {
+				t.Errorf("recommending from %d samples: got %v", i+1, err)
+			}
+		}
+	}
+
+	r, err := Recommend("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Samples != 40 || r.MemoryP95 != 100<<20 || r.MemoryPeak != 400<<20 || r.Memory != 125<<20 {
+		t.Errorf("memory of %+v, want a p95 of 100MiB and 125MiB recommended", r)
+	}
+	if r.CPUsP95 != 0.1 || r.CPUsPeak != 2 || r.CPUs != 0.13 {
+		t.Errorf("CPUs of %+v, want a p95 of 0.1 and 0.13 recommended", r)
+	}
+	if r.CurrentMemory != 1<<30 || r.CurrentCPUs != 2 {
+		t.Errorf("current limits of %+v", r)
+	}
+
+	r = recommend([]UsageSample{{Time: start}, {Time: start.Add(time.Second)}})
+	if r.Memory != 1<<20 || r.CPUs != 0.01 {
+		t.Errorf("recommendation for an idle container = %d bytes, %v CPUs, want the minimums", r.Memory, r.CPUs)
+	}
+}
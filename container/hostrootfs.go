@@ -0,0 +1,77 @@
+package container
+
+import (
+	"fmt"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A container run with the host rootfs, RunOptions.Rootfs set to
+// RootfsHost, runs a program of the host on the filesystem of the host:
+// there is no image or rootfs to prepare and no pivot_root, so what is
+// left are the namespaces, the cgroup, the seccomp filter, the
+// capabilities and the masked and read-only paths, each of which can be
+// seen at work on its own. The child stage still has a mount namespace of
+// its own, kept from propagating to the host, where it mounts the /proc
+// of the pid namespace and the /sys of the network namespace over those
+// of the host. The mounts and devices of the spec are left out, as the
+// filesystem is the host's as it is, and so are the options mounting
+// something into the rootfs, and user namespaces, whose idmapped mounts
+// need a rootfs.
+
+// RootfsHost is the Rootfs of RunOptions running the container on the
+// filesystem of the host.
+const RootfsHost = "host"
+
+// hostRootfs reports whether c runs on the filesystem of the host.
+func (c *Container) hostRootfs() bool {
+	return c.Options != nil && c.Options.Rootfs == RootfsHost
+}
+
+// validateHostRootfs checks that nothing options or spec ask for needs a
+// rootfs of its own, for a container run with the host rootfs.
+func validateHostRootfs(spec *specs.Spec, options *RunOptions) error {
+	if options.Rootfs != RootfsHost {
+		return nil
+	}
+	for _, c := range []struct {
+		set  bool
+		what string
+	}{
+		{options.Image != "", "an image"},
+		{options.Integrity, "integrity checking"},
+		{options.StorageSize > 0, "a storage quota"},
+		{options.OSRelease, "os-release"},
+		{len(options.Volumes) > 0, "volumes"},
+		{len(options.Secrets) > 0, "secrets"},
+		{options.Notify, "readiness notification"},
+		{options.Metadata, "the metadata socket"},
+		{userNamespace(spec), "a user namespace"},
+	} {
+		if c.set {
+			return fmt.Errorf("%s can't be used with the host rootfs", c.what)
+		}
+	}
+	propagation, err := rootfsPropagationFlags(spec)
+	if err != nil {
+		return err
+	}
+	if propagation&unix.MS_SHARED != 0 {
+		return fmt.Errorf("linux.rootfsPropagation %s would share the mounts of the container with the host", spec.Linux.RootfsPropagation)
+	}
+	return nil
+}
+
+// hostRootfsMounts returns the mounts of plan the child stage makes with the
+// host rootfs: those of /proc and /sys.
+func hostRootfsMounts(mounts []PlanMount) []PlanMount {
+	var kept []PlanMount
+	for _, m := range mounts {
+		switch m.Type {
+		case "proc", "sysfs", "cgroup2":
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,55 @@
+package container
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateHostRootfs(t *testing.T) {
+	userns := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.UserNamespace}}}}
+	shared := &specs.Spec{Linux: &specs.Linux{RootfsPropagation: "rshared"}}
+	for _, c := range []struct {
+		spec    *specs.Spec
+		options RunOptions
+		err     string
+	}{
+		{&specs.Spec{}, RunOptions{Rootfs: RootfsHost}, ""},
+		{userns, RunOptions{Rootfs: "/srv/rootfs"}, ""},
+		{&specs.Spec{}, RunOptions{Rootfs: RootfsHost, Image: "alpine"}, "an image can't be used"},
+		{&specs.Spec{}, RunOptions{Rootfs: RootfsHost, Volumes: []VolumeMount{{Name: "data", Target: "/data"}}}, "volumes can't be used"},
+		{userns, RunOptions{Rootfs: RootfsHost}, "a user namespace can't be used"},
+		{shared, RunOptions{Rootfs: RootfsHost}, "rshared would share"},
+	} {
+		err := validateHostRootfs(c.spec, &c.options)
+		if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Errorf("validateHostRootfs(%+v) = %v, want %q", c.options, err, c.err)
+		}
+	}
+}
+
+func TestFakeStagesHostRootfs(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	rt, specPath := fakeBundle(t, "sh", "-c", "pwd > "+out)
+	if err := rt.Run(context.Background(), "c1", specPath, fakeOptions(WithRootfs(RootfsHost))...); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	// The process runs in its working directory on the host.
+	if data, _ := os.ReadFile(out); string(data) != "/etc\n" {
+		t.Errorf("working directory %q, want /etc", data)
+	}
+	st, err := rt.State("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.hostRootfs() || st.Rootfs != "" || st.MachineID != "" {
+		t.Errorf("container run on the host rootfs %+v", st)
+	}
+	if _, err := rt.Clone(context.Background(), "c1", "c2"); err == nil || !strings.Contains(err.Error(), "host rootfs") {
+		t.Errorf("Clone = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,45 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A container with a network namespace of its own gets an /etc/hosts
+// generated in its state dir and bind mounted over that of its rootfs, as
+// many programs expect localhost, and often their hostname, to resolve
+// without a DNS server. The hostname maps to the address of the container,
+// 127.0.1.1 until it has one. A spec mounting a file of its own at
+// /etc/hosts keeps it, and containers on the host network have the hosts
+// of the host.
+
+// hostsFileName is the hosts file in the state dir of a container.
+const hostsFileName = "hosts"
+
+// containerHostsFile is where the hosts file is mounted in containers.
+const containerHostsFile = "/etc/hosts"
+
+// hostsFile returns the content of the hosts file of a container named
+// hostname, which is left out if empty, with address, an IP or empty.
+func hostsFile(hostname, address string) []byte {
+	var b strings.Builder
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	if hostname != "" {
+		if address == "" {
+			address = "127.0.1.1"
+		}
+		fmt.Fprintf(&b, "%s\t%s\n", address, hostname)
+	}
+	return []byte(b.String())
+}
+
+// writeHostsFile writes the hosts file at path in place, so a container
+// it is mounted in sees the new content.
+func writeHostsFile(path, hostname, address string) error {
+	if err := os.WriteFile(path, hostsFile(hostname, address), 0o644); err != nil {
+		return fmt.Errorf("failed to write hosts file: %w", err)
+	}
+	return nil
+}
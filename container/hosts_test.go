@@ -0,0 +1,46 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostsFile(t *testing.T) {
+	for _, c := range []struct {
+		hostname, address, want string
+	}{
+		{"", "", "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+		{"box", "", "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n127.0.1.1\tbox\n"},
+		{"box", "10.88.0.2", "127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n10.88.0.2\tbox\n"},
+	} {
+		if got := string(hostsFile(c.hostname, c.address)); got != c.want {
+			t.Errorf("hostsFile(%q, %q) = %q, want %q", c.hostname, c.address, got, c.want)
+		}
+	}
+}
+
+func TestWriteHostsFileInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), hostsFileName)
+	if err := writeHostsFile(path, "box", ""); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeHostsFile(path, "box", "10.88.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A bind mount of the file only sees writes to the same inode.
+	if !os.SameFile(before, after) {
+		t.Error("the hosts file was replaced rather than rewritten")
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(hostsFile("box", "10.88.0.2")) {
+		t.Errorf("hosts file = %q", data)
+	}
+}
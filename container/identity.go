@@ -0,0 +1,185 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// systemd, dbus and the programs using sd_id128_get_machine() identify the
+// system they run on by /etc/machine-id, and misbehave without one or when
+// containers share it with the host, as a rootfs copied from the host or
+// an image built with one does. Each container gets a machine ID of its
+// own, generated the first time it runs and kept in its state across runs,
+// written to its state dir and bind mounted read-only at /etc/machine-id
+// by the child stage, as the hosts file is, unless the spec mounts a file
+// there. A container run from an image with RunOptions.OSRelease also gets
+// the os-release of its rootfs with IMAGE_ID and IMAGE_VERSION set from
+// the image, from its title and version labels or its reference, mounted
+// over /etc/os-release, or what that links to.
+
+// machineIDFileName and osReleaseFileName are the identity files in the
+// state dir of a container.
+const (
+	machineIDFileName = "machine-id"
+	osReleaseFileName = "os-release"
+)
+
+// containerMachineIDFile is where the machine ID is mounted in containers,
+// and containerOSReleaseFiles where os-release is looked up, in order.
+const containerMachineIDFile = "/etc/machine-id"
+
+var containerOSReleaseFiles = []string{"/etc/os-release", "/usr/lib/os-release"}
+
+// The labels of an image naming it and its version.
+const (
+	labelImageTitle   = "org.opencontainers.image.title"
+	labelImageVersion = "org.opencontainers.image.version"
+)
+
+// newMachineID returns a random machine ID, 32 lowercase hex digits of a
+// version 4 UUID as systemd generates them.
+func newMachineID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate machine ID: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return hex.EncodeToString(id[:]), nil
+}
+
+// writeMachineID writes machineID to the state dir and returns its path,
+// for the child stage to mount at /etc/machine-id, or empty if the spec
+// mounts a file there itself.
+func writeMachineID(spec *specs.Spec, stateDir, machineID string) (string, error) {
+	if hasMountAt(spec, containerMachineIDFile) {
+		return "", nil
+	}
+	path := filepath.Join(stateDir, machineIDFileName)
+	if err := os.WriteFile(path, []byte(machineID+"\n"), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write machine ID: %w", err)
+	}
+	return path, nil
+}
+
+// applyOSRelease writes the os-release of rootfs, with the identity of
+// img, to the state dir and bind mounts it over that of the container of
+// spec, unless the spec mounts a file there itself.
+func applyOSRelease(spec *specs.Spec, stateDir, rootfs string, img *Image) error {
+	var data []byte
+	for _, p := range containerOSReleaseFiles {
+		f, err := openInRoot(rootfs, p)
+		if err != nil {
+			continue
+		}
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		break
+	}
+	target := osReleaseTarget(rootfs)
+	if hasMountAt(spec, target) {
+		return nil
+	}
+	id, version := imageIdentity(img)
+	data = setOSRelease(data, map[string]string{"IMAGE_ID": id, "IMAGE_VERSION": version})
+	file := filepath.Join(stateDir, osReleaseFileName)
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write os-release: %w", err)
+	}
+	spec.Mounts = append(spec.Mounts, specs.Mount{Destination: target, Type: "bind", Source: file, Options: []string{"bind", "ro"}})
+	return nil
+}
+
+// osReleaseTarget returns where to mount os-release in rootfs:
+// /etc/os-release, or what it links to, as a bind mount would follow the
+// link from the host.
+func osReleaseTarget(rootfs string) string {
+	target := containerOSReleaseFiles[0]
+	link, err := os.Readlink(filepath.Join(rootfs, target))
+	if err != nil {
+		return target
+	}
+	if !path.IsAbs(link) {
+		link = path.Join(path.Dir(target), link)
+	}
+	return path.Clean(link)
+}
+
+var (
+	// invalidImageIDChars are those IMAGE_ID can't have, and
+	// plainOSReleaseValue matches the values needing no quotes.
+	invalidImageIDChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+	plainOSReleaseValue = regexp.MustCompile(`^[A-Za-z0-9._+:-]+$`)
+)
+
+// imageIdentity returns the IMAGE_ID and IMAGE_VERSION of img: its title
+// label, or the last element of its repository, and its version label, or
+// its tag or the start of its digest.
+func imageIdentity(img *Image) (id, version string) {
+	labels := img.Config.Labels
+	id, version = labels[labelImageTitle], labels[labelImageVersion]
+	if r, err := ParseImageRef(img.Ref); err == nil {
+		if id == "" {
+			id = r.Repository[strings.LastIndex(r.Repository, "/")+1:]
+		}
+		if version == "" {
+			version = r.Tag
+		}
+		if version == "" {
+			_, hexDigest, _ := strings.Cut(r.Digest, ":")
+			version = hexDigest[:min(12, len(hexDigest))]
+		}
+	}
+	id = strings.Trim(invalidImageIDChars.ReplaceAllString(strings.ToLower(id), "-"), "-")
+	return id, version
+}
+
+// setOSRelease returns the os-release data with the variables of vars set,
+// in place of the lines assigning them, and the others appended in order
+// of name. Empty values are left out.
+func setOSRelease(data []byte, vars map[string]string) []byte {
+	var b bytes.Buffer
+	set := map[string]bool{}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		key, _, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if value, override := vars[key]; ok && override {
+			if value != "" && !set[key] {
+				fmt.Fprintf(&b, "%s=%s\n", key, osReleaseValue(value))
+			}
+			set[key] = true
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	for _, key := range sortedKeys(vars) {
+		if value := vars[key]; !set[key] && value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, osReleaseValue(value))
+		}
+	}
+	return b.Bytes()
+}
+
+// osReleaseValue quotes value as a shell-compatible os-release value.
+func osReleaseValue(value string) string {
+	if plainOSReleaseValue.MatchString(value) {
+		return value
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return `"` + r.Replace(value) + `"`
+}
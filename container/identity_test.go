@@ -0,0 +1,104 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestNewMachineID(t *testing.T) {
+	a, err := newMachineID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newMachineID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{12}4[0-9a-f]{3}[89ab][0-9a-f]{15}$`).MatchString(a) {
+		t.Errorf("machine ID %q isn't a version 4 UUID in hex", a)
+	}
+	if a == b {
+		t.Errorf("two machine IDs are both %q", a)
+	}
+}
+
+func TestWriteMachineID(t *testing.T) {
+	dir := t.TempDir()
+	path, err := writeMachineID(&specs.Spec{}, dir, "0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); path != filepath.Join(dir, machineIDFileName) || string(data) != "0123\n" {
+		t.Errorf("machine ID at %s = %q", path, data)
+	}
+
+	spec := &specs.Spec{Mounts: []specs.Mount{{Destination: containerMachineIDFile, Type: "bind", Source: "/etc/machine-id"}}}
+	if path, err := writeMachineID(spec, t.TempDir(), "0123"); err != nil || path != "" {
+		t.Errorf("machine ID of a spec mounting its own = %q, %v", path, err)
+	}
+}
+
+func TestImageIdentity(t *testing.T) {
+	for _, c := range []struct {
+		ref         string
+		labels      map[string]string
+		id, version string
+	}{
+		{"docker.io/library/alpine:3.20", nil, "alpine", "3.20"},
+		{"ghcr.io/org/my_app@sha256:" + hex64('a'), nil, "my_app", "aaaaaaaaaaaa"},
+		{"docker.io/library/app:v1", map[string]string{labelImageTitle: "Web Server", labelImageVersion: "2.1.0"}, "web-server", "2.1.0"},
+	} {
+		img := &Image{Ref: c.ref, Config: ImageConfig{Labels: c.labels}}
+		if id, version := imageIdentity(img); id != c.id || version != c.version {
+			t.Errorf("imageIdentity(%s) = %q, %q, want %q, %q", c.ref, id, version, c.id, c.version)
+		}
+	}
+}
+
+func TestSetOSRelease(t *testing.T) {
+	data := "NAME=\"Alpine Linux\"\nID=alpine\nIMAGE_ID=old\n"
+	got := string(setOSRelease([]byte(data), map[string]string{"IMAGE_ID": "app", "IMAGE_VERSION": "1.0 beta"}))
+	want := "NAME=\"Alpine Linux\"\nID=alpine\nIMAGE_ID=app\nIMAGE_VERSION=\"1.0 beta\"\n"
+	if got != want {
+		t.Errorf("setOSRelease = %q, want %q", got, want)
+	}
+	if got := string(setOSRelease(nil, map[string]string{"IMAGE_ID": "app", "IMAGE_VERSION": ""})); got != "IMAGE_ID=app\n" {
+		t.Errorf("setOSRelease of no os-release = %q", got)
+	}
+}
+
+func TestApplyOSRelease(t *testing.T) {
+	rootfs, stateDir := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "usr", "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(rootfs, "usr", "lib", "os-release"), "ID=debian\n", 0o644)
+	if err := os.Symlink("../usr/lib/os-release", filepath.Join(rootfs, "etc", "os-release")); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &specs.Spec{}
+	img := &Image{Ref: "docker.io/library/app:v1"}
+	if err := applyOSRelease(spec, stateDir, rootfs, img); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(stateDir, osReleaseFileName)
+	if len(spec.Mounts) != 1 || spec.Mounts[0].Destination != "/usr/lib/os-release" || spec.Mounts[0].Source != file {
+		t.Fatalf("mounts %+v, want os-release over the file /etc/os-release links to", spec.Mounts)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "ID=debian\nIMAGE_ID=app\nIMAGE_VERSION=v1\n" {
+		t.Errorf("os-release = %q", data)
+	}
+
+	// The os-release the spec mounts is kept.
+	if err := applyOSRelease(spec, stateDir, rootfs, img); err != nil || len(spec.Mounts) != 1 {
+		t.Errorf("mounts %+v, %v, want the mount of the spec kept", spec.Mounts, err)
+	}
+}
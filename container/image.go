@@ -0,0 +1,690 @@
+package container
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Images are pulled from registries into a content store under imagesDir:
+//
+//	blobs/sha256/<hex>  manifests, configs and layers, by digest
+//	rootfs/<hex>/       the layers of an image applied in order, by image id
+//	images.json         the pulled images, by reference
+//
+// A container run from an image gets a rootfs of its own under
+// containersDir/<container id>, prepared by the storage driver: an overlay
+// mount with the unpacked image as its lower layer, or with the vfs driver
+// a copy of it, made with reflinks where the filesystem has them. Changes
+// made by the container are kept until it is deleted, across restarts.
+
+// imagesDir and containersDir are variables so tests can override them.
+var (
+	imagesDir     = "/var/lib/containish/images"
+	containersDir = "/var/lib/containish/containers"
+)
+
+// Storage drivers preparing the rootfs of containers run from images.
+const (
+	// StorageOverlay mounts an overlay of a writable layer of the container
+	// over the unpacked image.
+	StorageOverlay = "overlay"
+	// StorageVFS copies the unpacked image, for filesystems overlayfs
+	// can't use.
+	StorageVFS = "vfs"
+)
+
+// storageDriver is the storage driver of new containers, set by the
+// storage_driver setting.
+var storageDriver = StorageOverlay
+
+// Image is a pulled image.
+type Image struct {
+	// Ref is the normalized reference the image was pulled by.
+	Ref string `json:"ref"`
+	// Digest is the digest of its manifest, and ID that of its config.
+	Digest string `json:"digest"`
+	ID     string `json:"id"`
+	// Architecture is the GOARCH the image is built for.
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Config       ImageConfig `json:"config"`
+	// Layers are the layer blobs, bottom first.
+	Layers   []Descriptor `json:"layers"`
+	Size     int64        `json:"size"`
+	PulledAt time.Time    `json:"pulledAt"`
+	// Pinned keeps the image from PruneImages and RemoveImage, see
+	// PinImage.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+// ImageConfig is the execution configuration of an image, the defaults of
+// the process of containers run from it.
+type ImageConfig struct {
+	User       string            `json:"User,omitempty"`
+	Env        []string          `json:"Env,omitempty"`
+	Entrypoint []string          `json:"Entrypoint,omitempty"`
+	Cmd        []string          `json:"Cmd,omitempty"`
+	WorkingDir string            `json:"WorkingDir,omitempty"`
+	StopSignal string            `json:"StopSignal,omitempty"`
+	Labels     map[string]string `json:"Labels,omitempty"`
+	// ExposedPorts are the ports the image serves on, as "<port>/<proto>",
+	// and Volumes the paths whose content outlives the writable layer of
+	// a container.
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+}
+
+// Descriptor points at a blob of an image.
+type Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ImageRootfs records the rootfs of a container run from an image.
+type ImageRootfs struct {
+	// Ref and ID are those of the image.
+	Ref string `json:"ref"`
+	ID  string `json:"id"`
+	// Driver is the storage driver that prepared the rootfs.
+	Driver string `json:"driver"`
+}
+
+// defaultRegistry is the registry of references that don't name one, and
+// registryHosts the hosts serving the API of registries known by another
+// name.
+const defaultRegistry = "docker.io"
+
+var registryHosts = map[string]string{defaultRegistry: "registry-1.docker.io"}
+
+var (
+	repositoryRe = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagRe        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestRe     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+)
+
+// ImageRef is a parsed image reference.
+type ImageRef struct {
+	Registry   string
+	Repository string
+	// Tag is the tag, latest unless a Digest is given.
+	Tag    string
+	Digest string
+}
+
+// ParseImageRef parses an image reference such as alpine:3.20,
+// ghcr.io/org/app@sha256:... or localhost:5000/app. References without a
+// registry are on Docker Hub, and single-name repositories there in
+// library/.
+func ParseImageRef(value string) (ImageRef, error) {
+	invalid := func(why string) (ImageRef, error) {
+		return ImageRef{}, fmt.Errorf("invalid image reference %q: %s", value, why)
+	}
+	var ref ImageRef
+	name := value
+	if n, digest, ok := strings.Cut(name, "@"); ok {
+		if !digestRe.MatchString(digest) {
+			return invalid("expected a sha256 digest")
+		}
+		name, ref.Digest = n, digest
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		if !tagRe.MatchString(name[i+1:]) {
+			return invalid("bad tag")
+		}
+		name, ref.Tag = name[:i], name[i+1:]
+	}
+	ref.Registry = defaultRegistry
+	if first, rest, ok := strings.Cut(name, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		ref.Registry, name = first, rest
+	}
+	if ref.Registry == defaultRegistry && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !repositoryRe.MatchString(name) {
+		return invalid("bad repository name")
+	}
+	ref.Repository = name
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// String returns the normalized reference.
+func (r ImageRef) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// reference is the tag or digest of r, as the manifests endpoint takes it.
+func (r ImageRef) reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func blobPath(digest string) string {
+	return filepath.Join(imagesDir, "blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func imageRootfsDir(id string) string {
+	return filepath.Join(imagesDir, "rootfs", strings.TrimPrefix(id, "sha256:"))
+}
+
+// imageContainerRootfs is the rootfs of container id run from an image.
+func imageContainerRootfs(id string) string {
+	return filepath.Join(containersDir, id, "rootfs")
+}
+
+// withImagesLock runs fn holding the lock of the image store.
+func withImagesLock(fn func() error) error {
+	if err := os.MkdirAll(imagesDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create images dir: %w", err)
+	}
+	dir, err := os.Open(imagesDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock images: %w", err)
+	}
+	defer unix.Flock(int(dir.Fd()), unix.LOCK_UN)
+	return fn()
+}
+
+func loadImages() (map[string]*Image, error) {
+	images := map[string]*Image{}
+	data, err := os.ReadFile(filepath.Join(imagesDir, "images.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return images, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read images: %w", err)
+	}
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("failed to decode images: %w", err)
+	}
+	return images, nil
+}
+
+func saveImages(images map[string]*Image) error {
+	data, err := json.MarshalIndent(images, "", " ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(imagesDir, "images.json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("failed to save images: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadImage returns the pulled image ref.
+func LoadImage(ref string) (*Image, error) {
+	r, err := ParseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	images, err := loadImages()
+	if err != nil {
+		return nil, err
+	}
+	img, ok := images[r.String()]
+	if !ok {
+		return nil, fmt.Errorf("image %s %w", r, ErrNotFound)
+	}
+	return img, nil
+}
+
+// ListImages returns the pulled images, sorted by reference.
+func ListImages() ([]*Image, error) {
+	images, err := loadImages()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Image, 0, len(images))
+	for _, img := range images {
+		list = append(list, img)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Ref < list[j].Ref })
+	return list, nil
+}
+
+// RemoveImage removes the pulled image ref, and its blobs and unpacked
+// rootfs unless another reference shares them. An image containers were
+// created from is refused until they are deleted, and a pinned one until it
+// is unpinned.
+func RemoveImage(ref string) error {
+	r, err := ParseImageRef(ref)
+	if err != nil {
+		return err
+	}
+	return withImagesLock(func() error {
+		images, err := loadImages()
+		if err != nil {
+			return err
+		}
+		img, ok := images[r.String()]
+		if !ok {
+			return fmt.Errorf("image %s %w", r, ErrNotFound)
+		}
+		if img.Pinned {
+			return fmt.Errorf("image %s is pinned, unpin it first", r)
+		}
+		containers, err := ListContainers()
+		if err != nil {
+			return err
+		}
+		garbage, err := dropImage(images, img, containers)
+		if err != nil {
+			return err
+		}
+		if err := saveImages(images); err != nil {
+			return err
+		}
+		removeGarbage(garbage)
+		return nil
+	})
+}
+
+// dropImage removes img from images, failing if one of containers was
+// created from it and no other reference shares it. It returns the blobs
+// and unpacked rootfs no other reference shares, to remove once images are
+// saved.
+func dropImage(images map[string]*Image, img *Image, containers []*Container) ([]string, error) {
+	shared := map[string]bool{}
+	for ref, other := range images {
+		if ref == img.Ref {
+			continue
+		}
+		shared[other.Digest], shared[other.ID] = true, true
+		for _, l := range other.Layers {
+			shared[l.Digest] = true
+		}
+	}
+	if !shared[img.ID] {
+		for _, c := range containers {
+			if c.Image != nil && c.Image.ID == img.ID {
+				return nil, fmt.Errorf("image %s is used by container %s", img.Ref, c.Id)
+			}
+		}
+	}
+	delete(images, img.Ref)
+	var garbage []string
+	if !shared[img.ID] {
+		garbage = append(garbage, imageRootfsDir(img.ID))
+	}
+	for _, d := range append([]Descriptor{{Digest: img.Digest}, {Digest: img.ID}}, img.Layers...) {
+		if !shared[d.Digest] {
+			garbage = append(garbage, blobPath(d.Digest))
+		}
+	}
+	return garbage, nil
+}
+
+// removeGarbage removes the blobs and unpacked rootfs dropImage returned.
+func removeGarbage(garbage []string) {
+	for _, path := range garbage {
+		if err := os.RemoveAll(path); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to remove %s: %v\n", path, err)
+		}
+	}
+}
+
+// resolveImage returns the image ref for arch, a GOARCH or empty for that
+// of the host, pulling it unless it is in the store, with progress reported
+// to report, if any.
+func resolveImage(ctx context.Context, ref, arch string, report *progressReporter) (*Image, error) {
+	if arch == "" {
+		arch = hostArch
+	}
+	img, err := LoadImage(ref)
+	if err == nil && img.Architecture == arch {
+		return img, nil
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return pullImage(ctx, ref, arch, report)
+}
+
+// writeBlob saves the blob read from r, which must match digest.
+func writeBlob(digest string, r io.Reader) error {
+	path := blobPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", digest, err)
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("blob %s has digest %s", digest, got)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// hasBlob reports whether the blob digest is in the store.
+func hasBlob(digest string) bool {
+	_, err := os.Stat(blobPath(digest))
+	return err == nil
+}
+
+// unpackImage applies the layers of img, once, and returns the directory
+// holding the result.
+func unpackImage(img *Image) (string, error) {
+	dir := imageRootfsDir(img.ID)
+	err := withImagesLock(func() error {
+		if _, err := os.Stat(dir); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(dir), 0o700); err != nil {
+			return err
+		}
+		tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, 0o755); err != nil {
+			return err
+		}
+		for _, l := range img.Layers {
+			if err := applyLayerBlob(tmp, l); err != nil {
+				os.RemoveAll(tmp)
+				return fmt.Errorf("failed to unpack layer %s of %s: %w", l.Digest, img.Ref, err)
+			}
+		}
+		return os.Rename(tmp, dir)
+	})
+	return dir, err
+}
+
+func applyLayerBlob(root string, l Descriptor) error {
+	f, err := os.Open(blobPath(l.Digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return applyLayer(root, f)
+}
+
+// prepareImageRootfs prepares the rootfs of container id from img with the
+// storage driver, unless a previous start of the container did.
+func prepareImageRootfs(id string, img *Image) (*ImageRootfs, error) {
+	lower, err := unpackImage(img)
+	if err != nil {
+		return nil, err
+	}
+	image := &ImageRootfs{Ref: img.Ref, ID: img.ID, Driver: storageDriver}
+	dir := filepath.Join(containersDir, id)
+	rootfs := imageContainerRootfs(id)
+	// A container keeps the driver it was created with.
+	if data, err := os.ReadFile(filepath.Join(dir, "driver")); err == nil {
+		image.Driver = string(data)
+	} else {
+		if image.Driver, err = newStorageDriver(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create container layer: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "driver"), []byte(image.Driver), 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	switch image.Driver {
+	case StorageOverlay:
+		for _, d := range []string{"upper", "work", "rootfs"} {
+			if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+				return nil, fmt.Errorf("failed to create container layer: %w", err)
+			}
+		}
+		if mp, _, err := parentMount(rootfs); err == nil && mp == rootfs {
+			return image, nil
+		}
+		data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, filepath.Join(dir, "upper"), filepath.Join(dir, "work"))
+		if err := unix.Mount("overlay", rootfs, "overlay", 0, data); err != nil {
+			return nil, fmt.Errorf("failed to mount the overlay rootfs of %s: %w (set storage_driver = %q on filesystems overlayfs can't use)", id, err, StorageVFS)
+		}
+	case StorageVFS:
+		if !rootfsEmpty(rootfs) {
+			return image, nil
+		}
+		tmp := rootfs + ".tmp"
+		_ = os.RemoveAll(tmp)
+		cmd := exec.Command("cp", "-a", "--reflink=auto", lower, tmp)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to copy %s into the rootfs of %s: %w", img.Ref, id, err)
+		}
+		if err := os.Rename(tmp, rootfs); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", image.Driver)
+	}
+	return image, nil
+}
+
+// releaseImageRootfs unmounts the overlay rootfs of a stopped container.
+func releaseImageRootfs(id string, image *ImageRootfs) error {
+	if image == nil || image.Driver != StorageOverlay {
+		return nil
+	}
+	err := unix.Unmount(imageContainerRootfs(id), unix.MNT_DETACH)
+	if err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return fmt.Errorf("failed to unmount the rootfs of %s: %w", id, err)
+	}
+	return nil
+}
+
+// removeImageRootfs removes the rootfs of a deleted container, with the
+// changes it made.
+func removeImageRootfs(id string, image *ImageRootfs) error {
+	if image == nil {
+		return nil
+	}
+	if err := releaseImageRootfs(id, image); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(containersDir, id)); err != nil {
+		return fmt.Errorf("failed to remove the rootfs of %s: %w", id, err)
+	}
+	return nil
+}
+
+// loadImageSpec returns the spec of a container run from img: the one at
+// specPath if there is one, else one generated from the image config and
+// the overrides of options. Its root is left to the rootfs prepared from
+// the image.
+func loadImageSpec(specPath string, img *Image, options *RunOptions) (*specs.Spec, error) {
+	spec, err := LoadSpec(specPath)
+	if err == nil && (options.Entrypoint != nil || len(options.Cmd) > 0 || options.Workdir != "" || options.User != "") {
+		return nil, fmt.Errorf("an entrypoint, command, working directory or user applies to the process generated from the image, but the bundle has %s", specPath)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		spec, err = imageSpec(img, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if spec.Root == nil {
+		spec.Root = &specs.Root{}
+	}
+	spec.Root.Path = ""
+	return spec, nil
+}
+
+// imageSpec returns the spec of a container run from img without a
+// config.json, its process taken from the image config with the overrides
+// of options, as docker run does: an entrypoint given replaces that of the
+// image and drops its command, a command given replaces that of the image,
+// and the working directory and user replace those of the image. The user
+// is left in process.user.username, for resolveImageUser to resolve in the
+// rootfs.
+func imageSpec(img *Image, options *RunOptions) (*specs.Spec, error) {
+	entrypoint, cmd := img.Config.Entrypoint, img.Config.Cmd
+	if options.Entrypoint != nil {
+		entrypoint, cmd = nil, nil
+		if *options.Entrypoint != "" {
+			entrypoint = []string{*options.Entrypoint}
+		}
+	}
+	if len(options.Cmd) > 0 {
+		cmd = options.Cmd
+	}
+	args := append(append([]string{}, entrypoint...), cmd...)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("image %s has no entrypoint or command, give one", img.Ref)
+	}
+	env := append([]string{}, img.Config.Env...)
+	if !slices.ContainsFunc(env, func(e string) bool { return strings.HasPrefix(e, "PATH=") }) {
+		env = append([]string{"PATH=" + defaultExecPath}, env...)
+	}
+	cwd := img.Config.WorkingDir
+	if options.Workdir != "" {
+		cwd = options.Workdir
+	}
+	if cwd == "" {
+		cwd = "/"
+	}
+	if !filepath.IsAbs(cwd) {
+		return nil, fmt.Errorf("working directory %q must be an absolute path", cwd)
+	}
+	user := img.Config.User
+	if options.User != "" {
+		user = options.User
+	}
+	spec := &specs.Spec{
+		Version: specs.Version,
+		Root:    &specs.Root{},
+		Process: &specs.Process{
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			User: specs.User{Username: user},
+		},
+	}
+	if img.Config.StopSignal != "" {
+		spec.Annotations = map[string]string{AnnotationStopSignal: img.Config.StopSignal}
+	}
+	return spec, nil
+}
+
+// resolveImageUser resolves the user of a process generated from an image
+// against the passwd and group files of rootfs, setting HOME to theirs
+// unless the environment has it.
+func resolveImageUser(spec *specs.Spec, rootfs string) error {
+	if spec.Process == nil || spec.Process.User.Username == "" {
+		return nil
+	}
+	u, err := lookupUser(rootfs, spec.Process.User.Username)
+	if err != nil {
+		return err
+	}
+	spec.Process.User = specs.User{UID: u.uid, GID: u.gid}
+	if !slices.ContainsFunc(spec.Process.Env, func(e string) bool { return strings.HasPrefix(e, "HOME=") }) {
+		spec.Process.Env = append(spec.Process.Env, "HOME="+u.home)
+	}
+	return nil
+}
+
+// imageVolumes returns the bind mounts of the volumes of img that neither
+// the spec nor volumes mount over. They are anonymous volumes of container
+// id, kept with its rootfs until it is deleted.
+func imageVolumes(id string, img *Image, spec *specs.Spec, volumes []VolumeMount) []specs.Mount {
+	mounted := map[string]bool{}
+	for _, m := range spec.Mounts {
+		mounted[filepath.Clean(m.Destination)] = true
+	}
+	for _, v := range volumes {
+		mounted[filepath.Clean(v.Target)] = true
+	}
+	var mounts []specs.Mount
+	for path := range img.Config.Volumes {
+		dest := filepath.Clean("/" + path)
+		if dest == "/" || mounted[dest] {
+			continue
+		}
+		sum := sha256.Sum256([]byte(dest))
+		mounts = append(mounts, specs.Mount{
+			Destination: dest,
+			Type:        "bind",
+			Source:      filepath.Join(containersDir, id, "volumes", hex.EncodeToString(sum[:8])),
+			Options:     []string{"rbind"},
+		})
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Destination < mounts[j].Destination })
+	return mounts
+}
+
+// populateImageVolumes creates the anonymous volumes mounts that don't
+// exist yet with the content of the image at their destination.
+func populateImageVolumes(img *Image, mounts []specs.Mount) error {
+	lower := imageRootfsDir(img.ID)
+	for _, m := range mounts {
+		if _, err := os.Stat(m.Source); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(m.Source), 0o700); err != nil {
+			return fmt.Errorf("failed to create volume for %s: %w", m.Destination, err)
+		}
+		tmp := m.Source + ".tmp"
+		_ = os.RemoveAll(tmp)
+		// The destination resolves in the image, whose symlinks can't
+		// point the copy at the host.
+		src, err := openInRoot(lower, m.Destination)
+		switch {
+		case errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR):
+			err = os.Mkdir(tmp, 0o755)
+		case err == nil:
+			cmd := exec.Command("cp", "-a", "/proc/self/fd/3/.", tmp)
+			cmd.ExtraFiles = []*os.File{src}
+			cmd.Stderr = os.Stderr
+			err = cmd.Run()
+			src.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to populate the volume for %s from %s: %w", m.Destination, img.Ref, err)
+		}
+		if err := os.Rename(tmp, m.Source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
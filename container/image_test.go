@@ -0,0 +1,253 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseImageRef(t *testing.T) {
+	for value, want := range map[string]string{
+		"alpine":                        "docker.io/library/alpine:latest",
+		"alpine:3.20":                   "docker.io/library/alpine:3.20",
+		"user/app:v1":                   "docker.io/user/app:v1",
+		"ghcr.io/org/app":               "ghcr.io/org/app:latest",
+		"localhost:5000/app:dev":        "localhost:5000/app:dev",
+		"localhost/app":                 "localhost/app:latest",
+		"alpine@sha256:" + hex64('a'):   "docker.io/library/alpine@sha256:" + hex64('a'),
+		"alpine:3@sha256:" + hex64('b'): "docker.io/library/alpine:3@sha256:" + hex64('b'),
+		"Alpine":                        "",
+		"alpine:":                       "",
+		"alpine@sha256:abc":             "",
+		"registry.io/":                  "",
+		"app:-tag":                      "",
+	} {
+		ref, err := ParseImageRef(value)
+		if want == "" {
+			if err == nil {
+				t.Errorf("ParseImageRef(%q) = %s, expected an error", value, ref)
+			}
+			continue
+		}
+		if err != nil || ref.String() != want {
+			t.Errorf("ParseImageRef(%q) = %s, %v, want %s", value, ref, err, want)
+		}
+	}
+}
+
+func hex64(c byte) string {
+	b := make([]byte, 64)
+	for i := range b {
+		b[i] = c
+	}
+	return string(b)
+}
+
+func TestLoadImageSpec(t *testing.T) {
+	img := &Image{Ref: "docker.io/library/app:latest", Config: ImageConfig{
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{"--serve"},
+		Env:        []string{"PATH=/bin", "MODE=prod"},
+		WorkingDir: "/srv",
+	}}
+	bundle := t.TempDir()
+	spec, err := loadImageSpec(filepath.Join(bundle, "config.json"), img, &RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := spec.Process
+	if !slices.Equal(p.Args, []string{"/bin/app", "--serve"}) || !slices.Equal(p.Env, img.Config.Env) || p.Cwd != "/srv" {
+		t.Errorf("unexpected process generated from the image: %+v", p)
+	}
+	if spec.Root == nil || spec.Root.Path != "" {
+		t.Errorf("expected the root to be left to the image, got %+v", spec.Root)
+	}
+
+	// The config.json of the bundle is used when there is one.
+	writeFile(t, filepath.Join(bundle, "config.json"), `{"ociVersion":"1.0.2","process":{"args":["sh"],"cwd":"/"},"root":{"path":"rootfs"}}`, 0o644)
+	spec, err = loadImageSpec(filepath.Join(bundle, "config.json"), img, &RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(spec.Process.Args, []string{"sh"}) || spec.Root.Path != "" {
+		t.Errorf("expected the bundle spec with the root left to the image, got %+v %+v", spec.Process, spec.Root)
+	}
+
+	if _, err := loadImageSpec(filepath.Join(t.TempDir(), "config.json"), &Image{Ref: "x"}, &RunOptions{}); err == nil {
+		t.Error("expected an error for an image without entrypoint or command")
+	}
+}
+
+func TestImageSpecOverrides(t *testing.T) {
+	img := &Image{Ref: "docker.io/library/app:latest", Config: ImageConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"nginx", "-g", "daemon off;"},
+		Env:        []string{"NGINX_VERSION=1.27"},
+		WorkingDir: "/srv",
+		User:       "nginx",
+		StopSignal: "SIGQUIT",
+	}}
+	empty, sh := "", "/bin/sh"
+	for _, c := range []struct {
+		name    string
+		options RunOptions
+		args    []string
+		cwd     string
+		user    string
+	}{
+		{"image defaults", RunOptions{}, []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, "/srv", "nginx"},
+		{"command", RunOptions{Cmd: []string{"nginx", "-t"}}, []string{"/docker-entrypoint.sh", "nginx", "-t"}, "/srv", "nginx"},
+		{"entrypoint drops the command", RunOptions{Entrypoint: &sh}, []string{"/bin/sh"}, "/srv", "nginx"},
+		{"entrypoint and command", RunOptions{Entrypoint: &sh, Cmd: []string{"-c", "id"}}, []string{"/bin/sh", "-c", "id"}, "/srv", "nginx"},
+		{"cleared entrypoint", RunOptions{Entrypoint: &empty, Cmd: []string{"id"}}, []string{"id"}, "/srv", "nginx"},
+		{"workdir and user", RunOptions{Workdir: "/tmp", User: "0:0"}, []string{"/docker-entrypoint.sh", "nginx", "-g", "daemon off;"}, "/tmp", "0:0"},
+	} {
+		spec, err := imageSpec(img, &c.options)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		p := spec.Process
+		if !slices.Equal(p.Args, c.args) || p.Cwd != c.cwd || p.User.Username != c.user {
+			t.Errorf("%s: got args %q in %s as %q, want %q in %s as %q", c.name, p.Args, p.Cwd, p.User.Username, c.args, c.cwd, c.user)
+		}
+		if !slices.Equal(p.Env, []string{"PATH=" + defaultExecPath, "NGINX_VERSION=1.27"}) {
+			t.Errorf("%s: expected the image env after the default PATH, got %q", c.name, p.Env)
+		}
+		if spec.Annotations[AnnotationStopSignal] != "SIGQUIT" {
+			t.Errorf("%s: expected the stop signal of the image, got %v", c.name, spec.Annotations)
+		}
+	}
+
+	if _, err := imageSpec(img, &RunOptions{Entrypoint: &empty}); err == nil {
+		t.Error("expected an error for a cleared entrypoint without a command")
+	}
+	if _, err := imageSpec(img, &RunOptions{Workdir: "srv"}); err == nil {
+		t.Error("expected an error for a relative working directory")
+	}
+	bundle := t.TempDir()
+	writeFile(t, filepath.Join(bundle, "config.json"), `{"ociVersion":"1.0.2","process":{"args":["sh"],"cwd":"/"}}`, 0o644)
+	if _, err := loadImageSpec(filepath.Join(bundle, "config.json"), img, &RunOptions{Cmd: []string{"id"}}); err == nil {
+		t.Error("expected an error for a command with the spec of the bundle")
+	}
+}
+
+func TestResolveImageUser(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.Mkdir(filepath.Join(rootfs, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(rootfs, "etc/passwd"), "root:x:0:0:root:/root:/bin/sh\nnginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin\n", 0o644)
+	writeFile(t, filepath.Join(rootfs, "etc/group"), "root:x:0:\nnginx:x:101:\nwww:x:33:\n", 0o644)
+
+	for user, want := range map[string][3]any{
+		"nginx":     {uint32(101), uint32(101), "HOME=/var/cache/nginx"},
+		"nginx:www": {uint32(101), uint32(33), "HOME=/var/cache/nginx"},
+		"1000:1000": {uint32(1000), uint32(1000), "HOME=/"},
+	} {
+		spec := &specs.Spec{Process: &specs.Process{User: specs.User{Username: user}, Env: []string{"PATH=/bin"}}}
+		if err := resolveImageUser(spec, rootfs); err != nil {
+			t.Errorf("%s: %v", user, err)
+			continue
+		}
+		u := spec.Process.User
+		if u.UID != want[0] || u.GID != want[1] || u.Username != "" || !slices.Contains(spec.Process.Env, want[2].(string)) {
+			t.Errorf("%s: got %+v with env %q, want %v", user, u, spec.Process.Env, want)
+		}
+	}
+	spec := &specs.Spec{Process: &specs.Process{User: specs.User{Username: "nginx"}, Env: []string{"HOME=/home"}}}
+	if err := resolveImageUser(spec, rootfs); err != nil || !slices.Equal(spec.Process.Env, []string{"HOME=/home"}) {
+		t.Errorf("expected HOME to be kept, got %q, %v", spec.Process.Env, err)
+	}
+	spec = &specs.Spec{Process: &specs.Process{User: specs.User{Username: "nobody"}}}
+	if err := resolveImageUser(spec, rootfs); err == nil {
+		t.Error("expected an error for a user missing from the rootfs")
+	}
+}
+
+func TestImageVolumes(t *testing.T) {
+	tempImages(t)
+	img := &Image{Ref: "docker.io/library/db:latest", ID: "sha256:" + hex64('6'), Config: ImageConfig{
+		Volumes: map[string]struct{}{"/var/lib/db": {}, "/data/": {}, "/logs": {}, "/empty": {}},
+	}}
+	spec := &specs.Spec{Mounts: []specs.Mount{{Destination: "/logs", Type: "tmpfs", Source: "tmpfs"}}}
+	mounts := imageVolumes("db1", img, spec, []VolumeMount{{Name: "data", Target: "/data"}})
+	var dests []string
+	for _, m := range mounts {
+		dests = append(dests, m.Destination)
+	}
+	if !slices.Equal(dests, []string{"/empty", "/var/lib/db"}) {
+		t.Fatalf("expected volumes for the paths not mounted over, got %q", dests)
+	}
+
+	// The volumes get the content of the image, resolved in it.
+	lower := imageRootfsDir(img.ID)
+	if err := os.MkdirAll(filepath.Join(lower, "var/lib/db"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(lower, "var/lib/db/init.sql"), "create", 0o644)
+	if err := populateImageVolumes(img, mounts); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(mounts[1].Source, "init.sql")); err != nil || string(data) != "create" {
+		t.Errorf("expected the volume to hold the content of the image, got %q, %v", data, err)
+	}
+	if fi, err := os.Stat(mounts[0].Source); err != nil || !fi.IsDir() {
+		t.Errorf("expected an empty volume for a path missing from the image, got %v", err)
+	}
+	// Existing volumes are kept as they are.
+	writeFile(t, filepath.Join(mounts[1].Source, "init.sql"), "changed", 0o644)
+	if err := populateImageVolumes(img, mounts); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(mounts[1].Source, "init.sql")); string(data) != "changed" {
+		t.Errorf("expected the volume to be kept, got %q", data)
+	}
+}
+
+func TestRemoveImageKeepsSharedBlobs(t *testing.T) {
+	tempImages(t)
+	shared := Descriptor{Digest: "sha256:" + hex64('1')}
+	a := &Image{Ref: "docker.io/library/a:latest", Digest: "sha256:" + hex64('2'), ID: "sha256:" + hex64('3'), Layers: []Descriptor{shared}}
+	b := &Image{Ref: "docker.io/library/b:latest", Digest: "sha256:" + hex64('4'), ID: "sha256:" + hex64('5'), Layers: []Descriptor{shared}}
+	for _, d := range []string{shared.Digest, a.Digest, a.ID, b.Digest, b.ID} {
+		if err := os.MkdirAll(filepath.Dir(blobPath(d)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, blobPath(d), "blob", 0o600)
+	}
+	if err := saveImages(map[string]*Image{a.Ref: a, b.Ref: b}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveImage("a"); err != nil {
+		t.Fatal(err)
+	}
+	if hasBlob(a.Digest) || hasBlob(a.ID) {
+		t.Error("expected the blobs of a to be removed")
+	}
+	if !hasBlob(shared.Digest) {
+		t.Error("expected the layer shared with b to be kept")
+	}
+	if _, err := LoadImage("a"); err == nil {
+		t.Error("expected a to be removed")
+	}
+	if _, err := LoadImage("b"); err != nil {
+		t.Error(err)
+	}
+	if err := RemoveImage("a"); err == nil {
+		t.Error("expected an error removing a missing image")
+	}
+}
+
+// tempImages points imagesDir, containersDir and baseStateDir at temporary
+// directories.
+func tempImages(t *testing.T) {
+	t.Helper()
+	oldImages, oldContainers, oldState := imagesDir, containersDir, baseStateDir
+	imagesDir, containersDir, baseStateDir = t.TempDir(), t.TempDir(), t.TempDir()
+	t.Cleanup(func() { imagesDir, containersDir, baseStateDir = oldImages, oldContainers, oldState })
+}
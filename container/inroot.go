@@ -0,0 +1,205 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The rootfs of a container may come from an image pulled from a registry,
+// so its symlinks can't be trusted: until pivot_root, an absolute one
+// leads to the host's files. Paths of the rootfs are therefore never
+// joined to it and handed to the kernel. They are resolved with
+// openat2(RESOLVE_IN_ROOT), as if the rootfs were /, entries are created
+// with mkdirat, mknodat and openat relative to a parent resolved so, and
+// mounts go onto the /proc/self/fd link of the resolved mount point.
+
+// openRootDir opens rootfs as an O_PATH directory to resolve paths in.
+func openRootDir(rootfs string) (int, error) {
+	fd, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("failed to open rootfs %s: %w", rootfs, err)
+	}
+	return fd, nil
+}
+
+// rootRel returns path relative to the root, "." for the root itself.
+func rootRel(path string) string {
+	rel := strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	if rel == "" {
+		return "."
+	}
+	return rel
+}
+
+// resolveInRoot opens path with flags as if root were the root directory.
+func resolveInRoot(root int, path string, flags int) (int, error) {
+	fd, err := unix.Openat2(root, rootRel(path), &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+	if err != nil {
+		return -1, fmt.Errorf("failed to resolve %s in rootfs: %w", path, err)
+	}
+	return fd, nil
+}
+
+// mkdirAllInRoot opens the directory path of root as O_PATH, creating it
+// and its parents with perm as needed.
+func mkdirAllInRoot(root int, path string, perm uint32) (int, error) {
+	rel := rootRel(path)
+	fd, err := unix.Openat2(root, rel, &unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+	if !errors.Is(err, unix.ENOENT) || rel == "." {
+		if err != nil {
+			return -1, fmt.Errorf("failed to open %s in rootfs: %w", path, err)
+		}
+		return fd, nil
+	}
+	parent, err := mkdirAllInRoot(root, filepath.Dir("/"+rel), perm)
+	if err != nil {
+		return -1, err
+	}
+	err = unix.Mkdirat(parent, filepath.Base(rel), perm)
+	unix.Close(parent)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return -1, fmt.Errorf("failed to create %s in rootfs: %w", path, err)
+	}
+	return resolveInRoot(root, rel, unix.O_PATH|unix.O_DIRECTORY)
+}
+
+// fdPath is the path to the file open as fd.
+func fdPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+// mountTarget is a mount point in a rootfs.
+type mountTarget struct {
+	path string
+	// dir makes a missing mount point a directory, rather than a file.
+	dir bool
+	// perm is that of a missing directory, 0755 if zero.
+	perm uint32
+	// noSymlink refuses a mount point that is a symlink, which is
+	// otherwise followed within the rootfs.
+	noSymlink bool
+}
+
+// openMountTarget opens the mount point t of root as O_PATH, creating it
+// and its parent directories as needed.
+func openMountTarget(root int, t mountTarget) (int, error) {
+	perm := t.perm
+	if perm == 0 {
+		perm = 0o755
+	}
+	rel := rootRel(t.path)
+	if rel != "." {
+		parent, err := mkdirAllInRoot(root, filepath.Dir("/"+rel), 0o755)
+		if err != nil {
+			return -1, err
+		}
+		defer unix.Close(parent)
+		base := filepath.Base(rel)
+		if t.dir {
+			err = unix.Mkdirat(parent, base, perm)
+		} else {
+			var fd int
+			// A symlink is left for the resolution below.
+			if fd, err = unix.Openat(parent, base, unix.O_RDONLY|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o644); err == nil {
+				unix.Close(fd)
+			} else if errors.Is(err, unix.ELOOP) {
+				err = nil
+			}
+		}
+		if err != nil && !errors.Is(err, unix.EEXIST) {
+			return -1, fmt.Errorf("failed to create mount point %s: %w", t.path, err)
+		}
+	}
+	flags := unix.O_PATH
+	if t.noSymlink {
+		flags |= unix.O_NOFOLLOW
+	}
+	fd, err := resolveInRoot(root, rel, flags)
+	if err != nil {
+		return -1, err
+	}
+	if t.noSymlink {
+		var st unix.Stat_t
+		if err := unix.Fstat(fd, &st); err != nil {
+			unix.Close(fd)
+			return -1, err
+		}
+		if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			unix.Close(fd)
+			return -1, fmt.Errorf("mount point %s is a symlink", t.path)
+		}
+	}
+	return fd, nil
+}
+
+// mountInRoot calls mount with the path of the mount point t of rootfs,
+// created as needed, then after, if set, with the path of what was
+// mounted there.
+func mountInRoot(rootfs string, t mountTarget, mount, after func(target string) error) error {
+	root, err := openRootDir(rootfs)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	fd, err := openMountTarget(root, t)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := mount(fdPath(fd)); err != nil {
+		return err
+	}
+	if after == nil {
+		return nil
+	}
+	// fd still refers to what is under the new mount, which the path
+	// resolved again enters.
+	top, err := resolveInRoot(root, t.path, unix.O_PATH)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(top)
+	return after(fdPath(top))
+}
+
+// writeFileInRoot writes data to path of rootfs, creating it with perm and
+// its parent directories as needed.
+func writeFileInRoot(rootfs, path string, data []byte, perm uint32) error {
+	root, err := openRootDir(rootfs)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	parent, err := mkdirAllInRoot(root, filepath.Dir("/"+rootRel(path)), 0o755)
+	if err != nil {
+		return err
+	}
+	unix.Close(parent)
+	fd, err := unix.Openat2(root, rootRel(path), &unix.OpenHow{
+		Flags:   unix.O_WRONLY | unix.O_CREAT | unix.O_TRUNC | unix.O_CLOEXEC,
+		Mode:    uint64(perm),
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open %s in rootfs: %w", path, err)
+	}
+	defer unix.Close(fd)
+	for len(data) > 0 {
+		n, err := unix.Write(fd, data)
+		if err != nil {
+			return fmt.Errorf("failed to write %s in rootfs: %w", path, err)
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestInRoot(t *testing.T) {
+	rootfs, host := t.TempDir(), t.TempDir()
+	// Absolute symlinks of the image point into the host until pivot_root.
+	if err := os.MkdirAll(filepath.Join(rootfs, host), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(rootfs, host, "hosts"), "", 0o644)
+	if err := os.Symlink(host, filepath.Join(rootfs, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(host, "hosts"), filepath.Join(rootfs, "hosts")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileInRoot(rootfs, "/etc/resolv.conf", []byte("nameserver 10.0.0.1\n"), 0o644); err != nil {
+		t.Fatalf("writeFileInRoot: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(host, "resolv.conf")); err == nil {
+		t.Fatalf("writeFileInRoot followed a symlink out of the rootfs")
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, host, "resolv.conf")); err != nil {
+		t.Fatalf("writeFileInRoot did not write in the rootfs: %v", err)
+	}
+
+	root, err := openRootDir(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(root)
+	fd, err := openMountTarget(root, mountTarget{path: "/etc/../../etc/ssl/certs", dir: true})
+	if err != nil {
+		t.Fatalf("openMountTarget: %v", err)
+	}
+	unix.Close(fd)
+	if _, err := os.Stat(filepath.Join(rootfs, host, "ssl/certs")); err != nil {
+		t.Fatalf("mount point not created in the rootfs: %v", err)
+	}
+	if entries, _ := os.ReadDir(host); len(entries) != 0 {
+		t.Fatalf("mount point created out of the rootfs: %v", entries)
+	}
+
+	if fd, err := openMountTarget(root, mountTarget{path: "/hosts", noSymlink: true}); err == nil {
+		unix.Close(fd)
+		t.Fatalf("openMountTarget accepted a symlink")
+	}
+	fd, err = openMountTarget(root, mountTarget{path: "/hosts"})
+	if err != nil {
+		t.Fatalf("openMountTarget: %v", err)
+	}
+	unix.Close(fd)
+	if entries, _ := os.ReadDir(host); len(entries) != 0 {
+		t.Fatalf("mount point created out of the rootfs: %v", entries)
+	}
+}
@@ -0,0 +1,286 @@
+package container
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// A container run from an image with RunOptions.Integrity gets a hash
+// manifest of the unpacked image, recorded when the container is first
+// created: the mode, owner and, for a regular file, the SHA-256 of each
+// entry. Verify compares the image with it, so that a change to the base
+// the container runs on, which the container itself can't make, shows up as
+// tampering, apart from the changes the container made in its writable
+// layer. The manifest is kept in the storage dir of the container, and its
+// own digest in the state, so that it can't be rewritten unnoticed either.
+// It trusts the image as unpacked when the container was created.
+
+// manifestName is the hash manifest in the storage dir of a container.
+const manifestName = "manifest.json"
+
+// manifestEntry is an entry of a hash manifest.
+type manifestEntry struct {
+	Path string      `json:"path"`
+	Mode fs.FileMode `json:"mode"`
+	Uid  uint32      `json:"uid"`
+	Gid  uint32      `json:"gid"`
+	// Digest is the SHA-256 of a regular file, Target the target of a
+	// symlink and Rdev the device number of a device.
+	Digest string `json:"digest,omitempty"`
+	Target string `json:"target,omitempty"`
+	Rdev   uint64 `json:"rdev,omitempty"`
+}
+
+// IntegrityChange is an entry of a rootfs that differs from its manifest.
+type IntegrityChange struct {
+	Path string `json:"path"`
+	// Kind is added, removed or modified, and Detail what of a modified
+	// entry changed: its content, mode, owner, target or type.
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// IntegrityReport is what Verify found of the rootfs of a container.
+type IntegrityReport struct {
+	Id string `json:"id"`
+	// Base are the changes to the image the container runs on since its
+	// manifest was recorded, which nothing should make.
+	Base []IntegrityChange `json:"base"`
+	// Layer are the changes the container made: those of its writable
+	// layer with the overlay storage driver, and with vfs those of its
+	// copy of the image.
+	Layer []IntegrityChange `json:"layer"`
+}
+
+// Tampered reports whether the base of the container changed.
+func (r *IntegrityReport) Tampered() bool {
+	return len(r.Base) > 0
+}
+
+// recordManifest records the hash manifest of lower, the unpacked image of
+// container id, unless an earlier start of the container did, and returns
+// its digest.
+func recordManifest(id, lower string) (string, error) {
+	path := filepath.Join(containersDir, id, manifestName)
+	if data, err := os.ReadFile(path); err == nil {
+		return digestOf(data), nil
+	}
+	entries, err := buildManifest(lower)
+	if err != nil {
+		return "", fmt.Errorf("failed to record the hash manifest of %s: %w", id, err)
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o400); err != nil {
+		return "", fmt.Errorf("failed to record the hash manifest of %s: %w", id, err)
+	}
+	return digestOf(data), nil
+}
+
+// digestOf returns the sha256 digest of data.
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// buildManifest returns the manifest of the tree at root, ordered by path.
+func buildManifest(root string) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e, err := newManifestEntry(rel, path, info)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// newManifestEntry returns the entry of the file at path, info, as rel.
+func newManifestEntry(rel, path string, info fs.FileInfo) (manifestEntry, error) {
+	e := manifestEntry{Path: rel, Mode: info.Mode()}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		e.Uid, e.Gid = st.Uid, st.Gid
+		if info.Mode()&(fs.ModeDevice|fs.ModeCharDevice) != 0 {
+			e.Rdev = uint64(st.Rdev)
+		}
+	}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		f, err := os.Open(path)
+		if err != nil {
+			return e, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return e, err
+		}
+		e.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	case mode&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return e, err
+		}
+		e.Target = target
+	}
+	return e, nil
+}
+
+// diffManifest returns how the entries of got differ from those of want.
+func diffManifest(want, got []manifestEntry) []IntegrityChange {
+	byPath := make(map[string]manifestEntry, len(got))
+	for _, e := range got {
+		byPath[e.Path] = e
+	}
+	changes := []IntegrityChange{}
+	for _, w := range want {
+		g, ok := byPath[w.Path]
+		if !ok {
+			changes = append(changes, IntegrityChange{Path: w.Path, Kind: "removed"})
+			continue
+		}
+		delete(byPath, w.Path)
+		if detail := entryChange(w, g); detail != "" {
+			changes = append(changes, IntegrityChange{Path: w.Path, Kind: "modified", Detail: detail})
+		}
+	}
+	for _, path := range sortedKeys(byPath) {
+		changes = append(changes, IntegrityChange{Path: path, Kind: "added"})
+	}
+	slices.SortFunc(changes, func(a, b IntegrityChange) int { return cmp.Compare(a.Path, b.Path) })
+	return changes
+}
+
+// entryChange returns what changed from entry w to g, or "".
+func entryChange(w, g manifestEntry) string {
+	switch {
+	case w.Mode.Type() != g.Mode.Type():
+		return "type"
+	case w.Digest != g.Digest:
+		return "content"
+	case w.Target != g.Target:
+		return "target"
+	case w.Rdev != g.Rdev:
+		return "device"
+	case w.Mode != g.Mode:
+		return "mode"
+	case w.Uid != g.Uid || w.Gid != g.Gid:
+		return "owner"
+	}
+	return ""
+}
+
+// layerChanges returns the changes an overlay writable layer at upper
+// makes to the entries of base: whiteouts remove them, and what else is in
+// upper adds or modifies them, except the directories copied up unchanged
+// on the way to what is.
+func layerChanges(base []manifestEntry, upper string) ([]IntegrityChange, error) {
+	byPath := make(map[string]manifestEntry, len(base))
+	for _, e := range base {
+		byPath[e.Path] = e
+	}
+	changes := []IntegrityChange{}
+	err := filepath.WalkDir(upper, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(upper, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode()&fs.ModeCharDevice != 0 && st.Rdev == 0 {
+			changes = append(changes, IntegrityChange{Path: rel, Kind: "removed"})
+			return nil
+		}
+		w, ok := byPath[rel]
+		if !ok {
+			changes = append(changes, IntegrityChange{Path: rel, Kind: "added"})
+			return nil
+		}
+		g, err := newManifestEntry(rel, path, info)
+		if err != nil {
+			return err
+		}
+		if detail := entryChange(w, g); detail != "" {
+			changes = append(changes, IntegrityChange{Path: rel, Kind: "modified", Detail: detail})
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// Verify checks the rootfs of container id, run with RunOptions.Integrity,
+// against its hash manifest.
+func Verify(id string) (*IntegrityReport, error) {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	if c.Image == nil || c.Integrity == "" {
+		return nil, fmt.Errorf("container %s has no hash manifest, run it from an image with integrity checking", id)
+	}
+	dir := filepath.Join(containersDir, id)
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("the hash manifest of %s was removed", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if digestOf(data) != c.Integrity {
+		return nil, fmt.Errorf("the hash manifest of %s was modified, it is %s rather than %s", id, digestOf(data), c.Integrity)
+	}
+	var manifest []manifestEntry
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode the hash manifest of %s: %w", id, err)
+	}
+
+	report := &IntegrityReport{Id: id}
+	base, err := buildManifest(imageRootfsDir(c.Image.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the image of %s: %w", id, err)
+	}
+	report.Base = diffManifest(manifest, base)
+	switch c.Image.Driver {
+	case StorageOverlay:
+		report.Layer, err = layerChanges(manifest, filepath.Join(dir, "upper"))
+	default:
+		var rootfs []manifestEntry
+		if rootfs, err = buildManifest(filepath.Join(dir, "rootfs")); err == nil {
+			report.Layer = diffManifest(manifest, rootfs)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the rootfs of %s: %w", id, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,115 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestDiffManifest(t *testing.T) {
+	want := []manifestEntry{
+		{Path: "bin", Mode: os.ModeDir | 0o755},
+		{Path: "bin/sh", Mode: 0o755, Digest: "sha256:a"},
+		{Path: "etc", Mode: os.ModeDir | 0o755},
+		{Path: "etc/passwd", Mode: 0o644, Digest: "sha256:b"},
+		{Path: "etc/shadow", Mode: 0o600, Digest: "sha256:c"},
+		{Path: "lib", Mode: os.ModeSymlink | 0o777, Target: "usr/lib"},
+	}
+	got := []manifestEntry{
+		{Path: "bin", Mode: os.ModeDir | 0o755},
+		{Path: "bin/sh", Mode: 0o4755, Digest: "sha256:a"},
+		{Path: "etc", Mode: os.ModeDir | 0o755},
+		{Path: "etc/passwd", Mode: 0o644, Digest: "sha256:d"},
+		{Path: "etc/sudoers", Mode: 0o440, Digest: "sha256:e"},
+		{Path: "lib", Mode: os.ModeSymlink | 0o777, Target: "/tmp/lib"},
+	}
+	changes := diffManifest(want, got)
+	expected := []IntegrityChange{
+		{Path: "bin/sh", Kind: "modified", Detail: "mode"},
+		{Path: "etc/passwd", Kind: "modified", Detail: "content"},
+		{Path: "etc/shadow", Kind: "removed"},
+		{Path: "etc/sudoers", Kind: "added"},
+		{Path: "lib", Kind: "modified", Detail: "target"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("diffManifest = %+v, want %+v", changes, expected)
+	}
+	if changes := diffManifest(want, want); len(changes) != 0 {
+		t.Errorf("diffManifest of the same entries = %+v", changes)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tempImages(t)
+	lower := imageRootfsDir("img")
+	for _, d := range []string{"bin", "etc"} {
+		if err := os.MkdirAll(filepath.Join(lower, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(lower, "bin/sh"), "shell", 0o755)
+	writeFile(t, filepath.Join(lower, "etc/passwd"), "root:x:0:0", 0o644)
+	writeFile(t, filepath.Join(lower, "etc/motd"), "hello", 0o644)
+
+	dir := filepath.Join(containersDir, "web")
+	upper := filepath.Join(dir, "upper")
+	if err := os.MkdirAll(filepath.Join(upper, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	digest, err := recordManifest("web", lower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := recordManifest("web", lower); err != nil || again != digest {
+		t.Fatalf("recording the manifest again = %s, %v, want the first one %s", again, err, digest)
+	}
+	c := &Container{Id: "web", Image: &ImageRootfs{Ref: "hello", ID: "img", Driver: StorageOverlay}, Integrity: digest}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// What the container writes goes to its writable layer.
+	writeFile(t, filepath.Join(upper, "etc/passwd"), "root:x:0:0\napp:x:1000:1000", 0o644)
+	writeFile(t, filepath.Join(upper, "etc/app.conf"), "port=80", 0o644)
+	if err := unix.Mknod(filepath.Join(upper, "etc/motd"), unix.S_IFCHR, 0); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Verify("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Tampered() {
+		t.Errorf("changes in the writable layer were reported as tampering: %+v", r.Base)
+	}
+	wantLayer := []IntegrityChange{
+		{Path: "etc/app.conf", Kind: "added"},
+		{Path: "etc/motd", Kind: "removed"},
+		{Path: "etc/passwd", Kind: "modified", Detail: "content"},
+	}
+	if !reflect.DeepEqual(r.Layer, wantLayer) {
+		t.Errorf("layer changes = %+v, want %+v", r.Layer, wantLayer)
+	}
+
+	// Changing the image under the container is tampering.
+	writeFile(t, filepath.Join(lower, "bin/sh"), "backdoor", 0o755)
+	if r, err = Verify("web"); err != nil {
+		t.Fatal(err)
+	}
+	wantBase := []IntegrityChange{{Path: "bin/sh", Kind: "modified", Detail: "content"}}
+	if !r.Tampered() || !reflect.DeepEqual(r.Base, wantBase) {
+		t.Errorf("base changes = %+v, want %+v", r.Base, wantBase)
+	}
+
+	// So is rewriting the manifest to hide it.
+	path := filepath.Join(dir, manifestName)
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, path, "[]", 0o400)
+	if _, err := Verify("web"); err == nil {
+		t.Error("a rewritten manifest was trusted")
+	}
+}
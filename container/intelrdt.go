@@ -0,0 +1,134 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// resctrlRoot is the mount point of the resctrl filesystem used for Intel
+// RDT. It is a variable so tests can point it at a temporary directory.
+var resctrlRoot = "/sys/fs/resctrl"
+
+// rdtGroup is the resctrl group a container has been placed in.
+type rdtGroup struct {
+	path string
+	// created is true when the group was made for this container and must
+	// be removed with it, as opposed to a shared pre-existing CLOS.
+	created bool
+}
+
+// setupIntelRdt creates (or joins, when closID names an existing group) the
+// resctrl group for a container and writes the L3 cache and memory
+// bandwidth schemata.
+func setupIntelRdt(id string, rdt *specs.LinuxIntelRdt) (*rdtGroup, error) {
+	if _, err := os.Stat(filepath.Join(resctrlRoot, "schemata")); err != nil {
+		return nil, fmt.Errorf("linux.intelRdt requires resctrl mounted at %s", resctrlRoot)
+	}
+	if rdt.L3CacheSchema != "" && !strings.HasPrefix(rdt.L3CacheSchema, "L3") {
+		return nil, fmt.Errorf("invalid l3CacheSchema %q: must start with L3", rdt.L3CacheSchema)
+	}
+	if rdt.MemBwSchema != "" && !strings.HasPrefix(rdt.MemBwSchema, "MB:") {
+		return nil, fmt.Errorf("invalid memBwSchema %q: must start with MB:", rdt.MemBwSchema)
+	}
+	if rdt.EnableCMT || rdt.EnableMBM {
+		if _, err := os.Stat(filepath.Join(resctrlRoot, "info", "L3_MON")); err != nil {
+			return nil, fmt.Errorf("intel RDT monitoring is not supported by this host")
+		}
+	}
+
+	name := rdt.ClosID
+	if name == "" {
+		name = "containish-" + id
+	}
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid closID %q", name)
+	}
+	g := &rdtGroup{path: filepath.Join(resctrlRoot, name)}
+
+	err := os.Mkdir(g.path, 0o755)
+	switch {
+	case err == nil:
+		g.created = true
+	case errors.Is(err, os.ErrExist) && rdt.ClosID != "":
+		// Joining an existing class of service: its schemata are owned by
+		// whoever created it, so ours must agree.
+		return g, checkRdtSchemata(g.path, rdt)
+	default:
+		return nil, fmt.Errorf("failed to create resctrl group %s: %w", g.path, err)
+	}
+
+	for _, schema := range []string{rdt.L3CacheSchema, rdt.MemBwSchema} {
+		if schema == "" {
+			continue
+		}
+		// The kernel takes one resource per write; multi-line schemas
+		// (e.g. L3CODE and L3DATA) are written line by line.
+		for _, line := range strings.Split(schema, "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(g.path, "schemata"), []byte(line+"\n"), 0o644); err != nil {
+				_ = g.remove()
+				return nil, fmt.Errorf("failed to write schemata %q: %w", line, err)
+			}
+		}
+	}
+	return g, nil
+}
+
+// checkRdtSchemata verifies every requested schema line is present in the
+// schemata of an existing group.
+func checkRdtSchemata(path string, rdt *specs.LinuxIntelRdt) error {
+	data, err := os.ReadFile(filepath.Join(path, "schemata"))
+	if err != nil {
+		return fmt.Errorf("failed to read schemata of %s: %w", path, err)
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		have[strings.ReplaceAll(line, " ", "")] = true
+	}
+
+	for _, schema := range []string{rdt.L3CacheSchema, rdt.MemBwSchema} {
+		for _, line := range strings.Split(schema, "\n") {
+			line = strings.ReplaceAll(strings.TrimSpace(line), " ", "")
+			if line != "" && !have[line] {
+				return fmt.Errorf("closID %s exists with different schemata than %q", filepath.Base(path), line)
+			}
+		}
+	}
+	return nil
+}
+
+// addTask moves pid into the group. Tasks forked afterwards inherit it.
+func (g *rdtGroup) addTask(pid int) error {
+	if err := os.WriteFile(filepath.Join(g.path, "tasks"), []byte(strconv.Itoa(pid)), 0o644); err != nil {
+		return fmt.Errorf("failed to add pid %d to resctrl group %s: %w", pid, g.path, err)
+	}
+	return nil
+}
+
+// remove deletes the group if it was created for the container.
+func (g *rdtGroup) remove() error {
+	if g == nil || !g.created {
+		return nil
+	}
+	return removeRdtGroup(g.path)
+}
+
+// removeRdtGroup deletes a resctrl group directory. Remaining tasks are
+// moved back to the default group by the kernel.
+func removeRdtGroup(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove resctrl group %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeResctrl points resctrlRoot at a temporary directory that looks like
+// a mounted resctrl filesystem.
+func fakeResctrl(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "schemata"), []byte("L3:0=fff\nMB:0=100\n"), 0o644); err != nil {
+		t.Fatalf("failed to create schemata: %v", err)
+	}
+	old := resctrlRoot
+	resctrlRoot = root
+	t.Cleanup(func() { resctrlRoot = old })
+	return root
+}
+
+func TestSetupIntelRdt(t *testing.T) {
+	root := fakeResctrl(t)
+
+	g, err := setupIntelRdt("c1", &specs.LinuxIntelRdt{MemBwSchema: "MB:0=50"})
+	if err != nil {
+		t.Fatalf("setupIntelRdt failed: %v", err)
+	}
+	if !g.created || g.path != filepath.Join(root, "containish-c1") {
+		t.Fatalf("unexpected group %+v", g)
+	}
+	data, err := os.ReadFile(filepath.Join(g.path, "schemata"))
+	if err != nil || strings.TrimSpace(string(data)) != "MB:0=50" {
+		t.Fatalf("unexpected schemata %q, %v", data, err)
+	}
+
+	if err := g.addTask(1234); err != nil {
+		t.Fatalf("addTask failed: %v", err)
+	}
+	// a real group can't be removed while it has files in it; emulate the
+	// kernel by clearing them first
+	os.Remove(filepath.Join(g.path, "schemata"))
+	os.Remove(filepath.Join(g.path, "tasks"))
+	if err := g.remove(); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+}
+
+func TestSetupIntelRdtSharedClos(t *testing.T) {
+	root := fakeResctrl(t)
+	shared := filepath.Join(root, "gold")
+	if err := os.Mkdir(shared, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(shared, "schemata"), []byte("    L3:0=00f\n    MB:0=100\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := setupIntelRdt("c1", &specs.LinuxIntelRdt{ClosID: "gold", L3CacheSchema: "L3:0=00f"})
+	if err != nil {
+		t.Fatalf("joining shared clos failed: %v", err)
+	}
+	if g.created {
+		t.Fatalf("shared group must not be owned by the container")
+	}
+
+	if _, err := setupIntelRdt("c2", &specs.LinuxIntelRdt{ClosID: "gold", L3CacheSchema: "L3:0=fff"}); err == nil {
+		t.Fatalf("expected error for conflicting schemata")
+	}
+}
+
+func TestSetupIntelRdtUnavailable(t *testing.T) {
+	old := resctrlRoot
+	resctrlRoot = t.TempDir()
+	defer func() { resctrlRoot = old }()
+
+	if _, err := setupIntelRdt("c1", &specs.LinuxIntelRdt{L3CacheSchema: "L3:0=f"}); err == nil {
+		t.Fatalf("expected error without resctrl")
+	}
+}
@@ -0,0 +1,140 @@
+package container
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+)
+
+// The address of a container on a bridge network is leased to it in the
+// state store, so that finding a free one doesn't read the state of every
+// container, and two containers started at once can't get the same one:
+// the store leases an address to one container at a time. A lease is held
+// until the container is deleted, so a container that is restarted gets
+// its address back, and Reconcile releases those of containers that are
+// gone. Running containers attached to a network before it had leases
+// have theirs taken over the first time an address of it is leased.
+
+// leaseAttempts bounds how often leaseAddress picks another address when
+// the one it picked is leased in between.
+const leaseAttempts = 8
+
+// NetworkLeases returns the addresses leased on the network name.
+func NetworkLeases(name string) ([]AddressLease, error) {
+	s, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.Leases(name)
+}
+
+// leaseAddress leases an address of n to container id and returns it in
+// CIDR notation: requested when given, else the address the container
+// already holds on n, else the lowest free one.
+func leaseAddress(n *Network, id, requested string) (string, error) {
+	s, err := stateStore()
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		leases, err := s.Leases(n.Name)
+		if err != nil {
+			return "", err
+		}
+		if len(leases) == 0 {
+			if leases, err = adoptLeases(s, n); err != nil {
+				return "", err
+			}
+		}
+		addr, err := allocateAddress(n, requested, leases, id)
+		if err != nil {
+			return "", err
+		}
+		ip, _, _ := net.ParseCIDR(addr)
+		err = s.Lease(AddressLease{Network: n.Name, Address: ip.String(), Container: id})
+		if err == nil {
+			return addr, nil
+		}
+		if !errors.Is(err, ErrExists) || requested != "" || attempt == leaseAttempts {
+			return "", err
+		}
+	}
+}
+
+// adoptLeases leases the addresses of the running containers attached to
+// n to them, for a network whose containers were started without leases.
+func adoptLeases(s StateStore, n *Network) ([]AddressLease, error) {
+	attached, err := NetworkContainers(n.Name)
+	if err != nil {
+		return nil, err
+	}
+	var leases []AddressLease
+	for _, c := range attached {
+		ip := networkIP(c.Network)
+		if ip == "" {
+			continue
+		}
+		l := AddressLease{Network: n.Name, Address: ip, Container: c.Id}
+		if err := s.Lease(l); err != nil {
+			return nil, err
+		}
+		leases = append(leases, l)
+	}
+	return leases, nil
+}
+
+// releaseAddresses releases the addresses leased to container c and runs
+// the PluginPostAddressRelease plugins for each.
+func releaseAddresses(c *Container) error {
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	released, err := s.Release(c.Id)
+	for _, l := range released {
+		event := newPluginEvent(PluginPostAddressRelease, c)
+		event.Lease = &l
+		if err := runPlugins(context.Background(), event); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	return err
+}
+
+// addressConflicts returns the addresses of a network several running
+// containers claim, with the ids of those containers, which only happens
+// when they got them without a lease.
+func addressConflicts(containers []*Container) map[AddressLease][]string {
+	holders := map[AddressLease][]string{}
+	for _, c := range containers {
+		if !c.Status.running() || c.Network == nil || c.Network.Driver != BridgeNetwork {
+			continue
+		}
+		if ip := networkIP(c.Network); ip != "" {
+			key := AddressLease{Network: c.Network.Name, Address: ip}
+			holders[key] = append(holders[key], c.Id)
+		}
+	}
+	for key, ids := range holders {
+		if len(ids) < 2 {
+			delete(holders, key)
+		}
+	}
+	return holders
+}
+
+// sortedLeases returns the keys of m ordered by network, then address.
+func sortedLeases(m map[AddressLease][]string) []AddressLease {
+	keys := make([]AddressLease, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b AddressLease) int {
+		return cmp.Or(cmp.Compare(a.Network, b.Network), cmp.Compare(a.Address, b.Address))
+	})
+	return keys
+}
@@ -0,0 +1,183 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLeases(t *testing.T) {
+	for _, kind := range []string{DirStateStore, BoltStateStore} {
+		t.Run(kind, func(t *testing.T) {
+			orig := baseStateDir
+			baseStateDir = t.TempDir()
+			defer func() { baseStateDir = orig }()
+			s, err := OpenStateStore(kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetStateStore(s)
+			defer SetStateStore(nil)
+
+			if leases, err := s.Leases(""); err != nil || len(leases) != 0 {
+				t.Fatalf("Leases of an empty store = %v, %v", leases, err)
+			}
+			if released, err := s.Release("a"); err != nil || len(released) != 0 {
+				t.Fatalf("Release of an empty store = %v, %v", released, err)
+			}
+			for _, id := range []string{"a", "b"} {
+				if err := s.Save(&Container{Id: id, Status: Running}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, l := range []AddressLease{
+				{Network: "web", Address: "10.89.0.2", Container: "a"},
+				{Network: "web", Address: "10.89.0.3", Container: "b"},
+				{Network: "db", Address: "10.89.1.2", Container: "a"},
+				{Network: "web", Address: "10.89.0.2", Container: "a"},
+			} {
+				if err := s.Lease(l); err != nil {
+					t.Fatalf("Lease %+v: %v", l, err)
+				}
+			}
+			if err := s.Lease(AddressLease{Network: "web", Address: "10.89.0.2", Container: "b"}); !errors.Is(err, ErrExists) {
+				t.Fatalf("Lease of a held address: got %v, want ErrExists", err)
+			}
+			leases, err := s.Leases("web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(leases); got != "[{web 10.89.0.2 a} {web 10.89.0.3 b}]" {
+				t.Fatalf("Leases(web) = %s", got)
+			}
+
+			released, err := s.Release("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(released); got != "[{db 10.89.1.2 a} {web 10.89.0.2 a}]" {
+				t.Fatalf("Release(a) = %s", got)
+			}
+			if leases, _ := s.Leases(""); fmt.Sprint(leases) != "[{web 10.89.0.3 b}]" {
+				t.Fatalf("Leases after Release = %v", leases)
+			}
+
+			// The lease of a container without state is taken over.
+			if err := s.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Lease(AddressLease{Network: "web", Address: "10.89.0.3", Container: "a"}); err != nil {
+				t.Fatalf("Lease of the address of a deleted container: %v", err)
+			}
+		})
+	}
+}
+
+func TestLeaseStaleRace(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	s := dirStore{}
+	stale := AddressLease{Network: "web", Address: "10.89.0.2", Container: "gone"}
+	if err := s.Lease(stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// Containers taking over the same stale lease at once: one gets it.
+	const n = 64
+	errs := make(chan error, n)
+	for i := range n {
+		id := fmt.Sprintf("c%d", i)
+		if err := s.Save(&Container{Id: id, Status: Running}); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			errs <- s.Lease(AddressLease{Network: "web", Address: "10.89.0.2", Container: id})
+		}()
+	}
+	var leased int
+	for range n {
+		if err := <-errs; err == nil {
+			leased++
+		} else if !errors.Is(err, ErrExists) {
+			t.Errorf("Lease: %v", err)
+		}
+	}
+	if leased != 1 {
+		t.Errorf("%d containers leased the address, want 1", leased)
+	}
+	if leases, err := s.Leases("web"); err != nil || len(leases) != 1 || leases[0].Container == "gone" {
+		t.Errorf("Leases(web) = %v, %v, want one container holding the address", leases, err)
+	}
+
+	// A link found stale is removed only while it still points to the
+	// container found gone.
+	link := filepath.Join(baseStateDir, leasesDirName, "web", "10.89.0.2")
+	if err := removeStaleLink(link, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Readlink(link); err != nil {
+		t.Errorf("removeStaleLink removed a link to another container: %v", err)
+	}
+}
+
+func TestLeaseAddress(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	s, err := OpenStateStore(DirStateStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetStateStore(s)
+	defer SetStateStore(nil)
+
+	n := &Network{Name: "web", Subnet: "10.89.0.0/29", Gateway: "10.89.0.1"}
+	// A container attached before the network had leases.
+	old := &Container{Id: "old", Status: Running, Network: &NetworkConfig{Driver: BridgeNetwork, Name: "web", Address: "10.89.0.2/29"}}
+	for _, c := range []*Container{old, {Id: "a"}, {Id: "b"}} {
+		if err := s.Save(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct{ id, requested, want string }{
+		{"a", "", "10.89.0.3/29"},
+		{"b", "", "10.89.0.4/29"},
+		{"a", "", "10.89.0.3/29"},
+		{"b", "10.89.0.4", "10.89.0.4/29"},
+	} {
+		if addr, err := leaseAddress(n, tt.id, tt.requested); err != nil || addr != tt.want {
+			t.Errorf("leaseAddress(%s, %q) = %q, %v, want %s", tt.id, tt.requested, addr, err, tt.want)
+		}
+	}
+	if _, err := leaseAddress(n, "b", "10.89.0.2"); err == nil {
+		t.Error("leasing the address of another container succeeded")
+	}
+
+	if err := releaseAddresses(&Container{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if addr, err := leaseAddress(n, "b2", ""); err != nil || addr != "10.89.0.3/29" {
+		t.Errorf("leaseAddress after a release = %q, %v, want 10.89.0.3/29", addr, err)
+	}
+}
+
+func TestAddressConflicts(t *testing.T) {
+	bridge := func(id, name, addr string) *Container {
+		return &Container{Id: id, Status: Running, Network: &NetworkConfig{Driver: BridgeNetwork, Name: name, Address: addr}}
+	}
+	stopped := bridge("d", "web", "10.89.0.2/24")
+	stopped.Status = Stopped
+	conflicts := addressConflicts([]*Container{
+		bridge("a", "web", "10.89.0.2/24"),
+		bridge("b", "web", "10.89.0.2/24"),
+		bridge("c", "db", "10.89.0.2/24"),
+		stopped,
+		bridge("e", "web", "10.89.0.3/24"),
+	})
+	if got := fmt.Sprint(conflicts); got != "map[{web 10.89.0.2 }:[a b]]" {
+		t.Errorf("addressConflicts = %s", got)
+	}
+}
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// What the kernel of the host supports among what containers may use is
+// probed once per process, when first needed, rather than found out by a
+// mount or system call failing in the child stage. What can be done
+// without is, with a warning: containers get the vfs storage driver when
+// overlayfs can't be mounted over the storage dir, and the limits of
+// cgroup controllers the kernel doesn't offer are dropped, unless
+// RunOptions.StrictSpec. What can't, user namespaces without idmapped
+// mounts and seccomp notify rules without user notification, fails the
+// container before it is created, naming what the kernel lacks.
+
+// KernelFeatures are what the kernel supports of what containers use.
+type KernelFeatures struct {
+	// Release is the release of the kernel, as uname -r prints it.
+	Release string `json:"release"`
+	// CgroupV2 is set when the unified cgroup hierarchy is mounted, with
+	// CgroupControllers the controllers it offers.
+	CgroupV2          bool     `json:"cgroupV2"`
+	CgroupControllers []string `json:"cgroupControllers"`
+	// Overlay is set when overlayfs can be mounted over the storage of
+	// containers, as the overlay storage driver does.
+	Overlay bool `json:"overlay"`
+	// OverlayUserns is set when overlayfs can be mounted in a user
+	// namespace, since Linux 5.11.
+	OverlayUserns bool `json:"overlayUserns"`
+	// IDMappedMounts is set when mounts can be idmapped, which user
+	// namespaced containers need, since Linux 5.12.
+	IDMappedMounts bool `json:"idmappedMounts"`
+	// TimeNamespace is set when the kernel has time namespaces, since
+	// Linux 5.6.
+	TimeNamespace bool `json:"timeNamespace"`
+	// SeccompNotify is set when seccomp filters can pass system calls to
+	// a seccomp agent, since Linux 5.0.
+	SeccompNotify bool `json:"seccompNotify"`
+}
+
+// Missing describes what the kernel lacks and what becomes of it.
+func (k *KernelFeatures) Missing() []string {
+	var missing []string
+	add := func(has bool, what string) {
+		if !has {
+			missing = append(missing, what)
+		}
+	}
+	add(k.CgroupV2, "no cgroup v2 hierarchy at "+cgroupRoot+": containers can't have resource limits")
+	for _, c := range cgroupControllers {
+		add(!k.CgroupV2 || slices.Contains(k.CgroupControllers, c), fmt.Sprintf("no %s cgroup controller: its limits are dropped", c))
+	}
+	add(k.Overlay, "overlayfs can't be mounted over "+containersDir+": containers run from images get the "+StorageVFS+" storage driver")
+	add(k.OverlayUserns, "no overlayfs in user namespaces: user namespaced containers can't have overlay mounts")
+	add(k.IDMappedMounts, "no idmapped mounts: containers can't have a user namespace")
+	add(k.TimeNamespace, "no time namespaces")
+	add(k.SeccompNotify, "no seccomp user notification: seccomp filters can't have "+string(specs.ActNotify)+" rules")
+	return missing
+}
+
+// kernelFeatures returns the features of the kernel, probing them the
+// first time. It is a variable so tests can override it.
+var kernelFeatures = sync.OnceValue(probeKernel)
+
+// Kernel returns what the kernel supports of what containers use.
+func Kernel() *KernelFeatures {
+	return kernelFeatures()
+}
+
+func probeKernel() *KernelFeatures {
+	k := &KernelFeatures{CgroupV2: cgroupsAvailable(), CgroupControllers: []string{}}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		k.Release = unix.ByteSliceToString(uts.Release[:])
+	}
+	if k.CgroupV2 {
+		k.CgroupControllers = availableControllers()
+	}
+	k.Overlay = overlayMountable(containersDir) == nil
+	k.OverlayUserns = kernelAtLeast(k.Release, 5, 11)
+	// mount_setattr fails with EBADF on a bad fd when the kernel has it.
+	err := unix.MountSetattr(-1, "", unix.AT_EMPTY_PATH, &unix.MountAttr{})
+	k.IDMappedMounts = !errors.Is(err, unix.ENOSYS)
+	_, err = os.Stat("/proc/self/ns/time")
+	k.TimeNamespace = err == nil
+	action := uint32(unix.SECCOMP_RET_USER_NOTIF)
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_GET_ACTION_AVAIL, 0, uintptr(unsafe.Pointer(&action)))
+	k.SeccompNotify = errno == 0
+	return k
+}
+
+// availableControllers returns the controllers of the cgroup hierarchy.
+func availableControllers() []string {
+	data, err := os.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return []string{}
+	}
+	return append([]string{}, strings.Fields(string(data))...)
+}
+
+// kernelAtLeast reports whether release is that of a kernel at least
+// major.minor.
+func kernelAtLeast(release string, major, minor int) bool {
+	fields := strings.FieldsFunc(release, func(r rune) bool { return r < '0' || r > '9' })
+	if len(fields) < 2 {
+		return false
+	}
+	maj, err1 := strconv.Atoi(fields[0])
+	min, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return maj > major || maj == major && min >= minor
+}
+
+// overlayProbes caches the outcome of overlayMountable by directory.
+var overlayProbes sync.Map
+
+// overlayMountable checks that an overlay with its layers in dir can be
+// mounted, by mounting one.
+func overlayMountable(dir string) error {
+	if err, ok := overlayProbes.Load(dir); ok {
+		err, _ := err.(error)
+		return err
+	}
+	err := probeOverlay(dir)
+	overlayProbes.Store(dir, err)
+	return err
+}
+
+func probeOverlay(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(dir, ".overlay-probe-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	for _, d := range []string{"lower", "upper", "work", "merged"} {
+		if err := os.Mkdir(filepath.Join(tmp, d), 0o700); err != nil {
+			return err
+		}
+	}
+	merged := filepath.Join(tmp, "merged")
+	data := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", filepath.Join(tmp, "lower"), filepath.Join(tmp, "upper"), filepath.Join(tmp, "work"))
+	if err := unix.Mount("overlay", merged, "overlay", 0, data); err != nil {
+		return err
+	}
+	return unix.Unmount(merged, unix.MNT_DETACH)
+}
+
+// newStorageDriver returns the storage driver of a new container, that of
+// the configuration unless it is overlay and overlayfs can't be mounted
+// over the storage of containers, with the reason when it isn't.
+func newStorageDriver() (string, error) {
+	if storageDriver != StorageOverlay {
+		return storageDriver, nil
+	}
+	if err := overlayMountable(containersDir); err != nil {
+		return StorageVFS, fmt.Errorf("overlayfs can't be mounted over %s (%w), using the %s storage driver", containersDir, err, StorageVFS)
+	}
+	return StorageOverlay, nil
+}
+
+// checkKernelFeatures fails on what spec needs that the kernel lacks,
+// and drops the limits of cgroup controllers the kernel doesn't offer with
+// a warning, or with strict fails on them.
+func checkKernelFeatures(spec *specs.Spec, strict bool) error {
+	k := Kernel()
+	if userNamespace(spec) {
+		if !k.IDMappedMounts {
+			return fmt.Errorf("a user namespace requires idmapped mounts, which kernel %s lacks (Linux 5.12 or later has them)", k.Release)
+		}
+		if !k.OverlayUserns && slices.ContainsFunc(spec.Mounts, func(m specs.Mount) bool { return m.Type == "overlay" }) {
+			return fmt.Errorf("overlay mounts in a user namespace require overlayfs in user namespaces, which kernel %s lacks (Linux 5.11 or later has it)", k.Release)
+		}
+	}
+	if l := spec.Linux; l != nil && l.Seccomp != nil && !k.SeccompNotify {
+		if slices.ContainsFunc(l.Seccomp.Syscalls, func(s specs.LinuxSyscall) bool { return s.Action == specs.ActNotify }) {
+			return fmt.Errorf("seccomp %s rules require seccomp user notification, which kernel %s lacks (Linux 5.0 or later has it)", specs.ActNotify, k.Release)
+		}
+	}
+
+	if spec.Linux == nil || spec.Linux.Resources == nil || !cgroupsAvailable() {
+		return nil
+	}
+	r := spec.Linux.Resources
+	available := availableControllers()
+	var dropped []string
+	for _, key := range sortedKeys(r.Unified) {
+		controller, _, _ := strings.Cut(key, ".")
+		if controller != "cgroup" && slices.Contains(cgroupControllers, controller) && !slices.Contains(available, controller) {
+			dropped = append(dropped, key)
+		}
+	}
+	if r.BlockIO != nil && !slices.Contains(available, "io") {
+		dropped = append(dropped, "linux.resources.blockIO")
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("the kernel lacks the cgroup controllers of %s", strings.Join(dropped, ", "))
+	}
+	fmt.Fprintf(os.Stderr, "warning: dropping %s, the kernel lacks their cgroup controllers\n", strings.Join(dropped, ", "))
+	for _, key := range dropped {
+		delete(r.Unified, key)
+	}
+	if slices.Contains(dropped, "linux.resources.blockIO") {
+		r.BlockIO = nil
+	}
+	return nil
+}
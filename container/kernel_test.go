@@ -0,0 +1,116 @@
+package container
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestKernelAtLeast(t *testing.T) {
+	for _, tt := range []struct {
+		release      string
+		major, minor int
+		want         bool
+	}{
+		{"5.11.0", 5, 11, true},
+		{"5.10.209-198.858.amzn2.x86_64", 5, 11, false},
+		{"6.1.0-18-amd64", 5, 11, true},
+		{"4.19", 5, 0, false},
+		{"5.4-rc1", 5, 4, true},
+		{"", 5, 0, false},
+	} {
+		if got := kernelAtLeast(tt.release, tt.major, tt.minor); got != tt.want {
+			t.Errorf("kernelAtLeast(%q, %d, %d) = %v, want %v", tt.release, tt.major, tt.minor, got, tt.want)
+		}
+	}
+}
+
+// withKernel overrides the probed kernel features with k for the test.
+func withKernel(t *testing.T, k KernelFeatures) {
+	old := kernelFeatures
+	kernelFeatures = func() *KernelFeatures { return &k }
+	t.Cleanup(func() { kernelFeatures = old })
+}
+
+func TestCheckKernelFeatures(t *testing.T) {
+	withKernel(t, KernelFeatures{Release: "5.4.0"})
+	userns := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.UserNamespace}}}}
+	if err := checkKernelFeatures(userns, false); err == nil {
+		t.Error("a user namespace without idmapped mounts was accepted")
+	}
+	notify := &specs.Spec{Linux: &specs.Linux{Seccomp: &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls:      []specs.LinuxSyscall{{Names: []string{"mkdir"}, Action: specs.ActNotify}},
+	}}}
+	if err := checkKernelFeatures(notify, false); err == nil {
+		t.Error("a notify rule without seccomp user notification was accepted")
+	}
+	if err := checkKernelFeatures(&specs.Spec{}, false); err != nil {
+		t.Errorf("a spec needing nothing was rejected: %v", err)
+	}
+
+	withKernel(t, KernelFeatures{Release: "5.12.0", IDMappedMounts: true, OverlayUserns: true})
+	userns.Mounts = []specs.Mount{{Destination: "/data", Type: "overlay", Source: "overlay"}}
+	if err := checkKernelFeatures(userns, false); err != nil {
+		t.Errorf("overlay mounts in a user namespace on 5.12 were rejected: %v", err)
+	}
+	withKernel(t, KernelFeatures{Release: "5.10.0", IDMappedMounts: true})
+	if err := checkKernelFeatures(userns, false); err == nil {
+		t.Error("overlay mounts in a user namespace on 5.10 were accepted")
+	}
+}
+
+func TestCheckKernelCgroupControllers(t *testing.T) {
+	if !cgroupsAvailable() {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	withKernel(t, KernelFeatures{IDMappedMounts: true, SeccompNotify: true})
+	available := availableControllers()
+	missing := ""
+	for _, c := range cgroupControllers {
+		if !slices.Contains(available, c) {
+			missing = c
+		}
+	}
+	if missing == "" {
+		t.Skip("the kernel offers every controller")
+	}
+	spec := func() *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{
+			Unified: map[string]string{missing + ".max": "1", "cgroup.type": "threaded"},
+		}}}
+	}
+	if err := checkKernelFeatures(spec(), true); err == nil {
+		t.Errorf("limits of the missing %s controller were accepted with strict", missing)
+	}
+	s := spec()
+	if err := checkKernelFeatures(s, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Linux.Resources.Unified[missing+".max"]; ok {
+		t.Errorf("limits of the missing %s controller weren't dropped", missing)
+	}
+	if _, ok := s.Linux.Resources.Unified["cgroup.type"]; !ok {
+		t.Error("a cgroup.* key was dropped")
+	}
+}
+
+func TestNewStorageDriver(t *testing.T) {
+	tempImages(t)
+	old := storageDriver
+	t.Cleanup(func() { storageDriver = old })
+	storageDriver = StorageVFS
+	if d, err := newStorageDriver(); d != StorageVFS || err != nil {
+		t.Errorf("newStorageDriver() = %s, %v, want %s", d, err, StorageVFS)
+	}
+	storageDriver = StorageOverlay
+	d, err := newStorageDriver()
+	if overlayMountable(containersDir) == nil {
+		if d != StorageOverlay || err != nil {
+			t.Errorf("newStorageDriver() = %s, %v, want %s", d, err, StorageOverlay)
+		}
+	} else if d != StorageVFS || err == nil {
+		t.Errorf("newStorageDriver() = %s, %v, want %s with a warning", d, err, StorageVFS)
+	}
+}
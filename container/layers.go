@@ -0,0 +1,272 @@
+package container
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// The layers of an image are tar archives, gzip compressed or not, applied
+// in order over its rootfs. Entries are created relative to the rootfs with
+// openat2(RESOLVE_IN_ROOT), so the symlinks of a layer, absolute ones
+// included, resolve inside it and can't make a later entry land on the
+// host. A whiteout entry .wh.<name> removes <name> from the layers below,
+// and .wh..wh..opq the content of its directory.
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// applyLayer applies the layer read from r over the directory root.
+func applyLayer(root string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var tr *tar.Reader
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(br)
+	}
+	rootFd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: root, Err: err}
+	}
+	defer unix.Close(rootFd)
+
+	l := &layerApplier{root: rootFd, created: map[string]bool{}}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := l.apply(hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// layerApplier applies the entries of a layer.
+type layerApplier struct {
+	root int
+	// created are the paths the layer created, which its opaque
+	// whiteouts keep.
+	created map[string]bool
+}
+
+func (l *layerApplier) apply(hdr *tar.Header, r io.Reader) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	dir, base := path.Split(name)
+	if base == whiteoutOpaque {
+		return l.clearDir(dir)
+	}
+	if target, ok := strings.CutPrefix(base, whiteoutPrefix); ok {
+		return l.remove(path.Join(dir, target))
+	}
+	parent, err := l.mkdirAll(dir)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	l.created[name] = true
+
+	// What the layers below have there is replaced, but a directory by a
+	// directory.
+	var st unix.Stat_t
+	if err := unix.Fstatat(parent, base, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		if hdr.Typeflag != tar.TypeDir || st.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if err := removeAt(parent, base); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := uint32(hdr.Mode & 0o7777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := unix.Mkdirat(parent, base, 0o700); err != nil && err != unix.EEXIST {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		fd, err := unix.Openat(parent, base, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o600)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), name)
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := unix.Symlinkat(hdr.Linkname, parent, base); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// The target is resolved in the rootfs too, and the link shares
+		// its attributes.
+		tdir, tbase := path.Split(path.Clean("/" + hdr.Linkname))
+		tparent, err := l.openDir(tdir, unix.O_PATH)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(tparent)
+		return unix.Linkat(tparent, tbase, parent, base, 0)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		if err := unix.Mknodat(parent, base, kind|mode, int(dev)); err != nil {
+			return err
+		}
+	default:
+		// Other entries, such as sparse files, aren't made by image
+		// builders.
+		return nil
+	}
+
+	if err := unix.Fchownat(parent, base, hdr.Uid, hdr.Gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// After chown, which clears the setuid and setgid bits.
+		if err := unix.Fchmodat(parent, base, mode, 0); err != nil {
+			return err
+		}
+		for key, value := range hdr.PAXRecords {
+			attr, ok := strings.CutPrefix(key, "SCHILY.xattr.")
+			if !ok {
+				continue
+			}
+			err := unix.Lsetxattr(fmt.Sprintf("/proc/self/fd/%d/%s", parent, base), attr, []byte(value), 0)
+			if err != nil && err != unix.ENOTSUP && err != unix.EPERM {
+				return fmt.Errorf("failed to set %s: %w", attr, err)
+			}
+		}
+	}
+	times := []unix.Timespec{unix.NsecToTimespec(hdr.AccessTime.UnixNano()), unix.NsecToTimespec(hdr.ModTime.UnixNano())}
+	if hdr.AccessTime.IsZero() {
+		times[0] = times[1]
+	}
+	return unix.UtimesNanoAt(parent, base, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// openDir opens the directory dir of the rootfs with flags.
+func (l *layerApplier) openDir(dir string, flags int) (int, error) {
+	rel := strings.Trim(dir, "/")
+	if rel == "" {
+		rel = "."
+	}
+	return unix.Openat2(l.root, rel, &unix.OpenHow{
+		Flags:   uint64(flags | unix.O_DIRECTORY | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_IN_ROOT,
+	})
+}
+
+// mkdirAll opens the directory dir of the rootfs, creating it and its
+// parents as needed.
+func (l *layerApplier) mkdirAll(dir string) (int, error) {
+	fd, err := l.openDir(dir, unix.O_PATH)
+	if err != unix.ENOENT {
+		return fd, err
+	}
+	pdir, base := path.Split(strings.TrimSuffix(dir, "/"))
+	parent, err := l.mkdirAll(pdir)
+	if err != nil {
+		return -1, err
+	}
+	err = unix.Mkdirat(parent, base, 0o755)
+	unix.Close(parent)
+	if err != nil && err != unix.EEXIST {
+		return -1, err
+	}
+	return l.openDir(dir, unix.O_PATH)
+}
+
+// remove removes name from the rootfs, if there.
+func (l *layerApplier) remove(name string) error {
+	dir, base := path.Split(name)
+	parent, err := l.openDir(dir, unix.O_PATH)
+	if err == unix.ENOENT || err == unix.ENOTDIR {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(parent)
+	return removeAt(parent, base)
+}
+
+// clearDir removes what the layers below have in the directory dir.
+func (l *layerApplier) clearDir(dir string) error {
+	fd, err := l.openDir(dir, unix.O_RDONLY)
+	if err == unix.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), dir)
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if l.created[path.Join(dir, name)] {
+			continue
+		}
+		if err := removeAt(int(f.Fd()), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAt removes name, and its content if it is a directory, from the
+// directory dirfd.
+func removeAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR {
+		return err
+	}
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	names, err := f.Readdirnames(-1)
+	for _, n := range names {
+		if err == nil {
+			err = removeAt(int(f.Fd()), n)
+		}
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
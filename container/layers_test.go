@@ -0,0 +1,109 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// layer returns a gzip compressed layer of the entries hdrs, regular files
+// holding their Linkname.
+func layer(t *testing.T, hdrs ...*tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, h := range hdrs {
+		var data []byte
+		if h.Typeflag == tar.TypeReg {
+			data, h.Linkname = []byte(h.Linkname), ""
+			h.Size = int64(len(data))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0o755
+		}
+		h.Uid, h.Gid = os.Getuid(), os.Getgid()
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestApplyLayer(t *testing.T) {
+	root := t.TempDir()
+	base := layer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Linkname: "base", Mode: 0o644},
+		&tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Linkname: "box", Mode: 0o644},
+		&tar.Header{Name: "var/cache/a", Typeflag: tar.TypeReg, Linkname: "a", Mode: 0o644},
+		&tar.Header{Name: "var/cache/b", Typeflag: tar.TypeReg, Linkname: "b", Mode: 0o644},
+		&tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Linkname: "tool", Mode: 0o4755},
+		&tar.Header{Name: "bin/alias", Typeflag: tar.TypeLink, Linkname: "bin/tool"},
+		// An absolute symlink resolves in the rootfs, not on the host.
+		&tar.Header{Name: "host", Typeflag: tar.TypeSymlink, Linkname: "/"},
+	)
+	upper := layer(t,
+		&tar.Header{Name: "etc/.wh.hostname", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Linkname: "upper", Mode: 0o644},
+		&tar.Header{Name: "var/cache/c", Typeflag: tar.TypeReg, Linkname: "c", Mode: 0o644},
+		&tar.Header{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg},
+		&tar.Header{Name: "host/escaped", Typeflag: tar.TypeReg, Linkname: "x", Mode: 0o644},
+	)
+	for _, l := range [][]byte{base, upper} {
+		if err := applyLayer(root, bytes.NewReader(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for path, want := range map[string]string{
+		"etc/os-release": "upper",
+		"var/cache/c":    "c",
+		"bin/alias":      "tool",
+		"escaped":        "x",
+	} {
+		if data, err := os.ReadFile(filepath.Join(root, path)); err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", path, data, err, want)
+		}
+	}
+	for _, path := range []string{"etc/hostname", "var/cache/a", "var/cache/b"} {
+		if _, err := os.Lstat(filepath.Join(root, path)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed by a whiteout, got %v", path, err)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(root, "bin/tool")); err != nil || fi.Mode()&os.ModeSetuid == 0 || fi.Mode().Perm() != 0o755 {
+		t.Errorf("expected bin/tool to keep its mode, got %v, %v", fi.Mode(), err)
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(root), "escaped")); !os.IsNotExist(err) {
+		t.Error("expected the layer not to write outside of the rootfs")
+	}
+}
+
+func TestApplyLayerReplaces(t *testing.T) {
+	root := t.TempDir()
+	for _, l := range [][]byte{
+		layer(t, &tar.Header{Name: "data/file", Typeflag: tar.TypeReg, Linkname: "x", Mode: 0o644}),
+		// A directory replaced by a file, then by a symlink.
+		layer(t, &tar.Header{Name: "data", Typeflag: tar.TypeReg, Linkname: "file", Mode: 0o644}),
+		layer(t, &tar.Header{Name: "data", Typeflag: tar.TypeSymlink, Linkname: "elsewhere"}),
+	} {
+		if err := applyLayer(root, bytes.NewReader(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(root, "data")); err != nil || target != "elsewhere" {
+		t.Errorf("data = %q, %v, want a symlink to elsewhere", target, err)
+	}
+}
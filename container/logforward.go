@@ -0,0 +1,400 @@
+package container
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The syslog, fluentd and http log drivers forward each line of output to a
+// remote collector, from the logger process, as well as logging it to the
+// file of the json-file driver so logs still prints it. Lines are queued in
+// memory, up to BufferSize, while the collector is unreachable, the oldest
+// being dropped past that, and sent in order once the logger has connected
+// again. A line may be sent twice if the connection breaks while sending it.
+
+// Log drivers forwarding the output to a remote collector.
+const (
+	// LogDriverSyslog sends RFC 5424 messages over TCP or TLS, framed by
+	// octet counting (RFC 6587).
+	LogDriverSyslog = "syslog"
+	// LogDriverFluentd sends events in the Fluentd forward protocol.
+	LogDriverFluentd = "fluentd"
+	// LogDriverHTTP POSTs batches of records as JSON lines.
+	LogDriverHTTP = "http"
+)
+
+// defaultLogBuffer is how many lines are queued for a collector by default.
+const defaultLogBuffer = 10000
+
+// logBatchSize bounds how many lines are sent at once.
+const logBatchSize = 500
+
+// logFlushTimeout bounds how long the logger keeps trying to send what is
+// queued once the container has exited.
+var logFlushTimeout = 10 * time.Second
+
+// logReconnectDelay and logMaxReconnectDelay bound the exponential backoff
+// between attempts to reach a collector.
+var (
+	logReconnectDelay    = time.Second
+	logMaxReconnectDelay = 30 * time.Second
+)
+
+// remoteLogDriver reports whether driver forwards to a collector.
+func remoteLogDriver(driver string) bool {
+	return driver == LogDriverSyslog || driver == LogDriverFluentd || driver == LogDriverHTTP
+}
+
+// validateLogConfig checks cfg once its driver is set.
+func validateLogConfig(cfg LogConfig) error {
+	remote := cfg.Address != "" || cfg.Tag != "" || cfg.TLSCA != "" || cfg.TLSSkipVerify || cfg.BufferSize != 0
+	if !remoteLogDriver(cfg.Driver) {
+		if remote {
+			return fmt.Errorf("address, tag, tls and buffer log options require the %s, %s or %s log driver", LogDriverSyslog, LogDriverFluentd, LogDriverHTTP)
+		}
+		return nil
+	}
+	if cfg.Address == "" {
+		return fmt.Errorf("the %s log driver requires an address log option", cfg.Driver)
+	}
+	_, _, err := parseLogAddress(cfg.Driver, cfg.Address)
+	return err
+}
+
+// parseLogAddress returns the dial address of a syslog or fluentd
+// collector, and whether to use TLS, or the URL of an http one. Syslog and
+// fluentd take tcp://host[:port], tls://host[:port] or host[:port], the port
+// defaulting to 514, 6514 over TLS, and 24224; http takes an http or https
+// URL.
+func parseLogAddress(driver, address string) (addr string, useTLS bool, err error) {
+	if driver == LogDriverHTTP {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", false, fmt.Errorf("invalid log address %q: expected an http or https URL", address)
+		}
+		return u.String(), u.Scheme == "https", nil
+	}
+	hostport := address
+	if scheme, rest, ok := strings.Cut(address, "://"); ok {
+		switch scheme {
+		case "tcp":
+		case "tls":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("invalid log address %q: expected tcp:// or tls://", address)
+		}
+		hostport = rest
+	}
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, "24224"
+		if driver == LogDriverSyslog {
+			port = "514"
+			if useTLS {
+				port = "6514"
+			}
+		}
+	}
+	if n, err := strconv.Atoi(port); host == "" || strings.ContainsAny(host, "/ ") || err != nil || n < 1 || n > 65535 {
+		return "", false, fmt.Errorf("invalid log address %q: expected [tcp:// or tls://]host[:port]", address)
+	}
+	return net.JoinHostPort(host, port), useTLS, nil
+}
+
+// logSink sends lines to a collector.
+type logSink interface {
+	// send sends entries in order, all of them or none if it fails.
+	send(entries []logEntry) error
+	close()
+}
+
+// newLogSink returns the sink of the remote driver of cfg.
+func newLogSink(cfg LogConfig) (logSink, error) {
+	addr, useTLS, err := parseLogAddress(cfg.Driver, cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		tlsConfig = &tls.Config{InsecureSkipVerify: cfg.TLSSkipVerify}
+		if cfg.TLSCA != "" {
+			pem, err := os.ReadFile(cfg.TLSCA)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read log tls-ca: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in log tls-ca %s", cfg.TLSCA)
+			}
+		}
+	}
+	switch cfg.Driver {
+	case LogDriverHTTP:
+		return &httpSink{url: addr, tag: cfg.Tag, client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}}, nil
+	case LogDriverSyslog:
+		hostname, _ := os.Hostname()
+		return &streamSink{addr: addr, tls: tlsConfig, encode: func(b *bytes.Buffer, e logEntry) {
+			encodeSyslog(b, hostname, cfg.Tag, e)
+		}}, nil
+	case LogDriverFluentd:
+		return &streamSink{addr: addr, tls: tlsConfig, encode: func(b *bytes.Buffer, e logEntry) {
+			encodeFluentd(b, cfg.Tag, e)
+		}}, nil
+	}
+	return nil, fmt.Errorf("log driver %q doesn't forward", cfg.Driver)
+}
+
+// streamSink writes encoded lines to a TCP or TLS connection, connecting
+// again after a failure.
+type streamSink struct {
+	addr   string
+	tls    *tls.Config
+	encode func(*bytes.Buffer, logEntry)
+	conn   net.Conn
+}
+
+func (s *streamSink) send(entries []logEntry) error {
+	if s.conn == nil {
+		d := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if s.tls != nil {
+			s.conn, err = tls.DialWithDialer(d, "tcp", s.addr, s.tls)
+		} else {
+			s.conn, err = d.Dial("tcp", s.addr)
+		}
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+	var b bytes.Buffer
+	for _, e := range entries {
+		s.encode(&b, e)
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *streamSink) close() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// encodeSyslog appends e as an octet-counted RFC 5424 message, from the
+// daemon facility, at the info severity for stdout and err for stderr.
+func encodeSyslog(b *bytes.Buffer, hostname, tag string, e logEntry) {
+	pri := 3<<3 | 6
+	if e.Stream == "stderr" {
+		pri = 3<<3 | 3
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s - - - %s", pri, e.Time.Format(time.RFC3339Nano),
+		syslogField(hostname, 255), syslogField(tag, 48), strings.TrimSuffix(e.Log, "\n"))
+	fmt.Fprintf(b, "%d %s", len(msg), msg)
+}
+
+// syslogField returns s as a header field of at most max printable ASCII
+// characters, or the nil value "-" if empty.
+func syslogField(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s[:min(len(s), max)]
+}
+
+// encodeFluentd appends e as a forward protocol message, [tag, time,
+// record] with time as an EventTime.
+func encodeFluentd(b *bytes.Buffer, tag string, e logEntry) {
+	b.WriteByte(0x93)
+	msgpackString(b, tag)
+	var t [10]byte
+	t[0], t[1] = 0xd7, 0x00
+	binary.BigEndian.PutUint32(t[2:], uint32(e.Time.Unix()))
+	binary.BigEndian.PutUint32(t[6:], uint32(e.Time.Nanosecond()))
+	b.Write(t[:])
+	b.WriteByte(0x83)
+	msgpackString(b, "log")
+	msgpackString(b, strings.TrimSuffix(e.Log, "\n"))
+	msgpackString(b, "stream")
+	msgpackString(b, e.Stream)
+	msgpackString(b, "container_name")
+	msgpackString(b, tag)
+}
+
+// msgpackString appends s as a MessagePack str.
+func msgpackString(b *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n < 32:
+		b.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		b.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		b.WriteByte(0xda)
+		_ = binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(0xdb)
+		_ = binary.Write(b, binary.BigEndian, uint32(n))
+	}
+	b.WriteString(s)
+}
+
+// httpSink POSTs each batch as JSON lines.
+type httpSink struct {
+	url    string
+	tag    string
+	client *http.Client
+}
+
+// httpLogRecord is a line as POSTed by the http log driver.
+type httpLogRecord struct {
+	Time      time.Time `json:"time"`
+	Container string    `json:"container"`
+	Stream    string    `json:"stream"`
+	Log       string    `json:"log"`
+}
+
+func (s *httpSink) send(entries []logEntry) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, e := range entries {
+		if err := enc.Encode(httpLogRecord{e.Time, s.tag, e.Stream, strings.TrimSuffix(e.Log, "\n")}); err != nil {
+			return err
+		}
+	}
+	resp, err := s.client.Post(s.url, "application/x-ndjson", &b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() {
+	s.client.CloseIdleConnections()
+}
+
+// logForwarder queues lines for a sink and sends them from a goroutine.
+type logForwarder struct {
+	sink logSink
+	max  int
+
+	mu      sync.Mutex
+	wake    chan struct{}
+	queue   []logEntry
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+func newLogForwarder(sink logSink, max int) *logForwarder {
+	if max <= 0 {
+		max = defaultLogBuffer
+	}
+	f := &logForwarder{sink: sink, max: max, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	go f.run()
+	return f
+}
+
+// add queues e, dropping the oldest line if the queue is full.
+func (f *logForwarder) add(e logEntry) {
+	f.mu.Lock()
+	if len(f.queue) == f.max {
+		f.queue = f.queue[1:]
+		f.dropped++
+	}
+	f.queue = append(f.queue, e)
+	f.mu.Unlock()
+	f.signal()
+}
+
+func (f *logForwarder) signal() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close sends what is queued, giving up after timeout.
+func (f *logForwarder) close(timeout time.Duration) {
+	f.mu.Lock()
+	f.closed = true
+	f.mu.Unlock()
+	f.signal()
+	select {
+	case <-f.done:
+	case <-time.After(timeout):
+		f.mu.Lock()
+		fmt.Fprintf(os.Stderr, "logger: gave up sending %d lines\n", len(f.queue))
+		f.mu.Unlock()
+	}
+	f.sink.close()
+}
+
+func (f *logForwarder) run() {
+	defer close(f.done)
+	var delay time.Duration
+	reported := 0
+	for {
+		f.mu.Lock()
+		batch := f.queue[:min(len(f.queue), logBatchSize)]
+		closed, dropped := f.closed, f.dropped
+		f.mu.Unlock()
+		if len(batch) == 0 {
+			if closed {
+				return
+			}
+			<-f.wake
+			continue
+		}
+
+		if err := f.sink.send(batch); err != nil {
+			delay = min(max(2*delay, logReconnectDelay), logMaxReconnectDelay)
+			fmt.Fprintf(os.Stderr, "logger: %v, retrying in %s\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		f.mu.Lock()
+		// Lines dropped meanwhile came off the front, possibly from the
+		// batch itself.
+		sent := len(batch) - min(f.dropped-dropped, len(batch))
+		f.queue = f.queue[sent:]
+		if f.dropped > reported {
+			fmt.Fprintf(os.Stderr, "logger: dropped %d lines while the collector was unreachable\n", f.dropped-reported)
+			reported = f.dropped
+		}
+		f.mu.Unlock()
+	}
+}
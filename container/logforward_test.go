@@ -0,0 +1,217 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateLogConfig(t *testing.T) {
+	cfg, err := ParseLogOpts([]string{"address=tls://logs.lab:6514", "tag=web", "tls-skip-verify=true", "buffer=100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (LogConfig{Address: "tls://logs.lab:6514", Tag: "web", TLSSkipVerify: true, BufferSize: 100}); cfg != want {
+		t.Fatalf("ParseLogOpts = %+v, want %+v", cfg, want)
+	}
+	for _, tt := range []struct {
+		cfg LogConfig
+		ok  bool
+	}{
+		{LogConfig{Driver: LogDriverSyslog, Address: "logs.lab"}, true},
+		{LogConfig{Driver: LogDriverFluentd, Address: "tcp://[::1]:24224"}, true},
+		{LogConfig{Driver: LogDriverHTTP, Address: "https://logs.lab/ingest"}, true},
+		{LogConfig{Driver: LogDriverSyslog}, false},
+		{LogConfig{Driver: LogDriverSyslog, Address: "udp://logs.lab"}, false},
+		{LogConfig{Driver: LogDriverFluentd, Address: "logs.lab:0"}, false},
+		{LogConfig{Driver: LogDriverHTTP, Address: "logs.lab:80"}, false},
+		{LogConfig{Driver: LogDriverJSONFile, Address: "logs.lab"}, false},
+		{LogConfig{Driver: LogDriverJSONFile, MaxSize: 1 << 20}, true},
+	} {
+		if err := validateLogConfig(tt.cfg); (err == nil) != tt.ok {
+			t.Errorf("validateLogConfig(%+v) = %v", tt.cfg, err)
+		}
+	}
+
+	for _, tt := range []struct{ driver, address, want string }{
+		{LogDriverSyslog, "logs.lab", "logs.lab:514"},
+		{LogDriverSyslog, "tls://logs.lab", "logs.lab:6514"},
+		{LogDriverFluentd, "logs.lab", "logs.lab:24224"},
+	} {
+		if addr, _, err := parseLogAddress(tt.driver, tt.address); err != nil || addr != tt.want {
+			t.Errorf("parseLogAddress(%s, %s) = %s, %v, want %s", tt.driver, tt.address, addr, err, tt.want)
+		}
+	}
+}
+
+func TestEncodeLogRecords(t *testing.T) {
+	e := logEntry{Time: time.Date(2026, 10, 18, 9, 0, 0, 5e8, time.UTC), Stream: "stderr", Log: "boom\n"}
+
+	var b bytes.Buffer
+	encodeSyslog(&b, "host 1", "web", e)
+	msg := "<27>1 2026-10-18T09:00:00.5Z host1 web - - - boom"
+	if want := strconv.Itoa(len(msg)) + " " + msg; b.String() != want {
+		t.Errorf("syslog: got %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	encodeFluentd(&b, "web", e)
+	want := []byte{0x93, 0xa3, 'w', 'e', 'b', 0xd7, 0x00}
+	want = binary.BigEndian.AppendUint32(want, uint32(e.Time.Unix()))
+	want = binary.BigEndian.AppendUint32(want, 5e8)
+	want = append(want, 0x83, 0xa3, 'l', 'o', 'g', 0xa4, 'b', 'o', 'o', 'm')
+	want = append(want, 0xa6, 's', 't', 'r', 'e', 'a', 'm', 0xa6, 's', 't', 'd', 'e', 'r', 'r')
+	want = append(want, 0xae, 'c', 'o', 'n', 't', 'a', 'i', 'n', 'e', 'r', '_', 'n', 'a', 'm', 'e', 0xa3, 'w', 'e', 'b')
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Errorf("fluentd: got % x, want % x", b.Bytes(), want)
+	}
+
+	b.Reset()
+	msgpackString(&b, strings.Repeat("x", 300))
+	if got := b.Bytes()[:3]; !bytes.Equal(got, []byte{0xda, 0x01, 0x2c}) {
+		t.Errorf("msgpack str16 header = % x", got)
+	}
+}
+
+// flakySink fails until up is set, recording what it is sent.
+type flakySink struct {
+	mu   sync.Mutex
+	up   bool
+	sent []string
+}
+
+func (s *flakySink) send(entries []logEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.up {
+		return errors.New("connection refused")
+	}
+	for _, e := range entries {
+		s.sent = append(s.sent, e.Log)
+	}
+	return nil
+}
+
+func (s *flakySink) close() {}
+
+func TestLogForwarderBuffers(t *testing.T) {
+	orig := logReconnectDelay
+	logReconnectDelay = 10 * time.Millisecond
+	defer func() { logReconnectDelay = orig }()
+
+	sink := &flakySink{}
+	f := newLogForwarder(sink, 3)
+	for i := 0; i < 5; i++ {
+		f.add(logEntry{Log: fmt.Sprint(i)})
+	}
+	sink.mu.Lock()
+	sink.up = true
+	sink.mu.Unlock()
+	f.close(5 * time.Second)
+
+	// The two oldest lines were dropped from the full buffer.
+	if got := strings.Join(sink.sent, ","); got != "2,3,4" {
+		t.Errorf("sent %s, want 2,3,4", got)
+	}
+}
+
+func TestLogForwarderSyslog(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			n := 0
+			if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+				return
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	}()
+
+	sink, err := newLogSink(LogConfig{Driver: LogDriverSyslog, Address: "tcp://" + l.Addr().String(), Tag: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newLogForwarder(sink, 0)
+	f.add(logEntry{Time: time.Now(), Stream: "stdout", Log: "hello\n"})
+	f.add(logEntry{Time: time.Now(), Stream: "stderr", Log: "oops\n"})
+	f.close(5 * time.Second)
+	for _, want := range []string{"<30>1 ", "<27>1 "} {
+		select {
+		case msg := <-received:
+			if !strings.HasPrefix(msg, want) || !strings.Contains(msg, " web - - - ") {
+				t.Errorf("got %q, want a message of web starting with %q", msg, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+	}
+}
+
+func TestLogForwarderHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var records []httpLogRecord
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// The first request fails, so the batch is sent again.
+		if calls++; calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		for {
+			var rec httpLogRecord
+			if err := dec.Decode(&rec); err != nil {
+				break
+			}
+			records = append(records, rec)
+		}
+	}))
+	defer srv.Close()
+
+	orig := logReconnectDelay
+	logReconnectDelay = 10 * time.Millisecond
+	defer func() { logReconnectDelay = orig }()
+
+	sink, err := newLogSink(LogConfig{Driver: LogDriverHTTP, Address: srv.URL, Tag: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newLogForwarder(sink, 0)
+	f.add(logEntry{Stream: "stdout", Log: "hello\n"})
+	f.close(5 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 1 || records[0].Container != "web" || records[0].Log != "hello" || records[0].Stream != "stdout" {
+		t.Errorf("got %+v", records)
+	}
+}
@@ -0,0 +1,800 @@
+package container
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// The output of a detached container is copied by a logger process, a
+// re-exec of containish ("init LOGGER <path> <config>"), into a file of JSON
+// lines in its state directory. When the file grows past MaxSize it is
+// renamed to <path>.1 and compressed, older files shift up by one and the
+// oldest is dropped, so at most MaxFile files are kept.
+
+// logStage is the init stage copying a container's output to its log file.
+const logStage = "LOGGER"
+
+const logFileName = "container.log"
+
+// maxLogLine is the longest line logged as one entry. Longer ones are
+// split into entries marked partial, of about that size as a character
+// isn't split, so output without newlines can't grow the logger without
+// bound.
+const maxLogLine = 16 << 10
+
+// logPollInterval is how often a follower checks for new lines.
+var logPollInterval = 200 * time.Millisecond
+
+// Log drivers of detached containers.
+const (
+	// LogDriverJSONFile logs the output to a file of JSON lines. It is
+	// the default.
+	LogDriverJSONFile = "json-file"
+	// LogDriverNone discards the output.
+	LogDriverNone = "none"
+)
+
+// defaultLogDriver is the log driver of detached containers that don't
+// select one, see Config.
+var defaultLogDriver = LogDriverJSONFile
+
+// defaultLogConfig is the rotation of detached containers logging to a
+// file that don't set one, see Config.
+var defaultLogConfig LogConfig
+
+func validateLogDriver(driver string) error {
+	switch driver {
+	case "", LogDriverJSONFile, LogDriverNone, LogDriverSyslog, LogDriverFluentd, LogDriverHTTP:
+		return nil
+	}
+	return fmt.Errorf("unknown log driver %q: expected %s, %s, %s, %s or %s", driver,
+		LogDriverJSONFile, LogDriverNone, LogDriverSyslog, LogDriverFluentd, LogDriverHTTP)
+}
+
+// LogConfig controls how the output of a detached container is logged.
+type LogConfig struct {
+	// Driver is the log driver, defaultLogDriver if empty.
+	Driver string `json:"driver,omitempty"`
+	// MaxSize is the size in bytes at which the log is rotated. Zero
+	// disables rotation.
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// MaxFile is the number of files kept, the current one included.
+	MaxFile int `json:"maxFile,omitempty"`
+	// Address is the collector the syslog, fluentd and http drivers
+	// forward to, see parseLogAddress.
+	Address string `json:"address,omitempty"`
+	// Tag names the container in forwarded records, its id if empty.
+	Tag string `json:"tag,omitempty"`
+	// TLSCA is a PEM file of the CAs to verify the collector with,
+	// instead of those of the host, and TLSSkipVerify doesn't verify it.
+	TLSCA         string `json:"tlsCA,omitempty"`
+	TLSSkipVerify bool   `json:"tlsSkipVerify,omitempty"`
+	// BufferSize is how many lines are queued while the collector is
+	// unreachable, defaultLogBuffer if zero.
+	BufferSize int `json:"bufferSize,omitempty"`
+}
+
+// logEntry is one line of container output. Time is encoded in RFC 3339
+// with nanoseconds and Stream is "stdout" or "stderr". Partial is set on
+// the pieces of a line longer than maxLogLine but the last, whose Log
+// doesn't end the line.
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Stream  string    `json:"stream"`
+	Log     string    `json:"log"`
+	Partial bool      `json:"partial,omitempty"`
+}
+
+// same reports whether e and o are the same entry.
+func (e logEntry) same(o logEntry) bool {
+	return e.Time.Equal(o.Time) && e.Stream == o.Stream && e.Log == o.Log
+}
+
+// ParseLogOpts parses --log-opt values of the form "max-size=10m" and
+// "max-file=3", and for the drivers forwarding to a collector "address=",
+// "tag=", "tls-ca=", "tls-skip-verify=true" and "buffer=".
+func ParseLogOpts(opts []string) (LogConfig, error) {
+	var cfg LogConfig
+	for _, o := range opts {
+		key, val, ok := strings.Cut(o, "=")
+		if !ok {
+			return cfg, fmt.Errorf("invalid --log-opt %q: expected key=value", o)
+		}
+		switch key {
+		case "max-size":
+			size, err := parseByteSize(val)
+			if err != nil || size <= 0 {
+				return cfg, fmt.Errorf("invalid max-size %q: expected a size such as 10m", val)
+			}
+			cfg.MaxSize = size
+		case "max-file":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("invalid max-file %q: expected a positive number", val)
+			}
+			cfg.MaxFile = n
+		case "address":
+			cfg.Address = val
+		case "tag":
+			cfg.Tag = val
+		case "tls-ca":
+			cfg.TLSCA = val
+		case "tls-skip-verify":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid tls-skip-verify %q: expected true or false", val)
+			}
+			cfg.TLSSkipVerify = b
+		case "buffer":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return cfg, fmt.Errorf("invalid buffer %q: expected a positive number of lines", val)
+			}
+			cfg.BufferSize = n
+		default:
+			return cfg, fmt.Errorf("unknown log option %q", key)
+		}
+	}
+	if cfg.MaxFile > 0 && cfg.MaxSize == 0 {
+		return cfg, fmt.Errorf("max-file requires max-size")
+	}
+	if cfg.MaxSize > 0 && cfg.MaxFile == 0 {
+		cfg.MaxFile = 1
+	}
+	return cfg, nil
+}
+
+// parseByteSize parses a number of bytes with an optional k, m or g suffix.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToLower(s), "b")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k':
+			mult = 1 << 10
+		case 'm':
+			mult = 1 << 20
+		case 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+// startLogger starts the logger process of a container and returns the
+// write ends of its stdout and stderr pipes.
+func startLogger(path string, cfg LogConfig) (stdout, stderr *os.File, err error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return nil, nil, err
+	}
+	defer outR.Close()
+	defer errR.Close()
+
+	cmd := exec.Command("/proc/self/exe", "init", logStage, path, string(data))
+	cmd.ExtraFiles = []*os.File{outR, errR}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		outW.Close()
+		errW.Close()
+		return nil, nil, fmt.Errorf("failed to start logger: %w", err)
+	}
+	_ = cmd.Process.Release()
+	return outW, errW, nil
+}
+
+// runLogger copies fds 3 (stdout) and 4 (stderr) to the log file at path
+// until both are closed, and forwards them to the collector of a remote
+// driver.
+func runLogger(path, config string) error {
+	var cfg LogConfig
+	if err := json.Unmarshal([]byte(config), &cfg); err != nil {
+		return fmt.Errorf("invalid log config: %w", err)
+	}
+	w, err := openLogWriter(path, cfg)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	if remoteLogDriver(cfg.Driver) {
+		sink, err := newLogSink(cfg)
+		if err != nil {
+			return err
+		}
+		w.forward = newLogForwarder(sink, cfg.BufferSize)
+		defer w.forward.close(logFlushTimeout)
+	}
+
+	var wg sync.WaitGroup
+	for i, stream := range []string{"stdout", "stderr"} {
+		wg.Add(1)
+		go func(f *os.File, stream string) {
+			defer wg.Done()
+			defer f.Close()
+			if err := w.copyStream(stream, f); err != nil {
+				fmt.Fprintf(os.Stderr, "logger: %v\n", err)
+			}
+		}(os.NewFile(uintptr(3+i), stream), stream)
+	}
+	wg.Wait()
+	return nil
+}
+
+// logWriter appends entries to a log file, rotating it between lines.
+type logWriter struct {
+	mu   sync.Mutex
+	path string
+	cfg  LogConfig
+	f    *os.File
+	size int64
+	// forward receives the entries too, if set.
+	forward *logForwarder
+}
+
+func openLogWriter(path string, cfg LogConfig) (*logWriter, error) {
+	w := &logWriter{path: path, cfg: cfg}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *logWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, fi.Size()
+	return nil
+}
+
+func (w *logWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+// copyStream writes every line read from r as an entry of stream, those
+// longer than maxLogLine in pieces.
+func (w *logWriter) copyStream(stream string, r io.Reader) error {
+	br := bufio.NewReaderSize(r, maxLogLine)
+	// rest is the start of a character cut by the previous piece.
+	var rest string
+	for {
+		data, err := br.ReadSlice('\n')
+		line := rest + string(data)
+		rest = ""
+		partial := err == bufio.ErrBufferFull
+		if partial {
+			line, rest = cutIncompleteRune(line)
+		}
+		if line != "" {
+			if werr := w.write(logEntry{Stream: stream, Log: line, Partial: partial}); werr != nil {
+				return werr
+			}
+		}
+		if partial {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// cutIncompleteRune splits s before a UTF-8 sequence cut short at its end.
+func cutIncompleteRune(s string) (string, string) {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return s[:i], s[i:]
+			}
+			break
+		}
+	}
+	return s, ""
+}
+
+// write timestamps and appends e, rotating first if it would push the file
+// past MaxSize. Entries are timestamped under the lock so times never go
+// backwards in the log, which followers rely on.
+func (w *logWriter) write(e logEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e.Time = time.Now().UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if w.cfg.MaxSize > 0 && w.size > 0 && w.size+int64(len(data)) > w.cfg.MaxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(data)
+	w.size += int64(n)
+	if w.forward != nil {
+		w.forward.add(e)
+	}
+	return err
+}
+
+// rotate moves the current file to <path>.1.gz, shifting older files up and
+// dropping those past MaxFile, and starts a new file.
+func (w *logWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	if w.cfg.MaxFile <= 1 {
+		if err := os.Remove(w.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return w.open()
+	}
+
+	for i := w.cfg.MaxFile - 1; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			src := rotatedLogFile(w.path, i) + ext
+			var err error
+			if i == w.cfg.MaxFile-1 {
+				err = os.Remove(src)
+			} else {
+				err = os.Rename(src, rotatedLogFile(w.path, i+1)+ext)
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to rotate log: %w", err)
+			}
+		}
+	}
+	rotated := rotatedLogFile(w.path, 1)
+	if err := os.Rename(w.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate log: %w", err)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	// An uncompressed file is still read back, so failing here loses
+	// nothing.
+	if err := compressFile(rotated); err != nil {
+		fmt.Fprintf(os.Stderr, "logger: failed to compress %s: %v\n", rotated, err)
+	}
+	return nil
+}
+
+func rotatedLogFile(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// compressFile replaces path with path.gz.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedLogFiles returns the rotated files of the log at path, oldest
+// first. A file found both compressed and not is still being compressed,
+// so the uncompressed copy is used.
+func rotatedLogFiles(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	files := map[int]string{}
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, path+".")
+		num, gz := strings.CutSuffix(suffix, ".gz")
+		n, err := strconv.Atoi(num)
+		if err != nil || n < 1 {
+			continue
+		}
+		if _, ok := files[n]; ok && gz {
+			continue
+		}
+		files[n] = m
+	}
+	nums := make([]int, 0, len(files))
+	for n := range files {
+		nums = append(nums, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+	var out []string
+	for _, n := range nums {
+		out = append(out, files[n])
+	}
+	return out, nil
+}
+
+// LogOptions selects what ReadLogs prints.
+type LogOptions struct {
+	// Follow keeps printing new output, across rotations, until the
+	// container stops.
+	Follow bool
+	// Timestamps prefixes each line with the RFC 3339 time it was logged.
+	Timestamps bool
+	// Since skips the lines logged before it, when set.
+	Since time.Time
+	// Tail limits the output to the last Tail lines logged so far. A
+	// negative value prints them all.
+	Tail int
+}
+
+// ParseLogSince parses a --since value, either an RFC 3339 time or a
+// duration such as "10m" counted back from now.
+func ParseLogSince(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid --since %q: expected an RFC 3339 time or a duration such as 10m", value)
+	}
+	return now.Add(-d), nil
+}
+
+// ReadLogs writes the logged output of a container to stdout and stderr,
+// each line to the stream it was logged from.
+func ReadLogs(id string, opts LogOptions, stdout, stderr io.Writer) error {
+	c, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if c.LogPath == "" {
+		return fmt.Errorf("container %s has no logs: only detached containers using the json-file log driver are logged", id)
+	}
+	running := func() bool {
+		c, err := LoadState(id)
+		return err == nil && c.Status.running() && syscall.Kill(c.InitProcessPiD, 0) == nil
+	}
+	if !opts.Follow {
+		running = func() bool { return false }
+	}
+	return readLogs(c.LogPath, newLogPrinter(opts, stdout, stderr), running)
+}
+
+// logPrinter writes the entries selected by LogOptions.
+type logPrinter struct {
+	opts           LogOptions
+	stdout, stderr io.Writer
+	// backlog holds the last opts.Tail entries until the end of the log
+	// is reached.
+	backlog   []logEntry
+	buffering bool
+}
+
+func newLogPrinter(opts LogOptions, stdout, stderr io.Writer) *logPrinter {
+	return &logPrinter{opts: opts, stdout: stdout, stderr: stderr, buffering: opts.Tail >= 0}
+}
+
+func (p *logPrinter) add(e logEntry) {
+	if !p.opts.Since.IsZero() && e.Time.Before(p.opts.Since) {
+		return
+	}
+	if !p.buffering {
+		p.write(e)
+		return
+	}
+	if p.opts.Tail == 0 {
+		return
+	}
+	if len(p.backlog) == p.opts.Tail {
+		p.backlog = p.backlog[1:]
+	}
+	p.backlog = append(p.backlog, e)
+}
+
+// flush prints the buffered tail; later entries are printed as they come.
+func (p *logPrinter) flush() {
+	for _, e := range p.backlog {
+		p.write(e)
+	}
+	p.backlog, p.buffering = nil, false
+}
+
+func (p *logPrinter) write(e logEntry) {
+	line := e.Log
+	if p.opts.Timestamps {
+		line = e.Time.Format(time.RFC3339Nano) + " " + line
+	}
+	if e.Stream == "stderr" {
+		io.WriteString(p.stderr, line)
+	} else {
+		io.WriteString(p.stdout, line)
+	}
+}
+
+// readLogs prints the rotated files and then the current log, polling for
+// new lines while running reports true.
+func readLogs(path string, p *logPrinter, running func() bool) error {
+	// Open the current file first so a rotation while the older files are
+	// printed can't make us skip it.
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer func() { f.Close() }()
+	if err := printRotatedBetween(path, nil, f, p); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	var pending string
+	// first is the first entry of the open file, once read, and final
+	// is set once it has been rotated away.
+	var first *logEntry
+	var final bool
+	for {
+		line, err := br.ReadString('\n')
+		pending += line
+		if err == nil {
+			if e, ok := printLogLine(pending, p); ok && first == nil {
+				first = &e
+			}
+			pending = ""
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		// Everything logged so far has been read.
+		p.flush()
+
+		// At the end of the file: move on to a new one if it was rotated,
+		// otherwise wait for more unless the container is gone.
+		if rotatedAway(f, path) {
+			if !final {
+				// The writer closes a file before rotating it, but may
+				// have appended to it since we reached its end: read it
+				// to the end once more before moving on.
+				final = true
+				continue
+			}
+			next, err := os.Open(path)
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) && running() {
+					time.Sleep(logPollInterval)
+					continue
+				}
+				return nil
+			}
+			// If we fell behind by more than one rotation, the files in
+			// between are the rotated ones after ours. Without an entry
+			// of ours to find it by, there were no rotations to fall
+			// behind by: the writer only rotates files it wrote to.
+			if first != nil {
+				if err := printRotatedBetween(path, first, next, p); err != nil {
+					next.Close()
+					return err
+				}
+			}
+			f.Close()
+			f, pending, first, final = next, "", nil, false
+			br.Reset(f)
+			continue
+		}
+		if !running() {
+			// Catch the lines written while we checked.
+			if !hasMore(f) {
+				return nil
+			}
+			continue
+		}
+		time.Sleep(logPollInterval)
+	}
+}
+
+// printRotatedBetween prints the rotated files of the log at path logged
+// after the one starting with the entry after, or from the oldest if nil,
+// and before cur, the open file. Rotated files are told apart by their
+// first entry, which keeps its nanosecond time when the file is renamed
+// or compressed.
+func printRotatedBetween(path string, after *logEntry, cur *os.File, p *logPrinter) error {
+	rotated, err := rotatedLogFiles(path)
+	if err != nil {
+		return err
+	}
+	// cur is read after listing, so it can only be among the rotated
+	// files if it had an entry by then.
+	last, ok, err := firstLogEntry(io.NewSectionReader(cur, 0, math.MaxInt64))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, name := range rotated {
+		e, found, err := firstRotatedEntry(name)
+		if err != nil {
+			return err
+		}
+		if !found {
+			// empty, or rotated away while we listed the others
+			continue
+		}
+		if after != nil && e.same(*after) {
+			// Only the files after ours are new.
+			names = names[:0]
+			continue
+		}
+		if ok && e.same(last) {
+			break
+		}
+		names = append(names, name)
+	}
+	for _, name := range names {
+		if err := printLogFile(name, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// firstRotatedEntry returns the first entry of a rotated log file.
+func firstRotatedEntry(name string) (logEntry, bool, error) {
+	var first logEntry
+	var found bool
+	err := readLogFile(name, func(e logEntry) bool {
+		first, found = e, true
+		return false
+	})
+	return first, found, err
+}
+
+// firstLogEntry returns the first entry logged to r.
+func firstLogEntry(r io.Reader) (logEntry, bool, error) {
+	var first logEntry
+	var found bool
+	err := readLogEntries(r, func(e logEntry) bool {
+		first, found = e, true
+		return false
+	})
+	return first, found, err
+}
+
+// rotatedAway reports whether path no longer names the open file f.
+func rotatedAway(f *os.File, path string) bool {
+	open, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(path)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(open, cur)
+}
+
+// hasMore reports whether f has grown past the current offset.
+func hasMore(f *os.File) bool {
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Size() > off
+}
+
+func printLogFile(name string, p *logPrinter) error {
+	return readLogFile(name, func(e logEntry) bool {
+		p.add(e)
+		return true
+	})
+}
+
+// readLogFile calls fn with the entries of a log file, compressed or not,
+// until it returns false.
+func readLogFile(name string, fn func(logEntry) bool) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		// rotated away while we were reading the older files
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return readLogEntries(r, fn)
+}
+
+// readLogEntries calls fn with the entries read from r until it returns
+// false.
+func readLogEntries(r io.Reader, fn func(logEntry) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		var e logEntry
+		if line != "" && json.Unmarshal([]byte(line), &e) == nil && !fn(e) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// printLogLine prints an encoded entry and returns it.
+func printLogLine(line string, p *logPrinter) (logEntry, bool) {
+	var e logEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		return logEntry{}, false
+	}
+	p.add(e)
+	return e, true
+}
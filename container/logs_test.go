@@ -0,0 +1,238 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestParseLogOpts(t *testing.T) {
+	cfg, err := ParseLogOpts([]string{"max-size=10m", "max-file=3"})
+	if err != nil {
+		t.Fatalf("ParseLogOpts failed: %v", err)
+	}
+	if cfg != (LogConfig{MaxSize: 10 << 20, MaxFile: 3}) {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if cfg, err := ParseLogOpts([]string{"max-size=512kb"}); err != nil || cfg != (LogConfig{MaxSize: 512 << 10, MaxFile: 1}) {
+		t.Fatalf("ParseLogOpts(max-size only) = %+v, %v", cfg, err)
+	}
+	if cfg, err := ParseLogOpts(nil); err != nil || cfg != (LogConfig{}) {
+		t.Fatalf("ParseLogOpts(nil) = %+v, %v", cfg, err)
+	}
+	for _, bad := range [][]string{
+		{"max-size"},
+		{"max-size=big"},
+		{"max-size=0"},
+		{"max-size=1m", "max-file=0"},
+		{"max-file=2"},
+		{"compress=true"},
+	} {
+		if _, err := ParseLogOpts(bad); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logFileName)
+	w, err := openLogWriter(path, LogConfig{MaxSize: 1024, MaxFile: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		stream := "stdout"
+		if i%10 == 0 {
+			stream = "stderr"
+		}
+		if err := w.write(logEntry{Stream: stream, Log: fmt.Sprintf("line %d\n", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.close()
+
+	for _, name := range []string{logFileName, logFileName + ".1.gz", logFileName + ".2.gz"} {
+		fi, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+		if err != nil {
+			t.Fatalf("missing %s: %v", name, err)
+		}
+		if !strings.HasSuffix(name, ".gz") && fi.Size() > 1024 {
+			t.Errorf("%s is %d bytes, over max-size", name, fi.Size())
+		}
+	}
+	for _, name := range []string{logFileName + ".1", logFileName + ".3.gz"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(path), name)); err == nil {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err := readLogs(path, newLogPrinter(LogOptions{Tail: -1}, &stdout, &stderr), func() bool { return false }); err != nil {
+		t.Fatalf("readLogs failed: %v", err)
+	}
+	// The oldest lines were dropped; the rest must be contiguous.
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	var first int
+	fmt.Sscanf(lines[0], "line %d", &first)
+	want := 0
+	for i := first; i < 100; i++ {
+		if i%10 != 0 {
+			if lines[want] != fmt.Sprintf("line %d", i) {
+				t.Fatalf("stdout line %d = %q, want %q", want, lines[want], fmt.Sprintf("line %d", i))
+			}
+			want++
+		}
+	}
+	if !strings.HasSuffix(stderr.String(), "line 90\n") {
+		t.Fatalf("unexpected stderr %q", stderr.String())
+	}
+}
+
+func TestCopyStreamLongLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), logFileName)
+	w, err := openLogWriter(path, LogConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A line of 2.5 times maxLogLine, cut in the middle of a character.
+	long := strings.Repeat("a", maxLogLine-1) + "é" + strings.Repeat("b", maxLogLine*3/2) + "\n"
+	if err := w.copyStream("stdout", strings.NewReader(long+"short\n")); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	var entries []logEntry
+	if err := readLogFile(path, func(e logEntry) bool { entries = append(entries, e); return true }); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatalf("got %d entries, want 4", len(entries))
+	}
+	var line string
+	for i, e := range entries[:3] {
+		if e.Partial != (i < 2) || len(e.Log) >= maxLogLine+utf8.UTFMax || !utf8.ValidString(e.Log) {
+			t.Errorf("entry %d: partial %v, %d bytes, valid UTF-8 %v", i, e.Partial, len(e.Log), utf8.ValidString(e.Log))
+		}
+		line += e.Log
+	}
+	if line != long || entries[3].Log != "short\n" || entries[3].Partial {
+		t.Errorf("entries don't add up to the lines written")
+	}
+}
+
+func TestFollowLogsAcrossRotation(t *testing.T) {
+	orig := logPollInterval
+	logPollInterval = time.Millisecond
+	defer func() { logPollInterval = orig }()
+
+	path := filepath.Join(t.TempDir(), logFileName)
+	// Files are rotated by the steps below only; max-file keeps them all.
+	w, err := openLogWriter(path, LogConfig{MaxFile: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	n := 0
+	write := func(count int) func() error {
+		return func() error {
+			for i := 0; i < count; i++ {
+				n++
+				if err := w.write(logEntry{Stream: "stdout", Log: fmt.Sprintf("line %d\n", n)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	rotate := func() error { return w.rotate() }
+	// Each step runs while the follower waits at the end of the open file.
+	steps := [][]func() error{
+		{write(2)},
+		// Lines appended to the file it has read to the end, then rotated.
+		{write(1), rotate, write(1)},
+		// Several rotations between two polls.
+		{write(1), rotate, write(1), rotate, write(1), rotate, write(1)},
+		// Rotations of empty files, one of them after the follower opened
+		// it and read nothing.
+		{rotate, rotate},
+		{rotate},
+		{write(2)},
+	}
+	step := 0
+	running := func() bool {
+		if step == len(steps) {
+			return false
+		}
+		for _, fn := range steps[step] {
+			if err := fn(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		step++
+		return step < len(steps)
+	}
+
+	var stdout bytes.Buffer
+	if err := readLogs(path, newLogPrinter(LogOptions{Tail: -1}, &stdout, &stdout), running); err != nil {
+		t.Fatalf("readLogs failed: %v", err)
+	}
+	var want strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&want, "line %d\n", i)
+	}
+	if stdout.String() != want.String() {
+		t.Fatalf("follower printed:\n%s\nwant:\n%s", stdout.String(), want.String())
+	}
+}
+
+func TestParseLogSince(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if got, err := ParseLogSince("10m", now); err != nil || !got.Equal(now.Add(-10*time.Minute)) {
+		t.Fatalf("ParseLogSince(10m) = %v, %v", got, err)
+	}
+	if got, err := ParseLogSince("2026-01-01T00:00:00.5Z", now); err != nil || got.Nanosecond() != 5e8 {
+		t.Fatalf("ParseLogSince(time) = %v, %v", got, err)
+	}
+	for _, bad := range []string{"yesterday", "-5m", "2026-01-01"} {
+		if _, err := ParseLogSince(bad, now); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestLogPrinter(t *testing.T) {
+	base := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+	entries := []logEntry{
+		{Time: base, Stream: "stdout", Log: "a\n"},
+		{Time: base.Add(time.Second), Stream: "stderr", Log: "b\n"},
+		{Time: base.Add(2 * time.Second), Stream: "stdout", Log: "c\n"},
+		{Time: base.Add(3 * time.Second), Stream: "stdout", Log: "d\n"},
+	}
+	for _, tc := range []struct {
+		opts           LogOptions
+		stdout, stderr string
+	}{
+		{LogOptions{Tail: -1}, "a\nc\nd\n", "b\n"},
+		{LogOptions{Tail: 2}, "c\nd\n", ""},
+		{LogOptions{Tail: 0}, "", ""},
+		{LogOptions{Tail: -1, Since: base.Add(time.Second)}, "c\nd\n", "b\n"},
+		{LogOptions{Tail: 3, Since: base.Add(2 * time.Second)}, "c\nd\n", ""},
+		{LogOptions{Tail: 1, Timestamps: true}, "2026-01-02T03:04:08.000000006Z d\n", ""},
+	} {
+		var stdout, stderr bytes.Buffer
+		p := newLogPrinter(tc.opts, &stdout, &stderr)
+		for _, e := range entries {
+			p.add(e)
+		}
+		p.flush()
+		if stdout.String() != tc.stdout || stderr.String() != tc.stderr {
+			t.Errorf("%+v: stdout %q stderr %q, want %q %q", tc.opts, stdout.String(), stderr.String(), tc.stdout, tc.stderr)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A container run with RunOptions.Metadata can ask about itself over HTTP
+// on a unix socket at /run/containish/metadata.sock, as apps on a cloud
+// instance ask its metadata service. The runtime serves it, the monitor
+// once a detached container is handed over, from the state of the
+// container at each request. The API is read-only:
+//
+//	GET /v1/metadata          the Metadata of the container
+//	GET /v1/metadata/id       its id, as a JSON string
+//	GET /v1/metadata/labels   its labels
+//	GET /v1/metadata/limits   its limits
+//	GET /v1/metadata/network  its network, null without one
+
+// containerMetadataSocket is where the metadata socket is bind-mounted
+// inside the container, and metadataSocketName its name in the state dir.
+const (
+	containerMetadataSocket = "/run/containish/metadata.sock"
+	metadataSocketName      = "metadata.sock"
+)
+
+// Metadata is what a container learns about itself from its metadata
+// socket.
+type Metadata struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Image is the reference of the image the container was run from.
+	Image string `json:"image,omitempty"`
+	// Labels are the annotations of the spec.
+	Labels map[string]string `json:"labels"`
+	Limits MetadataLimits    `json:"limits"`
+	// Network is nil for a container without a network of its own.
+	Network *MetadataNetwork `json:"network"`
+}
+
+// MetadataLimits are the limits of a container, zero where it has none.
+type MetadataLimits struct {
+	// Memory is its memory.max in bytes, and CPUs its CPU quota.
+	Memory int64   `json:"memory"`
+	CPUs   float64 `json:"cpus"`
+	// Storage is its storage quota in bytes.
+	Storage int64 `json:"storage"`
+}
+
+// MetadataNetwork is the network of a container.
+type MetadataNetwork struct {
+	Driver string `json:"driver"`
+	// Name is the user-defined network it is attached to, if any.
+	Name string `json:"name,omitempty"`
+	// Address is its address in CIDR notation.
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// containerMetadata returns the metadata of c.
+func containerMetadata(c *Container) *Metadata {
+	m := &Metadata{ID: c.Id, Status: c.Status.String(), CreatedAt: c.CreatedAt, Labels: c.Annotations}
+	if m.Labels == nil {
+		m.Labels = map[string]string{}
+	}
+	if c.Image != nil {
+		m.Image = c.Image.Ref
+	}
+	if r := c.Reservation; r != nil {
+		m.Limits.Memory, m.Limits.CPUs = r.Memory, r.CPUs
+	}
+	if c.Storage != nil {
+		m.Limits.Storage = c.Storage.Size
+	}
+	if n := c.Network; n != nil && n.Driver != HostNetwork && n.Driver != NoneNetwork {
+		m.Network = &MetadataNetwork{Driver: n.Driver, Name: n.Name, Address: n.Address, Gateway: n.Gateway, DNS: n.DNS}
+	}
+	return m
+}
+
+// metadataHandler returns the API of the metadata socket of container id.
+func metadataHandler(id string) http.Handler {
+	load := func(w http.ResponseWriter) *Metadata {
+		c, err := LoadState(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return nil
+		}
+		return containerMetadata(c)
+	}
+	write := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/metadata", func(w http.ResponseWriter, r *http.Request) {
+		if m := load(w); m != nil {
+			write(w, m)
+		}
+	})
+	mux.HandleFunc("GET /v1/metadata/{field}", func(w http.ResponseWriter, r *http.Request) {
+		m := load(w)
+		if m == nil {
+			return
+		}
+		switch r.PathValue("field") {
+		case "id":
+			write(w, m.ID)
+		case "labels":
+			write(w, m.Labels)
+		case "limits":
+			write(w, m.Limits)
+		case "network":
+			write(w, m.Network)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return mux
+}
+
+// listenMetadata creates the metadata socket at path, which anyone in the
+// container may connect to. It stays in place when the listener is closed,
+// as the runtime closes its copy once the monitor has one.
+func listenMetadata(path string) (*net.UnixListener, error) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale metadata socket: %w", err)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata socket %s: %w", path, err)
+	}
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0o666); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to chmod metadata socket %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// serveMetadata serves the metadata of container id on l until it is
+// closed.
+func serveMetadata(l net.Listener, id string) {
+	srv := &http.Server{Handler: metadataHandler(id), ReadHeaderTimeout: 10 * time.Second}
+	_ = srv.Serve(l)
+}
+
+// serveMetadataFd serves, for the monitor of container id, the metadata
+// socket the runtime passed as the fd v.
+func serveMetadataFd(v, id string) error {
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid METADATA_FD: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "metadata-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return fmt.Errorf("invalid metadata socket: %w", err)
+	}
+	go serveMetadata(l, id)
+	return nil
+}
@@ -0,0 +1,105 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContainerMetadata(t *testing.T) {
+	c := &Container{
+		Id:          "web",
+		Status:      Running,
+		Annotations: map[string]string{"team": "lab"},
+		Image:       &ImageRootfs{Ref: "docker.io/library/alpine:3.20"},
+		Reservation: &Reservation{Memory: 1 << 29, CPUs: 1.5},
+		Storage:     &StorageQuota{Size: 1 << 30},
+		Network:     &NetworkConfig{Driver: BridgeNetwork, Name: "lab", Address: "10.88.0.2/16", Gateway: "10.88.0.1"},
+	}
+	m := containerMetadata(c)
+	if m.ID != "web" || m.Status != "running" || m.Image != c.Image.Ref || m.Labels["team"] != "lab" {
+		t.Errorf("metadata is %+v", m)
+	}
+	if want := (MetadataLimits{Memory: 1 << 29, CPUs: 1.5, Storage: 1 << 30}); m.Limits != want {
+		t.Errorf("limits are %+v, want %+v", m.Limits, want)
+	}
+	if n := m.Network; n == nil || n.Address != "10.88.0.2/16" || n.Gateway != "10.88.0.1" || n.Name != "lab" {
+		t.Errorf("network is %+v", n)
+	}
+
+	m = containerMetadata(&Container{Id: "host", Network: &NetworkConfig{Driver: HostNetwork}})
+	if m.Network != nil || m.Labels == nil {
+		t.Errorf("metadata of a host network container is %+v", m)
+	}
+}
+
+func TestMetadataHandler(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	c := &Container{Id: "web", Status: Running, CreatedAt: time.Now(), Annotations: map[string]string{"team": "lab"}}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	h := metadataHandler("web")
+
+	get := func(method, path string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code, rec.Body.String()
+	}
+	code, body := get("GET", "/v1/metadata")
+	var m Metadata
+	if err := json.Unmarshal([]byte(body), &m); code != http.StatusOK || err != nil || m.ID != "web" || m.Labels["team"] != "lab" {
+		t.Errorf("GET /v1/metadata = %d %s", code, body)
+	}
+	if code, body = get("GET", "/v1/metadata/id"); code != http.StatusOK || body != "\"web\"\n" {
+		t.Errorf("GET /v1/metadata/id = %d %q", code, body)
+	}
+	if code, body = get("GET", "/v1/metadata/network"); code != http.StatusOK || body != "null\n" {
+		t.Errorf("GET /v1/metadata/network = %d %q", code, body)
+	}
+	if code, _ = get("GET", "/v1/metadata/secrets"); code != http.StatusNotFound {
+		t.Errorf("GET of an unknown field = %d, want 404", code)
+	}
+	if code, _ = get("PUT", "/v1/metadata"); code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT = %d, want 405", code)
+	}
+}
+
+func TestServeMetadata(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	if err := saveState(&Container{Id: "web", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), metadataSocketName)
+	l, err := listenMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveMetadata(l, "web")
+	defer l.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://metadata/v1/metadata/id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "\"web\"\n" {
+		t.Errorf("id is %q", body)
+	}
+}
@@ -0,0 +1,85 @@
+//go:build ignore
+
+// mksyscalls generates the syscallNames table of each architecture seccomp
+// and the tracer name system calls on, syscalls_<arch>.go, from the SYS_
+// constants of the golang.org/x/sys/unix the module requires:
+//
+//	go generate ./container
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// archs are the architectures with a table, see arch_<arch>.go.
+var archs = []string{"amd64", "arm64", "ppc64le", "riscv64", "s390x"}
+
+var sysConst = regexp.MustCompile(`^\s*SYS_([A-Z0-9_]+)\s*=\s*(\d+)\s*$`)
+
+func main() {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("failed to find golang.org/x/sys: %v", err)
+	}
+	dir := strings.TrimSpace(string(out))
+	for _, arch := range archs {
+		if err := generate(filepath.Join(dir, "unix", "zsysnum_linux_"+arch+".go"), arch); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func generate(path, arch string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	names := map[uint64]string{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		m := sysConst.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		nr, err := strconv.ParseUint(m[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		if _, ok := names[nr]; !ok {
+			names[nr] = strings.ToLower(m[1])
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	nrs := make([]uint64, 0, len(names))
+	for nr := range names {
+		nrs = append(nrs, nr)
+	}
+	slices.Sort(nrs)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "// Code generated from the SYS_ constants of golang.org/x/sys/unix for linux/%s. DO NOT EDIT.\n\n", arch)
+	b.WriteString("package container\n\n// syscallNames maps system call numbers to their names.\nvar syscallNames = map[uint64]string{\n")
+	for _, nr := range nrs {
+		fmt.Fprintf(&b, "%d: %q,\n", nr, names[nr])
+	}
+	b.WriteString("}\n")
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile("syscalls_"+arch+".go", src, 0o644)
+}
@@ -0,0 +1,386 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A detached container is owned by its monitor, the parent stage staying
+// behind once the runtime has returned. The monitor holds the console and
+// log pipes of the container and waits for its init process. When it
+// exits, the monitor records the exit code in the state, releases what the
+// container held unless a stop already did, runs the post-stop plugins and
+// applies the restart policy. Stopping or deleting the container waits for
+// it to be done with the exit, up to applying the restart policy, so the
+// state dir isn't removed under it.
+//
+// Each exit the monitor sees is added to the exit history of the container,
+// the last keptExits of them, which outlives restarts. A container whose
+// last crashLoopExits exits all failed, with a non-zero code or killed by
+// the OOM killer, within crashLoopUptime of their start is crash looping:
+// its restart policy waits crashLoopBackoff before each restart rather
+// than the restart delay, and it shows as CrashLooping meanwhile, until it
+// stays up longer.
+
+// Restart policies of detached containers.
+const (
+	// RestartNo leaves an exited container stopped.
+	RestartNo = "no"
+	// RestartOnFailure starts a container exiting with a non-zero code
+	// again, at most MaxRetries times if set.
+	RestartOnFailure = "on-failure"
+	// RestartAlways starts an exited container again whatever its exit
+	// code.
+	RestartAlways = "always"
+)
+
+// The monitor waits restartBackoff before restarting a container the first
+// time, and twice as long before each next restart, up to
+// restartMaxBackoff.
+var (
+	restartBackoff    = 100 * time.Millisecond
+	restartMaxBackoff = time.Minute
+)
+
+// keptExits is how many exits the exit history of a container keeps.
+const keptExits = 10
+
+// crashLoopExits is how many failed exits in a row, each within
+// crashLoopUptime of its start, make a crash loop.
+const crashLoopExits = 5
+
+// crashLoopUptime and crashLoopBackoff are variables so tests can override
+// them.
+var (
+	crashLoopUptime  = 10 * time.Second
+	crashLoopBackoff = 5 * time.Minute
+)
+
+// CrashLooping is the status shown of a stopped container whose restart
+// policy backs off a crash loop.
+const CrashLooping = "crash-looping"
+
+// ExitRecord is an exit of the init process of a container, as its monitor
+// saw it.
+type ExitRecord struct {
+	// StartedAt is when the monitor took the container over, once its
+	// process was released.
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	ExitCode   int       `json:"exitCode"`
+	// OOMKilled is set if the OOM killer killed a process of the
+	// container meanwhile.
+	OOMKilled bool `json:"oomKilled,omitempty"`
+}
+
+// failed reports whether the exit counts toward a crash loop.
+func (e ExitRecord) failed() bool {
+	return e.ExitCode != 0 || e.OOMKilled
+}
+
+// CrashLoop is a crash loop the restart policy of a container backs off.
+type CrashLoop struct {
+	// Since is when the first exit of the loop happened.
+	Since time.Time `json:"since"`
+	// RestartAt is when the container is started again.
+	RestartAt time.Time `json:"restartAt"`
+}
+
+// crashLoop returns the crash loop exits end with, if any.
+func crashLoop(exits []ExitRecord) *CrashLoop {
+	if len(exits) < crashLoopExits {
+		return nil
+	}
+	last := exits[len(exits)-crashLoopExits:]
+	for _, e := range last {
+		if !e.failed() || e.FinishedAt.Sub(e.StartedAt) >= crashLoopUptime {
+			return nil
+		}
+	}
+	return &CrashLoop{Since: last[0].FinishedAt, RestartAt: last[len(last)-1].FinishedAt.Add(crashLoopBackoff)}
+}
+
+// recordExit adds e to the exit history of c, dropping the oldest beyond
+// keptExits.
+func recordExit(c *Container, e ExitRecord) {
+	c.Exits = append(c.Exits, e)
+	if n := len(c.Exits) - keptExits; n > 0 {
+		c.Exits = slices.Delete(c.Exits, 0, n)
+	}
+}
+
+// cgroupOOMKilled reports whether the OOM killer struck in the cgroup at
+// path, created for the current run of its container.
+func cgroupOOMKilled(path string) bool {
+	if path == "" {
+		return false
+	}
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return oomKills(f) > 0
+}
+
+// RestartPolicy decides whether the monitor of a detached container starts
+// it again once its init process has exited. Containers stopped or killed
+// on request are never restarted.
+type RestartPolicy struct {
+	// Name is RestartNo, RestartOnFailure or RestartAlways. Empty means
+	// RestartNo.
+	Name string `json:"name,omitempty"`
+	// MaxRetries bounds the restarts of RestartOnFailure. Zero means no
+	// limit.
+	MaxRetries int `json:"maxRetries,omitempty"`
+}
+
+// ParseRestartPolicy parses a --restart value: no, on-failure,
+// on-failure:<max retries> or always.
+func ParseRestartPolicy(value string) (RestartPolicy, error) {
+	name, retries, limited := strings.Cut(value, ":")
+	switch name {
+	case RestartNo, RestartAlways:
+		if !limited {
+			return RestartPolicy{Name: name}, nil
+		}
+	case RestartOnFailure:
+		if !limited {
+			return RestartPolicy{Name: name}, nil
+		}
+		if n, err := strconv.Atoi(retries); err == nil && n > 0 {
+			return RestartPolicy{Name: name, MaxRetries: n}, nil
+		}
+	}
+	return RestartPolicy{}, fmt.Errorf("invalid restart policy %q: expected no, on-failure[:<max retries>] or always", value)
+}
+
+// String returns p as a --restart value.
+func (p RestartPolicy) String() string {
+	if p.Name == "" {
+		return RestartNo
+	}
+	if p.MaxRetries > 0 {
+		return fmt.Sprintf("%s:%d", p.Name, p.MaxRetries)
+	}
+	return p.Name
+}
+
+// restarts reports whether p may start a container again.
+func (p RestartPolicy) restarts() bool {
+	return p.Name != "" && p.Name != RestartNo
+}
+
+// shouldRestart reports whether c, whose init process has exited, is
+// started again.
+func (p RestartPolicy) shouldRestart(c *Container) bool {
+	if c.ManuallyStopped || c.ExitCode == nil {
+		return false
+	}
+	switch p.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return *c.ExitCode != 0 && (p.MaxRetries == 0 || c.RestartCount < p.MaxRetries)
+	}
+	return false
+}
+
+// restartDelay is how long to wait before starting a container again that
+// has been restarted count times already.
+func restartDelay(count int) time.Duration {
+	d := restartBackoff
+	for i := 0; i < count && d < restartMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, restartMaxBackoff)
+}
+
+// monitorContainer monitors detached container id until init, the child
+// stage running its process, exits. stdinForwarded tells whether our stdin
+// is still being forwarded to the container. The exit code is written to
+// exitFile, if any, each time init exits.
+func monitorContainer(id string, init *exec.Cmd, stdinForwarded bool, exitFile *os.File) error {
+	if err := detachMonitor(id, stdinForwarded); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	// The auxiliary processes and health checks run as long as init. A
+	// liveness restart stops init and has it started again below.
+	var restartUnhealthy atomic.Bool
+	started := time.Now()
+	ctx, stopSupervising := context.WithCancel(context.Background())
+	defer stopSupervising()
+	if c, err := LoadState(id); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	} else {
+		go superviseAuxProcesses(ctx, c)
+		if c.Options != nil && c.Options.HealthCheck != nil {
+			go runHealthChecks(ctx, c, func() {
+				restartUnhealthy.Store(true)
+				if err := stopUnhealthy(ctx, c); err != nil {
+					fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+				}
+			})
+		}
+	}
+	code, err := exitCode(init.Wait())
+	stopSupervising()
+	if err != nil {
+		return fmt.Errorf("failed waiting for the container process: %w", err)
+	}
+	finished := time.Now()
+
+	var c *Container
+	var release bool
+	err = updateState(id, func(s *Container) error {
+		// The container may have been started again meanwhile.
+		if s.InitProcessPiD != init.Process.Pid {
+			return nil
+		}
+		release = s.Status != Stopped
+		s.Status = Stopped
+		s.ExitCode, s.FinishedAt = &code, &finished
+		recordExit(s, ExitRecord{StartedAt: started, FinishedAt: finished, ExitCode: code, OOMKilled: cgroupOOMKilled(s.CgroupPath)})
+		s.CrashLoop = nil
+		if restartUnhealthy.Load() || s.Options != nil && s.Options.Restart.shouldRestart(s) {
+			s.CrashLoop = crashLoop(s.Exits)
+		}
+		c = s
+		return nil
+	})
+	if exitFile != nil {
+		// After the state, so a supervisor woken by it sees it updated.
+		if err := writeExitCode(exitFile, code); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	if errors.Is(err, ErrNotFound) || err == nil && c == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stageOut, "MONITOR: Container %s exited with code %d\n", id, code)
+
+	if c.CgroupManager == SystemdManager {
+		// The scope of the container was created with us in it. Leave it
+		// so systemd can collect it, and a restart can create it again.
+		if err := os.WriteFile(filepath.Join(cgroupRoot, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to leave the scope of %s: %v\n", id, err)
+		}
+	}
+	if release {
+		releaseResources(c)
+	}
+	event := newPluginEvent(PluginPostStop, c)
+	event.ExitCode = c.ExitCode
+	if err := runPlugins(context.Background(), event); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	// Done with the exit: a stop or delete waiting for us can go on,
+	// and a delete during the restart backoff cancels the restart.
+	err = updateState(id, func(s *Container) error {
+		if s.InitProcessPiD == init.Process.Pid {
+			s.MonitorPid, s.MonitorStartTime = 0, 0
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return restartContainer(c, restartUnhealthy.Load(), exitFile)
+}
+
+// detachMonitor points the stdio of the monitor at the runtime log in the
+// state dir of container id, so it doesn't hold the terminal or pipes of
+// the runtime that started it. stdin is kept if it is being forwarded.
+func detachMonitor(id string, keepStdin bool) error {
+	if !keepStdin {
+		devNull, err := os.Open(os.DevNull)
+		if err != nil {
+			return err
+		}
+		defer devNull.Close()
+		if err := unix.Dup3(int(devNull.Fd()), 0, 0); err != nil {
+			return fmt.Errorf("failed to detach stdin: %w", err)
+		}
+	}
+	log, err := os.OpenFile(filepath.Join(StateDir(id), runtimeLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open runtime log: %w", err)
+	}
+	defer log.Close()
+	for _, fd := range []int{1, 2} {
+		if err := unix.Dup3(int(log.Fd()), fd, 0); err != nil {
+			return fmt.Errorf("failed to detach output: %w", err)
+		}
+	}
+	return nil
+}
+
+// restartContainer starts c again, after the backoff, if its restart policy
+// says so or unhealthy is set. The new monitor writes to exitFile too.
+func restartContainer(c *Container, unhealthy bool, exitFile *os.File) error {
+	if c.Options == nil || c.SpecPath == "" || c.ManuallyStopped || !unhealthy && !c.Options.Restart.shouldRestart(c) {
+		return nil
+	}
+	delay := restartDelay(c.RestartCount)
+	if c.CrashLoop != nil {
+		delay = time.Until(c.CrashLoop.RestartAt)
+		fmt.Fprintf(stageOut, "MONITOR: %s is crash looping, restarting it at %s\n", c.Id, c.CrashLoop.RestartAt.Format(time.RFC3339))
+	}
+	time.Sleep(delay)
+
+	// Deleting or starting the container meanwhile cancels the restart.
+	cur, err := LoadState(c.Id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cur.Status != Stopped || cur.InitProcessPiD != c.InitProcessPiD || cur.ManuallyStopped {
+		return nil
+	}
+	options, err := cloneOptions(*c.Options)
+	if err != nil {
+		return err
+	}
+	// Nobody is attached to a container started again.
+	options.Detach = true
+	options.ConsoleSocket = ""
+	options.restartCount = c.RestartCount + 1
+	options.ExitFile = exitFile
+	reason := c.Options.Restart.String()
+	if unhealthy {
+		reason = HealthUnhealthy
+	}
+	fmt.Fprintf(stageOut, "MONITOR: Restarting %s (%s, restart %d)\n", c.Id, reason, options.restartCount)
+	return runContainer(context.Background(), c.Id, c.SpecPath, *options)
+}
+
+// stopUnhealthy stops the init process of c, as stop does, for its monitor
+// to start it again.
+func stopUnhealthy(ctx context.Context, c *Container) error {
+	pidfd, err := openInit(c)
+	if err != nil {
+		return nil
+	}
+	defer unix.Close(pidfd)
+	_, err = terminate(ctx, pidfd, stopSignal(c), DefaultStopTimeout)
+	return err
+}
@@ -0,0 +1,198 @@
+package container
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for value, want := range map[string]RestartPolicy{
+		"no":           {Name: RestartNo},
+		"always":       {Name: RestartAlways},
+		"on-failure":   {Name: RestartOnFailure},
+		"on-failure:3": {Name: RestartOnFailure, MaxRetries: 3},
+	} {
+		got, err := ParseRestartPolicy(value)
+		if err != nil || got != want {
+			t.Errorf("ParseRestartPolicy(%q) = %+v, %v, want %+v", value, got, err, want)
+		}
+		if got.String() != value {
+			t.Errorf("%+v.String() = %q, want %q", got, got.String(), value)
+		}
+	}
+	for _, value := range []string{"", "never", "always:2", "on-failure:0", "on-failure:x", "no:1"} {
+		if _, err := ParseRestartPolicy(value); err == nil {
+			t.Errorf("ParseRestartPolicy(%q) succeeded, expected an error", value)
+		}
+	}
+}
+
+func TestShouldRestart(t *testing.T) {
+	exited := func(code, restarts int, stopped bool) *Container {
+		return &Container{ExitCode: &code, RestartCount: restarts, ManuallyStopped: stopped}
+	}
+	onFailure := RestartPolicy{Name: RestartOnFailure, MaxRetries: 2}
+	for _, tc := range []struct {
+		policy RestartPolicy
+		c      *Container
+		want   bool
+	}{
+		{RestartPolicy{}, exited(1, 0, false), false},
+		{RestartPolicy{Name: RestartNo}, exited(1, 0, false), false},
+		{RestartPolicy{Name: RestartAlways}, exited(0, 5, false), true},
+		{RestartPolicy{Name: RestartAlways}, exited(137, 0, true), false},
+		{RestartPolicy{Name: RestartOnFailure}, exited(1, 100, false), true},
+		{onFailure, exited(0, 0, false), false},
+		{onFailure, exited(1, 1, false), true},
+		{onFailure, exited(1, 2, false), false},
+		{onFailure, &Container{}, false},
+	} {
+		if got := tc.policy.shouldRestart(tc.c); got != tc.want {
+			t.Errorf("%s.shouldRestart(exit %v, %d restarts, stopped %v) = %v, want %v",
+				tc.policy, tc.c.ExitCode, tc.c.RestartCount, tc.c.ManuallyStopped, got, tc.want)
+		}
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	for count, want := range map[int]time.Duration{
+		0:   100 * time.Millisecond,
+		1:   200 * time.Millisecond,
+		3:   800 * time.Millisecond,
+		10:  time.Minute,
+		100: time.Minute,
+	} {
+		if got := restartDelay(count); got != want {
+			t.Errorf("restartDelay(%d) = %v, want %v", count, got, want)
+		}
+	}
+}
+
+func TestMarkStopped(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	if err := saveState(&Container{Id: "web", Status: Running, InitProcessPiD: 42}); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first to see the container stop releases it.
+	code := 3
+	c, release, err := markStopped("web", func(s *Container) { s.ExitCode = &code })
+	if err != nil || !release || c.Status != Stopped || *c.ExitCode != 3 {
+		t.Fatalf("markStopped = %+v, %v, %v", c, release, err)
+	}
+	if _, release, err := markStopped("web", nil); err != nil || release {
+		t.Fatalf("expected the second markStopped not to release, got %v, %v", release, err)
+	}
+	if c, err := LoadState("web"); err != nil || c.ExitCode == nil || *c.ExitCode != 3 {
+		t.Fatalf("unexpected state %+v, %v", c, err)
+	}
+}
+
+func TestWaitMonitor(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	ctx := context.Background()
+
+	monitor := exec.Command("sleep", "60")
+	if err := monitor.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer monitor.Process.Kill()
+	start, err := processStartTime(monitor.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{Id: "web", Status: Stopped, MonitorPid: monitor.Process.Pid, MonitorStartTime: start}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitMonitor(ctx, "web", 50*time.Millisecond); err == nil {
+		t.Fatal("expected waiting for a monitor handling the exit to time out")
+	}
+
+	// A pid reused since doesn't count.
+	c.MonitorStartTime = start + 1
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitMonitor(ctx, "web", time.Second); err != nil {
+		t.Fatalf("waitMonitor with a reused pid: %v", err)
+	}
+
+	// Nor does a monitor done with the exit, or gone.
+	c.MonitorPid, c.MonitorStartTime = 0, 0
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitMonitor(ctx, "web", time.Second); err != nil {
+		t.Fatalf("waitMonitor of a monitor done: %v", err)
+	}
+	c.MonitorPid, c.MonitorStartTime = monitor.Process.Pid, start
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		monitor.Process.Kill()
+		monitor.Wait()
+	}()
+	if err := waitMonitor(ctx, "web", 5*time.Second); err != nil {
+		t.Fatalf("waitMonitor of an exiting monitor: %v", err)
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	start := time.Date(2026, 10, 18, 8, 0, 0, 0, time.UTC)
+	c := &Container{Id: "c1"}
+	exit := func(code int, uptime time.Duration) {
+		started := start
+		start = start.Add(uptime)
+		recordExit(c, ExitRecord{StartedAt: started, FinishedAt: start, ExitCode: code})
+		start = start.Add(time.Second)
+	}
+
+	// A long run breaks the streak of quick failures.
+	for range crashLoopExits - 1 {
+		exit(1, time.Second)
+	}
+	exit(1, time.Hour)
+	if l := crashLoop(c.Exits); l != nil {
+		t.Fatalf("crash loop after a long run: %+v", l)
+	}
+	for range crashLoopExits - 1 {
+		exit(1, time.Second)
+	}
+	exit(0, time.Second)
+	if l := crashLoop(c.Exits); l != nil {
+		t.Fatalf("crash loop ending with a success: %+v", l)
+	}
+
+	recordExit(c, ExitRecord{StartedAt: start, FinishedAt: start, OOMKilled: true})
+	for range crashLoopExits - 1 {
+		exit(137, time.Second)
+	}
+	l := crashLoop(c.Exits)
+	if l == nil {
+		t.Fatal("no crash loop after quick failures")
+	}
+	last := c.Exits[len(c.Exits)-1]
+	if first := c.Exits[len(c.Exits)-crashLoopExits]; !first.OOMKilled || !l.Since.Equal(first.FinishedAt) || !l.RestartAt.Equal(last.FinishedAt.Add(crashLoopBackoff)) {
+		t.Errorf("crash loop %+v", l)
+	}
+	if len(c.Exits) != keptExits {
+		t.Errorf("%d exits kept, want %d", len(c.Exits), keptExits)
+	}
+
+	c.Status, c.CrashLoop = Stopped, l
+	if c.StatusName() != CrashLooping {
+		t.Errorf("status of a crash looping container = %s", c.StatusName())
+	}
+	if c.Status = Running; c.StatusName() != "running" {
+		t.Errorf("status of a container started again = %s", c.StatusName())
+	}
+}
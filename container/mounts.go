@@ -0,0 +1,345 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// mountFlags maps mount options to the flags they set (true) or clear
+// (false).
+var mountFlags = map[string]struct {
+	flag uintptr
+	set  bool
+}{
+	"ro":          {unix.MS_RDONLY, true},
+	"rw":          {unix.MS_RDONLY, false},
+	"nosuid":      {unix.MS_NOSUID, true},
+	"suid":        {unix.MS_NOSUID, false},
+	"nodev":       {unix.MS_NODEV, true},
+	"dev":         {unix.MS_NODEV, false},
+	"noexec":      {unix.MS_NOEXEC, true},
+	"exec":        {unix.MS_NOEXEC, false},
+	"noatime":     {unix.MS_NOATIME, true},
+	"atime":       {unix.MS_NOATIME, false},
+	"nodiratime":  {unix.MS_NODIRATIME, true},
+	"diratime":    {unix.MS_NODIRATIME, false},
+	"relatime":    {unix.MS_RELATIME, true},
+	"norelatime":  {unix.MS_RELATIME, false},
+	"strictatime": {unix.MS_STRICTATIME, true},
+	"bind":        {unix.MS_BIND, true},
+	"rbind":       {unix.MS_BIND | unix.MS_REC, true},
+}
+
+// propagationFlags maps propagation options to the flags changing the
+// propagation type of a mount.
+var propagationFlags = map[string]uintptr{
+	"private":     unix.MS_PRIVATE,
+	"rprivate":    unix.MS_PRIVATE | unix.MS_REC,
+	"shared":      unix.MS_SHARED,
+	"rshared":     unix.MS_SHARED | unix.MS_REC,
+	"slave":       unix.MS_SLAVE,
+	"rslave":      unix.MS_SLAVE | unix.MS_REC,
+	"unbindable":  unix.MS_UNBINDABLE,
+	"runbindable": unix.MS_UNBINDABLE | unix.MS_REC,
+}
+
+// mountOptions is a parsed list of spec mount options.
+type mountOptions struct {
+	flags       uintptr
+	propagation []uintptr
+	// data holds the filesystem specific options.
+	data []string
+}
+
+// parseMountOptions sorts options into mount flags, propagation changes and
+// filesystem data.
+func parseMountOptions(options []string) mountOptions {
+	var o mountOptions
+	for _, opt := range options {
+		if f, ok := mountFlags[opt]; ok {
+			if f.set {
+				o.flags |= f.flag
+			} else {
+				o.flags &^= f.flag
+			}
+			continue
+		}
+		if p, ok := propagationFlags[opt]; ok {
+			o.propagation = append(o.propagation, p)
+			continue
+		}
+		o.data = append(o.data, opt)
+	}
+	return o
+}
+
+// rootfsPropagationFlags returns the propagation applied to / in the
+// container mount namespace, private unless linux.rootfsPropagation says
+// otherwise.
+func rootfsPropagationFlags(spec *specs.Spec) (uintptr, error) {
+	if spec == nil || spec.Linux == nil || spec.Linux.RootfsPropagation == "" {
+		return unix.MS_PRIVATE | unix.MS_REC, nil
+	}
+	p, ok := propagationFlags[spec.Linux.RootfsPropagation]
+	if !ok {
+		return 0, fmt.Errorf("invalid linux.rootfsPropagation %q", spec.Linux.RootfsPropagation)
+	}
+	return p, nil
+}
+
+// isBindMount reports whether a spec mount is a bind mount.
+func isBindMount(m specs.Mount) bool {
+	if m.Type == "bind" {
+		return true
+	}
+	for _, o := range m.Options {
+		if o == "bind" || o == "rbind" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBindMount checks a spec bind mount. Source must be absolute.
+func validateBindMount(m specs.Mount) error {
+	if !filepath.IsAbs(m.Destination) || filepath.Clean(m.Destination) == "/" {
+		return fmt.Errorf("bind mount destination %q must be an absolute path other than /", m.Destination)
+	}
+	if _, err := os.Stat(m.Source); err != nil {
+		return fmt.Errorf("bind mount source %q: %w", m.Source, err)
+	}
+	if o := parseMountOptions(m.Options); len(o.data) > 0 {
+		return fmt.Errorf("unknown bind mount option %q", o.data[0])
+	}
+	return nil
+}
+
+// mountBind bind mounts m.Source at rootfs+m.Destination and applies its
+// flags and propagation. A tree other than -1 is an idmapped copy of the
+// source attached in place of the bind.
+func mountBind(rootfs string, m specs.Mount, tree int) error {
+	o := parseMountOptions(m.Options)
+
+	fi, err := os.Stat(m.Source)
+	if err != nil {
+		return fmt.Errorf("bind mount source %s: %w", m.Source, err)
+	}
+	target := mountTarget{path: m.Destination, dir: fi.IsDir()}
+	return mountInRoot(rootfs, target, func(dst string) error {
+		if tree >= 0 {
+			return attachTree(tree, dst)
+		}
+		if err := unix.Mount(m.Source, dst, "", unix.MS_BIND|(o.flags&unix.MS_REC), ""); err != nil {
+			return fmt.Errorf("failed to bind %s on %s: %w", m.Source, m.Destination, err)
+		}
+		return nil
+	}, func(dst string) error {
+		// Flags other than MS_BIND/MS_REC are ignored on the initial bind
+		// and need a remount.
+		if extra := o.flags &^ (unix.MS_BIND | unix.MS_REC); extra != 0 {
+			if err := unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|extra, ""); err != nil {
+				return fmt.Errorf("failed to remount %s: %w", m.Destination, err)
+			}
+		}
+		return applyPropagation(dst, o.propagation)
+	})
+}
+
+// applyPropagation changes the propagation type of the mount at path.
+func applyPropagation(path string, propagation []uintptr) error {
+	for _, p := range propagation {
+		if err := unix.Mount("", path, "", p, ""); err != nil {
+			return fmt.Errorf("failed to set propagation of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// mountinfoPath is read to find the mount a path lives on.
+var mountinfoPath = "/proc/self/mountinfo"
+
+// parentMount returns the mount point containing path and whether that
+// mount is shared.
+func parentMount(path string) (string, bool, error) {
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	best, shared := "", false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// id parent major:minor root mountpoint options optional... - ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		mp := fields[4]
+		if mp != "/" && path != mp && !strings.HasPrefix(path, mp+"/") {
+			continue
+		}
+		if len(mp) < len(best) {
+			continue
+		}
+		best, shared = mp, false
+		for _, opt := range fields[6:] {
+			if opt == "-" {
+				break
+			}
+			if strings.HasPrefix(opt, "shared:") {
+				shared = true
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", false, err
+	}
+	if best == "" {
+		return "", false, fmt.Errorf("no mount found for %s", path)
+	}
+	return best, shared, nil
+}
+
+// makeParentMountPrivate makes the mount containing rootfs private when it
+// is shared, since pivot_root refuses to move a root out of a shared mount.
+func makeParentMountPrivate(rootfs string) error {
+	mp, shared, err := parentMount(rootfs)
+	if err != nil {
+		return fmt.Errorf("failed to find the mount of %s: %w", rootfs, err)
+	}
+	if !shared {
+		return nil
+	}
+	if err := unix.Mount("", mp, "", unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make %s private: %w", mp, err)
+	}
+	return nil
+}
+
+// resolveRootfs resolves the symlinks of rootfs, so the child stage can
+// open it refusing any, and checks it is safe to pivot into: not the host
+// root, and not on the host's / mount when the rootfs propagation of spec
+// would share the container's mounts with it.
+func resolveRootfs(rootfs string, spec *specs.Spec) (string, error) {
+	resolved, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve rootfs: %w", err)
+	}
+	if resolved, err = filepath.Abs(resolved); err != nil {
+		return "", fmt.Errorf("failed to resolve rootfs: %w", err)
+	}
+	if resolved == "/" {
+		return "", fmt.Errorf("rootfs %s is the host root", rootfs)
+	}
+	propagation, err := rootfsPropagationFlags(spec)
+	if err != nil {
+		return "", err
+	}
+	if propagation&unix.MS_SHARED != 0 {
+		mp, _, err := parentMount(resolved)
+		if err != nil {
+			return "", fmt.Errorf("failed to find the mount of %s: %w", resolved, err)
+		}
+		if mp == "/" {
+			return "", fmt.Errorf("rootfs %s is on the host's / mount, which linux.rootfsPropagation %s would share the container's mounts with; put it on a mount of its own", rootfs, spec.Linux.RootfsPropagation)
+		}
+	}
+	return resolved, nil
+}
+
+// openRootfs opens rootfs, as resolved by resolveRootfs, as an O_PATH
+// descriptor. The path is resolved without following symlinks, and within
+// the mount it is on without crossing into another, so it can't have been
+// redirected since the runtime checked it.
+func openRootfs(rootfs string) (int, error) {
+	mp, _, err := parentMount(rootfs)
+	if err != nil {
+		return -1, fmt.Errorf("failed to find the mount of %s: %w", rootfs, err)
+	}
+	rel, err := filepath.Rel(mp, rootfs)
+	if err != nil {
+		return -1, err
+	}
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC,
+		Resolve: unix.RESOLVE_NO_SYMLINKS | unix.RESOLVE_NO_MAGICLINKS,
+	}
+	mnt, err := unix.Openat2(unix.AT_FDCWD, mp, &how)
+	if err != nil {
+		return -1, rootfsOpenError(rootfs, err)
+	}
+	defer unix.Close(mnt)
+	how.Resolve |= unix.RESOLVE_NO_XDEV
+	fd, err := unix.Openat2(mnt, rel, &how)
+	if err != nil {
+		return -1, rootfsOpenError(rootfs, err)
+	}
+	return fd, nil
+}
+
+// rootfsOpenError explains why openRootfs failed.
+func rootfsOpenError(rootfs string, err error) error {
+	switch {
+	case errors.Is(err, unix.ELOOP):
+		return fmt.Errorf("rootfs %s: a symlink was swapped into its path", rootfs)
+	case errors.Is(err, unix.EXDEV):
+		return fmt.Errorf("rootfs %s: a mount was swapped into its path", rootfs)
+	}
+	return fmt.Errorf("failed to open rootfs %s: %w", rootfs, err)
+}
+
+// sameFile reports whether the descriptors a and b refer to the same file.
+func sameFile(a, b int) (bool, error) {
+	var sa, sb unix.Stat_t
+	if err := unix.Fstat(a, &sa); err != nil {
+		return false, err
+	}
+	if err := unix.Fstat(b, &sb); err != nil {
+		return false, err
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino, nil
+}
+
+// checkOldRootDetached checks, once the old root has been unmounted after
+// pivot_root, that / is newroot and the only mount on it, so no part of the
+// host's tree is left reachable.
+func checkOldRootDetached(newroot int) error {
+	root, err := unix.Open("/", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(root)
+	if same, err := sameFile(root, newroot); err != nil {
+		return err
+	} else if !same {
+		return fmt.Errorf("/ is not the new root after pivot_root")
+	}
+
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	roots := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if fields := strings.Fields(s.Text()); len(fields) > 4 && fields[4] == "/" {
+			roots++
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if roots != 1 {
+		return fmt.Errorf("the old root is still mounted on / after pivot_root")
+	}
+	return nil
+}
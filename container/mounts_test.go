@@ -0,0 +1,176 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountOptions(t *testing.T) {
+	o := parseMountOptions([]string{"rbind", "ro", "nosuid", "rslave", "private", "size=1m"})
+	if o.flags != unix.MS_BIND|unix.MS_REC|unix.MS_RDONLY|unix.MS_NOSUID {
+		t.Fatalf("unexpected flags %#x", o.flags)
+	}
+	want := []uintptr{unix.MS_SLAVE | unix.MS_REC, unix.MS_PRIVATE}
+	if !reflect.DeepEqual(o.propagation, want) {
+		t.Fatalf("propagation = %#x, want %#x", o.propagation, want)
+	}
+	if !reflect.DeepEqual(o.data, []string{"size=1m"}) {
+		t.Fatalf("data = %v", o.data)
+	}
+}
+
+func TestRootfsPropagationFlags(t *testing.T) {
+	for value, want := range map[string]uintptr{
+		"":           unix.MS_PRIVATE | unix.MS_REC,
+		"rslave":     unix.MS_SLAVE | unix.MS_REC,
+		"shared":     unix.MS_SHARED,
+		"rshared":    unix.MS_SHARED | unix.MS_REC,
+		"rprivate":   unix.MS_PRIVATE | unix.MS_REC,
+		"unbindable": unix.MS_UNBINDABLE,
+	} {
+		got, err := rootfsPropagationFlags(&specs.Spec{Linux: &specs.Linux{RootfsPropagation: value}})
+		if err != nil || got != want {
+			t.Errorf("rootfsPropagationFlags(%q) = %#x, %v, want %#x", value, got, err, want)
+		}
+	}
+	if got, err := rootfsPropagationFlags(nil); err != nil || got != unix.MS_PRIVATE|unix.MS_REC {
+		t.Errorf("rootfsPropagationFlags(nil) = %#x, %v", got, err)
+	}
+	if _, err := rootfsPropagationFlags(&specs.Spec{Linux: &specs.Linux{RootfsPropagation: "rw"}}); err == nil {
+		t.Errorf("expected error for an invalid propagation")
+	}
+}
+
+func TestValidateBindMount(t *testing.T) {
+	dir := t.TempDir()
+	mounts := []specs.Mount{
+		{Destination: "/data", Type: "bind", Source: dir, Options: []string{"rbind", "rshared"}},
+		{Destination: "/data2", Source: dir, Options: []string{"bind", "ro"}},
+	}
+	for _, m := range mounts {
+		if !isBindMount(m) {
+			t.Fatalf("%+v not detected as a bind mount", m)
+		}
+	}
+	if err := validateSpecMounts(mounts); err != nil {
+		t.Fatalf("valid mounts rejected: %v", err)
+	}
+
+	for _, bad := range []specs.Mount{
+		{Destination: "data", Type: "bind", Source: dir},
+		{Destination: "/", Type: "bind", Source: dir},
+		{Destination: "/data", Type: "bind", Source: filepath.Join(dir, "missing")},
+		{Destination: "/data", Type: "bind", Source: dir, Options: []string{"size=1m"}},
+	} {
+		if err := validateSpecMounts([]specs.Mount{bad}); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+	if err := validateTmpfs(specs.Mount{Destination: "/tmp", Type: "tmpfs", Options: []string{"bind"}}); err == nil {
+		t.Errorf("expected error for a bind tmpfs")
+	}
+}
+
+func TestParentMount(t *testing.T) {
+	orig := mountinfoPath
+	defer func() { mountinfoPath = orig }()
+	mountinfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	info := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+30 22 0:25 / /var rw,relatime - ext4 /dev/sdb1 rw
+31 30 0:26 / /var/lib/containers rw,relatime shared:7 master:2 - xfs /dev/sdc1 rw
+`
+	if err := os.WriteFile(mountinfoPath, []byte(info), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]struct {
+		mp     string
+		shared bool
+	}{
+		"/alpine":                      {"/", true},
+		"/var/run":                     {"/var", false},
+		"/variable":                    {"/", true},
+		"/var/lib/containers/x/rootfs": {"/var/lib/containers", true},
+	} {
+		mp, shared, err := parentMount(path)
+		if err != nil || mp != want.mp || shared != want.shared {
+			t.Errorf("parentMount(%s) = %s, %v, %v, want %s, %v", path, mp, shared, err, want.mp, want.shared)
+		}
+	}
+}
+
+func TestResolveRootfs(t *testing.T) {
+	dir := t.TempDir()
+	rootfs := filepath.Join(dir, "rootfs")
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink("rootfs", link); err != nil {
+		t.Fatal(err)
+	}
+	want, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := resolveRootfs(link, nil); err != nil || got != want {
+		t.Fatalf("resolveRootfs(%s) = %s, %v, want %s", link, got, err, want)
+	}
+	if _, err := resolveRootfs("/", nil); err == nil || !strings.Contains(err.Error(), "host root") {
+		t.Fatalf("expected the host root to be refused, got %v", err)
+	}
+
+	// Shared propagation is refused on the host's / mount only.
+	orig := mountinfoPath
+	defer func() { mountinfoPath = orig }()
+	mountinfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	writeFile(t, mountinfoPath, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n", 0o644)
+	shared := &specs.Spec{Linux: &specs.Linux{RootfsPropagation: "rshared"}}
+	if _, err := resolveRootfs(rootfs, shared); err == nil || !strings.Contains(err.Error(), "host's / mount") {
+		t.Fatalf("expected shared propagation on / to be refused, got %v", err)
+	}
+	if _, err := resolveRootfs(rootfs, &specs.Spec{Linux: &specs.Linux{RootfsPropagation: "rslave"}}); err != nil {
+		t.Fatalf("expected slave propagation to be accepted, got %v", err)
+	}
+	writeFile(t, mountinfoPath, "22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"+
+		"30 22 0:25 / "+dir+" rw,relatime shared:2 - tmpfs tmpfs rw\n", 0o644)
+	if _, err := resolveRootfs(rootfs, shared); err != nil {
+		t.Fatalf("expected a rootfs on its own mount to be accepted, got %v", err)
+	}
+}
+
+func TestOpenRootfs(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(dir, "bundle", "rootfs")
+	if err := os.MkdirAll(rootfs, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := openRootfs(rootfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if same, err := sameFile(fd, fd); err != nil || !same {
+		t.Fatalf("sameFile = %v, %v", same, err)
+	}
+
+	// A component swapped for a symlink after resolving is refused.
+	if err := os.Rename(filepath.Join(dir, "bundle"), filepath.Join(dir, "other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("other", filepath.Join(dir, "bundle")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRootfs(rootfs); err == nil || !strings.Contains(err.Error(), "symlink was swapped") {
+		t.Fatalf("expected the symlink to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,70 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Containers are referred to by their id, their name if they were given
+// one, or a prefix of their id that no other id starts with, as with git
+// revisions: ResolveID turns such a reference into the id every other
+// function of the package takes. An exact id wins over a name, and a name
+// over a prefix, so a reference that worked keeps naming the same
+// container as others are created.
+
+// ResolveID returns the id of the container ref refers to: the container
+// with that id, or with that name, or the only one whose id starts with
+// ref. It fails with an error wrapping ErrNotFound if no container
+// matches, and ErrAmbiguous if several ids start with ref.
+func ResolveID(ref string) (string, error) {
+	if !objectNameRe.MatchString(ref) {
+		return "", fmt.Errorf("no such container %q: %w", ref, ErrNotFound)
+	}
+	s, err := stateStore()
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Load(ref); !errors.Is(err, ErrNotFound) {
+		return ref, err
+	}
+	if id, err := s.NameID(ref); !errors.Is(err, ErrNotFound) {
+		return id, err
+	}
+	ids, err := s.IDs(ref)
+	if err != nil {
+		return "", err
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("no such container %s: %w", ref, ErrNotFound)
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("%w %s, it matches %s", ErrAmbiguous, ref, strings.Join(ids, ", "))
+}
+
+// checkName fails unless a container with id and name, which may be empty,
+// can be created: no other container may have the name as its name or id,
+// nor the id as its name.
+func checkName(id, name string) error {
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	if other, err := s.NameID(id); err == nil && other != id {
+		return fmt.Errorf("container id %s %w as the name of container %s", id, ErrExists, other)
+	}
+	if name == "" {
+		return nil
+	}
+	if other, err := s.NameID(name); err == nil && other != id {
+		return fmt.Errorf("container name %s %w, container %s has it", name, ErrExists, other)
+	}
+	if name != id {
+		if _, err := s.Load(name); err == nil {
+			return fmt.Errorf("container name %s %w as the id of a container", name, ErrExists)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveID(t *testing.T) {
+	for _, kind := range []string{DirStateStore, BoltStateStore} {
+		t.Run(kind, func(t *testing.T) {
+			orig := baseStateDir
+			baseStateDir = t.TempDir()
+			defer func() { baseStateDir = orig }()
+			s, err := OpenStateStore(kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetStateStore(s)
+			defer SetStateStore(nil)
+
+			for _, c := range []*Container{
+				{Id: "web1", Name: "frontend"},
+				{Id: "web2"},
+				{Id: "db7f3a", Name: "db"},
+				{Id: "db"},
+			} {
+				if err := s.Save(c); err != nil {
+					t.Fatalf("Save %s: %v", c.Id, err)
+				}
+			}
+			for ref, want := range map[string]string{
+				"web1":     "web1",
+				"frontend": "web1",
+				"db":       "db", // an id wins over a name
+				"db7":      "db7f3a",
+				"web2":     "web2",
+			} {
+				if id, err := ResolveID(ref); err != nil || id != want {
+					t.Errorf("ResolveID(%q) = %q, %v, want %q", ref, id, err, want)
+				}
+			}
+			if _, err := ResolveID("web"); !errors.Is(err, ErrAmbiguous) {
+				t.Errorf("ResolveID of a prefix of two ids: got %v, want ErrAmbiguous", err)
+			}
+			for _, ref := range []string{"cache", "", "../web1"} {
+				if _, err := ResolveID(ref); !errors.Is(err, ErrNotFound) {
+					t.Errorf("ResolveID(%q): got %v, want ErrNotFound", ref, err)
+				}
+			}
+
+			if err := s.Save(&Container{Id: "web3", Name: "frontend"}); !errors.Is(err, ErrExists) {
+				t.Errorf("Save with a taken name: got %v, want ErrExists", err)
+			}
+			for _, tt := range []struct{ id, name string }{
+				{"web3", "frontend"},
+				{"web3", "web2"},
+				{"frontend", ""},
+			} {
+				if err := checkName(tt.id, tt.name); !errors.Is(err, ErrExists) {
+					t.Errorf("checkName(%q, %q): got %v, want ErrExists", tt.id, tt.name, err)
+				}
+			}
+			if err := checkName("web1", "frontend"); err != nil {
+				t.Errorf("checkName of a container taking its name again: %v", err)
+			}
+
+			if err := s.Delete("web1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.NameID("frontend"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("NameID of the name of a deleted container: got %v, want ErrNotFound", err)
+			}
+			if err := s.Save(&Container{Id: "web3", Name: "frontend"}); err != nil {
+				t.Errorf("Save with a freed name: %v", err)
+			}
+			if id, err := ResolveID("frontend"); err != nil || id != "web3" {
+				t.Errorf("ResolveID(frontend) = %q, %v, want web3", id, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,421 @@
+package container
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// DiagnoseNetwork checks the network of a running container the way its
+// processes see it, from inside its network namespace: the state of its
+// links, its address and default route, whether its gateway answers pings
+// and its nameservers resolve a name, and from the host whether the ports
+// its image exposes accept connections on its address.
+
+// Statuses of a NetworkCheck.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// diagnoseTimeout bounds each probe of DiagnoseNetwork. It is a variable
+// so tests can override it.
+var diagnoseTimeout = 2 * time.Second
+
+// NetworkDiagnosis is the report of DiagnoseNetwork.
+type NetworkDiagnosis struct {
+	Container string         `json:"container"`
+	Network   *NetworkConfig `json:"network,omitempty"`
+	Checks    []NetworkCheck `json:"checks"`
+}
+
+// NetworkCheck is the outcome of one check of a NetworkDiagnosis.
+type NetworkCheck struct {
+	// Name is what was checked, such as "link eth0", "route" or
+	// "port 80/tcp".
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Failed reports whether any check of d failed.
+func (d *NetworkDiagnosis) Failed() bool {
+	return slices.ContainsFunc(d.Checks, func(c NetworkCheck) bool { return c.Status == CheckFailed })
+}
+
+func (d *NetworkDiagnosis) add(name, status, format string, args ...any) {
+	d.Checks = append(d.Checks, NetworkCheck{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// DiagnoseNetwork checks the network of container id. The DNS check
+// resolves name, by default the id of the container on a bridge network,
+// which its DNS server answers, and example.com on others. The error
+// reports what kept the checks from running, not failed checks.
+func DiagnoseNetwork(ctx context.Context, id, name string) (*NetworkDiagnosis, error) {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	if !c.Status.running() {
+		return nil, fmt.Errorf("container %s is %w", id, ErrNotRunning)
+	}
+	pidfd, err := openInit(c)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(pidfd)
+
+	cfg := c.Network
+	if cfg == nil {
+		cfg = &NetworkConfig{Driver: NoneNetwork}
+	}
+	d := &NetworkDiagnosis{Container: c.Id, Network: cfg}
+	if cfg.Driver == HostNetwork {
+		d.add("network", CheckSkipped, "the container shares the network of the host")
+		return d, nil
+	}
+	if name == "" {
+		name = "example.com"
+		if cfg.Driver == BridgeNetwork {
+			name = c.Id
+		}
+	}
+	pid := c.InitProcessPiD
+	nameservers := resolvConfNameservers(fmt.Sprintf("/proc/%d/root/etc/resolv.conf", pid))
+
+	err = withNetns(pid, func() error {
+		diagnoseLink(d, "lo", "")
+		if cfg.Driver == NoneNetwork {
+			return nil
+		}
+		diagnoseLink(d, containerIfname, cfg.Address)
+		if cfg.Gateway == "" {
+			d.add("gateway", CheckSkipped, "no gateway")
+		} else if rtt, err := icmpEcho(net.ParseIP(cfg.Gateway), diagnoseTimeout); err != nil {
+			d.add("gateway", CheckFailed, "%s doesn't answer: %v", cfg.Gateway, err)
+		} else {
+			d.add("gateway", CheckOK, "%s answered in %v", cfg.Gateway, rtt.Round(time.Microsecond))
+		}
+		diagnoseDNS(ctx, d, name, nameservers)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Driver == NoneNetwork {
+		return d, nil
+	}
+	// Routes are read from outside, /proc/net being that of the process.
+	diagnoseRoute(d, fmt.Sprintf("/proc/%d/net/route", pid), cfg.Gateway)
+	diagnosePorts(ctx, d, c)
+	return d, nil
+}
+
+// diagnoseLink checks that link is up, and has address if set.
+func diagnoseLink(d *NetworkDiagnosis, link, address string) {
+	iface, err := net.InterfaceByName(link)
+	if err != nil {
+		d.add("link "+link, CheckFailed, "%v", err)
+		return
+	}
+	switch {
+	case iface.Flags&net.FlagUp == 0:
+		d.add("link "+link, CheckFailed, "down")
+	case iface.Flags&net.FlagRunning == 0 && iface.Flags&net.FlagLoopback == 0:
+		d.add("link "+link, CheckFailed, "up without carrier")
+	default:
+		detail := fmt.Sprintf("up, mtu %d", iface.MTU)
+		if len(iface.HardwareAddr) > 0 {
+			detail += ", " + iface.HardwareAddr.String()
+		}
+		d.add("link "+link, CheckOK, "%s", detail)
+	}
+	if address == "" {
+		return
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		d.add("address", CheckFailed, "%v", err)
+		return
+	}
+	var have []string
+	for _, a := range addrs {
+		have = append(have, a.String())
+	}
+	if slices.Contains(have, address) {
+		d.add("address", CheckOK, "%s on %s", address, link)
+	} else {
+		d.add("address", CheckFailed, "%s not on %s, which has %s", address, link, strings.Join(have, ", "))
+	}
+}
+
+// diagnoseRoute checks that the routing table at path has a default route
+// through gateway.
+func diagnoseRoute(d *NetworkDiagnosis, path, gateway string) {
+	gw, dev, err := defaultRoute(path)
+	switch {
+	case err != nil:
+		d.add("route", CheckFailed, "%v", err)
+	case gw == nil:
+		d.add("route", CheckFailed, "no default route")
+	case gateway != "" && !gw.Equal(net.ParseIP(gateway)):
+		d.add("route", CheckFailed, "default route via %s dev %s, expected via %s", gw, dev, gateway)
+	default:
+		d.add("route", CheckOK, "default via %s dev %s", gw, dev)
+	}
+}
+
+// defaultRoute returns the gateway and link of the default IPv4 route of
+// the routing table at path, in the format of /proc/net/route, nil if
+// there is none.
+func defaultRoute(path string) (net.IP, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read routes: %w", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid route %q", s.Text())
+		}
+		ip := make(net.IP, 4)
+		binary.NativeEndian.PutUint32(ip, uint32(gw))
+		return ip, fields[0], nil
+	}
+	return nil, "", s.Err()
+}
+
+// diagnoseDNS checks that one of nameservers resolves name.
+func diagnoseDNS(ctx context.Context, d *NetworkDiagnosis, name string, nameservers []string) {
+	if len(nameservers) == 0 {
+		d.add("dns", CheckFailed, "no nameserver in /etc/resolv.conf")
+		return
+	}
+	var errs []string
+	for _, ns := range nameservers {
+		ips, err := resolveA(ctx, ns, name)
+		if err == nil {
+			d.add("dns", CheckOK, "%s is %s, from %s", name, ips[0], ns)
+			return
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", ns, err))
+	}
+	d.add("dns", CheckFailed, "%s not resolved: %s", name, strings.Join(errs, "; "))
+}
+
+// resolveA asks the nameserver ns for the IPv4 addresses of name.
+func resolveA(ctx context.Context, ns, name string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", net.JoinHostPort(ns, "53"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	id := uint16(time.Now().UnixNano())
+	if _, err := conn.Write(dnsQueryA(id, name)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return parseDNSAnswer(buf[:n], id)
+}
+
+// dnsQueryA builds a recursive query for the A records of name.
+func dnsQueryA(id uint16, name string) []byte {
+	q := make([]byte, 12)
+	binary.BigEndian.PutUint16(q[0:2], id)
+	binary.BigEndian.PutUint16(q[2:4], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(q[4:6], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0)
+	q = binary.BigEndian.AppendUint16(q, dnsTypeA)
+	return binary.BigEndian.AppendUint16(q, dnsClassIN)
+}
+
+// dnsRcodeNames name the common error codes of DNS responses.
+var dnsRcodeNames = map[uint16]string{1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 5: "REFUSED"}
+
+// parseDNSAnswer returns the IPv4 addresses answered by the response msg
+// to the query id.
+func parseDNSAnswer(msg []byte, id uint16) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("short DNS message")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if binary.BigEndian.Uint16(msg[0:2]) != id || flags&0x8000 == 0 {
+		return nil, errors.New("not a response to the query")
+	}
+	if rcode := flags & 0xf; rcode != 0 {
+		if name, ok := dnsRcodeNames[rcode]; ok {
+			return nil, errors.New(name)
+		}
+		return nil, fmt.Errorf("response code %d", rcode)
+	}
+	off := 12
+	var err error
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	var ips []net.IP
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:8])); i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errors.New("truncated answer")
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		size := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+size > len(msg) {
+			return nil, errors.New("truncated answer")
+		}
+		if typ == dnsTypeA && size == 4 {
+			ips = append(ips, net.IP(append([]byte{}, msg[off:off+4]...)))
+		}
+		off += size
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no address")
+	}
+	return ips, nil
+}
+
+// skipDNSName returns the offset past the name at off in msg.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errors.New("truncated name")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			// A pointer ends the name.
+			return off + 2, nil
+		}
+		off += 1 + l
+	}
+}
+
+// icmpEcho pings ip once and returns the round trip time.
+func icmpEcho(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	id, seq := uint16(os.Getpid()), uint16(time.Now().UnixNano())
+	msg := []byte{8, 0, 0, 0} // echo request
+	msg = binary.BigEndian.AppendUint16(msg, id)
+	msg = binary.BigEndian.AppendUint16(msg, seq)
+	msg = append(msg, "containish"...)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		// An echo reply to this request, IPv4 headers being stripped.
+		if n >= 8 && buf[0] == 0 && binary.BigEndian.Uint16(buf[4:]) == id &&
+			binary.BigEndian.Uint16(buf[6:]) == seq && from.(*net.IPAddr).IP.Equal(ip) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// icmpChecksum is the internet checksum of msg.
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// diagnosePorts checks from the host that the TCP ports the image of c
+// exposes accept connections on its address. Only bridge networks route
+// the address of a container to the host.
+func diagnosePorts(ctx context.Context, d *NetworkDiagnosis, c *Container) {
+	if c.Image == nil {
+		return
+	}
+	img, err := LoadImage(c.Image.Ref)
+	if err != nil || len(img.Config.ExposedPorts) == 0 {
+		return
+	}
+	var ports []string
+	for p := range img.Config.ExposedPorts {
+		ports = append(ports, p)
+	}
+	slices.Sort(ports)
+	addr := networkIP(c.Network)
+	for _, p := range ports {
+		port, proto, _ := strings.Cut(p, "/")
+		name := "port " + port + "/" + cmp.Or(proto, "tcp")
+		switch {
+		case proto != "" && proto != "tcp":
+			d.add(name, CheckSkipped, "only TCP ports are checked")
+		case c.Network.Driver != BridgeNetwork:
+			d.add(name, CheckSkipped, "the host can't reach a %s address", c.Network.Driver)
+		default:
+			ctx, cancel := context.WithTimeout(ctx, diagnoseTimeout)
+			var dialer net.Dialer
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr, port))
+			cancel()
+			if err != nil {
+				d.add(name, CheckFailed, "%v", err)
+				continue
+			}
+			conn.Close()
+			d.add(name, CheckOK, "%s accepts connections", net.JoinHostPort(addr, port))
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultRoute(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "route")
+	writeFile(t, path, `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0059000A	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0100590A	0003	0	0	0	00000000	0	0	0
+`, 0o644)
+	gw, dev, err := defaultRoute(path)
+	if err != nil || dev != "eth0" || !gw.Equal(net.IPv4(10, 89, 0, 1)) {
+		t.Fatalf("defaultRoute = %v, %q, %v, want 10.89.0.1 on eth0", gw, dev, err)
+	}
+
+	writeFile(t, path, "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\n", 0o644)
+	if gw, _, err := defaultRoute(path); err != nil || gw != nil {
+		t.Errorf("defaultRoute = %v, %v without a default route", gw, err)
+	}
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	lookup := func(name string) (net.IP, bool) { return net.IPv4(10, 89, 0, 2), name == "web" }
+	resp, ok := answerDNS(dnsQueryA(42, "web"), lookup)
+	if !ok {
+		t.Fatal("no answer")
+	}
+	ips, err := parseDNSAnswer(resp, 42)
+	if err != nil || len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 89, 0, 2)) {
+		t.Fatalf("parseDNSAnswer = %v, %v, want 10.89.0.2", ips, err)
+	}
+	if _, err := parseDNSAnswer(resp, 43); err == nil {
+		t.Error("expected an error for another query id")
+	}
+	if _, err := parseDNSAnswer(resp[:len(resp)-2], 42); err == nil {
+		t.Error("expected an error for a truncated answer")
+	}
+	servfail := forwardDNS(dnsQueryA(42, "example.com"), nil)
+	if _, err := parseDNSAnswer(servfail, 42); err == nil {
+		t.Error("expected an error for SERVFAIL")
+	}
+}
+
+func TestICMPChecksum(t *testing.T) {
+	// An echo request of id 1, seq 1, without data.
+	if sum := icmpChecksum([]byte{8, 0, 0, 0, 0, 1, 0, 1}); sum != 0xf7fd {
+		t.Errorf("icmpChecksum = %#x, want 0xf7fd", sum)
+	}
+}
+
+func TestDiagnoseNetwork(t *testing.T) {
+	tempImages(t)
+	if _, err := DiagnoseNetwork(context.Background(), "missing", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DiagnoseNetwork of a missing container = %v, want ErrNotFound", err)
+	}
+	if err := saveState(&Container{Id: "stopped", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DiagnoseNetwork(context.Background(), "stopped", ""); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("DiagnoseNetwork of a stopped container = %v, want ErrNotRunning", err)
+	}
+
+	// This process stands in for the init of a running container, in the
+	// network namespace of the host.
+	start, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Container{Id: "web", Status: Running, InitProcessPiD: os.Getpid(), InitStartTime: start, Network: &NetworkConfig{Driver: HostNetwork}}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	d, err := DiagnoseNetwork(context.Background(), "web", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Checks) != 1 || d.Checks[0].Status != CheckSkipped || d.Failed() {
+		t.Errorf("expected the checks of a host network to be skipped, got %+v", d.Checks)
+	}
+
+	c.Network = &NetworkConfig{Driver: NoneNetwork}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	d, err = DiagnoseNetwork(context.Background(), "web", "")
+	if err != nil {
+		t.Skipf("can't enter network namespaces: %v", err)
+	}
+	if len(d.Checks) != 1 || d.Checks[0].Name != "link lo" || d.Checks[0].Status != CheckOK {
+		t.Errorf("expected loopback to be up, got %+v", d.Checks)
+	}
+}
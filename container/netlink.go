@@ -0,0 +1,276 @@
+package container
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// This file contains a minimal rtnetlink client: just the requests needed to
+// create links, assign addresses and add routes. Messages are built by hand
+// in host byte order, the same way the kernel expects them.
+
+// Link modes not exported by x/sys/unix, from linux/if_link.h.
+const (
+	macvlanModePrivate  = 1
+	macvlanModeVepa     = 2
+	macvlanModeBridge   = 4
+	macvlanModePassthru = 8
+
+	ipvlanModeL2  = 0
+	ipvlanModeL3  = 1
+	ipvlanModeL3S = 2
+
+	vethInfoPeer = 1
+)
+
+var netlinkSeq uint32
+
+// nlAttr is a netlink route attribute, possibly with nested attributes.
+type nlAttr struct {
+	typ      uint16
+	data     []byte
+	children []nlAttr
+}
+
+func attr(typ uint16, data []byte) nlAttr {
+	return nlAttr{typ: typ, data: data}
+}
+
+func attrString(typ uint16, s string) nlAttr {
+	return attr(typ, append([]byte(s), 0))
+}
+
+func attrUint32(typ uint16, v uint32) nlAttr {
+	return attr(typ, binary.NativeEndian.AppendUint32(nil, v))
+}
+
+func attrUint16(typ uint16, v uint16) nlAttr {
+	return attr(typ, binary.NativeEndian.AppendUint16(nil, v))
+}
+
+func attrNested(typ uint16, children ...nlAttr) nlAttr {
+	return nlAttr{typ: typ | unix.NLA_F_NESTED, children: children}
+}
+
+// encode serializes the attribute, padding it to a 4-byte boundary.
+func (a nlAttr) encode() []byte {
+	payload := a.data
+	for _, c := range a.children {
+		payload = append(payload, c.encode()...)
+	}
+	b := make([]byte, unix.SizeofRtAttr, unix.SizeofRtAttr+len(payload)+3)
+	binary.NativeEndian.PutUint16(b[0:], uint16(unix.SizeofRtAttr+len(payload)))
+	binary.NativeEndian.PutUint16(b[2:], a.typ)
+	b = append(b, payload...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// netlinkRequest sends a single rtnetlink request with the given fixed
+// header (ifinfomsg, ifaddrmsg, rtmsg...) and attributes, and waits for the
+// kernel's acknowledgement.
+func netlinkRequest(msgType uint16, flags uint16, header []byte, attrs ...nlAttr) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	body := append([]byte{}, header...)
+	for _, a := range attrs {
+		body = append(body, a.encode()...)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:], msgType)
+	binary.NativeEndian.PutUint16(msg[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:], seq)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send netlink request: %w", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("failed to read netlink reply: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse netlink reply: %w", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink error")
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// ifInfoMsg builds a struct ifinfomsg.
+func ifInfoMsg(index int32, flags, change uint32) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], flags)
+	binary.NativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// linkAdd creates a link. Extra attributes (kind, parent, namespace...)
+// describe the link type.
+func linkAdd(name string, attrs ...nlAttr) error {
+	attrs = append([]nlAttr{attrString(unix.IFLA_IFNAME, name)}, attrs...)
+	if err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfoMsg(0, 0, 0), attrs...); err != nil {
+		return fmt.Errorf("failed to create link %s: %w", name, err)
+	}
+	return nil
+}
+
+// linkSetUp brings the named link up.
+func linkSetUp(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := netlinkRequest(unix.RTM_NEWLINK, 0, ifInfoMsg(int32(iface.Index), unix.IFF_UP, unix.IFF_UP)); err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", name, err)
+	}
+	return nil
+}
+
+// linkModify changes attributes of an existing link, such as its master.
+func linkModify(name string, attrs ...nlAttr) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := netlinkRequest(unix.RTM_NEWLINK, 0, ifInfoMsg(int32(iface.Index), 0, 0), attrs...); err != nil {
+		return fmt.Errorf("failed to modify link %s: %w", name, err)
+	}
+	return nil
+}
+
+// linkDel removes the named link.
+func linkDel(name string) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	if err := netlinkRequest(unix.RTM_DELLINK, 0, ifInfoMsg(int32(iface.Index), 0, 0)); err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", name, err)
+	}
+	return nil
+}
+
+// addrAdd assigns an IPv4 address with prefix to the named link.
+func addrAdd(name string, addr *net.IPNet) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return fmt.Errorf("only IPv4 addresses are supported, got %s", addr)
+	}
+	ones, _ := addr.Mask.Size()
+
+	h := make([]byte, unix.SizeofIfAddrmsg)
+	h[0] = unix.AF_INET
+	h[1] = byte(ones)
+	h[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(h[4:], uint32(iface.Index))
+
+	bcast := make(net.IP, 4)
+	for i := range ip {
+		bcast[i] = ip[i] | ^addr.Mask[i]
+	}
+	if err := netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, h,
+		attr(unix.IFA_LOCAL, ip),
+		attr(unix.IFA_ADDRESS, ip),
+		attr(unix.IFA_BROADCAST, bcast),
+	); err != nil {
+		return fmt.Errorf("failed to add address %s to %s: %w", addr, name, err)
+	}
+	return nil
+}
+
+// routeAddDefault adds a default IPv4 route through gw on the named link.
+func routeAddDefault(name string, gw net.IP) error {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to find link %s: %w", name, err)
+	}
+	h := make([]byte, unix.SizeofRtMsg)
+	h[0] = unix.AF_INET
+	h[4] = unix.RT_TABLE_MAIN
+	h[5] = unix.RTPROT_BOOT
+	h[6] = unix.RT_SCOPE_UNIVERSE
+	h[7] = unix.RTN_UNICAST
+
+	if err := netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, h,
+		attr(unix.RTA_GATEWAY, gw.To4()),
+		attrUint32(unix.RTA_OIF, uint32(iface.Index)),
+	); err != nil {
+		return fmt.Errorf("failed to add default route via %s: %w", gw, err)
+	}
+	return nil
+}
+
+// withNetns runs fn with the calling goroutine's thread switched into the
+// network namespace of pid. Sockets created by fn belong to that namespace.
+func withNetns(pid int, fn func() error) error {
+	runtime.LockOSThread()
+
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current netns: %w", err)
+	}
+	defer orig.Close()
+
+	target, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open netns of pid %d: %w", pid, err)
+	}
+	defer target.Close()
+
+	if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter netns of pid %d: %w", pid, err)
+	}
+
+	fnErr := fn()
+
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// Leave the thread locked so the runtime discards it rather than
+		// reusing a thread stuck in the wrong namespace.
+		return fmt.Errorf("failed to restore netns: %w", err)
+	}
+	runtime.UnlockOSThread()
+	return fnErr
+}
@@ -0,0 +1,249 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network drivers accepted in NetworkConfig.Driver.
+const (
+	// HostNetwork shares the host network namespace.
+	HostNetwork = "host"
+	// NoneNetwork gives the container a namespace with only loopback.
+	NoneNetwork = "none"
+	// BridgeNetwork attaches the container to a named bridge network
+	// through a veth pair.
+	BridgeNetwork = "bridge"
+	MacvlanDriver = "macvlan"
+	IpvlanDriver  = "ipvlan"
+)
+
+// defaultNetwork is the network of containers that don't select one, see
+// Config.
+var defaultNetwork = NoneNetwork
+
+// containerIfname is the name of the container's primary interface.
+const containerIfname = "eth0"
+
+// dhcpTimeout bounds how long a container start waits for a DHCP lease.
+var dhcpTimeout = 10 * time.Second
+
+// NetworkConfig describes how a container is attached to the network. It is
+// recorded in the container state once the interface is configured.
+type NetworkConfig struct {
+	Driver string `json:"driver"`
+	// Name is the user-defined network the container is attached to, if
+	// any. Containers sharing a named network are not isolated.
+	Name string `json:"name,omitempty"`
+	// Parent is the host interface macvlan/ipvlan links hang off.
+	Parent string `json:"parent,omitempty"`
+	// Mode is the driver mode, e.g. "bridge" for macvlan or "l2" for ipvlan.
+	Mode string `json:"mode,omitempty"`
+	// Address is the container address in CIDR notation. When empty on
+	// input the address is obtained through DHCP.
+	Address string   `json:"address,omitempty"`
+	Gateway string   `json:"gateway,omitempty"`
+	DHCP    bool     `json:"dhcp,omitempty"`
+	DNS     []string `json:"dns,omitempty"`
+}
+
+// ParseNetwork parses a --network value: "host", "none", "bridge" (the
+// default bridge network), the name of a user-defined network, or
+// "<driver>:<parent>[:<mode>]", e.g. "macvlan:eth0" or "ipvlan:eth0:l3".
+func ParseNetwork(value string) (*NetworkConfig, error) {
+	parts := strings.Split(value, ":")
+	cfg := &NetworkConfig{Driver: parts[0]}
+
+	switch cfg.Driver {
+	case HostNetwork, NoneNetwork:
+		if len(parts) != 1 {
+			return nil, fmt.Errorf("invalid network %q: %s takes no options", value, cfg.Driver)
+		}
+	case MacvlanDriver, IpvlanDriver:
+		if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid network %q: expected %s:<parent>[:<mode>]", value, cfg.Driver)
+		}
+		cfg.Parent = parts[1]
+		if len(parts) == 3 {
+			cfg.Mode = parts[2]
+		}
+		if _, err := linkModeAttr(cfg); err != nil {
+			return nil, err
+		}
+	default:
+		if len(parts) != 1 || validateNetworkName(value) != nil {
+			return nil, fmt.Errorf("unknown network driver %q", cfg.Driver)
+		}
+		cfg.Driver = BridgeNetwork
+		cfg.Name = value
+	}
+	return cfg, nil
+}
+
+// linkModeAttr returns the IFLA_INFO_DATA attribute selecting the driver
+// mode, applying the default mode when none was given.
+func linkModeAttr(cfg *NetworkConfig) (nlAttr, error) {
+	switch cfg.Driver {
+	case MacvlanDriver:
+		modes := map[string]uint32{
+			"private":  macvlanModePrivate,
+			"vepa":     macvlanModeVepa,
+			"bridge":   macvlanModeBridge,
+			"passthru": macvlanModePassthru,
+		}
+		if cfg.Mode == "" {
+			cfg.Mode = "bridge"
+		}
+		m, ok := modes[cfg.Mode]
+		if !ok {
+			return nlAttr{}, fmt.Errorf("unknown macvlan mode %q", cfg.Mode)
+		}
+		return attrUint32(unix.IFLA_MACVLAN_MODE, m), nil
+	case IpvlanDriver:
+		modes := map[string]uint16{"l2": ipvlanModeL2, "l3": ipvlanModeL3, "l3s": ipvlanModeL3S}
+		if cfg.Mode == "" {
+			cfg.Mode = "l2"
+		}
+		m, ok := modes[cfg.Mode]
+		if !ok {
+			return nlAttr{}, fmt.Errorf("unknown ipvlan mode %q", cfg.Mode)
+		}
+		return attrUint16(unix.IFLA_IPVLAN_MODE, m), nil
+	}
+	return nlAttr{}, fmt.Errorf("unknown network driver %q", cfg.Driver)
+}
+
+// validateNetwork checks static addressing before anything is created.
+func validateNetwork(cfg *NetworkConfig) error {
+	if cfg.Driver == HostNetwork || cfg.Driver == NoneNetwork {
+		if cfg.Address != "" || cfg.Gateway != "" {
+			return fmt.Errorf("network %s does not take an address", cfg.Driver)
+		}
+		return nil
+	}
+	if cfg.Driver == BridgeNetwork {
+		if cfg.Gateway != "" {
+			return fmt.Errorf("the gateway of a bridge network cannot be overridden")
+		}
+		if cfg.Address != "" && net.ParseIP(strings.Split(cfg.Address, "/")[0]).To4() == nil {
+			return fmt.Errorf("invalid address %q", cfg.Address)
+		}
+		_, err := LoadNetwork(cfg.Name)
+		return err
+	}
+	if cfg.Address == "" {
+		if cfg.Gateway != "" {
+			return fmt.Errorf("a gateway requires a static address")
+		}
+		cfg.DHCP = true
+		return nil
+	}
+	ip, _, err := net.ParseCIDR(cfg.Address)
+	if err != nil || ip.To4() == nil {
+		return fmt.Errorf("invalid address %q: expected an IPv4 CIDR such as 192.168.1.50/24", cfg.Address)
+	}
+	if cfg.Gateway != "" && net.ParseIP(cfg.Gateway).To4() == nil {
+		return fmt.Errorf("invalid gateway %q", cfg.Gateway)
+	}
+	return nil
+}
+
+// setupNetwork configures the network namespace of pid, the init process
+// of container id, according to cfg. Every namespace of its own has
+// loopback up already, brought up by the child stage; drivers then add
+// eth0.
+func setupNetwork(id string, pid int, rootfs string, cfg *NetworkConfig) error {
+	switch cfg.Driver {
+	case HostNetwork, NoneNetwork:
+		return nil
+	case BridgeNetwork:
+		return setupBridge(id, pid, rootfs, cfg)
+	}
+	return setupSubinterface(pid, rootfs, cfg)
+}
+
+// setupSubinterface creates a macvlan/ipvlan interface in the network
+// namespace of pid and configures its address and default route. DHCP
+// results are written back into cfg.
+func setupSubinterface(pid int, rootfs string, cfg *NetworkConfig) error {
+	parent, err := net.InterfaceByName(cfg.Parent)
+	if err != nil {
+		return fmt.Errorf("parent interface %s not found: %w", cfg.Parent, err)
+	}
+	mode, err := linkModeAttr(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Create the sub-interface directly inside the container namespace.
+	if err := linkAdd(containerIfname,
+		attrUint32(unix.IFLA_LINK, uint32(parent.Index)),
+		attrUint32(unix.IFLA_NET_NS_PID, uint32(pid)),
+		attrNested(unix.IFLA_LINKINFO,
+			attrString(unix.IFLA_INFO_KIND, cfg.Driver),
+			attrNested(unix.IFLA_INFO_DATA, mode),
+		),
+	); err != nil {
+		return err
+	}
+
+	err = withNetns(pid, func() error {
+		if err := linkSetUp(containerIfname); err != nil {
+			return err
+		}
+
+		if cfg.DHCP {
+			iface, err := net.InterfaceByName(containerIfname)
+			if err != nil {
+				return err
+			}
+			lease, err := dhcpAcquire(containerIfname, iface.HardwareAddr, dhcpTimeout)
+			if err != nil {
+				return err
+			}
+			cfg.Address = lease.Address.String()
+			if lease.Gateway != nil {
+				cfg.Gateway = lease.Gateway.String()
+			}
+			for _, d := range lease.DNS {
+				cfg.DNS = append(cfg.DNS, d.String())
+			}
+		}
+
+		ip, ipnet, err := net.ParseCIDR(cfg.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address %q: %w", cfg.Address, err)
+		}
+		if err := addrAdd(containerIfname, &net.IPNet{IP: ip, Mask: ipnet.Mask}); err != nil {
+			return err
+		}
+		if cfg.Gateway != "" {
+			return routeAddDefault(containerIfname, net.ParseIP(cfg.Gateway))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.DNS) > 0 {
+		return writeResolvConf(rootfs, cfg.DNS)
+	}
+	return nil
+}
+
+// writeResolvConf points the container resolver at the given servers.
+func writeResolvConf(rootfs string, servers []string) error {
+	var b strings.Builder
+	for _, s := range servers {
+		fmt.Fprintf(&b, "nameserver %s\n", s)
+	}
+	if err := writeFileInRoot(rootfs, "/etc/resolv.conf", []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write resolv.conf: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseNetwork(t *testing.T) {
+	cfg, err := ParseNetwork("macvlan:eth0")
+	if err != nil {
+		t.Fatalf("ParseNetwork failed: %v", err)
+	}
+	if cfg.Driver != MacvlanDriver || cfg.Parent != "eth0" || cfg.Mode != "bridge" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	cfg, err = ParseNetwork("ipvlan:enp3s0:l3")
+	if err != nil {
+		t.Fatalf("ParseNetwork failed: %v", err)
+	}
+	if cfg.Driver != IpvlanDriver || cfg.Parent != "enp3s0" || cfg.Mode != "l3" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+
+	for _, mode := range []string{HostNetwork, NoneNetwork} {
+		cfg, err := ParseNetwork(mode)
+		if err != nil || cfg.Driver != mode {
+			t.Fatalf("ParseNetwork(%q) = %+v, %v", mode, cfg, err)
+		}
+	}
+
+	for value, name := range map[string]string{"bridge": DefaultBridgeNetwork, "web": "web"} {
+		cfg, err := ParseNetwork(value)
+		if err != nil || cfg.Driver != BridgeNetwork || cfg.Name != name {
+			t.Fatalf("ParseNetwork(%q) = %+v, %v", value, cfg, err)
+		}
+	}
+
+	for _, bad := range []string{"host:eth0", "none:x", "vxlan:eth0", "macvlan", "macvlan:", "macvlan:eth0:l3", "ipvlan:eth0:bridge", "ipvlan:eth0:l2:x"} {
+		if _, err := ParseNetwork(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	cfg := &NetworkConfig{Driver: MacvlanDriver, Parent: "eth0"}
+	if err := validateNetwork(cfg); err != nil || !cfg.DHCP {
+		t.Fatalf("expected DHCP when no address is set, got %+v, %v", cfg, err)
+	}
+
+	cfg = &NetworkConfig{Driver: MacvlanDriver, Parent: "eth0", Address: "192.168.1.50/24", Gateway: "192.168.1.1"}
+	if err := validateNetwork(cfg); err != nil || cfg.DHCP {
+		t.Fatalf("static config rejected: %+v, %v", cfg, err)
+	}
+
+	for _, bad := range []*NetworkConfig{
+		{Address: "192.168.1.50"},
+		{Address: "fd00::2/64"},
+		{Address: "192.168.1.50/24", Gateway: "router"},
+		{Gateway: "192.168.1.1"},
+		{Driver: HostNetwork, Address: "192.168.1.50/24"},
+		{Driver: NoneNetwork, Gateway: "192.168.1.1"},
+	} {
+		if err := validateNetwork(bad); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestNlAttrEncode(t *testing.T) {
+	got := attrString(unix.IFLA_IFNAME, "eth0").encode()
+	want := []byte{9, 0, unix.IFLA_IFNAME, 0, 'e', 't', 'h', '0', 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("encode() = %v, want %v", got, want)
+	}
+
+	nested := attrNested(unix.IFLA_LINKINFO, attrString(unix.IFLA_INFO_KIND, "macvlan")).encode()
+	if len(nested) != 4+12 || nested[0] != 16 {
+		t.Fatalf("unexpected nested attribute %v", nested)
+	}
+	if typ := uint16(nested[2]) | uint16(nested[3])<<8; typ != unix.IFLA_LINKINFO|unix.NLA_F_NESTED {
+		t.Fatalf("nested flag not set: %#x", typ)
+	}
+}
+
+func TestWriteResolvConf(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := writeResolvConf(rootfs, []string{"10.0.0.1", "10.0.0.2"}); err != nil {
+		t.Fatalf("writeResolvConf failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(rootfs, "etc", "resolv.conf"))
+	if err != nil {
+		t.Fatalf("resolv.conf not written: %v", err)
+	}
+	if string(data) != "nameserver 10.0.0.1\nnameserver 10.0.0.2\n" {
+		t.Fatalf("unexpected resolv.conf %q", data)
+	}
+}
@@ -0,0 +1,339 @@
+package container
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// networksDir holds one JSON file per user-defined network. It is a
+// variable so tests can override it.
+var networksDir = "/var/lib/containish/networks"
+
+// DefaultBridgeNetwork is the network "--network bridge" attaches to. It is
+// created on first use and, unlike user-defined networks, does not let its
+// containers talk to each other.
+const DefaultBridgeNetwork = "bridge"
+
+const (
+	defaultBridgeDevice = "containish0"
+	defaultBridgeSubnet = "10.88.0.0/16"
+)
+
+// objectNameRe matches valid network and volume names.
+var objectNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Network is a named bridge network containers can be attached to.
+type Network struct {
+	Name      string    `json:"name"`
+	ID        string    `json:"id"`
+	Bridge    string    `json:"bridge"`
+	Subnet    string    `json:"subnet"`
+	Gateway   string    `json:"gateway"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func networkFile(name string) string {
+	return filepath.Join(networksDir, name+".json")
+}
+
+// validateNetworkName rejects names that are not usable as file names or
+// that collide with the built-in network modes.
+func validateNetworkName(name string) error {
+	if !objectNameRe.MatchString(name) {
+		return fmt.Errorf("invalid network name %q", name)
+	}
+	switch name {
+	case HostNetwork, NoneNetwork, MacvlanDriver, IpvlanDriver:
+		return fmt.Errorf("network name %q is reserved", name)
+	}
+	return nil
+}
+
+// CreateNetwork creates a bridge network. An empty subnet picks a free /24
+// in 10.89.0.0/16 and an empty gateway the first address of the subnet.
+func CreateNetwork(name, subnet, gateway string) (*Network, error) {
+	if err := validateNetworkName(name); err != nil {
+		return nil, err
+	}
+	if name == DefaultBridgeNetwork {
+		return nil, fmt.Errorf("network name %q is reserved", name)
+	}
+	n, err := newNetwork(name, subnet, gateway)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureBridge(n); err != nil {
+		_ = removeBridge(n)
+		return nil, err
+	}
+	if err := saveNetwork(n); err != nil {
+		_ = removeBridge(n)
+		return nil, err
+	}
+	return n, nil
+}
+
+// newNetwork validates the addressing of a new network and fills in the
+// defaults without creating anything.
+func newNetwork(name, subnet, gateway string) (*Network, error) {
+	if _, err := os.Stat(networkFile(name)); err == nil {
+		return nil, fmt.Errorf("network %s %w", name, ErrExists)
+	}
+	existing, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	var ipnet *net.IPNet
+	if subnet == "" {
+		if ipnet, err = freeSubnet(existing); err != nil {
+			return nil, err
+		}
+	} else {
+		var ip net.IP
+		ip, ipnet, err = net.ParseCIDR(subnet)
+		if err != nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %q: expected an IPv4 CIDR such as 10.90.0.0/24", subnet)
+		}
+		if ones, _ := ipnet.Mask.Size(); ones > 30 {
+			return nil, fmt.Errorf("subnet %s is too small", subnet)
+		}
+		for _, o := range existing {
+			_, other, err := net.ParseCIDR(o.Subnet)
+			if err == nil && (other.Contains(ipnet.IP) || ipnet.Contains(other.IP)) {
+				return nil, fmt.Errorf("subnet %s overlaps network %s (%s)", ipnet, o.Name, o.Subnet)
+			}
+		}
+	}
+
+	gw := nthAddress(ipnet, 1)
+	if gateway != "" {
+		gw = net.ParseIP(gateway).To4()
+		if gw == nil || !ipnet.Contains(gw) || !usableAddress(ipnet, gw) {
+			return nil, fmt.Errorf("invalid gateway %q for subnet %s", gateway, ipnet)
+		}
+	}
+
+	id, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	return &Network{
+		Name:      name,
+		ID:        id,
+		Bridge:    "br-" + id[:12],
+		Subnet:    ipnet.String(),
+		Gateway:   gw.String(),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// freeSubnet returns the first 10.89.x.0/24 not used by another network.
+func freeSubnet(existing []*Network) (*net.IPNet, error) {
+	used := map[string]bool{}
+	for _, n := range existing {
+		used[n.Subnet] = true
+	}
+	for i := 0; i < 256; i++ {
+		s := fmt.Sprintf("10.89.%d.0/24", i)
+		if !used[s] {
+			_, ipnet, _ := net.ParseCIDR(s)
+			return ipnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in 10.89.0.0/16, use --subnet")
+}
+
+func saveNetwork(n *Network) error {
+	if err := os.MkdirAll(networksDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create networks dir: %w", err)
+	}
+	data, err := json.MarshalIndent(n, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(networkFile(n.Name), data, 0o644); err != nil {
+		return fmt.Errorf("failed to save network %s: %w", n.Name, err)
+	}
+	return nil
+}
+
+// LoadNetwork returns the named network. The default bridge network is
+// created the first time it is asked for.
+func LoadNetwork(name string) (*Network, error) {
+	data, err := os.ReadFile(networkFile(name))
+	if errors.Is(err, os.ErrNotExist) {
+		if name == DefaultBridgeNetwork {
+			return createDefaultNetwork()
+		}
+		return nil, fmt.Errorf("network %s %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network %s: %w", name, err)
+	}
+	var n Network
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("failed to decode network %s: %w", name, err)
+	}
+	return &n, nil
+}
+
+func createDefaultNetwork() (*Network, error) {
+	n, err := newNetwork(DefaultBridgeNetwork, defaultBridgeSubnet, "")
+	if err != nil {
+		return nil, err
+	}
+	n.Bridge = defaultBridgeDevice
+	if err := saveNetwork(n); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ListNetworks returns all saved networks ordered by name.
+func ListNetworks() ([]*Network, error) {
+	entries, err := os.ReadDir(networksDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read networks dir: %w", err)
+	}
+	var networks []*Network
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		n, err := LoadNetwork(name)
+		if err != nil {
+			continue
+		}
+		networks = append(networks, n)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+// NetworkContainers returns the running containers attached to a network.
+func NetworkContainers(name string) ([]*Container, error) {
+	all, err := ListContainers()
+	if err != nil {
+		return nil, err
+	}
+	var attached []*Container
+	for _, c := range all {
+		if c.Status.running() && c.Network != nil && c.Network.Driver == BridgeNetwork && c.Network.Name == name {
+			attached = append(attached, c)
+		}
+	}
+	return attached, nil
+}
+
+// RemoveNetwork deletes a network that has no running containers, along
+// with its bridge, NAT rules and DNS server.
+func RemoveNetwork(name string) error {
+	if name == DefaultBridgeNetwork {
+		return fmt.Errorf("the default bridge network cannot be removed")
+	}
+	n, err := LoadNetwork(name)
+	if err != nil {
+		return err
+	}
+	attached, err := NetworkContainers(name)
+	if err != nil {
+		return err
+	}
+	if len(attached) > 0 {
+		return fmt.Errorf("network %s is in use by %d running container(s)", name, len(attached))
+	}
+
+	stopDNSServer(n)
+	if err := removeBridge(n); err != nil {
+		return err
+	}
+	if err := os.Remove(networkFile(name)); err != nil {
+		return fmt.Errorf("failed to remove network %s: %w", name, err)
+	}
+	return nil
+}
+
+// allocateAddress picks the address of container id on n: the requested
+// one when given, otherwise the one leased to it, otherwise the lowest
+// address leased to no other container.
+func allocateAddress(n *Network, requested string, leases []AddressLease, id string) (string, error) {
+	_, ipnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return "", fmt.Errorf("network %s has an invalid subnet: %w", n.Name, err)
+	}
+	ones, _ := ipnet.Mask.Size()
+
+	used := map[string]string{n.Gateway: "the gateway"}
+	held := ""
+	for _, l := range leases {
+		if l.Container != id {
+			used[l.Address] = "container " + l.Container
+		} else if ip := net.ParseIP(l.Address).To4(); ip != nil && ipnet.Contains(ip) && usableAddress(ipnet, ip) {
+			held = ip.String()
+		}
+	}
+
+	if requested != "" {
+		ip := net.ParseIP(strings.Split(requested, "/")[0]).To4()
+		if ip == nil || !ipnet.Contains(ip) || !usableAddress(ipnet, ip) {
+			return "", fmt.Errorf("address %s is not usable in network %s (%s)", requested, n.Name, n.Subnet)
+		}
+		if holder, ok := used[ip.String()]; ok {
+			return "", fmt.Errorf("address %s is already in use in network %s by %s", ip, n.Name, holder)
+		}
+		return fmt.Sprintf("%s/%d", ip, ones), nil
+	}
+	if held != "" {
+		return fmt.Sprintf("%s/%d", held, ones), nil
+	}
+
+	for i := uint32(1); ; i++ {
+		ip := nthAddress(ipnet, i)
+		if !ipnet.Contains(ip) || !usableAddress(ipnet, ip) {
+			return "", fmt.Errorf("no free address left in network %s", n.Name)
+		}
+		if _, ok := used[ip.String()]; !ok {
+			return fmt.Sprintf("%s/%d", ip, ones), nil
+		}
+	}
+}
+
+// nthAddress returns the address n hosts into the subnet.
+func nthAddress(ipnet *net.IPNet, n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ipnet.IP.To4())+n)
+	return ip
+}
+
+// usableAddress reports whether ip is neither the network nor the broadcast
+// address of ipnet.
+func usableAddress(ipnet *net.IPNet, ip net.IP) bool {
+	v := binary.BigEndian.Uint32(ip.To4())
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	bcast := base | ^binary.BigEndian.Uint32(ipnet.Mask)
+	return v != base && v != bcast
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,139 @@
+package container
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// tempNetworksDir points networksDir at a temporary directory.
+func tempNetworksDir(t *testing.T) {
+	t.Helper()
+	old := networksDir
+	networksDir = t.TempDir()
+	t.Cleanup(func() { networksDir = old })
+}
+
+func TestNewNetwork(t *testing.T) {
+	tempNetworksDir(t)
+
+	n, err := newNetwork("web", "", "")
+	if err != nil {
+		t.Fatalf("newNetwork failed: %v", err)
+	}
+	if n.Subnet != "10.89.0.0/24" || n.Gateway != "10.89.0.1" || !strings.HasPrefix(n.Bridge, "br-") || len(n.Bridge) > 15 {
+		t.Fatalf("unexpected network %+v", n)
+	}
+	if err := saveNetwork(n); err != nil {
+		t.Fatalf("saveNetwork failed: %v", err)
+	}
+
+	next, err := newNetwork("db", "", "")
+	if err != nil || next.Subnet != "10.89.1.0/24" {
+		t.Fatalf("expected the next free subnet, got %+v, %v", next, err)
+	}
+
+	custom, err := newNetwork("lab", "172.30.0.0/16", "172.30.255.254")
+	if err != nil || custom.Gateway != "172.30.255.254" {
+		t.Fatalf("custom network rejected: %+v, %v", custom, err)
+	}
+
+	for _, bad := range []struct{ name, subnet, gateway string }{
+		{"web", "", ""},
+		{"overlap", "10.89.0.128/25", ""},
+		{"wide", "10.0.0.0/8", ""},
+		{"tiny", "192.168.5.0/31", ""},
+		{"v6", "fd00::/64", ""},
+		{"gw", "192.168.6.0/24", "192.168.7.1"},
+		{"bcast", "192.168.6.0/24", "192.168.6.255"},
+	} {
+		if _, err := newNetwork(bad.name, bad.subnet, bad.gateway); err == nil {
+			t.Errorf("expected error for %+v", bad)
+		}
+	}
+}
+
+func TestLoadAndListNetworks(t *testing.T) {
+	tempNetworksDir(t)
+
+	if _, err := LoadNetwork("missing"); err == nil {
+		t.Fatalf("expected error for a missing network")
+	}
+	for _, name := range []string{"b", "a"} {
+		n, err := newNetwork(name, "", "")
+		if err != nil {
+			t.Fatalf("newNetwork failed: %v", err)
+		}
+		if err := saveNetwork(n); err != nil {
+			t.Fatalf("saveNetwork failed: %v", err)
+		}
+	}
+
+	networks, err := ListNetworks()
+	if err != nil || len(networks) != 2 || networks[0].Name != "a" {
+		t.Fatalf("unexpected networks %v, %v", networks, err)
+	}
+
+	def, err := LoadNetwork(DefaultBridgeNetwork)
+	if err != nil {
+		t.Fatalf("default network not created: %v", err)
+	}
+	if def.Bridge != defaultBridgeDevice || def.Subnet != defaultBridgeSubnet {
+		t.Fatalf("unexpected default network %+v", def)
+	}
+}
+
+func TestValidateNetworkName(t *testing.T) {
+	for _, ok := range []string{"web", "my-net_1.2"} {
+		if err := validateNetworkName(ok); err != nil {
+			t.Errorf("%q rejected: %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "-x", "a/b", "../x", HostNetwork, NoneNetwork, MacvlanDriver} {
+		if err := validateNetworkName(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	n := &Network{Name: "web", Subnet: "10.89.0.0/29", Gateway: "10.89.0.1"}
+	leases := []AddressLease{{Network: "web", Address: "10.89.0.2", Container: "a"}}
+
+	addr, err := allocateAddress(n, "", leases, "b")
+	if err != nil || addr != "10.89.0.3/29" {
+		t.Fatalf("allocateAddress = %q, %v; want 10.89.0.3/29", addr, err)
+	}
+	addr, err = allocateAddress(n, "10.89.0.6", leases, "b")
+	if err != nil || addr != "10.89.0.6/29" {
+		t.Fatalf("static allocateAddress = %q, %v", addr, err)
+	}
+	for _, bad := range []string{"10.89.0.2", "10.89.0.1", "10.89.0.7", "10.89.0.0", "10.90.0.5"} {
+		if _, err := allocateAddress(n, bad, leases, "b"); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+	// A container gets back the address leased to it.
+	addr, err = allocateAddress(n, "", leases, "a")
+	if err != nil || addr != "10.89.0.2/29" {
+		t.Fatalf("allocateAddress of the holder = %q, %v; want 10.89.0.2/29", addr, err)
+	}
+
+	for i := 3; i <= 6; i++ {
+		leases = append(leases, AddressLease{Network: "web", Address: fmt.Sprintf("10.89.0.%d", i), Container: fmt.Sprint(i)})
+	}
+	if _, err := allocateAddress(n, "", leases, "b"); err == nil {
+		t.Fatalf("expected error when the subnet is full")
+	}
+}
+
+func TestNatRuleset(t *testing.T) {
+	n := &Network{Bridge: "br-0123456789ab", Subnet: "10.89.0.0/24"}
+	r := natRuleset(n)
+	if !strings.HasPrefix(r, "table ip containish-br-0123456789ab\ndelete table ip containish-br-0123456789ab\n") {
+		t.Fatalf("ruleset does not reset the table:\n%s", r)
+	}
+	if !strings.Contains(r, "ip saddr 10.89.0.0/24 ip daddr != 10.89.0.0/24 masquerade") {
+		t.Fatalf("missing masquerade rule:\n%s", r)
+	}
+}
@@ -0,0 +1,325 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// The OCI lifecycle splits a start in two. Create sets the container up and
+// leaves its init process blocked opening the exec fifo in the state dir
+// for writing; start opens the fifo for reading, which lets the init
+// process write a byte and execute the container process.
+
+// execFifoName is the exec fifo in the state dir of a created container.
+const execFifoName = "exec.fifo"
+
+// String returns the OCI name of the status, or starting.
+func (s Status) String() string {
+	switch s {
+	case Created:
+		return string(specs.StateCreated)
+	case Running:
+		return string(specs.StateRunning)
+	case Stopped:
+		return string(specs.StateStopped)
+	case Starting:
+		return "starting"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// StatusName returns the status of c as shown: that of its Status, or
+// CrashLooping.
+func (c *Container) StatusName() string {
+	if c.Status == Stopped && c.CrashLoop != nil {
+		return CrashLooping
+	}
+	return c.Status.String()
+}
+
+// running reports whether the container process runs, ready or not.
+func (s Status) running() bool {
+	return s == Running || s == Starting
+}
+
+// ParseStatus returns the status with the given name.
+func ParseStatus(name string) (Status, error) {
+	for _, s := range []Status{Created, Running, Stopped, Starting} {
+		if s.String() == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown container status %q", name)
+}
+
+// OCIState returns the state of c as defined by the OCI runtime spec.
+func (c *Container) OCIState() specs.State {
+	st := specs.State{
+		Version:     specs.Version,
+		ID:          c.Id,
+		Status:      specs.ContainerState(c.Status.String()),
+		Bundle:      c.Bundle,
+		Annotations: c.Annotations,
+	}
+	if c.Status == Starting {
+		st.Status = specs.StateRunning
+	}
+	if c.Status != Stopped {
+		st.Pid = c.InitProcessPiD
+	}
+	return st
+}
+
+// processAlive reports whether a process with the given pid exists and
+// hasn't exited. An exited container init is a zombie until whoever
+// inherited it reaps it.
+func processAlive(pid int) bool {
+	if err := unix.Kill(pid, 0); err != nil && !errors.Is(err, unix.EPERM) {
+		return false
+	}
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	// The state follows the command name, which is in parentheses.
+	i := bytes.LastIndexByte(stat, ')')
+	return i < 0 || i+2 >= len(stat) || stat[i+2] != 'Z'
+}
+
+// processStartTime returns when pid started, in clock ticks since boot.
+// It tells a process apart from a later one reusing its pid.
+func processStartTime(pid int) (uint64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The fields after the command name start with the state, the third
+	// field; the start time is the 22nd.
+	i := bytes.LastIndexByte(stat, ')')
+	fields := strings.Fields(string(stat[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// initAlive reports whether the init process of c is still running, and
+// not a process that reused its pid since.
+func initAlive(c *Container) bool {
+	if !processAlive(c.InitProcessPiD) {
+		return false
+	}
+	if c.InitStartTime == 0 {
+		return true
+	}
+	start, err := processStartTime(c.InitProcessPiD)
+	return err != nil && !os.IsNotExist(err) || start == c.InitStartTime
+}
+
+// openInit returns a pidfd of the init process of c, once checked against
+// its start time, so that signals sent through it can't reach a later
+// process reusing its pid. It fails with ErrNotRunning if the process is
+// gone.
+func openInit(c *Container) (int, error) {
+	pidfd, err := openProcess(c.InitProcessPiD, c.InitStartTime)
+	if err != nil {
+		return -1, fmt.Errorf("init process of container %s: %w", c.Id, err)
+	}
+	return pidfd, nil
+}
+
+// openProcess returns a pidfd of the process pid that started at start, in
+// clock ticks since boot, or at any time if zero. It fails with
+// ErrNotRunning if the process is gone.
+func openProcess(pid int, start uint64) (int, error) {
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if errors.Is(err, unix.ESRCH) {
+		return -1, fmt.Errorf("process %d is %w", pid, ErrNotRunning)
+	}
+	if err != nil {
+		return -1, fmt.Errorf("failed to open process %d: %w", pid, err)
+	}
+	// The pidfd refers to the process found now, which is the one we
+	// want if it started when it did.
+	if start != 0 {
+		if cur, err := processStartTime(pid); err != nil || cur != start {
+			unix.Close(pidfd)
+			return -1, fmt.Errorf("process %d is %w, its pid was reused", pid, ErrNotRunning)
+		}
+	}
+	return pidfd, nil
+}
+
+// processNsPid returns the pid of pid in its own pid namespace, the
+// innermost one of the NSpid line of its status.
+func processNsPid(pid int) (int, error) {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if rest, ok := strings.CutPrefix(line, "NSpid:"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) == 0 {
+				break
+			}
+			return strconv.Atoi(fields[len(fields)-1])
+		}
+	}
+	return 0, fmt.Errorf("no NSpid in /proc/%d/status", pid)
+}
+
+// refreshStatus marks a created or running container whose init process
+// has exited as stopped. The saved state is left alone.
+func refreshStatus(c *Container) {
+	if c.Status != Stopped && c.InitProcessPiD != 0 && !initAlive(c) {
+		c.Status = Stopped
+	}
+}
+
+func createExecFifo(stateDir string) (string, error) {
+	path := filepath.Join(stateDir, execFifoName)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove stale exec fifo: %w", err)
+	}
+	if err := unix.Mkfifo(path, 0o600); err != nil {
+		return "", fmt.Errorf("failed to create exec fifo: %w", err)
+	}
+	return path, nil
+}
+
+// waitExecFifo blocks until the container is started. fd is an O_PATH
+// descriptor of the exec fifo.
+func waitExecFifo(fd int) error {
+	f, err := os.OpenFile(fmt.Sprintf("/proc/self/fd/%d", fd), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open exec fifo: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{0}); err != nil {
+		return fmt.Errorf("failed to write exec fifo: %w", err)
+	}
+	return nil
+}
+
+// startContainer lets the init process of a created container execute the
+// container process.
+func startContainer(ctx context.Context, containerId string) error {
+	c, err := LoadState(containerId)
+	if err != nil {
+		return err
+	}
+	if c.Status != Created {
+		return fmt.Errorf("container %s has already been started", containerId)
+	}
+	if err := runPlugins(ctx, newPluginEvent(PluginPreExec, c)); err != nil {
+		return err
+	}
+	path := filepath.Join(StateDir(containerId), execFifoName)
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open exec fifo of %s: %w", containerId, err)
+	}
+	defer unix.Close(fd)
+
+	// The init process might never open the fifo, so keep checking on it.
+	for {
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, 100)
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return fmt.Errorf("failed waiting on exec fifo: %w", err)
+		}
+		if n > 0 {
+			b := make([]byte, 1)
+			if n, _ := unix.Read(fd, b); n == 1 {
+				break
+			}
+		}
+		if !processAlive(c.InitProcessPiD) {
+			c.Status = Stopped
+			if err := saveState(c); err != nil {
+				return err
+			}
+			releaseResources(c)
+			return fmt.Errorf("container %s exited before it was started", containerId)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	_ = os.Remove(path)
+
+	err = updateState(containerId, func(c *Container) error {
+		if c.Status != Created {
+			return fmt.Errorf("container %s was stopped while starting", containerId)
+		}
+		c.Status = Running
+		if c.Options != nil && c.Options.Notify && c.ReadyAt == nil {
+			c.Status = Starting
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := sendWebhook(EventStart, c); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	return nil
+}
+
+// killCreated kills the init process of a created container, which is
+// blocked on the exec fifo, and waits for it to go away.
+func killCreated(c *Container) error {
+	pidfd, err := openInit(c)
+	if errors.Is(err, ErrNotRunning) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+	if err := unix.PidfdSendSignal(pidfd, unix.SIGKILL, nil, 0); err != nil && !errors.Is(err, unix.ESRCH) {
+		return fmt.Errorf("failed to kill container %s: %w", c.Id, err)
+	}
+	waitExit(context.Background(), pidfd, time.Second)
+	return nil
+}
+
+// sendConsole sends the master of a pseudo terminal over the unix socket at
+// socketPath, with the terminal's name as payload.
+func sendConsole(socketPath string, master *os.File) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to connect to console socket: %w", err)
+	}
+	defer conn.Close()
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("console socket %s is not a unix socket", socketPath)
+	}
+	if _, _, err := uc.WriteMsgUnix([]byte(master.Name()), unix.UnixRights(int(master.Fd())), nil); err != nil {
+		return fmt.Errorf("failed to send console: %w", err)
+	}
+	return nil
+}
+
+// rootfsEmpty reports whether path is missing or an empty directory.
+func rootfsEmpty(path string) bool {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+	return len(entries) == 0
+}
@@ -0,0 +1,242 @@
+package container
+
+import "time"
+
+// The JSON the commands print with --output json is that of the types of
+// this file rather than the state of the containers, which changes with
+// the runtime: fields are renamed or dropped only along with a new
+// OutputSchemaVersion, which every document carries, so tools reading the
+// output need only ignore the fields they don't know.
+
+// OutputSchemaVersion is the version of the JSON output.
+const OutputSchemaVersion = 1
+
+// ContainerOutput is a container as run, inspect and list print it.
+type ContainerOutput struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Id            string    `json:"id"`
+	Name          string    `json:"name,omitempty"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Bundle        string    `json:"bundle"`
+	// Pid is the init process of a container that hasn't stopped, and
+	// NsPid its pid in the pid namespace of the container.
+	Pid   int `json:"pid,omitempty"`
+	NsPid int `json:"nsPid,omitempty"`
+	// Image is the reference of the image of a container run from one.
+	Image       string            `json:"image,omitempty"`
+	Rootfs      string            `json:"rootfs,omitempty"`
+	CgroupPath  string            `json:"cgroupPath,omitempty"`
+	LogPath     string            `json:"logPath,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	ReadyAt     *time.Time        `json:"readyAt,omitempty"`
+	// ExitCode and FinishedAt are known once the monitor of a detached
+	// container has seen it exit.
+	ExitCode     *int            `json:"exitCode,omitempty"`
+	FinishedAt   *time.Time      `json:"finishedAt,omitempty"`
+	RestartCount int             `json:"restartCount"`
+	Health       *HealthOutput   `json:"health,omitempty"`
+	Security     *SecurityOutput `json:"security,omitempty"`
+	// Usage is what a stopped container consumed.
+	Usage *Usage `json:"usage,omitempty"`
+	// Exits are the last exits seen by the monitor, the oldest first,
+	// and CrashLoop the crash loop the restart policy backs off.
+	Exits     []ExitRecord `json:"exits,omitempty"`
+	CrashLoop *CrashLoop   `json:"crashLoop,omitempty"`
+	MachineID string       `json:"machineID,omitempty"`
+}
+
+// HealthOutput is the health of a container with a health check.
+type HealthOutput struct {
+	Status        string `json:"status"`
+	FailingStreak int    `json:"failingStreak"`
+}
+
+// SecurityOutput is what a container sees of /proc and /sys.
+type SecurityOutput struct {
+	Class         string   `json:"class"`
+	MaskedPaths   []string `json:"maskedPaths"`
+	ReadonlyPaths []string `json:"readonlyPaths"`
+	WritablePaths []string `json:"writablePaths"`
+}
+
+// ContainerListOutput is the containers list prints.
+type ContainerListOutput struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Containers    []ContainerOutput `json:"containers"`
+}
+
+// StatsOutput is the resource usage stats prints.
+type StatsOutput struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	Id            string   `json:"id"`
+	CPUUsageUsec  uint64   `json:"cpuUsageUsec"`
+	MemoryCurrent uint64   `json:"memoryCurrent"`
+	SwapCurrent   uint64   `json:"swapCurrent"`
+	PidsCurrent   uint64   `json:"pidsCurrent"`
+	Pressure      Pressure `json:"pressure"`
+}
+
+// UsageHistoryOutput is the usage history stats --history prints.
+type UsageHistoryOutput struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Id            string        `json:"id"`
+	Samples       []UsageSample `json:"samples"`
+}
+
+// RecommendationOutput is the limits recommend suggests.
+type RecommendationOutput struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Recommendation
+}
+
+// EventOutput is an event as events prints it, one per line.
+type EventOutput struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Type          EventType         `json:"type"`
+	Id            string            `json:"id"`
+	Time          time.Time         `json:"time"`
+	Pid           int               `json:"pid,omitempty"`
+	Bundle        string            `json:"bundle,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+	// Health is the health status of an EventHealth.
+	Health string `json:"health,omitempty"`
+}
+
+// IntegrityOutput is what verify prints of the rootfs of a container.
+type IntegrityOutput struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Id            string            `json:"id"`
+	Tampered      bool              `json:"tampered"`
+	Base          []IntegrityChange `json:"base"`
+	Layer         []IntegrityChange `json:"layer"`
+}
+
+// CoresOutput is what cores prints of the core dumps of a container.
+type CoresOutput struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	Id            string     `json:"id"`
+	Dir           string     `json:"dir"`
+	Cores         []CoreDump `json:"cores"`
+}
+
+// NewContainerOutput returns the output of c.
+func NewContainerOutput(c *Container) ContainerOutput {
+	o := ContainerOutput{
+		SchemaVersion: OutputSchemaVersion,
+		Id:            c.Id,
+		Name:          c.Name,
+		Status:        c.StatusName(),
+		CreatedAt:     c.CreatedAt,
+		Bundle:        c.Bundle,
+		Rootfs:        c.Rootfs,
+		CgroupPath:    c.CgroupPath,
+		LogPath:       c.LogPath,
+		Annotations:   c.Annotations,
+		ReadyAt:       c.ReadyAt,
+		ExitCode:      c.ExitCode,
+		FinishedAt:    c.FinishedAt,
+		RestartCount:  c.RestartCount,
+		Exits:         c.Exits,
+		CrashLoop:     c.CrashLoop,
+		MachineID:     c.MachineID,
+		Usage:         c.Usage,
+	}
+	if c.Status != Stopped {
+		o.Pid, o.NsPid = c.InitProcessPiD, c.InitNsPid
+	}
+	if c.Image != nil {
+		o.Image = c.Image.Ref
+	}
+	if h := c.Health; h != nil {
+		o.Health = &HealthOutput{Status: h.Status, FailingStreak: h.FailingStreak}
+	}
+	if s := c.Security; s != nil {
+		o.Security = &SecurityOutput{
+			Class:         s.Class,
+			MaskedPaths:   nonNil(s.MaskedPaths),
+			ReadonlyPaths: nonNil(s.ReadonlyPaths),
+			WritablePaths: nonNil(s.WritablePaths),
+		}
+	}
+	return o
+}
+
+// NewContainerListOutput returns the output of containers.
+func NewContainerListOutput(containers []*Container) ContainerListOutput {
+	o := ContainerListOutput{SchemaVersion: OutputSchemaVersion, Containers: []ContainerOutput{}}
+	for _, c := range containers {
+		o.Containers = append(o.Containers, NewContainerOutput(c))
+	}
+	return o
+}
+
+// NewStatsOutput returns the output of s.
+func NewStatsOutput(s *Stats) StatsOutput {
+	return StatsOutput{
+		SchemaVersion: OutputSchemaVersion,
+		Id:            s.Id,
+		CPUUsageUsec:  s.CPUUsageUsec,
+		MemoryCurrent: s.MemoryCurrent,
+		SwapCurrent:   s.SwapCurrent,
+		PidsCurrent:   s.PidsCurrent,
+		Pressure:      s.Pressure,
+	}
+}
+
+// NewUsageHistoryOutput returns the output of the usage history samples
+// of container id.
+func NewUsageHistoryOutput(id string, samples []UsageSample) UsageHistoryOutput {
+	if samples == nil {
+		samples = []UsageSample{}
+	}
+	return UsageHistoryOutput{SchemaVersion: OutputSchemaVersion, Id: id, Samples: samples}
+}
+
+// NewRecommendationOutput returns the output of r.
+func NewRecommendationOutput(r *Recommendation) RecommendationOutput {
+	return RecommendationOutput{SchemaVersion: OutputSchemaVersion, Recommendation: *r}
+}
+
+// NewEventOutput returns the output of ev.
+func NewEventOutput(ev *Event) EventOutput {
+	return EventOutput{
+		SchemaVersion: OutputSchemaVersion,
+		Type:          ev.Type,
+		Id:            ev.Id,
+		Time:          ev.Time,
+		Pid:           ev.Pid,
+		Bundle:        ev.Bundle,
+		Annotations:   ev.Annotations,
+		Health:        ev.Health,
+	}
+}
+
+// NewIntegrityOutput returns the output of r.
+func NewIntegrityOutput(r *IntegrityReport) IntegrityOutput {
+	return IntegrityOutput{
+		SchemaVersion: OutputSchemaVersion,
+		Id:            r.Id,
+		Tampered:      r.Tampered(),
+		Base:          r.Base,
+		Layer:         r.Layer,
+	}
+}
+
+// NewCoresOutput returns the output of the core dumps cores of container
+// id.
+func NewCoresOutput(id string, cores []CoreDump) CoresOutput {
+	if cores == nil {
+		cores = []CoreDump{}
+	}
+	return CoresOutput{SchemaVersion: OutputSchemaVersion, Id: id, Dir: CoresDir(id), Cores: cores}
+}
+
+// nonNil returns s, or an empty slice for nil, so lists are printed as []
+// rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
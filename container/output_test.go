@@ -0,0 +1,137 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// The output of the commands is relied upon by tools: these tests pin its
+// fields, which may only change along with OutputSchemaVersion.
+
+func checkOutput(t *testing.T, v any, want string) {
+	t.Helper()
+	got, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != compact.String() {
+		t.Errorf("output\n%s\nwant\n%s", got, compact.String())
+	}
+}
+
+func TestContainerOutput(t *testing.T) {
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	finished := created.Add(time.Hour)
+	code := 137
+	c := &Container{
+		Id:             "web",
+		InitProcessPiD: 4242,
+		InitNsPid:      1,
+		CreatedAt:      created,
+		Status:         Stopped,
+		Bundle:         "/srv/web",
+		Rootfs:         "/srv/web/rootfs",
+		Image:          &ImageRootfs{Ref: "docker.io/library/nginx:1.27", ID: "sha256:abc", Driver: "overlay"},
+		CgroupPath:     "/sys/fs/cgroup/containish/web",
+		LogPath:        "/run/containish/web/container.log",
+		Annotations:    map[string]string{"team": "infra"},
+		ReadyAt:        &created,
+		ExitCode:       &code,
+		FinishedAt:     &finished,
+		RestartCount:   2,
+		Health:         &Health{Status: HealthUnhealthy, FailingStreak: 3, Log: []HealthResult{{ExitCode: 1}}},
+		Security:       &SecurityProfile{Class: ClassHardened, MaskedPaths: []string{"/proc/kcore"}, ReadonlyPaths: []string{"/proc/sys"}},
+		Usage:          &Usage{CPUUsageUsec: 3, CPUUserUsec: 2, CPUSystemUsec: 1, MemoryPeak: 4096, SwapPeak: 2048, IOReadBytes: 10, IOWriteBytes: 20},
+		Options:        &RunOptions{Detach: true},
+	}
+	checkOutput(t, NewContainerOutput(c), `{
+		"schemaVersion": 1,
+		"id": "web",
+		"status": "stopped",
+		"createdAt": "2026-03-01T12:00:00Z",
+		"bundle": "/srv/web",
+		"image": "docker.io/library/nginx:1.27",
+		"rootfs": "/srv/web/rootfs",
+		"cgroupPath": "/sys/fs/cgroup/containish/web",
+		"logPath": "/run/containish/web/container.log",
+		"annotations": {"team": "infra"},
+		"readyAt": "2026-03-01T12:00:00Z",
+		"exitCode": 137,
+		"finishedAt": "2026-03-01T13:00:00Z",
+		"restartCount": 2,
+		"health": {"status": "unhealthy", "failingStreak": 3},
+		"security": {"class": "hardened", "maskedPaths": ["/proc/kcore"], "readonlyPaths": ["/proc/sys"], "writablePaths": []},
+		"usage": {"cpuUsageUsec": 3, "cpuUserUsec": 2, "cpuSystemUsec": 1, "memoryPeak": 4096, "swapPeak": 2048, "ioReadBytes": 10, "ioWriteBytes": 20}
+	}`)
+
+	// A running container has a pid, and its status is a name rather than
+	// the number of the state.
+	checkOutput(t, NewContainerListOutput([]*Container{{Id: "db", Status: Running, InitProcessPiD: 99, InitNsPid: 1, CreatedAt: created}}), `{
+		"schemaVersion": 1,
+		"containers": [{
+			"schemaVersion": 1,
+			"id": "db",
+			"status": "running",
+			"createdAt": "2026-03-01T12:00:00Z",
+			"bundle": "",
+			"pid": 99,
+			"nsPid": 1,
+			"restartCount": 0
+		}]
+	}`)
+	checkOutput(t, NewContainerListOutput(nil), `{"schemaVersion": 1, "containers": []}`)
+}
+
+func TestStatsOutput(t *testing.T) {
+	s := &Stats{
+		Id:            "web",
+		CPUUsageUsec:  1500,
+		MemoryCurrent: 1 << 20,
+		SwapCurrent:   1 << 19,
+		PidsCurrent:   3,
+		Pressure: Pressure{CPU: &PSIStats{
+			Some: PSIData{Avg10: 1.5, Avg60: 0.5, Avg300: 0.25, Total: 100},
+			Full: PSIData{Total: 10},
+		}},
+	}
+	checkOutput(t, NewStatsOutput(s), `{
+		"schemaVersion": 1,
+		"id": "web",
+		"cpuUsageUsec": 1500,
+		"memoryCurrent": 1048576,
+		"swapCurrent": 524288,
+		"pidsCurrent": 3,
+		"pressure": {"cpu": {
+			"some": {"avg10": 1.5, "avg60": 0.5, "avg300": 0.25, "total": 100},
+			"full": {"avg10": 0, "avg60": 0, "avg300": 0, "total": 10}
+		}}
+	}`)
+}
+
+func TestEventOutput(t *testing.T) {
+	ev := &Event{
+		Type:        EventHealth,
+		Id:          "web",
+		Time:        time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC),
+		Pid:         4242,
+		Bundle:      "/srv/web",
+		Annotations: map[string]string{"team": "infra"},
+		Health:      HealthHealthy,
+	}
+	checkOutput(t, NewEventOutput(ev), `{
+		"schemaVersion": 1,
+		"type": "health_status",
+		"id": "web",
+		"time": "2026-03-01T12:00:00Z",
+		"pid": 4242,
+		"bundle": "/srv/web",
+		"annotations": {"team": "infra"},
+		"health": "healthy"
+	}`)
+}
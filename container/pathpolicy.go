@@ -0,0 +1,195 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// What a container sees of /proc and /sys is decided by the path policy of
+// its class: ClassDefault or ClassHardened, chosen with
+// RunOptions.SecurityClass, or ClassPrivileged, that of privileged
+// containers. The paths the spec lists in linux.maskedPaths and
+// linux.readonlyPaths, or defaultMaskedPaths and defaultReadonlyPaths when
+// it lists none, are the starting point: the policy passes some of them
+// through, then masks and makes read-only paths of its own. A path passed
+// through below a read-only one is bound writable again. The configuration
+// extends the built-in policy of each class, within a guardrail: outside
+// the privileged class it may only pass through the kernel tunables of
+// the namespaces of the container, and never the paths of guardedPaths.
+
+// Security classes of containers.
+const (
+	ClassDefault    = "default"
+	ClassHardened   = "hardened"
+	ClassPrivileged = "privileged"
+)
+
+// PathPolicy is what the containers of a class see of /proc and /sys.
+type PathPolicy struct {
+	// Masked are hidden, directories under an empty tmpfs and files
+	// under /dev/null.
+	Masked []string `toml:"masked" json:"masked,omitempty"`
+	// Readonly are bound read-only.
+	Readonly []string `toml:"readonly" json:"readonly,omitempty"`
+	// Passthrough are left as they are, with the paths below them, when
+	// the spec or the defaults mask them or make them read-only.
+	Passthrough []string `toml:"passthrough" json:"passthrough,omitempty"`
+}
+
+// builtinPathPolicies are the policies of the classes, which those of the
+// configuration extend.
+var builtinPathPolicies = map[string]PathPolicy{
+	ClassDefault: {},
+	// What gives away the layout and state of the kernel to exploits.
+	ClassHardened: {Masked: []string{
+		"/proc/kallsyms",
+		"/proc/modules",
+		"/proc/pagetypeinfo",
+		"/proc/slabinfo",
+		"/proc/vmallocinfo",
+		"/proc/zoneinfo",
+		"/sys/kernel",
+		"/sys/module",
+	}},
+	ClassPrivileged: {Passthrough: []string{"/proc", "/sys"}},
+}
+
+// pathPolicies are the policies of the configuration, by class.
+var pathPolicies map[string]PathPolicy
+
+// guardedPaths reach into the memory, firmware or keys of the host. Only
+// the privileged class may pass them through.
+var guardedPaths = []string{
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/sysrq-trigger",
+	"/sys/firmware",
+}
+
+// namespacedTunables are the parts of /proc/sys belonging to the network,
+// UTS and IPC namespaces of the container rather than to the host, the
+// only ones a class other than the privileged one may pass through.
+var namespacedTunables = []string{
+	"/proc/sys/fs/mqueue",
+	"/proc/sys/kernel/domainname",
+	"/proc/sys/kernel/hostname",
+	"/proc/sys/kernel/msgmax",
+	"/proc/sys/kernel/msgmnb",
+	"/proc/sys/kernel/msgmni",
+	"/proc/sys/kernel/sem",
+	"/proc/sys/kernel/shm_rmid_forced",
+	"/proc/sys/kernel/shmall",
+	"/proc/sys/kernel/shmmax",
+	"/proc/sys/kernel/shmmni",
+	"/proc/sys/net",
+}
+
+// SecurityProfile records what a container sees of /proc and /sys.
+type SecurityProfile struct {
+	Class         string   `json:"class"`
+	MaskedPaths   []string `json:"maskedPaths"`
+	ReadonlyPaths []string `json:"readonlyPaths"`
+	// WritablePaths are passed through below read-only paths.
+	WritablePaths []string `json:"writablePaths,omitempty"`
+}
+
+// isUnder reports whether path is dir or below it.
+func isUnder(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// securityClass returns the class of the container of options.
+func securityClass(options *RunOptions) (string, error) {
+	switch c := options.SecurityClass; {
+	case options.Privileged && c != "" && c != ClassPrivileged:
+		return "", fmt.Errorf("a privileged container is of the %s class, not %s", ClassPrivileged, c)
+	case options.Privileged:
+		return ClassPrivileged, nil
+	case c == "":
+		return ClassDefault, nil
+	case c == ClassDefault || c == ClassHardened:
+		return c, nil
+	case c == ClassPrivileged:
+		return "", fmt.Errorf("the %s class is that of privileged containers", c)
+	}
+	return "", fmt.Errorf("unknown security class %q, must be %s or %s", options.SecurityClass, ClassDefault, ClassHardened)
+}
+
+// classPathPolicy returns the built-in policy of class extended by that of
+// the configuration.
+func classPathPolicy(class string) PathPolicy {
+	p, cfg := builtinPathPolicies[class], pathPolicies[class]
+	return PathPolicy{
+		Masked:      append(slices.Clip(p.Masked), cfg.Masked...),
+		Readonly:    append(slices.Clip(p.Readonly), cfg.Readonly...),
+		Passthrough: append(slices.Clip(p.Passthrough), cfg.Passthrough...),
+	}
+}
+
+// applyPathPolicy applies the policy of class to the masked and read-only
+// paths of spec.
+func applyPathPolicy(spec *specs.Spec, class string) *SecurityProfile {
+	policy := classPathPolicy(class)
+	passed := func(path string) bool {
+		return slices.ContainsFunc(policy.Passthrough, func(p string) bool { return isUnder(path, p) })
+	}
+	add := func(paths []string, more ...string) []string {
+		for _, p := range more {
+			if !slices.Contains(paths, p) {
+				paths = append(paths, p)
+			}
+		}
+		return paths
+	}
+	profile := &SecurityProfile{
+		Class:         class,
+		MaskedPaths:   add(slices.DeleteFunc(slices.Clone(maskedPaths(spec)), passed), policy.Masked...),
+		ReadonlyPaths: add(slices.DeleteFunc(slices.Clone(readonlyPaths(spec)), passed), policy.Readonly...),
+	}
+	// Never nil, which would get the defaults.
+	profile.MaskedPaths = append([]string{}, profile.MaskedPaths...)
+	profile.ReadonlyPaths = append([]string{}, profile.ReadonlyPaths...)
+	for _, p := range policy.Passthrough {
+		if slices.ContainsFunc(profile.ReadonlyPaths, func(r string) bool { return p != r && isUnder(p, r) }) {
+			profile.WritablePaths = add(profile.WritablePaths, p)
+		}
+	}
+
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	spec.Linux.MaskedPaths, spec.Linux.ReadonlyPaths = profile.MaskedPaths, profile.ReadonlyPaths
+	return profile
+}
+
+// validatePathPolicy checks the policy of the configuration for class.
+func validatePathPolicy(class string, p PathPolicy) error {
+	if _, ok := builtinPathPolicies[class]; !ok {
+		return fmt.Errorf("unknown security class %q, must be %s, %s or %s", class, ClassDefault, ClassHardened, ClassPrivileged)
+	}
+	for _, paths := range [][]string{p.Masked, p.Readonly, p.Passthrough} {
+		for _, path := range paths {
+			if filepath.Clean(path) != path || !(isUnder(path, "/proc") || isUnder(path, "/sys")) {
+				return fmt.Errorf("path %q of the %s class must be a clean path below /proc or /sys", path, class)
+			}
+		}
+	}
+	if class == ClassPrivileged {
+		return nil
+	}
+	for _, path := range p.Passthrough {
+		for _, g := range guardedPaths {
+			if isUnder(g, path) {
+				return fmt.Errorf("the %s class can't pass %s through, which uncovers %s: only the %s class can", class, path, g, ClassPrivileged)
+			}
+		}
+		if isUnder("/proc/sys", path) || (isUnder(path, "/proc/sys") && !slices.ContainsFunc(namespacedTunables, func(t string) bool { return isUnder(path, t) })) {
+			return fmt.Errorf("the %s class can't pass %s through, which holds kernel tunables of the host: only the %s class can", class, path, ClassPrivileged)
+		}
+	}
+	return nil
+}
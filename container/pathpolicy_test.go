@@ -0,0 +1,93 @@
+package container
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestSecurityClass(t *testing.T) {
+	for _, tt := range []struct {
+		options RunOptions
+		want    string
+	}{
+		{RunOptions{}, ClassDefault},
+		{RunOptions{SecurityClass: ClassHardened}, ClassHardened},
+		{RunOptions{Privileged: true}, ClassPrivileged},
+		{RunOptions{Privileged: true, SecurityClass: ClassPrivileged}, ClassPrivileged},
+		{RunOptions{Privileged: true, SecurityClass: ClassHardened}, ""},
+		{RunOptions{SecurityClass: ClassPrivileged}, ""},
+		{RunOptions{SecurityClass: "relaxed"}, ""},
+	} {
+		class, err := securityClass(&tt.options)
+		if class != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("securityClass(%+v) = %q, %v, want %q", tt.options, class, err, tt.want)
+		}
+	}
+}
+
+func TestApplyPathPolicy(t *testing.T) {
+	defer func(orig map[string]PathPolicy) { pathPolicies = orig }(pathPolicies)
+	pathPolicies = nil
+
+	spec := &specs.Spec{}
+	p := applyPathPolicy(spec, ClassDefault)
+	if !slices.Equal(p.MaskedPaths, defaultMaskedPaths) || !slices.Equal(p.ReadonlyPaths, defaultReadonlyPaths) || p.WritablePaths != nil {
+		t.Errorf("default class = %+v, want the defaults", p)
+	}
+	if !slices.Equal(spec.Linux.MaskedPaths, p.MaskedPaths) || !slices.Equal(spec.Linux.ReadonlyPaths, p.ReadonlyPaths) {
+		t.Errorf("spec paths = %v %v, want those of the profile", spec.Linux.MaskedPaths, spec.Linux.ReadonlyPaths)
+	}
+
+	// The hardened class masks more, on top of the paths of the spec.
+	spec = &specs.Spec{Linux: &specs.Linux{MaskedPaths: []string{"/proc/kcore"}}}
+	p = applyPathPolicy(spec, ClassHardened)
+	if p.MaskedPaths[0] != "/proc/kcore" || !slices.Contains(p.MaskedPaths, "/proc/kallsyms") || slices.Contains(p.MaskedPaths, "/proc/acpi") {
+		t.Errorf("hardened masked paths = %v", p.MaskedPaths)
+	}
+
+	// The privileged class passes the paths of the spec through, but not
+	// those its configured policy masks.
+	pathPolicies = map[string]PathPolicy{ClassPrivileged: {Masked: []string{"/proc/kcore"}}}
+	spec = &specs.Spec{Linux: &specs.Linux{MaskedPaths: []string{"/proc/keys"}, ReadonlyPaths: []string{"/sys/fs"}}}
+	p = applyPathPolicy(spec, ClassPrivileged)
+	if !slices.Equal(p.MaskedPaths, []string{"/proc/kcore"}) || p.ReadonlyPaths == nil || len(p.ReadonlyPaths) > 0 {
+		t.Errorf("privileged class = %+v, want only the configured mask", p)
+	}
+
+	// A tunable of the network namespace passed through stays writable
+	// below the read-only /proc/sys.
+	pathPolicies = map[string]PathPolicy{ClassDefault: {Passthrough: []string{"/proc/sys/net"}, Readonly: []string{"/proc/cmdline"}}}
+	p = applyPathPolicy(&specs.Spec{}, ClassDefault)
+	if !slices.Contains(p.ReadonlyPaths, "/proc/sys") || !slices.Contains(p.ReadonlyPaths, "/proc/cmdline") || !slices.Equal(p.WritablePaths, []string{"/proc/sys/net"}) {
+		t.Errorf("read-only %v and writable %v paths", p.ReadonlyPaths, p.WritablePaths)
+	}
+}
+
+func TestValidatePathPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		class string
+		p     PathPolicy
+		ok    bool
+	}{
+		{ClassDefault, PathPolicy{Passthrough: []string{"/proc/sys/net"}}, true},
+		{ClassHardened, PathPolicy{Passthrough: []string{"/proc/sys/kernel/hostname"}, Masked: []string{"/sys/class"}}, true},
+		{ClassDefault, PathPolicy{Passthrough: []string{"/proc/acpi"}}, true},
+		{ClassPrivileged, PathPolicy{Masked: []string{"/proc/kcore"}}, true},
+		// Tunables of the host.
+		{ClassDefault, PathPolicy{Passthrough: []string{"/proc/sys"}}, false},
+		{ClassDefault, PathPolicy{Passthrough: []string{"/proc/sys/vm"}}, false},
+		// Guarded paths, or what holds them.
+		{ClassDefault, PathPolicy{Passthrough: []string{"/proc/kcore"}}, false},
+		{ClassHardened, PathPolicy{Passthrough: []string{"/sys"}}, false},
+		// Outside /proc and /sys, or not clean.
+		{ClassDefault, PathPolicy{Readonly: []string{"/etc"}}, false},
+		{ClassDefault, PathPolicy{Masked: []string{"/proc/../etc"}}, false},
+		{"relaxed", PathPolicy{}, false},
+	} {
+		if err := validatePathPolicy(tt.class, tt.p); (err == nil) != tt.ok {
+			t.Errorf("validatePathPolicy(%s, %+v) = %v, want ok %v", tt.class, tt.p, err, tt.ok)
+		}
+	}
+}
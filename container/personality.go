@@ -0,0 +1,82 @@
+package container
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// The child stage sets process.user.umask, 0022 when unset as with other
+// runtimes, and linux.personality just before executing the container
+// process, and gives it a session keyring of its own unless
+// RunOptions.NoNewKeyring is set.
+
+// defaultUmask is the umask of a container process whose spec sets none.
+const defaultUmask = 0o022
+
+// Execution domains of the personality syscall, see personality(2).
+const (
+	perLinux   = 0x0000
+	perLinux32 = 0x0008
+	// uname26 is the flag reporting a 2.6 kernel version.
+	uname26 = 0x0020000
+)
+
+// personalityDomains maps the domains of linux.personality to theirs.
+var personalityDomains = map[specs.LinuxPersonalityDomain]uintptr{
+	specs.PerLinux:   perLinux,
+	specs.PerLinux32: perLinux32,
+}
+
+// validateProcessAttrs checks the umask and personality of spec.
+func validateProcessAttrs(spec *specs.Spec) error {
+	if spec.Process != nil && spec.Process.User.Umask != nil && *spec.Process.User.Umask > 0o777 {
+		return fmt.Errorf("invalid process.user.umask %#o: expected at most 0777", *spec.Process.User.Umask)
+	}
+	if spec.Linux != nil && spec.Linux.Personality != nil {
+		if _, err := parsePersonality(spec.Linux.Personality); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePersonality returns the persona of p for the personality syscall.
+// No personality flag is defined by the spec, so none is accepted.
+func parsePersonality(p *specs.LinuxPersonality) (uintptr, error) {
+	persona, ok := personalityDomains[p.Domain]
+	if !ok {
+		return 0, fmt.Errorf("unsupported linux.personality domain %q: expected %s or %s", p.Domain, specs.PerLinux, specs.PerLinux32)
+	}
+	if p.Domain == specs.PerLinux32 && !linux32 {
+		return 0, fmt.Errorf("unsupported linux.personality domain %s: %s has no 32-bit execution domain", p.Domain, runtime.GOARCH)
+	}
+	if len(p.Flags) > 0 {
+		return 0, fmt.Errorf("unsupported linux.personality flags %q: none are defined", p.Flags)
+	}
+	return persona, nil
+}
+
+// setPersonality locks the calling thread, which executes the container
+// process, and sets its execution domain to that of p.
+func setPersonality(p *specs.LinuxPersonality) error {
+	persona, err := parsePersonality(p)
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	if _, _, errno := unix.RawSyscall(unix.SYS_PERSONALITY, persona, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to set the %s personality: %w", p.Domain, errno)
+	}
+	return nil
+}
+
+// processUmask returns the umask of the container process of p.
+func processUmask(p *specs.Process) int {
+	if p != nil && p.User.Umask != nil {
+		return int(*p.User.Umask)
+	}
+	return defaultUmask
+}
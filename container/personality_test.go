@@ -0,0 +1,43 @@
+package container
+
+import (
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestValidateProcessAttrs(t *testing.T) {
+	umask := func(m uint32) *specs.Spec {
+		return &specs.Spec{Process: &specs.Process{User: specs.User{Umask: &m}}}
+	}
+	personality := func(domain string, flags ...specs.LinuxPersonalityFlag) *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{Personality: &specs.LinuxPersonality{Domain: specs.LinuxPersonalityDomain(domain), Flags: flags}}}
+	}
+	for _, tt := range []struct {
+		name string
+		spec *specs.Spec
+		ok   bool
+	}{
+		{"none", &specs.Spec{}, true},
+		{"umask", umask(0o077), true},
+		{"umask too large", umask(0o1022), false},
+		{"linux32", personality("LINUX32"), linux32},
+		{"linux", personality("LINUX"), true},
+		{"unknown domain", personality("SVR4"), false},
+		{"flags", personality("LINUX", "ADDR_NO_RANDOMIZE"), false},
+	} {
+		if err := validateProcessAttrs(tt.spec); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	if m := processUmask(nil); m != 0o022 {
+		t.Errorf("processUmask(nil) = %#o, want 0022", m)
+	}
+	if m := processUmask(umask(0o077).Process); m != 0o077 {
+		t.Errorf("processUmask = %#o, want 0077", m)
+	}
+	if p, err := parsePersonality(&specs.LinuxPersonality{Domain: specs.PerLinux32}); linux32 && (err != nil || p != 0x0008) {
+		t.Errorf("parsePersonality(LINUX32) = %#x, %v, want 0x8", p, err)
+	}
+}
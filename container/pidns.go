@@ -0,0 +1,162 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A container gets a pid namespace of its own, where its init process is
+// pid 1 and the kernel kills whatever is left in it when init exits. It can
+// instead join the pid namespace of another container, given as
+// RunOptions.PidContainer, for containers that see each other's processes
+// as those of a pod do, or one at the path of the pid entry of the
+// linux.namespaces of its spec. Its init process is then an ordinary
+// process of that namespace: its /proc shows every process of it, signals
+// it has no handler for aren't ignored as they are for a pid 1, and the
+// processes it leaves behind when it exits are killed through its cgroup.
+// Those it orphans are reaped by the pid 1 of the namespace, and they all
+// die with it.
+
+// pidContainerPrefix starts a --pid value naming a container.
+const pidContainerPrefix = "container:"
+
+// ParsePidNamespace parses a --pid value, container:<id>, returning the
+// PidContainer of RunOptions.
+func ParsePidNamespace(value string) (string, error) {
+	id, ok := strings.CutPrefix(value, pidContainerPrefix)
+	if !ok {
+		return "", fmt.Errorf("invalid pid namespace %q: expected container:<id>", value)
+	}
+	if !objectNameRe.MatchString(id) {
+		return "", fmt.Errorf("invalid container id %q", id)
+	}
+	return id, nil
+}
+
+// specPidNamespace returns the path of the pid namespace the spec joins,
+// empty if it has none.
+func specPidNamespace(spec *specs.Spec) string {
+	if spec == nil || spec.Linux == nil {
+		return ""
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == specs.PIDNamespace {
+			return ns.Path
+		}
+	}
+	return ""
+}
+
+// pidNamespaceName describes the pid namespace the container of spec and
+// options joins, container:<id> or a path, empty if it gets its own.
+func pidNamespaceName(spec *specs.Spec, options *RunOptions) string {
+	if options.PidContainer != "" {
+		return pidContainerPrefix + options.PidContainer
+	}
+	return specPidNamespace(spec)
+}
+
+// validatePidNamespace checks the pid namespace the container of spec and
+// options joins, if any. A container with a user namespace of its own
+// couldn't mount the /proc of a pid namespace it doesn't own.
+func validatePidNamespace(spec *specs.Spec, options *RunOptions) error {
+	path := specPidNamespace(spec)
+	if path == "" && options.PidContainer == "" {
+		return nil
+	}
+	if path != "" && options.PidContainer != "" {
+		return fmt.Errorf("the spec joins pid namespace %s, so it can't share that of container %s", path, options.PidContainer)
+	}
+	if path != "" && !filepath.IsAbs(path) {
+		return fmt.Errorf("invalid pid namespace path %q: must be absolute", path)
+	}
+	if userNamespace(spec) {
+		return fmt.Errorf("a container with a user namespace can't join a pid namespace")
+	}
+	return nil
+}
+
+// openPidNamespace opens the pid namespace the container of spec and
+// options joins, or returns nil if it gets its own. The namespace of a
+// container is that of its init process, which must still be the one it
+// started.
+func openPidNamespace(spec *specs.Spec, options *RunOptions) (*os.File, error) {
+	path := specPidNamespace(spec)
+	var owner *Container
+	if options.PidContainer != "" {
+		var err error
+		if owner, err = LoadState(options.PidContainer); err != nil {
+			return nil, err
+		}
+		if owner.Status == Stopped {
+			return nil, fmt.Errorf("container %s is %w, so its pid namespace can't be joined", owner.Id, ErrNotRunning)
+		}
+		path = fmt.Sprintf("/proc/%d/ns/pid", owner.InitProcessPiD)
+	}
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pid namespace: %w", err)
+	}
+	if err := checkPidNamespace(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if owner != nil {
+		pidfd, err := openInit(owner)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		unix.Close(pidfd)
+	}
+	return f, nil
+}
+
+// startOnThread starts cmd from a thread of its own, which setup moves to
+// the namespaces of the children it forks, a pid namespace to join or a
+// new time namespace. The thread is kept until release is called, as the
+// parent death signal of cmd is sent when the thread that forked it exits.
+func startOnThread(cmd *exec.Cmd, setup func() error) (release func(), err error) {
+	started := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		// The thread keeps the namespaces for the children it forks, so
+		// it is left locked for Go to discard it when this returns.
+		runtime.LockOSThread()
+		if err := setup(); err != nil {
+			started <- err
+			return
+		}
+		err := cmd.Start()
+		started <- err
+		if err == nil {
+			<-done
+		}
+	}()
+	if err := <-started; err != nil {
+		return nil, err
+	}
+	return func() { close(done) }, nil
+}
+
+// checkPidNamespace checks that f is a pid namespace.
+func checkPidNamespace(f *os.File) error {
+	typ, err := unix.IoctlRetInt(int(f.Fd()), unix.NS_GET_NSTYPE)
+	if err != nil {
+		return fmt.Errorf("%s is not a namespace: %w", f.Name(), err)
+	}
+	if typ != unix.CLONE_NEWPID {
+		return fmt.Errorf("%s is not a pid namespace", f.Name())
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParsePidNamespace(t *testing.T) {
+	if id, err := ParsePidNamespace("container:web"); err != nil || id != "web" {
+		t.Fatalf("ParsePidNamespace = %q, %v, want web", id, err)
+	}
+	for _, value := range []string{"web", "host", "container:", "container:../x"} {
+		if _, err := ParsePidNamespace(value); err == nil {
+			t.Errorf("ParsePidNamespace(%q) succeeded, want an error", value)
+		}
+	}
+}
+
+func TestValidatePidNamespace(t *testing.T) {
+	spec := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.PIDNamespace}}}}
+	if err := validatePidNamespace(spec, &RunOptions{}); err != nil {
+		t.Fatalf("new pid namespace rejected: %v", err)
+	}
+	if name := pidNamespaceName(spec, &RunOptions{}); name != "" {
+		t.Errorf("pidNamespaceName = %q for a new pid namespace", name)
+	}
+	if err := validatePidNamespace(spec, &RunOptions{PidContainer: "web"}); err != nil {
+		t.Fatalf("joining a container rejected: %v", err)
+	}
+	if name := pidNamespaceName(spec, &RunOptions{PidContainer: "web"}); name != "container:web" {
+		t.Errorf("pidNamespaceName = %q, want container:web", name)
+	}
+
+	spec.Linux.Namespaces[0].Path = "/proc/1/ns/pid"
+	if err := validatePidNamespace(spec, &RunOptions{}); err != nil {
+		t.Fatalf("joining a path rejected: %v", err)
+	}
+	if err := validatePidNamespace(spec, &RunOptions{PidContainer: "web"}); err == nil {
+		t.Errorf("expected error joining both a path and a container")
+	}
+	spec.Linux.Namespaces[0].Path = "ns/pid"
+	if err := validatePidNamespace(spec, &RunOptions{}); err == nil {
+		t.Errorf("expected error for a relative path")
+	}
+
+	userns := usernsSpec()
+	if err := validatePidNamespace(userns, &RunOptions{PidContainer: "web"}); err == nil {
+		t.Errorf("expected error joining a pid namespace with a user namespace")
+	}
+}
+
+func TestChildCloneFlagsPidNamespace(t *testing.T) {
+	if flags := childCloneFlags(&stageOptions{}); flags&unix.CLONE_NEWPID == 0 {
+		t.Errorf("no CLONE_NEWPID for a pid namespace of its own")
+	}
+	if flags := childCloneFlags(&stageOptions{PidNamespace: "container:web"}); flags&unix.CLONE_NEWPID != 0 {
+		t.Errorf("CLONE_NEWPID when joining a pid namespace")
+	}
+}
+
+func TestCheckPidNamespace(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		ok   bool
+	}{
+		{"/proc/self/ns/pid", true},
+		{"/proc/self/ns/net", false},
+		{"/proc/self/status", false},
+	} {
+		f, err := os.Open(c.path)
+		if err != nil {
+			t.Skipf("no %s: %v", c.path, err)
+		}
+		err = checkPidNamespace(f)
+		f.Close()
+		if (err == nil) != c.ok {
+			t.Errorf("checkPidNamespace(%s) = %v, want ok %v", c.path, err, c.ok)
+		}
+	}
+}
+
+func TestOpenPidNamespace(t *testing.T) {
+	tempImages(t)
+	if f, err := openPidNamespace(&specs.Spec{}, &RunOptions{}); err != nil || f != nil {
+		t.Fatalf("openPidNamespace = %v, %v without a namespace to join", f, err)
+	}
+	if _, err := openPidNamespace(&specs.Spec{}, &RunOptions{PidContainer: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("openPidNamespace of a missing container = %v, want ErrNotFound", err)
+	}
+	if err := saveState(&Container{Id: "stopped", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openPidNamespace(&specs.Spec{}, &RunOptions{PidContainer: "stopped"}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("openPidNamespace of a stopped container = %v, want ErrNotRunning", err)
+	}
+
+	// This process stands in for the init of a running container.
+	start, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := &Container{Id: "owner", Status: Running, InitProcessPiD: os.Getpid(), InitStartTime: start}
+	if err := saveState(owner); err != nil {
+		t.Fatal(err)
+	}
+	f, err := openPidNamespace(&specs.Spec{}, &RunOptions{PidContainer: "owner"})
+	if err != nil {
+		t.Fatalf("openPidNamespace: %v", err)
+	}
+	f.Close()
+
+	owner.InitStartTime++
+	if err := saveState(owner); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openPidNamespace(&specs.Spec{}, &RunOptions{PidContainer: "owner"}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("openPidNamespace with a reused pid = %v, want ErrNotRunning", err)
+	}
+
+	spec := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.PIDNamespace, Path: "/proc/self/ns/net"}}}}
+	if _, err := openPidNamespace(spec, &RunOptions{}); err == nil || !strings.Contains(err.Error(), "not a pid namespace") {
+		t.Errorf("openPidNamespace of a net namespace = %v, want an error", err)
+	}
+}
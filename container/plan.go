@@ -0,0 +1,654 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Plan describes what starting a container would do on this host. It is
+// computed from the spec and options the same way a start is, but nothing
+// is created.
+type Plan struct {
+	ID       string `json:"id"`
+	Spec     string `json:"spec"`
+	StateDir string `json:"stateDir"`
+	// Rootfs is the container root on the host. PopulateRootfs is set when
+	// it is empty and gets populated from the local Alpine image.
+	Rootfs         string `json:"rootfs"`
+	PopulateRootfs bool   `json:"populateRootfs,omitempty"`
+	// Image is the image the rootfs is prepared from, as its reference
+	// and digest, by StorageDriver. SpecFromImage is set when the bundle
+	// has no spec and the process comes from the image config.
+	Image         string `json:"image,omitempty"`
+	StorageDriver string `json:"storageDriver,omitempty"`
+	SpecFromImage bool   `json:"specFromImage,omitempty"`
+	// ExposedPorts are those of the image config, which aren't published.
+	ExposedPorts []string `json:"exposedPorts,omitempty"`
+	Detach       bool     `json:"detach"`
+	// Emulation is how a rootfs for another architecture is run. It is
+	// left out while the rootfs is yet to be populated.
+	Emulation *Emulation `json:"emulation,omitempty"`
+	// StorageSize is the storage quota of the rootfs, in bytes.
+	StorageSize int64 `json:"storageSize,omitempty"`
+	// Restart is the restart policy, as a --restart value.
+	Restart string `json:"restart,omitempty"`
+	// AuxProcesses are the auxiliary processes of the bundle.
+	AuxProcesses []AuxProcess `json:"auxProcesses,omitempty"`
+	// HealthCheck is the health check, with its defaults filled in.
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// LogPath is the log file of a detached container.
+	LogPath string `json:"logPath,omitempty"`
+	// TracePath is the system call trace, when tracing.
+	TracePath string `json:"tracePath,omitempty"`
+
+	// CloneFlags are the namespaces created for the container.
+	CloneFlags  []string               `json:"cloneFlags"`
+	UIDMappings []specs.LinuxIDMapping `json:"uidMappings,omitempty"`
+	GIDMappings []specs.LinuxIDMapping `json:"gidMappings,omitempty"`
+	// PidNamespace is the pid namespace the container joins instead of
+	// creating one, container:<id> or a path.
+	PidNamespace string `json:"pidNamespace,omitempty"`
+
+	Cgroup PlanCgroup `json:"cgroup"`
+	// IntelRdtClosID is the resctrl group the container joins, if any.
+	IntelRdtClosID string `json:"intelRdtClosID,omitempty"`
+
+	Network *NetworkConfig `json:"network"`
+	Egress  *EgressPolicy  `json:"egress,omitempty"`
+
+	// RootPropagation is applied to / in the container mount namespace.
+	RootPropagation string `json:"rootPropagation"`
+	// Devices are created in /dev, or bind mounted from the host when the
+	// container has a user namespace.
+	Devices     []specs.LinuxDevice `json:"devices,omitempty"`
+	BindDevices bool                `json:"bindDevices,omitempty"`
+	// Mounts are made in order; those with AfterPivot once the container
+	// root is in place. PivotRoot is empty with the host rootfs, which
+	// stays in place.
+	Mounts    []PlanMount `json:"mounts"`
+	PivotRoot string      `json:"pivotRoot"`
+	// ReadonlyPaths are then made read-only, WritablePaths below them
+	// writable again and MaskedPaths hidden, as the policy of
+	// SecurityClass decides.
+	SecurityClass string   `json:"securityClass"`
+	ReadonlyPaths []string `json:"readonlyPaths,omitempty"`
+	WritablePaths []string `json:"writablePaths,omitempty"`
+	MaskedPaths   []string `json:"maskedPaths,omitempty"`
+
+	// Isolation is the sandbox of the container process, empty for the
+	// process sandbox. A VM has no PivotRoot, as the rootfs is shared
+	// with the guest where it is.
+	Isolation string `json:"isolation,omitempty"`
+	// Args and Env are what the container init process is executed with,
+	// as User in Cwd, or its WebAssembly module run with when Wasm is set.
+	Wasm     bool       `json:"wasm,omitempty"`
+	Args     []string   `json:"args"`
+	Env      []string   `json:"env"`
+	Cwd      string     `json:"cwd"`
+	User     specs.User `json:"user"`
+	Hostname string     `json:"hostname,omitempty"`
+	// Umask and Personality are set before executing the process, in a
+	// session keyring of its own if NewKeyring is set.
+	Umask       uint32 `json:"umask"`
+	Personality string `json:"personality,omitempty"`
+	NewKeyring  bool   `json:"newKeyring"`
+}
+
+// PlanCgroup describes the cgroup of a planned container.
+type PlanCgroup struct {
+	// Manager is CgroupfsManager or SystemdManager, or empty when the host
+	// has no cgroup v2 hierarchy and the container gets no cgroup.
+	Manager string `json:"manager,omitempty"`
+	Path    string `json:"path,omitempty"`
+	// Unit and Slice name the transient scope with the systemd manager,
+	// which also applies the spec resources.
+	Unit  string `json:"unit,omitempty"`
+	Slice string `json:"slice,omitempty"`
+	// DeviceRules are the default rules followed by those of the spec, in
+	// the order they are evaluated.
+	DeviceRules []specs.LinuxDeviceCgroup `json:"deviceRules"`
+	Settings    []CgroupSetting           `json:"settings,omitempty"`
+}
+
+// PlanMount is a mount made in the container mount namespace. Destination
+// is a path in the container.
+type PlanMount struct {
+	Destination string   `json:"destination"`
+	Type        string   `json:"type"`
+	Source      string   `json:"source"`
+	Options     []string `json:"options,omitempty"`
+	// Idmapped mounts are shifted to the container user namespace.
+	Idmapped   bool `json:"idmapped,omitempty"`
+	AfterPivot bool `json:"afterPivot,omitempty"`
+}
+
+// cloneFlagNames are the namespace flags in the order they are printed.
+var cloneFlagNames = []struct {
+	flag uintptr
+	name string
+}{
+	{unix.CLONE_NEWUSER, "CLONE_NEWUSER"},
+	{unix.CLONE_NEWNS, "CLONE_NEWNS"},
+	{unix.CLONE_NEWPID, "CLONE_NEWPID"},
+	{unix.CLONE_NEWNET, "CLONE_NEWNET"},
+	{unix.CLONE_NEWUTS, "CLONE_NEWUTS"},
+	{unix.CLONE_NEWIPC, "CLONE_NEWIPC"},
+	{unix.CLONE_NEWCGROUP, "CLONE_NEWCGROUP"},
+}
+
+// planContainer validates the spec at specPath and the options and returns
+// what runContainer would do with them.
+func planContainer(containerId, specPath string, options RunOptions) (*Plan, error) {
+	// A dry run doesn't pull.
+	var img *Image
+	if options.Image != "" {
+		var err error
+		if img, err = LoadImage(options.Image); errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("%w: pull it first with containish image pull", err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	spec, err := loadRunSpec(specPath, img, &options)
+	if err != nil {
+		return nil, err
+	}
+	aux, err := loadAuxProcesses(options.bundleDir(specPath))
+	if err != nil {
+		return nil, err
+	}
+	stateDir := StateDir(containerId)
+	p := &Plan{
+		ID:       containerId,
+		Spec:     specPath,
+		StateDir: stateDir,
+		Rootfs:   spec.Root.Path,
+		Detach:   options.Detach,
+		Network:  options.Network,
+		Egress:   options.Egress,
+
+		StorageSize: options.StorageSize,
+	}
+	if options.Restart.restarts() {
+		p.Restart = options.Restart.String()
+	}
+	p.AuxProcesses = aux
+	if options.HealthCheck != nil {
+		check := options.HealthCheck.withDefaults()
+		p.HealthCheck = &check
+	}
+	if img != nil {
+		p.Image = img.Ref + "@" + img.Digest
+		p.StorageDriver, _ = newStorageDriver()
+		if _, err := os.Stat(specPath); errors.Is(err, os.ErrNotExist) {
+			p.SpecFromImage = true
+		}
+		p.Rootfs = imageContainerRootfs(containerId)
+		for port := range img.Config.ExposedPorts {
+			p.ExposedPorts = append(p.ExposedPorts, port)
+		}
+		sort.Strings(p.ExposedPorts)
+		spec.Mounts = append(spec.Mounts, imageVolumes(containerId, img, spec, options.Volumes)...)
+		// Without its rootfs, the user is resolved in the unpacked image
+		// if it is, else shown by name.
+		if _, err := os.Stat(imageRootfsDir(img.ID)); err == nil {
+			if err := resolveImageUser(spec, imageRootfsDir(img.ID)); err != nil {
+				return nil, err
+			}
+		}
+	} else if options.Rootfs == RootfsHost {
+		p.Rootfs = "/"
+	} else if options.Rootfs != "" {
+		p.Rootfs = options.Rootfs
+	} else if p.Rootfs == "" {
+		p.Rootfs = "/alpine"
+	}
+	hostRootfs := options.Rootfs == RootfsHost
+	p.PopulateRootfs = img == nil && !hostRootfs && rootfsEmpty(p.Rootfs)
+	if img == nil && !hostRootfs && !p.PopulateRootfs {
+		if p.Rootfs, err = resolveRootfs(p.Rootfs, spec); err != nil {
+			return nil, err
+		}
+		if options.Runtime != RuntimeWasm {
+			if p.Emulation, err = checkPlatform(p.Rootfs, spec, options.Platform, options.CopyEmulator); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if options.Detach && options.Log.Driver != LogDriverNone {
+		p.LogPath = filepath.Join(stateDir, logFileName)
+	}
+	if options.Trace != "" {
+		p.TracePath = filepath.Join(stateDir, traceFileName)
+	}
+
+	var notifySocket string
+	if spec.Annotations[AnnotationSdNotify] == "true" && os.Getenv("NOTIFY_SOCKET") != "" && !options.Detach || options.Notify {
+		notifySocket = filepath.Join(stateDir, "notify.sock")
+	}
+	var metadataSocket string
+	if options.Metadata {
+		metadataSocket = filepath.Join(stateDir, metadataSocketName)
+	}
+	stage := stageOptions{
+		Spec:           spec,
+		NotifySocket:   notifySocket,
+		MetadataSocket: metadataSocket,
+		HostNetwork:    options.Network.Driver == HostNetwork,
+		PidNamespace:   pidNamespaceName(spec, &options),
+	}
+	p.PidNamespace = stage.PidNamespace
+	flags := childCloneFlags(&stage)
+	for _, f := range cloneFlagNames {
+		if flags&f.flag != 0 {
+			p.CloneFlags = append(p.CloneFlags, f.name)
+		}
+	}
+	// The time namespace is unshared before the clone rather than by it.
+	if timeNamespace(spec) {
+		p.CloneFlags = append(p.CloneFlags, "CLONE_NEWTIME")
+	}
+	userns := userNamespace(spec)
+	if userns {
+		p.UIDMappings = spec.Linux.UIDMappings
+		p.GIDMappings = spec.Linux.GIDMappings
+	}
+
+	if err := planCgroup(p, containerId, spec, options.CgroupManager); err != nil {
+		return nil, err
+	}
+	if spec.Linux != nil && spec.Linux.IntelRdt != nil {
+		p.IntelRdtClosID = spec.Linux.IntelRdt.ClosID
+		if p.IntelRdtClosID == "" {
+			p.IntelRdtClosID = "containish-" + containerId
+		}
+	}
+
+	p.RootPropagation = "rprivate"
+	if spec.Linux != nil && spec.Linux.RootfsPropagation != "" {
+		p.RootPropagation = spec.Linux.RootfsPropagation
+	}
+	if spec.Linux != nil {
+		p.Devices = spec.Linux.Devices
+		p.BindDevices = userns
+	}
+	p.Mounts = planMounts(p.Rootfs, spec, options.Volumes, notifySocket, metadataSocket, userns, stage.HostNetwork, options.Privileged, p.Cgroup.Manager != "")
+	p.SecurityClass = options.security.Class
+	p.ReadonlyPaths, p.WritablePaths, p.MaskedPaths = readonlyPaths(spec), options.security.WritablePaths, maskedPaths(spec)
+	p.PivotRoot = p.Rootfs
+	if hostRootfs {
+		p.Devices, p.Mounts, p.PivotRoot = nil, hostRootfsMounts(p.Mounts), ""
+	}
+	p.Isolation = options.Isolation
+	if p.Isolation == IsolationVM {
+		p.PivotRoot = ""
+	}
+
+	p.Args, p.Env = initProcess(spec, notifySocket != "")
+	p.Wasm = options.Runtime == RuntimeWasm
+	secretFiles := false
+	for _, s := range options.Secrets {
+		secretFiles = secretFiles || s.Target != ""
+		if s.Env != "" {
+			p.Env = append(p.Env, fmt.Sprintf("%s=<secret from %s>", s.Env, s.Source))
+		}
+	}
+	if secretFiles {
+		p.Mounts = append(p.Mounts, PlanMount{Destination: secretsDir, Type: "tmpfs", Source: "secrets", Options: []string{"nosuid", "nodev", "noexec", "mode=0500", "ro"}, AfterPivot: true})
+	}
+	p.Cwd, p.Hostname = "/", spec.Hostname
+	if spec.Process != nil {
+		p.User = spec.Process.User
+		if spec.Process.Cwd != "" {
+			p.Cwd = spec.Process.Cwd
+		}
+	}
+	p.Umask = uint32(processUmask(spec.Process))
+	if spec.Linux != nil && spec.Linux.Personality != nil {
+		p.Personality = string(spec.Linux.Personality.Domain)
+	}
+	p.NewKeyring = !options.NoNewKeyring
+	return p, nil
+}
+
+func planCgroup(p *Plan, containerId string, spec *specs.Spec, manager string) error {
+	var resources *specs.LinuxResources
+	var cgroupsPath string
+	if spec.Linux != nil {
+		resources = spec.Linux.Resources
+		cgroupsPath = spec.Linux.CgroupsPath
+	}
+	var devices []specs.LinuxDeviceCgroup
+	if resources != nil {
+		devices = resources.Devices
+	}
+	rules := append(append([]specs.LinuxDeviceCgroup{}, defaultDeviceRules...), devices...)
+	// Fail on the rules a start would reject.
+	if _, err := compileDeviceFilter(rules); err != nil {
+		return err
+	}
+
+	switch {
+	case manager == SystemdManager:
+		unit, err := parseSystemdCgroupsPath(containerId, cgroupsPath)
+		if err != nil {
+			return err
+		}
+		path, err := unit.cgroupPath()
+		if err != nil {
+			return err
+		}
+		p.Cgroup = PlanCgroup{Manager: SystemdManager, Path: path, Unit: unit.Name, Slice: unit.Slice, DeviceRules: rules}
+		if resources != nil {
+			if p.Cgroup.Settings, err = unifiedSettings(resources.Unified); err != nil {
+				return err
+			}
+		}
+	case cgroupsAvailable():
+		p.Cgroup = PlanCgroup{Manager: CgroupfsManager, Path: CgroupPath(containerId), DeviceRules: rules}
+		if resources != nil {
+			settings, err := blockIOSettings(resources.BlockIO)
+			if err != nil {
+				return err
+			}
+			unified, err := unifiedSettings(resources.Unified)
+			if err != nil {
+				return err
+			}
+			p.Cgroup.Settings = append(settings, unified...)
+		}
+	case resources != nil:
+		return fmt.Errorf("linux.resources requires a cgroup v2 hierarchy at %s", cgroupRoot)
+	}
+	return nil
+}
+
+// planMounts lists the mounts in the order handleChildStage makes them.
+func planMounts(rootfs string, spec *specs.Spec, volumes []VolumeMount, notifySocket, metadataSocket string, userns, hostNetwork, privileged, cgroup bool) []PlanMount {
+	mounts := []PlanMount{{Destination: "/", Type: "bind", Source: rootfs, Options: []string{"rbind"}, Idmapped: userns}}
+
+	var tmpfsMounts, bindMounts []specs.Mount
+	for _, m := range spec.Mounts {
+		if isBindMount(m) {
+			bindMounts = append(bindMounts, m)
+			continue
+		}
+		if m.Type != "tmpfs" {
+			continue
+		}
+		if filepath.Clean(m.Destination) == "/dev" {
+			mounts = append(mounts, PlanMount{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: m.Options})
+			continue
+		}
+		tmpfsMounts = append(tmpfsMounts, m)
+	}
+	for _, m := range bindMounts {
+		mounts = append(mounts, PlanMount{Destination: m.Destination, Type: "bind", Source: m.Source, Options: m.Options, Idmapped: userns})
+	}
+	for _, v := range volumes {
+		source := filepath.Join(volumeDir(v.Name), "_data")
+		if vol, err := LoadVolume(v.Name); err == nil {
+			source = vol.Mountpoint
+		}
+		var opts []string
+		if v.ReadOnly {
+			opts = []string{"ro"}
+		}
+		mounts = append(mounts, PlanMount{Destination: v.Target, Type: "volume", Source: source, Options: opts, Idmapped: userns})
+	}
+	if notifySocket != "" {
+		mounts = append(mounts, PlanMount{Destination: containerNotifySocket, Type: "bind", Source: notifySocket})
+	}
+	if metadataSocket != "" {
+		mounts = append(mounts, PlanMount{Destination: containerMetadataSocket, Type: "bind", Source: metadataSocket})
+	}
+	procOpts := []string{"nosuid", "nodev", "noexec"}
+	if data, _ := procMountData(spec.Mounts); data != "" {
+		procOpts = append(procOpts, data)
+	}
+	mounts = append(mounts, PlanMount{Destination: "/proc", Type: "proc", Source: "proc", Options: procOpts})
+	if !hasMountAt(spec, "/sys") {
+		writable := sysWritable(userns, hostNetwork, privileged)
+		sysOpts := []string{"nosuid", "nodev", "noexec", "ro"}
+		if writable {
+			sysOpts[3] = "rw"
+		}
+		if userns && hostNetwork {
+			// Falling back to the host's, see mountSys.
+			mounts = append(mounts, PlanMount{Destination: "/sys", Type: "bind", Source: "/sys", Options: []string{"rbind", "ro"}})
+		} else {
+			mounts = append(mounts, PlanMount{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: sysOpts})
+		}
+		if cgroup && !hasMountAt(spec, "/sys/fs/cgroup") {
+			mounts = append(mounts, PlanMount{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup", Options: sysOpts})
+		}
+	}
+	for _, m := range tmpfsMounts {
+		mounts = append(mounts, PlanMount{Destination: m.Destination, Type: "tmpfs", Source: "tmpfs", Options: m.Options, AfterPivot: true})
+	}
+	return mounts
+}
+
+// Write prints the plan for people.
+func (p *Plan) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	line := func(key, format string, args ...any) {
+		fmt.Fprintf(tw, "%s:\t%s\n", key, fmt.Sprintf(format, args...))
+	}
+
+	line("Container", "%s", p.ID)
+	if p.SpecFromImage {
+		line("Spec", "generated from the image config (no %s)", p.Spec)
+	} else {
+		line("Spec", "%s", p.Spec)
+	}
+	line("State dir", "%s", p.StateDir)
+	if p.Image != "" {
+		line("Image", "%s", p.Image)
+		line("Rootfs", "%s (%s storage driver)", p.Rootfs, p.StorageDriver)
+		if len(p.ExposedPorts) > 0 {
+			line("Exposed ports", "%s (not published)", strings.Join(p.ExposedPorts, ", "))
+		}
+	} else if p.PopulateRootfs {
+		line("Rootfs", "%s (populated from the Alpine image)", p.Rootfs)
+	} else if p.PivotRoot == "" && p.Isolation != IsolationVM {
+		line("Rootfs", "%s (the host's, without pivot_root)", p.Rootfs)
+	} else {
+		line("Rootfs", "%s", p.Rootfs)
+	}
+	if e := p.Emulation; e != nil {
+		if e.Copy {
+			line("Platform", "linux/%s, emulated by %s (copied into the rootfs)", e.Arch, e.Interpreter)
+		} else {
+			line("Platform", "linux/%s, emulated by %s", e.Arch, e.Interpreter)
+		}
+	}
+	switch p.Isolation {
+	case IsolationUserns:
+		line("Isolation", "%s, in a user namespace of its own", p.Isolation)
+	case IsolationVM:
+		line("Isolation", "%s, in a microVM booting %s, with the rootfs shared over 9p", p.Isolation, vmKernel)
+	}
+	if p.StorageSize > 0 {
+		line("Storage quota", "%d bytes (project quota)", p.StorageSize)
+	}
+	if p.Detach && p.LogPath == "" {
+		line("Mode", "detached, output discarded")
+	} else if p.Detach {
+		line("Mode", "detached, output to %s", p.LogPath)
+	} else {
+		line("Mode", "foreground")
+	}
+	if p.Restart != "" {
+		line("Restart", "%s", p.Restart)
+	}
+	for _, a := range p.AuxProcesses {
+		line("Aux process", "%s: %q", a.Name, a.Args)
+	}
+	if h := p.HealthCheck; h != nil {
+		action := h.Action
+		if h.Action == HealthActionSignal {
+			action += ":" + h.Signal
+		}
+		line("Health check", "%q every %v, timeout %v, unhealthy after %d failures, then %s", h.Cmd, h.Interval, h.Timeout, h.Retries, action)
+	}
+	if p.TracePath != "" {
+		line("Trace", "%s", p.TracePath)
+	}
+	line("Clone flags", "%s", strings.Join(p.CloneFlags, " | "))
+	if p.PidNamespace != "" {
+		line("PID namespace", "joins %s", p.PidNamespace)
+	}
+	for _, m := range p.UIDMappings {
+		line("UID map", "container %d -> host %d, size %d", m.ContainerID, m.HostID, m.Size)
+	}
+	for _, m := range p.GIDMappings {
+		line("GID map", "container %d -> host %d, size %d", m.ContainerID, m.HostID, m.Size)
+	}
+
+	switch p.Cgroup.Manager {
+	case "":
+		line("Cgroup", "none (no cgroup v2 hierarchy)")
+	case SystemdManager:
+		line("Cgroup", "systemd scope %s in %s (%s)", p.Cgroup.Unit, p.Cgroup.Slice, p.Cgroup.Path)
+	default:
+		line("Cgroup", "%s", p.Cgroup.Path)
+	}
+	if p.Cgroup.Manager != "" {
+		rules := make([]string, len(p.Cgroup.DeviceRules))
+		for i, r := range p.Cgroup.DeviceRules {
+			rules[i] = formatDeviceRule(r)
+		}
+		line("Device rules", "%s", strings.Join(rules, ", "))
+		for _, st := range p.Cgroup.Settings {
+			line("Cgroup file", "%s = %q", st.File, st.Value)
+		}
+	}
+	if p.IntelRdtClosID != "" {
+		line("Intel RDT", "%s", p.IntelRdtClosID)
+	}
+
+	network := p.Network.Driver
+	if p.Network.Name != "" {
+		network += " " + p.Network.Name
+	}
+	if p.Network.Address != "" {
+		network += " " + p.Network.Address
+	}
+	line("Network", "%s", network)
+	if p.Egress != nil && p.Egress.Deny {
+		allow := make([]string, len(p.Egress.Allow))
+		for i, r := range p.Egress.Allow {
+			allow[i] = r.CIDR
+			if r.Port != 0 {
+				allow[i] += ":" + strconv.Itoa(int(r.Port))
+			}
+			if r.Proto != "" {
+				allow[i] += "/" + r.Proto
+			}
+		}
+		line("Egress", "deny, allow [%s]", strings.Join(allow, " "))
+	}
+	line("Root propagation", "%s", p.RootPropagation)
+	for _, d := range p.Devices {
+		how := "mknod"
+		if p.BindDevices {
+			how = "bind from host"
+		}
+		line("Device", "%s %s %d:%d (%s)", d.Path, d.Type, d.Major, d.Minor, how)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nMounts:")
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  DESTINATION\tTYPE\tSOURCE\tOPTIONS")
+	pivoted := false
+	for _, m := range p.Mounts {
+		if m.AfterPivot && !pivoted && p.PivotRoot != "" {
+			fmt.Fprintf(tw, "  pivot_root(%s)\t\t\t\n", p.PivotRoot)
+			pivoted = true
+		}
+		opts := strings.Join(m.Options, ",")
+		if m.Idmapped {
+			opts = strings.TrimPrefix(opts+",idmapped", ",")
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", m.Destination, m.Type, m.Source, opts)
+	}
+	if !pivoted && p.PivotRoot != "" {
+		fmt.Fprintf(tw, "  pivot_root(%s)\t\t\t\n", p.PivotRoot)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Class:     %s\n", p.SecurityClass)
+	if len(p.ReadonlyPaths) > 0 {
+		fmt.Fprintf(w, "Read-only: %s\n", strings.Join(p.ReadonlyPaths, " "))
+	}
+	if len(p.WritablePaths) > 0 {
+		fmt.Fprintf(w, "Writable:  %s\n", strings.Join(p.WritablePaths, " "))
+	}
+	if len(p.MaskedPaths) > 0 {
+		fmt.Fprintf(w, "Masked:    %s\n", strings.Join(p.MaskedPaths, " "))
+	}
+
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if p.Hostname != "" {
+		line("Hostname", "%s", p.Hostname)
+	}
+	if p.Wasm {
+		line("Exec", "%s (WebAssembly, run by the embedded engine)", strings.Join(p.Args, " "))
+	} else if p.Isolation == IsolationVM {
+		line("Exec", "%s (in the microVM)", strings.Join(p.Args, " "))
+	} else {
+		line("Exec", "%s", strings.Join(p.Args, " "))
+	}
+	line("Env", "%s", strings.Join(p.Env, " "))
+	line("Cwd", "%s", p.Cwd)
+	if p.User.Username != "" {
+		line("User", "%s, resolved in the rootfs", p.User.Username)
+	} else {
+		line("User", "uid %d, gid %d, groups %v", p.User.UID, p.User.GID, p.User.AdditionalGids)
+	}
+	line("Umask", "%04o", p.Umask)
+	if p.Personality != "" {
+		line("Personality", "%s", p.Personality)
+	}
+	if p.NewKeyring {
+		line("Keyring", "session keyring %s%s", sessionKeyringPrefix, p.ID)
+	} else {
+		line("Keyring", "session keyring of the runtime")
+	}
+	return tw.Flush()
+}
+
+// formatDeviceRule prints a device cgroup rule like "allow c 1:3 rwm".
+func formatDeviceRule(r specs.LinuxDeviceCgroup) string {
+	verb := "deny"
+	if r.Allow {
+		verb = "allow"
+	}
+	typ := r.Type
+	if typ == "" {
+		typ = "a"
+	}
+	num := func(n *int64) string {
+		if n == nil || *n == wildcardDevice {
+			return "*"
+		}
+		return strconv.FormatInt(*n, 10)
+	}
+	return fmt.Sprintf("%s %s %s:%s %s", verb, typ, num(r.Major), num(r.Minor), r.Access)
+}
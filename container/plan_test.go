@@ -0,0 +1,148 @@
+package container
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRuntimePlan(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	origRoot := cgroupRoot
+	cgroupRoot = t.TempDir()
+	defer func() { cgroupRoot = origRoot }()
+
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "config.json")
+	spec := `{"ociVersion": "1.0.2", "root": {"path": "rootfs"},
+		"mounts": [{"destination": "/data", "type": "bind", "source": "data", "options": ["rbind", "ro"]}]}`
+	if err := os.WriteFile(specPath, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := rt.Plan("web", specPath, Detached(), WithTmpfs(mustParseTmpfs(t, "/tmp")), WithNetwork(&NetworkConfig{Driver: HostNetwork}))
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if slices.Contains(p.CloneFlags, "CLONE_NEWNET") || !slices.Contains(p.CloneFlags, "CLONE_NEWPID") {
+		t.Errorf("unexpected clone flags %v", p.CloneFlags)
+	}
+	if p.Cgroup.Manager != "" {
+		t.Errorf("expected no cgroup without a v2 hierarchy, got %+v", p.Cgroup)
+	}
+	var dests []string
+	for _, m := range p.Mounts {
+		dests = append(dests, m.Destination)
+	}
+	if got := strings.Join(dests, " "); got != "/ /data /proc /sys /tmp" {
+		t.Errorf("mounts in order %q", got)
+	}
+	if m := p.Mounts[1]; m.Source != filepath.Join(dir, "data") {
+		t.Errorf("relative bind source resolved to %s", m.Source)
+	}
+	if m := p.Mounts[3]; m.Type != "sysfs" || !slices.Contains(m.Options, "ro") {
+		t.Errorf("expected a read-only sysfs without a user namespace, got %+v", m)
+	}
+	if !slices.Equal(p.MaskedPaths, defaultMaskedPaths) || !slices.Equal(p.ReadonlyPaths, defaultReadonlyPaths) {
+		t.Errorf("expected the default masked and read-only paths, got %v and %v", p.MaskedPaths, p.ReadonlyPaths)
+	}
+	if !p.Mounts[4].AfterPivot || p.Mounts[3].AfterPivot {
+		t.Error("only the tmpfs should be mounted after pivot_root")
+	}
+	if p.LogPath != filepath.Join(StateDir("web"), logFileName) {
+		t.Errorf("unexpected log path %s", p.LogPath)
+	}
+	if _, err := os.Stat(StateDir("web")); !os.IsNotExist(err) {
+		t.Fatalf("Plan created the state dir: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := p.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"detached", "pivot_root(" + p.Rootfs + ")", "Exec:"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan output lacks %q:\n%s", want, out.String())
+		}
+	}
+
+	if _, err := rt.Plan("web", specPath, WithTrace("bogus")); err == nil {
+		t.Fatal("expected invalid options to be rejected")
+	}
+}
+
+func TestPlanBundle(t *testing.T) {
+	origRoot := cgroupRoot
+	cgroupRoot = t.TempDir()
+	defer func() { cgroupRoot = origRoot }()
+
+	// The config is outside the bundle, as with run -c /elsewhere/config.json.
+	bundle := t.TempDir()
+	specPath := filepath.Join(t.TempDir(), "config.json")
+	spec := `{"ociVersion": "1.0.2", "root": {"path": "rootfs"},
+		"mounts": [{"destination": "/data", "type": "bind", "source": "data", "options": ["rbind", "ro"]}]}`
+	writeFile(t, specPath, spec, 0o644)
+	if err := os.Mkdir(filepath.Join(bundle, "data"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := rt.Plan("web", specPath, WithBundle(bundle))
+	if err != nil {
+		t.Fatalf("Plan failed: %v", err)
+	}
+	if p.Rootfs != filepath.Join(bundle, "rootfs") {
+		t.Errorf("relative root resolved to %s, want it in the bundle %s", p.Rootfs, bundle)
+	}
+	if m := p.Mounts[1]; m.Source != filepath.Join(bundle, "data") {
+		t.Errorf("relative bind source resolved to %s, want it in the bundle %s", m.Source, bundle)
+	}
+}
+
+func TestPlanCgroupSettings(t *testing.T) {
+	origRoot := cgroupRoot
+	cgroupRoot = t.TempDir()
+	defer func() { cgroupRoot = origRoot }()
+	if err := os.WriteFile(filepath.Join(cgroupRoot, "cgroup.controllers"), []byte("io memory"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	specPath := filepath.Join(t.TempDir(), "config.json")
+	spec := `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "linux": {"resources": {
+		"blockIO": {"weight": 500}, "unified": {"memory.high": "1G"},
+		"devices": [{"allow": true, "type": "c", "major": 10, "minor": 200, "access": "rw"}]}}}`
+	if err := os.WriteFile(specPath, []byte(spec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := planContainer("web", specPath, RunOptions{})
+	if err != nil {
+		t.Fatalf("planContainer failed: %v", err)
+	}
+	if p.Cgroup.Path != CgroupPath("web") {
+		t.Errorf("cgroup path %s", p.Cgroup.Path)
+	}
+	if len(p.Cgroup.Settings) != 2 || p.Cgroup.Settings[0].File != "io.weight" || p.Cgroup.Settings[1] != (CgroupSetting{"memory.high", "1G"}) {
+		t.Errorf("unexpected settings %+v", p.Cgroup.Settings)
+	}
+	last := p.Cgroup.DeviceRules[len(p.Cgroup.DeviceRules)-1]
+	if got := formatDeviceRule(last); got != "allow c 10:200 rw" {
+		t.Errorf("last device rule %q", got)
+	}
+	if got := formatDeviceRule(p.Cgroup.DeviceRules[0]); got != "deny a *:* rwm" {
+		t.Errorf("first device rule %q", got)
+	}
+}
@@ -0,0 +1,301 @@
+package container
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A rootfs built for another architecture, such as an arm64 image on an
+// amd64 host, runs when the host has a qemu-user-static handler registered
+// with binfmt_misc for it: the kernel then hands the binaries of the
+// container to the emulator. The architecture is read from the ELF header
+// of the program the container executes. A handler registered with the F
+// flag has its emulator opened when it is registered and works in any
+// container; without it the kernel looks the emulator up in the container,
+// so it has to be copied into the rootfs.
+
+// binfmtMiscDir lists the binfmt_misc handlers of the host. It is a
+// variable so tests can override it.
+var binfmtMiscDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuNames are the names of the qemu user emulators, by GOARCH.
+var qemuNames = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "arm",
+	"arm64":   "aarch64",
+	"loong64": "loongarch64",
+	"ppc64":   "ppc64",
+	"ppc64le": "ppc64le",
+	"riscv64": "riscv64",
+	"s390x":   "s390x",
+}
+
+// hostArch is the architecture of the host. It is a variable so tests can
+// override it.
+var hostArch = runtime.GOARCH
+
+// Emulation is how a container built for another architecture is run.
+type Emulation struct {
+	// Arch is the architecture of the container, as a GOARCH.
+	Arch string `json:"arch"`
+	// Handler is the binfmt_misc handler running its binaries and
+	// Interpreter the emulator it runs.
+	Handler     string `json:"handler"`
+	Interpreter string `json:"interpreter"`
+	// Copy is set when the emulator must be copied into the rootfs.
+	Copy bool `json:"copy,omitempty"`
+}
+
+// ParsePlatform parses a --platform value, "linux/<arch>[/<variant>]" or
+// "<arch>", and returns the architecture as a GOARCH. WebAssembly is
+// wasip1/wasm, wasi/wasm or wasm.
+func ParsePlatform(value string) (string, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) == 2 && parts[1] == wasmArch && imagePlatformOS(parts[0], wasmArch) || value == wasmArch {
+		return wasmArch, nil
+	}
+	if len(parts) > 1 {
+		if parts[0] != "linux" {
+			return "", fmt.Errorf("invalid platform %q: only linux is supported", value)
+		}
+		parts = parts[1:]
+	}
+	if len(parts) > 2 {
+		return "", fmt.Errorf("invalid platform %q: expected linux/<arch>[/<variant>]", value)
+	}
+	arch := parts[0]
+	switch arch {
+	case "x86_64":
+		arch = "amd64"
+	case "aarch64":
+		arch = "arm64"
+	}
+	if _, ok := qemuNames[arch]; !ok {
+		return "", fmt.Errorf("invalid platform %q: unknown architecture %q", value, parts[0])
+	}
+	return arch, nil
+}
+
+// checkPlatform works out the architecture of the container executing
+// spec.process in rootfs and, if it isn't the host's, how to emulate it.
+// platform, if set, is the architecture the container must have. It
+// returns nil when the container runs natively.
+func checkPlatform(rootfs string, spec *specs.Spec, platform string, copyEmulator bool) (*Emulation, error) {
+	arch := rootfsArch(rootfs, spec)
+	if platform != "" {
+		if arch != "" && arch != platform {
+			return nil, fmt.Errorf("rootfs %s is for linux/%s, not linux/%s", rootfs, arch, platform)
+		}
+		arch = platform
+	}
+	if arch == "" || nativeArch(arch) {
+		return nil, nil
+	}
+
+	e, err := binfmtHandler(arch)
+	if err != nil {
+		return nil, err
+	}
+	if e.Copy {
+		if _, err := statInRoot(rootfs, e.Interpreter); err == nil {
+			e.Copy = false
+		} else if !copyEmulator {
+			return nil, fmt.Errorf("binfmt handler %s looks for %s in the container; register it with the F flag, or copy the emulator into the rootfs with --copy-emulator", e.Handler, e.Interpreter)
+		}
+	}
+	return e, nil
+}
+
+// nativeArch reports whether the host runs arch without emulation.
+func nativeArch(arch string) bool {
+	return arch == hostArch || (hostArch == "amd64" && arch == "386")
+}
+
+// binfmtHandler returns the enabled qemu handler of arch.
+func binfmtHandler(arch string) (*Emulation, error) {
+	name := "qemu-" + qemuNames[arch]
+	f, err := os.Open(filepath.Join(binfmtMiscDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("the container is for linux/%s, which needs the %s binfmt_misc handler of qemu-user-static", arch, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read binfmt handler: %w", err)
+	}
+	defer f.Close()
+
+	e := &Emulation{Arch: arch, Handler: name, Copy: true}
+	enabled := false
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, val, _ := strings.Cut(sc.Text(), " ")
+		switch key {
+		case "enabled":
+			enabled = true
+		case "interpreter":
+			e.Interpreter = val
+		case "flags:":
+			e.Copy = !strings.Contains(val, "F")
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read binfmt handler %s: %w", name, err)
+	}
+	if !enabled || e.Interpreter == "" {
+		return nil, fmt.Errorf("the container is for linux/%s, but the %s binfmt_misc handler is disabled", arch, name)
+	}
+	return e, nil
+}
+
+// rootfsArch returns the architecture of the program spec.process executes
+// from rootfs, or of its shell, or "" if neither is an ELF binary.
+func rootfsArch(rootfs string, spec *specs.Spec) string {
+	argv, env := initProcess(spec, false)
+	path := envValue(env, "PATH")
+	if path == "" {
+		path = defaultExecPath
+	}
+	for _, file := range []string{argv[0], initProcessPath} {
+		for _, p := range execCandidates(file, path) {
+			f, err := openInRoot(rootfs, p)
+			if err != nil {
+				continue
+			}
+			arch, err := elfArch(f)
+			f.Close()
+			if err == nil {
+				return arch
+			}
+			break
+		}
+	}
+	return ""
+}
+
+// execCandidates returns where file may be found on path.
+func execCandidates(file, path string) []string {
+	if strings.Contains(file, "/") {
+		return []string{file}
+	}
+	var paths []string
+	for _, dir := range filepath.SplitList(path) {
+		paths = append(paths, filepath.Join(dir, file))
+	}
+	return paths
+}
+
+// elfArch returns the architecture of the ELF binary r as a GOARCH.
+func elfArch(r io.ReaderAt) (string, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return "", err
+	}
+	switch f.Machine {
+	case elf.EM_386:
+		return "386", nil
+	case elf.EM_X86_64:
+		return "amd64", nil
+	case elf.EM_ARM:
+		return "arm", nil
+	case elf.EM_AARCH64:
+		return "arm64", nil
+	case elf.EM_LOONGARCH:
+		return "loong64", nil
+	case elf.EM_PPC64:
+		if f.ByteOrder == binary.LittleEndian {
+			return "ppc64le", nil
+		}
+		return "ppc64", nil
+	case elf.EM_RISCV:
+		if f.Class == elf.ELFCLASS64 {
+			return "riscv64", nil
+		}
+	case elf.EM_S390:
+		return "s390x", nil
+	}
+	return "", fmt.Errorf("unsupported ELF machine %v", f.Machine)
+}
+
+// openInRoot opens path as if rootfs were the root directory, so symlinks
+// can't lead out of it.
+func openInRoot(rootfs, path string) (*os.File, error) {
+	root, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: rootfs, Err: err}
+	}
+	defer unix.Close(root)
+	fd, err := unix.Openat2(root, path, &unix.OpenHow{Flags: unix.O_RDONLY | unix.O_CLOEXEC, Resolve: unix.RESOLVE_IN_ROOT})
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(rootfs, path)), nil
+}
+
+// statInRoot stats path as if rootfs were the root directory.
+func statInRoot(rootfs, path string) (os.FileInfo, error) {
+	f, err := openInRoot(rootfs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// installEmulator copies the emulator of e from the host into rootfs, at
+// the same path.
+func installEmulator(rootfs string, e *Emulation) error {
+	src, err := os.Open(e.Interpreter)
+	if err != nil {
+		return fmt.Errorf("failed to open emulator: %w", err)
+	}
+	defer src.Close()
+
+	root, err := unix.Open(rootfs, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open rootfs: %w", err)
+	}
+	defer unix.Close(root)
+	// Create the directories of the emulator one at a time, resolving each
+	// in the rootfs.
+	dir := root
+	for _, name := range strings.Split(strings.Trim(filepath.Dir(e.Interpreter), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if err := unix.Mkdirat(dir, name, 0o755); err != nil && !errors.Is(err, unix.EEXIST) {
+			return fmt.Errorf("failed to create %s in rootfs: %w", name, err)
+		}
+		next, err := unix.Openat2(dir, name, &unix.OpenHow{Flags: unix.O_PATH | unix.O_DIRECTORY | unix.O_CLOEXEC, Resolve: unix.RESOLVE_IN_ROOT})
+		if dir != root {
+			unix.Close(dir)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open %s in rootfs: %w", name, err)
+		}
+		dir = next
+	}
+	if dir != root {
+		defer unix.Close(dir)
+	}
+	fd, err := unix.Openat(dir, filepath.Base(e.Interpreter), unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed to create emulator in rootfs: %w", err)
+	}
+	dst := os.NewFile(uintptr(fd), e.Interpreter)
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to copy emulator: %w", err)
+	}
+	return dst.Close()
+}
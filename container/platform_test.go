@@ -0,0 +1,122 @@
+package container
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// elfHeader returns the header of a little-endian 64-bit ELF executable
+// for machine.
+func elfHeader(machine elf.Machine) string {
+	h := make([]byte, 64)
+	copy(h, elf.ELFMAG)
+	h[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	h[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	h[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.LittleEndian.PutUint16(h[16:], uint16(elf.ET_EXEC))
+	binary.LittleEndian.PutUint16(h[18:], uint16(machine))
+	binary.LittleEndian.PutUint32(h[20:], uint32(elf.EV_CURRENT))
+	binary.LittleEndian.PutUint16(h[52:], 64)
+	return string(h)
+}
+
+// tempBinfmt points the binfmt_misc dir at a new temporary directory and
+// makes the host amd64.
+func tempBinfmt(t *testing.T) string {
+	t.Helper()
+	origDir, origArch := binfmtMiscDir, hostArch
+	binfmtMiscDir, hostArch = t.TempDir(), "amd64"
+	t.Cleanup(func() { binfmtMiscDir, hostArch = origDir, origArch })
+	return binfmtMiscDir
+}
+
+func TestParsePlatform(t *testing.T) {
+	for value, want := range map[string]string{
+		"linux/arm64":    "arm64",
+		"linux/arm/v7":   "arm",
+		"aarch64":        "arm64",
+		"linux/x86_64":   "amd64",
+		"linux/riscv64":  "riscv64",
+		"wasip1/wasm":    "wasm",
+		"wasm":           "wasm",
+		"wasip1/amd64":   "",
+		"windows/amd64":  "",
+		"linux/mips":     "",
+		"linux/arm/v7/x": "",
+	} {
+		got, err := ParsePlatform(value)
+		if want == "" {
+			if err == nil {
+				t.Errorf("ParsePlatform(%q) = %q, expected an error", value, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("ParsePlatform(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	binfmt := tempBinfmt(t)
+	rootfs := t.TempDir()
+	for _, dir := range []string{"bin", "usr/bin"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(rootfs, "usr/bin/app"), elfHeader(elf.EM_AARCH64), 0o755)
+	writeFile(t, filepath.Join(rootfs, "bin/sh"), elfHeader(elf.EM_X86_64), 0o755)
+	// An absolute symlink resolves in the rootfs, not on the host.
+	if err := os.Symlink("/usr/bin/app", filepath.Join(rootfs, "bin/app")); err != nil {
+		t.Fatal(err)
+	}
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"app"}, Env: []string{"PATH=/bin"}}}
+
+	if e, err := checkPlatform(rootfs, &specs.Spec{}, "", false); err != nil || e != nil {
+		t.Fatalf("expected the shell to run natively, got %+v, %v", e, err)
+	}
+	if _, err := checkPlatform(rootfs, spec, "amd64", false); err == nil || !strings.Contains(err.Error(), "is for linux/arm64, not linux/amd64") {
+		t.Fatalf("expected a platform mismatch, got %v", err)
+	}
+	if _, err := checkPlatform(rootfs, spec, "", false); err == nil || !strings.Contains(err.Error(), "qemu-aarch64") {
+		t.Fatalf("expected a missing handler, got %v", err)
+	}
+
+	emulator := filepath.Join(t.TempDir(), "qemu-aarch64-static")
+	writeFile(t, emulator, "emulator", 0o755)
+	writeFile(t, filepath.Join(binfmt, "qemu-aarch64"), "disabled\ninterpreter "+emulator+"\nflags: F\n", 0o644)
+	if _, err := checkPlatform(rootfs, spec, "", false); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Fatalf("expected a disabled handler, got %v", err)
+	}
+	writeFile(t, filepath.Join(binfmt, "qemu-aarch64"), "enabled\ninterpreter "+emulator+"\nflags: OCF\noffset 0\n", 0o644)
+	e, err := checkPlatform(rootfs, spec, "arm64", false)
+	if err != nil || e == nil || e.Arch != "arm64" || e.Interpreter != emulator || e.Copy {
+		t.Fatalf("expected emulation by the fixed handler, got %+v, %v", e, err)
+	}
+
+	writeFile(t, filepath.Join(binfmt, "qemu-aarch64"), "enabled\ninterpreter "+emulator+"\nflags: \n", 0o644)
+	if _, err := checkPlatform(rootfs, spec, "", false); err == nil || !strings.Contains(err.Error(), "--copy-emulator") {
+		t.Fatalf("expected the emulator to be missing from the rootfs, got %v", err)
+	}
+	e, err = checkPlatform(rootfs, spec, "", true)
+	if err != nil || e == nil || !e.Copy {
+		t.Fatalf("expected the emulator to be copied, got %+v, %v", e, err)
+	}
+	if err := installEmulator(rootfs, e); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(rootfs, emulator))
+	if err != nil || string(data) != "emulator" {
+		t.Fatalf("emulator not copied: %q, %v", data, err)
+	}
+	if e, err = checkPlatform(rootfs, spec, "", false); err != nil || e == nil || e.Copy {
+		t.Fatalf("expected the copied emulator to be used, got %+v, %v", e, err)
+	}
+}
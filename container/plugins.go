@@ -0,0 +1,159 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Plugins extend the runtime with site-specific behavior, such as
+// registering containers in an inventory or preparing storage, without
+// changing containish. They are the executables of the plugin dir, run in
+// name order at each extension point as "<plugin> <point>" with a
+// PluginEvent as JSON on stdin. Their stdout is ignored and their stderr
+// reported when they fail. A plugin failing, or outliving
+// pluginTimeout, at a point before the container runs aborts what was
+// being done; failures once a container has stopped are only reported.
+
+// Extension points plugins are run at.
+const (
+	// PluginPostStoragePrepare runs once the rootfs is populated and the
+	// volumes of the container are ready, before its namespaces exist.
+	PluginPostStoragePrepare = "post-storage-prepare"
+	// PluginPreNetwork runs once the init process is waiting in the
+	// container namespaces, before its network is configured.
+	PluginPreNetwork = "pre-network"
+	// PluginPreExec runs before the container process is executed, when
+	// the container is started, and before a process is started in it
+	// with exec.
+	PluginPreExec = "pre-exec"
+	// PluginPostStop runs once the init process of a detached container
+	// has exited and what the container held is released, before its
+	// restart policy is applied.
+	PluginPostStop = "post-stop"
+	// PluginPostAddressRelease runs once an address leased to a
+	// container, which is being deleted, is released to its network.
+	PluginPostAddressRelease = "post-address-release"
+	// PluginPostDelete runs once a container has been deleted.
+	PluginPostDelete = "post-delete"
+)
+
+// pluginDir holds the plugins, see Config. It is a variable so tests can
+// override it.
+var pluginDir = "/etc/containish/plugins.d"
+
+// pluginTimeout bounds how long a plugin may run.
+var pluginTimeout = 30 * time.Second
+
+// PluginEvent describes the container a plugin is run for.
+type PluginEvent struct {
+	Point       string            `json:"point"`
+	ID          string            `json:"id"`
+	Bundle      string            `json:"bundle,omitempty"`
+	Rootfs      string            `json:"rootfs,omitempty"`
+	StateDir    string            `json:"stateDir"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Volumes     []VolumeMount     `json:"volumes,omitempty"`
+	// Pid is the init process of the container, once it exists.
+	Pid int `json:"pid,omitempty"`
+	// Network is the network the container is connected to, or about to
+	// be at PluginPreNetwork.
+	Network *NetworkConfig `json:"network,omitempty"`
+	// ExecID and Exec describe the process started by exec, at
+	// PluginPreExec.
+	ExecID string       `json:"execId,omitempty"`
+	Exec   *ExecOptions `json:"exec,omitempty"`
+	// ExitCode is the exit code of the init process, at PluginPostStop.
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Lease is the address released, at PluginPostAddressRelease.
+	Lease *AddressLease `json:"lease,omitempty"`
+}
+
+// newPluginEvent returns the event of c at point.
+func newPluginEvent(point string, c *Container) PluginEvent {
+	return PluginEvent{
+		Point:       point,
+		ID:          c.Id,
+		Bundle:      c.Bundle,
+		Rootfs:      c.Rootfs,
+		StateDir:    StateDir(c.Id),
+		Annotations: c.Annotations,
+		Volumes:     c.Volumes,
+		Pid:         c.InitProcessPiD,
+		Network:     c.Network,
+	}
+}
+
+// listPlugins returns the executables of the plugin dir in name order.
+// Hidden files are left out.
+func listPlugins() ([]string, error) {
+	entries, err := os.ReadDir(pluginDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list plugins: %w", err)
+	}
+	var plugins []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(pluginDir, e.Name())
+		// Follow symlinks, so plugins can be installed elsewhere.
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			continue
+		}
+		plugins = append(plugins, path)
+	}
+	return plugins, nil
+}
+
+// runPlugins runs the plugins at the point of e, stopping at the first
+// that fails.
+func runPlugins(ctx context.Context, e PluginEvent) error {
+	plugins, err := listPlugins()
+	if err != nil || len(plugins) == 0 {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	for _, p := range plugins {
+		if err := runPlugin(ctx, p, e.Point, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPlugin runs the plugin at path with the event data on stdin.
+func runPlugin(ctx context.Context, path, point string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, point)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	// Don't wait on children the plugin left holding stderr.
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %v", pluginTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return fmt.Errorf("plugin %s failed at %s: %w", filepath.Base(path), point, err)
+	}
+	return nil
+}
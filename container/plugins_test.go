@@ -0,0 +1,105 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempPluginDir points the plugin dir at a new temporary directory.
+func tempPluginDir(t *testing.T) string {
+	t.Helper()
+	orig := pluginDir
+	pluginDir = t.TempDir()
+	t.Cleanup(func() { pluginDir = orig })
+	return pluginDir
+}
+
+func TestRunPlugins(t *testing.T) {
+	dir := tempPluginDir(t)
+	out := filepath.Join(t.TempDir(), "calls")
+	writeFile(t, filepath.Join(dir, "10-record"), "#!/bin/sh\necho \"$(basename $0) $1 $(cat)\" >> "+out+"\n", 0o755)
+	writeFile(t, filepath.Join(dir, "20-veto"), "#!/bin/sh\ncat >/dev/null\n[ \"$1\" != pre-exec ] || { echo 'not in the inventory' >&2; exit 1; }\n", 0o755)
+	writeFile(t, filepath.Join(dir, "30-record"), "#!/bin/sh\necho \"$(basename $0) $1\" >> "+out+"\n", 0o755)
+	writeFile(t, filepath.Join(dir, ".10-hidden"), "#!/bin/sh\nexit 1\n", 0o755)
+	writeFile(t, filepath.Join(dir, "README"), "not a plugin\n", 0o644)
+
+	c := &Container{Id: "c1", Bundle: "/bundle", Rootfs: "/bundle/rootfs", Annotations: map[string]string{"team": "db"}}
+	event := newPluginEvent(PluginPreNetwork, c)
+	event.Pid = 42
+	if err := runPlugins(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	err := runPlugins(context.Background(), newPluginEvent(PluginPreExec, c))
+	if err == nil || !strings.Contains(err.Error(), "20-veto failed at pre-exec") || !strings.Contains(err.Error(), "not in the inventory") {
+		t.Fatalf("expected the veto of 20-veto, got %v", err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "10-record pre-network {") || lines[1] != "30-record pre-network" || !strings.HasPrefix(lines[2], "10-record pre-exec {") {
+		t.Fatalf("unexpected plugin calls:\n%s", data)
+	}
+	var got PluginEvent
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[0], "10-record pre-network ")), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Point != PluginPreNetwork || got.ID != "c1" || got.Pid != 42 || got.Rootfs != "/bundle/rootfs" || got.StateDir != StateDir("c1") || got.Annotations["team"] != "db" {
+		t.Fatalf("unexpected event %+v", got)
+	}
+}
+
+func TestRunPluginsTimeout(t *testing.T) {
+	dir := tempPluginDir(t)
+	orig := pluginTimeout
+	pluginTimeout = 50 * time.Millisecond
+	defer func() { pluginTimeout = orig }()
+	writeFile(t, filepath.Join(dir, "slow"), "#!/bin/sh\nexec sleep 5\n", 0o755)
+
+	start := time.Now()
+	err := runPlugins(context.Background(), PluginEvent{Point: PluginPostStoragePrepare, ID: "c1"})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("the plugin wasn't killed")
+	}
+}
+
+func TestDeleteRunsPlugins(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	dir := tempPluginDir(t)
+	out := filepath.Join(t.TempDir(), "deleted")
+	writeFile(t, filepath.Join(dir, "cmdb"), "#!/bin/sh\ncat > "+out+"\n", 0o755)
+
+	if err := saveState(&Container{Id: "c1", Status: Stopped, Bundle: "/bundle"}); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Delete("c1"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("post-delete plugin not run: %v", err)
+	}
+	var got PluginEvent
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Point != PluginPostDelete || got.ID != "c1" || got.Bundle != "/bundle" {
+		t.Fatalf("unexpected event %+v", got)
+	}
+}
@@ -0,0 +1,224 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A preset is a named run configuration kept in the configuration dir of
+// the user, so many identically configured containers can be run from it:
+// the bundle they are created from, their mounts, environment, limits and
+// network. Its settings are kept as the values of the run flags they stand
+// for, which run applies unless given on the command line.
+
+// presetsDir holds the presets, one <name>.json each. It is a variable so
+// tests can override it.
+var presetsDir = defaultPresetsDir()
+
+// defaultPresetsDir returns the presets dir in the configuration dir of the
+// user, or next to the host-wide configuration if they have none.
+func defaultPresetsDir() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "containish", "presets")
+	}
+	return filepath.Join(filepath.Dir(DefaultConfigPath), "presets")
+}
+
+// Preset is a named run configuration.
+type Preset struct {
+	Name string `json:"name"`
+	// Bundle is the absolute path of the bundle containers are created
+	// from, and Config their spec, relative to the bundle, config.json if
+	// empty.
+	Bundle string `json:"bundle"`
+	Config string `json:"config,omitempty"`
+	// Volumes and Tmpfs are -v and --tmpfs values.
+	Volumes []string `json:"volumes,omitempty"`
+	Tmpfs   []string `json:"tmpfs,omitempty"`
+	// Env are KEY=VALUE variables of the container process.
+	Env []string `json:"env,omitempty"`
+	// Memory, CPUs and StorageSize are --memory, --cpus and
+	// --storage-size values.
+	Memory      string `json:"memory,omitempty"`
+	CPUs        string `json:"cpus,omitempty"`
+	StorageSize string `json:"storageSize,omitempty"`
+	// Network is a --network value.
+	Network string `json:"network,omitempty"`
+	// Detach runs the containers detached, with the Restart policy.
+	Detach  bool   `json:"detach,omitempty"`
+	Restart string `json:"restart,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Validate checks the settings of p.
+func (p *Preset) Validate() error {
+	if !objectNameRe.MatchString(p.Name) {
+		return fmt.Errorf("invalid preset name %q", p.Name)
+	}
+	if !filepath.IsAbs(p.Bundle) {
+		return fmt.Errorf("preset bundle %q must be an absolute path", p.Bundle)
+	}
+	config := p.Config
+	if config == "" {
+		config = "config.json"
+	}
+	if !filepath.IsAbs(config) {
+		config = filepath.Join(p.Bundle, config)
+	}
+	if _, err := LoadSpec(config); err != nil {
+		return fmt.Errorf("invalid preset bundle: %w", err)
+	}
+	var mounts []VolumeMount
+	for _, v := range p.Volumes {
+		m, err := ParseVolumeMount(v)
+		if err != nil {
+			return err
+		}
+		mounts = append(mounts, m)
+	}
+	if err := validateVolumeMounts(mounts); err != nil {
+		return err
+	}
+	for _, t := range p.Tmpfs {
+		if _, err := ParseTmpfs(t); err != nil {
+			return err
+		}
+	}
+	for _, e := range p.Env {
+		if _, err := ParseEnv(e); err != nil {
+			return err
+		}
+	}
+	if p.Memory != "" {
+		if _, err := ParseMemory(p.Memory); err != nil {
+			return err
+		}
+	}
+	if p.CPUs != "" {
+		if _, err := ParseCPUs(p.CPUs); err != nil {
+			return err
+		}
+	}
+	if p.StorageSize != "" {
+		if _, err := ParseStorageSize(p.StorageSize); err != nil {
+			return err
+		}
+	}
+	if p.Network != "" {
+		if _, err := ParseNetwork(p.Network); err != nil {
+			return err
+		}
+	}
+	if p.Restart != "" {
+		policy, err := ParseRestartPolicy(p.Restart)
+		if err != nil {
+			return err
+		}
+		if policy.restarts() && !p.Detach {
+			return fmt.Errorf("a restart policy requires a detached container")
+		}
+	}
+	return nil
+}
+
+func presetPath(name string) string {
+	return filepath.Join(presetsDir, name+".json")
+}
+
+// CreatePreset validates p and saves it. A preset of the same name is
+// refused.
+func CreatePreset(p *Preset) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
+	}
+	data, err := json.MarshalIndent(p, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(presetsDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create presets dir: %w", err)
+	}
+	f, err := os.OpenFile(presetPath(p.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("preset %s %w", p.Name, ErrExists)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save preset %s: %w", p.Name, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save preset %s: %w", p.Name, err)
+	}
+	return f.Close()
+}
+
+// LoadPreset returns the named preset.
+func LoadPreset(name string) (*Preset, error) {
+	if !objectNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid preset name %q", name)
+	}
+	data, err := os.ReadFile(presetPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("preset %s %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preset %s: %w", name, err)
+	}
+	var p Preset
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode preset %s: %w", name, err)
+	}
+	return &p, nil
+}
+
+// ListPresets returns the presets, sorted by name.
+func ListPresets() ([]*Preset, error) {
+	entries, err := os.ReadDir(presetsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read presets dir: %w", err)
+	}
+	var presets []*Preset
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		p, err := LoadPreset(name)
+		if err != nil {
+			continue
+		}
+		presets = append(presets, p)
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+	return presets, nil
+}
+
+// RemovePreset deletes the named preset. Containers run from it are left
+// as they are.
+func RemovePreset(name string) error {
+	if !objectNameRe.MatchString(name) {
+		return fmt.Errorf("invalid preset name %q", name)
+	}
+	err := os.Remove(presetPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("preset %s %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove preset %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package container
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPresets(t *testing.T) {
+	orig := presetsDir
+	presetsDir = filepath.Join(t.TempDir(), "presets")
+	defer func() { presetsDir = orig }()
+
+	bundle := t.TempDir()
+	writeFile(t, filepath.Join(bundle, "config.json"), `{"ociVersion":"1.0.2","root":{"path":"rootfs"}}`, 0o644)
+
+	if presets, err := ListPresets(); err != nil || len(presets) != 0 {
+		t.Fatalf("ListPresets = %v, %v, want none", presets, err)
+	}
+	for _, p := range []Preset{
+		{Name: "bad/name", Bundle: bundle},
+		{Name: "rel", Bundle: "bundle"},
+		{Name: "missing", Bundle: filepath.Join(bundle, "missing")},
+		{Name: "vol", Bundle: bundle, Volumes: []string{"data:/data", "logs:/data"}},
+		{Name: "env", Bundle: bundle, Env: []string{"FOO"}},
+		{Name: "mem", Bundle: bundle, Memory: "1k"},
+		{Name: "restart", Bundle: bundle, Restart: "always"},
+	} {
+		if err := CreatePreset(&p); err == nil {
+			t.Errorf("CreatePreset(%+v) succeeded, expected an error", p)
+		}
+	}
+
+	lab := &Preset{Name: "lab", Bundle: bundle, Env: []string{"LAB=1"}, Memory: "256m", CPUs: "0.5", Detach: true, Restart: "on-failure:3"}
+	if err := CreatePreset(lab); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreatePreset(&Preset{Name: "lab", Bundle: bundle}); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected a second lab preset to exist already, got %v", err)
+	}
+	if err := CreatePreset(&Preset{Name: "base", Bundle: bundle}); err != nil {
+		t.Fatal(err)
+	}
+	presets, err := ListPresets()
+	if err != nil || len(presets) != 2 || presets[0].Name != "base" || presets[1].Name != "lab" {
+		t.Fatalf("ListPresets = %v, %v", presets, err)
+	}
+	if p := presets[1]; p.Memory != "256m" || p.Restart != "on-failure:3" || !p.Detach || len(p.Env) != 1 {
+		t.Fatalf("unexpected preset %+v", p)
+	}
+
+	if err := RemovePreset("lab"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPreset("lab"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the removed preset to be gone, got %v", err)
+	}
+	if err := RemovePreset("lab"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected removing it again to fail, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// The first container run from an image pays for pulling it and applying
+// its layers, which on a freshly provisioned host can take longer than
+// anything else of the start. PrewarmImage does both ahead of time: the
+// unpacked image is the lower dir of the overlay rootfs of its containers,
+// and what the vfs driver copies, so a container run from it afterwards
+// only mounts or copies its rootfs. A pinned image, as PrewarmImage leaves
+// it unless asked not to, is kept by PruneImages, which removes the other
+// images no container was created from, and refused by RemoveImage.
+
+// PrewarmImage pulls the image ref for arch, a GOARCH or empty for that of
+// the host, unless it is in the store, unpacks it and, with pin, pins it.
+// With the overlay storage driver it also warns if overlayfs can't be
+// mounted where the rootfs of containers go.
+func PrewarmImage(ctx context.Context, ref, arch string, pin bool) (*Image, error) {
+	img, err := resolveImage(ctx, ref, arch, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unpackImage(img); err != nil {
+		return nil, err
+	}
+	if _, err := newStorageDriver(); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if pin {
+		if err := PinImage(img.Ref, true); err != nil {
+			return nil, err
+		}
+		img.Pinned = true
+	}
+	return img, nil
+}
+
+// PinImage pins the pulled image ref, or unpins it.
+func PinImage(ref string, pinned bool) error {
+	r, err := ParseImageRef(ref)
+	if err != nil {
+		return err
+	}
+	return withImagesLock(func() error {
+		images, err := loadImages()
+		if err != nil {
+			return err
+		}
+		img, ok := images[r.String()]
+		if !ok {
+			return fmt.Errorf("image %s %w", r, ErrNotFound)
+		}
+		img.Pinned = pinned
+		return saveImages(images)
+	})
+}
+
+// PruneImages removes the pulled images that aren't pinned and no
+// container was created from, with their blobs and unpacked rootfs as
+// RemoveImage does, and returns their references.
+func PruneImages() ([]string, error) {
+	var pruned []string
+	err := withImagesLock(func() error {
+		images, err := loadImages()
+		if err != nil {
+			return err
+		}
+		containers, err := ListContainers()
+		if err != nil {
+			return err
+		}
+		refs := make([]string, 0, len(images))
+		for ref := range images {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		var garbage []string
+		for _, ref := range refs {
+			img := images[ref]
+			if img.Pinned || imageInUse(img, containers) {
+				continue
+			}
+			g, err := dropImage(images, img, containers)
+			if err != nil {
+				return err
+			}
+			garbage = append(garbage, g...)
+			pruned = append(pruned, ref)
+		}
+		if len(pruned) == 0 {
+			return nil
+		}
+		if err := saveImages(images); err != nil {
+			return err
+		}
+		removeGarbage(garbage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// imageInUse reports whether one of containers was created from img.
+func imageInUse(img *Image, containers []*Container) bool {
+	for _, c := range containers {
+		if c.Image != nil && c.Image.ID == img.ID {
+			return true
+		}
+	}
+	return false
+}
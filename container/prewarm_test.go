@@ -0,0 +1,86 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrewarmImage(t *testing.T) {
+	tempImages(t)
+	r := newTestRegistry(t)
+	ctx := context.Background()
+
+	img, err := PrewarmImage(ctx, r.ref("app:v1"), "amd64", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !img.Pinned {
+		t.Error("prewarmed image isn't pinned")
+	}
+	if data, err := os.ReadFile(filepath.Join(imageRootfsDir(img.ID), "bin/app")); err != nil || string(data) != "app" {
+		t.Errorf("unpacked bin/app = %q, %v", data, err)
+	}
+	// Pulling it again keeps it pinned.
+	if _, err := PullImage(ctx, r.ref("app:v1"), "amd64", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveImage(r.ref("app:v1")); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Errorf("removing a pinned image: %v", err)
+	}
+	if pruned, err := PruneImages(); err != nil || len(pruned) != 0 {
+		t.Errorf("PruneImages = %v, %v, want the pinned image kept", pruned, err)
+	}
+
+	if err := PinImage(r.ref("app:v1"), false); err != nil {
+		t.Fatal(err)
+	}
+	if pruned, err := PruneImages(); err != nil || fmt.Sprint(pruned) != fmt.Sprintf("[%s]", r.ref("app:v1")) {
+		t.Errorf("PruneImages = %v, %v, want the unpinned image", pruned, err)
+	}
+	if _, err := os.Stat(imageRootfsDir(img.ID)); !os.IsNotExist(err) {
+		t.Errorf("the unpacked image of a pruned image is left: %v", err)
+	}
+	if err := PinImage(r.ref("app:v1"), true); err == nil {
+		t.Error("pinning a missing image succeeded")
+	}
+}
+
+func TestPruneImages(t *testing.T) {
+	tempImages(t)
+	shared := Descriptor{Digest: "sha256:" + hex64('1')}
+	image := func(name string, digest, id byte) *Image {
+		return &Image{Ref: "docker.io/library/" + name + ":latest", Digest: "sha256:" + hex64(digest), ID: "sha256:" + hex64(id), Layers: []Descriptor{shared}}
+	}
+	pinned, used, unused := image("pinned", '2', '3'), image("used", '4', '5'), image("unused", '6', '7')
+	pinned.Pinned = true
+	for _, d := range []string{shared.Digest, pinned.Digest, pinned.ID, used.Digest, used.ID, unused.Digest, unused.ID} {
+		if err := os.MkdirAll(filepath.Dir(blobPath(d)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, blobPath(d), "blob", 0o600)
+	}
+	if err := saveImages(map[string]*Image{pinned.Ref: pinned, used.Ref: used, unused.Ref: unused}); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(&Container{Id: "web", Status: Stopped, Image: &ImageRootfs{Ref: used.Ref, ID: used.ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := PruneImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(pruned) != "["+unused.Ref+"]" {
+		t.Errorf("pruned %v, want only %s", pruned, unused.Ref)
+	}
+	if hasBlob(unused.Digest) || hasBlob(unused.ID) || !hasBlob(shared.Digest) || !hasBlob(used.ID) {
+		t.Error("the blobs of the pruned image are kept or those of the others removed")
+	}
+	if images, err := ListImages(); err != nil || len(images) != 2 {
+		t.Errorf("images after pruning = %v, %v", images, err)
+	}
+}
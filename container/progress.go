@@ -0,0 +1,216 @@
+package container
+
+import (
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Setting a container up goes through phases, each reported to the
+// ProgressFunc of its RunOptions with a started and a done event, which
+// tells how long it took. Copying the Alpine image into an empty rootfs
+// also reports how many bytes have been copied so far, so wrappers can draw
+// a progress bar, and so does pulling the image of a container, layer by
+// layer, with events naming the layer. The init stages time the parts of
+// PhaseCreate themselves, so PhaseClone, PhaseMounts and PhasePivot only
+// have done events, sent once the runtime learns of them.
+
+// Phases of setting a container up.
+const (
+	// PhasePull pulls the image of the container from its registry,
+	// unless the store has it.
+	PhasePull = "pull"
+	// PhaseRootfs prepares the root filesystem from an image, or
+	// populates an empty one.
+	PhaseRootfs = "rootfs"
+	// PhaseCreate starts the init stages in the container namespaces.
+	PhaseCreate = "create"
+	// PhaseClone forks the child stage into the namespaces, PhaseMounts
+	// mounts the filesystems of the container and PhasePivot moves into
+	// its root and finishes setting it up, within PhaseCreate.
+	PhaseClone  = "clone"
+	PhaseMounts = "mounts"
+	PhasePivot  = "pivot"
+	// PhaseNetwork connects the container.
+	PhaseNetwork = "network"
+	// PhaseStart lets the container process run.
+	PhaseStart = "start"
+)
+
+// Statuses of a progress event.
+const (
+	ProgressStarted = "started"
+	ProgressUpdate  = "progress"
+	ProgressDone    = "done"
+)
+
+// ProgressEvent is a step of setting a container up.
+type ProgressEvent struct {
+	Time time.Time `json:"time"`
+	// Container is the container being set up, empty in the events of
+	// PullImage.
+	Container string `json:"container,omitempty"`
+	Phase     string `json:"phase"`
+	Status    string `json:"status"`
+	// Layer is the digest of the layer a PhasePull event is about, empty
+	// in those of the whole pull. Layers already in the store only have a
+	// done event.
+	Layer string `json:"layer,omitempty"`
+	// Current and Total are the bytes copied so far and to copy, for
+	// PhaseRootfs, or downloaded and to download of the Layer, for
+	// PhasePull.
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+	// Pid is the init process of the container once PhaseCreate is done.
+	Pid int `json:"pid,omitempty"`
+	// Duration is how long the phase took, in done events.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// stagePhases are the phases the init stages time, in order.
+var stagePhases = []string{PhaseClone, PhaseMounts, PhasePivot}
+
+// ProgressFunc receives progress events. Calls never overlap.
+type ProgressFunc func(ProgressEvent)
+
+// progressInterval is how often the bytes copied into a rootfs are
+// reported.
+var progressInterval = 250 * time.Millisecond
+
+// progressReporter sends the events of one container to a ProgressFunc.
+// A nil reporter or one without a func drops them.
+type progressReporter struct {
+	mu        sync.Mutex
+	container string
+	fn        ProgressFunc
+	// starts is when each phase, or layer of PhasePull, started, for the
+	// Duration of its done event.
+	starts map[string]time.Time
+}
+
+func newProgressReporter(container string, fn ProgressFunc) *progressReporter {
+	return &progressReporter{container: container, fn: fn}
+}
+
+func (r *progressReporter) enabled() bool { return r != nil && r.fn != nil }
+
+func (r *progressReporter) send(e ProgressEvent) {
+	if !r.enabled() {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Time = time.Now().UTC()
+	e.Container = r.container
+	key := e.Phase + " " + e.Layer
+	switch e.Status {
+	case ProgressStarted:
+		if r.starts == nil {
+			r.starts = map[string]time.Time{}
+		}
+		r.starts[key] = e.Time
+	case ProgressDone:
+		if start, ok := r.starts[key]; ok && e.Duration == 0 {
+			e.Duration = e.Time.Sub(start)
+		}
+	}
+	r.fn(e)
+}
+
+func (r *progressReporter) started(phase string) {
+	r.send(ProgressEvent{Phase: phase, Status: ProgressStarted})
+}
+
+func (r *progressReporter) done(phase string) {
+	r.send(ProgressEvent{Phase: phase, Status: ProgressDone})
+}
+
+// stagesDone reports the phases the init stages timed, as given in their
+// ready message.
+func (r *progressReporter) stagesDone(timings map[string]time.Duration) {
+	for _, phase := range stagePhases {
+		if d, ok := timings[phase]; ok {
+			r.send(ProgressEvent{Phase: phase, Status: ProgressDone, Duration: d})
+		}
+	}
+}
+
+// watchCopy reports the bytes under dst every progressInterval while
+// something copies total bytes into it, until the returned func is called.
+func (r *progressReporter) watchCopy(dst string, total int64) (stop func()) {
+	if !r.enabled() {
+		return func() {}
+	}
+	r.send(ProgressEvent{Phase: PhaseRootfs, Status: ProgressStarted, Total: total})
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		t := time.NewTicker(progressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-t.C:
+				r.send(ProgressEvent{Phase: PhaseRootfs, Status: ProgressUpdate, Current: treeSize(dst), Total: total})
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-finished
+	}
+}
+
+// watchLayer reports the bytes of the layer d read from body every
+// progressInterval, returning the reader to read it through.
+func (r *progressReporter) watchLayer(d Descriptor, body io.Reader) io.Reader {
+	if !r.enabled() {
+		return body
+	}
+	r.send(ProgressEvent{Phase: PhasePull, Status: ProgressStarted, Layer: d.Digest, Total: d.Size})
+	return &layerReader{r: body, report: r, layer: d, last: time.Now()}
+}
+
+// layerReader counts the bytes of a layer read through it.
+type layerReader struct {
+	r       io.Reader
+	report  *progressReporter
+	layer   Descriptor
+	current int64
+	last    time.Time
+}
+
+func (l *layerReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.current += int64(n)
+	if now := time.Now(); now.Sub(l.last) >= progressInterval {
+		l.last = now
+		l.report.send(ProgressEvent{Phase: PhasePull, Status: ProgressUpdate, Layer: l.layer.Digest, Current: l.current, Total: l.layer.Size})
+	}
+	return n, err
+}
+
+// layerDone reports the layer d pulled, or found in the store.
+func (r *progressReporter) layerDone(d Descriptor) {
+	r.send(ProgressEvent{Phase: PhasePull, Status: ProgressDone, Layer: d.Digest, Current: d.Size, Total: d.Size})
+}
+
+// treeSize returns the size of the regular files under root. Files that
+// can't be read are left out.
+func treeSize(root string) int64 {
+	var size int64
+	_ = filepath.WalkDir(root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
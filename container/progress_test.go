@@ -0,0 +1,65 @@
+package container
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchCopy(t *testing.T) {
+	orig := progressInterval
+	progressInterval = 5 * time.Millisecond
+	defer func() { progressInterval = orig }()
+
+	var events []ProgressEvent
+	r := newProgressReporter("c1", func(e ProgressEvent) { events = append(events, e) })
+	dst := t.TempDir()
+	stop := r.watchCopy(dst, 10)
+	writeFile(t, filepath.Join(dst, "a"), "hello", 0o644)
+	writeFile(t, filepath.Join(dst, "b"), "world", 0o644)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	n := len(events)
+	time.Sleep(20 * time.Millisecond)
+	if len(events) != n {
+		t.Fatal("events sent after stop")
+	}
+
+	if n < 2 {
+		t.Fatalf("got %d events, want a started event and updates", n)
+	}
+	if e := events[0]; e.Status != ProgressStarted || e.Phase != PhaseRootfs || e.Total != 10 || e.Container != "c1" {
+		t.Fatalf("unexpected first event %+v", e)
+	}
+	if e := events[n-1]; e.Status != ProgressUpdate || e.Current != 10 || e.Total != 10 {
+		t.Fatalf("unexpected last event %+v", e)
+	}
+
+	// Without a func nothing is watched or sent.
+	newProgressReporter("c1", nil).watchCopy(dst, 10)()
+	var nilReporter *progressReporter
+	nilReporter.done(PhaseStart)
+}
+
+func TestProgressDuration(t *testing.T) {
+	var events []ProgressEvent
+	r := newProgressReporter("c1", func(e ProgressEvent) { events = append(events, e) })
+	r.started(PhaseNetwork)
+	time.Sleep(5 * time.Millisecond)
+	r.done(PhaseNetwork)
+	if d := events[1].Duration; d < 5*time.Millisecond {
+		t.Errorf("network took %v, want at least 5ms", d)
+	}
+	if events[0].Duration != 0 {
+		t.Errorf("started event has a duration %v", events[0].Duration)
+	}
+
+	events = nil
+	r.stagesDone(map[string]time.Duration{PhasePivot: 2 * time.Millisecond, PhaseClone: time.Millisecond})
+	if len(events) != 2 || events[0].Phase != PhaseClone || events[1].Phase != PhasePivot {
+		t.Fatalf("stage events %+v, want clone then pivot", events)
+	}
+	if e := events[1]; e.Status != ProgressDone || e.Duration != 2*time.Millisecond {
+		t.Errorf("unexpected pivot event %+v", e)
+	}
+}
@@ -0,0 +1,105 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty allocates a pseudo terminal and returns its master and slave ends.
+func openPty() (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open /dev/ptmx: %w", err)
+	}
+	n, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to get pty number: %w", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to unlock pty: %w", err)
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(n), os.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("failed to open pty slave: %w", err)
+	}
+	return master, slave, nil
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// MakeRaw puts the terminal on fd in raw mode and returns a function that
+// restores its previous state.
+func MakeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { _ = unix.IoctlSetTermios(fd, unix.TCSETS, old) }, nil
+}
+
+// resizePty copies the window size of the terminal on fd to the pty.
+func resizePty(master *os.File, fd int) {
+	if ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+		_ = unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, ws)
+	}
+}
+
+// attachPty connects our stdio to the pty master until the process on the
+// other side closes it. When stdin is a terminal it is switched to raw mode
+// and window size changes are forwarded. The returned function waits for
+// the output to drain and restores the terminal.
+func attachPty(master *os.File) func() {
+	stdinFd := int(os.Stdin.Fd())
+	restore := func() {}
+	if r, err := MakeRaw(stdinFd); err == nil {
+		restore = r
+		resizePty(master, stdinFd)
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			resizePty(master, stdinFd)
+		}
+	}()
+
+	go func() { _, _ = io.Copy(master, os.Stdin) }()
+	done := make(chan struct{})
+	go func() {
+		// Reading the master fails with EIO once the slave is closed.
+		_, _ = io.Copy(os.Stdout, master)
+		close(done)
+	}()
+
+	return func() {
+		<-done
+		signal.Stop(winch)
+		close(winch)
+		restore()
+	}
+}
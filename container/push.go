@@ -0,0 +1,216 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// Images are pushed with the registry HTTP API too: the config and layers
+// the registry doesn't have yet, then the manifest. A blob of another
+// repository of the same registry, such as the one the image was pulled
+// from, is mounted from it without being uploaded, as far as the registry
+// and the credentials allow. Others are uploaded in chunks of
+// pushChunkSize. The manifest pushed is that of the platform of the image,
+// so an image pulled through an index is pushed without it.
+
+// pushChunkSize is the size of the chunks of blob uploads. It is a
+// variable so tests can override it.
+var pushChunkSize = 8 << 20
+
+// PushImage pushes the image src of the store to the reference dest, src
+// itself if empty, and returns the reference pushed with the digest of
+// its manifest.
+func PushImage(ctx context.Context, src, dest string) (ImageRef, error) {
+	img, err := LoadImage(src)
+	if err != nil {
+		return ImageRef{}, err
+	}
+	if dest == "" {
+		dest = img.Ref
+	}
+	r, err := ParseImageRef(dest)
+	if err != nil {
+		return ImageRef{}, err
+	}
+	if r.Digest != "" && r.Digest != img.Digest {
+		return ImageRef{}, fmt.Errorf("can't push %s as %s: its manifest has digest %s", img.Ref, r, img.Digest)
+	}
+	data, err := readBlob(img.Digest)
+	if err != nil {
+		return ImageRef{}, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ImageRef{}, fmt.Errorf("invalid manifest of %s: %w", img.Ref, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = mediaTypeOCIManifest
+	}
+
+	c := newRegistryClient(r)
+	c.scopes = []string{"repository:" + r.Repository + ":pull,push"}
+	var from string
+	if s, err := ParseImageRef(img.Ref); err == nil && s.Registry == r.Registry && s.Repository != r.Repository {
+		from = s.Repository
+		c.scopes = append(c.scopes, "repository:"+from+":pull")
+	}
+	if err := c.pickBase(ctx); err != nil {
+		return ImageRef{}, fmt.Errorf("failed to push %s: %w", r, err)
+	}
+	for _, d := range append([]string{img.ID}, layerDigests(img)...) {
+		if err := c.pushBlob(ctx, d, from); err != nil {
+			return ImageRef{}, fmt.Errorf("failed to push blob %s of %s: %w", d, r, err)
+		}
+	}
+	header := http.Header{"Content-Type": {m.MediaType}}
+	resp, err := c.send(ctx, http.MethodPut, c.url(c.bases[0], "manifests/"+r.reference()), header, data)
+	if err != nil {
+		return ImageRef{}, fmt.Errorf("failed to push the manifest of %s: %w", r, err)
+	}
+	if err := expectStatus(resp, http.StatusCreated); err != nil {
+		return ImageRef{}, fmt.Errorf("failed to push the manifest of %s: %w", r, err)
+	}
+	r.Digest = img.Digest
+	return r, nil
+}
+
+// layerDigests returns the digests of the layers of img.
+func layerDigests(img *Image) []string {
+	digests := make([]string, 0, len(img.Layers))
+	for _, l := range img.Layers {
+		digests = append(digests, l.Digest)
+	}
+	return digests
+}
+
+// pickBase keeps the first base of the registry that answers, as a push
+// goes to the registry itself and not to its mirrors.
+func (c *registryClient) pickBase(ctx context.Context) error {
+	if c.ref.Registry == defaultRegistry {
+		c.bases = c.bases[len(registryConfig.Mirrors):]
+	}
+	var errs []error
+	for _, base := range c.bases {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v2/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Body.Close()
+		c.bases = []string{base}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// pushBlob uploads the blob digest of the store unless the repository has
+// it or it can be mounted from the repository from.
+func (c *registryClient) pushBlob(ctx context.Context, digest, from string) error {
+	base := c.bases[0]
+	resp, err := c.send(ctx, http.MethodHead, c.url(base, "blobs/"+digest), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	path := "blobs/uploads/"
+	if from != "" {
+		path += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	}
+	resp, err = c.send(ctx, http.MethodPost, c.url(base, path), nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusCreated {
+		// Mounted.
+		resp.Body.Close()
+		return nil
+	}
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(blobPath(digest))
+	if err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", digest, err)
+	}
+	defer f.Close()
+	chunk := make([]byte, pushChunkSize)
+	for offset := 0; ; {
+		n, readErr := io.ReadFull(f, chunk)
+		if n > 0 {
+			header := http.Header{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("%d-%d", offset, offset+n-1)},
+			}
+			resp, err := c.send(ctx, http.MethodPatch, location.String(), header, chunk[:n])
+			if err != nil {
+				return err
+			}
+			if location, err = uploadLocation(resp); err != nil {
+				return err
+			}
+			offset += n
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("failed to read blob %s: %w", digest, readErr)
+		}
+	}
+
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+	resp, err = c.send(ctx, http.MethodPut, location.String(), http.Header{"Content-Type": {"application/octet-stream"}}, nil)
+	if err != nil {
+		return err
+	}
+	return expectStatus(resp, http.StatusCreated)
+}
+
+// uploadLocation returns where an upload continues after resp, which must
+// have accepted its request.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	if err := expectStatus(resp, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: no upload location: %w", resp.Request.Method, resp.Request.URL, err)
+	}
+	return location, nil
+}
+
+// expectStatus closes the body of resp and checks it has status.
+func expectStatus(resp *http.Response, status int) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == status {
+		return nil
+	}
+	var body struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+	if json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&body) == nil && len(body.Errors) > 0 {
+		err = fmt.Errorf("%w: %s", err, body.Errors[0].Message)
+	}
+	return err
+}
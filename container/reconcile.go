@@ -0,0 +1,337 @@
+package container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A runtime that crashes, or a host that loses processes behind its back,
+// leaves state that no longer matches the system: containers recorded as
+// running whose init process is gone, state dirs without a container, host
+// mounts, veth links and NAT tables nothing uses anymore. Reconcile finds
+// and repairs them.
+
+// reconcileGrace is how old a container without an init process or a
+// state dir without a container must be before Reconcile treats it as
+// left over, so it doesn't race a container being created.
+const reconcileGrace = time.Minute
+
+// sysClassNet lists the network links of the host. It is a variable so
+// tests can override it.
+var sysClassNet = "/sys/class/net"
+
+// Repair is an inconsistency Reconcile fixed.
+type Repair struct {
+	// Kind is what was repaired: "container", "state-dir", "mount",
+	// "veth", "nat-table" or "lease".
+	Kind string `json:"kind"`
+	// Name is the container id, path, link or table repaired.
+	Name string `json:"name"`
+	// Action is what was done about it.
+	Action string `json:"action"`
+}
+
+// Reconcile brings the saved state of the containers in line with the
+// host and garbage collects what stopped containers left behind, and the
+// address leases of containers that are gone. It
+// returns the repairs made; failed repairs are joined in the error and
+// don't stop the others.
+func Reconcile() ([]Repair, error) {
+	var repairs []Repair
+	var errs []error
+
+	s, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := s.List(StateFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Containers whose init process is gone or was replaced.
+	for _, c := range containers {
+		if !stale(c) {
+			continue
+		}
+		err := updateState(c.Id, func(s *Container) error {
+			s.Status = Stopped
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c.Status = Stopped
+		releaseResources(c)
+		repairs = append(repairs, Repair{Kind: "container", Name: c.Id, Action: "marked stopped and released its resources"})
+	}
+
+	// Mounts under the state dirs and root filesystems of stopped
+	// containers, including state dirs without a container.
+	// A root filesystem shared with a live container is left alone.
+	live := map[string]bool{}
+	for _, c := range containers {
+		if c.Status != Stopped {
+			live[c.Rootfs] = true
+		}
+	}
+	var dirs []string
+	for _, c := range containers {
+		if c.Status != Stopped {
+			continue
+		}
+		dirs = append(dirs, StateDir(c.Id))
+		if c.Rootfs != "" && !live[c.Rootfs] {
+			dirs = append(dirs, c.Rootfs)
+		}
+	}
+	orphans, err := orphanStateDirs(s)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	dirs = append(dirs, orphans...)
+	mounts, err := mountsBelow(dirs)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, mp := range mounts {
+		if err := unix.Unmount(mp, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+			errs = append(errs, fmt.Errorf("failed to unmount %s: %w", mp, err))
+			continue
+		}
+		repairs = append(repairs, Repair{Kind: "mount", Name: mp, Action: "unmounted"})
+	}
+	for _, dir := range orphans {
+		if err := os.RemoveAll(dir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove %s: %w", dir, err))
+			continue
+		}
+		repairs = append(repairs, Repair{Kind: "state-dir", Name: dir, Action: "removed"})
+	}
+
+	// Address leases of containers that are gone, and addresses several
+	// running containers claim, which can't be repaired by releasing one.
+	leases, err := s.Leases("")
+	if err != nil {
+		errs = append(errs, err)
+	}
+	ids := map[string]bool{}
+	for _, c := range containers {
+		ids[c.Id] = true
+	}
+	released := map[string]bool{}
+	for _, l := range leases {
+		if ids[l.Container] || released[l.Container] {
+			continue
+		}
+		released[l.Container] = true
+		gone, err := s.Release(l.Container)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, g := range gone {
+			repairs = append(repairs, Repair{Kind: "lease", Name: g.Network + "/" + g.Address, Action: "released, container " + g.Container + " is gone"})
+		}
+	}
+	conflicts := addressConflicts(containers)
+	for _, key := range sortedLeases(conflicts) {
+		errs = append(errs, fmt.Errorf("address %s of network %s is used by containers %s", key.Address, key.Network, strings.Join(conflicts[key], ", ")))
+	}
+
+	// Host network resources of containers and networks that are gone.
+	networks, err := ListNetworks()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	bridges := map[string]bool{}
+	for _, n := range networks {
+		bridges[n.Bridge] = true
+	}
+	veths, err := danglingVeths(bridges)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, name := range veths {
+		if err := linkDel(name); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		repairs = append(repairs, Repair{Kind: "veth", Name: name, Action: "deleted"})
+	}
+	if _, err := exec.LookPath(nftBinary); err == nil {
+		tables, err := orphanNatTables(bridges)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, t := range tables {
+			if err := runNft(fmt.Sprintf("delete table ip %s\n", t)); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			repairs = append(repairs, Repair{Kind: "nat-table", Name: t, Action: "deleted"})
+		}
+	}
+
+	return repairs, errors.Join(errs...)
+}
+
+// stale reports whether the saved state of c claims an init process that
+// isn't there. A container saved before its init process was started only
+// counts once it is older than reconcileGrace.
+func stale(c *Container) bool {
+	if c.Status == Stopped {
+		return false
+	}
+	if c.InitProcessPiD == 0 {
+		return time.Since(c.CreatedAt) > reconcileGrace
+	}
+	return !initAlive(c)
+}
+
+// orphanStateDirs returns the dirs under the base state dir that belong to
+// no container and haven't changed within reconcileGrace.
+func orphanStateDirs(s StateStore) ([]string, error) {
+	entries, err := os.ReadDir(baseStateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state dir: %w", err)
+	}
+	var orphans []string
+	for _, e := range entries {
+		// Ids don't start with a dot, such dirs are the runtime's own.
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if _, err := s.Load(e.Name()); !errors.Is(err, ErrNotFound) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < reconcileGrace {
+			continue
+		}
+		orphans = append(orphans, filepath.Join(baseStateDir, e.Name()))
+	}
+	return orphans, nil
+}
+
+// mountsBelow returns the mount points strictly below any of dirs, the
+// deepest first so they can be unmounted in order.
+func mountsBelow(dirs []string) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	f, err := os.Open(mountinfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// id parent major:minor root mountpoint options optional... - ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		mp := unescapeMountinfo(fields[4])
+		for _, dir := range dirs {
+			if strings.HasPrefix(mp, filepath.Clean(dir)+"/") {
+				mounts = append(mounts, mp)
+				break
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	// Later mounts may sit on top of earlier ones, so undo them first.
+	slices.Reverse(mounts)
+	return mounts, nil
+}
+
+// unescapeMountinfo decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes in paths.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// danglingVeths returns the host ends of container veth pairs on one of
+// bridges that have lost their peer.
+func danglingVeths(bridges map[string]bool) ([]string, error) {
+	entries, err := os.ReadDir(sysClassNet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network links: %w", err)
+	}
+	var veths []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, "veth") {
+			continue
+		}
+		master, err := os.Readlink(filepath.Join(sysClassNet, name, "master"))
+		if err != nil || !bridges[filepath.Base(master)] {
+			continue
+		}
+		state, err := os.ReadFile(filepath.Join(sysClassNet, name, "operstate"))
+		if err != nil || strings.TrimSpace(string(state)) == "up" {
+			continue
+		}
+		veths = append(veths, name)
+	}
+	return veths, nil
+}
+
+// orphanNatTables returns the NAT tables of networks whose bridge isn't
+// one of bridges.
+func orphanNatTables(bridges map[string]bool) ([]string, error) {
+	out, err := exec.Command(nftBinary, "list", "tables", "ip").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables tables: %w", err)
+	}
+	return parseNatTables(string(out), bridges), nil
+}
+
+// parseNatTables picks the tables of unknown bridges out of the output of
+// "nft list tables".
+func parseNatTables(out string, bridges map[string]bool) []string {
+	var tables []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "table" || fields[1] != "ip" {
+			continue
+		}
+		bridge, ok := strings.CutPrefix(fields[2], natTablePrefix)
+		if ok && bridge != "" && !bridges[bridge] {
+			tables = append(tables, fields[2])
+		}
+	}
+	return tables
+}
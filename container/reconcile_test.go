@@ -0,0 +1,149 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReconcile(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	tempNetworksDir(t)
+	origSys, origMountinfo, origNft := sysClassNet, mountinfoPath, nftBinary
+	sysClassNet = t.TempDir()
+	mountinfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	nftBinary = "containish-no-nft"
+	defer func() { sysClassNet, mountinfoPath, nftBinary = origSys, origMountinfo, origNft }()
+	if err := os.WriteFile(mountinfoPath, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	self := os.Getpid()
+	start, err := processStartTime(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, c := range []*Container{
+		{Id: "exited", Status: Running, InitProcessPiD: exited.Process.Pid, CreatedAt: now},
+		{Id: "reused", Status: Running, InitProcessPiD: self, InitStartTime: start + 1, CreatedAt: now},
+		{Id: "alive", Status: Running, InitProcessPiD: self, InitStartTime: start, CreatedAt: now},
+		{Id: "creating", Status: Created, CreatedAt: now},
+		{Id: "abandoned", Status: Created, CreatedAt: now.Add(-time.Hour)},
+	} {
+		if err := saveState(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"orphan", "fresh"} {
+		if err := os.Mkdir(StateDir(dir), 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := now.Add(-time.Hour)
+	if err := os.Chtimes(StateDir("orphan"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	repairs, err := Reconcile()
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	var got []string
+	for _, r := range repairs {
+		got = append(got, r.Kind+" "+filepath.Base(r.Name))
+	}
+	slices.Sort(got)
+	want := []string{"container abandoned", "container exited", "container reused", "state-dir orphan"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("repairs = %v, want %v", got, want)
+	}
+	for id, status := range map[string]Status{"exited": Stopped, "reused": Stopped, "abandoned": Stopped, "alive": Running, "creating": Created} {
+		c, err := LoadState(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Status != status {
+			t.Errorf("%s is %v, want %v", id, c.Status, status)
+		}
+	}
+	if _, err := os.Stat(StateDir("fresh")); err != nil {
+		t.Fatalf("a fresh state dir was removed: %v", err)
+	}
+
+	if repairs, err := Reconcile(); err != nil || len(repairs) != 0 {
+		t.Fatalf("second Reconcile = %v, %v, want nothing to repair", repairs, err)
+	}
+}
+
+func TestMountsBelow(t *testing.T) {
+	orig := mountinfoPath
+	mountinfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	defer func() { mountinfoPath = orig }()
+	data := `22 1 0:21 / / rw shared:1 - ext4 /dev/sda1 rw
+30 22 0:30 / /run/miniruntime/c1 rw - tmpfs tmpfs rw
+31 30 0:31 / /run/miniruntime/c1/shm rw - tmpfs tmpfs rw
+32 22 8:1 /data /srv/my\040rootfs/data rw - ext4 /dev/sda1 rw
+33 32 0:32 / /srv/my\040rootfs/data/proc rw - proc proc rw
+34 22 0:33 / /run/miniruntime/c10/shm rw - tmpfs tmpfs rw
+`
+	if err := os.WriteFile(mountinfoPath, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := mountsBelow([]string{"/run/miniruntime/c1", "/srv/my rootfs/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/srv/my rootfs/data/proc", "/srv/my rootfs/data", "/run/miniruntime/c1/shm"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("mountsBelow = %q, want %q", got, want)
+	}
+}
+
+func TestDanglingVeths(t *testing.T) {
+	orig := sysClassNet
+	sysClassNet = t.TempDir()
+	defer func() { sysClassNet = orig }()
+	link := func(name, master, state string) {
+		dir := filepath.Join(sysClassNet, name)
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if master != "" {
+			if err := os.Symlink("../"+master, filepath.Join(dir, "master")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeFile(t, filepath.Join(dir, "operstate"), state+"\n", 0o644)
+	}
+	link("vethaaaa", "containish0", "up")
+	link("vethbbbb", "containish0", "lowerlayerdown")
+	link("vethcccc", "docker0", "down")
+	link("vethdddd", "", "down")
+	link("eth0", "containish0", "down")
+
+	got, err := danglingVeths(map[string]bool{"containish0": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"vethbbbb"}) {
+		t.Fatalf("danglingVeths = %v", got)
+	}
+}
+
+func TestParseNatTables(t *testing.T) {
+	out := "table ip containish-containish0\ntable ip containish-br-0123456789ab\ntable ip nat\ntable inet containish\n"
+	got := parseNatTables(out, map[string]bool{"containish0": true})
+	if !slices.Equal(got, []string{"containish-br-0123456789ab"}) {
+		t.Fatalf("parseNatTables = %v", got)
+	}
+}
@@ -0,0 +1,401 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Images are pulled with the registry HTTP API: the manifest of the
+// reference, resolved through an index to the manifest of the platform,
+// then its config and layers, each checked against its digest. Registry
+// mirrors are tried before Docker Hub, and insecure registries are reached
+// without TLS verification, falling back to plain HTTP. Registries are
+// reached anonymously unless the auth file has credentials for them.
+
+// Media types of manifests.
+const (
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// maxManifestSize bounds manifests and token responses.
+const maxManifestSize = 4 << 20
+
+// registryTimeout bounds each request to a registry, layer downloads
+// included. It is a variable so tests can override it.
+var registryTimeout = 10 * time.Minute
+
+// registryConfig holds the registry settings of the configuration.
+var registryConfig RegistryConfig
+
+// manifest is an image manifest or an index of them.
+type manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    Descriptor   `json:"config"`
+	Layers    []Descriptor `json:"layers"`
+	Manifests []struct {
+		Descriptor
+		Platform struct {
+			Architecture string `json:"architecture"`
+			OS           string `json:"os"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// imageConfigFile is the config blob of an image.
+type imageConfigFile struct {
+	Architecture string      `json:"architecture"`
+	OS           string      `json:"os"`
+	Config       ImageConfig `json:"config"`
+}
+
+// registryClient talks to the registry of an image.
+type registryClient struct {
+	ref ImageRef
+	// bases are the URLs tried in order, the mirrors then the registry.
+	bases  []string
+	client *http.Client
+	// scopes are the access a token is asked for, pulling the repository
+	// unless pushing to it.
+	scopes []string
+	token  string
+	// basic holds the credentials of the auth file when the registry
+	// takes them as they are.
+	basic *url.Userinfo
+}
+
+func newRegistryClient(ref ImageRef) *registryClient {
+	host := ref.Registry
+	if h, ok := registryHosts[host]; ok {
+		host = h
+	}
+	c := &registryClient{
+		ref:    ref,
+		client: &http.Client{Timeout: registryTimeout},
+		scopes: []string{"repository:" + ref.Repository + ":pull"},
+	}
+	if ref.Registry == defaultRegistry {
+		for _, m := range registryConfig.Mirrors {
+			c.bases = append(c.bases, strings.TrimSuffix(m, "/"))
+		}
+	}
+	if slices.Contains(registryConfig.Insecure, ref.Registry) {
+		c.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		c.bases = append(c.bases, "https://"+host, "http://"+host)
+	} else {
+		c.bases = append(c.bases, "https://"+host)
+	}
+	return c
+}
+
+// url returns the URL of path in the repository at base.
+func (c *registryClient) url(base, path string) string {
+	return base + "/v2/" + c.ref.Repository + "/" + path
+}
+
+// get fetches path from the first base that serves it.
+func (c *registryClient) get(ctx context.Context, path string, accept ...string) (*http.Response, error) {
+	var errs []error
+	for _, base := range c.bases {
+		resp, err := c.getFrom(ctx, base, path, accept)
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *registryClient) getFrom(ctx context.Context, base, path string, accept []string) (*http.Response, error) {
+	header := http.Header{}
+	for _, a := range accept {
+		header.Add("Accept", a)
+	}
+	resp, err := c.send(ctx, http.MethodGet, c.url(base, path), header, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", resp.Request.URL, resp.Status)
+	}
+	return resp, nil
+}
+
+// send sends a request to target and returns the response, whatever its
+// status. A registry asking for authentication gets it, and the request
+// again with body.
+func (c *registryClient) send(ctx context.Context, method, target string, header http.Header, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		} else if c.basic != nil {
+			password, _ := c.basic.Password()
+			req.SetBasicAuth(c.basic.Username(), password)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			if err := c.authenticate(ctx, resp.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// authenticate answers the challenge of the registry: with a bearer token
+// for the scopes of the client, asked for anonymously unless the auth file
+// has credentials for the registry, or with those credentials themselves.
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	user, password, ok, err := registryCredentials(c.ref.Registry)
+	if err != nil {
+		return err
+	}
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if strings.EqualFold(scheme, "Basic") {
+		if !ok {
+			return fmt.Errorf("registry %s requires credentials, and the auth file has none for it", c.ref.Registry)
+		}
+		c.basic = url.UserPassword(user, password)
+		return nil
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("registry %s requires %q authentication, which isn't supported", c.ref.Registry, scheme)
+	}
+	attrs := map[string]string{}
+	for _, p := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		attrs[k] = strings.Trim(v, `"`)
+	}
+	u, err := url.Parse(attrs["realm"])
+	if err != nil || attrs["realm"] == "" {
+		return fmt.Errorf("registry %s sent an invalid authentication challenge %q", c.ref.Registry, challenge)
+	}
+	q := u.Query()
+	if s := attrs["service"]; s != "" {
+		q.Set("service", s)
+	}
+	for _, s := range c.scopes {
+		q.Add("scope", s)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if ok {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get a token for %s: %w", c.ref.Registry, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get a token for %s: %s", c.ref.Registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return fmt.Errorf("invalid token from %s: %w", c.ref.Registry, err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// getManifest fetches the manifest or index reference and returns it with
+// its digest, which must be want if set.
+func (c *registryClient) getManifest(ctx context.Context, reference, want string) (*manifest, string, error) {
+	resp, err := c.get(ctx, "manifests/"+reference,
+		mediaTypeOCIIndex, mediaTypeDockerList, mediaTypeOCIManifest, mediaTypeDockerManifest)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest of %s is too large", c.ref)
+	}
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if want != "" && digest != want {
+		return nil, "", fmt.Errorf("manifest of %s has digest %s, expected %s", c.ref, digest, want)
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, "", fmt.Errorf("invalid manifest of %s: %w", c.ref, err)
+	}
+	if m.MediaType == "" {
+		m.MediaType = resp.Header.Get("Content-Type")
+	}
+	if err := writeBlob(digest, bytes.NewReader(data)); err != nil {
+		return nil, "", err
+	}
+	return &m, digest, nil
+}
+
+// fetchBlob saves the blob d unless the store has it, reporting its
+// download as a layer to report, if any.
+func (c *registryClient) fetchBlob(ctx context.Context, d Descriptor, report *progressReporter) error {
+	if !digestRe.MatchString(d.Digest) {
+		return fmt.Errorf("unsupported blob digest %q", d.Digest)
+	}
+	if hasBlob(d.Digest) {
+		report.layerDone(d)
+		return nil
+	}
+	resp, err := c.get(ctx, "blobs/"+d.Digest)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := writeBlob(d.Digest, report.watchLayer(d, resp.Body)); err != nil {
+		return err
+	}
+	report.layerDone(d)
+	return nil
+}
+
+// PullImage pulls the image ref for arch, a GOARCH, into the store and
+// returns it. The PhasePull events of the pull, which have no Container,
+// are sent to progress if not nil.
+func PullImage(ctx context.Context, ref, arch string, progress ProgressFunc) (*Image, error) {
+	return pullImage(ctx, ref, arch, newProgressReporter("", progress))
+}
+
+// pullImage is PullImage reporting the pull to report, if any.
+func pullImage(ctx context.Context, ref, arch string, report *progressReporter) (*Image, error) {
+	r, err := ParseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+	if arch == "" {
+		arch = hostArch
+	}
+	c := newRegistryClient(r)
+	m, digest, err := c.getManifest(ctx, r.reference(), r.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull %s: %w", r, err)
+	}
+	if m.MediaType == mediaTypeOCIIndex || m.MediaType == mediaTypeDockerList || len(m.Manifests) > 0 {
+		var found *Descriptor
+		for i, e := range m.Manifests {
+			if imagePlatformOS(e.Platform.OS, arch) && e.Platform.Architecture == arch {
+				found = &m.Manifests[i].Descriptor
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("image %s has no %s variant", r, platformName(arch))
+		}
+		if m, digest, err = c.getManifest(ctx, found.Digest, found.Digest); err != nil {
+			return nil, fmt.Errorf("failed to pull %s: %w", r, err)
+		}
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("failed to pull %s: unsupported manifest type %q", r, m.MediaType)
+	}
+
+	if err := c.fetchBlob(ctx, m.Config, nil); err != nil {
+		return nil, fmt.Errorf("failed to pull the config of %s: %w", r, err)
+	}
+	data, err := readBlob(m.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var cfg imageConfigFile
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid config of %s: %w", r, err)
+	}
+	if cfg.OS != "" && !imagePlatformOS(cfg.OS, arch) || cfg.Architecture != "" && cfg.Architecture != arch {
+		return nil, fmt.Errorf("image %s is for %s/%s, not %s", r, cfg.OS, cfg.Architecture, platformName(arch))
+	}
+	goos, _, _ := strings.Cut(platformName(arch), "/")
+	if cfg.OS != "" {
+		goos = cfg.OS
+	}
+	img := &Image{
+		Ref:          r.String(),
+		Digest:       digest,
+		ID:           m.Config.Digest,
+		Architecture: arch,
+		OS:           goos,
+		Config:       cfg.Config,
+		Layers:       m.Layers,
+		PulledAt:     time.Now(),
+	}
+	report.started(PhasePull)
+	for _, l := range m.Layers {
+		if strings.Contains(l.MediaType, "zstd") {
+			return nil, fmt.Errorf("image %s has zstd layers, which aren't supported", r)
+		}
+		if err := c.fetchBlob(ctx, l, report); err != nil {
+			return nil, fmt.Errorf("failed to pull layer %s of %s: %w", l.Digest, r, err)
+		}
+		img.Size += l.Size
+	}
+	err = withImagesLock(func() error {
+		images, err := loadImages()
+		if err != nil {
+			return err
+		}
+		if old, ok := images[img.Ref]; ok {
+			// Pulling it again keeps it pinned.
+			img.Pinned = old.Pinned
+		}
+		images[img.Ref] = img
+		return saveImages(images)
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.done(PhasePull)
+	return img, nil
+}
+
+// readBlob returns the content of the blob digest.
+func readBlob(digest string) ([]byte, error) {
+	data, err := os.ReadFile(blobPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", digest, err)
+	}
+	return data, nil
+}
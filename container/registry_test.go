@@ -0,0 +1,421 @@
+package container
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRegistry serves the image app:v1, an index of a linux/amd64 image of
+// one layer, anonymously with a bearer token. Pushing takes the
+// credentials user:password, with blobs uploaded in chunks or mounted from
+// another repository.
+type testRegistry struct {
+	*httptest.Server
+	blobs map[string][]byte
+	// repos are the blobs of each repository, and tags its manifests by
+	// tag.
+	repos   map[string]map[string]bool
+	tags    map[string]map[string][]byte
+	uploads map[string][]byte
+	pulls   int
+	chunks  int
+	mounts  int
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	r := &testRegistry{
+		blobs:   map[string][]byte{},
+		repos:   map[string]map[string]bool{"app": {}},
+		uploads: map[string][]byte{},
+	}
+	add := func(data []byte) string {
+		d := digestOf(data)
+		r.blobs[d] = data
+		r.repos["app"][d] = true
+		return d
+	}
+	mustJSON := func(v any) []byte {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	l := layer(t, &tar.Header{Name: "bin/app", Typeflag: tar.TypeReg, Linkname: "app", Mode: 0o755})
+	config := mustJSON(map[string]any{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]any{"Cmd": []string{"/bin/app"}, "Env": []string{"PATH=/bin"}},
+	})
+	m := mustJSON(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIManifest,
+		"config":        Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: add(config), Size: int64(len(config))},
+		"layers":        []Descriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: add(l), Size: int64(len(l))}},
+	})
+	index := mustJSON(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     mediaTypeOCIIndex,
+		"manifests": []map[string]any{{
+			"mediaType": mediaTypeOCIManifest,
+			"digest":    add(m),
+			"size":      len(m),
+			"platform":  map[string]string{"os": "linux", "architecture": "amd64"},
+		}},
+	})
+	r.tags = map[string]map[string][]byte{"app": {"v1": index}}
+
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/token" {
+			token := "secret"
+			for _, scope := range req.URL.Query()["scope"] {
+				_, access, _ := strings.Cut(strings.TrimPrefix(scope, "repository:"), ":")
+				if !strings.HasPrefix(scope, "repository:") || access != "pull" && access != "pull,push" {
+					http.Error(w, "bad scope", http.StatusBadRequest)
+					return
+				}
+				if access == "pull,push" {
+					if user, password, _ := req.BasicAuth(); user != "user" || password != "password" {
+						w.WriteHeader(http.StatusUnauthorized)
+						return
+					}
+					token = "push-secret"
+				}
+			}
+			w.Write([]byte(`{"token":"` + token + `"}`))
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		write := req.Method != http.MethodGet && req.Method != http.MethodHead
+		if auth != "Bearer push-secret" && (write || auth != "Bearer secret") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Path == "/v2/" {
+			return
+		}
+		name, path, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		if r.repos[name] == nil {
+			r.repos[name], r.tags[name] = map[string]bool{}, map[string][]byte{}
+		}
+		if id, ok := strings.CutPrefix(path, "blobs/uploads/"); ok {
+			r.serveUpload(w, req, name, id)
+			return
+		}
+		if ref, ok := strings.CutPrefix(path, "manifests/"); ok {
+			if req.Method == http.MethodPut {
+				data, _ := io.ReadAll(req.Body)
+				if req.Header.Get("Content-Type") != mediaTypeOCIManifest {
+					http.Error(w, "bad media type", http.StatusBadRequest)
+					return
+				}
+				r.blobs[digestOf(data)] = data
+				r.tags[name][ref] = data
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			data, ok := r.tags[name][ref]
+			if !ok {
+				data, ok = r.blobs[ref]
+			}
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(data)
+			return
+		}
+		if d, ok := strings.CutPrefix(path, "blobs/"); ok {
+			data, ok := r.blobs[d]
+			if !ok || !r.repos[name][d] {
+				http.NotFound(w, req)
+				return
+			}
+			if req.Method == http.MethodGet {
+				r.pulls++
+				w.Write(data)
+			}
+			return
+		}
+		http.NotFound(w, req)
+	}))
+	t.Cleanup(r.Close)
+
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := registryConfig
+	registryConfig = RegistryConfig{Insecure: []string{u.Host}, AuthFile: filepath.Join(t.TempDir(), "auth.json")}
+	t.Cleanup(func() { registryConfig = old })
+	return r
+}
+
+// serveUpload serves the upload id of a blob to repository name, starting
+// it, or mounting the blob, when id is empty.
+func (r *testRegistry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	q := req.URL.Query()
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		if d, from := q.Get("mount"), q.Get("from"); d != "" && r.repos[from][d] {
+			r.repos[name][d] = true
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		id = fmt.Sprint(len(r.uploads) + 1)
+		r.uploads[id] = []byte{}
+	case req.Method == http.MethodPatch && r.uploads[id] != nil:
+		data, _ := io.ReadAll(req.Body)
+		if want := fmt.Sprintf("%d-%d", len(r.uploads[id]), len(r.uploads[id])+len(data)-1); req.Header.Get("Content-Range") != want {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(r.uploads[id], data...)
+		r.chunks++
+	case req.Method == http.MethodPut && r.uploads[id] != nil:
+		data, _ := io.ReadAll(req.Body)
+		data = append(r.uploads[id], data...)
+		if d := q.Get("digest"); d != digestOf(data) {
+			http.Error(w, "digest mismatch", http.StatusBadRequest)
+			return
+		}
+		r.blobs[digestOf(data)] = data
+		r.repos[name][digestOf(data)] = true
+		delete(r.uploads, id)
+		w.WriteHeader(http.StatusCreated)
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	// Relative, as registries send it, with state of its own.
+	w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id+"?state="+fmt.Sprint(len(r.uploads[id])))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (r *testRegistry) ref(name string) string {
+	return strings.TrimPrefix(r.URL, "http://") + "/" + name
+}
+
+func TestPullImageProgress(t *testing.T) {
+	tempImages(t)
+	r := newTestRegistry(t)
+
+	var events []ProgressEvent
+	progress := func(e ProgressEvent) { events = append(events, e) }
+	img, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := img.Layers[0]
+	var got []string
+	for _, e := range events {
+		if e.Phase != PhasePull || e.Container != "" {
+			t.Errorf("event %+v of another phase or of a container", e)
+		}
+		got = append(got, e.Status+" "+e.Layer)
+		if e.Layer != "" && e.Total != layer.Size {
+			t.Errorf("layer event %+v, want a total of %d", e, layer.Size)
+		}
+	}
+	want := []string{"started ", "started " + layer.Digest, "done " + layer.Digest, "done "}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("events %q, want %q", got, want)
+	}
+	if e := events[2]; e.Current != layer.Size {
+		t.Errorf("layer done %+v, want all of it downloaded", e)
+	}
+
+	// Layers in the store are only done.
+	events = nil
+	if _, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", progress); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[1].Status != ProgressDone || events[1].Layer != layer.Digest {
+		t.Errorf("events of a pull from the store %+v", events)
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	tempImages(t)
+	r := newTestRegistry(t)
+
+	img, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Ref != r.ref("app:v1") || img.Architecture != "amd64" || len(img.Layers) != 1 {
+		t.Errorf("unexpected image %+v", img)
+	}
+	if got := img.Config.Cmd; len(got) != 1 || got[0] != "/bin/app" {
+		t.Errorf("expected the command of the image config, got %q", got)
+	}
+	if loaded, err := LoadImage(r.ref("app:v1")); err != nil || loaded.Digest != img.Digest {
+		t.Errorf("expected the image in the store, got %+v, %v", loaded, err)
+	}
+	for _, d := range []string{img.Digest, img.ID, img.Layers[0].Digest} {
+		if !hasBlob(d) {
+			t.Errorf("expected blob %s in the store", d)
+		}
+	}
+
+	// The blobs in the store aren't fetched again.
+	pulls := r.pulls
+	if _, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.pulls != pulls {
+		t.Errorf("expected no blob to be fetched again, got %d fetches", r.pulls-pulls)
+	}
+
+	dir, err := unpackImage(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "bin/app")); err != nil || string(data) != "app" {
+		t.Errorf("bin/app = %q, %v", data, err)
+	}
+
+	if _, err := PullImage(context.Background(), r.ref("app:v1"), "arm64", nil); err == nil || !strings.Contains(err.Error(), "no linux/arm64 variant") {
+		t.Errorf("expected a missing platform error, got %v", err)
+	}
+	if _, err := PullImage(context.Background(), r.ref("app:v2"), "amd64", nil); err == nil {
+		t.Error("expected an error pulling a missing tag")
+	}
+}
+
+func TestPullImageRejectsTamperedBlobs(t *testing.T) {
+	tempImages(t)
+	r := newTestRegistry(t)
+	for d, data := range r.blobs {
+		if !strings.Contains(string(data), "schemaVersion") {
+			r.blobs[d] = append([]byte{}, append(data, 0)...)
+		}
+	}
+	if _, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", nil); err == nil || !strings.Contains(err.Error(), "has digest") {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+}
+
+// writeAuthFile saves credentials for the registry r in the auth file.
+func (r *testRegistry) writeAuthFile(t *testing.T, user, password string) {
+	t.Helper()
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	host := strings.TrimPrefix(r.URL, "http://")
+	writeFile(t, registryConfig.AuthFile, `{"auths":{"http://`+host+`/v2/":{"auth":"`+auth+`"}}}`, 0o600)
+}
+
+func TestPushImage(t *testing.T) {
+	tempImages(t)
+	r := newTestRegistry(t)
+	img, err := PullImage(context.Background(), r.ref("app:v1"), "amd64", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := PushImage(context.Background(), r.ref("app:v1"), r.ref("copy:v1")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected pushing without credentials to fail, got %v", err)
+	}
+	r.writeAuthFile(t, "user", "password")
+
+	// The blobs are mounted from the repository the image was pulled from.
+	pushed, err := PushImage(context.Background(), r.ref("app:v1"), r.ref("copy:v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pushed.String() != r.ref("copy:v1")+"@"+img.Digest {
+		t.Errorf("PushImage = %s", pushed)
+	}
+	if r.mounts != 2 || r.chunks != 0 {
+		t.Errorf("expected 2 mounts and no upload, got %d mounts and %d chunks", r.mounts, r.chunks)
+	}
+	if digestOf(r.tags["copy"]["v1"]) != img.Digest {
+		t.Errorf("expected the manifest of the image under copy:v1")
+	}
+
+	// They are uploaded in chunks when they can't be mounted.
+	old := pushChunkSize
+	pushChunkSize = 64
+	t.Cleanup(func() { pushChunkSize = old })
+	r.repos["app"] = map[string]bool{}
+	if _, err := PushImage(context.Background(), r.ref("app:v1"), r.ref("other:v1")); err != nil {
+		t.Fatal(err)
+	}
+	size := int(img.Layers[0].Size)
+	if want := (size+63)/64 + 1; r.chunks < want {
+		t.Errorf("expected at least %d chunks, got %d", want, r.chunks)
+	}
+	for _, d := range append([]string{img.ID}, layerDigests(img)...) {
+		if !r.repos["other"][d] {
+			t.Errorf("blob %s wasn't pushed", d)
+		}
+	}
+
+	// Blobs the repository has aren't uploaded again.
+	chunks := r.chunks
+	if _, err := PushImage(context.Background(), r.ref("app:v1"), r.ref("other:v2")); err != nil {
+		t.Fatal(err)
+	}
+	if r.chunks != chunks || r.tags["other"]["v2"] == nil {
+		t.Errorf("expected only the manifest to be pushed, got %d chunks", r.chunks-chunks)
+	}
+
+	if _, err := PushImage(context.Background(), r.ref("app:v1"), r.ref("other@sha256:"+strings.Repeat("0", 64))); err == nil {
+		t.Error("expected an error pushing to another digest")
+	}
+	if _, err := PushImage(context.Background(), r.ref("missing:v1"), ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound pushing a missing image, got %v", err)
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	old := registryConfig
+	t.Cleanup(func() { registryConfig = old })
+	registryConfig = RegistryConfig{AuthFile: filepath.Join(t.TempDir(), "auth.json")}
+
+	if _, _, ok, err := registryCredentials("ghcr.io"); ok || err != nil {
+		t.Fatalf("expected no credentials without an auth file, got %v, %v", ok, err)
+	}
+	hub := base64.StdEncoding.EncodeToString([]byte("hubuser:hub:pass"))
+	writeFile(t, registryConfig.AuthFile, `{"auths":{
+		"https://index.docker.io/v1/": {"auth": "`+hub+`"},
+		"ghcr.io": {"username": "gh", "password": "token"}
+	}}`, 0o600)
+	for _, c := range []struct {
+		registry, user, password string
+		ok                       bool
+	}{
+		{defaultRegistry, "hubuser", "hub:pass", true},
+		{"GHCR.io", "gh", "token", true},
+		{"quay.io", "", "", false},
+	} {
+		user, password, ok, err := registryCredentials(c.registry)
+		if err != nil || ok != c.ok || user != c.user || password != c.password {
+			t.Errorf("registryCredentials(%s) = %q, %q, %v, %v", c.registry, user, password, ok, err)
+		}
+	}
+
+	writeFile(t, registryConfig.AuthFile, `{"auths":{"ghcr.io":{"auth":"!"}}}`, 0o600)
+	if _, _, _, err := registryCredentials("ghcr.io"); err == nil {
+		t.Error("expected an error for an invalid auth")
+	}
+}
@@ -0,0 +1,97 @@
+package container
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Credentials for registries are read from an auth file in the format of
+// the Docker client's config.json, so that `docker login` fills it:
+//
+//	{"auths": {"ghcr.io": {"auth": "<base64 of user:password>"}}}
+//
+// The file is the auth_file of the registry settings, by default
+// $DOCKER_CONFIG/config.json or ~/.docker/config.json. Entries may also
+// have a username and password instead of auth, and keys may be URLs, as
+// https://index.docker.io/v1/ is for Docker Hub. Credential helpers aren't
+// supported.
+
+// dockerHubAuthKeys are the hosts Docker Hub credentials may be saved for.
+var dockerHubAuthKeys = []string{"index.docker.io", defaultRegistry, "registry-1.docker.io"}
+
+// authFile is the auth file of the Docker client format.
+type authFile struct {
+	Auths map[string]struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"auths"`
+}
+
+// authFilePath returns the auth file of the configuration, or the default
+// one of the Docker client, empty if there is none.
+func authFilePath() string {
+	if registryConfig.AuthFile != "" {
+		return registryConfig.AuthFile
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".docker", "config.json")
+	}
+	return ""
+}
+
+// registryCredentials returns the credentials the auth file has for
+// registry, if any. A missing auth file has none.
+func registryCredentials(registry string) (user, password string, ok bool, err error) {
+	path := authFilePath()
+	if path == "" {
+		return "", "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to read auth file: %w", err)
+	}
+	var file authFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return "", "", false, fmt.Errorf("invalid auth file %s: %w", path, err)
+	}
+	hosts := []string{registry}
+	if registry == defaultRegistry {
+		hosts = dockerHubAuthKeys
+	}
+	for key, entry := range file.Auths {
+		host := key
+		if _, rest, found := strings.Cut(host, "://"); found {
+			host = rest
+		}
+		host, _, _ = strings.Cut(host, "/")
+		if !slices.ContainsFunc(hosts, func(h string) bool { return strings.EqualFold(h, host) }) {
+			continue
+		}
+		if entry.Auth == "" {
+			return entry.Username, entry.Password, entry.Username != "", nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return "", "", false, fmt.Errorf("invalid auth of %s in %s: %w", key, path, err)
+		}
+		user, password, found := strings.Cut(string(decoded), ":")
+		if !found {
+			return "", "", false, fmt.Errorf("invalid auth of %s in %s: expected user:password", key, path)
+		}
+		return user, password, true, nil
+	}
+	return "", "", false, nil
+}
@@ -0,0 +1,238 @@
+package container
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// A container run with RunOptions.Requires depends on the containers it
+// lists, which are added to its AnnotationDependsOn annotation, so that
+// ShutdownAll and RestoreAll order it after them as they do with those the
+// spec lists. Whichever way they are listed, a container only runs once
+// the containers it depends on are running, or with
+// RunOptions.RequiresCondition once they are ready or healthy, waiting up
+// to RequiresTimeout for them, and a dependency closing a cycle is
+// refused. StartOrdered starts containers after the stopped ones they
+// require, and StopOrdered stops containers before those requiring them.
+
+// DefaultRequiresTimeout is how long a container waits for those it
+// requires to meet RunOptions.RequiresCondition, unless set otherwise.
+const DefaultRequiresTimeout = time.Minute
+
+// applyRequires adds the containers options requires to the
+// AnnotationDependsOn annotation of spec.
+func applyRequires(spec *specs.Spec, options *RunOptions) {
+	if len(options.Requires) == 0 {
+		return
+	}
+	deps := dependsOn(spec.Annotations)
+	for _, id := range options.Requires {
+		if !slices.Contains(deps, id) {
+			deps = append(deps, id)
+		}
+	}
+	if spec.Annotations == nil {
+		spec.Annotations = map[string]string{}
+	}
+	spec.Annotations[AnnotationDependsOn] = strings.Join(deps, ",")
+}
+
+// validateRequiresCondition checks the condition options gate a container
+// on.
+func validateRequiresCondition(options *RunOptions) error {
+	switch options.RequiresCondition {
+	case "", WaitReady, WaitHealthy:
+	default:
+		return fmt.Errorf("invalid requires condition %q: expected %s or %s", options.RequiresCondition, WaitReady, WaitHealthy)
+	}
+	if options.RequiresTimeout < 0 {
+		return fmt.Errorf("invalid requires timeout %v", options.RequiresTimeout)
+	}
+	return nil
+}
+
+// checkRequires returns once the containers deps that container id depends
+// on are running, or meet the RequiresCondition of options, and fails if
+// one doesn't exist, isn't running or doesn't meet the condition in time,
+// or depends on id itself.
+func checkRequires(ctx context.Context, id string, deps []string, options *RunOptions) error {
+	if len(deps) == 0 {
+		return nil
+	}
+	if cycle := requiresCycle(id, deps); cycle != nil {
+		return fmt.Errorf("container %s can't require %s, as they would form a cycle: %s", id, cycle[1], strings.Join(cycle, " -> "))
+	}
+	rt := &Runtime{cgroupManager: cmp.Or(options.CgroupManager, CgroupfsManager)}
+	for _, dep := range deps {
+		c, err := rt.State(dep)
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("container %s requires %s, which doesn't exist: %w", id, dep, err)
+		}
+		if err != nil {
+			return err
+		}
+		if options.RequiresCondition == "" {
+			if !c.Status.running() {
+				return fmt.Errorf("container %s requires %s, which is not running: %w", id, dep, ErrNotRunning)
+			}
+			continue
+		}
+		timeout := cmp.Or(options.RequiresTimeout, DefaultRequiresTimeout)
+		wait, cancel := context.WithTimeout(ctx, timeout)
+		_, err = rt.Wait(wait, dep, options.RequiresCondition)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			return fmt.Errorf("container %s requires %s, which isn't %s after %v", id, dep, options.RequiresCondition, timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("container %s requires %s: %w", id, dep, err)
+		}
+	}
+	return nil
+}
+
+// requiresCycle returns the cycle container id depending on deps would
+// close, starting and ending with id, following the AnnotationDependsOn
+// annotations of the containers, or nil if there is none.
+func requiresCycle(id string, deps []string) []string {
+	seen := map[string]bool{}
+	var visit func(path []string) []string
+	visit = func(path []string) []string {
+		cur := path[len(path)-1]
+		if cur == id {
+			return path
+		}
+		if seen[cur] {
+			return nil
+		}
+		seen[cur] = true
+		c, err := LoadState(cur)
+		if err != nil {
+			return nil
+		}
+		for _, d := range dependsOn(c.Annotations) {
+			if cycle := visit(append(slices.Clip(path), d)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	for _, d := range deps {
+		if cycle := visit([]string{id, d}); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// StartOrdered starts the containers ids as Start does, after the stopped
+// or created containers they depend on, directly or not, which it starts
+// too. The containers of a level are started in parallel, and those
+// depending on one that failed to start aren't.
+func (r *Runtime) StartOrdered(ctx context.Context, ids []string) ([]ContainerResult, error) {
+	deps := map[string][]string{}
+	var all []string
+	var add func(id string) error
+	add = func(id string) error {
+		if _, ok := deps[id]; ok {
+			return nil
+		}
+		c, err := r.State(id)
+		if err != nil {
+			return err
+		}
+		deps[id] = dependsOn(c.Annotations)
+		all = append(all, id)
+		for _, d := range deps[id] {
+			dc, err := r.State(d)
+			if errors.Is(err, ErrNotFound) {
+				// Starting id reports it.
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !dc.Status.running() {
+				if err := add(d); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, id := range ids {
+		if err := add(id); err != nil {
+			return nil, err
+		}
+	}
+	levels, err := dependencyLevels(all, deps)
+	if err != nil {
+		return nil, err
+	}
+	return startLevels(levels, deps, func(id string) error {
+		return r.Start(ctx, id)
+	}), nil
+}
+
+// StopOrdered stops the containers ids as Stop does with opts, those
+// depending on others of ids first. The containers of a level are stopped
+// in parallel, and one failing doesn't stop the others.
+func (r *Runtime) StopOrdered(ctx context.Context, ids []string, opts ...StopOption) ([]ContainerResult, error) {
+	deps := map[string][]string{}
+	for _, id := range ids {
+		c, err := LoadState(id)
+		if err != nil {
+			return nil, err
+		}
+		deps[id] = dependsOn(c.Annotations)
+	}
+	levels, err := dependencyLevels(ids, deps)
+	if err != nil {
+		return nil, err
+	}
+	return stopLevels(levels, func(id string) error {
+		return r.Stop(ctx, id, opts...)
+	}), nil
+}
+
+// stopLevels stops the containers of levels with stop, the last level
+// first and those of a level in parallel.
+func stopLevels(levels [][]string, stop func(id string) error) []ContainerResult {
+	var results []ContainerResult
+	for i := len(levels) - 1; i >= 0; i-- {
+		results = append(results, inParallel(levels[i], stop)...)
+	}
+	return results
+}
+
+// startLevels starts the containers of levels with start, a level after
+// the other and those of a level in parallel, skipping those depending
+// on one that failed to start.
+func startLevels(levels [][]string, deps map[string][]string, start func(id string) error) []ContainerResult {
+	var results []ContainerResult
+	failed := map[string]bool{}
+	for _, level := range levels {
+		res := inParallel(level, func(id string) error {
+			for _, d := range deps[id] {
+				if failed[d] {
+					return fmt.Errorf("not started, as %s it depends on failed to", d)
+				}
+			}
+			return start(id)
+		})
+		for _, re := range res {
+			if re.Err != nil {
+				failed[re.Id] = true
+			}
+		}
+		results = append(results, res...)
+	}
+	return results
+}
@@ -0,0 +1,129 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestApplyRequires(t *testing.T) {
+	spec := &specs.Spec{Annotations: map[string]string{AnnotationDependsOn: "db, cache"}}
+	applyRequires(spec, &RunOptions{Requires: []string{"cache", "auth"}})
+	if got := spec.Annotations[AnnotationDependsOn]; got != "db,cache,auth" {
+		t.Errorf("annotation = %q, want db,cache,auth", got)
+	}
+
+	spec = &specs.Spec{}
+	applyRequires(spec, &RunOptions{})
+	if spec.Annotations != nil {
+		t.Errorf("annotations without requires = %v", spec.Annotations)
+	}
+}
+
+func TestValidateRequiresCondition(t *testing.T) {
+	for _, tt := range []struct {
+		options RunOptions
+		ok      bool
+	}{
+		{RunOptions{}, true},
+		{RunOptions{RequiresCondition: WaitReady}, true},
+		{RunOptions{RequiresCondition: WaitHealthy, RequiresTimeout: time.Second}, true},
+		{RunOptions{RequiresCondition: WaitStopped}, false},
+		{RunOptions{RequiresCondition: WaitHealthy, RequiresTimeout: -time.Second}, false},
+	} {
+		if err := validateRequiresCondition(&tt.options); (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v, want ok %v", tt.options, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckRequires(t *testing.T) {
+	orig, origInterval := baseStateDir, waitInterval
+	baseStateDir, waitInterval = t.TempDir(), time.Millisecond
+	defer func() { baseStateDir, waitInterval = orig, origInterval }()
+	init := exec.Command("sleep", "60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	go init.Wait()
+	check := &HealthCheck{}
+	for _, c := range []*Container{
+		{Id: "db", Status: Running, InitProcessPiD: init.Process.Pid, Options: &RunOptions{HealthCheck: check}, Health: &Health{Status: HealthHealthy}},
+		{Id: "cache", Status: Running, InitProcessPiD: init.Process.Pid, Options: &RunOptions{HealthCheck: check}, Health: &Health{Status: HealthStarting}},
+		{Id: "old", Status: Stopped},
+		{Id: "api", Status: Running, InitProcessPiD: init.Process.Pid, Annotations: map[string]string{AnnotationDependsOn: "db"}},
+		{Id: "web", Status: Stopped, Annotations: map[string]string{AnnotationDependsOn: "api"}},
+	} {
+		if err := saveState(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+
+	if err := checkRequires(ctx, "new", []string{"db", "cache"}, &RunOptions{}); err != nil {
+		t.Errorf("requiring running containers: %v", err)
+	}
+	if err := checkRequires(ctx, "new", []string{"old"}, &RunOptions{}); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("requiring a stopped container: got %v, want ErrNotRunning", err)
+	}
+	if err := checkRequires(ctx, "new", []string{"missing"}, &RunOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("requiring a missing container: got %v, want ErrNotFound", err)
+	}
+	if err := checkRequires(ctx, "new", []string{"db"}, &RunOptions{RequiresCondition: WaitHealthy}); err != nil {
+		t.Errorf("requiring a healthy container: %v", err)
+	}
+	err := checkRequires(ctx, "new", []string{"cache"}, &RunOptions{RequiresCondition: WaitHealthy, RequiresTimeout: 20 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "isn't healthy after 20ms") {
+		t.Errorf("requiring a container not yet healthy: got %v", err)
+	}
+	if err := checkRequires(ctx, "new", []string{"cache"}, &RunOptions{RequiresCondition: WaitReady}); err != nil {
+		t.Errorf("requiring a ready container: %v", err)
+	}
+
+	err = checkRequires(ctx, "db", []string{"web"}, &RunOptions{})
+	if err == nil || !strings.Contains(err.Error(), "db -> web -> api -> db") {
+		t.Errorf("closing a cycle: got %v", err)
+	}
+	if err := checkRequires(ctx, "db", []string{"db"}, &RunOptions{}); err == nil {
+		t.Error("requiring itself succeeded")
+	}
+}
+
+func TestStartLevels(t *testing.T) {
+	var mu sync.Mutex
+	var started []string
+	deps := map[string][]string{"api": {"db"}, "web": {"api", "cache"}, "cache": nil}
+	results := startLevels([][]string{{"db", "cache"}, {"api"}, {"web"}}, deps, func(id string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		started = append(started, id)
+		if id == "api" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if len(started) != 3 || started[2] != "api" {
+		t.Errorf("started %v, want db and cache, then api", started)
+	}
+	want := "[{db <nil>} {cache <nil>} {api failed} {web not started, as api it depends on failed to}]"
+	if got := fmt.Sprint(results); got != want {
+		t.Errorf("results = %s, want %s", got, want)
+	}
+
+	var stopped []string
+	stopLevels([][]string{{"db"}, {"api"}, {"web"}}, func(id string) error {
+		stopped = append(stopped, id)
+		return nil
+	})
+	if fmt.Sprint(stopped) != "[web api db]" {
+		t.Errorf("stopped %v, want the dependents first", stopped)
+	}
+}
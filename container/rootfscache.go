@@ -0,0 +1,109 @@
+package container
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// An empty rootfs is populated from the local Alpine filesystem, which in
+// the VM is a shared folder slow to read. Its first copy is kept in
+// rootfsCacheDir/<digest>, by a digest of the source tree, and later
+// rootfs are copied from there, with reflinks where the filesystem has
+// them. A change to the source changes its digest, and the copy of the
+// previous one is removed.
+
+// rootfsCacheDir is a variable so tests can override it.
+var rootfsCacheDir = "/var/lib/containish/rootfs-cache"
+
+// rootfsCacheTmp prefixes the copies being made in rootfsCacheDir.
+const rootfsCacheTmp = ".tmp-"
+
+// sourceDigest returns a digest of the tree at root from the path, mode,
+// size, modification time and link target of its entries. No file is
+// read, yet changing one changes it.
+func sourceDigest(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		var target string
+		if d.Type() == fs.ModeSymlink {
+			if target, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(h, "%q %o %d %d %q\n", rel, info.Mode(), info.Size(), info.ModTime().UnixNano(), target)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", root, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedRootfs returns the cached copy of the tree at src, making it if
+// the cache has none of its current content.
+func cachedRootfs(src string) (string, error) {
+	digest, err := sourceDigest(src)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(rootfsCacheDir, digest)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+	if err := os.MkdirAll(rootfsCacheDir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create the rootfs cache: %w", err)
+	}
+	tmp, err := os.MkdirTemp(rootfsCacheDir, rootfsCacheTmp)
+	if err != nil {
+		return "", fmt.Errorf("failed to create the rootfs cache: %w", err)
+	}
+	if err := copyTree(src, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	// Another container may have cached the same source meanwhile.
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		if _, serr := os.Stat(dir); serr != nil {
+			return "", fmt.Errorf("failed to cache %s: %w", src, err)
+		}
+	}
+
+	entries, err := os.ReadDir(rootfsCacheDir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.Name() != digest && !strings.HasPrefix(e.Name(), rootfsCacheTmp) {
+			if err := os.RemoveAll(filepath.Join(rootfsCacheDir, e.Name())); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to remove a stale rootfs copy: %v\n", err)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// copyTree copies the content of the directory src into dst, preserving
+// everything, with reflinks where the filesystem has them.
+func copyTree(src, dst string) error {
+	cmd := exec.Command("cp", "-a", "--reflink=auto", src+"/.", dst)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error copying directory from %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSourceDigest(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "os-release"), "alpine", 0o644)
+	if err := os.Symlink("/bin/busybox", filepath.Join(src, "sh")); err != nil {
+		t.Fatal(err)
+	}
+	d1, err := sourceDigest(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2, _ := sourceDigest(src); d2 != d1 {
+		t.Fatal("digest changed without the source changing")
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "os-release"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if d2, _ := sourceDigest(src); d2 == d1 {
+		t.Fatal("digest unchanged after a file was modified")
+	}
+	if _, err := sourceDigest(filepath.Join(src, "missing")); err == nil {
+		t.Fatal("expected an error for a missing source")
+	}
+}
+
+func TestCachedRootfs(t *testing.T) {
+	orig := rootfsCacheDir
+	rootfsCacheDir = filepath.Join(t.TempDir(), "cache")
+	defer func() { rootfsCacheDir = orig }()
+
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "os-release"), "alpine 3.20", 0o644)
+	dir, err := cachedRootfs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "os-release")); err != nil || string(data) != "alpine 3.20" {
+		t.Fatalf("cached copy has %q, %v", data, err)
+	}
+	// The cached copy is used as long as the source is the same.
+	writeFile(t, filepath.Join(dir, "marker"), "", 0o644)
+	if again, err := cachedRootfs(src); err != nil || again != dir {
+		t.Fatalf("cachedRootfs = %s, %v, want %s", again, err, dir)
+	}
+
+	writeFile(t, filepath.Join(src, "os-release"), "alpine 3.21!", 0o644)
+	fresh, err := cachedRootfs(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh == dir {
+		t.Fatal("the cache wasn't refreshed after the source changed")
+	}
+	if data, _ := os.ReadFile(filepath.Join(fresh, "os-release")); string(data) != "alpine 3.21!" {
+		t.Fatalf("refreshed copy has %q", data)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("the stale copy is still there: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := copyTree(fresh, dst); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "os-release")); string(data) != "alpine 3.21!" {
+		t.Fatalf("rootfs copied from the cache has %q", data)
+	}
+}
@@ -0,0 +1,750 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Runtime manages containers. It is the entry point for programs embedding
+// containish; the zero value is not usable, use New.
+type Runtime struct {
+	cgroupManager string
+	fakeStages    bool
+}
+
+// Option configures a Runtime.
+type Option func(*Runtime)
+
+// WithCgroupManager selects how container cgroups are created, either
+// CgroupfsManager (the default) or SystemdManager.
+func WithCgroupManager(manager string) Option {
+	return func(r *Runtime) { r.cgroupManager = manager }
+}
+
+// WithFakeStages runs containers through a fake child stage that executes
+// their process on the host, without namespaces, cgroups or mounts, so
+// tests can exercise the lifecycle of containers without privileges.
+func WithFakeStages() Option {
+	return func(r *Runtime) { r.fakeStages = true }
+}
+
+// New returns a Runtime configured by opts.
+func New(opts ...Option) (*Runtime, error) {
+	r := &Runtime{cgroupManager: CgroupfsManager}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.cgroupManager != CgroupfsManager && r.cgroupManager != SystemdManager {
+		return nil, fmt.Errorf("unknown cgroup manager %q", r.cgroupManager)
+	}
+	return r, nil
+}
+
+// CreateOption configures a container made with Runtime.Create or
+// Runtime.Run.
+type CreateOption func(*RunOptions)
+
+// Detached makes Run return once the container init process is running.
+// The container output then goes to its log file.
+func Detached() CreateOption {
+	return func(o *RunOptions) { o.Detach = true }
+}
+
+// WithNetwork connects the container as described by cfg, see
+// ParseNetwork. Without it the container only has loopback.
+func WithNetwork(cfg *NetworkConfig) CreateOption {
+	return func(o *RunOptions) { o.Network = cfg }
+}
+
+// WithEgress restricts outbound traffic from the container.
+func WithEgress(policy *EgressPolicy) CreateOption {
+	return func(o *RunOptions) { o.Egress = policy }
+}
+
+// WithVolumes mounts named volumes, created on first use.
+func WithVolumes(volumes ...VolumeMount) CreateOption {
+	return func(o *RunOptions) { o.Volumes = append(o.Volumes, volumes...) }
+}
+
+// WithTmpfs adds tmpfs mounts to those of the spec, see ParseTmpfs.
+func WithTmpfs(mounts ...specs.Mount) CreateOption {
+	return func(o *RunOptions) { o.Tmpfs = append(o.Tmpfs, mounts...) }
+}
+
+// WithLogConfig sets the log rotation of a detached container.
+func WithLogConfig(cfg LogConfig) CreateOption {
+	return func(o *RunOptions) { o.Log = cfg }
+}
+
+// WithTrace traces the system calls of the container processes, see
+// TraceLog and TraceSummary.
+func WithTrace(mode string) CreateOption {
+	return func(o *RunOptions) { o.Trace = mode }
+}
+
+// WithCoreDumps captures the core dumps of the container processes in its
+// state dir, see ListCores.
+func WithCoreDumps() CreateOption {
+	return func(o *RunOptions) { o.CoreDumps = true }
+}
+
+// WithDefaultStopSignal sets the signal stopping the container sends
+// first, overriding the AnnotationStopSignal annotation.
+func WithDefaultStopSignal(sig string) CreateOption {
+	return func(o *RunOptions) { o.StopSignal = sig }
+}
+
+// WithConsoleSocket gives the container a pseudo terminal and sends its
+// master to the unix socket at path. The spec must set process.terminal.
+func WithConsoleSocket(path string) CreateOption {
+	return func(o *RunOptions) { o.ConsoleSocket = path }
+}
+
+// WithNotify keeps the container starting until its process reports it is
+// ready, see RunOptions.Notify.
+func WithNotify() CreateOption {
+	return func(o *RunOptions) { o.Notify = true }
+}
+
+// WithMetadata gives the container a socket to ask about itself, see
+// Metadata.
+func WithMetadata() CreateOption {
+	return func(o *RunOptions) { o.Metadata = true }
+}
+
+// WithPidContainer has the container join the pid namespace of container
+// id rather than getting one of its own.
+func WithPidContainer(id string) CreateOption {
+	return func(o *RunOptions) { o.PidContainer = id }
+}
+
+// WithSpecPatch applies the JSON merge patch or JSON patch patch to the
+// spec of the container, after those given before, see ParseSpecPatch.
+func WithSpecPatch(patch json.RawMessage) CreateOption {
+	return func(o *RunOptions) { o.SpecPatches = append(o.SpecPatches, patch) }
+}
+
+// WithoutNewKeyring keeps the container process in the session keyring of
+// the runtime, see RunOptions.NoNewKeyring.
+func WithoutNewKeyring() CreateOption {
+	return func(o *RunOptions) { o.NoNewKeyring = true }
+}
+
+// Quiet writes the messages of the runtime to runtime.log in the state dir
+// rather than stdout, so only the container's own output reaches it.
+func Quiet() CreateOption {
+	return func(o *RunOptions) { o.Quiet = true }
+}
+
+// WithSecrets exposes host files to the container, see ParseSecret.
+func WithSecrets(secrets ...Secret) CreateOption {
+	return func(o *RunOptions) { o.Secrets = append(o.Secrets, secrets...) }
+}
+
+// WithHostDevices passes host devices through to the container, see
+// ParseHostDevice.
+func WithHostDevices(devices ...HostDevice) CreateOption {
+	return func(o *RunOptions) { o.HostDevices = append(o.HostDevices, devices...) }
+}
+
+// WithCDIDevices injects CDI devices into the container, by fully
+// qualified name, see ParseCDIDevice.
+func WithCDIDevices(names ...string) CreateOption {
+	return func(o *RunOptions) { o.Devices = append(o.Devices, names...) }
+}
+
+// WithStorageSize limits the space the container can use in its rootfs to
+// size bytes, see StorageQuota.
+func WithStorageSize(size int64) CreateOption {
+	return func(o *RunOptions) { o.StorageSize = size }
+}
+
+// WithEnv sets KEY=VALUE variables in the environment of the container
+// process, see ParseEnv.
+func WithEnv(env ...string) CreateOption {
+	return func(o *RunOptions) { o.Env = append(o.Env, env...) }
+}
+
+// WithTimezone runs the container in timezone tz, a zone such as
+// Europe/Lisbon or TimezoneHost.
+func WithTimezone(tz string) CreateOption {
+	return func(o *RunOptions) { o.Timezone = tz }
+}
+
+// WithHostLocale passes the locale variables of the runtime on to the
+// container process.
+func WithHostLocale() CreateOption {
+	return func(o *RunOptions) { o.HostLocale = true }
+}
+
+// WithLimits limits the memory of the container to memory bytes and its CPU
+// time to cpus CPUs. Zero keeps the limit of the spec.
+func WithLimits(memory int64, cpus float64) CreateOption {
+	return func(o *RunOptions) { o.Memory, o.CPUs = memory, cpus }
+}
+
+// WithMonotonicOffset shifts the monotonic clocks of the container by
+// offset, see RunOptions.MonotonicOffset.
+func WithMonotonicOffset(offset time.Duration) CreateOption {
+	return func(o *RunOptions) { o.MonotonicOffset = offset }
+}
+
+// WithFakeDate tells the container process it is date, see
+// RunOptions.FakeDate.
+func WithFakeDate(date time.Time) CreateOption {
+	return func(o *RunOptions) { o.FakeDate = date }
+}
+
+// WithOSRelease mounts the os-release of the rootfs of a container run from
+// an image with the identity of the image.
+func WithOSRelease() CreateOption {
+	return func(o *RunOptions) { o.OSRelease = true }
+}
+
+// WithNoRTC takes the RTC devices away from the container.
+func WithNoRTC() CreateOption {
+	return func(o *RunOptions) { o.NoRTC = true }
+}
+
+// WithMemorySwap limits the memory and swap of the container together to
+// memorySwap bytes, see RunOptions.MemorySwap.
+func WithMemorySwap(memorySwap int64) CreateOption {
+	return func(o *RunOptions) { o.MemorySwap = memorySwap }
+}
+
+// WithForce runs the container even if the host lacks the memory or CPUs
+// it reserves, see RunOptions.Force.
+func WithForce() CreateOption {
+	return func(o *RunOptions) { o.Force = true }
+}
+
+// WithImage runs the container from the image ref, see RunOptions.Image.
+func WithImage(ref string) CreateOption {
+	return func(o *RunOptions) { o.Image = ref }
+}
+
+// WithRootfs runs the container from the rootfs at path in place of the
+// root.path of the spec, or from that of the host with RootfsHost.
+func WithRootfs(path string) CreateOption {
+	return func(o *RunOptions) { o.Rootfs = path }
+}
+
+// WithRuntime executes the container process with runtime, RuntimeWasm
+// or empty for an ELF binary.
+func WithRuntime(runtime string) CreateOption {
+	return func(o *RunOptions) { o.Runtime = runtime }
+}
+
+// WithIsolation runs the container process in the sandbox of isolation,
+// IsolationUserns or IsolationVM, or empty for the namespaces of the
+// container.
+func WithIsolation(isolation string) CreateOption {
+	return func(o *RunOptions) { o.Isolation = isolation }
+}
+
+// WithEntrypoint replaces the entrypoint of the image with entrypoint, or
+// clears it when empty, see RunOptions.Entrypoint.
+func WithEntrypoint(entrypoint string) CreateOption {
+	return func(o *RunOptions) { o.Entrypoint = &entrypoint }
+}
+
+// WithCmd replaces the command of the image with cmd.
+func WithCmd(cmd ...string) CreateOption {
+	return func(o *RunOptions) { o.Cmd = cmd }
+}
+
+// WithWorkdir replaces the working directory of the image with dir.
+func WithWorkdir(dir string) CreateOption {
+	return func(o *RunOptions) { o.Workdir = dir }
+}
+
+// WithUser runs the process generated from the image as user, a
+// "<user>[:<group>]" of the rootfs or numeric ids, in place of the user of
+// the image.
+func WithUser(user string) CreateOption {
+	return func(o *RunOptions) { o.User = user }
+}
+
+// WithRestart sets the restart policy of a detached container.
+func WithRestart(policy RestartPolicy) CreateOption {
+	return func(o *RunOptions) { o.Restart = policy }
+}
+
+// WithHealthCheck probes a detached container with check, see HealthCheck.
+func WithHealthCheck(check HealthCheck) CreateOption {
+	return func(o *RunOptions) { o.HealthCheck = &check }
+}
+
+// WithRequires makes the container depend on the containers ids, see
+// RunOptions.Requires.
+func WithRequires(ids ...string) CreateOption {
+	return func(o *RunOptions) { o.Requires = ids }
+}
+
+// WithRequiresCondition makes the container wait up to timeout for those
+// it requires to meet condition, WaitReady or WaitHealthy.
+func WithRequiresCondition(condition string, timeout time.Duration) CreateOption {
+	return func(o *RunOptions) { o.RequiresCondition, o.RequiresTimeout = condition, timeout }
+}
+
+// WithGPUs passes GPUs through to the container, see ParseGPUs.
+func WithGPUs(ids ...string) CreateOption {
+	return func(o *RunOptions) { o.GPUs = ids }
+}
+
+// WithPlatform requires the rootfs to be for arch, a GOARCH as returned by
+// ParsePlatform. With copyEmulator the qemu emulator of a foreign rootfs is
+// copied into it when its binfmt_misc handler needs it there.
+func WithPlatform(arch string, copyEmulator bool) CreateOption {
+	return func(o *RunOptions) { o.Platform, o.CopyEmulator = arch, copyEmulator }
+}
+
+// WithProgress reports the progress of setting the container up to fn.
+func WithProgress(fn ProgressFunc) CreateOption {
+	return func(o *RunOptions) { o.Progress = fn }
+}
+
+// WithPrivileged runs the container privileged, see RunOptions.Privileged.
+func WithPrivileged() CreateOption {
+	return func(o *RunOptions) { o.Privileged = true }
+}
+
+// WithSecurityClass sets the class of the container, see
+// RunOptions.SecurityClass.
+func WithSecurityClass(class string) CreateOption {
+	return func(o *RunOptions) { o.SecurityClass = class }
+}
+
+// WithName names the container, see RunOptions.Name.
+func WithName(name string) CreateOption {
+	return func(o *RunOptions) { o.Name = name }
+}
+
+// WithBundle sets the bundle of the container when the spec is not in it,
+// see RunOptions.Bundle.
+func WithBundle(dir string) CreateOption {
+	return func(o *RunOptions) { o.Bundle = dir }
+}
+
+// WithIntegrity records a hash manifest of the image of the container, see
+// RunOptions.Integrity.
+func WithIntegrity() CreateOption {
+	return func(o *RunOptions) { o.Integrity = true }
+}
+
+// WithStrictSpec rejects a spec setting what the runtime doesn't support,
+// see RunOptions.StrictSpec.
+func WithStrictSpec() CreateOption {
+	return func(o *RunOptions) { o.StrictSpec = true }
+}
+
+// WithExitFile has the monitor of a detached container write the exit code
+// of its process to f, see OpenExitFd.
+func WithExitFile(f *os.File) CreateOption {
+	return func(o *RunOptions) { o.ExitFile = f }
+}
+
+// options validates id and returns the options of a container.
+func (r *Runtime) options(id string, opts []CreateOption) (RunOptions, error) {
+	if !objectNameRe.MatchString(id) {
+		return RunOptions{}, fmt.Errorf("invalid container id %q", id)
+	}
+	options := RunOptions{CgroupManager: r.cgroupManager, fakeStages: r.fakeStages}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.Name != "" && !objectNameRe.MatchString(options.Name) {
+		return RunOptions{}, fmt.Errorf("invalid container name %q", options.Name)
+	}
+	if options.Bundle != "" {
+		bundle, err := filepath.Abs(options.Bundle)
+		if err != nil {
+			return RunOptions{}, err
+		}
+		options.Bundle = bundle
+	}
+	return options, nil
+}
+
+// Create sets up a container from the spec at specPath, whose directory is
+// the container bundle unless WithBundle gives another, and leaves it
+// Created: its namespaces, cgroup and mounts are in place and its init
+// process waits for Start before executing process.args. A stopped
+// container with the same id is replaced. Unless the container is
+// Detached, the container process gets the caller's stdio, or a pseudo
+// terminal with WithConsoleSocket.
+func (r *Runtime) Create(ctx context.Context, id, specPath string, opts ...CreateOption) (*Container, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	options, err := r.options(id, opts)
+	if err != nil {
+		return nil, err
+	}
+	options.create = true
+	if specPath, err = filepath.Abs(specPath); err != nil {
+		return nil, err
+	}
+	if err := r.checkReplace(id); err != nil {
+		return nil, err
+	}
+	if err := checkName(id, options.Name); err != nil {
+		return nil, err
+	}
+	if err := runContainer(ctx, id, specPath, options); err != nil {
+		return nil, err
+	}
+	return LoadState(id)
+}
+
+// checkReplace fails unless a container with id can be created, that is it
+// doesn't exist or has stopped.
+func (r *Runtime) checkReplace(id string) error {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil
+	}
+	refreshStatus(c)
+	if c.Status != Stopped {
+		return fmt.Errorf("container %s %w and is %s", id, ErrExists, c.Status)
+	}
+	return nil
+}
+
+// Start lets the process of a created container run and returns once it
+// has been executed. Cancelling ctx gives up waiting for the container init
+// process, leaving the container Created. A stopped container is run again,
+// detached, from the spec and with the options it was last run with.
+func (r *Runtime) Start(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	saved := c.Status
+	refreshStatus(c)
+	switch c.Status {
+	case Created:
+		return startContainer(ctx, id)
+	case Running, Starting:
+		return fmt.Errorf("container %s is already running", id)
+	}
+	if c.Options == nil || c.SpecPath == "" {
+		return fmt.Errorf("container %s has no saved configuration to start it again, run it instead", id)
+	}
+	if saved != Stopped {
+		// It exited on its own and still holds what it was given, unless
+		// its monitor released it meanwhile.
+		s, release, err := markStopped(id, nil)
+		if err != nil {
+			return err
+		}
+		if release {
+			releaseResources(s)
+		}
+	}
+	options, err := cloneOptions(*c.Options)
+	if err != nil {
+		return err
+	}
+	// Nobody is attached to a container started again.
+	options.Detach = true
+	options.ConsoleSocket = ""
+	options.fakeStages = r.fakeStages
+	return runContainer(ctx, id, c.SpecPath, *options)
+}
+
+// Restart stops a running or created container like Stop, then starts it
+// again like Start.
+func (r *Runtime) Restart(ctx context.Context, id string, opts ...StopOption) error {
+	c, err := r.State(id)
+	if err != nil {
+		return err
+	}
+	if c.Status != Stopped {
+		if err := r.Stop(ctx, id, opts...); err != nil {
+			return err
+		}
+	}
+	return r.Start(ctx, id)
+}
+
+// Run sets up and starts a container in one go. Unless it is Detached, Run
+// waits for the container to exit. Cancelling ctx aborts a start that
+// hasn't completed, killing the partially started container and releasing
+// what it held; in the foreground it also kills a running container.
+func (r *Runtime) Run(ctx context.Context, id, specPath string, opts ...CreateOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	options, err := r.options(id, opts)
+	if err != nil {
+		return err
+	}
+	if specPath, err = filepath.Abs(specPath); err != nil {
+		return err
+	}
+	if err := r.checkReplace(id); err != nil {
+		return err
+	}
+	if err := checkName(id, options.Name); err != nil {
+		return err
+	}
+	return runContainer(ctx, id, specPath, options)
+}
+
+// Plan validates a container like Create and describes what starting it
+// would do, without creating anything.
+func (r *Runtime) Plan(id, specPath string, opts ...CreateOption) (*Plan, error) {
+	options, err := r.options(id, opts)
+	if err != nil {
+		return nil, err
+	}
+	if specPath, err = filepath.Abs(specPath); err != nil {
+		return nil, err
+	}
+	return planContainer(id, specPath, options)
+}
+
+// StopOption configures Runtime.Stop.
+type StopOption func(*stopOptions)
+
+type stopOptions struct {
+	signal  unix.Signal
+	timeout time.Duration
+}
+
+// WithStopSignal sets the signal asking the init process to exit,
+// overriding the container's stop signal.
+func WithStopSignal(sig unix.Signal) StopOption {
+	return func(o *stopOptions) { o.signal = sig }
+}
+
+// WithStopTimeout sets how long the init process gets to exit after the
+// stop signal before it is killed, DefaultStopTimeout if not set. Zero kills it
+// right away.
+func WithStopTimeout(d time.Duration) StopOption {
+	return func(o *stopOptions) { o.timeout = d }
+}
+
+// Stop asks the init process of a running container to exit with its stop
+// signal, SIGTERM by default, kills it if it hasn't within the stop
+// timeout, and releases what it held on the host. Cancelling ctx kills it
+// without waiting further.
+func (r *Runtime) Stop(ctx context.Context, id string, opts ...StopOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	o := stopOptions{timeout: DefaultStopTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return stopContainer(ctx, id, o.signal, o.timeout)
+}
+
+// Kill sends sig to the init process of a created or running container.
+func (r *Runtime) Kill(ctx context.Context, id string, sig unix.Signal) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c, err := r.State(id)
+	if err != nil {
+		return err
+	}
+	if c.Status == Stopped {
+		return fmt.Errorf("container %s is %w", id, ErrNotRunning)
+	}
+	if sig == unix.SIGKILL || sig == stopSignal(c) {
+		// Killing the container stops it for good, like Stop.
+		err := updateState(id, func(s *Container) error {
+			s.ManuallyStopped = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	pidfd, err := openInit(c)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+	if err := unix.PidfdSendSignal(pidfd, sig, nil, 0); err != nil {
+		return fmt.Errorf("failed to signal container %s: %w", id, err)
+	}
+	return nil
+}
+
+// Delete removes a container that isn't running. A created container's
+// init process is killed first, and what a container that exited on its
+// own held on the host is released.
+func (r *Runtime) Delete(id string) error {
+	if !objectNameRe.MatchString(id) {
+		return fmt.Errorf("invalid container id %q", id)
+	}
+	c, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	saved := c.Status
+	refreshStatus(c)
+	switch c.Status {
+	case Running, Starting:
+		return fmt.Errorf("container %s is running, stop it first", id)
+	case Created:
+		if err := killCreated(c); err != nil {
+			return err
+		}
+		releaseResources(c)
+	default:
+		if saved != Stopped {
+			s, release, err := markStopped(id, nil)
+			if err != nil {
+				return err
+			}
+			if release {
+				releaseResources(s)
+			}
+		}
+	}
+	// The state dir is the monitor's until it is done with the exit.
+	if err := waitMonitor(context.Background(), id, monitorTimeout); err != nil {
+		return fmt.Errorf("can't remove container %s yet: %w", id, err)
+	}
+	if err := deleteState(id); err != nil {
+		return fmt.Errorf("failed to remove container %s: %w", id, err)
+	}
+	if err := releaseAddresses(c); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if c.Storage != nil {
+		if err := removeStorageQuota(c.Rootfs, c.Storage); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+	}
+	if err := removeImageRootfs(c.Id, c.Image); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if c.Image == nil && c.Options != nil && c.Options.ClonedFrom != "" {
+		removeClonedRootfs(c.Id)
+	}
+	if err := runPlugins(context.Background(), newPluginEvent(PluginPostDelete, c)); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	return nil
+}
+
+// State returns the state of a container. A container whose init process
+// has exited is reported as Stopped, with the usage read from the cgroup
+// it still holds.
+func (r *Runtime) State(id string) (*Container, error) {
+	c, err := LoadState(id)
+	if err != nil {
+		return nil, err
+	}
+	saved := c.Status
+	refreshStatus(c)
+	if saved != Stopped && c.Status == Stopped && c.Usage == nil && c.CgroupPath != "" {
+		if u, err := readUsage(c.CgroupPath); err == nil {
+			c.Usage = u
+		}
+	}
+	if c.Storage != nil {
+		if used, err := storageUsage(c.Rootfs, c.Storage); err == nil {
+			c.Storage.Used = used
+		}
+	}
+	return c, nil
+}
+
+// Conditions Wait waits for.
+const (
+	// WaitStopped waits for the init process of the container to exit.
+	WaitStopped = "stopped"
+	// WaitReady waits for the container to be running, which a container
+	// run with WithNotify is once its workload sent READY=1.
+	WaitReady = "ready"
+	// WaitHealthy waits for the container to be ready and, if it has a
+	// health check, healthy.
+	WaitHealthy = "healthy"
+)
+
+// waitInterval is how often Wait checks the state of the container. It is
+// a variable so tests can override it.
+var waitInterval = 100 * time.Millisecond
+
+// Wait blocks until the container meets condition, WaitStopped,
+// WaitReady or WaitHealthy, or ctx is done, and returns its state then.
+// Waiting for a container to be ready or healthy fails if it stops first.
+func (r *Runtime) Wait(ctx context.Context, id, condition string) (*Container, error) {
+	if condition != WaitStopped && condition != WaitReady && condition != WaitHealthy {
+		return nil, fmt.Errorf("invalid wait condition %q: expected %s, %s or %s", condition, WaitStopped, WaitReady, WaitHealthy)
+	}
+	ticker := time.NewTicker(waitInterval)
+	defer ticker.Stop()
+	for {
+		c, err := r.State(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c.Status == Stopped && condition != WaitStopped:
+			return c, fmt.Errorf("container %s stopped before it was %s: %w", id, condition, ErrNotRunning)
+		case c.Status == Stopped, c.Status == Running && condition == WaitReady, c.Status == Running && condition == WaitHealthy && healthy(c):
+			return c, nil
+		}
+		select {
+		case <-ctx.Done():
+			return c, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthy reports whether c passes its health check, which a container
+// without one always does.
+func healthy(c *Container) bool {
+	if c.Options == nil || c.Options.HealthCheck == nil {
+		return true
+	}
+	return c.Health != nil && c.Health.Status == HealthHealthy
+}
+
+// List returns the state of every container, ordered by id, like State.
+func (r *Runtime) List() ([]*Container, error) {
+	return r.Find(StateFilter{})
+}
+
+// Find returns the state of the containers matching filter, ordered by id,
+// like State. The store's indexes select the containers, so filtering on
+// Stopped also has to look at those whose init process exited since their
+// state was saved.
+func (r *Runtime) Find(filter StateFilter) ([]*Container, error) {
+	query := filter
+	if slices.Contains(filter.Status, Stopped) {
+		query.Status = nil
+	}
+	containers, err := FindContainers(query)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(containers, func(c *Container) bool {
+		refreshStatus(c)
+		return !filter.Match(c)
+	}), nil
+}
+
+// Exec starts a process in a running container, see ExecContainer.
+func (r *Runtime) Exec(ctx context.Context, id string, opts ExecOptions) (*ExecProcess, error) {
+	return ExecContainer(ctx, id, opts)
+}
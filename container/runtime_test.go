@@ -0,0 +1,359 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestNewRuntime(t *testing.T) {
+	if _, err := New(); err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if _, err := New(WithCgroupManager("bogus")); err == nil {
+		t.Fatal("expected error for an unknown cgroup manager")
+	}
+}
+
+func TestRuntimeCreateValidation(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	dir := t.TempDir()
+	specPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(specPath, []byte(`{"ociVersion": "1.0.2", "root": {"path": "rootfs"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ttyPath := filepath.Join(dir, "tty.json")
+	if err := os.WriteFile(ttyPath, []byte(`{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"terminal": true, "args": ["sh"]}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := rt.Create(ctx, "c1", specPath, WithLogConfig(LogConfig{MaxSize: 1024, MaxFile: 1})); err == nil || !strings.Contains(err.Error(), "detached") {
+		t.Fatalf("expected log options to require a detached container, got %v", err)
+	}
+	if _, err := rt.Create(ctx, "../c1", specPath); err == nil {
+		t.Fatal("expected error for an invalid id")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := rt.Create(cancelled, "c1", specPath); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Create with a cancelled context = %v", err)
+	}
+	if _, err := rt.Create(ctx, "c1", ttyPath); err == nil || !strings.Contains(err.Error(), "console socket") {
+		t.Fatalf("expected a terminal to require a console socket, got %v", err)
+	}
+	if _, err := rt.Create(ctx, "c1", specPath, WithConsoleSocket("/nonexistent.sock")); err == nil || !strings.Contains(err.Error(), "process.terminal") {
+		t.Fatalf("expected a console socket to require a terminal, got %v", err)
+	}
+	if _, err := os.Stat(StateDir("c1")); !os.IsNotExist(err) {
+		t.Fatalf("failed creates left a state dir: %v", err)
+	}
+}
+
+func TestRuntimeLifecycle(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// A stand-in for a created container's init process, blocked on the
+	// exec fifo until started.
+	stateDir := StateDir("c1")
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	fifo, err := createExecFifo(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := exec.Command("sh", "-c", "echo > "+fifo+"; exec sleep 60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	exited := make(chan struct{})
+	go func() { init.Wait(); close(exited) }()
+
+	c := &Container{Id: "c1", Status: Created, InitProcessPiD: init.Process.Pid, Bundle: "/bundle", Annotations: map[string]string{"a": "b"}}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	st, err := rt.State("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oci := st.OCIState(); oci.Status != "created" || oci.Pid != init.Process.Pid || oci.Bundle != "/bundle" || oci.Annotations["a"] != "b" {
+		t.Fatalf("unexpected OCI state %+v", oci)
+	}
+	list, err := rt.List()
+	if err != nil || len(list) != 1 || list[0].Id != "c1" {
+		t.Fatalf("List = %v, %v", list, err)
+	}
+	if _, err := rt.Create(ctx, "c1", "config.json"); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists creating over a created container, got %v", err)
+	}
+
+	if err := rt.Start(ctx, "c1"); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	if st, _ := rt.State("c1"); st.Status != Running {
+		t.Fatalf("started container is %v", st.Status)
+	}
+	if _, err := os.Stat(fifo); !os.IsNotExist(err) {
+		t.Fatalf("exec fifo not removed: %v", err)
+	}
+	if err := rt.Start(ctx, "c1"); err == nil {
+		t.Fatal("expected error starting a running container")
+	}
+	if err := rt.Delete("c1"); err == nil {
+		t.Fatal("expected error deleting a running container")
+	}
+
+	if err := rt.Kill(ctx, "c1", unix.SIGKILL); err != nil {
+		t.Fatalf("Kill failed: %v", err)
+	}
+	<-exited
+	if st, _ := rt.State("c1"); st.Status != Stopped || st.OCIState().Pid != 0 {
+		t.Fatalf("killed container is %v", st.Status)
+	}
+	if err := rt.Kill(ctx, "c1", unix.SIGTERM); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning killing a stopped container, got %v", err)
+	}
+	if err := rt.Delete("c1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := os.Stat(stateDir); !os.IsNotExist(err) {
+		t.Fatalf("state dir still exists: %v", err)
+	}
+	if err := rt.Delete("c1"); err == nil {
+		t.Fatal("expected error deleting a missing container")
+	}
+}
+
+func TestDeleteCreated(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	init := exec.Command("sleep", "60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	go init.Wait()
+	if err := saveState(&Container{Id: "c1", Status: Created, InitProcessPiD: init.Process.Pid}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Delete("c1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if processAlive(init.Process.Pid) {
+		t.Fatal("the init process of a deleted container is still alive")
+	}
+}
+
+func TestStartStopped(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// Without saved options a container can't be run again.
+	if err := saveState(&Container{Id: "c1", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Start(ctx, "c1"); err == nil || !strings.Contains(err.Error(), "no saved configuration") {
+		t.Fatalf("expected an error starting a stopped container without options, got %v", err)
+	}
+
+	// Restart stops a running container before starting it.
+	init := exec.Command("sleep", "60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	go init.Wait()
+	if err := saveState(&Container{Id: "c2", Status: Running, InitProcessPiD: init.Process.Pid}); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Restart(ctx, "c2", WithStopTimeout(0)); err == nil || !strings.Contains(err.Error(), "no saved configuration") {
+		t.Fatalf("expected Restart to fail starting c2, got %v", err)
+	}
+	if st, _ := rt.State("c2"); st.Status != Stopped {
+		t.Fatalf("restarted container is %v, want it stopped", st.Status)
+	}
+	if err := rt.Restart(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound restarting a missing container, got %v", err)
+	}
+}
+
+func TestCloneOptions(t *testing.T) {
+	options := RunOptions{
+		Detach:  true,
+		Network: &NetworkConfig{Driver: "bridge", DNS: []string{"1.1.1.1"}},
+		Volumes: []VolumeMount{{Name: "data", Target: "/data"}},
+		create:  true,
+	}
+	clone, err := cloneOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.Network.DNS[0] = "8.8.8.8"
+	options.Volumes[0].ReadOnly = true
+	if !clone.Detach || clone.Network.DNS[0] != "1.1.1.1" || clone.Volumes[0].ReadOnly {
+		t.Fatalf("clone shares state with the original: %+v", clone)
+	}
+	if clone.create {
+		t.Fatal("clone kept the create flag")
+	}
+}
+
+func mustParseTmpfs(t *testing.T, value string) specs.Mount {
+	t.Helper()
+	m, err := ParseTmpfs(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestWait(t *testing.T) {
+	orig, origInterval := baseStateDir, waitInterval
+	baseStateDir, waitInterval = t.TempDir(), time.Millisecond
+	defer func() { baseStateDir, waitInterval = orig, origInterval }()
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := exec.Command("sleep", "60")
+	if err := init.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer init.Process.Kill()
+	exited := make(chan struct{})
+	go func() { init.Wait(); close(exited) }()
+	if err := saveState(&Container{Id: "c1", Status: Starting, InitProcessPiD: init.Process.Pid}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if _, err := rt.Wait(ctx, "c1", "alive"); err == nil {
+		t.Fatal("expected an error for an unknown condition")
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := rt.Wait(short, "c1", WaitReady); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a starting container not to be ready, got %v", err)
+	}
+
+	go markReady("c1")
+	if c, err := rt.Wait(ctx, "c1", WaitReady); err != nil || c.Status != Running {
+		t.Fatalf("Wait(ready) = %v, %v", c, err)
+	}
+
+	c, err := LoadState("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Options, c.Health = &RunOptions{HealthCheck: &HealthCheck{}}, &Health{Status: HealthStarting}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	short, cancel = context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := rt.Wait(short, "c1", WaitHealthy); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a container still starting its health check not to be healthy, got %v", err)
+	}
+	c.Health.Status = HealthHealthy
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.Wait(ctx, "c1", WaitHealthy); err != nil {
+		t.Fatalf("Wait(healthy) = %v", err)
+	}
+
+	init.Process.Kill()
+	<-exited
+	if c, err := rt.Wait(ctx, "c1", WaitStopped); err != nil || c.Status != Stopped {
+		t.Fatalf("Wait(stopped) = %v, %v", c, err)
+	}
+	if _, err := rt.Wait(ctx, "c1", WaitReady); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning waiting for a stopped container to be ready, got %v", err)
+	}
+	if _, err := rt.Wait(ctx, "missing", WaitStopped); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSignalReusedPid(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := exec.Command("sleep", "60")
+	if err := other.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Process.Kill()
+	go other.Wait()
+	start, err := processStartTime(other.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nsPid, err := processNsPid(other.Process.Pid); err != nil || nsPid != other.Process.Pid {
+		t.Fatalf("processNsPid = %d, %v, want %d", nsPid, err, other.Process.Pid)
+	}
+
+	// The saved init process started earlier than the process now holding
+	// its pid, which mustn't be signalled.
+	c := &Container{Id: "c1", Status: Running, InitProcessPiD: other.Process.Pid, InitStartTime: start - 1}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openInit(c); !errors.Is(err, ErrNotRunning) {
+		t.Fatalf("expected ErrNotRunning opening a reused pid, got %v", err)
+	}
+	ctx := context.Background()
+	if err := rt.Kill(ctx, "c1", unix.SIGKILL); err == nil {
+		t.Fatal("expected an error killing a container whose pid was reused")
+	}
+	if err := rt.Stop(ctx, "c1", WithStopTimeout(0)); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := LoadState("c1"); st.Status != Stopped {
+		t.Fatalf("container is %v after stop, want stopped", st.Status)
+	}
+	if err := unix.Kill(other.Process.Pid, 0); err != nil {
+		t.Fatalf("the process reusing the pid was signalled: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// The process of a container runs in a sandbox, selected by its isolation,
+// RunOptions.Isolation. Every sandbox is entered the same way: the runtime
+// starts the parent stage, which clones the child stage into the
+// namespaces and cgroup of the container, and the child stage sets the
+// rootfs up and waits to be released. The sandbox decides the rest: it
+// adjusts the spec before anything is created, prepares what it needs in
+// the state dir before the stages start, and ends the child stage by
+// running the process of the container. The process sandbox, the default,
+// executes it in place of the child stage. The userns sandbox is the
+// process sandbox with a user namespace of its own, so that root in the
+// container is an unprivileged user on the host. The vm sandbox boots a
+// microVM in the namespaces and cgroup of the container and runs the
+// process in it, see vm.go. A new isolation is a sandbox added to
+// sandboxes.
+
+// Isolations selecting the sandbox of a container, see
+// RunOptions.Isolation.
+const (
+	// IsolationProcess runs the process in the namespaces of the
+	// container. It is given as an empty Isolation.
+	IsolationProcess = "process"
+	// IsolationUserns also gives it a user namespace of its own.
+	IsolationUserns = "userns"
+	// IsolationVM runs it in a microVM.
+	IsolationVM = "vm"
+)
+
+// sandbox runs the process of a container.
+type sandbox interface {
+	// configure checks that the container of spec can run in the sandbox
+	// with options, and adjusts spec to it, before the container is
+	// created.
+	configure(spec *specs.Spec, options *RunOptions) error
+	// prepare readies the sandbox of the container run with options in
+	// stateDir and adjusts the stage options to it, before the init
+	// stages start.
+	prepare(stateDir string, options *RunOptions, opts *stageOptions) error
+	// exec ends the child stage, with the container set up and released,
+	// by running its process. seccompConn is the connection to the
+	// seccomp agent, if any.
+	exec(opts *stageOptions, seccompConn *net.UnixConn) error
+}
+
+// sandboxes are the sandboxes by isolation.
+var sandboxes = map[string]sandbox{
+	"":              processSandbox{},
+	IsolationUserns: usernsSandbox{},
+	IsolationVM:     vmSandbox{},
+}
+
+// ParseIsolation parses an --isolation value, process, userns or vm,
+// returning the Isolation of RunOptions.
+func ParseIsolation(value string) (string, error) {
+	if value == IsolationProcess {
+		return "", nil
+	}
+	if _, ok := sandboxes[value]; !ok {
+		return "", fmt.Errorf("unknown isolation %q: expected %s, %s or %s", value, IsolationProcess, IsolationUserns, IsolationVM)
+	}
+	return value, nil
+}
+
+// sandboxFor returns the sandbox of isolation.
+func sandboxFor(isolation string) (sandbox, error) {
+	isolation, err := ParseIsolation(isolation)
+	if err != nil {
+		return nil, err
+	}
+	return sandboxes[isolation], nil
+}
+
+// processSandbox executes the process of the container in place of the
+// child stage.
+type processSandbox struct{}
+
+func (processSandbox) configure(*specs.Spec, *RunOptions) error { return nil }
+
+func (processSandbox) prepare(string, *RunOptions, *stageOptions) error { return nil }
+
+func (processSandbox) exec(opts *stageOptions, seccompConn *net.UnixConn) error {
+	return execProcess(opts, seccompConn)
+}
+
+// usernsSandbox is the process sandbox with a user namespace mapping the
+// container to the subordinate ids of usernsRemapUser, unless the spec
+// creates one with mappings of its own.
+type usernsSandbox struct {
+	processSandbox
+}
+
+// usernsRemapUser is the user whose subordinate ids in /etc/subuid and
+// /etc/subgid the userns sandbox maps containers to, and
+// defaultSubordinateIDs what it maps them to on hosts without those files.
+// Where they exist, the default range may be a real user's, which useradd
+// gives the first regular user, so the user must have an entry there.
+const usernsRemapUser = "containish"
+
+var defaultSubordinateIDs = specs.LinuxIDMapping{ContainerID: 0, HostID: 100000, Size: 65536}
+
+// The subordinate id files, variables so tests can override them.
+var (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+)
+
+func (usernsSandbox) configure(spec *specs.Spec, options *RunOptions) error {
+	if options.Rootfs == RootfsHost {
+		return fmt.Errorf("the %s isolation can't be used with the host rootfs", IsolationUserns)
+	}
+	if userNamespace(spec) {
+		return nil
+	}
+	uids, err := subordinateIDs(subuidPath, usernsRemapUser)
+	if err != nil {
+		return err
+	}
+	gids, err := subordinateIDs(subgidPath, usernsRemapUser)
+	if err != nil {
+		return err
+	}
+	if spec.Linux == nil {
+		spec.Linux = &specs.Linux{}
+	}
+	spec.Linux.Namespaces = append(spec.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+	spec.Linux.UIDMappings = []specs.LinuxIDMapping{uids}
+	spec.Linux.GIDMappings = []specs.LinuxIDMapping{gids}
+	return nil
+}
+
+// subordinateIDs returns the mapping of container ids from 0 to the first
+// range of subordinate ids of name, or of its uid, in the file at path, or
+// defaultSubordinateIDs if there is no such file.
+func subordinateIDs(path, name string) (specs.LinuxIDMapping, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return defaultSubordinateIDs, nil
+	}
+	if err != nil {
+		return specs.LinuxIDMapping{}, err
+	}
+	defer f.Close()
+	owners := []string{name}
+	if u, err := user.Lookup(name); err == nil {
+		owners = append(owners, u.Uid)
+	}
+	// free is past the ranges of the other users, to suggest one from.
+	free := uint64(defaultSubordinateIDs.HostID)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Split(strings.TrimSpace(s.Text()), ":")
+		if len(fields) != 3 {
+			continue
+		}
+		if !slices.Contains(owners, fields[0]) {
+			start, err1 := strconv.ParseUint(fields[1], 10, 32)
+			size, err2 := strconv.ParseUint(fields[2], 10, 32)
+			if err1 == nil && err2 == nil && start+size > free {
+				free = start + size
+			}
+			continue
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return specs.LinuxIDMapping{}, fmt.Errorf("invalid entry of %s in %s: %w", fields[0], path, err)
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil || size == 0 {
+			return specs.LinuxIDMapping{}, fmt.Errorf("invalid entry of %s in %s: count %q", fields[0], path, fields[2])
+		}
+		return specs.LinuxIDMapping{ContainerID: 0, HostID: uint32(start), Size: uint32(size)}, nil
+	}
+	if err := s.Err(); err != nil {
+		return specs.LinuxIDMapping{}, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return specs.LinuxIDMapping{}, fmt.Errorf("%s has no subordinate ids for %s, which the %s isolation maps containers to: add a range unused by other users, such as %s:%d:%d",
+		path, name, IsolationUserns, name, free, defaultSubordinateIDs.Size)
+}
@@ -0,0 +1,112 @@
+package container
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestParseIsolation(t *testing.T) {
+	for value, want := range map[string]string{
+		"":               "",
+		IsolationProcess: "",
+		IsolationUserns:  IsolationUserns,
+		IsolationVM:      IsolationVM,
+	} {
+		if got, err := ParseIsolation(value); err != nil || got != want {
+			t.Errorf("ParseIsolation(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseIsolation("gvisor"); err == nil {
+		t.Error("expected an unknown isolation to be rejected")
+	}
+}
+
+func TestSubordinateIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	writeFile(t, path, "alice:100000:65536\ncontainish:300000:10000\ncontainish:400000:10000\n", 0o644)
+	if m, err := subordinateIDs(path, usernsRemapUser); err != nil || m != (specs.LinuxIDMapping{ContainerID: 0, HostID: 300000, Size: 10000}) {
+		t.Errorf("subordinateIDs = %+v, %v, want the first range of %s", m, err, usernsRemapUser)
+	}
+	// The default range may be that of a user of the file.
+	writeFile(t, path, "alice:100000:65536\n", 0o644)
+	if m, err := subordinateIDs(path, usernsRemapUser); err == nil || !strings.Contains(err.Error(), usernsRemapUser+":165536:65536") {
+		t.Errorf("subordinateIDs of a user without an entry = %+v, %v, want an error", m, err)
+	}
+	if m, err := subordinateIDs(filepath.Join(t.TempDir(), "missing"), usernsRemapUser); err != nil || m != defaultSubordinateIDs {
+		t.Errorf("subordinateIDs of a missing file = %+v, %v", m, err)
+	}
+	writeFile(t, path, "containish:300000:0\n", 0o644)
+	if _, err := subordinateIDs(path, usernsRemapUser); err == nil {
+		t.Error("expected an empty range to be rejected")
+	}
+}
+
+func TestUsernsSandbox(t *testing.T) {
+	dir := t.TempDir()
+	origUID, origGID := subuidPath, subgidPath
+	subuidPath, subgidPath = filepath.Join(dir, "subuid"), filepath.Join(dir, "subgid")
+	defer func() { subuidPath, subgidPath = origUID, origGID }()
+	writeFile(t, subuidPath, "containish:200000:65536\n", 0o644)
+
+	spec := &specs.Spec{}
+	if err := (usernsSandbox{}).configure(spec, &RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !userNamespace(spec) {
+		t.Fatalf("namespaces %+v, want a user namespace", spec.Linux.Namespaces)
+	}
+	if m := spec.Linux.UIDMappings; len(m) != 1 || m[0].HostID != 200000 {
+		t.Errorf("uid mappings %+v, want those of /etc/subuid", m)
+	}
+	if m := spec.Linux.GIDMappings; len(m) != 1 || m[0] != defaultSubordinateIDs {
+		t.Errorf("gid mappings %+v, want the default without /etc/subgid", m)
+	}
+
+	// A user namespace of the spec keeps its mappings.
+	own := []specs.LinuxIDMapping{{ContainerID: 0, HostID: 1000, Size: 1}}
+	spec = &specs.Spec{Linux: &specs.Linux{
+		Namespaces:  []specs.LinuxNamespace{{Type: specs.UserNamespace}},
+		UIDMappings: own,
+		GIDMappings: own,
+	}}
+	if err := (usernsSandbox{}).configure(spec, &RunOptions{}); err != nil || len(spec.Linux.Namespaces) != 1 || spec.Linux.UIDMappings[0] != own[0] {
+		t.Errorf("spec %+v, %v, want its user namespace kept", spec.Linux, err)
+	}
+	if err := (usernsSandbox{}).configure(&specs.Spec{}, &RunOptions{Rootfs: RootfsHost}); err == nil {
+		t.Error("expected the host rootfs to be rejected")
+	}
+}
+
+func TestPlanUserns(t *testing.T) {
+	origUID, origGID := subuidPath, subgidPath
+	subuidPath, subgidPath = filepath.Join(t.TempDir(), "subuid"), filepath.Join(t.TempDir(), "subgid")
+	defer func() { subuidPath, subgidPath = origUID, origGID }()
+	origRoot := cgroupRoot
+	cgroupRoot = t.TempDir()
+	defer func() { cgroupRoot = origRoot }()
+
+	specPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(specPath, []byte(`{"ociVersion": "1.0.2", "root": {"path": "rootfs"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := planContainer("web", specPath, RunOptions{Isolation: IsolationUserns})
+	if err != nil {
+		t.Fatalf("planContainer failed: %v", err)
+	}
+	if !slices.Contains(p.CloneFlags, "CLONE_NEWUSER") || len(p.UIDMappings) != 1 || p.UIDMappings[0] != defaultSubordinateIDs {
+		t.Errorf("clone flags %v and uid mappings %+v, want a user namespace mapped to subordinate ids", p.CloneFlags, p.UIDMappings)
+	}
+	var out bytes.Buffer
+	if err := p.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Isolation:") {
+		t.Errorf("plan output lacks the isolation:\n%s", out.String())
+	}
+}
@@ -0,0 +1,165 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// AnnotationSdNotify, when set to "true" in the spec annotations, gives the
+// container a NOTIFY_SOCKET whose messages are forwarded to the socket
+// systemd handed to the runtime. This lets a Type=notify unit running
+// "containish run" report readiness from inside the container.
+const AnnotationSdNotify = "containish.sd-notify"
+
+// containerNotifySocket is where the forwarding socket is bind-mounted
+// inside the container.
+const containerNotifySocket = "/run/containish/notify.sock"
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// SdNotify sends a state string such as "READY=1" to the service manager. It
+// returns false without error when the process isn't running under systemd
+// with notification support.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if err := sendNotify(socket, []byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sendNotify writes a single datagram to a notify socket. A leading '@'
+// denotes an abstract socket.
+func sendNotify(socket string, msg []byte) error {
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if strings.HasPrefix(socket, "@") {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket %s: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to write to notify socket %s: %w", socket, err)
+	}
+	return nil
+}
+
+// ListenFds returns the listening sockets passed by systemd socket
+// activation, or nil when there are none. The LISTEN_* variables are
+// cleared so they aren't inherited by containers.
+func ListenFds() []*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	files := make([]*os.File, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		unix.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - listenFdsStart; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	return files
+}
+
+// listenNotify creates the notify socket of a container, a datagram socket
+// at path.
+func listenNotify(path string) (*net.UnixConn, error) {
+	_ = os.Remove(path)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create notify socket %s: %w", path, err)
+	}
+	// The container user may not be root, so let anyone send to it.
+	if err := os.Chmod(path, 0o777); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to chmod notify socket %s: %w", path, err)
+	}
+	return conn, nil
+}
+
+// serveNotify reads the messages sent to the notify socket of container id
+// until conn is closed. They are forwarded to hostSocket when set, and
+// READY=1 marks the container ready when ready is set.
+func serveNotify(conn *net.UnixConn, containerId, hostSocket string, ready bool) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if hostSocket != "" {
+			if err := sendNotify(hostSocket, buf[:n]); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to forward sd_notify message: %v\n", err)
+			}
+		}
+		if ready && slices.Contains(strings.Split(string(buf[:n]), "\n"), "READY=1") {
+			if err := markReady(containerId); err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+			ready = false
+		}
+	}
+}
+
+// serveNotifyFd serves, for the monitor of container id, the notify socket
+// the runtime passed as the fd v.
+func serveNotifyFd(v, containerId string) error {
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid NOTIFY_FD: %w", err)
+	}
+	f := os.NewFile(uintptr(fd), "notify-socket")
+	defer f.Close()
+	c, err := net.FileConn(f)
+	if err != nil {
+		return fmt.Errorf("invalid notify socket: %w", err)
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return fmt.Errorf("invalid notify socket")
+	}
+	go serveNotify(conn, containerId, "", true)
+	return nil
+}
+
+// markReady records that the process of container id is ready, which
+// makes a Starting container Running.
+func markReady(containerId string) error {
+	return updateState(containerId, func(c *Container) error {
+		if c.ReadyAt != nil || !c.Status.running() {
+			return nil
+		}
+		now := time.Now()
+		c.ReadyAt = &now
+		c.Status = Running
+		return nil
+	})
+}
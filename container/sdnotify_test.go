@@ -0,0 +1,125 @@
+package container
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenHostNotify creates a datagram socket standing in for systemd's.
+func listenHostNotify(t *testing.T) (*net.UnixConn, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "systemd.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := SdNotify("READY=1"); sent || err != nil {
+		t.Fatalf("SdNotify without socket = %v, %v", sent, err)
+	}
+
+	conn, path := listenHostNotify(t)
+	t.Setenv("NOTIFY_SOCKET", path)
+	if sent, err := SdNotify("READY=1"); !sent || err != nil {
+		t.Fatalf("SdNotify = %v, %v", sent, err)
+	}
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Fatalf("unexpected notification %q", got)
+	}
+}
+
+func TestNotifyRelay(t *testing.T) {
+	host, hostPath := listenHostNotify(t)
+	relayPath := filepath.Join(t.TempDir(), "notify.sock")
+
+	relay, err := listenNotify(relayPath)
+	if err != nil {
+		t.Fatalf("listenNotify failed: %v", err)
+	}
+	defer relay.Close()
+	go serveNotify(relay, "relay", hostPath, false)
+
+	if err := sendNotify(relayPath, []byte("STATUS=warming up")); err != nil {
+		t.Fatalf("sendNotify failed: %v", err)
+	}
+	if got := readNotify(t, host); got != "STATUS=warming up" {
+		t.Fatalf("unexpected forwarded message %q", got)
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	c := &Container{Id: "web", Status: Starting, Options: &RunOptions{Notify: true}}
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := listenNotify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go serveNotify(conn, c.Id, "", true)
+
+	if err := sendNotify(path, []byte("STATUS=loading")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendNotify(path, []byte("STATUS=serving\nREADY=1")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s, err := LoadState(c.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Status == Running && s.ReadyAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the container to become ready, got %s", s.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A stopped container doesn't come back to life.
+	c.Status, c.ReadyAt = Stopped, nil
+	if err := saveState(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := markReady(c.Id); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := LoadState(c.Id); s.Status != Stopped || s.ReadyAt != nil {
+		t.Errorf("expected a stopped container to stay stopped, got %s", s.Status)
+	}
+}
+
+func TestListenFdsWrongPid(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if files := ListenFds(); files != nil {
+		t.Fatalf("expected no fds for another pid, got %v", files)
+	}
+}
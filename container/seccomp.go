@@ -0,0 +1,362 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"unsafe"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// linux.seccomp is compiled into a classic BPF program run by the kernel on
+// every system call of the container process. The program receives a
+// struct seccomp_data:
+//
+//	struct seccomp_data {
+//		int   nr;
+//		__u32 arch;
+//		__u64 instruction_pointer;
+//		__u64 args[6];
+//	};
+//
+// and returns the action to take. Rules are checked in the order of the
+// spec and the first match decides; a system call no rule matches gets the
+// default action. Only the native architecture is filtered by name: calls
+// made through another ABI, such as 32-bit x86 or x32 on x86_64, fail with
+// ENOSYS.
+//
+// With listenerPath set, the filter is loaded with
+// SECCOMP_FILTER_FLAG_NEW_LISTENER and the notify fd it returns is sent to
+// the agent listening on that unix socket, with the container process state
+// as payload, so the agent can handle the system calls of SCMP_ACT_NOTIFY
+// rules on the container's behalf.
+
+// Offsets in struct seccomp_data.
+const (
+	seccompNrOff   = 0
+	seccompArchOff = 4
+	seccompArgsOff = 16
+)
+
+// Classic BPF opcodes used by the seccomp filter.
+const (
+	cbpfLdAbs = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+	cbpfAndK  = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+	cbpfJeqK  = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+	cbpfJgtK  = unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K
+	cbpfJgeK  = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+	cbpfRetK  = unix.BPF_RET | unix.BPF_K
+	// cbpfJumpFail is a placeholder patched to jump past the rule.
+	cbpfJumpFail = 0xff
+)
+
+// x32SyscallBit marks the system calls of the x32 ABI on x86_64.
+const x32SyscallBit = 0x40000000
+
+var seccompFlags = map[specs.LinuxSeccompFlag]uint{
+	specs.LinuxSeccompFlagLog:              unix.SECCOMP_FILTER_FLAG_LOG,
+	specs.LinuxSeccompFlagSpecAllow:        unix.SECCOMP_FILTER_FLAG_SPEC_ALLOW,
+	specs.LinuxSeccompFlagWaitKillableRecv: unix.SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV,
+}
+
+// nativeAudit returns the audit architecture of the system calls filtered
+// by name, see arch.go.
+func nativeAudit() (uint32, bool) {
+	return nativeAuditArch, nativeAuditArch != 0
+}
+
+// syscallNumbers maps system call names to their numbers.
+var syscallNumbers = func() map[string]uint32 {
+	m := make(map[string]uint32, len(syscallNames))
+	for nr, name := range syscallNames {
+		m[name] = uint32(nr)
+	}
+	return m
+}()
+
+// defaultSeccompProfile is a JSON file holding the linux.seccomp of specs
+// without one, see Config.
+var defaultSeccompProfile string
+
+// loadSeccompProfile reads a linux.seccomp from the JSON file at path.
+func loadSeccompProfile(path string) (*specs.LinuxSeccomp, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile: %w", err)
+	}
+	var s specs.LinuxSeccomp
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("invalid seccomp profile %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// seccompFilter is a compiled linux.seccomp.
+type seccompFilter struct {
+	prog  []unix.SockFilter
+	flags uint
+}
+
+// compileSeccomp compiles s, rejecting what the kernel would.
+func compileSeccomp(s *specs.LinuxSeccomp) (*seccompFilter, error) {
+	arch, ok := nativeAudit()
+	if !ok {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	f := &seccompFilter{}
+	for _, flag := range s.Flags {
+		v, ok := seccompFlags[flag]
+		if !ok {
+			return nil, fmt.Errorf("unknown seccomp flag %q", flag)
+		}
+		f.flags |= v
+	}
+	if s.ListenerPath != "" {
+		f.flags |= unix.SECCOMP_FILTER_FLAG_NEW_LISTENER
+	} else if f.flags&unix.SECCOMP_FILTER_FLAG_WAIT_KILLABLE_RECV != 0 {
+		return nil, fmt.Errorf("seccomp flag %s requires listenerPath", specs.LinuxSeccompFlagWaitKillableRecv)
+	}
+
+	if s.DefaultAction == specs.ActNotify {
+		return nil, fmt.Errorf("seccomp defaultAction can't be %s", specs.ActNotify)
+	}
+	defaultAction, err := seccompAction(s.DefaultAction, s.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+
+	f.prog = []unix.SockFilter{
+		bpfStmt(cbpfLdAbs, seccompArchOff),
+		bpfJump(cbpfJeqK, arch, 1, 0),
+		bpfStmt(cbpfRetK, enosys),
+	}
+	if x32Syscalls {
+		f.prog = append(f.prog,
+			bpfStmt(cbpfLdAbs, seccompNrOff),
+			bpfJump(cbpfJgeK, x32SyscallBit, 0, 1),
+			bpfStmt(cbpfRetK, enosys),
+		)
+	}
+	var notify bool
+	for _, sc := range s.Syscalls {
+		action, err := seccompAction(sc.Action, sc.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		notify = notify || sc.Action == specs.ActNotify
+		for _, name := range sc.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				// Like libseccomp, skip system calls this kernel
+				// architecture doesn't have.
+				continue
+			}
+			rule, err := compileSeccompRule(nr, sc.Args, action)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seccomp rule for %s: %w", name, err)
+			}
+			f.prog = append(f.prog, rule...)
+		}
+	}
+	if notify && s.ListenerPath == "" {
+		return nil, fmt.Errorf("seccomp action %s requires listenerPath", specs.ActNotify)
+	}
+	f.prog = append(f.prog, bpfStmt(cbpfRetK, defaultAction))
+	if len(f.prog) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp filter has %d instructions, more than the %d allowed", len(f.prog), unix.BPF_MAXINSNS)
+	}
+	return f, nil
+}
+
+// compileSeccompRule returns the instructions returning action for the
+// system call nr when all args match, and falling through otherwise.
+func compileSeccompRule(nr uint32, args []specs.LinuxSeccompArg, action uint32) ([]unix.SockFilter, error) {
+	rule := []unix.SockFilter{
+		bpfStmt(cbpfLdAbs, seccompNrOff),
+		bpfJump(cbpfJeqK, nr, 0, cbpfJumpFail),
+	}
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("argument index %d out of range", arg.Index)
+		}
+		// Arguments are 64 bits, compared a 32 bit word at a time, in
+		// the byte order of the architecture.
+		lo := uint32(seccompArgsOff + 8*arg.Index)
+		hi := lo + 4
+		if bigEndian {
+			lo, hi = hi, lo
+		}
+		vlo, vhi := uint32(arg.Value), uint32(arg.Value>>32)
+		switch arg.Op {
+		case specs.OpEqualTo:
+			rule = append(rule,
+				bpfStmt(cbpfLdAbs, hi), bpfJump(cbpfJeqK, vhi, 0, cbpfJumpFail),
+				bpfStmt(cbpfLdAbs, lo), bpfJump(cbpfJeqK, vlo, 0, cbpfJumpFail))
+		case specs.OpNotEqual:
+			rule = append(rule,
+				bpfStmt(cbpfLdAbs, hi), bpfJump(cbpfJeqK, vhi, 0, 2),
+				bpfStmt(cbpfLdAbs, lo), bpfJump(cbpfJeqK, vlo, cbpfJumpFail, 0))
+		case specs.OpMaskedEqual:
+			mlo, mhi := vlo, vhi
+			wlo, whi := uint32(arg.ValueTwo), uint32(arg.ValueTwo>>32)
+			rule = append(rule,
+				bpfStmt(cbpfLdAbs, hi), bpfStmt(cbpfAndK, mhi), bpfJump(cbpfJeqK, whi, 0, cbpfJumpFail),
+				bpfStmt(cbpfLdAbs, lo), bpfStmt(cbpfAndK, mlo), bpfJump(cbpfJeqK, wlo, 0, cbpfJumpFail))
+		case specs.OpGreaterThan, specs.OpGreaterEqual:
+			// Greater if the high word is, or it is equal and the
+			// low word is.
+			last := bpfJump(cbpfJgtK, vlo, 0, cbpfJumpFail)
+			if arg.Op == specs.OpGreaterEqual {
+				last = bpfJump(cbpfJgeK, vlo, 0, cbpfJumpFail)
+			}
+			rule = append(rule,
+				bpfStmt(cbpfLdAbs, hi), bpfJump(cbpfJgtK, vhi, 3, 0), bpfJump(cbpfJeqK, vhi, 0, cbpfJumpFail),
+				bpfStmt(cbpfLdAbs, lo), last)
+		case specs.OpLessThan, specs.OpLessEqual:
+			last := bpfJump(cbpfJgeK, vlo, cbpfJumpFail, 0)
+			if arg.Op == specs.OpLessEqual {
+				last = bpfJump(cbpfJgtK, vlo, cbpfJumpFail, 0)
+			}
+			rule = append(rule,
+				bpfStmt(cbpfLdAbs, hi), bpfJump(cbpfJgeK, vhi, 0, 3), bpfJump(cbpfJeqK, vhi, 0, cbpfJumpFail),
+				bpfStmt(cbpfLdAbs, lo), last)
+		default:
+			return nil, fmt.Errorf("unknown operator %q", arg.Op)
+		}
+	}
+	rule = append(rule, bpfStmt(cbpfRetK, action))
+
+	// A failed match jumps past the return.
+	for i := range rule {
+		if rule[i].Code&0x07 != unix.BPF_JMP {
+			continue
+		}
+		fail := uint8(len(rule) - i - 1)
+		if rule[i].Jt == cbpfJumpFail {
+			rule[i].Jt = fail
+		}
+		if rule[i].Jf == cbpfJumpFail {
+			rule[i].Jf = fail
+		}
+	}
+	return rule, nil
+}
+
+// seccompAction returns the filter return value of an action.
+func seccompAction(action specs.LinuxSeccompAction, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		if *errnoRet > unix.SECCOMP_RET_DATA {
+			return 0, fmt.Errorf("seccomp errnoRet %d out of range", *errnoRet)
+		}
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case specs.ActKill, specs.ActKillThread:
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case specs.ActKillProcess:
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case specs.ActTrap:
+		return unix.SECCOMP_RET_TRAP, nil
+	case specs.ActErrno:
+		return unix.SECCOMP_RET_ERRNO | errno, nil
+	case specs.ActTrace:
+		return unix.SECCOMP_RET_TRACE | errno, nil
+	case specs.ActAllow:
+		return unix.SECCOMP_RET_ALLOW, nil
+	case specs.ActLog:
+		return unix.SECCOMP_RET_LOG, nil
+	case specs.ActNotify:
+		return unix.SECCOMP_RET_USER_NOTIF, nil
+	}
+	return 0, fmt.Errorf("unknown seccomp action %q", action)
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// load installs the filter on the calling thread, which must stay locked
+// to the goroutine until it executes the container process. It returns the
+// notify fd when the filter has a listener, -1 otherwise.
+func (f *seccompFilter) load() (int, error) {
+	prog := unix.SockFprog{Len: uint16(len(f.prog)), Filter: &f.prog[0]}
+	fd, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, uintptr(f.flags), uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return -1, fmt.Errorf("failed to load seccomp filter: %w", errno)
+	}
+	if f.flags&unix.SECCOMP_FILTER_FLAG_NEW_LISTENER == 0 {
+		return -1, nil
+	}
+	return int(fd), nil
+}
+
+// loadSeccomp installs the filter of s on the calling thread, which is
+// locked to the goroutine so that it is the one executing the container
+// process, and sends the notify fd to the agent on conn when s has a
+// listener.
+func loadSeccomp(s *specs.LinuxSeccomp, conn *net.UnixConn, state *specs.State) error {
+	f, err := compileSeccomp(s)
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	fd, err := f.load()
+	if err != nil || fd < 0 {
+		return err
+	}
+	defer unix.Close(fd)
+	return sendSeccompFd(conn, fd, s, *state)
+}
+
+// dialSeccompListener connects to the seccomp agent at path. It is called
+// while the host filesystem is still visible.
+func dialSeccompListener(path string) (*net.UnixConn, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to seccomp listener: %w", err)
+	}
+	return conn.(*net.UnixConn), nil
+}
+
+// sendSeccompFd sends the notify fd to the seccomp agent along with the
+// container process state, as the runtime spec describes.
+func sendSeccompFd(conn *net.UnixConn, fd int, s *specs.LinuxSeccomp, state specs.State) error {
+	data, err := json.Marshal(specs.ContainerProcessState{
+		Version:  specs.Version,
+		Fds:      []string{specs.SeccompFdName},
+		Pid:      state.Pid,
+		Metadata: s.ListenerMetadata,
+		State:    state,
+	})
+	if err != nil {
+		return err
+	}
+	if _, _, err := conn.WriteMsgUnix(data, unix.UnixRights(fd), nil); err != nil {
+		return fmt.Errorf("failed to send seccomp fd: %w", err)
+	}
+	return nil
+}
+
+// hostPid returns the pid of the calling process in the pid namespace of
+// the host's /proc, before the container's replaces it.
+func hostPid() (int, error) {
+	var pid int
+	link, err := os.Readlink("/proc/self")
+	if err == nil {
+		_, err = fmt.Sscanf(link, "%d", &pid)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read host pid: %w", err)
+	}
+	return pid, nil
+}
@@ -0,0 +1,210 @@
+package container
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// runFilter interprets the filter for a system call with args, like the
+// kernel does.
+func runFilter(t *testing.T, f *seccompFilter, arch uint32, nr uint32, args ...uint64) uint32 {
+	t.Helper()
+	data := make([]byte, 64)
+	binary.NativeEndian.PutUint32(data[seccompNrOff:], nr)
+	binary.NativeEndian.PutUint32(data[seccompArchOff:], arch)
+	for i, a := range args {
+		binary.NativeEndian.PutUint64(data[seccompArgsOff+8*i:], a)
+	}
+	var acc uint32
+	for pc := 0; pc < len(f.prog); pc++ {
+		in := f.prog[pc]
+		switch in.Code {
+		case cbpfLdAbs:
+			acc = binary.NativeEndian.Uint32(data[in.K:])
+		case cbpfAndK:
+			acc &= in.K
+		case cbpfRetK:
+			return in.K
+		case cbpfJeqK, cbpfJgtK, cbpfJgeK:
+			var ok bool
+			switch in.Code {
+			case cbpfJeqK:
+				ok = acc == in.K
+			case cbpfJgtK:
+				ok = acc > in.K
+			default:
+				ok = acc >= in.K
+			}
+			if ok {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		default:
+			t.Fatalf("unexpected instruction %+v at %d", in, pc)
+		}
+	}
+	t.Fatal("filter ran off its end")
+	return 0
+}
+
+func uintPtr(v uint) *uint { return &v }
+
+func TestCompileSeccomp(t *testing.T) {
+	arch, ok := nativeAudit()
+	if !ok {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+	nr := func(name string) uint32 {
+		n, ok := syscallNumbers[name]
+		if !ok {
+			t.Fatalf("no system call %s", name)
+		}
+		return n
+	}
+
+	f, err := compileSeccomp(&specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"mkdirat", "no_such_call"}, Action: specs.ActErrno, ErrnoRet: uintPtr(uint(unix.EACCES))},
+			{Names: []string{"kill"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Index: 1, Value: 9, Op: specs.OpEqualTo}}},
+			{Names: []string{"personality"}, Action: specs.ActKillProcess, Args: []specs.LinuxSeccompArg{{Index: 0, Value: 0xffffffff, Op: specs.OpNotEqual}}},
+			{Names: []string{"clone"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Index: 0, Value: unix.CLONE_NEWUSER, ValueTwo: unix.CLONE_NEWUSER, Op: specs.OpMaskedEqual}}},
+			{Names: []string{"lseek"}, Action: specs.ActTrap, Args: []specs.LinuxSeccompArg{{Index: 2, Value: 1 << 32, Op: specs.OpGreaterEqual}}},
+			{Names: []string{"dup3"}, Action: specs.ActLog, Args: []specs.LinuxSeccompArg{{Index: 1, Value: 3, Op: specs.OpLessThan}}},
+			{Names: []string{"mkdirat"}, Action: specs.ActKillProcess},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eacces := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EACCES))
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	enosys := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS))
+	for _, tt := range []struct {
+		name string
+		arch uint32
+		nr   uint32
+		args []uint64
+		want uint32
+	}{
+		{"default", arch, nr("getpid"), nil, unix.SECCOMP_RET_ALLOW},
+		{"first rule wins", arch, nr("mkdirat"), nil, eacces},
+		{"other arch", unix.AUDIT_ARCH_I386, nr("getpid"), nil, enosys},
+		{"eq match", arch, nr("kill"), []uint64{1, 9}, eperm},
+		{"eq mismatch", arch, nr("kill"), []uint64{1, 15}, unix.SECCOMP_RET_ALLOW},
+		{"eq high word", arch, nr("kill"), []uint64{1, 1<<32 | 9}, unix.SECCOMP_RET_ALLOW},
+		{"ne equal", arch, nr("personality"), []uint64{0xffffffff}, unix.SECCOMP_RET_ALLOW},
+		{"ne low word", arch, nr("personality"), []uint64{8}, unix.SECCOMP_RET_KILL_PROCESS},
+		{"ne high word", arch, nr("personality"), []uint64{1<<32 | 0xffffffff}, unix.SECCOMP_RET_KILL_PROCESS},
+		{"masked match", arch, nr("clone"), []uint64{unix.CLONE_NEWUSER | unix.CLONE_NEWNS}, eperm},
+		{"masked mismatch", arch, nr("clone"), []uint64{unix.CLONE_NEWNS}, unix.SECCOMP_RET_ALLOW},
+		{"ge above", arch, nr("lseek"), []uint64{0, 0, 1<<32 + 1}, unix.SECCOMP_RET_TRAP},
+		{"ge equal", arch, nr("lseek"), []uint64{0, 0, 1 << 32}, unix.SECCOMP_RET_TRAP},
+		{"ge below", arch, nr("lseek"), []uint64{0, 0, 1<<32 - 1}, unix.SECCOMP_RET_ALLOW},
+		{"lt below", arch, nr("dup3"), []uint64{0, 2}, unix.SECCOMP_RET_LOG},
+		{"lt equal", arch, nr("dup3"), []uint64{0, 3}, unix.SECCOMP_RET_ALLOW},
+		{"lt high word", arch, nr("dup3"), []uint64{0, 1 << 32}, unix.SECCOMP_RET_ALLOW},
+	} {
+		if got := runFilter(t, f, tt.arch, tt.nr, tt.args...); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+	if x32Syscalls {
+		if got := runFilter(t, f, arch, x32SyscallBit|nr("getpid")); got != enosys {
+			t.Errorf("x32 system call: got %#x, want ENOSYS", got)
+		}
+	}
+}
+
+func TestCompileSeccompErrors(t *testing.T) {
+	if _, ok := nativeAudit(); !ok {
+		t.Skip("seccomp is not supported on this architecture")
+	}
+	notify := []specs.LinuxSyscall{{Names: []string{"mount"}, Action: specs.ActNotify}}
+	for _, tt := range []struct {
+		seccomp specs.LinuxSeccomp
+		want    string
+	}{
+		{specs.LinuxSeccomp{DefaultAction: "SCMP_ACT_NOPE"}, "unknown seccomp action"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActNotify, ListenerPath: "/run/agent.sock"}, "defaultAction"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: notify}, "requires listenerPath"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Flags: []specs.LinuxSeccompFlag{"SECCOMP_FILTER_FLAG_NOPE"}}, "unknown seccomp flag"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Flags: []specs.LinuxSeccompFlag{specs.LinuxSeccompFlagWaitKillableRecv}}, "requires listenerPath"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActErrno, DefaultErrnoRet: uintPtr(1 << 16)}, "out of range"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: []specs.LinuxSyscall{{Names: []string{"kill"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Index: 6, Op: specs.OpEqualTo}}}}}, "out of range"},
+		{specs.LinuxSeccomp{DefaultAction: specs.ActAllow, Syscalls: []specs.LinuxSyscall{{Names: []string{"kill"}, Action: specs.ActErrno, Args: []specs.LinuxSeccompArg{{Op: "SCMP_CMP_NOPE"}}}}}, "unknown operator"},
+	} {
+		if _, err := compileSeccomp(&tt.seccomp); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%+v: got %v, want an error containing %q", tt.seccomp, err, tt.want)
+		}
+	}
+
+	f, err := compileSeccomp(&specs.LinuxSeccomp{DefaultAction: specs.ActAllow, ListenerPath: "/run/agent.sock", Syscalls: notify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.flags&unix.SECCOMP_FILTER_FLAG_NEW_LISTENER == 0 {
+		t.Fatal("a filter with a listener doesn't ask for a notify fd")
+	}
+}
+
+func TestSendSeccompFd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := dialSeccompListener(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	agent, err := l.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := &specs.LinuxSeccomp{ListenerPath: path, ListenerMetadata: "emulate-mknod"}
+	state := specs.State{ID: "c1", Status: specs.StateCreating, Pid: 42, Bundle: "/bundle"}
+	if err := sendSeccompFd(conn, int(f.Fd()), s, state); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := agent.ReadMsgUnix(buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("expected one control message, got %v, %v", msgs, err)
+	}
+	fds, err := unix.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("expected one fd, got %v, %v", fds, err)
+	}
+	unix.Close(fds[0])
+	got := string(buf[:n])
+	for _, want := range []string{`"fds":["seccompFd"]`, `"pid":42`, `"metadata":"emulate-mknod"`, `"id":"c1"`, `"status":"creating"`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("payload %s lacks %s", got, want)
+		}
+	}
+}
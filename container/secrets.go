@@ -0,0 +1,231 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Secrets are files of the host handed to the container without going
+// through its rootfs or state. The runtime reads them when the container
+// starts and sends their contents down the init pipes; the child stage
+// writes them into a tmpfs on /run/secrets readable only by the container
+// user, or into the environment of the container process. The tmpfs
+// belongs to the mount namespace of the container, so it goes away with
+// the container when it stops. Only the host paths are saved.
+
+// secretsDir is where file secrets are mounted in the container.
+const secretsDir = "/run/secrets"
+
+// maxSecretSize is the largest secret file accepted.
+const maxSecretSize = 1 << 20
+
+// Secret is a host file exposed to the container, as a file under
+// /run/secrets, an environment variable, or both.
+type Secret struct {
+	// Source is the file on the host.
+	Source string `json:"source"`
+	// Target is the path of the secret in the container, under
+	// /run/secrets.
+	Target string `json:"target,omitempty"`
+	// Env is an environment variable of the container process set to the
+	// contents of Source, without a trailing newline.
+	Env string `json:"env,omitempty"`
+}
+
+// stageSecret is a file secret sent to the child stage.
+type stageSecret struct {
+	Target string `json:"target"`
+	Data   []byte `json:"data"`
+}
+
+// ParseSecret parses a --secret value of the form
+// "src=<file>[,target=<path>][,env=<name>]". A relative target is relative
+// to /run/secrets; without a target or env the secret is mounted as
+// /run/secrets/<base name of src>.
+func ParseSecret(value string) (Secret, error) {
+	var s Secret
+	for _, field := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok || val == "" {
+			return s, fmt.Errorf("invalid secret %q: expected src=<file>[,target=<path>][,env=<name>]", value)
+		}
+		switch key {
+		case "src", "source":
+			s.Source = val
+		case "target", "dst":
+			s.Target = val
+		case "env":
+			s.Env = val
+		default:
+			return s, fmt.Errorf("invalid secret %q: unknown option %q", value, key)
+		}
+	}
+	if s.Source == "" {
+		return s, fmt.Errorf("invalid secret %q: missing src", value)
+	}
+	src, err := filepath.Abs(s.Source)
+	if err != nil {
+		return s, err
+	}
+	s.Source = src
+	if s.Target == "" && s.Env == "" {
+		s.Target = filepath.Base(s.Source)
+	}
+	if s.Target != "" && !filepath.IsAbs(s.Target) {
+		s.Target = filepath.Join(secretsDir, s.Target)
+	}
+	if s.Target != "" {
+		s.Target = filepath.Clean(s.Target)
+	}
+	if err := validateSecrets([]Secret{s}); err != nil {
+		return s, fmt.Errorf("invalid secret %q: %w", value, err)
+	}
+	return s, nil
+}
+
+// validateSecrets checks the targets and variables of secrets and rejects
+// two secrets with the same one.
+func validateSecrets(secrets []Secret) error {
+	targets := map[string]bool{}
+	envs := map[string]bool{}
+	for _, s := range secrets {
+		if !filepath.IsAbs(s.Source) {
+			return fmt.Errorf("secret source %q must be an absolute path", s.Source)
+		}
+		if s.Target == "" && s.Env == "" {
+			return fmt.Errorf("secret %s has neither a target nor an env", s.Source)
+		}
+		if s.Target != "" {
+			if !strings.HasPrefix(s.Target, secretsDir+"/") || filepath.Clean(s.Target) != s.Target {
+				return fmt.Errorf("secret target %q must be a clean path under %s", s.Target, secretsDir)
+			}
+			if targets[s.Target] {
+				return fmt.Errorf("duplicate secret target %s", s.Target)
+			}
+			targets[s.Target] = true
+		}
+		if s.Env != "" {
+			if strings.ContainsAny(s.Env, "=\x00") {
+				return fmt.Errorf("invalid secret env name %q", s.Env)
+			}
+			if envs[s.Env] {
+				return fmt.Errorf("duplicate secret env %s", s.Env)
+			}
+			envs[s.Env] = true
+		}
+	}
+	// A file can't also be the directory of another.
+	for t := range targets {
+		for dir := filepath.Dir(t); dir != secretsDir; dir = filepath.Dir(dir) {
+			if targets[dir] {
+				return fmt.Errorf("secret target %s is inside secret %s", t, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// readSecrets reads the secrets from the host, returning the files to
+// mount and the environment variables to set.
+func readSecrets(secrets []Secret) (files []stageSecret, env []string, err error) {
+	for _, s := range secrets {
+		data, err := readSecret(s.Source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.Target != "" {
+			files = append(files, stageSecret{Target: s.Target, Data: data})
+		}
+		if s.Env != "" {
+			value := bytes.TrimSuffix(data, []byte("\n"))
+			if bytes.IndexByte(value, 0) >= 0 {
+				return nil, nil, fmt.Errorf("secret %s contains a NUL byte and can't be an environment variable", s.Source)
+			}
+			env = append(env, s.Env+"="+string(value))
+		}
+	}
+	return files, env, nil
+}
+
+// readSecret reads a secret file of at most maxSecretSize bytes.
+func readSecret(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret: %w", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSecretSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", path, err)
+	}
+	if len(data) > maxSecretSize {
+		return nil, fmt.Errorf("secret %s is larger than %d bytes", path, maxSecretSize)
+	}
+	return data, nil
+}
+
+// mountSecrets mounts a tmpfs on root/run/secrets, writes files into it
+// owned by uid and gid and readable only by them, and makes it read-only.
+func mountSecrets(root string, files []stageSecret, uid, gid int) error {
+	const flags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+	return mountInRoot(root, mountTarget{path: secretsDir, dir: true}, func(dir string) error {
+		if err := unix.Mount("tmpfs", dir, "tmpfs", flags, "mode=0500"); err != nil {
+			return fmt.Errorf("failed to mount tmpfs on %s: %w", secretsDir, err)
+		}
+		return nil
+	}, func(dir string) error {
+		if err := unix.Mount("", dir, "", unix.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("failed to make %s private: %w", secretsDir, err)
+		}
+		// dir is the new tmpfs, holding nothing but what is written here.
+		if err := writeSecrets(dir, files, uid, gid); err != nil {
+			return err
+		}
+		if err := unix.Mount("", dir, "", unix.MS_REMOUNT|unix.MS_RDONLY|flags, "mode=0500"); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", secretsDir, err)
+		}
+		return nil
+	})
+}
+
+// writeSecrets writes files into dir, the secrets dir of the container,
+// with the directories they need.
+func writeSecrets(dir string, files []stageSecret, uid, gid int) error {
+	chown := func(path string) error {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown secret %s: %w", path, err)
+		}
+		return nil
+	}
+	if err := chown(dir); err != nil {
+		return err
+	}
+	for _, f := range files {
+		rel, err := filepath.Rel(secretsDir, f.Target)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("secret target %q must be under %s", f.Target, secretsDir)
+		}
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0o500); err != nil {
+			return fmt.Errorf("failed to create secret dir: %w", err)
+		}
+		for d := filepath.Dir(path); d != dir; d = filepath.Dir(d) {
+			if err := chown(d); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(path, f.Data, 0o400); err != nil {
+			return fmt.Errorf("failed to write secret %s: %w", f.Target, err)
+		}
+		if err := chown(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSecret(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  Secret
+	}{
+		{"src=/etc/db-password", Secret{Source: "/etc/db-password", Target: "/run/secrets/db-password"}},
+		{"src=/etc/db-password,target=db/password", Secret{Source: "/etc/db-password", Target: "/run/secrets/db/password"}},
+		{"src=/etc/token,target=/run/secrets/token,env=TOKEN", Secret{Source: "/etc/token", Target: "/run/secrets/token", Env: "TOKEN"}},
+		{"src=/etc/token,env=TOKEN", Secret{Source: "/etc/token", Env: "TOKEN"}},
+	} {
+		got, err := ParseSecret(tc.value)
+		if err != nil {
+			t.Errorf("ParseSecret(%q) failed: %v", tc.value, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseSecret(%q) = %+v, want %+v", tc.value, got, tc.want)
+		}
+	}
+
+	got, err := ParseSecret("src=token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(got.Source) {
+		t.Fatalf("relative source not made absolute: %s", got.Source)
+	}
+
+	for _, value := range []string{
+		"",
+		"target=/run/secrets/x",
+		"src=/etc/x,mode=0400",
+		"src=/etc/x,target=/etc/shadow",
+		"src=/etc/x,target=../escape",
+		"src=/etc/x,target=/run/secrets",
+		"src=/etc/x,env=A=B",
+	} {
+		if _, err := ParseSecret(value); err == nil {
+			t.Errorf("expected ParseSecret(%q) to fail", value)
+		}
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	for _, secrets := range [][]Secret{
+		{{Source: "/a", Target: "/run/secrets/x"}, {Source: "/b", Target: "/run/secrets/x"}},
+		{{Source: "/a", Env: "X"}, {Source: "/b", Env: "X"}},
+		{{Source: "/a", Target: "/run/secrets/x"}, {Source: "/b", Target: "/run/secrets/x/y"}},
+	} {
+		if err := validateSecrets(secrets); err == nil {
+			t.Errorf("expected %+v to be rejected", secrets)
+		}
+	}
+}
+
+func TestReadAndWriteSecrets(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "password"), "hunter2\n", 0o600)
+	writeFile(t, filepath.Join(dir, "cert"), "-----BEGIN-----\n", 0o600)
+
+	files, env, err := readSecrets([]Secret{
+		{Source: filepath.Join(dir, "password"), Target: "/run/secrets/password", Env: "PASSWORD"},
+		{Source: filepath.Join(dir, "cert"), Target: "/run/secrets/tls/cert"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(env, []string{"PASSWORD=hunter2"}) {
+		t.Fatalf("env = %q", env)
+	}
+
+	mnt := t.TempDir()
+	if err := writeSecrets(mnt, files, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"password": "hunter2\n", "tls/cert": "-----BEGIN-----\n"} {
+		p := filepath.Join(mnt, path)
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", path, data, want)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o400 {
+			t.Errorf("%s has mode %v, want 0400", path, info.Mode().Perm())
+		}
+	}
+	// Let t.TempDir clean up.
+	if err := os.Chmod(filepath.Join(mnt, "tls"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	big := filepath.Join(dir, "big")
+	writeFile(t, big, strings.Repeat("x", maxSecretSize+1), 0o600)
+	if _, _, err := readSecrets([]Secret{{Source: big, Target: "/run/secrets/big"}}); err == nil {
+		t.Fatal("expected an oversized secret to be rejected")
+	}
+	if _, _, err := readSecrets([]Secret{{Source: filepath.Join(dir, "missing"), Env: "X"}}); err == nil {
+		t.Fatal("expected a missing secret to be rejected")
+	}
+}
+
+func TestSecretsPlan(t *testing.T) {
+	specPath := filepath.Join(t.TempDir(), "config.json")
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "process": {"cwd": "/", "args": ["sh"]}}`, 0o644)
+	rt, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := rt.Plan("secret", specPath, WithSecrets(
+		Secret{Source: "/etc/token", Target: "/run/secrets/token"},
+		Secret{Source: "/etc/password", Env: "PASSWORD"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := p.Mounts[len(p.Mounts)-1]
+	if last.Destination != secretsDir || !last.AfterPivot {
+		t.Fatalf("secrets not mounted after pivot_root: %+v", p.Mounts)
+	}
+	if !slices.Contains(p.Env, "PASSWORD=<secret from /etc/password>") {
+		t.Fatalf("secret env not planned: %q", p.Env)
+	}
+
+	writeFile(t, specPath, `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "linux": {"rootfsPropagation": "rshared"}}`, 0o644)
+	if _, err := rt.Plan("secret", specPath, WithSecrets(Secret{Source: "/etc/token", Target: "/run/secrets/token"})); err == nil {
+		t.Fatal("expected secrets with shared propagation to be rejected")
+	}
+}
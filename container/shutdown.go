@@ -0,0 +1,233 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Before the host shuts down, ShutdownAll stops every running container
+// with its stop signal and timeout rather than leaving them to be killed,
+// and records which were running under the storage dir, which unlike the
+// state dir survives a reboot. RestoreAll then starts them again, running
+// them from their recorded spec and options if their state is gone with
+// the state dir. Containers listing others in their containish.depends-on
+// annotation are stopped before those and started after them; the others
+// are stopped and started in parallel.
+
+// AnnotationDependsOn lists the containers a container depends on,
+// separated by commas.
+const AnnotationDependsOn = "containish.depends-on"
+
+// shutdownRecordPath records the containers ShutdownAll stopped. It is a
+// variable so tests can override it.
+var shutdownRecordPath = "/var/lib/containish/shutdown.json"
+
+// shutdownRecord is what ShutdownAll records for RestoreAll.
+type shutdownRecord struct {
+	Time       time.Time             `json:"time"`
+	Containers []shutdownRecordEntry `json:"containers"`
+}
+
+// shutdownRecordEntry is a container stopped by ShutdownAll.
+type shutdownRecordEntry struct {
+	Id        string      `json:"id"`
+	SpecPath  string      `json:"specPath"`
+	Options   *RunOptions `json:"options"`
+	DependsOn []string    `json:"dependsOn,omitempty"`
+}
+
+// ContainerResult is the outcome of an operation on one of several
+// containers.
+type ContainerResult struct {
+	Id  string
+	Err error
+}
+
+// dependsOn returns the containers the annotations of a container say it
+// depends on.
+func dependsOn(annotations map[string]string) []string {
+	var deps []string
+	for _, d := range strings.Split(annotations[AnnotationDependsOn], ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// dependencyLevels orders ids so every container comes in a level after
+// those of deps it depends on. Dependencies outside ids are ignored.
+func dependencyLevels(ids []string, deps map[string][]string) ([][]string, error) {
+	remaining := map[string]bool{}
+	for _, id := range ids {
+		remaining[id] = true
+	}
+	var levels [][]string
+	for len(remaining) > 0 {
+		var level []string
+		for _, id := range ids {
+			if !remaining[id] {
+				continue
+			}
+			ready := true
+			for _, d := range deps[id] {
+				if remaining[d] && d != id {
+					ready = false
+				}
+			}
+			if ready {
+				level = append(level, id)
+			}
+		}
+		if len(level) == 0 {
+			var cycle []string
+			for id := range remaining {
+				cycle = append(cycle, id)
+			}
+			slices.Sort(cycle)
+			return nil, fmt.Errorf("the dependencies of %s form a cycle", strings.Join(cycle, ", "))
+		}
+		for _, id := range level {
+			delete(remaining, id)
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// ShutdownAll stops every running container, dependents first, as Stop
+// does with opts, and records them for RestoreAll. The containers of a
+// level are stopped in parallel, and one failing doesn't stop the others.
+func (r *Runtime) ShutdownAll(ctx context.Context, opts ...StopOption) ([]ContainerResult, error) {
+	containers, err := r.Find(StateFilter{Status: []Status{Running, Starting}})
+	if err != nil {
+		return nil, err
+	}
+	record := shutdownRecord{Time: time.Now().UTC()}
+	var ids []string
+	deps := map[string][]string{}
+	for _, c := range containers {
+		ids = append(ids, c.Id)
+		deps[c.Id] = dependsOn(c.Annotations)
+		// A container without saved options can't be started again.
+		if c.Options != nil && c.SpecPath != "" {
+			record.Containers = append(record.Containers, shutdownRecordEntry{Id: c.Id, SpecPath: c.SpecPath, Options: c.Options, DependsOn: deps[c.Id]})
+		}
+	}
+	levels, err := dependencyLevels(ids, deps)
+	if err != nil {
+		return nil, err
+	}
+	// Recorded first, so a shutdown cut short still restores them.
+	if err := saveShutdownRecord(record); err != nil {
+		return nil, err
+	}
+
+	return stopLevels(levels, func(id string) error {
+		return r.Stop(ctx, id, opts...)
+	}), nil
+}
+
+// RestoreAll starts again the containers the last ShutdownAll stopped,
+// dependencies first, then forgets them. Those running already are skipped,
+// and those whose dependency failed to start aren't started. Without a
+// record it does nothing.
+func (r *Runtime) RestoreAll(ctx context.Context) ([]ContainerResult, error) {
+	data, err := os.ReadFile(shutdownRecordPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shutdown record: %w", err)
+	}
+	var record shutdownRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid shutdown record %s: %w", shutdownRecordPath, err)
+	}
+	var ids []string
+	entries := map[string]shutdownRecordEntry{}
+	deps := map[string][]string{}
+	for _, e := range record.Containers {
+		ids = append(ids, e.Id)
+		entries[e.Id] = e
+		deps[e.Id] = e.DependsOn
+	}
+	levels, err := dependencyLevels(ids, deps)
+	if err != nil {
+		return nil, err
+	}
+
+	results := startLevels(levels, deps, func(id string) error {
+		return r.restore(ctx, entries[id])
+	})
+	if err := os.Remove(shutdownRecordPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return results, fmt.Errorf("failed to remove shutdown record: %w", err)
+	}
+	return results, nil
+}
+
+// restore starts the container of e again.
+func (r *Runtime) restore(ctx context.Context, e shutdownRecordEntry) error {
+	c, err := r.State(e.Id)
+	if err == nil {
+		if c.Status.running() {
+			return nil
+		}
+		return r.Start(ctx, e.Id)
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if e.Options == nil {
+		return fmt.Errorf("container %s has no saved configuration", e.Id)
+	}
+	options, err := cloneOptions(*e.Options)
+	if err != nil {
+		return err
+	}
+	options.Detach = true
+	options.ConsoleSocket = ""
+	return runContainer(ctx, e.Id, e.SpecPath, *options)
+}
+
+// saveShutdownRecord replaces the shutdown record with record.
+func saveShutdownRecord(record shutdownRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(shutdownRecordPath), 0o700); err != nil {
+		return fmt.Errorf("failed to save shutdown record: %w", err)
+	}
+	tmp := shutdownRecordPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save shutdown record: %w", err)
+	}
+	if err := os.Rename(tmp, shutdownRecordPath); err != nil {
+		return fmt.Errorf("failed to save shutdown record: %w", err)
+	}
+	return nil
+}
+
+// inParallel applies op to every container of ids at once.
+func inParallel(ids []string, op func(id string) error) []ContainerResult {
+	results := make([]ContainerResult, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = ContainerResult{Id: id, Err: op(id)}
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,90 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDependencyLevels(t *testing.T) {
+	deps := map[string][]string{
+		"web":    dependsOn(map[string]string{AnnotationDependsOn: "api, cache"}),
+		"api":    dependsOn(map[string]string{AnnotationDependsOn: "db,gone"}),
+		"cache":  nil,
+		"db":     dependsOn(map[string]string{AnnotationDependsOn: "db"}),
+		"worker": dependsOn(map[string]string{AnnotationDependsOn: "db"}),
+	}
+	levels, err := dependencyLevels([]string{"api", "cache", "db", "web", "worker"}, deps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"cache", "db"}, {"api", "worker"}, {"web"}}
+	if !reflect.DeepEqual(levels, want) {
+		t.Errorf("got %v, want %v", levels, want)
+	}
+
+	deps["db"] = []string{"web"}
+	if _, err := dependencyLevels([]string{"api", "cache", "db", "web"}, deps); err == nil {
+		t.Error("a cycle succeeded, expected an error")
+	}
+}
+
+func TestRestoreAllRecord(t *testing.T) {
+	tempImages(t)
+	orig := shutdownRecordPath
+	shutdownRecordPath = filepath.Join(t.TempDir(), "lib", "shutdown.json")
+	defer func() { shutdownRecordPath = orig }()
+
+	r, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := r.RestoreAll(context.Background()); err != nil || results != nil {
+		t.Errorf("RestoreAll without a record = %v, %v, want nothing", results, err)
+	}
+
+	record := shutdownRecord{Containers: []shutdownRecordEntry{
+		{Id: "db", SpecPath: "/bundles/db/config.json"},
+		{Id: "api", SpecPath: "/bundles/api/config.json", Options: &RunOptions{}, DependsOn: []string{"db"}},
+	}}
+	if err := saveShutdownRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(shutdownRecordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved shutdownRecord
+	if err := json.Unmarshal(data, &saved); err != nil || !reflect.DeepEqual(saved, record) {
+		t.Errorf("saved %+v, %v, want %+v", saved, err, record)
+	}
+
+	// db has no options to run it with, so api isn't started either.
+	results, err := r.RestoreAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Id != "db" || results[0].Err == nil || results[1].Id != "api" || results[1].Err == nil {
+		t.Errorf("got %+v, want db and api to fail", results)
+	}
+	if _, err := os.Stat(shutdownRecordPath); !os.IsNotExist(err) {
+		t.Errorf("the record is left after RestoreAll: %v", err)
+	}
+}
+
+func TestThawCgroup(t *testing.T) {
+	dir := t.TempDir()
+	if err := thawCgroup(dir); err != nil {
+		t.Errorf("thawCgroup without a freezer: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "cgroup.freeze"), "1\n", 0o644)
+	if err := thawCgroup(dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "cgroup.freeze")); string(data) != "0" {
+		t.Errorf("cgroup.freeze is %q, want 0", data)
+	}
+}
@@ -0,0 +1,42 @@
+package container
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// AnnotationStopSignal sets the signal stopping a container asks its init
+// process to exit with, like STOPSIGNAL in a Dockerfile. It is given by
+// name or number, and SIGTERM if unset.
+const AnnotationStopSignal = "containish.stop-signal"
+
+// ParseSignal parses a signal given by number or by name, with or without
+// the SIG prefix.
+func ParseSignal(s string) (unix.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal %q", s)
+		}
+		return unix.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("invalid signal %q", s)
+	}
+	return sig, nil
+}
+
+// stopSignal returns the signal stopping c sends first.
+func stopSignal(c *Container) unix.Signal {
+	if sig, err := ParseSignal(c.StopSignal); err == nil {
+		return sig
+	}
+	return unix.SIGTERM
+}
@@ -0,0 +1,90 @@
+package container
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseSignal(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want unix.Signal
+	}{
+		{"TERM", unix.SIGTERM},
+		{"sigquit", unix.SIGQUIT},
+		{"SIGINT", unix.SIGINT},
+		{"9", unix.SIGKILL},
+	} {
+		if got, err := ParseSignal(tt.in); err != nil || got != tt.want {
+			t.Errorf("ParseSignal(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, bad := range []string{"", "0", "65", "BOGUS"} {
+		if _, err := ParseSignal(bad); err == nil {
+			t.Errorf("ParseSignal(%q): expected error", bad)
+		}
+	}
+}
+
+func TestStopSignalAnnotation(t *testing.T) {
+	dir := t.TempDir()
+	spec := filepath.Join(dir, "config.json")
+	write := func(annotation string) {
+		data := `{"ociVersion": "1.0.2", "root": {"path": "rootfs"}, "annotations": {"` + AnnotationStopSignal + `": "` + annotation + `"}}`
+		if err := os.WriteFile(spec, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("SIGQUIT")
+	var opts RunOptions
+	if _, err := loadRunSpec(spec, nil, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if opts.StopSignal != "SIGQUIT" {
+		t.Fatalf("stop signal %q, want the annotation's", opts.StopSignal)
+	}
+	opts = RunOptions{StopSignal: "INT"}
+	if _, err := loadRunSpec(spec, nil, &opts); err != nil || opts.StopSignal != "INT" {
+		t.Fatalf("an explicit stop signal was overridden: %q, %v", opts.StopSignal, err)
+	}
+
+	write("SIGNOPE")
+	if _, err := loadRunSpec(spec, nil, &RunOptions{}); err == nil {
+		t.Fatal("expected error for an invalid stop signal annotation")
+	}
+}
+
+func TestStopContainerStopSignal(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	// An init process only exiting on SIGINT.
+	cmd := exec.Command("sh", "-c", `trap "" TERM; trap "exit 0" INT; while :; do sleep 0.05; done`)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	go cmd.Wait()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := saveState(&Container{Id: "web", InitProcessPiD: cmd.Process.Pid, Status: Running, StopSignal: "SIGINT"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopContainer("web", 5*time.Second); err != nil {
+		t.Fatalf("StopContainer failed: %v", err)
+	}
+	c, err := LoadState("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Graceful == nil || !*c.Graceful {
+		t.Fatalf("expected the stop signal to stop the container, graceful %v", c.Graceful)
+	}
+}
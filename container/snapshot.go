@@ -0,0 +1,373 @@
+package container
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshots capture the root filesystem of a container so it can be rolled
+// back later. The rootfs is a plain directory, so a snapshot is a gzipped
+// tar of all of it, kept in <state dir>/snapshots/<name>.tar.gz with its
+// record in <name>.json. Snapshots go away with the container. They hold
+// files only: the processes of a running container aren't checkpointed.
+
+// Snapshot is a point in time copy of a container's root filesystem.
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Container string    `json:"container"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Size is the size of the archive in bytes.
+	Size int64 `json:"size"`
+}
+
+func snapshotDir(containerId string) string {
+	return filepath.Join(StateDir(containerId), "snapshots")
+}
+
+func snapshotArchive(containerId, name string) string {
+	return filepath.Join(snapshotDir(containerId), name+".tar.gz")
+}
+
+// snapshotRootfs returns the root filesystem of a container.
+func snapshotRootfs(c *Container) (string, error) {
+	if c.hostRootfs() {
+		return "", fmt.Errorf("container %s runs on the host rootfs, which can't be snapshotted", c.Id)
+	}
+	if c.Rootfs == "" {
+		return "", fmt.Errorf("container %s doesn't record its rootfs, run it again to snapshot it", c.Id)
+	}
+	return c.Rootfs, nil
+}
+
+// CreateSnapshot archives the root filesystem of a container under name, a
+// timestamp if empty. Files written while a running container is archived
+// may be captured half way, so stop it first for a consistent snapshot.
+func CreateSnapshot(containerId, name string) (*Snapshot, error) {
+	if name == "" {
+		name = time.Now().UTC().Format("20060102T150405Z")
+	}
+	if !objectNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	c, err := LoadState(containerId)
+	if err != nil {
+		return nil, err
+	}
+	rootfs, err := snapshotRootfs(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(snapshotDir(containerId), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot dir: %w", err)
+	}
+	path := snapshotArchive(containerId, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("snapshot %s of %s %w", name, containerId, ErrExists)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot %s: %w", name, err)
+	}
+	s := &Snapshot{Name: name, Container: containerId, CreatedAt: time.Now()}
+	err = writeArchive(f, rootfs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		var info os.FileInfo
+		if info, err = os.Stat(path); err == nil {
+			s.Size = info.Size()
+			err = saveSnapshot(s)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("failed to snapshot %s: %w", containerId, err)
+	}
+	return s, nil
+}
+
+func saveSnapshot(s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(snapshotDir(s.Container), s.Name+".json")
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadSnapshot returns a snapshot of a container.
+func LoadSnapshot(containerId, name string) (*Snapshot, error) {
+	if !objectNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(snapshotDir(containerId), name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("snapshot %s %w in container %s", name, ErrNotFound, containerId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+// ListSnapshots returns the snapshots of a container, oldest first.
+func ListSnapshots(containerId string) ([]*Snapshot, error) {
+	if _, err := LoadState(containerId); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(snapshotDir(containerId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		s, err := LoadSnapshot(containerId, name)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt) })
+	return snapshots, nil
+}
+
+// RestoreSnapshot rolls the root filesystem of a stopped container back to
+// a snapshot. The snapshot is extracted next to the rootfs and swapped in
+// once complete, so a failed restore leaves the rootfs as it was.
+func RestoreSnapshot(containerId, name string) error {
+	s, err := LoadSnapshot(containerId, name)
+	if err != nil {
+		return err
+	}
+	c, err := LoadState(containerId)
+	if err != nil {
+		return err
+	}
+	refreshStatus(c)
+	if c.Status != Stopped {
+		return fmt.Errorf("container %s is %s, stop it before restoring a snapshot", containerId, c.Status)
+	}
+	rootfs, err := snapshotRootfs(c)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(snapshotArchive(containerId, s.Name))
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot %s: %w", s.Name, err)
+	}
+	defer f.Close()
+	tmp, err := os.MkdirTemp(filepath.Dir(rootfs), "."+filepath.Base(rootfs)+".restore-")
+	if err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", s.Name, err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := extractArchive(f, tmp); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", s.Name, err)
+	}
+
+	old := tmp + ".old"
+	if err := os.Rename(rootfs, old); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to restore snapshot %s: %w", s.Name, err)
+	}
+	if err := os.Rename(tmp, rootfs); err != nil {
+		_ = os.Rename(old, rootfs)
+		return fmt.Errorf("failed to restore snapshot %s: %w", s.Name, err)
+	}
+	if err := os.RemoveAll(old); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to remove the replaced rootfs %s: %v\n", old, err)
+	}
+	return nil
+}
+
+// writeArchive writes the tree at root to w as a gzipped tar, with paths
+// relative to root. Hard links within the tree are kept as such.
+func writeArchive(w io.Writer, root string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	links := map[[2]uint64]string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Sockets belong to the processes that bound them.
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// Owners are numeric, the host's names mean nothing in the
+		// container.
+		hdr.Uname, hdr.Gname = "", ""
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if first, ok := links[key]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[key] = hdr.Name
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractArchive extracts an archive of writeArchive into dir, restoring
+// modes, owners and modification times. Entries escaping dir are refused.
+func extractArchive(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("invalid archive entry %q", hdr.Name)
+		}
+		path := filepath.Join(dir, name)
+		mode := uint32(hdr.Mode & 0o7777)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if name != "." {
+				if err := os.Mkdir(path, 0o700); err != nil {
+					return err
+				}
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+			if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			target := filepath.Clean(hdr.Linkname)
+			if filepath.IsAbs(target) || target == ".." || strings.HasPrefix(target, "../") {
+				return fmt.Errorf("invalid archive link %q", hdr.Linkname)
+			}
+			if err := os.Link(filepath.Join(dir, target), path); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			kind := map[byte]uint32{tar.TypeChar: unix.S_IFCHR, tar.TypeBlock: unix.S_IFBLK, tar.TypeFifo: unix.S_IFIFO}[hdr.Typeflag]
+			dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+			if err := unix.Mknod(path, kind|0o600, dev); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry %q of type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+		// chown clears setuid bits, so set the mode after it.
+		if err := unix.Chmod(path, mode); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path, hdr.ModTime})
+			continue
+		}
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	// Creating entries updates the times of their directory, so set those
+	// last, deepest first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
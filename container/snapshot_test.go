@@ -0,0 +1,142 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	rootfs := filepath.Join(t.TempDir(), "rootfs")
+	for _, dir := range []string{"etc", "bin", "var/empty"} {
+		if err := os.MkdirAll(filepath.Join(rootfs, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(rootfs, "etc/hostname"), "box\n", 0o644)
+	writeFile(t, filepath.Join(rootfs, "bin/tool"), "#!/bin/sh\n", os.ModeSetuid|0o755)
+	if err := os.Link(filepath.Join(rootfs, "bin/tool"), filepath.Join(rootfs, "bin/alias")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/hostname", filepath.Join(rootfs, "etc/name")); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(&Container{Id: "c1", Status: Stopped, Rootfs: rootfs}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := CreateSnapshot("c1", "base")
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if s.Size == 0 {
+		t.Fatal("snapshot has no size")
+	}
+	if _, err := CreateSnapshot("c1", "base"); !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists reusing a snapshot name, got %v", err)
+	}
+	if _, err := CreateSnapshot("c1", "../x"); err == nil {
+		t.Fatal("expected an error for an invalid name")
+	}
+	if _, err := CreateSnapshot("c1", ""); err != nil {
+		t.Fatalf("CreateSnapshot without a name failed: %v", err)
+	}
+	list, err := ListSnapshots("c1")
+	if err != nil || len(list) != 2 || list[0].Name != "base" {
+		t.Fatalf("ListSnapshots = %v, %v", list, err)
+	}
+
+	// Change the rootfs, then roll it back.
+	writeFile(t, filepath.Join(rootfs, "etc/hostname"), "changed\n", 0o644)
+	writeFile(t, filepath.Join(rootfs, "etc/new"), "new\n", 0o644)
+	if err := os.RemoveAll(filepath.Join(rootfs, "var")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSnapshot("c1", "base"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(rootfs, "etc/hostname")); string(data) != "box\n" {
+		t.Fatalf("hostname not restored: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/new")); !os.IsNotExist(err) {
+		t.Fatalf("file created after the snapshot survived the restore: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(rootfs, "var/empty")); err != nil || !info.IsDir() {
+		t.Fatalf("empty dir not restored: %v", err)
+	}
+	if info, err := os.Stat(filepath.Join(rootfs, "bin/tool")); err != nil || info.Mode()&os.ModeSetuid == 0 {
+		t.Fatalf("setuid bit not restored: %v %v", info, err)
+	}
+	tool, _ := os.Stat(filepath.Join(rootfs, "bin/tool"))
+	alias, _ := os.Stat(filepath.Join(rootfs, "bin/alias"))
+	if !os.SameFile(tool, alias) {
+		t.Fatal("hard link not restored")
+	}
+	if link, err := os.Readlink(filepath.Join(rootfs, "etc/name")); err != nil || link != "/etc/hostname" {
+		t.Fatalf("symlink not restored: %q, %v", link, err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(rootfs))
+	if len(entries) != 1 {
+		t.Fatalf("restore left files next to the rootfs: %v", entries)
+	}
+
+	if err := RestoreSnapshot("c1", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound restoring a missing snapshot, got %v", err)
+	}
+	if err := updateState("c1", func(c *Container) error {
+		c.Status = Running
+		c.InitProcessPiD = os.Getpid()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RestoreSnapshot("c1", "base"); err == nil || !strings.Contains(err.Error(), "stop it") {
+		t.Fatalf("expected an error restoring a running container, got %v", err)
+	}
+}
+
+func TestExtractArchiveRefusesEscapes(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	body := "x"
+	if err := tw.WriteHeader(&tar.Header{Name: "../evil", Typeflag: tar.TypeReg, Mode: 0o644, Size: int64(len(body))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	gz.Close()
+
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	if err := os.Mkdir(out, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractArchive(&buf, out); err == nil || !strings.Contains(err.Error(), "invalid archive entry") {
+		t.Fatalf("expected an escaping entry to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil")); !os.IsNotExist(err) {
+		t.Fatalf("escaping entry was written: %v", err)
+	}
+}
+
+func writeFile(t *testing.T, path, data string, mode os.FileMode) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
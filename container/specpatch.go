@@ -0,0 +1,358 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// A spec patch tweaks the spec of a shared bundle for one run without
+// editing its config.json. It is either a JSON merge patch (RFC 7386), an
+// object merged into the spec, or a JSON patch (RFC 6902), an array of
+// operations. Patches are applied in order to the spec as loaded, before
+// anything else of the run changes it, and kept in the run options, so a
+// restarted container is patched the same way.
+
+// patchOp is an operation of a JSON patch.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// ParseSpecPatch checks that data is a JSON merge patch or JSON patch,
+// returning it compacted.
+func ParseSpecPatch(data []byte) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return nil, fmt.Errorf("invalid spec patch: %w", err)
+	}
+	patch := json.RawMessage(buf.Bytes())
+	switch patch[0] {
+	case '{':
+		return patch, nil
+	case '[':
+		var ops []patchOp
+		if err := json.Unmarshal(patch, &ops); err != nil {
+			return nil, fmt.Errorf("invalid spec patch: %w", err)
+		}
+		for i, op := range ops {
+			if err := op.check(); err != nil {
+				return nil, fmt.Errorf("invalid spec patch operation %d: %w", i, err)
+			}
+		}
+		return patch, nil
+	}
+	return nil, fmt.Errorf("invalid spec patch: expected a JSON merge patch object or a JSON patch array")
+}
+
+func (op patchOp) check() error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("%s requires a value", op.Op)
+		}
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return err
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	_, err := parsePointer(op.Path)
+	return err
+}
+
+// patchSpec returns spec with patches applied in order.
+func patchSpec(spec *specs.Spec, patches []json.RawMessage) (*specs.Spec, error) {
+	if len(patches) == 0 {
+		return spec, nil
+	}
+	doc, err := decodeJSON(mustMarshal(spec))
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range patches {
+		p, err := ParseSpecPatch(p)
+		if err != nil {
+			return nil, err
+		}
+		if p[0] == '{' {
+			patch, err := decodeJSON(p)
+			if err != nil {
+				return nil, err
+			}
+			doc = mergePatch(doc, patch)
+		} else if doc, err = applyJSONPatch(doc, p); err != nil {
+			return nil, fmt.Errorf("spec patch %d: %w", i+1, err)
+		}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	// A misspelled field would otherwise be dropped silently.
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var patched specs.Spec
+	if err := dec.Decode(&patched); err != nil {
+		return nil, fmt.Errorf("invalid patched spec: %w", err)
+	}
+	return &patched, nil
+}
+
+// mustMarshal encodes a spec, which can't fail.
+func mustMarshal(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// decodeJSON decodes data keeping numbers as written, as spec values such
+// as rlimits don't fit a float64.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid spec patch: %w", err)
+	}
+	return v, nil
+}
+
+// mergePatch applies the JSON merge patch patch to target: the members of
+// an object patch are merged recursively, null ones removing the member,
+// and any other patch replaces target.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyJSONPatch applies the operations of the JSON patch data to doc.
+func applyJSONPatch(doc any, data []byte) (any, error) {
+	var ops []patchOp
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, fmt.Errorf("invalid spec patch: %w", err)
+	}
+	for _, op := range ops {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op patchOp) apply(doc any) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	if op.Value != nil {
+		if value, err = decodeJSON(op.Value); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addPointer(doc, path, value)
+	case "remove":
+		doc, _, err := removePointer(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, _, err = removePointer(doc, path); err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if len(path) > len(from) && slices.Equal(path[:len(from)], from) {
+				return nil, fmt.Errorf("cannot move %s into itself", op.From)
+			}
+			if doc, value, err = removePointer(doc, from); err != nil {
+				return nil, err
+			}
+		} else if value, err = getPointer(doc, from); err != nil {
+			return nil, err
+		} else if value, err = decodeJSON(mustMarshal(value)); err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	case "test":
+		cur, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(cur, value) {
+			return nil, fmt.Errorf("test failed: the value is %s", mustMarshal(cur))
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits the JSON pointer p into its unescaped tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q: expected a leading /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex returns the index token t designates in an array of n
+// elements, n for "-" if end is allowed.
+func arrayIndex(t string, n int, end bool) (int, error) {
+	if t == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || (t != "0" && t[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", t)
+	}
+	if i > n || i == n && !end {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// getPointer returns the value of doc at path.
+func getPointer(doc any, path []string) (any, error) {
+	for _, t := range path {
+		switch v := doc.(type) {
+		case map[string]any:
+			var ok bool
+			if doc, ok = v[t]; !ok {
+				return nil, fmt.Errorf("no member %q", t)
+			}
+		case []any:
+			i, err := arrayIndex(t, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("cannot descend into a scalar at %q", t)
+		}
+	}
+	return doc, nil
+}
+
+// addPointer returns doc with value added at path: set as a member of an
+// object, or inserted into an array.
+func addPointer(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]any:
+		v[last] = value
+		return doc, nil
+	case []any:
+		i, err := arrayIndex(last, len(v), true)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v[:i], append([]any{value}, v[i:]...)...)
+		return setPointer(doc, path[:len(path)-1], v)
+	}
+	return nil, fmt.Errorf("cannot add to a scalar")
+}
+
+// removePointer returns doc without the value at path, and that value.
+func removePointer(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("cannot remove the whole spec")
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]any:
+		old, ok := v[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("no member %q", last)
+		}
+		delete(v, last)
+		return doc, old, nil
+	case []any:
+		i, err := arrayIndex(last, len(v), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		old := v[i]
+		v = append(v[:i:i], v[i+1:]...)
+		doc, err = setPointer(doc, path[:len(path)-1], v)
+		return doc, old, err
+	}
+	return nil, nil, fmt.Errorf("cannot remove from a scalar")
+}
+
+// setPointer returns doc with the value at the existing path replaced, as
+// growing or shrinking an array makes a new slice.
+func setPointer(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := getPointer(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+	switch v := parent.(type) {
+	case map[string]any:
+		v[last] = value
+	case []any:
+		i, err := arrayIndex(last, len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = value
+	}
+	return doc, nil
+}
@@ -0,0 +1,103 @@
+package container
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestPatchSpec(t *testing.T) {
+	spec := func() *specs.Spec {
+		return &specs.Spec{
+			Version:  "1.0.2",
+			Hostname: "base",
+			Process: &specs.Process{
+				Args:    []string{"/app", "serve"},
+				Env:     []string{"PATH=/bin"},
+				Rlimits: []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Hard: 1 << 63, Soft: 1024}},
+			},
+			Mounts: []specs.Mount{{Destination: "/proc", Type: "proc", Source: "proc"}},
+		}
+	}
+
+	for _, tt := range []struct {
+		name    string
+		patches []string
+		want    func(*specs.Spec)
+	}{
+		{"merge", []string{`{"hostname":"web","process":{"args":["/app","debug"]}}`}, func(s *specs.Spec) {
+			s.Hostname = "web"
+			s.Process.Args = []string{"/app", "debug"}
+		}},
+		{"merge null removes", []string{`{"hostname":null}`}, func(s *specs.Spec) { s.Hostname = "" }},
+		{"json patch", []string{`[
+			{"op":"add","path":"/mounts/-","value":{"destination":"/data","type":"bind","source":"/srv/data","options":["rbind"]}},
+			{"op":"replace","path":"/process/args/1","value":"debug"},
+			{"op":"add","path":"/process/env/0","value":"MODE=test"},
+			{"op":"test","path":"/hostname","value":"base"},
+			{"op":"copy","from":"/hostname","path":"/domainname"},
+			{"op":"remove","path":"/hostname"}
+		]`}, func(s *specs.Spec) {
+			s.Mounts = append(s.Mounts, specs.Mount{Destination: "/data", Type: "bind", Source: "/srv/data", Options: []string{"rbind"}})
+			s.Process.Args[1] = "debug"
+			s.Process.Env = []string{"MODE=test", "PATH=/bin"}
+			s.Domainname, s.Hostname = "base", ""
+		}},
+		{"in order", []string{`{"hostname":"a"}`, `[{"op":"move","from":"/hostname","path":"/domainname"}]`}, func(s *specs.Spec) {
+			s.Hostname, s.Domainname = "", "a"
+		}},
+	} {
+		var patches []json.RawMessage
+		for _, p := range tt.patches {
+			patch, err := ParseSpecPatch([]byte(p))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			patches = append(patches, patch)
+		}
+		got, err := patchSpec(spec(), patches)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := spec()
+		tt.want(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		`"hostname"`,
+		`{"hostname":`,
+		`[{"op":"frobnicate","path":"/hostname"}]`,
+		`[{"op":"add","path":"hostname","value":"x"}]`,
+		`[{"op":"replace","path":"/hostname"}]`,
+	} {
+		if _, err := ParseSpecPatch([]byte(bad)); err == nil {
+			t.Errorf("ParseSpecPatch(%s) succeeded, expected an error", bad)
+		}
+	}
+	// A stored patch is used as ParseSpecPatch returns it, whatever its
+	// leading whitespace.
+	got, err := patchSpec(spec(), []json.RawMessage{json.RawMessage("\n  {\"hostname\": \"web\"}")})
+	if err != nil || got.Hostname != "web" {
+		t.Errorf("patchSpec of an indented merge patch = %+v, %v", got, err)
+	}
+
+	for _, bad := range []string{
+		`{"procss":{"args":["sh"]}}`,
+		`{"hostname":42}`,
+		`[{"op":"remove","path":"/nothing"}]`,
+		`[{"op":"replace","path":"/process/args/2","value":"x"}]`,
+		`[{"op":"add","path":"/process/args/01","value":"x"}]`,
+		`[{"op":"test","path":"/hostname","value":"other"}]`,
+		`[{"op":"move","from":"/process","path":"/process/user"}]`,
+	} {
+		if _, err := patchSpec(spec(), []json.RawMessage{json.RawMessage(bad)}); err == nil {
+			t.Errorf("patchSpec(%s) succeeded, expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Stats is a point-in-time sample of a container's cgroup counters.
+type Stats struct {
+	Id string `json:"id"`
+	// CPUUsageUsec is the total CPU time consumed, from cpu.stat.
+	CPUUsageUsec uint64 `json:"cpuUsageUsec"`
+	// MemoryCurrent is the memory in use, in bytes, and SwapCurrent the
+	// swap.
+	MemoryCurrent uint64 `json:"memoryCurrent"`
+	SwapCurrent   uint64 `json:"swapCurrent"`
+	// PidsCurrent is the number of tasks in the cgroup.
+	PidsCurrent uint64   `json:"pidsCurrent"`
+	Pressure    Pressure `json:"pressure"`
+}
+
+// Pressure holds the pressure stall information of each resource. A nil
+// entry means the kernel doesn't expose PSI for that resource.
+type Pressure struct {
+	CPU    *PSIStats `json:"cpu,omitempty"`
+	Memory *PSIStats `json:"memory,omitempty"`
+	IO     *PSIStats `json:"io,omitempty"`
+}
+
+// PSIStats is the content of a <resource>.pressure file. "some" is the share
+// of time at least one task was stalled on the resource, "full" the share of
+// time all tasks were.
+type PSIStats struct {
+	Some PSIData `json:"some"`
+	Full PSIData `json:"full"`
+}
+
+// PSIData is one line of a pressure file. Averages are percentages over the
+// last 10, 60 and 300 seconds; Total is the stall time in microseconds.
+type PSIData struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	Total  uint64  `json:"total"`
+}
+
+// GetStats samples the cgroup of a container.
+func GetStats(containerId string) (*Stats, error) {
+	c, err := LoadState(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if c.CgroupPath == "" {
+		return nil, fmt.Errorf("container %s has no cgroup", containerId)
+	}
+	return readStats(c.Id, c.CgroupPath)
+}
+
+// readStats collects the counters from the cgroup directory at path.
+// Interface files of controllers that aren't enabled are skipped.
+func readStats(id, path string) (*Stats, error) {
+	s := &Stats{Id: id}
+
+	cpu, err := readKeyValues(filepath.Join(path, "cpu.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	s.CPUUsageUsec = cpu["usage_usec"]
+
+	if s.MemoryCurrent, err = readUintFile(filepath.Join(path, "memory.current")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if s.SwapCurrent, err = readUintFile(filepath.Join(path, "memory.swap.current")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if s.PidsCurrent, err = readUintFile(filepath.Join(path, "pids.current")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for name, dst := range map[string]**PSIStats{
+		"cpu.pressure":    &s.Pressure.CPU,
+		"memory.pressure": &s.Pressure.Memory,
+		"io.pressure":     &s.Pressure.IO,
+	} {
+		data, err := os.ReadFile(filepath.Join(path, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		if *dst, err = parsePSI(data); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+	}
+	return s, nil
+}
+
+// Usage summarizes what a container consumed over its life. It is read
+// from the cgroup when the container stops, before the cgroup is removed.
+type Usage struct {
+	// CPUUsageUsec is the total CPU time, split into user and system
+	// time, in microseconds.
+	CPUUsageUsec  uint64 `json:"cpuUsageUsec"`
+	CPUUserUsec   uint64 `json:"cpuUserUsec"`
+	CPUSystemUsec uint64 `json:"cpuSystemUsec"`
+	// MemoryPeak is the highest memory use, in bytes. It is 0 on kernels
+	// without memory.peak.
+	MemoryPeak uint64 `json:"memoryPeak"`
+	// SwapPeak is the highest swap use, in bytes. It is 0 on kernels
+	// without memory.swap.peak, before Linux 6.5.
+	SwapPeak uint64 `json:"swapPeak"`
+	// IOReadBytes and IOWriteBytes are the block I/O of all devices.
+	IOReadBytes  uint64 `json:"ioReadBytes"`
+	IOWriteBytes uint64 `json:"ioWriteBytes"`
+}
+
+// readUsage collects the usage summary from the cgroup directory at path.
+// Like readStats, it skips the files of controllers that aren't enabled.
+func readUsage(path string) (*Usage, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	u := &Usage{}
+
+	cpu, err := readKeyValues(filepath.Join(path, "cpu.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	u.CPUUsageUsec = cpu["usage_usec"]
+	u.CPUUserUsec = cpu["user_usec"]
+	u.CPUSystemUsec = cpu["system_usec"]
+
+	if u.MemoryPeak, err = readUintFile(filepath.Join(path, "memory.peak")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if u.SwapPeak, err = readUintFile(filepath.Join(path, "memory.swap.peak")); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(path, "io.stat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read io.stat: %w", err)
+	}
+	if u.IOReadBytes, u.IOWriteBytes, err = parseIOStat(data); err != nil {
+		return nil, fmt.Errorf("failed to parse io.stat: %w", err)
+	}
+	return u, nil
+}
+
+// parseIOStat sums the bytes read and written over the devices of io.stat:
+//
+//	8:0 rbytes=90112 wbytes=0 rios=3 wios=0 dbytes=0 dios=0
+func parseIOStat(data []byte) (rbytes, wbytes uint64, err error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || (k != "rbytes" && k != "wbytes") {
+				continue
+			}
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return 0, 0, fmt.Errorf("malformed field %q: %w", kv, err)
+			}
+			if k == "rbytes" {
+				rbytes += n
+			} else {
+				wbytes += n
+			}
+		}
+	}
+	return rbytes, wbytes, nil
+}
+
+// parsePSI parses the content of a pressure file:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parsePSI(data []byte) (*PSIStats, error) {
+	var psi PSIStats
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var d *PSIData
+		switch fields[0] {
+		case "some":
+			d = &psi.Some
+		case "full":
+			d = &psi.Full
+		default:
+			return nil, fmt.Errorf("unexpected line %q", sc.Text())
+		}
+
+		for _, kv := range fields[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("malformed field %q", kv)
+			}
+			var err error
+			switch k {
+			case "avg10":
+				d.Avg10, err = strconv.ParseFloat(v, 64)
+			case "avg60":
+				d.Avg60, err = strconv.ParseFloat(v, 64)
+			case "avg300":
+				d.Avg300, err = strconv.ParseFloat(v, 64)
+			case "total":
+				d.Total, err = strconv.ParseUint(v, 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("malformed field %q: %w", kv, err)
+			}
+		}
+	}
+	return &psi, sc.Err()
+}
+
+// readKeyValues parses flat-keyed cgroup files such as cpu.stat.
+func readKeyValues(path string) (map[string]uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]uint64{}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed line %q in %s: %w", line, path, err)
+		}
+		values[fields[0]] = v
+	}
+	return values, nil
+}
+
+// readUintFile reads a cgroup file holding a single number.
+func readUintFile(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("malformed value in %s: %w", path, err)
+	}
+	return v, nil
+}
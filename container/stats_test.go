@@ -0,0 +1,93 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePSI(t *testing.T) {
+	data := []byte("some avg10=1.50 avg60=0.75 avg300=0.10 total=12345\n" +
+		"full avg10=0.25 avg60=0.00 avg300=0.00 total=678\n")
+	psi, err := parsePSI(data)
+	if err != nil {
+		t.Fatalf("parsePSI failed: %v", err)
+	}
+	if psi.Some.Avg10 != 1.5 || psi.Some.Avg60 != 0.75 || psi.Some.Total != 12345 {
+		t.Fatalf("unexpected some line %+v", psi.Some)
+	}
+	if psi.Full.Avg10 != 0.25 || psi.Full.Total != 678 {
+		t.Fatalf("unexpected full line %+v", psi.Full)
+	}
+
+	if _, err := parsePSI([]byte("some avg10=x\n")); err == nil {
+		t.Fatalf("expected error for malformed value")
+	}
+}
+
+func TestReadStats(t *testing.T) {
+	cg := t.TempDir()
+	files := map[string]string{
+		"cpu.stat":            "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n",
+		"memory.current":      "1048576\n",
+		"memory.swap.current": "4096\n",
+		"pids.current":        "3\n",
+		"cpu.pressure":        "some avg10=4.00 avg60=2.00 avg300=1.00 total=10\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+		"memory.pressure":     "some avg10=0.00 avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cg, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+
+	s, err := readStats("c1", cg)
+	if err != nil {
+		t.Fatalf("readStats failed: %v", err)
+	}
+	if s.CPUUsageUsec != 2500000 || s.MemoryCurrent != 1048576 || s.SwapCurrent != 4096 || s.PidsCurrent != 3 {
+		t.Fatalf("unexpected counters %+v", s)
+	}
+	if s.Pressure.CPU == nil || s.Pressure.CPU.Some.Avg10 != 4 {
+		t.Fatalf("unexpected cpu pressure %+v", s.Pressure.CPU)
+	}
+	if s.Pressure.IO != nil {
+		t.Fatalf("expected no io pressure without io.pressure")
+	}
+}
+
+func TestRecordUsage(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	cg := t.TempDir()
+	files := map[string]string{
+		"cpu.stat":         "usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n",
+		"memory.peak":      "8388608\n",
+		"memory.swap.peak": "1048576\n",
+		"io.stat":          "8:0 rbytes=4096 wbytes=1024 rios=1 wios=1 dbytes=0 dios=0\n253:0 rbytes=8192 wbytes=0 rios=2 wios=0 dbytes=0 dios=0\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(cg, name), []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	if err := saveState(&Container{Id: "c1", Status: Stopped, CgroupPath: cg}); err != nil {
+		t.Fatal(err)
+	}
+
+	recordUsage(&Container{Id: "c1", CgroupPath: cg})
+	c, err := LoadState("c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Usage{CPUUsageUsec: 2500000, CPUUserUsec: 2000000, CPUSystemUsec: 500000, MemoryPeak: 8388608, SwapPeak: 1048576, IOReadBytes: 12288, IOWriteBytes: 1024}
+	if c.Usage == nil || *c.Usage != want {
+		t.Fatalf("usage = %+v, want %+v", c.Usage, want)
+	}
+
+	if _, err := readUsage(filepath.Join(cg, "gone")); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing cgroup to be reported, got %v", err)
+	}
+}
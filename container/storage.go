@@ -0,0 +1,241 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A storage quota caps the space a container can take up in its rootfs, so
+// a runaway container can't fill the host disk. It is a project quota: the
+// rootfs and everything in it are tagged with a project id of the
+// container, which new files inherit, and the filesystem refuses writes
+// once the files of the project use up the limit. The filesystem of the
+// rootfs must have project quotas enabled, XFS mounted with prjquota or
+// ext4 with the project and quota features mounted with prjquota. Files
+// already in the rootfs count towards the quota.
+
+// StorageQuota is the storage quota of a container.
+type StorageQuota struct {
+	// Size is the limit in bytes.
+	Size int64 `json:"size"`
+	// Project is the project id the rootfs is tagged with.
+	Project uint32 `json:"project"`
+	// Used is the space the rootfs takes up, reported by Runtime.State.
+	Used int64 `json:"used,omitempty"`
+}
+
+// Project ids of containers are allocated from storageProjectBase on, above
+// those usually assigned by hand in /etc/projid.
+const (
+	storageProjectBase  = 1 << 24
+	storageProjectRange = 1 << 20
+)
+
+// fsxattr is struct fsxattr of linux/fs.h, for FS_IOC_FSGETXATTR and
+// FS_IOC_FSSETXATTR.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// ifDqblk is struct if_dqblk of linux/quota.h. Block limits are in units
+// of 1KiB.
+type ifDqblk struct {
+	bhardlimit uint64
+	bsoftlimit uint64
+	curspace   uint64
+	ihardlimit uint64
+	isoftlimit uint64
+	curinodes  uint64
+	btime      uint64
+	itime      uint64
+	valid      uint32
+}
+
+const (
+	fsIocFsgetxattr    = 0x801c581f
+	fsIocFssetxattr    = 0x401c5820
+	fsXflagProjinherit = 0x200
+
+	qGetquota  = 0x800007
+	qSetquota  = 0x800008
+	prjQuota   = 2
+	qifBlimits = 1
+)
+
+// ParseStorageSize parses a --storage-size value, a number of bytes with an
+// optional k, m or g suffix.
+func ParseStorageSize(value string) (int64, error) {
+	size, err := parseByteSize(value)
+	if err != nil || size < 1<<20 {
+		return 0, fmt.Errorf("invalid storage size %q: expected at least 1m", value)
+	}
+	return size, nil
+}
+
+// applyStorageQuota limits the rootfs of container id to size bytes. The
+// project id already on the rootfs is kept when it was the container's,
+// so starting it again doesn't go over the whole rootfs.
+func applyStorageQuota(id, rootfs string, size int64) (*StorageQuota, error) {
+	root, err := os.Open(rootfs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rootfs: %w", err)
+	}
+	defer root.Close()
+	attr, err := getFsxattr(root)
+	if err != nil {
+		return nil, storageQuotaError(rootfs, err)
+	}
+
+	project, err := storageProject(id, attr.projid)
+	if err != nil {
+		return nil, err
+	}
+	if attr.projid != project || attr.xflags&fsXflagProjinherit == 0 {
+		if err := setProject(rootfs, project); err != nil {
+			return nil, storageQuotaError(rootfs, err)
+		}
+	}
+	limit := ifDqblk{bhardlimit: uint64(size+1023) / 1024, bsoftlimit: uint64(size+1023) / 1024, valid: qifBlimits}
+	if err := quotactl(root, qSetquota, project, &limit); err != nil {
+		return nil, storageQuotaError(rootfs, err)
+	}
+	return &StorageQuota{Size: size, Project: project}, nil
+}
+
+// removeStorageQuota lifts the storage quota q of rootfs.
+func removeStorageQuota(rootfs string, q *StorageQuota) error {
+	root, err := os.Open(rootfs)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open rootfs: %w", err)
+	}
+	defer root.Close()
+	if err := quotactl(root, qSetquota, q.Project, &ifDqblk{valid: qifBlimits}); err != nil {
+		return fmt.Errorf("failed to remove the storage quota of %s: %w", rootfs, err)
+	}
+	return nil
+}
+
+// storageUsage returns the space used by the project of q in rootfs.
+func storageUsage(rootfs string, q *StorageQuota) (int64, error) {
+	root, err := os.Open(rootfs)
+	if err != nil {
+		return 0, err
+	}
+	defer root.Close()
+	var dq ifDqblk
+	if err := quotactl(root, qGetquota, q.Project, &dq); err != nil {
+		return 0, err
+	}
+	return int64(dq.curspace), nil
+}
+
+// storageProject returns the project id of container id, current if the
+// rootfs is already tagged with one of the container's. Ids are derived
+// from the container id, skipping those of other containers.
+func storageProject(id string, current uint32) (uint32, error) {
+	containers, err := ListContainers()
+	if err != nil {
+		return 0, err
+	}
+	taken := map[uint32]bool{}
+	for _, c := range containers {
+		if c.Id != id && c.Storage != nil {
+			taken[c.Storage.Project] = true
+		}
+	}
+	if current >= storageProjectBase && current < storageProjectBase+storageProjectRange && !taken[current] {
+		return current, nil
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	start := h.Sum32() % storageProjectRange
+	for i := uint32(0); i < storageProjectRange; i++ {
+		if p := storageProjectBase + (start+i)%storageProjectRange; !taken[p] {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("no project id left for the storage quota")
+}
+
+// setProject tags the directories and regular files under root with
+// project, directories so that what is created in them inherits it.
+// Symlinks and special files can't be tagged, and count towards the
+// project of their directory anyway.
+func setProject(root string, project uint32) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		attr, err := getFsxattr(f)
+		if err != nil {
+			return err
+		}
+		attr.projid = project
+		if d.IsDir() {
+			attr.xflags |= fsXflagProjinherit
+		}
+		if err := ioctlPtr(f, fsIocFssetxattr, unsafe.Pointer(&attr)); err != nil {
+			return fmt.Errorf("failed to set the project of %s: %w", path, err)
+		}
+		return nil
+	})
+}
+
+func getFsxattr(f *os.File) (fsxattr, error) {
+	var attr fsxattr
+	err := ioctlPtr(f, fsIocFsgetxattr, unsafe.Pointer(&attr))
+	return attr, err
+}
+
+func ioctlPtr(f *os.File, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// quotactl runs the project quota command cmd for project on the
+// filesystem of f.
+func quotactl(f *os.File, cmd int, project uint32, dq *ifDqblk) error {
+	qcmd := cmd<<8 | prjQuota
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL_FD, f.Fd(), uintptr(qcmd), uintptr(project), uintptr(unsafe.Pointer(dq)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// storageQuotaError explains why a storage quota can't be set on rootfs.
+func storageQuotaError(rootfs string, err error) error {
+	switch {
+	case errors.Is(err, unix.ENOTTY), errors.Is(err, unix.EOPNOTSUPP):
+		return fmt.Errorf("the filesystem of %s doesn't support project quotas, needed by --storage-size", rootfs)
+	case errors.Is(err, unix.ESRCH):
+		return fmt.Errorf("project quotas are not enabled on the filesystem of %s, mount it with prjquota to use --storage-size", rootfs)
+	case errors.Is(err, unix.ENOSYS):
+		return fmt.Errorf("--storage-size requires Linux 5.14 or later")
+	}
+	return fmt.Errorf("failed to set the storage quota of %s: %w", rootfs, err)
+}
@@ -0,0 +1,75 @@
+package container
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseStorageSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"1g":    1 << 30,
+		"512m":  512 << 20,
+		"2048k": 2 << 20,
+		"10k":   0,
+		"big":   0,
+		"":      0,
+	} {
+		got, err := ParseStorageSize(value)
+		if want == 0 {
+			if err == nil {
+				t.Errorf("ParseStorageSize(%q) = %d, expected an error", value, got)
+			}
+			continue
+		}
+		if err != nil || got != want {
+			t.Errorf("ParseStorageSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+}
+
+func TestStorageProject(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	p, err := storageProject("web", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p < storageProjectBase || p >= storageProjectBase+storageProjectRange {
+		t.Fatalf("project %d out of range", p)
+	}
+	// Another container holding the project pushes web to the next one.
+	if err := saveState(&Container{Id: "db", Status: Stopped, Storage: &StorageQuota{Size: 1 << 30, Project: p}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := storageProject("web", 0); err != nil || got == p {
+		t.Fatalf("expected another project than %d, got %d, %v", p, got, err)
+	}
+	// The project already on the rootfs is kept, unless it is db's or not
+	// one of the containers'.
+	if got, err := storageProject("web", p+1); err != nil || got != p+1 {
+		t.Fatalf("expected the current project %d, got %d, %v", p+1, got, err)
+	}
+	if got, err := storageProject("web", p); err != nil || got == p {
+		t.Fatalf("expected db's project %d not to be reused, got %d, %v", p, got, err)
+	}
+	if got, err := storageProject("web", 42); err != nil || got == 42 {
+		t.Fatalf("expected project 42 not to be reused, got %d, %v", got, err)
+	}
+}
+
+func TestStorageQuotaError(t *testing.T) {
+	for errno, want := range map[unix.Errno]string{
+		unix.EOPNOTSUPP: "doesn't support project quotas",
+		unix.ENOTTY:     "doesn't support project quotas",
+		unix.ESRCH:      "mount it with prjquota",
+		unix.EPERM:      "operation not permitted",
+	} {
+		if err := storageQuotaError("/rootfs", errno); !strings.Contains(err.Error(), want) {
+			t.Errorf("storageQuotaError(%v) = %v, want %q", errno, err, want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// The rootfs of a stopped container run from an image can be moved to
+// another storage driver, keeping the changes the container made:
+//
+//   - from vfs to overlay, the copy of the image is compared with the
+//     unpacked image and what differs goes into the writable layer, the
+//     files the container removed as whiteouts, before the copy is dropped;
+//   - from overlay to vfs, the writable layer and the image are mounted
+//     read-only as the lower layers of an overlay whose merged view is
+//     copied into the rootfs.
+//
+// The new storage is made next to the old one and swapped in once
+// complete, so a failed migration leaves the container as it was.
+
+// MigrateStorage moves the rootfs of the stopped container id to the
+// storage driver to. It does nothing if the container already uses it.
+func MigrateStorage(id, to string) error {
+	if to != StorageOverlay && to != StorageVFS {
+		return fmt.Errorf("unknown storage driver %q, must be %s or %s", to, StorageOverlay, StorageVFS)
+	}
+	c, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	refreshStatus(c)
+	if c.Status != Stopped {
+		return fmt.Errorf("container %s is %s, stop it before migrating its storage", id, c.Status)
+	}
+	if c.Image == nil {
+		return fmt.Errorf("container %s isn't run from an image, its rootfs is that of its bundle", id)
+	}
+	if c.Image.Driver == to {
+		return nil
+	}
+	if to == StorageOverlay {
+		if err := overlayMountable(containersDir); err != nil {
+			return fmt.Errorf("overlayfs can't be mounted over %s: %w", containersDir, err)
+		}
+	}
+	lower, err := migrationLower(c.Image)
+	if err != nil {
+		return err
+	}
+	if err := releaseImageRootfs(id, c.Image); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(containersDir, id)
+	var cleanup func()
+	switch to {
+	case StorageOverlay:
+		cleanup, err = migrateToOverlay(dir, lower)
+	case StorageVFS:
+		cleanup, err = migrateToVFS(dir, lower)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to migrate the storage of %s to %s: %w", id, to, err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "driver"), []byte(to), 0o600); err != nil {
+		return err
+	}
+	if err := updateState(id, func(c *Container) error {
+		c.Image.Driver = to
+		return nil
+	}); err != nil {
+		return err
+	}
+	cleanup()
+	return nil
+}
+
+// migrationLower returns the unpacked image of image, unpacking it again
+// if it was removed from the store.
+func migrationLower(image *ImageRootfs) (string, error) {
+	lower := imageRootfsDir(image.ID)
+	if _, err := os.Stat(lower); err == nil {
+		return lower, nil
+	}
+	images, err := loadImages()
+	if err != nil {
+		return "", err
+	}
+	for _, img := range images {
+		if img.ID == image.ID {
+			return unpackImage(img)
+		}
+	}
+	return "", fmt.Errorf("image %s %w in the store", image.Ref, ErrNotFound)
+}
+
+// migrateToOverlay replaces the vfs rootfs in dir by a writable layer over
+// lower, returning what removes the replaced copy.
+func migrateToOverlay(dir, lower string) (func(), error) {
+	rootfs, upper := filepath.Join(dir, "rootfs"), filepath.Join(dir, "upper")
+	tmp := upper + ".tmp"
+	_ = os.RemoveAll(tmp)
+	if err := os.Mkdir(tmp, 0o755); err != nil {
+		return nil, err
+	}
+	if err := diffLayer(lower, rootfs, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	old := rootfs + ".old"
+	if err := os.Rename(rootfs, old); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	for _, step := range []func() error{
+		func() error { return os.RemoveAll(upper) },
+		func() error { return os.Rename(tmp, upper) },
+		func() error { return os.MkdirAll(filepath.Join(dir, "work"), 0o755) },
+		func() error { return os.Mkdir(rootfs, 0o755) },
+	} {
+		if err := step(); err != nil {
+			os.RemoveAll(tmp)
+			os.Remove(rootfs)
+			_ = os.Rename(old, rootfs)
+			return nil, err
+		}
+	}
+	return func() { removeMigrated(old) }, nil
+}
+
+// migrateToVFS replaces the overlay rootfs in dir by a copy of what the
+// container sees, returning what removes the replaced layer.
+func migrateToVFS(dir, lower string) (func(), error) {
+	rootfs, upper := filepath.Join(dir, "rootfs"), filepath.Join(dir, "upper")
+	merged := filepath.Join(dir, "merged.tmp")
+	tmp := rootfs + ".tmp"
+	_ = os.RemoveAll(tmp)
+	if err := os.MkdirAll(merged, 0o755); err != nil {
+		return nil, err
+	}
+	defer os.Remove(merged)
+	// Without an upper layer the overlay is read-only and needs no work
+	// dir, and whiteouts of the writable layer still hide the files of
+	// the image.
+	if err := unix.Mount("overlay", merged, "overlay", unix.MS_RDONLY, "lowerdir="+upper+":"+lower); err != nil {
+		return nil, fmt.Errorf("failed to mount the overlay rootfs: %w", err)
+	}
+	err := os.Mkdir(tmp, 0o755)
+	if err == nil {
+		err = copyTree(merged, tmp)
+	}
+	if uerr := unix.Unmount(merged, unix.MNT_DETACH); err == nil && uerr != nil {
+		err = fmt.Errorf("failed to unmount the overlay rootfs: %w", uerr)
+	}
+	if err == nil {
+		if err = os.Remove(rootfs); errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, rootfs)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		_ = os.Mkdir(rootfs, 0o755)
+		return nil, err
+	}
+	return func() {
+		removeMigrated(upper)
+		removeMigrated(filepath.Join(dir, "work"))
+	}, nil
+}
+
+// removeMigrated removes the storage a migration replaced.
+func removeMigrated(path string) {
+	if err := os.RemoveAll(path); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: failed to remove the replaced storage %s: %v\n", path, err)
+	}
+}
+
+// diffLayer fills upper with what differs in the tree at root from that at
+// lower, as an overlay writable layer: the entries added or changed, with
+// the directories leading to them, and whiteouts for those removed.
+func diffLayer(lower, root, upper string) error {
+	// mkdirs creates the directories of upper leading to rel, as they are
+	// in root.
+	var mkdirs func(rel string) error
+	mkdirs = func(rel string) error {
+		if rel == "." {
+			return nil
+		}
+		if _, err := os.Lstat(filepath.Join(upper, rel)); err == nil {
+			return nil
+		}
+		if err := mkdirs(filepath.Dir(rel)); err != nil {
+			return err
+		}
+		return copyDirMeta(filepath.Join(root, rel), filepath.Join(upper, rel))
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." || d.Type()&fs.ModeSocket != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		base, err := os.Lstat(filepath.Join(lower, rel))
+		if err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return err
+		}
+		switch {
+		case base != nil && sameEntry(info, base, path, filepath.Join(lower, rel)):
+			return nil
+		case base != nil && info.IsDir() && base.IsDir():
+			// The directory changed itself, what is in it is compared
+			// on.
+			if err := mkdirs(filepath.Dir(rel)); err != nil {
+				return err
+			}
+			return copyDirMeta(path, filepath.Join(upper, rel))
+		}
+		// Added, or replaced by another type or content: copied whole.
+		if err := mkdirs(filepath.Dir(rel)); err != nil {
+			return err
+		}
+		cmd := exec.Command("cp", "-a", "--reflink=auto", path, filepath.Join(upper, rel))
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("error copying %s: %w", path, err)
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(lower, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(lower, path)
+		if rel == "." {
+			return nil
+		}
+		info, err := os.Lstat(filepath.Join(root, rel))
+		if err == nil {
+			// A directory replaced by another type, which the first
+			// walk copied, hides what was in it.
+			if d.IsDir() && !info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := mkdirs(filepath.Dir(rel)); err != nil {
+			return err
+		}
+		if err := unix.Mknod(filepath.Join(upper, rel), unix.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create the whiteout of %s: %w", rel, err)
+		}
+		return skipDir(d)
+	})
+}
+
+// skipDir returns filepath.SkipDir for a directory, so that its content
+// isn't walked, and nil otherwise.
+func skipDir(d fs.DirEntry) error {
+	if d.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// sameEntry reports whether the entry at path, info, is the same as that
+// at basePath, base, as far as an overlay is concerned. Regular files are
+// compared as rsync does, by size and modification time, which a copy
+// made with cp -a keeps. Directories are compared by themselves.
+func sameEntry(info, base fs.FileInfo, path, basePath string) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	bst, bok := base.Sys().(*syscall.Stat_t)
+	if !ok || !bok || info.Mode() != base.Mode() || st.Uid != bst.Uid || st.Gid != bst.Gid {
+		return false
+	}
+	switch mode := info.Mode(); {
+	case mode.IsDir():
+		return true
+	case mode.IsRegular():
+		return info.Size() == base.Size() && info.ModTime().Equal(base.ModTime())
+	case mode&fs.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		baseTarget, berr := os.Readlink(basePath)
+		return err == nil && berr == nil && target == baseTarget
+	case mode&(fs.ModeDevice|fs.ModeCharDevice) != 0:
+		return st.Rdev == bst.Rdev
+	}
+	return true
+}
+
+// copyDirMeta creates the directory dst with the mode, owner and times of
+// the directory src.
+func copyDirMeta(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dst, 0o700); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, info.Mode()&(fs.ModePerm|fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,210 @@
+package container
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// imageTree writes the unpacked image of the tests under dir.
+func imageTree(t *testing.T, dir string) {
+	t.Helper()
+	for path, data := range map[string]string{
+		"etc/hostname":    "image",
+		"etc/motd":        "welcome",
+		"usr/lib/a.so":    "a",
+		"usr/lib/b.so":    "b",
+		"usr/share/doc/x": "x",
+		"bin/tool":        "tool",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(dir, path), data, 0o644)
+	}
+	if err := os.Symlink("tool", filepath.Join(dir, "bin/alias")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// changeTree makes the changes of a container of the tests to the copy of
+// the image at root.
+func changeTree(t *testing.T, root string) {
+	t.Helper()
+	writeFile(t, filepath.Join(root, "etc/hostname"), "container", 0o644)
+	for _, p := range []string{"usr/lib/b.so", "usr/share/doc", "bin/tool"} {
+		if err := os.RemoveAll(filepath.Join(root, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A file replaced by a directory.
+	if err := os.MkdirAll(filepath.Join(root, "bin/tool/sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "var/lib/app"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "var/lib/app/data"), "state", 0o600)
+	if err := os.Chmod(filepath.Join(root, "usr"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// treeContent lists the entries of the tree at root with their content.
+func treeContent(t *testing.T, root string) []string {
+	t.Helper()
+	var entries []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		entry := rel + " " + info.Mode().String()
+		switch {
+		case info.Mode().IsRegular():
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			entry += " " + string(data)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, _ := os.Readlink(path)
+			entry += " -> " + target
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestDiffLayer(t *testing.T) {
+	dir := t.TempDir()
+	lower, root, upper := filepath.Join(dir, "lower"), filepath.Join(dir, "root"), filepath.Join(dir, "upper")
+	imageTree(t, lower)
+	if err := exec.Command("cp", "-a", lower, root).Run(); err != nil {
+		t.Fatal(err)
+	}
+	changeTree(t, root)
+	if err := os.Mkdir(upper, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := diffLayer(lower, root, upper); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skipf("can't create whiteouts: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"bin drwxr-xr-x",
+		"bin/tool drwxr-xr-x",
+		"bin/tool/sub drwxr-xr-x",
+		"etc drwxr-xr-x",
+		"etc/hostname -rw-r--r-- container",
+		"usr drwx------",
+		"usr/lib drwxr-xr-x",
+		"usr/lib/b.so Dc---------",
+		"usr/share drwxr-xr-x",
+		"usr/share/doc Dc---------",
+		"var drwxr-x---",
+		"var/lib drwxr-x---",
+		"var/lib/app drwxr-x---",
+		"var/lib/app/data -rw------- state",
+	}
+	if got := treeContent(t, upper); !slices.Equal(got, want) {
+		t.Errorf("writable layer:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMigrateStorage(t *testing.T) {
+	tempImages(t)
+	if err := MigrateStorage("web", "btrfs"); err == nil {
+		t.Error("migrated to an unknown driver")
+	}
+	if err := MigrateStorage("missing", StorageOverlay); !errors.Is(err, ErrNotFound) {
+		t.Errorf("MigrateStorage of a missing container = %v, want ErrNotFound", err)
+	}
+	if err := saveState(&Container{Id: "bundle", Status: Stopped, Rootfs: "/srv/bundle/rootfs"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateStorage("bundle", StorageOverlay); err == nil {
+		t.Error("migrated a container not run from an image")
+	}
+	start, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := &ImageRootfs{Ref: "docker.io/library/app:1", ID: "sha256:0123", Driver: StorageVFS}
+	if err := saveState(&Container{Id: "running", Status: Running, InitProcessPiD: os.Getpid(), InitStartTime: start, Image: image}); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateStorage("running", StorageOverlay); err == nil || !strings.Contains(err.Error(), "stop it") {
+		t.Errorf("MigrateStorage of a running container = %v", err)
+	}
+
+	// A round trip keeps the changes of the container.
+	imageTree(t, imageRootfsDir(image.ID))
+	dir := filepath.Join(containersDir, "web")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("cp", "-a", imageRootfsDir(image.ID), filepath.Join(dir, "rootfs")).Run(); err != nil {
+		t.Fatal(err)
+	}
+	changeTree(t, filepath.Join(dir, "rootfs"))
+	writeFile(t, filepath.Join(dir, "driver"), StorageVFS, 0o600)
+	want := treeContent(t, filepath.Join(dir, "rootfs"))
+	if err := saveState(&Container{Id: "web", Status: Stopped, Image: image}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateStorage("web", StorageOverlay); err != nil {
+		if errors.Is(err, unix.EPERM) {
+			t.Skipf("can't create whiteouts: %v", err)
+		}
+		t.Fatal(err)
+	}
+	c, err := LoadState("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Image.Driver != StorageOverlay {
+		t.Errorf("driver = %s after migrating to overlay", c.Image.Driver)
+	}
+	if driver, _ := os.ReadFile(filepath.Join(dir, "driver")); string(driver) != StorageOverlay {
+		t.Errorf("driver file = %q after migrating to overlay", driver)
+	}
+	if !rootfsEmpty(filepath.Join(dir, "rootfs")) {
+		t.Error("the copy of the image was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "work")); err != nil {
+		t.Error(err)
+	}
+
+	if err := MigrateStorage("web", StorageVFS); err != nil {
+		if errors.Is(err, unix.EPERM) || strings.Contains(err.Error(), "failed to mount") {
+			t.Skipf("can't mount overlays: %v", err)
+		}
+		t.Fatal(err)
+	}
+	if got := treeContent(t, filepath.Join(dir, "rootfs")); !slices.Equal(got, want) {
+		t.Errorf("rootfs after a round trip:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, name := range []string{"upper", "work", "merged.tmp"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s is left after migrating to vfs: %v", name, err)
+		}
+	}
+	if c, err := LoadState("web"); err != nil || c.Image.Driver != StorageVFS {
+		t.Errorf("state after migrating to vfs = %+v, %v", c, err)
+	}
+}
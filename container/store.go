@@ -0,0 +1,507 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// State store backends, see OpenStateStore.
+const (
+	// DirStateStore keeps the state of each container in state.json in
+	// its state dir. It is the default.
+	DirStateStore = "dir"
+	// BoltStateStore keeps the state of all containers in one BoltDB file
+	// under the base state dir, indexed by status and annotation.
+	BoltStateStore = "bolt"
+)
+
+// StateStoreEnv selects the state store backend when SetStateStore hasn't
+// been called.
+const StateStoreEnv = "CONTAINISH_STATE_STORE"
+
+// StateStore persists the state of containers. Every runtime working on the
+// same containers, in this process or another, must use the same backend.
+type StateStore interface {
+	// Load returns the state of the container with id, or an error
+	// wrapping ErrNotFound.
+	Load(id string) (*Container, error)
+	// Save writes the state of c, replacing any previous state.
+	Save(c *Container) error
+	// Update applies fn to the saved state of the container with id and
+	// saves the result, with no other update in between. An error from fn
+	// aborts the update and is returned.
+	Update(id string, fn func(*Container) error) error
+	// Delete removes the state of the container with id. Deleting a
+	// container without state isn't an error.
+	Delete(id string) error
+	// List returns the state of the containers matching filter, ordered
+	// by id.
+	List(filter StateFilter) ([]*Container, error)
+	// IDs returns the ids of the containers starting with prefix, ordered.
+	IDs(prefix string) ([]string, error)
+	// NameID returns the id of the container named name, or an error
+	// wrapping ErrNotFound. Save indexes the names of containers, failing
+	// with ErrExists for a name another container has.
+	NameID(name string) (string, error)
+	// Leases returns the addresses leased on network, or on every network
+	// when it is empty, ordered by network, then address.
+	Leases(network string) ([]AddressLease, error)
+	// Lease leases an address of a network to a container. It fails with
+	// an error wrapping ErrExists if another container holds it; leasing
+	// an address again to its holder isn't an error, and the lease of a
+	// container without state is taken over.
+	Lease(l AddressLease) error
+	// Release releases the leases of the container with id, on every
+	// network, and returns them.
+	Release(id string) ([]AddressLease, error)
+}
+
+// AddressLease is an address of a network leased to a container, see IPAM.
+type AddressLease struct {
+	Network   string `json:"network"`
+	Address   string `json:"address"`
+	Container string `json:"container"`
+}
+
+// StateFilter selects containers by their saved state. The zero value
+// matches every container.
+type StateFilter struct {
+	// Status matches containers with any of the statuses. Empty matches
+	// any status.
+	Status []Status
+	// Annotations matches containers having all of the annotations.
+	Annotations map[string]string
+}
+
+// Match reports whether c is selected by f.
+func (f StateFilter) Match(c *Container) bool {
+	if len(f.Status) > 0 && !slices.Contains(f.Status, c.Status) {
+		return false
+	}
+	for k, v := range f.Annotations {
+		if got, ok := c.Annotations[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenStateStore returns the state store backend named kind, DirStateStore
+// or BoltStateStore. Both keep their data under the base state dir.
+func OpenStateStore(kind string) (StateStore, error) {
+	switch kind {
+	case "", DirStateStore:
+		return dirStore{}, nil
+	case BoltStateStore:
+		return boltStore{}, nil
+	}
+	return nil, fmt.Errorf("unknown state store %q", kind)
+}
+
+var (
+	storeMu sync.Mutex
+	store   StateStore
+)
+
+// SetStateStore makes every runtime in the process use s for container
+// state. Without it the backend named by $CONTAINISH_STATE_STORE is used,
+// DirStateStore if unset.
+func SetStateStore(s StateStore) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	store = s
+}
+
+// stateStore returns the state store of the process.
+func stateStore() (StateStore, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if store == nil {
+		s, err := OpenStateStore(os.Getenv(StateStoreEnv))
+		if err != nil {
+			return nil, fmt.Errorf("invalid $%s: %w", StateStoreEnv, err)
+		}
+		store = s
+	}
+	return store, nil
+}
+
+func saveState(c *Container) error {
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	return s.Save(c)
+}
+
+// updateState applies fn to the saved state of a container, see
+// StateStore.Update.
+func updateState(id string, fn func(*Container) error) error {
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	return s.Update(id, fn)
+}
+
+// deleteState removes the state and the state dir of a container.
+func deleteState(id string) error {
+	s, err := stateStore()
+	if err != nil {
+		return err
+	}
+	if err := s.Delete(id); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(StateDir(id)); err != nil {
+		return fmt.Errorf("failed to remove state dir: %w", err)
+	}
+	return nil
+}
+
+// LoadState returns the saved state of the container with id.
+func LoadState(id string) (*Container, error) {
+	s, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.Load(id)
+}
+
+// ListContainers returns the saved state of every container, ordered by id.
+func ListContainers() ([]*Container, error) {
+	return FindContainers(StateFilter{})
+}
+
+// FindContainers returns the saved state of the containers matching
+// filter, ordered by id.
+func FindContainers(filter StateFilter) ([]*Container, error) {
+	s, err := stateStore()
+	if err != nil {
+		return nil, err
+	}
+	return s.List(filter)
+}
+
+// stateFileName is the state of a container in its state dir, used by
+// DirStateStore.
+const stateFileName = "state.json"
+
+// namesDirName is the index of container names under the base state dir,
+// used by DirStateStore: a symlink to the id of each named container. Ids
+// don't start with a dot, so it is no container's state dir.
+const namesDirName = ".names"
+
+// leasesDirName holds the address leases under the base state dir, used
+// by DirStateStore: a dir per network with a symlink named after each
+// leased address to the id of the container holding it.
+const leasesDirName = ".leases"
+
+// dirStore is DirStateStore.
+type dirStore struct{}
+
+func (dirStore) Load(id string) (*Container, error) {
+	data, err := os.ReadFile(filepath.Join(StateDir(id), stateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("container %s %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state.json: %w", err)
+	}
+	var c Container
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to decode state.json: %w", err)
+	}
+	return &c, nil
+}
+
+// Save replaces state.json atomically, so readers never see it half
+// written.
+func (s dirStore) Save(c *Container) error {
+	stateDir := StateDir(c.Id)
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return fmt.Errorf("failed to create state dir: %w", err)
+	}
+	if err := s.indexName(c); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(c, "", " ")
+	if err != nil {
+		return fmt.Errorf("failed to encode container state: %w", err)
+	}
+
+	f, err := os.CreateTemp(stateDir, ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create state.json: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state.json: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync state.json: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state.json: %w", err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(stateDir, stateFileName)); err != nil {
+		return fmt.Errorf("failed to replace state.json: %w", err)
+	}
+	return nil
+}
+
+// Update holds an exclusive lock on the state dir while it runs.
+func (s dirStore) Update(id string, fn func(*Container) error) error {
+	fd, err := unix.Open(StateDir(id), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("container %s %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open state dir: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Flock(fd, unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock state dir: %w", err)
+	}
+
+	c, err := s.Load(id)
+	if err != nil {
+		return err
+	}
+	if err := fn(c); err != nil {
+		return err
+	}
+	return s.Save(c)
+}
+
+func (s dirStore) Delete(id string) error {
+	if c, err := s.Load(id); err == nil && c.Name != "" {
+		link := filepath.Join(baseStateDir, namesDirName, c.Name)
+		if target, err := os.Readlink(link); err == nil && target == id {
+			_ = os.Remove(link)
+		}
+	}
+	err := os.Remove(filepath.Join(StateDir(id), stateFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state.json: %w", err)
+	}
+	return nil
+}
+
+// indexName links the name of c to its id. A link left to a container
+// that no longer has the name is replaced.
+func (s dirStore) indexName(c *Container) error {
+	if c.Name == "" {
+		return nil
+	}
+	dir := filepath.Join(baseStateDir, namesDirName)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create names index: %w", err)
+	}
+	link := filepath.Join(dir, c.Name)
+	for {
+		err := os.Symlink(c.Id, link)
+		if !errors.Is(err, os.ErrExist) {
+			if err != nil {
+				return fmt.Errorf("failed to index name %s: %w", c.Name, err)
+			}
+			return nil
+		}
+		id, err := os.Readlink(link)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to index name %s: %w", c.Name, err)
+		}
+		if id == c.Id {
+			return nil
+		}
+		if other, err := s.Load(id); err == nil && other.Name == c.Name {
+			return fmt.Errorf("container name %s %w, container %s has it", c.Name, ErrExists, id)
+		}
+		if err := removeStaleLink(link, id); err != nil {
+			return fmt.Errorf("failed to index name %s: %w", c.Name, err)
+		}
+	}
+}
+
+// removeStaleLink removes link if it still points to target, found to be
+// gone. The directory of link is locked meanwhile, so that of two callers
+// reclaiming the same link, the one coming second can't remove the link
+// the first made in its place.
+func removeStaleLink(link, target string) error {
+	fd, err := unix.Open(filepath.Dir(link), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Dir(link), err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Flock(fd, unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", filepath.Dir(link), err)
+	}
+	if t, err := os.Readlink(link); err != nil || t != target {
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.Remove(link); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// IDs reads the state dirs.
+func (s dirStore) IDs(prefix string) ([]string, error) {
+	entries, err := os.ReadDir(baseStateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state dir: %w", err)
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(baseStateDir, e.Name(), stateFileName)); err == nil {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// NameID follows the link of name, checking the container it leads to
+// still has the name.
+func (s dirStore) NameID(name string) (string, error) {
+	id, err := os.Readlink(filepath.Join(baseStateDir, namesDirName, name))
+	if err == nil {
+		if c, err := s.Load(id); err == nil && c.Name == name {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("container name %s %w", name, ErrNotFound)
+}
+
+// Leases reads the links of the network dirs.
+func (s dirStore) Leases(network string) ([]AddressLease, error) {
+	dir := filepath.Join(baseStateDir, leasesDirName)
+	networks := []string{network}
+	if network == "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read leases: %w", err)
+		}
+		networks = nil
+		for _, e := range entries {
+			networks = append(networks, e.Name())
+		}
+	}
+	var leases []AddressLease
+	for _, n := range networks {
+		entries, err := os.ReadDir(filepath.Join(dir, n))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read leases of network %s: %w", n, err)
+		}
+		for _, e := range entries {
+			if id, err := os.Readlink(filepath.Join(dir, n, e.Name())); err == nil {
+				leases = append(leases, AddressLease{Network: n, Address: e.Name(), Container: id})
+			}
+		}
+	}
+	return leases, nil
+}
+
+// Lease links the address to the id. Creating a symlink fails if it
+// exists, so two containers can't both get it.
+func (s dirStore) Lease(l AddressLease) error {
+	dir := filepath.Join(baseStateDir, leasesDirName, l.Network)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create leases of network %s: %w", l.Network, err)
+	}
+	link := filepath.Join(dir, l.Address)
+	for {
+		err := os.Symlink(l.Container, link)
+		if !errors.Is(err, os.ErrExist) {
+			if err != nil {
+				return fmt.Errorf("failed to lease address %s: %w", l.Address, err)
+			}
+			return nil
+		}
+		id, err := os.Readlink(link)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lease address %s: %w", l.Address, err)
+		}
+		if id == l.Container {
+			return nil
+		}
+		if _, err := s.Load(id); err == nil {
+			return fmt.Errorf("address %s of network %s %w, container %s holds it", l.Address, l.Network, ErrExists, id)
+		}
+		if err := removeStaleLink(link, id); err != nil {
+			return fmt.Errorf("failed to lease address %s: %w", l.Address, err)
+		}
+	}
+}
+
+// Release removes the links to id.
+func (s dirStore) Release(id string) ([]AddressLease, error) {
+	leases, err := s.Leases("")
+	if err != nil {
+		return nil, err
+	}
+	var released []AddressLease
+	for _, l := range leases {
+		if l.Container != id {
+			continue
+		}
+		err := os.Remove(filepath.Join(baseStateDir, leasesDirName, l.Network, l.Address))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return released, fmt.Errorf("failed to release address %s: %w", l.Address, err)
+		}
+		released = append(released, l)
+	}
+	return released, nil
+}
+
+// List reads every state dir. Those without a readable state.json are
+// skipped.
+func (s dirStore) List(filter StateFilter) ([]*Container, error) {
+	entries, err := os.ReadDir(baseStateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state dir: %w", err)
+	}
+
+	var containers []*Container
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		c, err := s.Load(e.Name())
+		if err != nil || !filter.Match(c) {
+			continue
+		}
+		containers = append(containers, c)
+	}
+	return containers, nil
+}
@@ -0,0 +1,141 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStores(t *testing.T) {
+	for _, kind := range []string{DirStateStore, BoltStateStore} {
+		t.Run(kind, func(t *testing.T) {
+			orig := baseStateDir
+			baseStateDir = t.TempDir()
+			defer func() { baseStateDir = orig }()
+
+			s, err := OpenStateStore(kind)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Load("web"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Load of a missing container: got %v, want ErrNotFound", err)
+			}
+			if list, err := s.List(StateFilter{}); err != nil || len(list) != 0 {
+				t.Fatalf("List of an empty store = %v, %v", list, err)
+			}
+
+			for _, c := range []*Container{
+				{Id: "web", Status: Running, Annotations: map[string]string{"tier": "front", "team": "a"}},
+				{Id: "db", Status: Running, Annotations: map[string]string{"tier": "back", "team": "a"}},
+				{Id: "job", Status: Stopped, Annotations: map[string]string{"tier": "back"}},
+			} {
+				if err := s.Save(c); err != nil {
+					t.Fatalf("Save %s: %v", c.Id, err)
+				}
+			}
+
+			c, err := s.Load("web")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Status != Running || c.Annotations["tier"] != "front" {
+				t.Fatalf("Load returned %+v", c)
+			}
+
+			err = s.Update("web", func(c *Container) error {
+				c.Status = Stopped
+				c.Annotations["tier"] = "back"
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Update: %v", err)
+			}
+			boom := errors.New("boom")
+			err = s.Update("db", func(c *Container) error {
+				c.Status = Stopped
+				return boom
+			})
+			if !errors.Is(err, boom) {
+				t.Fatalf("Update returned %v, want the error of fn", err)
+			}
+			if err := s.Update("nope", func(*Container) error { return nil }); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Update of a missing container: got %v, want ErrNotFound", err)
+			}
+
+			for _, tt := range []struct {
+				filter StateFilter
+				want   string
+			}{
+				{StateFilter{}, "[db job web]"},
+				{StateFilter{Status: []Status{Running}}, "[db]"},
+				{StateFilter{Status: []Status{Stopped}}, "[job web]"},
+				{StateFilter{Status: []Status{Created, Running}}, "[db]"},
+				{StateFilter{Annotations: map[string]string{"tier": "back"}}, "[db job web]"},
+				{StateFilter{Annotations: map[string]string{"tier": "front"}}, "[]"},
+				{StateFilter{Annotations: map[string]string{"tier": "back", "team": "a"}}, "[db web]"},
+				{StateFilter{Status: []Status{Stopped}, Annotations: map[string]string{"team": "a"}}, "[web]"},
+			} {
+				list, err := s.List(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := containerIds(list); got != tt.want {
+					t.Errorf("List(%+v) = %s, want %s", tt.filter, got, tt.want)
+				}
+			}
+
+			if err := s.Delete("web"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("web"); err != nil {
+				t.Fatalf("Delete of a deleted container: %v", err)
+			}
+			list, err := s.List(StateFilter{Annotations: map[string]string{"team": "a"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := containerIds(list); got != "[db]" {
+				t.Fatalf("List after Delete = %s, want [db]", got)
+			}
+		})
+	}
+}
+
+func TestBoltStoreFile(t *testing.T) {
+	orig := baseStateDir
+	baseStateDir = t.TempDir()
+	defer func() { baseStateDir = orig }()
+
+	if err := (boltStore{}).Save(&Container{Id: "web", Status: Created}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(baseStateDir, stateDBName)); err != nil {
+		t.Fatalf("state database not created: %v", err)
+	}
+	if _, err := os.Stat(StateDir("web")); !os.IsNotExist(err) {
+		t.Fatalf("bolt store created a state dir: %v", err)
+	}
+}
+
+func TestOpenStateStore(t *testing.T) {
+	if _, err := OpenStateStore("bogus"); err == nil {
+		t.Fatal("expected error for an unknown state store")
+	}
+	s, err := OpenStateStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(dirStore); !ok {
+		t.Fatalf("default state store is %T, want dirStore", s)
+	}
+}
+
+func containerIds(containers []*Container) string {
+	ids := []string{}
+	for _, c := range containers {
+		ids = append(ids, c.Id)
+	}
+	return fmt.Sprint(ids)
+}
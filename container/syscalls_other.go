@@ -0,0 +1,7 @@
+//go:build !amd64 && !arm64 && !ppc64le && !riscv64 && !s390x
+
+package container
+
+// syscallNames is empty on architectures without a generated table; system
+// calls are traced by number.
+var syscallNames = map[uint64]string{}
@@ -0,0 +1,276 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// Every container gets /proc, /sys and, when it has a cgroup, its cgroup
+// namespace at /sys/fs/cgroup, unless its spec binds something there.
+// /proc takes the hidepid, gid and subset options of a proc mount of the
+// spec. /sys and /sys/fs/cgroup are read-only unless the container owns
+// both its user and network namespaces, the one case where sysfs only
+// shows what belongs to it, or is privileged; a user namespace can't mount
+// the sysfs of the host network namespace, so such a container gets the
+// host's /sys bound read-only instead. Then the paths of
+// linux.maskedPaths are hidden and those of linux.readonlyPaths made
+// read-only, as the path policy of the class of the container decides.
+
+// defaultMaskedPaths are hidden when the spec has no linux.maskedPaths.
+var defaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/asound",
+	"/proc/interrupts",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/sys/devices/virtual/powercap",
+	"/sys/firmware",
+}
+
+// defaultReadonlyPaths are made read-only when the spec has no
+// linux.readonlyPaths.
+var defaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+	"/proc/sysrq-trigger",
+}
+
+// procOptions are the proc options a /proc mount of the spec may set.
+var procOptions = map[string]bool{"hidepid": true, "gid": true, "subset": true}
+
+// procMountData returns the proc options of the /proc mount of the spec,
+// checking they are among procOptions.
+func procMountData(mounts []specs.Mount) (string, error) {
+	var data []string
+	for _, m := range mounts {
+		if m.Type != "proc" || filepath.Clean(m.Destination) != "/proc" {
+			continue
+		}
+		for _, opt := range parseMountOptions(m.Options).data {
+			key, _, _ := strings.Cut(opt, "=")
+			if !procOptions[key] {
+				return "", fmt.Errorf("unsupported /proc mount option %q: expected hidepid=, gid= or subset=", opt)
+			}
+			data = append(data, opt)
+		}
+	}
+	return strings.Join(data, ","), nil
+}
+
+// hasMountAt reports whether the spec mounts something at dst, which
+// then replaces the standard mount there.
+func hasMountAt(spec *specs.Spec, dst string) bool {
+	if spec == nil {
+		return false
+	}
+	for _, m := range spec.Mounts {
+		if isBindMount(m) && filepath.Clean(m.Destination) == dst {
+			return true
+		}
+	}
+	return false
+}
+
+// sysWritable reports whether /sys is mounted read-write, when the
+// container owns both its user and network namespaces, or is privileged
+// and can mount it.
+func sysWritable(userns, hostNetwork, privileged bool) bool {
+	if userns && hostNetwork {
+		return false
+	}
+	return userns || privileged
+}
+
+// maskedPaths returns the paths hidden in the container of spec.
+func maskedPaths(spec *specs.Spec) []string {
+	if spec != nil && spec.Linux != nil && spec.Linux.MaskedPaths != nil {
+		return spec.Linux.MaskedPaths
+	}
+	return defaultMaskedPaths
+}
+
+// readonlyPaths returns the paths made read-only in the container of spec.
+func readonlyPaths(spec *specs.Spec) []string {
+	if spec != nil && spec.Linux != nil && spec.Linux.ReadonlyPaths != nil {
+		return spec.Linux.ReadonlyPaths
+	}
+	return defaultReadonlyPaths
+}
+
+// mountProc mounts a proc of the current pid namespace at rootfs/proc with
+// the proc options data.
+func mountProc(rootfs, data string) error {
+	return mountInRoot(rootfs, mountTarget{path: "/proc", dir: true, perm: 0o555}, func(dst string) error {
+		if err := unix.Mount("proc", dst, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, data); err != nil {
+			return fmt.Errorf("failed to mount /proc: %w", err)
+		}
+		return nil
+	}, nil)
+}
+
+// mountSys mounts sysfs at rootfs/sys, read-write if writable, and with
+// cgroup the cgroup2 hierarchy of the current cgroup namespace at
+// rootfs/sys/fs/cgroup.
+func mountSys(rootfs string, writable, cgroup bool) error {
+	flags := uintptr(unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC)
+	if !writable {
+		flags |= unix.MS_RDONLY
+	}
+	var bound bool
+	return mountInRoot(rootfs, mountTarget{path: "/sys", dir: true, perm: 0o555}, func(dst string) error {
+		err := unix.Mount("sysfs", dst, "sysfs", flags, "")
+		if errors.Is(err, unix.EPERM) && !writable {
+			// The network namespace belongs to another user namespace.
+			// The mounts below /sys come along, as a user namespace
+			// can't uncover what they hide.
+			err = unix.Mount("/sys", dst, "", unix.MS_BIND|unix.MS_REC, "")
+			bound = err == nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mount /sys: %w", err)
+		}
+		return nil
+	}, func(dst string) error {
+		if bound {
+			if err := remountReadOnly(dst); err != nil {
+				return fmt.Errorf("failed to mount /sys: %w", err)
+			}
+		}
+		if !cgroup {
+			return nil
+		}
+		// What is under dst is the kernel's now, not the image's.
+		if err := unix.Mount("cgroup2", filepath.Join(dst, "fs/cgroup"), "cgroup2", flags, ""); err != nil {
+			return fmt.Errorf("failed to mount /sys/fs/cgroup: %w", err)
+		}
+		return nil
+	})
+}
+
+// devNullTrees returns n detached copies of the host's /dev/null, which
+// maskPaths attaches over files once the host's is out of reach, as the
+// container may have no /dev/null of its own.
+func devNullTrees(n int) ([]int, error) {
+	var trees []int
+	for i := 0; i < n; i++ {
+		fd, err := unix.OpenTree(unix.AT_FDCWD, "/dev/null", unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC)
+		if err != nil {
+			closeAll(trees)
+			return nil, fmt.Errorf("failed to copy /dev/null: %w", err)
+		}
+		trees = append(trees, fd)
+	}
+	return trees, nil
+}
+
+// closeAll closes the descriptors fds.
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// maskPaths hides paths from the container, directories under an empty
+// read-only tmpfs and files under a tree of devNullTrees, one per path.
+// Missing paths are skipped.
+func maskPaths(paths []string, devNulls []int) error {
+	for i, p := range paths {
+		fi, err := os.Stat(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", p, err)
+		}
+		if fi.IsDir() {
+			err = unix.Mount("tmpfs", p, "tmpfs", unix.MS_RDONLY, "")
+		} else {
+			err = unix.MoveMount(devNulls[i], "", unix.AT_FDCWD, p, unix.MOVE_MOUNT_F_EMPTY_PATH)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mask %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// makeReadonly binds paths on themselves read-only. Missing paths are
+// skipped.
+func makeReadonly(paths []string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind %s: %w", p, err)
+		}
+		if err := remountReadOnly(p); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// makeWritable binds paths below read-only ones on themselves writable.
+// Missing paths are skipped.
+func makeWritable(paths []string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := unix.Mount(p, p, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind %s: %w", p, err)
+		}
+		if err := remountBind(p, 0); err != nil {
+			return fmt.Errorf("failed to make %s writable: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// statfsMountFlags maps the statfs flags of a mount to the mount flags a
+// user namespace can't clear on remount.
+var statfsMountFlags = map[int64]uintptr{
+	unix.ST_NOSUID:     unix.MS_NOSUID,
+	unix.ST_NODEV:      unix.MS_NODEV,
+	unix.ST_NOEXEC:     unix.MS_NOEXEC,
+	unix.ST_NOATIME:    unix.MS_NOATIME,
+	unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+	unix.ST_RELATIME:   unix.MS_RELATIME,
+}
+
+// remountReadOnly remounts the bind mount at path read-only, keeping its
+// other flags.
+func remountReadOnly(path string) error {
+	return remountBind(path, unix.MS_RDONLY)
+}
+
+// remountBind remounts the bind mount at path with flags, keeping its
+// other flags but read-only.
+func remountBind(path string, flags uintptr) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return err
+	}
+	flags |= unix.MS_BIND | unix.MS_REMOUNT
+	for sf, mf := range statfsMountFlags {
+		if int64(st.Flags)&sf != 0 {
+			flags |= mf
+		}
+	}
+	return unix.Mount("", path, "", flags, "")
+}
@@ -0,0 +1,67 @@
+package container
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestProcMountData(t *testing.T) {
+	mounts := []specs.Mount{
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"mode=755"}},
+		{Destination: "/proc/", Type: "proc", Source: "proc", Options: []string{"nosuid", "noexec", "hidepid=invisible", "gid=10"}},
+	}
+	data, err := procMountData(mounts)
+	if err != nil || data != "hidepid=invisible,gid=10" {
+		t.Fatalf("procMountData = %q, %v", data, err)
+	}
+	if data, err := procMountData(nil); err != nil || data != "" {
+		t.Fatalf("procMountData without a proc mount = %q, %v", data, err)
+	}
+	mounts[1].Options = []string{"size=1m"}
+	if _, err := procMountData(mounts); err == nil {
+		t.Fatal("expected an error for a non-proc option")
+	}
+}
+
+func TestSysWritable(t *testing.T) {
+	for _, tc := range []struct {
+		userns, hostNetwork, privileged, want bool
+	}{
+		{false, false, false, false},
+		{false, true, false, false},
+		{true, true, false, false},
+		{true, false, false, true},
+		{false, false, true, true},
+		{false, true, true, true},
+		{true, true, true, false},
+	} {
+		if got := sysWritable(tc.userns, tc.hostNetwork, tc.privileged); got != tc.want {
+			t.Errorf("sysWritable(%v, %v, %v) = %v, want %v", tc.userns, tc.hostNetwork, tc.privileged, got, tc.want)
+		}
+	}
+}
+
+func TestMaskedAndReadonlyPaths(t *testing.T) {
+	spec := &specs.Spec{}
+	if !slices.Equal(maskedPaths(spec), defaultMaskedPaths) || !slices.Equal(readonlyPaths(spec), defaultReadonlyPaths) {
+		t.Fatal("expected the defaults without linux settings")
+	}
+	// An empty list is the spec asking for none.
+	spec.Linux = &specs.Linux{MaskedPaths: []string{"/proc/kcore"}, ReadonlyPaths: []string{}}
+	if got := maskedPaths(spec); !slices.Equal(got, []string{"/proc/kcore"}) {
+		t.Errorf("maskedPaths = %v", got)
+	}
+	if got := readonlyPaths(spec); len(got) != 0 {
+		t.Errorf("readonlyPaths = %v, want none", got)
+	}
+
+	spec.Mounts = []specs.Mount{
+		{Destination: "/sys/", Type: "bind", Source: "/sys", Options: []string{"rbind"}},
+		{Destination: "/sys/fs/cgroup", Type: "cgroup2", Source: "cgroup"},
+	}
+	if !hasMountAt(spec, "/sys") || hasMountAt(spec, "/sys/fs/cgroup") {
+		t.Error("only bind mounts replace the standard mounts")
+	}
+}
@@ -0,0 +1,243 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Cgroup managers accepted by RunOptions.CgroupManager.
+const (
+	CgroupfsManager = "cgroupfs"
+	SystemdManager  = "systemd"
+)
+
+// defaultSlice is the slice container scopes are placed in when the spec
+// doesn't choose one through linux.cgroupsPath.
+const defaultSlice = "system.slice"
+
+// systemdScopeTimeout bounds how long we wait for systemd to move the
+// container into its new scope.
+var systemdScopeTimeout = 5 * time.Second
+
+// systemdUnit identifies the transient scope of a container.
+type systemdUnit struct {
+	Slice string
+	Name  string
+}
+
+// parseSystemdCgroupsPath interprets linux.cgroupsPath in the
+// "slice:prefix:name" form used by systemd-aware runtimes. Empty parts fall
+// back to the defaults.
+func parseSystemdCgroupsPath(id, cgroupsPath string) (systemdUnit, error) {
+	slice, prefix, name := defaultSlice, "containish", id
+	if cgroupsPath != "" {
+		parts := strings.Split(cgroupsPath, ":")
+		if len(parts) != 3 {
+			return systemdUnit{}, fmt.Errorf("invalid systemd cgroupsPath %q: expected slice:prefix:name", cgroupsPath)
+		}
+		if parts[0] != "" {
+			slice = parts[0]
+		}
+		if parts[1] != "" {
+			prefix = parts[1]
+		}
+		if parts[2] != "" {
+			name = parts[2]
+		}
+	}
+	if !strings.HasSuffix(slice, ".slice") {
+		return systemdUnit{}, fmt.Errorf("invalid slice %q: must end in .slice", slice)
+	}
+	return systemdUnit{Slice: slice, Name: prefix + "-" + name + ".scope"}, nil
+}
+
+// expandSlice converts a slice name into its cgroup path, e.g.
+// "a-b-c.slice" becomes "a.slice/a-b.slice/a-b-c.slice".
+func expandSlice(slice string) (string, error) {
+	name := strings.TrimSuffix(slice, ".slice")
+	if name == "-" {
+		return "", nil
+	}
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, "-") ||
+		strings.HasSuffix(name, "-") || strings.Contains(name, "--") {
+		return "", fmt.Errorf("invalid slice name %q", slice)
+	}
+
+	var path, prefix string
+	for _, part := range strings.Split(name, "-") {
+		prefix += part
+		path = filepath.Join(path, prefix+".slice")
+		prefix += "-"
+	}
+	return path, nil
+}
+
+// cgroupPath returns the absolute cgroup directory systemd creates for u.
+func (u systemdUnit) cgroupPath() (string, error) {
+	slice, err := expandSlice(u.Slice)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cgroupRoot, slice, u.Name), nil
+}
+
+// startSystemdScope asks systemd to create a transient scope containing pid,
+// with cgroup delegation and the spec resources translated to unit
+// properties. It returns the cgroup path of the scope once pid has been
+// moved into it.
+func startSystemdScope(u systemdUnit, pid int, r *specs.LinuxResources) (string, error) {
+	path, err := u.cgroupPath()
+	if err != nil {
+		return "", err
+	}
+
+	var body dbusEncoder
+	body.string(u.Name)
+	body.string("replace")
+	var propErr error
+	body.array(8, func() {
+		prop := func(name, sig string, fn func()) {
+			body.structure(func() {
+				body.string(name)
+				body.variant(sig, fn)
+			})
+		}
+		prop("Description", "s", func() { body.string("containish container " + u.Name) })
+		prop("Slice", "s", func() { body.string(u.Slice) })
+		prop("Delegate", "b", func() { body.bool(true) })
+		prop("PIDs", "au", func() {
+			body.array(4, func() { body.uint32(uint32(pid)) })
+		})
+		propErr = systemdResourceProperties(r, prop, &body)
+	})
+	if propErr != nil {
+		return "", propErr
+	}
+	// auxiliary units: a(sa(sv)), always empty
+	body.array(8, func() {})
+
+	conn, err := dialSystemBus()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.call("org.freedesktop.systemd1", "/org/freedesktop/systemd1",
+		"org.freedesktop.systemd1.Manager", "StartTransientUnit", "ssa(sv)a(sa(sv))", body.buf); err != nil {
+		return "", err
+	}
+
+	if err := waitForCgroupPid(path, pid, systemdScopeTimeout); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// systemdResourceProperties adds the unit properties equivalent to the spec
+// resources supported by the cgroupfs manager.
+func systemdResourceProperties(r *specs.LinuxResources, prop func(string, string, func()), body *dbusEncoder) error {
+	if r == nil || r.BlockIO == nil {
+		return nil
+	}
+	b := r.BlockIO
+
+	if b.Weight != nil {
+		w, err := blkioToIOWeight(*b.Weight)
+		if err != nil {
+			return err
+		}
+		prop("IOWeight", "t", func() { body.uint64(w) })
+	}
+
+	// Per-device settings are a(st) of (device path, value) pairs.
+	type devValue struct {
+		path  string
+		value uint64
+	}
+	devProp := func(name string, values []devValue) {
+		if len(values) == 0 {
+			return
+		}
+		prop(name, "a(st)", func() {
+			body.array(8, func() {
+				for _, v := range values {
+					body.structure(func() {
+						body.string(v.path)
+						body.uint64(v.value)
+					})
+				}
+			})
+		})
+	}
+	blockDev := func(major, minor int64) (string, error) {
+		if err := validateBlockDevice(major, minor); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("/dev/block/%d:%d", major, minor), nil
+	}
+
+	var weights []devValue
+	for _, wd := range b.WeightDevice {
+		if wd.Weight == nil {
+			continue
+		}
+		dev, err := blockDev(wd.Major, wd.Minor)
+		if err != nil {
+			return err
+		}
+		w, err := blkioToIOWeight(*wd.Weight)
+		if err != nil {
+			return err
+		}
+		weights = append(weights, devValue{dev, w})
+	}
+	devProp("IODeviceWeight", weights)
+
+	throttles := []struct {
+		name  string
+		rules []specs.LinuxThrottleDevice
+	}{
+		{"IOReadBandwidthMax", b.ThrottleReadBpsDevice},
+		{"IOWriteBandwidthMax", b.ThrottleWriteBpsDevice},
+		{"IOReadIOPSMax", b.ThrottleReadIOPSDevice},
+		{"IOWriteIOPSMax", b.ThrottleWriteIOPSDevice},
+	}
+	for _, t := range throttles {
+		var values []devValue
+		for _, rule := range t.rules {
+			dev, err := blockDev(rule.Major, rule.Minor)
+			if err != nil {
+				return err
+			}
+			values = append(values, devValue{dev, rule.Rate})
+		}
+		devProp(t.name, values)
+	}
+	return nil
+}
+
+// waitForCgroupPid polls until pid shows up in the cgroup at path.
+func waitForCgroupPid(path string, pid int, timeout time.Duration) error {
+	want := strconv.Itoa(pid)
+	deadline := time.Now().Add(timeout)
+	for {
+		data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err == nil {
+			for _, p := range strings.Fields(string(data)) {
+				if p == want {
+					return nil
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for pid %d to join %s", pid, path)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
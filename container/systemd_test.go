@@ -0,0 +1,83 @@
+package container
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExpandSlice(t *testing.T) {
+	cases := map[string]string{
+		"-.slice":           "",
+		"system.slice":      "system.slice",
+		"user-1000.slice":   "user.slice/user-1000.slice",
+		"a-b-c.slice":       "a.slice/a-b.slice/a-b-c.slice",
+		"machine-lab.slice": "machine.slice/machine-lab.slice",
+	}
+	for in, want := range cases {
+		got, err := expandSlice(in)
+		if err != nil || got != want {
+			t.Errorf("expandSlice(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+
+	for _, bad := range []string{"a--b.slice", "-a.slice", "a/b.slice", ".slice"} {
+		if _, err := expandSlice(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParseSystemdCgroupsPath(t *testing.T) {
+	u, err := parseSystemdCgroupsPath("web", "")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if u.Slice != "system.slice" || u.Name != "containish-web.scope" {
+		t.Fatalf("unexpected default unit %+v", u)
+	}
+
+	u, err = parseSystemdCgroupsPath("web", "machine.slice:lab:")
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if u.Slice != "machine.slice" || u.Name != "lab-web.scope" {
+		t.Fatalf("unexpected unit %+v", u)
+	}
+
+	if _, err := parseSystemdCgroupsPath("web", "/containish/web"); err == nil {
+		t.Fatalf("expected error for cgroupfs style path")
+	}
+}
+
+func TestReadDbusMessage(t *testing.T) {
+	// Build an error reply the way the bus would send it.
+	var body dbusEncoder
+	body.string("Unit already exists")
+
+	var h dbusEncoder
+	h.byte('l')
+	h.byte(dbusError)
+	h.byte(0)
+	h.byte(1)
+	h.uint32(uint32(len(body.buf)))
+	h.uint32(7)
+	h.array(8, func() {
+		h.field(dbusFieldErrorName, "s", func() { h.string("org.freedesktop.systemd1.UnitExists") })
+		h.field(dbusFieldReplySerial, "u", func() { h.uint32(3) })
+		h.field(dbusFieldSignature, "g", func() { h.signature("s") })
+	})
+	h.align(8)
+
+	msg, err := readDbusMessage(bytes.NewReader(append(h.buf, body.buf...)))
+	if err != nil {
+		t.Fatalf("readDbusMessage failed: %v", err)
+	}
+	if msg.typ != dbusError || msg.replySerial != 3 || msg.signature != "s" ||
+		msg.errorName != "org.freedesktop.systemd1.UnitExists" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+	d := dbusDecoder{buf: msg.body}
+	if got := d.string(); got != "Unit already exists" {
+		t.Fatalf("unexpected body %q", got)
+	}
+}
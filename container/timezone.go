@@ -0,0 +1,140 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// A container runs in the timezone and locale of its rootfs, UTC and C for
+// the Alpine rootfs, which has no zoneinfo. A Timezone bind mounts the
+// zoneinfo file of a zone of the host at /etc/localtime, and at its path
+// under /usr/share/zoneinfo so TZ, set to the zone name, resolves without
+// tzdata in the rootfs. HostLocale passes the locale variables of the
+// runtime on to the container process.
+
+// Timezones of RunOptions other than zone names.
+const (
+	// TimezoneHost is the timezone of the host, that of /etc/localtime.
+	TimezoneHost = "host"
+	// TimezoneNone leaves the timezone to the rootfs. It is given as an
+	// empty Timezone.
+	TimezoneNone = "none"
+)
+
+var (
+	// hostLocaltime is the timezone of the host and zoneinfoDir the zones
+	// it has, variables so tests can override them.
+	hostLocaltime = "/etc/localtime"
+	zoneinfoDir   = "/usr/share/zoneinfo"
+)
+
+// containerZoneinfoDir is where the zoneinfo of the rootfs is looked up.
+const containerZoneinfoDir = "/usr/share/zoneinfo"
+
+// ParseTimezone parses a --tz value: a zone such as Europe/Lisbon, host or
+// none, returning the Timezone of RunOptions.
+func ParseTimezone(value string) (string, error) {
+	switch value {
+	case TimezoneNone:
+		return "", nil
+	case TimezoneHost:
+		return value, nil
+	}
+	if _, err := zoneFile(value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// zoneFile returns the zoneinfo file of zone on the host.
+func zoneFile(zone string) (string, error) {
+	if !filepath.IsLocal(zone) {
+		return "", fmt.Errorf("invalid timezone %q", zone)
+	}
+	p := filepath.Join(zoneinfoDir, zone)
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("unknown timezone %q: %w", zone, err)
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "TZif" {
+		return "", fmt.Errorf("unknown timezone %q: %s isn't a zoneinfo file", zone, p)
+	}
+	return p, nil
+}
+
+// hostTimezone returns the zoneinfo file of the timezone of the host and its
+// zone name, empty if the file isn't one of zoneinfoDir. A host without
+// /etc/localtime is on UTC and has none.
+func hostTimezone() (zone, file string, err error) {
+	file, err = filepath.EvalSymlinks(hostLocaltime)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the host timezone: %w", err)
+	}
+	dir, err := filepath.EvalSymlinks(zoneinfoDir)
+	if err != nil {
+		dir = zoneinfoDir
+	}
+	if rel, err := filepath.Rel(dir, file); err == nil && filepath.IsLocal(rel) {
+		zone = rel
+	}
+	return zone, file, nil
+}
+
+// applyTimezone bind mounts the zoneinfo file of tz, a Timezone, into the
+// container of spec and sets TZ. Mounts the spec makes itself are kept.
+func applyTimezone(spec *specs.Spec, tz string) error {
+	var zone, file string
+	var err error
+	if tz == TimezoneHost {
+		zone, file, err = hostTimezone()
+	} else {
+		zone = tz
+		file, err = zoneFile(tz)
+	}
+	if err != nil || file == "" {
+		return err
+	}
+	bind := func(dst string) {
+		if !hasMountAt(spec, dst) {
+			spec.Mounts = append(spec.Mounts, specs.Mount{Destination: dst, Type: "bind", Source: file, Options: []string{"bind", "ro"}})
+		}
+	}
+	bind("/etc/localtime")
+	// Without a zone name, TZ names the file.
+	value := ":/etc/localtime"
+	if zone != "" {
+		bind(path.Join(containerZoneinfoDir, filepath.ToSlash(zone)))
+		value = zone
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return nil
+	}
+	return setEnv(spec, []string{"TZ=" + value})
+}
+
+// hostLocaleEnv returns the locale variables of the environment of the
+// runtime, LANG, LANGUAGE and LC_*.
+func hostLocaleEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		key, _, _ := strings.Cut(e, "=")
+		if key == "LANG" || key == "LANGUAGE" || strings.HasPrefix(key, "LC_") {
+			env = append(env, e)
+		}
+	}
+	sort.Strings(env)
+	return env
+}
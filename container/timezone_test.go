@@ -0,0 +1,120 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// fakeZoneinfo points zoneinfoDir at a temporary directory holding
+// Europe/Lisbon, and hostLocaltime at a link to it.
+func fakeZoneinfo(t *testing.T) string {
+	t.Helper()
+	oldDir, oldLocaltime := zoneinfoDir, hostLocaltime
+	t.Cleanup(func() { zoneinfoDir, hostLocaltime = oldDir, oldLocaltime })
+	zoneinfoDir = t.TempDir()
+	hostLocaltime = filepath.Join(t.TempDir(), "localtime")
+	if err := os.MkdirAll(filepath.Join(zoneinfoDir, "Europe"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lisbon := filepath.Join(zoneinfoDir, "Europe", "Lisbon")
+	writeFile(t, lisbon, "TZif2\n", 0o644)
+	writeFile(t, filepath.Join(zoneinfoDir, "zone.tab"), "PT\t+3843-00908\tEurope/Lisbon\n", 0o644)
+	if err := os.Symlink(lisbon, hostLocaltime); err != nil {
+		t.Fatal(err)
+	}
+	return lisbon
+}
+
+func TestParseTimezone(t *testing.T) {
+	fakeZoneinfo(t)
+	for value, want := range map[string]string{"Europe/Lisbon": "Europe/Lisbon", "host": TimezoneHost, "none": ""} {
+		if got, err := ParseTimezone(value); err != nil || got != want {
+			t.Errorf("ParseTimezone(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "Mars/Base", "../etc/passwd", "/etc/localtime", "zone.tab", "Europe"} {
+		if _, err := ParseTimezone(value); err == nil {
+			t.Errorf("ParseTimezone(%q) succeeded", value)
+		}
+	}
+}
+
+func TestHostTimezone(t *testing.T) {
+	lisbon := fakeZoneinfo(t)
+	zone, file, err := hostTimezone()
+	if err != nil || zone != "Europe/Lisbon" || file != lisbon {
+		t.Errorf("hostTimezone() = %q, %q, %v", zone, file, err)
+	}
+
+	// A copied zone file has no name.
+	os.Remove(hostLocaltime)
+	writeFile(t, hostLocaltime, "TZif2\n", 0o644)
+	if zone, file, err = hostTimezone(); err != nil || zone != "" || file != hostLocaltime {
+		t.Errorf("hostTimezone() of a copy = %q, %q, %v", zone, file, err)
+	}
+
+	os.Remove(hostLocaltime)
+	if zone, file, err = hostTimezone(); err != nil || zone != "" || file != "" {
+		t.Errorf("hostTimezone() without localtime = %q, %q, %v", zone, file, err)
+	}
+}
+
+func TestApplyTimezone(t *testing.T) {
+	lisbon := fakeZoneinfo(t)
+	spec := &specs.Spec{Process: &specs.Process{Args: []string{"/bin/sh"}, Env: []string{"TZ=UTC", "PATH=/bin"}}}
+	if err := applyTimezone(spec, TimezoneHost); err != nil {
+		t.Fatal(err)
+	}
+	var dsts []string
+	for _, m := range spec.Mounts {
+		if m.Source != lisbon || !isBindMount(m) || !slices.Contains(m.Options, "ro") {
+			t.Errorf("unexpected mount %+v", m)
+		}
+		dsts = append(dsts, m.Destination)
+	}
+	if want := []string{"/etc/localtime", "/usr/share/zoneinfo/Europe/Lisbon"}; !slices.Equal(dsts, want) {
+		t.Errorf("mounts at %v, want %v", dsts, want)
+	}
+	if want := []string{"PATH=/bin", "TZ=Europe/Lisbon"}; !slices.Equal(spec.Process.Env, want) {
+		t.Errorf("env is %v, want %v", spec.Process.Env, want)
+	}
+
+	// A mount of the spec at /etc/localtime is kept.
+	own := specs.Mount{Destination: "/etc/localtime", Type: "bind", Source: "/elsewhere", Options: []string{"bind"}}
+	spec = &specs.Spec{Mounts: []specs.Mount{own}}
+	if err := applyTimezone(spec, "Europe/Lisbon"); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Mounts) != 2 || spec.Mounts[0].Source != "/elsewhere" {
+		t.Errorf("mounts are %+v", spec.Mounts)
+	}
+
+	if err := applyTimezone(&specs.Spec{}, "Mars/Base"); err == nil {
+		t.Error("applying an unknown timezone succeeded")
+	}
+}
+
+func TestHostLocaleEnv(t *testing.T) {
+	t.Setenv("LANG", "pt_PT.UTF-8")
+	t.Setenv("LC_TIME", "en_GB.UTF-8")
+	t.Setenv("LANGUAGE", "")
+	os.Unsetenv("LANGUAGE")
+	t.Setenv("LC_ALL", "")
+	os.Unsetenv("LC_ALL")
+	env := hostLocaleEnv()
+	for _, want := range []string{"LANG=pt_PT.UTF-8", "LC_TIME=en_GB.UTF-8"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("%s missing from %v", want, env)
+		}
+	}
+	for _, e := range env {
+		if key, _, _ := strings.Cut(e, "="); key != "LANG" && !strings.HasPrefix(key, "LC_") {
+			t.Errorf("unexpected variable %q", e)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package container
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// defaultTmpfsOptions are applied to --tmpfs mounts before the user's own.
+var defaultTmpfsOptions = []string{"nosuid", "nodev"}
+
+// ParseTmpfs parses a --tmpfs value of the form "<path>[:<options>]", where
+// options are comma separated, e.g. "/tmp:size=64m,mode=1777".
+func ParseTmpfs(value string) (specs.Mount, error) {
+	path, opts, _ := strings.Cut(value, ":")
+	m := specs.Mount{
+		Destination: path,
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     append([]string{}, defaultTmpfsOptions...),
+	}
+	if opts != "" {
+		m.Options = append(m.Options, strings.Split(opts, ",")...)
+	}
+	if err := validateTmpfs(m); err != nil {
+		return m, fmt.Errorf("invalid --tmpfs %q: %w", value, err)
+	}
+	return m, nil
+}
+
+// validateTmpfs checks the destination and options of a tmpfs mount.
+func validateTmpfs(m specs.Mount) error {
+	if !filepath.IsAbs(m.Destination) || filepath.Clean(m.Destination) == "/" {
+		return fmt.Errorf("tmpfs destination %q must be an absolute path other than /", m.Destination)
+	}
+	_, _, err := tmpfsMountOptions(m.Options)
+	return err
+}
+
+// validateSpecMounts checks the spec mounts containish acts on, so errors
+// surface before the container is started.
+func validateSpecMounts(mounts []specs.Mount) error {
+	for _, m := range mounts {
+		var err error
+		switch {
+		case isBindMount(m):
+			err = validateBindMount(m)
+		case m.Type == "tmpfs":
+			err = validateTmpfs(m)
+		case m.Type == "proc":
+			_, err = procMountData([]specs.Mount{m})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tmpfsMountOptions splits mount options into mount flags, propagation and
+// the tmpfs data string, validating size= and mode=.
+func tmpfsMountOptions(options []string) (mountOptions, string, error) {
+	o := parseMountOptions(options)
+	if o.flags&unix.MS_BIND != 0 {
+		return o, "", fmt.Errorf("tmpfs mounts cannot be bind mounts")
+	}
+	for _, opt := range o.data {
+		key, val, ok := strings.Cut(opt, "=")
+		switch {
+		case !ok:
+			return o, "", fmt.Errorf("unknown tmpfs option %q", opt)
+		case key == "size" || key == "nr_inodes":
+			if !validTmpfsSize(val) {
+				return o, "", fmt.Errorf("invalid tmpfs %s %q", key, val)
+			}
+		case key == "mode":
+			if m, err := strconv.ParseUint(val, 8, 32); err != nil || m > 0o7777 {
+				return o, "", fmt.Errorf("invalid tmpfs mode %q: expected octal permissions", val)
+			}
+		case key == "uid" || key == "gid":
+			if _, err := strconv.ParseUint(val, 10, 32); err != nil {
+				return o, "", fmt.Errorf("invalid tmpfs %s %q", key, val)
+			}
+		default:
+			return o, "", fmt.Errorf("unknown tmpfs option %q", opt)
+		}
+	}
+	return o, strings.Join(o.data, ","), nil
+}
+
+// validTmpfsSize accepts a number with an optional k, m, g or % suffix.
+func validTmpfsSize(s string) bool {
+	if s == "" {
+		return false
+	}
+	if last := s[len(s)-1]; strings.IndexByte("kKmMgG%", last) >= 0 {
+		s = s[:len(s)-1]
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// mountTmpfs mounts a tmpfs at root+m.Destination, creating the directory.
+func mountTmpfs(root string, m specs.Mount) error {
+	o, data, err := tmpfsMountOptions(m.Options)
+	if err != nil {
+		return err
+	}
+	return mountInRoot(root, mountTarget{path: m.Destination, dir: true}, func(dst string) error {
+		if err := unix.Mount("tmpfs", dst, "tmpfs", o.flags, data); err != nil {
+			return fmt.Errorf("failed to mount tmpfs on %s: %w", m.Destination, err)
+		}
+		return nil
+	}, func(dst string) error {
+		return applyPropagation(dst, o.propagation)
+	})
+}
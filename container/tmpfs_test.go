@@ -0,0 +1,66 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseTmpfs(t *testing.T) {
+	m, err := ParseTmpfs("/tmp:size=64m,mode=1777")
+	if err != nil {
+		t.Fatalf("ParseTmpfs failed: %v", err)
+	}
+	want := specs.Mount{
+		Destination: "/tmp",
+		Type:        "tmpfs",
+		Source:      "tmpfs",
+		Options:     []string{"nosuid", "nodev", "size=64m", "mode=1777"},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("ParseTmpfs = %+v, want %+v", m, want)
+	}
+
+	if m, err := ParseTmpfs("/run"); err != nil || len(m.Options) != 2 {
+		t.Fatalf("ParseTmpfs without options = %+v, %v", m, err)
+	}
+
+	for _, bad := range []string{"tmp", "/", "/tmp:size=big", "/tmp:mode=999", "/tmp:bogus", "/tmp:color=red"} {
+		if _, err := ParseTmpfs(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestTmpfsMountOptions(t *testing.T) {
+	o, data, err := tmpfsMountOptions([]string{"nosuid", "nodev", "noexec", "exec", "ro", "size=50%", "nr_inodes=10k", "uid=1000", "mode=755"})
+	if err != nil {
+		t.Fatalf("tmpfsMountOptions failed: %v", err)
+	}
+	if o.flags != unix.MS_NOSUID|unix.MS_NODEV|unix.MS_RDONLY {
+		t.Fatalf("unexpected flags %#x", o.flags)
+	}
+	if data != "size=50%,nr_inodes=10k,uid=1000,mode=755" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+func TestValidateSpecMounts(t *testing.T) {
+	mounts := []specs.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"nosuid", "hidepid=2"}},
+		{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+	}
+	if err := validateSpecMounts(mounts); err != nil {
+		t.Fatalf("valid mounts rejected: %v", err)
+	}
+	bad := append(mounts, specs.Mount{Destination: "/proc", Type: "proc", Source: "proc", Options: []string{"whatever"}})
+	if err := validateSpecMounts(bad); err == nil {
+		t.Fatalf("expected error for an unsupported proc option")
+	}
+	mounts = append(mounts, specs.Mount{Destination: "/tmp", Type: "tmpfs", Options: []string{"size=-1"}})
+	if err := validateSpecMounts(mounts); err == nil {
+		t.Fatalf("expected error for an invalid tmpfs size")
+	}
+}
@@ -0,0 +1,411 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// With --trace the container init is traced with ptrace from the moment it
+// is released, and so are all the processes it forks. A tracer process
+// started by the runtime attaches to the child stage while it waits for the
+// go byte and outlives the runtime for detached containers. It writes
+// trace.log in the state dir, either one line per system call or a table of
+// call counts written when the container exits.
+
+// traceStage is the init stage tracing a container.
+const traceStage = "TRACER"
+
+// traceFileName is the trace output in the container state dir.
+const traceFileName = "trace.log"
+
+// Trace modes.
+const (
+	// TraceLog logs every system call with its arguments and result.
+	TraceLog = "log"
+	// TraceSummary counts calls and errors per system call.
+	TraceSummary = "summary"
+)
+
+// traceStringMax bounds the length of path arguments read from tracees.
+const traceStringMax = 256
+
+// tracePathArgs lists the arguments of system calls that are paths, which
+// are printed as strings.
+var tracePathArgs = map[string][]int{
+	"access": {0}, "faccessat": {1}, "faccessat2": {1},
+	"open": {0}, "openat": {1}, "openat2": {1}, "creat": {0},
+	"stat": {0}, "lstat": {0}, "newfstatat": {1}, "statx": {1},
+	"execve": {0}, "execveat": {1},
+	"readlink": {0}, "readlinkat": {1},
+	"chdir": {0}, "chroot": {0}, "pivot_root": {0, 1},
+	"mkdir": {0}, "mkdirat": {1}, "rmdir": {0},
+	"unlink": {0}, "unlinkat": {1},
+	"rename": {0, 1}, "renameat": {1, 3}, "renameat2": {1, 3},
+	"link": {0, 1}, "linkat": {1, 3}, "symlink": {0, 1}, "symlinkat": {0, 2},
+	"chmod": {0}, "fchmodat": {1}, "chown": {0}, "lchown": {0}, "fchownat": {1},
+	"truncate": {0}, "utimensat": {1},
+	"mount": {0, 1, 2}, "umount2": {0},
+}
+
+func validateTraceMode(mode string) error {
+	switch mode {
+	case "", TraceLog, TraceSummary:
+		return nil
+	}
+	return fmt.Errorf("invalid trace mode %q: expected %s or %s", mode, TraceLog, TraceSummary)
+}
+
+// startTracer starts a tracer for pid writing to path and waits until it is
+// attached.
+func startTracer(pid int, path, mode string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command("/proc/self/exe", "init", traceStage, strconv.Itoa(pid), path, mode)
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to start tracer: %w", err)
+	}
+	w.Close()
+	defer cmd.Process.Release()
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("tracer exited: %w", err)
+	}
+	if msg, ok := strings.CutPrefix(strings.TrimSpace(line), "error:"); ok {
+		return fmt.Errorf("failed to trace container: %s", msg)
+	}
+	return nil
+}
+
+// runTracer traces pid and the processes it forks until they have all
+// exited, reporting on fd 3 once it is attached.
+func runTracer(pid int, path, mode string) error {
+	report := os.NewFile(3, "trace-report")
+	defer report.Close()
+	fail := func(err error) error {
+		fmt.Fprintf(report, "error:%v\n", err)
+		return err
+	}
+
+	// ptrace requests must come from the thread that attached.
+	runtime.LockOSThread()
+	f, err := os.Create(path)
+	if err != nil {
+		return fail(err)
+	}
+	defer f.Close()
+	out := bufio.NewWriter(f)
+	defer out.Flush()
+
+	if err := attachTracee(pid); err != nil {
+		return fail(err)
+	}
+	fmt.Fprintln(report, "ok")
+	report.Close()
+
+	t := newTracer(out, mode)
+	err = t.run()
+	if mode == TraceSummary {
+		t.writeSummary()
+	}
+	return err
+}
+
+// attachTracee seizes every thread of pid and resumes them with system
+// call tracing.
+func attachTracee(pid int) error {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return fmt.Errorf("failed to list threads of %d: %w", pid, err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if err := attachThread(tid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func attachThread(tid int) error {
+	if err := unix.PtraceSeize(tid); err != nil {
+		return fmt.Errorf("failed to attach to %d: %w", tid, err)
+	}
+	// Options can only be set in a ptrace-stop.
+	if err := unix.PtraceInterrupt(tid); err != nil {
+		return fmt.Errorf("failed to interrupt %d: %w", tid, err)
+	}
+	var ws unix.WaitStatus
+	if _, err := unix.Wait4(tid, &ws, unix.WALL, nil); err != nil {
+		return fmt.Errorf("failed waiting for %d: %w", tid, err)
+	}
+	opts := unix.PTRACE_O_TRACESYSGOOD | unix.PTRACE_O_TRACEFORK | unix.PTRACE_O_TRACEVFORK |
+		unix.PTRACE_O_TRACECLONE | unix.PTRACE_O_TRACEEXEC
+	if err := unix.PtraceSetOptions(tid, opts); err != nil {
+		return fmt.Errorf("failed to set trace options: %w", err)
+	}
+	return unix.PtraceSyscall(tid, 0)
+}
+
+// ptraceSyscallInfo is struct ptrace_syscall_info. At a system call exit Nr
+// holds the return value and the low byte of Args[0] whether it is an
+// error.
+type ptraceSyscallInfo struct {
+	Op      uint8
+	_       [3]uint8
+	Arch    uint32
+	IP      uint64
+	SP      uint64
+	Nr      uint64
+	Args    [6]uint64
+	RetData uint32
+	_       uint32
+}
+
+func getSyscallInfo(tid int) (*ptraceSyscallInfo, error) {
+	var info ptraceSyscallInfo
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_GET_SYSCALL_INFO, uintptr(tid),
+		unsafe.Sizeof(info), uintptr(unsafe.Pointer(&info)), 0, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	return &info, nil
+}
+
+// pendingSyscall is a system call a tracee entered.
+type pendingSyscall struct {
+	name string
+	args string
+}
+
+// syscallCount is a line of the summary.
+type syscallCount struct {
+	name          string
+	calls, errors int
+}
+
+type tracer struct {
+	out     io.Writer
+	log     bool
+	pending map[int]*pendingSyscall
+	counts  map[string]*syscallCount
+}
+
+func newTracer(out io.Writer, mode string) *tracer {
+	return &tracer{
+		out:     out,
+		log:     mode != TraceSummary,
+		pending: make(map[int]*pendingSyscall),
+		counts:  make(map[string]*syscallCount),
+	}
+}
+
+// run handles the stops of the tracees until none are left.
+func (t *tracer) run() error {
+	for {
+		var ws unix.WaitStatus
+		tid, err := unix.Wait4(-1, &ws, unix.WALL, nil)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if errors.Is(err, unix.ECHILD) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case ws.Exited() || ws.Signaled():
+			if p := t.pending[tid]; p != nil && t.log {
+				t.logf(tid, "%s(%s) = ?", p.name, p.args)
+			}
+			delete(t.pending, tid)
+			if t.log {
+				if ws.Exited() {
+					t.logf(tid, "+++ exited with %d +++", ws.ExitStatus())
+				} else {
+					t.logf(tid, "+++ killed by %s +++", unix.SignalName(ws.Signal()))
+				}
+			}
+			continue
+		case !ws.Stopped():
+			continue
+		}
+
+		sig := ws.StopSignal()
+		event := int(uint32(ws)>>16) & 0xff
+		inject := 0
+		switch {
+		case sig == unix.SIGTRAP|0x80:
+			t.syscallStop(tid)
+		case event == unix.PTRACE_EVENT_STOP:
+			if sig == unix.SIGSTOP || sig == unix.SIGTSTP || sig == unix.SIGTTIN || sig == unix.SIGTTOU {
+				// A group-stop: stay stopped without resuming.
+				_ = ptraceListen(tid)
+				continue
+			}
+		case event != 0:
+			// fork, clone and exec events; new tasks are traced
+			// automatically.
+		default:
+			// A signal is being delivered; pass it on.
+			if t.log {
+				t.logf(tid, "--- %s ---", unix.SignalName(sig))
+			}
+			inject = int(sig)
+		}
+		// The tracee may have been killed in the meantime.
+		_ = unix.PtraceSyscall(tid, inject)
+	}
+}
+
+func ptraceListen(tid int) error {
+	_, _, errno := unix.Syscall6(unix.SYS_PTRACE, unix.PTRACE_LISTEN, uintptr(tid), 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (t *tracer) syscallStop(tid int) {
+	info, err := getSyscallInfo(tid)
+	if err != nil {
+		return
+	}
+	switch info.Op {
+	case unix.PTRACE_SYSCALL_INFO_ENTRY:
+		name := syscallName(info.Arch, info.Nr)
+		t.pending[tid] = &pendingSyscall{name: name, args: t.formatArgs(tid, name, info.Args)}
+		c := t.counts[name]
+		if c == nil {
+			c = &syscallCount{name: name}
+			t.counts[name] = c
+		}
+		c.calls++
+	case unix.PTRACE_SYSCALL_INFO_EXIT:
+		p := t.pending[tid]
+		if p == nil {
+			// We attached in the middle of this call.
+			return
+		}
+		delete(t.pending, tid)
+		rval, isError := int64(info.Nr), info.Args[0]&0xff != 0
+		if isError {
+			t.counts[p.name].errors++
+		}
+		if t.log {
+			t.logf(tid, "%s(%s) = %s", p.name, p.args, formatReturn(rval, isError))
+		}
+	}
+}
+
+// syscallName returns the name of the system call nr of the audit
+// architecture arch. Those of another architecture than the native one,
+// as made by a 32-bit program, are only numbered.
+func syscallName(arch uint32, nr uint64) string {
+	if name, ok := syscallNames[nr]; ok && arch == nativeAuditArch {
+		return name
+	}
+	return fmt.Sprintf("syscall_%d", nr)
+}
+
+// formatArgs prints the arguments of a system call, reading path arguments
+// from the tracee. Only the summary needs no arguments.
+func (t *tracer) formatArgs(tid int, name string, args [6]uint64) string {
+	if !t.log {
+		return ""
+	}
+	strs := make([]string, len(args))
+	for i, a := range args {
+		strs[i] = "0x" + strconv.FormatUint(a, 16)
+	}
+	for _, i := range tracePathArgs[name] {
+		if s, ok := readTraceeString(tid, uintptr(args[i])); ok {
+			strs[i] = strconv.Quote(s)
+		}
+	}
+	return strings.Join(strs, ", ")
+}
+
+// readTraceeString reads a NUL terminated string at addr in the memory of
+// tid, truncated to traceStringMax bytes.
+func readTraceeString(tid int, addr uintptr) (string, bool) {
+	if addr == 0 {
+		return "", false
+	}
+	buf := make([]byte, traceStringMax)
+	n, _ := unix.PtracePeekData(tid, addr, buf)
+	if n == 0 {
+		return "", false
+	}
+	buf = buf[:n]
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		return string(buf[:i]), true
+	}
+	return string(buf) + "...", true
+}
+
+func formatReturn(rval int64, isError bool) string {
+	if !isError {
+		return strconv.FormatInt(rval, 10)
+	}
+	errno := unix.Errno(-rval)
+	name := unix.ErrnoName(errno)
+	if name == "" {
+		name = "E" + strconv.FormatInt(-rval, 10)
+	}
+	return fmt.Sprintf("-1 %s (%s)", name, errno.Error())
+}
+
+func (t *tracer) logf(tid int, format string, args ...any) {
+	fmt.Fprintf(t.out, "%s [%d] %s\n", time.Now().Format("15:04:05.000000"), tid, fmt.Sprintf(format, args...))
+}
+
+// writeSummary writes the call counts, most called first.
+func (t *tracer) writeSummary() {
+	counts := make([]*syscallCount, 0, len(t.counts))
+	var calls, errs int
+	for _, c := range t.counts {
+		counts = append(counts, c)
+		calls += c.calls
+		errs += c.errors
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].calls != counts[j].calls {
+			return counts[i].calls > counts[j].calls
+		}
+		return counts[i].name < counts[j].name
+	})
+	fmt.Fprintf(t.out, "%8s %8s %s\n", "calls", "errors", "syscall")
+	fmt.Fprintf(t.out, "%8s %8s %s\n", "--------", "--------", "----------------")
+	for _, c := range counts {
+		fmt.Fprintf(t.out, "%8d %8d %s\n", c.calls, c.errors, c.name)
+	}
+	fmt.Fprintf(t.out, "%8s %8s %s\n", "--------", "--------", "----------------")
+	fmt.Fprintf(t.out, "%8d %8d %s\n", calls, errs, "total")
+}
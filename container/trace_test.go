@@ -0,0 +1,66 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestValidateTraceMode(t *testing.T) {
+	for _, mode := range []string{"", TraceLog, TraceSummary} {
+		if err := validateTraceMode(mode); err != nil {
+			t.Errorf("mode %q: unexpected error %v", mode, err)
+		}
+	}
+	if err := validateTraceMode("verbose"); err == nil {
+		t.Fatal("expected an unknown mode to be rejected")
+	}
+}
+
+func TestFormatReturn(t *testing.T) {
+	if got := formatReturn(3, false); got != "3" {
+		t.Errorf("got %q, want 3", got)
+	}
+	if got, want := formatReturn(-int64(unix.ENOENT), true), "-1 ENOENT (no such file or directory)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyscallName(t *testing.T) {
+	if got := syscallName(nativeAuditArch, 1<<20); got != "syscall_1048576" {
+		t.Errorf("unknown syscall printed as %q", got)
+	}
+	if len(syscallNames) > 0 {
+		if got := syscallName(nativeAuditArch, unix.SYS_OPENAT); got != "openat" {
+			t.Errorf("got %q, want openat", got)
+		}
+		if got := syscallName(unix.AUDIT_ARCH_I386, unix.SYS_OPENAT); got != fmt.Sprintf("syscall_%d", unix.SYS_OPENAT) {
+			t.Errorf("syscall of another architecture printed as %q", got)
+		}
+	}
+}
+
+func TestTraceSummary(t *testing.T) {
+	var buf bytes.Buffer
+	tr := newTracer(&buf, TraceSummary)
+	tr.counts["read"] = &syscallCount{name: "read", calls: 2}
+	tr.counts["openat"] = &syscallCount{name: "openat", calls: 5, errors: 1}
+	tr.counts["close"] = &syscallCount{name: "close", calls: 2}
+	tr.writeSummary()
+
+	var names []string
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, l := range lines[2 : len(lines)-2] {
+		f := strings.Fields(l)
+		names = append(names, f[2])
+	}
+	if got := strings.Join(names, ","); got != "openat,close,read" {
+		t.Errorf("summary order %s, want openat,close,read", got)
+	}
+	if f := strings.Fields(lines[len(lines)-1]); f[0] != "9" || f[1] != "1" || f[2] != "total" {
+		t.Errorf("unexpected total line %q", lines[len(lines)-1])
+	}
+}
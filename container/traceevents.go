@@ -0,0 +1,620 @@
+package container
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TraceEvents follows a running container with eBPF rather than ptrace, so
+// its processes run at full speed and needn't have been started traced.
+// Programs attached to the exec, open and connect tracepoints check that
+// the current task is under the cgroup of the container and send the
+// event through a ring buffer map read here. The programs are assembled
+// at load time with the offsets of the tracepoint fields read from their
+// format in tracefs, so like CO-RE programs they load on any kernel with
+// those tracepoints and BPF ring buffers (5.8), without being compiled
+// against its headers.
+
+// Types of a TraceEvent.
+const (
+	TraceExec    = "exec"
+	TraceOpen    = "open"
+	TraceConnect = "connect"
+)
+
+// TraceEvent is an event of a process of a traced container.
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Pid is the pid of the process on the host.
+	Pid  int    `json:"pid"`
+	Comm string `json:"comm"`
+	// Path is the program executed or the file opened.
+	Path string `json:"path,omitempty"`
+	// Flags are the flags of an open, such as "read" or "write,create".
+	Flags string `json:"flags,omitempty"`
+	// Address is the address connected to, host:port or the path of a
+	// unix socket, @ prefixed in the abstract namespace.
+	Address string `json:"address,omitempty"`
+}
+
+// Event kinds, as the programs write them.
+const (
+	traceKindExec = iota + 1
+	traceKindOpen
+	traceKindConnect
+)
+
+// Layout of the events written by the programs: the kind, the tgid, the
+// comm, a kind specific argument and the path or socket address.
+const (
+	traceEventKindOff = 0
+	traceEventPidOff  = 4
+	traceEventCommOff = 8
+	traceEventArgOff  = 24
+	traceEventDataOff = 32
+	traceDataMax      = 256
+	traceEventSize    = traceEventDataOff + traceDataMax
+)
+
+// traceRingSize is the size of the ring buffer, a power of two multiple of
+// the page size.
+const traceRingSize = 256 * 1024
+
+// traceLicense is that of the programs. The helpers reading process memory
+// are only available to GPL compatible programs.
+const traceLicense = "Dual BSD/GPL"
+
+// tracePollInterval is how often TraceEvents checks for its context being
+// done while no event comes.
+const tracePollInterval = 200 * time.Millisecond
+
+// tracefsDirs are where tracefs is looked for. It is mounted on the first
+// when it is on neither.
+var tracefsDirs = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// tracepoint is a tracepoint the tracer attaches to, and the fields its
+// program reads. Optional ones are skipped on kernels without them, such as
+// sys_enter_open on arm64.
+type tracepoint struct {
+	kind     int32
+	category string
+	name     string
+	fields   []string
+	optional bool
+}
+
+var traceTracepoints = []tracepoint{
+	{kind: traceKindExec, category: "sched", name: "sched_process_exec", fields: []string{"filename"}},
+	{kind: traceKindOpen, category: "syscalls", name: "sys_enter_openat", fields: []string{"filename", "flags"}},
+	{kind: traceKindOpen, category: "syscalls", name: "sys_enter_open", fields: []string{"filename", "flags"}, optional: true},
+	{kind: traceKindConnect, category: "syscalls", name: "sys_enter_connect", fields: []string{"uservaddr", "addrlen"}},
+}
+
+// tracepointField is a field of a tracepoint record.
+type tracepointField struct {
+	offset int16
+	size   int
+}
+
+// eBPF opcodes used by the trace programs, on top of those of the device
+// filter.
+const (
+	bpfLdxMemDW = unix.BPF_LDX | unix.BPF_MEM | unix.BPF_DW
+	bpfStMemW   = unix.BPF_ST | unix.BPF_MEM | unix.BPF_W
+	bpfStMemDW  = unix.BPF_ST | unix.BPF_MEM | unix.BPF_DW
+	bpfStxMemW  = unix.BPF_STX | unix.BPF_MEM | unix.BPF_W
+	bpfStxMemDW = unix.BPF_STX | unix.BPF_MEM | unix.BPF_DW
+	bpfMov64K   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_K
+	bpfMov64X   = unix.BPF_ALU64 | unix.BPF_MOV | unix.BPF_X
+	bpfAdd64K   = unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_K
+	bpfAdd64X   = unix.BPF_ALU64 | unix.BPF_ADD | unix.BPF_X
+	bpfRsh64K   = unix.BPF_ALU64 | unix.BPF_RSH | unix.BPF_K
+	bpfJleK     = unix.BPF_JMP | unix.BPF_JLE | unix.BPF_K
+	bpfCall     = unix.BPF_JMP | unix.BPF_CALL
+	bpfLdImm64  = unix.BPF_LD | unix.BPF_DW | unix.BPF_IMM
+	bpfJumpExit = -1 // placeholder patched to the exit of the program
+)
+
+// BPF helpers called by the trace programs.
+const (
+	bpfGetCurrentPidTgid      = 14
+	bpfGetCurrentComm         = 16
+	bpfCurrentTaskUnderCgroup = 37
+	bpfProbeReadUser          = 112
+	bpfProbeReadUserStr       = 114
+	bpfProbeReadKernelStr     = 115
+	bpfRingbufOutput          = 130
+)
+
+// bpfRegFP is the read-only frame pointer register.
+const bpfRegFP = 10
+
+// bpfLoadMap loads the fd of a map into dst, which takes two instructions.
+func bpfLoadMap(dst uint8, fd int) []bpfInsn {
+	return []bpfInsn{insn(bpfLdImm64, dst, unix.BPF_PSEUDO_MAP_FD, 0, int32(fd)), {}}
+}
+
+// bpfLdx loads the field of the tracepoint record in r6 into dst.
+func bpfLdx(dst uint8, f tracepointField) bpfInsn {
+	if f.size == 4 {
+		return insn(bpfLdxMemW, dst, 6, f.offset, 0)
+	}
+	return insn(bpfLdxMemDW, dst, 6, f.offset, 0)
+}
+
+// compileTraceProgram assembles the program of a tracepoint of kind, which
+// reads fields from its record.
+func compileTraceProgram(kind int32, fields map[string]tracepointField, cgroupMap, ringMap int) []bpfInsn {
+	// r6 = record, r7 = event on the stack
+	prog := []bpfInsn{insn(bpfMov64X, 6, 1, 0, 0)}
+	prog = append(prog, bpfLoadMap(1, cgroupMap)...)
+	prog = append(prog,
+		insn(bpfMov64K, 2, 0, 0, 0),
+		insn(bpfCall, 0, 0, 0, bpfCurrentTaskUnderCgroup),
+		insn(bpfJneK, 0, 0, bpfJumpExit, 1),
+		insn(bpfMov64X, 7, bpfRegFP, 0, 0),
+		insn(bpfAdd64K, 7, 0, 0, -traceEventSize),
+	)
+	for off := 0; off < traceEventSize; off += 8 {
+		prog = append(prog, insn(bpfStMemDW, 7, 0, int16(off), 0))
+	}
+	prog = append(prog,
+		insn(bpfStMemW, 7, 0, traceEventKindOff, kind),
+		insn(bpfCall, 0, 0, 0, bpfGetCurrentPidTgid),
+		insn(bpfRsh64K, 0, 0, 0, 32),
+		insn(bpfStxMemW, 7, 0, traceEventPidOff, 0),
+		insn(bpfMov64X, 1, 7, 0, 0),
+		insn(bpfAdd64K, 1, 0, 0, traceEventCommOff),
+		insn(bpfMov64K, 2, 0, 0, 16),
+		insn(bpfCall, 0, 0, 0, bpfGetCurrentComm),
+	)
+
+	switch kind {
+	case traceKindExec:
+		// The filename is a __data_loc, its offset in the record in the
+		// low 16 bits.
+		prog = append(prog,
+			bpfLdx(4, fields["filename"]),
+			insn(bpfAndK, 4, 0, 0, 0xffff),
+			insn(bpfMov64X, 3, 6, 0, 0),
+			insn(bpfAdd64X, 3, 4, 0, 0),
+			insn(bpfMov64X, 1, 7, 0, 0),
+			insn(bpfAdd64K, 1, 0, 0, traceEventDataOff),
+			insn(bpfMov64K, 2, 0, 0, traceDataMax),
+			insn(bpfCall, 0, 0, 0, bpfProbeReadKernelStr),
+		)
+	case traceKindOpen:
+		prog = append(prog,
+			bpfLdx(1, fields["flags"]),
+			insn(bpfStxMemDW, 7, 1, traceEventArgOff, 0),
+			bpfLdx(3, fields["filename"]),
+			insn(bpfMov64X, 1, 7, 0, 0),
+			insn(bpfAdd64K, 1, 0, 0, traceEventDataOff),
+			insn(bpfMov64K, 2, 0, 0, traceDataMax),
+			insn(bpfCall, 0, 0, 0, bpfProbeReadUserStr),
+		)
+	case traceKindConnect:
+		// r8 = addrlen, bounded for the verifier
+		prog = append(prog,
+			bpfLdx(8, fields["addrlen"]),
+			insn(bpfJleK, 8, 0, 1, traceDataMax),
+			insn(bpfMov64K, 8, 0, 0, traceDataMax),
+			insn(bpfStxMemDW, 7, 8, traceEventArgOff, 0),
+			bpfLdx(3, fields["uservaddr"]),
+			insn(bpfMov64X, 1, 7, 0, 0),
+			insn(bpfAdd64K, 1, 0, 0, traceEventDataOff),
+			insn(bpfMov64X, 2, 8, 0, 0),
+			insn(bpfCall, 0, 0, 0, bpfProbeReadUser),
+		)
+	}
+
+	prog = append(prog, bpfLoadMap(1, ringMap)...)
+	prog = append(prog,
+		insn(bpfMov64X, 2, 7, 0, 0),
+		insn(bpfMov64K, 3, 0, 0, traceEventSize),
+		insn(bpfMov64K, 4, 0, 0, 0),
+		insn(bpfCall, 0, 0, 0, bpfRingbufOutput),
+	)
+	exit := len(prog)
+	for i := range prog {
+		if prog[i].code&0x07 == unix.BPF_JMP && prog[i].code != bpfCall && prog[i].off == bpfJumpExit {
+			prog[i].off = int16(exit - i - 1)
+		}
+	}
+	return append(prog,
+		insn(bpfMov64K, 0, 0, 0, 0),
+		insn(bpfExit, 0, 0, 0, 0),
+	)
+}
+
+// readTracepointFormat returns the fields of the tracepoint record
+// described by the format file at path, by name.
+func readTracepointFormat(path string) (map[string]tracepointField, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]tracepointField)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// field:const char * filename;	offset:24;	size:8;	signed:0;
+		parts := strings.Split(strings.TrimSpace(scanner.Text()), ";")
+		decl, ok := strings.CutPrefix(parts[0], "field:")
+		if !ok || len(parts) < 3 {
+			continue
+		}
+		words := strings.Fields(decl)
+		name, _, _ := strings.Cut(words[len(words)-1], "[")
+		offset, err1 := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[1]), "offset:"))
+		size, err2 := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(parts[2]), "size:"))
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid field %q in %s", decl, path)
+		}
+		fields[name] = tracepointField{offset: int16(offset), size: size}
+	}
+	return fields, scanner.Err()
+}
+
+// tracefs returns where tracefs is mounted, mounting it if it isn't.
+func tracefs() (string, error) {
+	for _, dir := range tracefsDirs {
+		if _, err := os.Stat(filepath.Join(dir, "events")); err == nil {
+			return dir, nil
+		}
+	}
+	if err := unix.Mount("tracefs", tracefsDirs[0], "tracefs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return "", fmt.Errorf("failed to mount tracefs on %s: %w", tracefsDirs[0], err)
+	}
+	return tracefsDirs[0], nil
+}
+
+// bpfMapCreateAttr is the BPF_MAP_CREATE member of union bpf_attr.
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+// bpfMapElemAttr is the BPF_MAP_*_ELEM member of union bpf_attr.
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+func createBPFMap(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := bpfMapCreateAttr{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries}
+	fd, err := bpf(unix.BPF_MAP_CREATE, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// newCgroupMap returns a cgroup array map holding the cgroup at path.
+func newCgroupMap(path string) (int, error) {
+	fd, err := createBPFMap(unix.BPF_MAP_TYPE_CGROUP_ARRAY, 4, 4, 1)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create cgroup map: %w", err)
+	}
+	cgroup, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to open cgroup %s: %w", path, err)
+	}
+	defer unix.Close(cgroup)
+
+	key, value := uint32(0), uint32(cgroup)
+	attr := bpfMapElemAttr{
+		mapFd: uint32(fd),
+		key:   uint64(uintptr(unsafe.Pointer(&key))),
+		value: uint64(uintptr(unsafe.Pointer(&value))),
+	}
+	_, err = bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&key)
+	runtime.KeepAlive(&value)
+	if err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to add cgroup %s to the map: %w", path, err)
+	}
+	return fd, nil
+}
+
+// Bits of the length in the header of a ring buffer record.
+const (
+	ringbufBusyBit    = 1 << 31
+	ringbufDiscardBit = 1 << 30
+	ringbufHeaderSize = 8
+)
+
+// ringBuffer is the consumer side of a BPF ring buffer map.
+type ringBuffer struct {
+	// consumer is the page of the consumer position, data the page of the
+	// producer position followed by the data, mapped twice so records
+	// wrapping around are contiguous.
+	consumer []byte
+	data     []byte
+	mask     uint64
+}
+
+func openRingBuffer(fd, size int) (*ringBuffer, error) {
+	page := os.Getpagesize()
+	consumer, err := unix.Mmap(fd, 0, page, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map ring buffer: %w", err)
+	}
+	data, err := unix.Mmap(fd, int64(page), page+2*size, unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		unix.Munmap(consumer)
+		return nil, fmt.Errorf("failed to map ring buffer: %w", err)
+	}
+	return &ringBuffer{consumer: consumer, data: data, mask: uint64(size - 1)}, nil
+}
+
+func (r *ringBuffer) close() {
+	unix.Munmap(r.consumer)
+	unix.Munmap(r.data)
+}
+
+// read passes the records committed since the last read to fn.
+func (r *ringBuffer) read(fn func([]byte)) {
+	page := uint64(os.Getpagesize())
+	consumerPos := (*uint64)(unsafe.Pointer(&r.consumer[0]))
+	producerPos := (*uint64)(unsafe.Pointer(&r.data[0]))
+	pos := atomic.LoadUint64(consumerPos)
+	for end := atomic.LoadUint64(producerPos); pos < end; {
+		off := page + pos&r.mask
+		header := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[off])))
+		if header&ringbufBusyBit != 0 {
+			break
+		}
+		n := uint64(header &^ (ringbufBusyBit | ringbufDiscardBit))
+		if header&ringbufDiscardBit == 0 {
+			fn(r.data[off+ringbufHeaderSize : off+ringbufHeaderSize+n])
+		}
+		pos += (n + ringbufHeaderSize + 7) &^ 7
+		atomic.StoreUint64(consumerPos, pos)
+	}
+}
+
+// eventTracer holds the maps, programs and perf events of a trace. Closing
+// the perf events detaches the programs.
+type eventTracer struct {
+	fds  []int
+	ring *ringBuffer
+}
+
+func (t *eventTracer) close() {
+	if t.ring != nil {
+		t.ring.close()
+	}
+	for _, fd := range t.fds {
+		unix.Close(fd)
+	}
+}
+
+// newEventTracer attaches the trace programs for the tasks under the
+// cgroup at path.
+func newEventTracer(path string) (_ *eventTracer, err error) {
+	dir, err := tracefs()
+	if err != nil {
+		return nil, err
+	}
+	t := &eventTracer{}
+	defer func() {
+		if err != nil {
+			t.close()
+		}
+	}()
+
+	cgroupMap, err := newCgroupMap(path)
+	if err != nil {
+		return nil, err
+	}
+	t.fds = append(t.fds, cgroupMap)
+	ringMap, err := createBPFMap(unix.BPF_MAP_TYPE_RINGBUF, 0, 0, traceRingSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ring buffer: %w", err)
+	}
+	t.fds = append(t.fds, ringMap)
+	if t.ring, err = openRingBuffer(ringMap, traceRingSize); err != nil {
+		return nil, err
+	}
+
+	for _, tp := range traceTracepoints {
+		eventDir := filepath.Join(dir, "events", tp.category, tp.name)
+		if _, err := os.Stat(eventDir); err != nil && tp.optional {
+			continue
+		}
+		fields, err := readTracepointFormat(filepath.Join(eventDir, "format"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tracepoint %s: %w", tp.name, err)
+		}
+		for _, name := range tp.fields {
+			if f, ok := fields[name]; !ok || (f.size != 4 && f.size != 8) {
+				return nil, fmt.Errorf("tracepoint %s has no field %s", tp.name, name)
+			}
+		}
+		data, err := os.ReadFile(filepath.Join(eventDir, "id"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tracepoint %s: %w", tp.name, err)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id of tracepoint %s: %w", tp.name, err)
+		}
+
+		prog, err := loadBPFProgram(unix.BPF_PROG_TYPE_TRACEPOINT, 0, "containish_tp", traceLicense,
+			compileTraceProgram(tp.kind, fields, cgroupMap, ringMap))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the program of %s: %w", tp.name, err)
+		}
+		t.fds = append(t.fds, prog)
+		// The program of a tracepoint runs on every CPU whichever the
+		// event is opened on.
+		attr := unix.PerfEventAttr{Type: unix.PERF_TYPE_TRACEPOINT, Size: uint32(unsafe.Sizeof(unix.PerfEventAttr{})), Config: id}
+		event, err := unix.PerfEventOpen(&attr, -1, 0, -1, unix.PERF_FLAG_FD_CLOEXEC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tracepoint %s: %w", tp.name, err)
+		}
+		t.fds = append(t.fds, event)
+		if err := unix.IoctlSetInt(event, unix.PERF_EVENT_IOC_SET_BPF, prog); err != nil {
+			return nil, fmt.Errorf("failed to attach to tracepoint %s: %w", tp.name, err)
+		}
+		if err := unix.IoctlSetInt(event, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			return nil, fmt.Errorf("failed to enable tracepoint %s: %w", tp.name, err)
+		}
+	}
+	return t, nil
+}
+
+// decodeTraceEvent decodes an event written by the programs.
+func decodeTraceEvent(b []byte) (TraceEvent, bool) {
+	if len(b) < traceEventSize {
+		return TraceEvent{}, false
+	}
+	e := TraceEvent{
+		Time: time.Now(),
+		Pid:  int(binary.NativeEndian.Uint32(b[traceEventPidOff:])),
+		Comm: cString(b[traceEventCommOff:traceEventArgOff]),
+	}
+	arg := binary.NativeEndian.Uint64(b[traceEventArgOff:])
+	data := b[traceEventDataOff:traceEventSize]
+	switch binary.NativeEndian.Uint32(b[traceEventKindOff:]) {
+	case traceKindExec:
+		e.Type, e.Path = TraceExec, cString(data)
+	case traceKindOpen:
+		e.Type, e.Path, e.Flags = TraceOpen, cString(data), openFlags(int(arg))
+	case traceKindConnect:
+		e.Type, e.Address = TraceConnect, sockaddrString(data[:min(arg, traceDataMax)])
+	default:
+		return TraceEvent{}, false
+	}
+	return e, true
+}
+
+// openFlags describes the flags of an open.
+func openFlags(flags int) string {
+	var s string
+	switch flags & unix.O_ACCMODE {
+	case unix.O_WRONLY:
+		s = "write"
+	case unix.O_RDWR:
+		s = "read-write"
+	default:
+		s = "read"
+	}
+	for _, f := range []struct {
+		flag int
+		name string
+	}{
+		{unix.O_CREAT, "create"}, {unix.O_TRUNC, "truncate"}, {unix.O_APPEND, "append"}, {unix.O_DIRECTORY, "directory"},
+	} {
+		if flags&f.flag != 0 {
+			s += "," + f.name
+		}
+	}
+	return s
+}
+
+// sockaddrString formats the struct sockaddr in b.
+func sockaddrString(b []byte) string {
+	if len(b) < 2 {
+		return ""
+	}
+	family := binary.NativeEndian.Uint16(b)
+	switch {
+	case family == unix.AF_INET && len(b) >= 8:
+		return net.JoinHostPort(net.IP(b[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(b[2:]))))
+	case family == unix.AF_INET6 && len(b) >= 24:
+		return net.JoinHostPort(net.IP(b[8:24]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(b[2:]))))
+	case family == unix.AF_UNIX:
+		if len(b) > 2 && b[2] == 0 {
+			return "@" + cString(b[3:])
+		}
+		return cString(b[2:])
+	case family == unix.AF_UNSPEC:
+		return "unspec"
+	}
+	return fmt.Sprintf("family %d", family)
+}
+
+// TraceEvents passes the execs, file opens and connections of the
+// processes of running container id to fn until the container stops or
+// ctx is done.
+func TraceEvents(ctx context.Context, id string, fn func(TraceEvent)) error {
+	c, err := LoadState(id)
+	if err != nil {
+		return err
+	}
+	if !c.Status.running() {
+		return fmt.Errorf("container %s is %w", id, ErrNotRunning)
+	}
+	if c.CgroupPath == "" {
+		return fmt.Errorf("container %s has no cgroup", id)
+	}
+	pidfd, err := openInit(c)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(pidfd)
+
+	t, err := newEventTracer(c.CgroupPath)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(epfd)
+	// The ring buffer map is the second fd of the tracer.
+	for _, fd := range []int{t.fds[1], pidfd} {
+		if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}); err != nil {
+			return err
+		}
+	}
+
+	emit := func(b []byte) {
+		if e, ok := decodeTraceEvent(b); ok {
+			fn(e)
+		}
+	}
+	events := make([]unix.EpollEvent, 2)
+	for ctx.Err() == nil {
+		n, err := unix.EpollWait(epfd, events, int(tracePollInterval/time.Millisecond))
+		if err != nil && !errors.Is(err, unix.EINTR) {
+			return err
+		}
+		t.ring.read(emit)
+		for _, ev := range events[:max(n, 0)] {
+			if int(ev.Fd) == pidfd {
+				return nil
+			}
+		}
+	}
+	return nil
+}
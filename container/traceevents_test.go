@@ -0,0 +1,178 @@
+package container
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadTracepointFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "format")
+	writeFile(t, path, `name: sys_enter_openat
+ID: 700
+format:
+	field:unsigned short common_type;	offset:0;	size:2;	signed:0;
+	field:int common_pid;	offset:4;	size:4;	signed:1;
+
+	field:int __syscall_nr;	offset:8;	size:4;	signed:1;
+	field:const char * filename;	offset:24;	size:8;	signed:0;
+	field:int flags;	offset:32;	size:8;	signed:0;
+	field:__data_loc char[] comm;	offset:40;	size:4;	signed:0;
+
+print fmt: "dfd: 0x%08lx, filename: 0x%08lx", ((unsigned long)(REC->dfd))
+`, 0o644)
+	fields, err := readTracepointFormat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]tracepointField{
+		"filename": {offset: 24, size: 8},
+		"flags":    {offset: 32, size: 8},
+		"comm":     {offset: 40, size: 4},
+	} {
+		if fields[name] != want {
+			t.Errorf("field %s = %+v, want %+v", name, fields[name], want)
+		}
+	}
+}
+
+func TestDecodeTraceEvent(t *testing.T) {
+	event := func(kind uint32, arg uint64, data []byte) []byte {
+		b := make([]byte, traceEventSize)
+		binary.NativeEndian.PutUint32(b[traceEventKindOff:], kind)
+		binary.NativeEndian.PutUint32(b[traceEventPidOff:], 42)
+		copy(b[traceEventCommOff:], "nginx")
+		binary.NativeEndian.PutUint64(b[traceEventArgOff:], arg)
+		copy(b[traceEventDataOff:], data)
+		return b
+	}
+
+	e, ok := decodeTraceEvent(event(traceKindOpen, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC, []byte("/var/log/nginx.log\x00")))
+	if !ok || e.Type != TraceOpen || e.Pid != 42 || e.Comm != "nginx" || e.Path != "/var/log/nginx.log" || e.Flags != "write,create,truncate" {
+		t.Errorf("open event = %+v, %v", e, ok)
+	}
+	if e, ok := decodeTraceEvent(event(traceKindExec, 0, []byte("/usr/sbin/nginx\x00"))); !ok || e.Type != TraceExec || e.Path != "/usr/sbin/nginx" {
+		t.Errorf("exec event = %+v, %v", e, ok)
+	}
+
+	sin := make([]byte, 16)
+	binary.NativeEndian.PutUint16(sin, unix.AF_INET)
+	binary.BigEndian.PutUint16(sin[2:], 5432)
+	copy(sin[4:], []byte{10, 89, 0, 3})
+	if e, ok := decodeTraceEvent(event(traceKindConnect, uint64(len(sin)), sin)); !ok || e.Type != TraceConnect || e.Address != "10.89.0.3:5432" {
+		t.Errorf("connect event = %+v, %v", e, ok)
+	}
+
+	if _, ok := decodeTraceEvent(event(99, 0, nil)); ok {
+		t.Error("decoded an event of an unknown kind")
+	}
+	if _, ok := decodeTraceEvent(make([]byte, traceEventDataOff)); ok {
+		t.Error("decoded a truncated event")
+	}
+}
+
+func TestSockaddrString(t *testing.T) {
+	sin6 := make([]byte, 28)
+	binary.NativeEndian.PutUint16(sin6, unix.AF_INET6)
+	binary.BigEndian.PutUint16(sin6[2:], 443)
+	sin6[23] = 1
+	unixAddr := func(path string) []byte {
+		b := binary.NativeEndian.AppendUint16(nil, unix.AF_UNIX)
+		return append(b, path...)
+	}
+	for _, tt := range []struct {
+		addr []byte
+		want string
+	}{
+		{sin6, "[::1]:443"},
+		{unixAddr("/run/postgresql/.s.PGSQL.5432\x00"), "/run/postgresql/.s.PGSQL.5432"},
+		{unixAddr("\x00dbus"), "@dbus"},
+		{binary.NativeEndian.AppendUint16(nil, unix.AF_UNSPEC), "unspec"},
+		{binary.NativeEndian.AppendUint16(nil, unix.AF_NETLINK), "family 16"},
+		{nil, ""},
+	} {
+		if got := sockaddrString(tt.addr); got != tt.want {
+			t.Errorf("sockaddrString(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestRingBufferRead(t *testing.T) {
+	page := unix.Getpagesize()
+	size := page
+	r := &ringBuffer{
+		consumer: make([]byte, page),
+		data:     make([]byte, page+2*size),
+		mask:     uint64(size - 1),
+	}
+	// Three records: a committed one, a discarded one and one still being
+	// written.
+	var pos uint64
+	record := func(header uint32, payload string) {
+		off := uint64(page) + pos
+		binary.NativeEndian.PutUint32(r.data[off:], header|uint32(len(payload)))
+		copy(r.data[off+ringbufHeaderSize:], payload)
+		pos += (uint64(len(payload)) + ringbufHeaderSize + 7) &^ 7
+	}
+	record(0, "first")
+	record(ringbufDiscardBit, "discarded")
+	busy := pos
+	record(ringbufBusyBit, "busy")
+	*(*uint64)(unsafe.Pointer(&r.data[0])) = pos
+
+	var got []string
+	r.read(func(b []byte) { got = append(got, string(b)) })
+	if len(got) != 1 || got[0] != "first" {
+		t.Errorf("read %q, want the committed record", got)
+	}
+	if consumed := *(*uint64)(unsafe.Pointer(&r.consumer[0])); consumed != busy {
+		t.Errorf("consumer position = %d, want %d, before the busy record", consumed, busy)
+	}
+}
+
+func TestCompileTraceProgram(t *testing.T) {
+	cgroupMap, err := createBPFMap(unix.BPF_MAP_TYPE_CGROUP_ARRAY, 4, 4, 1)
+	if err != nil {
+		t.Skipf("can't create BPF maps: %v", err)
+	}
+	defer unix.Close(cgroupMap)
+	ringMap, err := createBPFMap(unix.BPF_MAP_TYPE_RINGBUF, 0, 0, traceRingSize)
+	if err != nil {
+		t.Skipf("can't create BPF ring buffers: %v", err)
+	}
+	defer unix.Close(ringMap)
+
+	// The programs pass the verifier with the fields of any layout.
+	for kind, fields := range map[int32]map[string]tracepointField{
+		traceKindExec:    {"filename": {offset: 8, size: 4}},
+		traceKindOpen:    {"filename": {offset: 24, size: 8}, "flags": {offset: 32, size: 8}},
+		traceKindConnect: {"uservaddr": {offset: 24, size: 8}, "addrlen": {offset: 32, size: 8}},
+	} {
+		fd, err := loadBPFProgram(unix.BPF_PROG_TYPE_TRACEPOINT, 0, "containish_tp", traceLicense,
+			compileTraceProgram(kind, fields, cgroupMap, ringMap))
+		if err != nil {
+			t.Errorf("program of kind %d: %v", kind, err)
+			continue
+		}
+		unix.Close(fd)
+	}
+}
+
+func TestTraceEvents(t *testing.T) {
+	tempImages(t)
+	noop := func(TraceEvent) {}
+	if err := TraceEvents(context.Background(), "missing", noop); !errors.Is(err, ErrNotFound) {
+		t.Errorf("TraceEvents of a missing container = %v, want ErrNotFound", err)
+	}
+	if err := saveState(&Container{Id: "stopped", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := TraceEvents(context.Background(), "stopped", noop); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("TraceEvents of a stopped container = %v, want ErrNotRunning", err)
+	}
+}
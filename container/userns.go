@@ -0,0 +1,185 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// userNamespace reports whether the spec asks for a new user namespace.
+func userNamespace(spec *specs.Spec) bool {
+	if spec == nil || spec.Linux == nil {
+		return false
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == specs.UserNamespace {
+			return ns.Path == ""
+		}
+	}
+	return false
+}
+
+// validateUserNamespace checks the uid and gid mappings of a user namespaced
+// container.
+func validateUserNamespace(spec *specs.Spec) error {
+	if spec == nil || spec.Linux == nil {
+		return nil
+	}
+	for _, ns := range spec.Linux.Namespaces {
+		if ns.Type == specs.UserNamespace && ns.Path != "" {
+			return fmt.Errorf("joining an existing user namespace is not supported")
+		}
+	}
+	if !userNamespace(spec) {
+		return nil
+	}
+	for name, mappings := range map[string][]specs.LinuxIDMapping{
+		"uidMappings": spec.Linux.UIDMappings,
+		"gidMappings": spec.Linux.GIDMappings,
+	} {
+		if len(mappings) == 0 {
+			return fmt.Errorf("a user namespace requires linux.%s", name)
+		}
+		for _, m := range mappings {
+			if m.Size == 0 {
+				return fmt.Errorf("invalid linux.%s entry %+v: size must be positive", name, m)
+			}
+		}
+	}
+	return nil
+}
+
+// idMappings converts spec mappings to the form exec.Cmd writes to
+// /proc/<pid>/{uid,gid}_map.
+func idMappings(mappings []specs.LinuxIDMapping) []syscall.SysProcIDMap {
+	var out []syscall.SysProcIDMap
+	for _, m := range mappings {
+		out = append(out, syscall.SysProcIDMap{
+			ContainerID: int(m.ContainerID),
+			HostID:      int(m.HostID),
+			Size:        int(m.Size),
+		})
+	}
+	return out
+}
+
+// idmapSource is a host path to idmap and whether its submounts come along.
+type idmapSource struct {
+	Path      string
+	Recursive bool
+}
+
+// idmapSources lists the host paths the parent stage idmaps for a user
+// namespaced container: the rootfs, then the spec bind mounts and volumes in
+// the order the child stage mounts them.
+func idmapSources(opts *stageOptions) []idmapSource {
+	sources := []idmapSource{{opts.Rootfs, true}}
+	if opts.Spec != nil {
+		for _, m := range opts.Spec.Mounts {
+			if isBindMount(m) {
+				rec := parseMountOptions(m.Options).flags&unix.MS_REC != 0
+				sources = append(sources, idmapSource{m.Source, rec})
+			}
+		}
+	}
+	for _, m := range opts.Mounts {
+		sources = append(sources, idmapSource{m.Source, true})
+	}
+	return sources
+}
+
+// idmapTree returns a detached copy of the mount at src.Path with ownership
+// mapped through the user namespace usernsFd. It needs privileges in the
+// initial user namespace, so it runs in the parent stage.
+func idmapTree(src idmapSource, usernsFd int) (int, error) {
+	var rec uint
+	if src.Recursive {
+		rec = unix.AT_RECURSIVE
+	}
+	fd, err := unix.OpenTree(unix.AT_FDCWD, src.Path, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|rec)
+	if err != nil {
+		return -1, fmt.Errorf("failed to clone mount tree %s: %w", src.Path, err)
+	}
+	attr := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(usernsFd),
+	}
+	if err := unix.MountSetattr(fd, "", unix.AT_EMPTY_PATH|rec, &attr); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("failed to idmap %s (the filesystem may not support idmapped mounts): %w", src.Path, err)
+	}
+	return fd, nil
+}
+
+// sendIdmappedMounts idmaps sources for the user namespace of pid and passes
+// the mount fds to the child stage over conn.
+func sendIdmappedMounts(conn *os.File, pid int, sources []idmapSource) error {
+	userns, err := os.Open(fmt.Sprintf("/proc/%d/ns/user", pid))
+	if err != nil {
+		return fmt.Errorf("failed to open user namespace: %w", err)
+	}
+	defer userns.Close()
+
+	var fds []int
+	defer func() {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+	}()
+	for _, src := range sources {
+		fd, err := idmapTree(src, int(userns.Fd()))
+		if err != nil {
+			return err
+		}
+		fds = append(fds, fd)
+	}
+	if err := unix.Sendmsg(int(conn.Fd()), []byte{0}, unix.UnixRights(fds...), nil, 0); err != nil {
+		return fmt.Errorf("failed to send idmapped mounts: %w", err)
+	}
+	return nil
+}
+
+// recvIdmappedMounts asks the parent stage for n idmapped mounts and returns
+// their fds.
+func recvIdmappedMounts(conn *os.File, n int) ([]int, error) {
+	if err := writeStageMsg(conn, stageMsg{Type: msgIdmap}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(n*4))
+	_, oobn, _, _, err := unix.Recvmsg(int(conn.Fd()), buf, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive idmapped mounts: %w", err)
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, m := range msgs {
+		rights, err := unix.ParseUnixRights(&m)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != n {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return nil, fmt.Errorf("expected %d idmapped mounts, got %d", n, len(fds))
+	}
+	return fds, nil
+}
+
+// attachTree mounts the detached tree fd on target.
+func attachTree(fd int, target string) error {
+	defer unix.Close(fd)
+	if err := unix.MoveMount(fd, "", unix.AT_FDCWD, target, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("failed to attach idmapped mount on %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package container
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func usernsSpec() *specs.Spec {
+	return &specs.Spec{Linux: &specs.Linux{
+		Namespaces:  []specs.LinuxNamespace{{Type: specs.PIDNamespace}, {Type: specs.UserNamespace}},
+		UIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+		GIDMappings: []specs.LinuxIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}},
+	}}
+}
+
+func TestValidateUserNamespace(t *testing.T) {
+	spec := usernsSpec()
+	if !userNamespace(spec) {
+		t.Fatalf("user namespace not detected")
+	}
+	if err := validateUserNamespace(spec); err != nil {
+		t.Fatalf("valid spec rejected: %v", err)
+	}
+	if userNamespace(&specs.Spec{Linux: &specs.Linux{}}) || userNamespace(nil) {
+		t.Fatalf("user namespace detected without one in the spec")
+	}
+
+	spec.Linux.GIDMappings = nil
+	if err := validateUserNamespace(spec); err == nil {
+		t.Errorf("expected error without gid mappings")
+	}
+	spec = usernsSpec()
+	spec.Linux.UIDMappings[0].Size = 0
+	if err := validateUserNamespace(spec); err == nil {
+		t.Errorf("expected error for an empty mapping")
+	}
+	spec = usernsSpec()
+	spec.Linux.Namespaces[1].Path = "/proc/1/ns/user"
+	if err := validateUserNamespace(spec); err == nil {
+		t.Errorf("expected error for joining a user namespace")
+	}
+}
+
+func TestIdMappings(t *testing.T) {
+	got := idMappings(usernsSpec().Linux.UIDMappings)
+	want := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("idMappings = %+v, want %+v", got, want)
+	}
+}
+
+func TestIdmapSources(t *testing.T) {
+	spec := usernsSpec()
+	spec.Mounts = []specs.Mount{
+		{Destination: "/proc", Type: "proc", Source: "proc"},
+		{Destination: "/a", Type: "bind", Source: "/srv/a", Options: []string{"rbind"}},
+		{Destination: "/tmp", Type: "tmpfs", Source: "tmpfs"},
+		{Destination: "/b", Source: "/srv/b", Options: []string{"bind", "ro"}},
+	}
+	opts := &stageOptions{
+		Rootfs: "/alpine",
+		Spec:   spec,
+		Mounts: []stageMount{{Source: "/var/lib/containish/volumes/v/_data", Target: "/data"}},
+	}
+	want := []idmapSource{
+		{"/alpine", true},
+		{"/srv/a", true},
+		{"/srv/b", false},
+		{"/var/lib/containish/volumes/v/_data", true},
+	}
+	if got := idmapSources(opts); !reflect.DeepEqual(got, want) {
+		t.Fatalf("idmapSources = %+v, want %+v", got, want)
+	}
+}
+
+func TestRecvIdmappedMounts(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := os.NewFile(uintptr(fds[0]), "parent")
+	child := os.NewFile(uintptr(fds[1]), "child")
+	defer parent.Close()
+	defer child.Close()
+
+	f1, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		if _, err := expectStageMsg(parent, msgIdmap, "child stage", time.Second); err != nil {
+			errc <- err
+			return
+		}
+		errc <- unix.Sendmsg(int(parent.Fd()), []byte{0}, unix.UnixRights(int(f1.Fd()), int(f1.Fd())), nil, 0)
+	}()
+
+	got, err := recvIdmappedMounts(child, 2)
+	if err != nil {
+		t.Fatalf("recvIdmappedMounts failed: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("sending fds failed: %v", err)
+	}
+	for _, fd := range got {
+		unix.Close(fd)
+	}
+	if len(got) != 2 {
+		t.Fatalf("received %d fds, want 2", len(got))
+	}
+}
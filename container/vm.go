@@ -0,0 +1,696 @@
+package container
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+// A container run with IsolationVM runs its process in a microVM booted by
+// QEMU with a kernel image shared by every container, Config.VM.Kernel.
+// The container is set up as ever, with its namespaces, cgroup and rootfs,
+// but the child stage keeps the root of the host and, once released, runs
+// QEMU rather than the process, so the limits of the cgroup and the
+// network namespace of the container apply to the VM. The rootfs is shared
+// with the guest over 9p, and the guest boots an initramfs holding
+// containish itself as init, which mounts it, switches to it and runs the
+// process the way the child stage would, with its user, capabilities and
+// seccomp filter, then writes its exit code to a dir of the state dir
+// shared with the guest and powers the VM off. The child stage exits with
+// that code, and forwards the signals stopping the container to QEMU. The
+// console of the guest is the stdio of the container, on which the output
+// and error streams of the process are merged. A container with a network
+// gets QEMU user networking, whose traffic leaves through that of the
+// container namespace. The guest gets as much memory as the memory limit
+// of the container, less what QEMU needs, and as many CPUs as its CPU
+// limit. The isolation is experimental: it needs a kernel with virtio-pci,
+// 9p and virtio-net built in, a containish linked statically, so it can
+// run as the init of the guest, and it can't exec into the container.
+
+// vmGuestStage is the init of the guest, and vmProcessStage the stage it
+// runs the process of the container in.
+const (
+	vmGuestStage   = "VM_GUEST_STAGE"
+	vmProcessStage = "VM_PROCESS_STAGE"
+)
+
+// vmShareDirName is the dir of the state dir shared with the guest, and
+// vmInitramfsName its initramfs. The share holds the stage options of the
+// guest, vmOptionsFileName, and the exit code of the process once it has
+// exited, vmExitFileName.
+const (
+	vmShareDirName    = "vm"
+	vmInitramfsName   = "vm-initramfs"
+	vmOptionsFileName = "options.json"
+	vmExitFileName    = "exit-code"
+)
+
+// vmRootfsTag and vmShareTag are the 9p mount tags of the rootfs and the
+// share, mounted by the guest at vmGuestRootfs and vmGuestShare with
+// vm9pOptions.
+const (
+	vmRootfsTag   = "rootfs"
+	vmShareTag    = "containish"
+	vmGuestRootfs = "/rootfs"
+	vmGuestShare  = "/share"
+	vm9pOptions   = "trans=virtio,version=9p2000.L,msize=262144,cache=mmap"
+)
+
+// The memory of a guest without a memory limit, what QEMU needs on top of
+// the memory of the guest within one, and the least a guest boots with.
+const (
+	vmDefaultMemory  = 512 << 20
+	vmMemoryOverhead = 128 << 20
+	vmMinMemory      = 64 << 20
+)
+
+// vmKernel is the kernel image guests boot, and vmHypervisor the QEMU
+// system emulator running them, qemu-system-<arch> on PATH if empty, see
+// Config.VM.
+var (
+	vmKernel     = "/var/lib/containish/vm/vmlinux"
+	vmHypervisor = ""
+)
+
+// kvmDevice is the device of the KVM hypervisor, whose cgroup rule the vm
+// isolation adds so QEMU can use it.
+const kvmDevice = "/dev/kvm"
+
+var kvmDeviceRule = specs.LinuxDeviceCgroup{Allow: true, Type: "c", Major: int64Ptr(10), Minor: int64Ptr(232), Access: "rwm"}
+
+// The address and gateway of guests on QEMU user networking.
+var (
+	vmGuestAddr    = net.IPNet{IP: net.IPv4(10, 0, 2, 15), Mask: net.CIDRMask(24, 32)}
+	vmGuestGateway = net.IPv4(10, 0, 2, 2)
+)
+
+// qemuTarget is the QEMU system emulator of an architecture, with its
+// machine and the serial console of its guests.
+type qemuTarget struct {
+	Arch    string
+	Machine string
+	Console string
+}
+
+// qemuTargets are the QEMU targets by GOARCH.
+var qemuTargets = map[string]qemuTarget{
+	"amd64": {"x86_64", "q35", "ttyS0"},
+	"arm64": {"aarch64", "virt", "ttyAMA0"},
+}
+
+// vmStage is how the child stage runs the microVM of a container, and the
+// guest its network.
+type vmStage struct {
+	// Args run QEMU.
+	Args []string `json:"args,omitempty"`
+	// Share is the host dir shared with the guest.
+	Share string `json:"share,omitempty"`
+	// Network configures the guest for QEMU user networking.
+	Network bool `json:"network,omitempty"`
+}
+
+// vmMachine describes the microVM of a container.
+type vmMachine struct {
+	Hypervisor string
+	Target     qemuTarget
+	Kernel     string
+	Initramfs  string
+	Rootfs     string
+	Share      string
+	ReadOnly   bool
+	KVM        bool
+	Network    bool
+	Memory     int64
+	CPUs       int
+}
+
+// args returns the QEMU command line booting m.
+func (m vmMachine) args() []string {
+	accel, cpu := "tcg", "max"
+	if m.KVM {
+		accel, cpu = "kvm", "host"
+	}
+	rootfs := fmt.Sprintf("local,id=%s,path=%s,security_model=passthrough,multidevs=remap", vmRootfsTag, qemuValue(m.Rootfs))
+	if m.ReadOnly {
+		rootfs += ",readonly=on"
+	}
+	cmdline := fmt.Sprintf("console=%s quiet panic=-1 rdinit=/init -- init %s", m.Target.Console, vmGuestStage)
+	args := []string{
+		m.Hypervisor,
+		"-nodefaults", "-no-user-config", "-no-reboot",
+		"-machine", m.Target.Machine, "-accel", accel, "-cpu", cpu,
+		"-smp", strconv.Itoa(m.CPUs), "-m", strconv.FormatInt(m.Memory>>20, 10) + "M",
+		"-display", "none", "-monitor", "none", "-serial", "stdio",
+		"-kernel", m.Kernel, "-initrd", m.Initramfs, "-append", cmdline,
+		"-device", "virtio-rng-pci",
+		"-fsdev", rootfs,
+		"-device", "virtio-9p-pci,fsdev=" + vmRootfsTag + ",mount_tag=" + vmRootfsTag,
+		"-fsdev", fmt.Sprintf("local,id=%s,path=%s,security_model=none", vmShareTag, qemuValue(m.Share)),
+		"-device", "virtio-9p-pci,fsdev=" + vmShareTag + ",mount_tag=" + vmShareTag,
+	}
+	if m.Network {
+		args = append(args, "-netdev", "user,id=net0", "-device", "virtio-net-pci,netdev=net0")
+	}
+	return args
+}
+
+// qemuValue escapes the commas of a value of a QEMU option.
+func qemuValue(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// vmSandbox runs the process of the container in a microVM.
+type vmSandbox struct{}
+
+func (vmSandbox) configure(spec *specs.Spec, options *RunOptions) error {
+	for _, c := range []struct {
+		set  bool
+		what string
+	}{
+		{options.Rootfs == RootfsHost, "the host rootfs"},
+		{options.Runtime == RuntimeWasm, "the wasm runtime"},
+		{options.fakeStages, "fake stages"},
+		{options.Notify, "readiness notification"},
+		{options.Metadata, "the metadata socket"},
+		{options.Trace != "", "tracing"},
+		{options.HealthCheck != nil, "a health check"},
+		{pidNamespaceName(spec, options) != "", "a shared pid namespace"},
+		{userNamespace(spec), "a user namespace"},
+		{spec.Linux != nil && spec.Linux.Seccomp != nil && spec.Linux.Seccomp.ListenerPath != "", "a seccomp agent"},
+	} {
+		if c.set {
+			return fmt.Errorf("%s can't be used with the %s isolation", c.what, IsolationVM)
+		}
+	}
+	target, err := vmTarget()
+	if err != nil {
+		return err
+	}
+	if _, err := vmHypervisorPath(target); err != nil {
+		return err
+	}
+	if _, err := os.Stat(vmKernel); err != nil {
+		return fmt.Errorf("the %s isolation needs a kernel image: %w", IsolationVM, err)
+	}
+	static, err := staticBinary("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+	if !static {
+		return fmt.Errorf("the %s isolation needs a statically linked containish, built with CGO_ENABLED=0, to run as the init of the guest", IsolationVM)
+	}
+	if _, err := vmMemory(spec); err != nil {
+		return err
+	}
+	if kvmAvailable() && cgroupsAvailable() {
+		if spec.Linux == nil {
+			spec.Linux = &specs.Linux{}
+		}
+		if spec.Linux.Resources == nil {
+			spec.Linux.Resources = &specs.LinuxResources{}
+		}
+		spec.Linux.Resources.Devices = append(spec.Linux.Resources.Devices, kvmDeviceRule)
+	}
+	return nil
+}
+
+func (vmSandbox) prepare(stateDir string, options *RunOptions, opts *stageOptions) error {
+	target, err := vmTarget()
+	if err != nil {
+		return err
+	}
+	hypervisor, err := vmHypervisorPath(target)
+	if err != nil {
+		return err
+	}
+	memory, err := vmMemory(opts.Spec)
+	if err != nil {
+		return err
+	}
+	share := filepath.Join(stateDir, vmShareDirName)
+	if err := os.RemoveAll(share); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(share, 0o700); err != nil {
+		return err
+	}
+	initramfs := filepath.Join(stateDir, vmInitramfsName)
+	if err := createInitramfs(initramfs, "/proc/self/exe"); err != nil {
+		return err
+	}
+
+	network := options.Network.Driver != NoneNetwork
+	guest := stageOptions{
+		ContainerId: opts.ContainerId,
+		Spec:        opts.Spec,
+		Privileged:  opts.Privileged,
+		SecretEnv:   opts.SecretEnv,
+		Faketime:    opts.Faketime,
+		VM:          &vmStage{Network: network},
+	}
+	data, err := json.Marshal(guest)
+	if err != nil {
+		return fmt.Errorf("failed to encode the options of the guest: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(share, vmOptionsFileName), data, 0o600); err != nil {
+		return err
+	}
+
+	m := vmMachine{
+		Hypervisor: hypervisor,
+		Target:     target,
+		Kernel:     vmKernel,
+		Initramfs:  initramfs,
+		Rootfs:     opts.Rootfs,
+		Share:      share,
+		ReadOnly:   opts.Spec.Root != nil && opts.Spec.Root.Readonly,
+		KVM:        kvmAvailable(),
+		Network:    network,
+		Memory:     memory,
+		CPUs:       vmCPUs(opts.Spec),
+	}
+	opts.KeepRoot = true
+	opts.VM = &vmStage{Args: m.args(), Share: share}
+	return nil
+}
+
+func (vmSandbox) exec(opts *stageOptions, _ *net.UnixConn) error {
+	fmt.Fprintf(stageOut, "INIT (child-stage): Booting the microVM with %s...\n", opts.VM.Args[0])
+	code, err := runVM(opts.VM)
+	if err != nil {
+		return err
+	}
+	os.Exit(code)
+	return nil
+}
+
+// inVM reports whether the process of c runs in a microVM.
+func (c *Container) inVM() bool {
+	return c.Options != nil && c.Options.Isolation == IsolationVM
+}
+
+// errExecVM is the error of an exec into c, which runs in a microVM whose
+// namespaces are those of QEMU.
+func errExecVM(c *Container) error {
+	return fmt.Errorf("container %s runs in a microVM, which processes can't be executed in", c.Id)
+}
+
+// vmTarget returns the QEMU target of the host.
+func vmTarget() (qemuTarget, error) {
+	target, ok := qemuTargets[runtime.GOARCH]
+	if !ok {
+		return qemuTarget{}, fmt.Errorf("the %s isolation isn't supported on %s", IsolationVM, runtime.GOARCH)
+	}
+	return target, nil
+}
+
+// vmHypervisorPath returns the QEMU system emulator of target.
+func vmHypervisorPath(target qemuTarget) (string, error) {
+	if vmHypervisor != "" {
+		return vmHypervisor, nil
+	}
+	path, err := exec.LookPath("qemu-system-" + target.Arch)
+	if err != nil {
+		return "", fmt.Errorf("the %s isolation needs QEMU: %w", IsolationVM, err)
+	}
+	return path, nil
+}
+
+// kvmAvailable reports whether QEMU can use KVM, rather than emulate the
+// CPU of the guest.
+func kvmAvailable() bool {
+	return unix.Access(kvmDevice, unix.R_OK|unix.W_OK) == nil
+}
+
+// vmMemory returns the memory of the guest of the container of spec.
+func vmMemory(spec *specs.Spec) (int64, error) {
+	if spec == nil || spec.Linux == nil || spec.Linux.Resources == nil || spec.Linux.Resources.Memory == nil ||
+		spec.Linux.Resources.Memory.Limit == nil || *spec.Linux.Resources.Memory.Limit <= 0 {
+		return vmDefaultMemory, nil
+	}
+	limit := *spec.Linux.Resources.Memory.Limit
+	if limit-vmMemoryOverhead < vmMinMemory {
+		return 0, fmt.Errorf("a memory limit of %d MiB is too low for the %s isolation, which needs %d MiB", limit>>20, IsolationVM, (vmMinMemory+vmMemoryOverhead)>>20)
+	}
+	return limit - vmMemoryOverhead, nil
+}
+
+// vmCPUs returns the CPUs of the guest of the container of spec: its CPU
+// limit rounded up, or those of the host.
+func vmCPUs(spec *specs.Spec) int {
+	if spec != nil && spec.Linux != nil && spec.Linux.Resources != nil && spec.Linux.Resources.CPU != nil {
+		cpu := spec.Linux.Resources.CPU
+		if cpu.Quota != nil && *cpu.Quota > 0 {
+			period := int64(100000)
+			if cpu.Period != nil && *cpu.Period > 0 {
+				period = int64(*cpu.Period)
+			}
+			return int((*cpu.Quota + period - 1) / period)
+		}
+	}
+	return runtime.NumCPU()
+}
+
+// staticBinary reports whether the ELF program at path runs without a
+// dynamic loader.
+func staticBinary(path string) (bool, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// createInitramfs writes the initramfs of guests to path, with the program
+// at init as their init.
+func createInitramfs(path, init string) error {
+	src, err := os.Open(init)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create initramfs: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	err = writeInitramfs(w, src, fi.Size())
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write initramfs: %w", err)
+	}
+	return nil
+}
+
+// writeInitramfs writes an initramfs, an uncompressed newc cpio archive,
+// to w: the mount points of the guest init, /dev/console for it to get
+// as its stdio, and init of size bytes as /init.
+func writeInitramfs(w io.Writer, init io.Reader, size int64) error {
+	entries := []struct {
+		name         string
+		mode         uint32
+		major, minor uint32
+	}{
+		{".", unix.S_IFDIR | 0o755, 0, 0},
+		{"dev", unix.S_IFDIR | 0o755, 0, 0},
+		{"dev/console", unix.S_IFCHR | 0o600, 5, 1},
+		{"proc", unix.S_IFDIR | 0o555, 0, 0},
+		{"sys", unix.S_IFDIR | 0o555, 0, 0},
+		{strings.TrimPrefix(vmGuestRootfs, "/"), unix.S_IFDIR | 0o755, 0, 0},
+		{strings.TrimPrefix(vmGuestShare, "/"), unix.S_IFDIR | 0o755, 0, 0},
+	}
+	ino := 1
+	for _, e := range entries {
+		if err := writeCpioHeader(w, ino, e.mode, 0, e.major, e.minor, e.name); err != nil {
+			return err
+		}
+		ino++
+	}
+	if err := writeCpioHeader(w, ino, unix.S_IFREG|0o755, size, 0, 0, "init"); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w, init, size); err != nil {
+		return err
+	}
+	if err := writeCpioPadding(w, size); err != nil {
+		return err
+	}
+	return writeCpioHeader(w, 0, 0, 0, 0, 0, "TRAILER!!!")
+}
+
+// writeCpioHeader writes the newc header of an entry, and its name.
+func writeCpioHeader(w io.Writer, ino int, mode uint32, size int64, rdevMajor, rdevMinor uint32, name string) error {
+	nlink := 1
+	if mode&unix.S_IFMT == unix.S_IFDIR {
+		nlink = 2
+	}
+	header := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%s\x00",
+		ino, mode, 0, 0, nlink, 0, size, 0, 0, rdevMajor, rdevMinor, len(name)+1, 0, name)
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	return writeCpioPadding(w, int64(len(header)))
+}
+
+// writeCpioPadding pads what is n bytes long to a multiple of 4.
+func writeCpioPadding(w io.Writer, n int64) error {
+	_, err := w.Write(make([]byte, (4-n%4)%4))
+	return err
+}
+
+// runVM runs QEMU until the VM stops, forwarding the signals stopping the
+// container to it, and returns the exit code of the process of the guest.
+func runVM(vm *vmStage) (int, error) {
+	cmd := exec.Command(vm.Args[0], vm.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, unix.SIGTERM, unix.SIGINT, unix.SIGHUP, unix.SIGQUIT)
+	defer signal.Stop(signals)
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start %s: %w", vm.Args[0], err)
+	}
+	var forwarded atomic.Int32
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				forwarded.Store(int32(sig.(unix.Signal)))
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+	code, err := exitCode(cmd.Wait())
+	close(done)
+	if err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(filepath.Join(vm.Share, vmExitFileName))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if sig := forwarded.Load(); sig != 0 {
+		return 128 + int(sig), nil
+	}
+	if code != 0 {
+		return code, nil
+	}
+	return 0, fmt.Errorf("the VM stopped without the exit code of the container process")
+}
+
+// runVMGuest is the init of a guest. It mounts the rootfs, switches to it
+// and runs the process of the container, whose exit code it writes to the
+// share. The VM is powered off once it returns.
+func runVMGuest() error {
+	for _, m := range []struct{ source, target, fstype, data string }{
+		{"devtmpfs", "/dev", "devtmpfs", ""},
+		{"proc", "/proc", "proc", ""},
+		{"sysfs", "/sys", "sysfs", ""},
+		{vmShareTag, vmGuestShare, "9p", vm9pOptions},
+	} {
+		if err := unix.Mount(m.source, m.target, m.fstype, 0, m.data); err != nil && !(m.fstype == "devtmpfs" && err == unix.EBUSY) {
+			return fmt.Errorf("failed to mount %s: %w", m.target, err)
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(vmGuestShare, vmOptionsFileName))
+	if err != nil {
+		return err
+	}
+	var opts stageOptions
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return fmt.Errorf("invalid guest options: %w", err)
+	}
+	if opts.Spec == nil || opts.VM == nil {
+		return fmt.Errorf("missing guest options")
+	}
+	// The share is out of reach once the root is switched.
+	share, err := unix.Open(vmGuestShare, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", vmGuestShare, err)
+	}
+	defer unix.Close(share)
+
+	var flags uintptr
+	if opts.Spec.Root != nil && opts.Spec.Root.Readonly {
+		flags |= unix.MS_RDONLY
+	}
+	if err := unix.Mount(vmRootfsTag, vmGuestRootfs, "9p", flags, vm9pOptions); err != nil {
+		return fmt.Errorf("failed to mount the rootfs: %w", err)
+	}
+	if err := mountProc(vmGuestRootfs, ""); err != nil {
+		return err
+	}
+	if err := mountSys(vmGuestRootfs, sysWritable(false, false, opts.Privileged), false); err != nil {
+		return err
+	}
+	dev := filepath.Join(vmGuestRootfs, "dev")
+	if err := unix.Mount("/dev", dev, "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("failed to move /dev: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dev, "pts"), 0o755); err != nil {
+		return err
+	}
+	if err := unix.Mount("devpts", filepath.Join(dev, "pts"), "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		return fmt.Errorf("failed to mount /dev/pts: %w", err)
+	}
+	for _, m := range opts.Spec.Mounts {
+		if m.Type == "tmpfs" && filepath.Clean(m.Destination) != "/dev" {
+			if err := mountTmpfs(vmGuestRootfs, m); err != nil {
+				return err
+			}
+		}
+	}
+	// The initramfs can't be pivoted away from, so the rootfs is moved
+	// over it.
+	if err := unix.Chdir(vmGuestRootfs); err != nil {
+		return err
+	}
+	if err := unix.Mount(".", "/", "", unix.MS_MOVE, ""); err != nil {
+		return fmt.Errorf("failed to move the rootfs to /: %w", err)
+	}
+	if err := unix.Chroot("."); err != nil {
+		return fmt.Errorf("failed to switch to the rootfs: %w", err)
+	}
+	if err := unix.Chdir("/"); err != nil {
+		return err
+	}
+
+	if opts.Spec.Hostname != "" {
+		if err := unix.Sethostname([]byte(opts.Spec.Hostname)); err != nil {
+			return fmt.Errorf("failed to set hostname: %w", err)
+		}
+	}
+	if err := linkSetUp("lo"); err != nil {
+		return err
+	}
+	if opts.VM.Network {
+		if err := linkSetUp("eth0"); err != nil {
+			return err
+		}
+		if err := addrAdd("eth0", &vmGuestAddr); err != nil {
+			return err
+		}
+		if err := routeAddDefault("eth0", vmGuestGateway); err != nil {
+			return err
+		}
+	}
+
+	code, err := runVMProcess(&opts)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Openat(share, vmExitFileName, unix.O_WRONLY|unix.O_CREAT|unix.O_TRUNC|unix.O_CLOEXEC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to record the exit code: %w", err)
+	}
+	defer unix.Close(fd)
+	if _, err := unix.Write(fd, []byte(strconv.Itoa(code)+"\n")); err != nil {
+		return fmt.Errorf("failed to record the exit code: %w", err)
+	}
+	return nil
+}
+
+// runVMProcess runs the process of the container in the process stage and
+// returns its exit code, reaping the orphans the guest init inherits
+// meanwhile.
+func runVMProcess(opts *stageOptions) (int, error) {
+	parent, child, err := initSocketPair("stage", unix.SOCK_CLOEXEC)
+	if err != nil {
+		return 0, err
+	}
+	defer parent.Close()
+	cmd := exec.Command("/proc/self/exe", "init", vmProcessStage)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{child}
+	cmd.Env = []string{"STAGE_PIPE=3"}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if opts.Spec.Process != nil && opts.Spec.Process.Terminal {
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+	}
+	err = cmd.Start()
+	child.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to start the process stage: %w", err)
+	}
+	if err := writeStageMsg(parent, stageMsg{Type: msgOptions, Options: opts}); err != nil {
+		return 0, err
+	}
+	for {
+		var ws unix.WaitStatus
+		pid, err := unix.Wait4(-1, &ws, 0, nil)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed waiting for the container process: %w", err)
+		}
+		if pid != cmd.Process.Pid {
+			continue
+		}
+		if ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+		return ws.ExitStatus(), nil
+	}
+}
+
+// handleVMProcessStage executes the process of the container in the guest,
+// with the stage options the guest init sends.
+func handleVMProcessStage() error {
+	fd, err := strconv.Atoi(os.Getenv("STAGE_PIPE"))
+	if err != nil {
+		return fmt.Errorf("invalid STAGE_PIPE fd: %w", err)
+	}
+	stagePipe := os.NewFile(uintptr(fd), "stage-pipe")
+	m, err := expectStageMsg(stagePipe, msgOptions, "guest init", handshakeTimeout)
+	stagePipe.Close()
+	if err != nil {
+		return err
+	}
+	if m.Options == nil {
+		return fmt.Errorf("missing stage options")
+	}
+	return execProcess(m.Options, nil)
+}
+
+// vmPowerOff powers the VM of the guest init off.
+func vmPowerOff() {
+	unix.Sync()
+	if err := unix.Reboot(unix.LINUX_REBOOT_CMD_POWER_OFF); err != nil {
+		fmt.Fprintf(os.Stderr, "Error in VM guest: failed to power off: %v\n", err)
+	}
+	os.Exit(1)
+}
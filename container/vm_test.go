@@ -0,0 +1,153 @@
+package container
+
+import (
+	"bytes"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runtime-spec/specs-go"
+)
+
+func TestVMMachineArgs(t *testing.T) {
+	m := vmMachine{
+		Hypervisor: "/usr/bin/qemu-system-x86_64",
+		Target:     qemuTargets["amd64"],
+		Kernel:     "/srv/vmlinux",
+		Initramfs:  "/run/c1/vm-initramfs",
+		Rootfs:     "/srv/a,b",
+		Share:      "/run/c1/vm",
+		ReadOnly:   true,
+		Memory:     384 << 20,
+		CPUs:       2,
+	}
+	args := strings.Join(m.args(), " ")
+	for _, want := range []string{
+		"/usr/bin/qemu-system-x86_64 -nodefaults",
+		"-machine q35 -accel tcg -cpu max -smp 2 -m 384M",
+		"-append console=ttyS0 quiet panic=-1 rdinit=/init -- init " + vmGuestStage,
+		"path=/srv/a,,b,security_model=passthrough,multidevs=remap,readonly=on",
+		"mount_tag=" + vmShareTag,
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q lack %q", args, want)
+		}
+	}
+	if strings.Contains(args, "-netdev") {
+		t.Errorf("args %q have a network without one asked for", args)
+	}
+
+	m.KVM, m.ReadOnly, m.Network = true, false, true
+	args = strings.Join(m.args(), " ")
+	if !strings.Contains(args, "-accel kvm -cpu host") || strings.Contains(args, "readonly=on") || !strings.Contains(args, "-netdev user,id=net0") {
+		t.Errorf("args %q, want kvm, a writable rootfs and user networking", args)
+	}
+}
+
+func TestVMMemory(t *testing.T) {
+	limit := func(l int64) *specs.Spec {
+		return &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{Memory: &specs.LinuxMemory{Limit: &l}}}}
+	}
+	if m, err := vmMemory(&specs.Spec{}); err != nil || m != vmDefaultMemory {
+		t.Errorf("vmMemory without a limit = %d, %v", m, err)
+	}
+	if m, err := vmMemory(limit(1 << 30)); err != nil || m != 1<<30-vmMemoryOverhead {
+		t.Errorf("vmMemory of 1 GiB = %d, %v", m, err)
+	}
+	if _, err := vmMemory(limit(128 << 20)); err == nil {
+		t.Error("expected a limit below the overhead of the guest to be rejected")
+	}
+}
+
+func TestVMCPUs(t *testing.T) {
+	quota, period := int64(150000), uint64(100000)
+	spec := &specs.Spec{Linux: &specs.Linux{Resources: &specs.LinuxResources{CPU: &specs.LinuxCPU{Quota: &quota, Period: &period}}}}
+	if n := vmCPUs(spec); n != 2 {
+		t.Errorf("vmCPUs of 1.5 CPUs = %d, want 2", n)
+	}
+	if n := vmCPUs(&specs.Spec{}); n < 1 {
+		t.Errorf("vmCPUs without a limit = %d", n)
+	}
+}
+
+func TestWriteInitramfs(t *testing.T) {
+	init := "#!/bin/true\n"
+	var buf bytes.Buffer
+	if err := writeInitramfs(&buf, strings.NewReader(init), int64(len(init))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	field := func(header []byte, i int) uint64 {
+		v, err := strconv.ParseUint(string(header[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			t.Fatalf("bad header field %d: %v", i, err)
+		}
+		return v
+	}
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	var names []string
+	files := map[string]string{}
+	for off := 0; ; {
+		if off%4 != 0 || off+110 > len(data) || string(data[off:off+6]) != "070701" {
+			t.Fatalf("no newc header at %d", off)
+		}
+		header := data[off : off+110]
+		nameSize, size := int(field(header, 11)), int(field(header, 6))
+		name := string(data[off+110 : off+110+nameSize-1])
+		if name == "TRAILER!!!" {
+			break
+		}
+		names = append(names, name)
+		if name == "dev/console" && (field(header, 1)&0o170000 != 0o020000 || field(header, 9) != 5 || field(header, 10) != 1) {
+			t.Errorf("dev/console header %q, want the character device 5:1", header)
+		}
+		off = align(off + 110 + nameSize)
+		files[name] = string(data[off : off+size])
+		off = align(off + size)
+	}
+	for _, want := range []string{".", "dev", "dev/console", "proc", "sys", "rootfs", "share", "init"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("initramfs entries %v lack %s", names, want)
+		}
+	}
+	if files["init"] != init {
+		t.Errorf("init is %q, want %q", files["init"], init)
+	}
+}
+
+func TestVMSandboxConfigure(t *testing.T) {
+	for what, options := range map[string]RunOptions{
+		"host rootfs":  {Rootfs: RootfsHost},
+		"wasm runtime": {Runtime: RuntimeWasm},
+		"notify":       {Notify: true},
+		"health check": {HealthCheck: &HealthCheck{}},
+	} {
+		if err := (vmSandbox{}).configure(&specs.Spec{}, &options); err == nil || !strings.Contains(err.Error(), IsolationVM) {
+			t.Errorf("configure with a %s = %v, want it rejected", what, err)
+		}
+	}
+	userns := &specs.Spec{Linux: &specs.Linux{Namespaces: []specs.LinuxNamespace{{Type: specs.UserNamespace}}}}
+	if err := (vmSandbox{}).configure(userns, &RunOptions{}); err == nil {
+		t.Error("expected a user namespace to be rejected")
+	}
+
+	origKernel, origHypervisor := vmKernel, vmHypervisor
+	vmKernel, vmHypervisor = filepath.Join(t.TempDir(), "vmlinux"), "/bin/true"
+	defer func() { vmKernel, vmHypervisor = origKernel, origHypervisor }()
+	if _, err := vmTarget(); err != nil {
+		t.Skip(err)
+	}
+	if err := (vmSandbox{}).configure(&specs.Spec{}, &RunOptions{}); err == nil || !strings.Contains(err.Error(), "kernel") {
+		t.Errorf("configure without a kernel = %v, want it rejected", err)
+	}
+}
+
+func TestExecVM(t *testing.T) {
+	c := &Container{Id: "c1", Options: &RunOptions{Isolation: IsolationVM}}
+	if _, _, err := startExec(c, ExecOptions{}, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "microVM") {
+		t.Errorf("startExec = %v, want exec into a microVM rejected", err)
+	}
+}
@@ -0,0 +1,314 @@
+package container
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// volumesDir holds one directory per named volume: the data lives in
+// <name>/_data and the metadata in <name>/volume.json. It is a variable so
+// tests can override it.
+var volumesDir = "/var/lib/containish/volumes"
+
+// Volume is a named directory that outlives the containers using it.
+type Volume struct {
+	Name       string    `json:"name"`
+	Mountpoint string    `json:"mountpoint"`
+	CreatedAt  time.Time `json:"createdAt"`
+	// Owned is set once the data directory has been chowned to the user
+	// of the first container that mounted it.
+	Owned bool `json:"owned"`
+	// Refs lists the containers the volume is mounted in.
+	Refs []string `json:"refs,omitempty"`
+}
+
+// VolumeMount mounts a named volume into a container.
+type VolumeMount struct {
+	Name     string `json:"name"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// ParseVolumeMount parses a -v value of the form "<name>:<path>[:ro|rw]".
+func ParseVolumeMount(value string) (VolumeMount, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return VolumeMount{}, fmt.Errorf("invalid volume %q: expected <name>:<path>[:ro]", value)
+	}
+	m := VolumeMount{Name: parts[0], Target: parts[1]}
+	if strings.HasPrefix(m.Name, "/") || strings.HasPrefix(m.Name, ".") {
+		return m, fmt.Errorf("invalid volume %q: only named volumes are supported", value)
+	}
+	if err := validateVolumeName(m.Name); err != nil {
+		return m, err
+	}
+	if !filepath.IsAbs(m.Target) || filepath.Clean(m.Target) == "/" {
+		return m, fmt.Errorf("invalid volume %q: the mount path must be absolute and not /", value)
+	}
+	m.Target = filepath.Clean(m.Target)
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return m, fmt.Errorf("invalid volume %q: unknown option %q", value, parts[2])
+		}
+	}
+	return m, nil
+}
+
+// validateVolumeMounts rejects two volumes mounted on the same path.
+func validateVolumeMounts(mounts []VolumeMount) error {
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		if seen[m.Target] {
+			return fmt.Errorf("duplicate mount path %s", m.Target)
+		}
+		seen[m.Target] = true
+	}
+	return nil
+}
+
+func validateVolumeName(name string) error {
+	if !objectNameRe.MatchString(name) {
+		return fmt.Errorf("invalid volume name %q", name)
+	}
+	return nil
+}
+
+func volumeDir(name string) string {
+	return filepath.Join(volumesDir, name)
+}
+
+// CreateVolume creates an empty named volume.
+func CreateVolume(name string) (*Volume, error) {
+	if err := validateVolumeName(name); err != nil {
+		return nil, err
+	}
+	v := &Volume{
+		Name:       name,
+		Mountpoint: filepath.Join(volumeDir(name), "_data"),
+		CreatedAt:  time.Now(),
+	}
+	if err := os.MkdirAll(volumesDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create volumes dir: %w", err)
+	}
+	if err := os.Mkdir(volumeDir(name), 0o700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("volume %s %w", name, ErrExists)
+		}
+		return nil, fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	if err := os.Mkdir(v.Mountpoint, 0o755); err != nil {
+		_ = os.RemoveAll(volumeDir(name))
+		return nil, fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+	if err := saveVolume(v); err != nil {
+		_ = os.RemoveAll(volumeDir(name))
+		return nil, err
+	}
+	return v, nil
+}
+
+func saveVolume(v *Volume) error {
+	data, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(volumeDir(v.Name), "volume.json"), data, 0o600); err != nil {
+		return fmt.Errorf("failed to save volume %s: %w", v.Name, err)
+	}
+	return nil
+}
+
+// LoadVolume returns the named volume.
+func LoadVolume(name string) (*Volume, error) {
+	if err := validateVolumeName(name); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(volumeDir(name), "volume.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("volume %s %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume %s: %w", name, err)
+	}
+	var v Volume
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("failed to decode volume %s: %w", name, err)
+	}
+	return &v, nil
+}
+
+// ListVolumes returns all volumes ordered by name.
+func ListVolumes() ([]*Volume, error) {
+	entries, err := os.ReadDir(volumesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volumes dir: %w", err)
+	}
+	var volumes []*Volume
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		v, err := LoadVolume(e.Name())
+		if err != nil {
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// RemoveVolume deletes a volume and its data. Volumes still referenced by
+// a container that has not stopped are refused.
+func RemoveVolume(name string) error {
+	return withVolumeLock(name, func(v *Volume) error {
+		v.Refs = liveRefs(v.Refs)
+		if len(v.Refs) > 0 {
+			return fmt.Errorf("volume %s is in use by %s", name, strings.Join(v.Refs, ", "))
+		}
+		if err := os.RemoveAll(volumeDir(name)); err != nil {
+			return fmt.Errorf("failed to remove volume %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// liveRefs drops references to containers that are gone or stopped without
+// releasing their volumes.
+func liveRefs(refs []string) []string {
+	var live []string
+	for _, id := range refs {
+		c, err := LoadState(id)
+		if err == nil && c.Status != Stopped {
+			live = append(live, id)
+		}
+	}
+	return live
+}
+
+// withVolumeLock runs fn with the volume metadata loaded under an exclusive
+// lock and saves it afterwards, unless fn removed the volume.
+func withVolumeLock(name string, fn func(v *Volume) error) error {
+	if err := validateVolumeName(name); err != nil {
+		return err
+	}
+	dir, err := os.Open(volumeDir(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("volume %s %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock volume %s: %w", name, err)
+	}
+	defer unix.Flock(int(dir.Fd()), unix.LOCK_UN)
+
+	v, err := LoadVolume(name)
+	if err != nil {
+		return err
+	}
+	if err := fn(v); err != nil {
+		return err
+	}
+	if _, err := os.Stat(volumeDir(name)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return saveVolume(v)
+}
+
+// acquireVolumes creates missing volumes, chowns fresh ones to uid:gid and
+// records containerId as a user of each. It returns the host directories to
+// mount, in the order of mounts.
+func acquireVolumes(containerId string, mounts []VolumeMount, uid, gid int) ([]string, error) {
+	var sources []string
+	for i, m := range mounts {
+		if _, err := LoadVolume(m.Name); err != nil {
+			if _, err := CreateVolume(m.Name); err != nil {
+				releaseVolumes(containerId, mounts[:i])
+				return nil, err
+			}
+		}
+		err := withVolumeLock(m.Name, func(v *Volume) error {
+			if !v.Owned {
+				if err := os.Chown(v.Mountpoint, uid, gid); err != nil {
+					return fmt.Errorf("failed to chown volume %s: %w", v.Name, err)
+				}
+				v.Owned = true
+			}
+			if !slices.Contains(v.Refs, containerId) {
+				v.Refs = append(v.Refs, containerId)
+			}
+			sources = append(sources, v.Mountpoint)
+			return nil
+		})
+		if err != nil {
+			releaseVolumes(containerId, mounts[:i])
+			return nil, err
+		}
+	}
+	return sources, nil
+}
+
+// releaseVolumes drops containerId from the users of its volumes.
+func releaseVolumes(containerId string, mounts []VolumeMount) {
+	for _, m := range mounts {
+		err := withVolumeLock(m.Name, func(v *Volume) error {
+			v.Refs = slices.DeleteFunc(v.Refs, func(id string) bool { return id == containerId })
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to release volume %s: %v\n", m.Name, err)
+		}
+	}
+}
+
+// stageMount is a bind mount performed by the child stage before
+// pivot_root. Source is a host path and Target a path in the container.
+type stageMount struct {
+	Source   string `json:"source"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// bindMount mounts m at its target in rootfs, creating the directory. A
+// tree other than -1 is an idmapped copy of the source attached instead.
+func bindMount(rootfs string, m stageMount, tree int) error {
+	mount := func(dst string) error {
+		if tree >= 0 {
+			return attachTree(tree, dst)
+		}
+		if err := unix.Mount(m.Source, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to mount %s on %s: %w", m.Source, m.Target, err)
+		}
+		return nil
+	}
+	var after func(string) error
+	if m.ReadOnly {
+		after = func(dst string) error {
+			// MS_RDONLY is ignored on the initial bind and needs a remount.
+			if err := unix.Mount("", dst, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+				return fmt.Errorf("failed to make %s read-only: %w", m.Target, err)
+			}
+			return nil
+		}
+	}
+	return mountInRoot(rootfs, mountTarget{path: m.Target, dir: true}, mount, after)
+}
@@ -0,0 +1,120 @@
+package container
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// tempVolumesDir points volumesDir and baseStateDir at temporary directories.
+func tempVolumesDir(t *testing.T) {
+	t.Helper()
+	oldVolumes, oldState := volumesDir, baseStateDir
+	volumesDir, baseStateDir = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { volumesDir, baseStateDir = oldVolumes, oldState })
+}
+
+func TestParseVolumeMount(t *testing.T) {
+	cases := map[string]VolumeMount{
+		"data:/data":           {Name: "data", Target: "/data"},
+		"data:/var/lib/db/:ro": {Name: "data", Target: "/var/lib/db", ReadOnly: true},
+		"cache:/cache:rw":      {Name: "cache", Target: "/cache"},
+	}
+	for in, want := range cases {
+		got, err := ParseVolumeMount(in)
+		if err != nil || got != want {
+			t.Errorf("ParseVolumeMount(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, bad := range []string{"data", "data:relative", "data:/", "/host:/data", "../x:/data", "data:/data:rx", "a:b:c:d"} {
+		if _, err := ParseVolumeMount(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestValidateVolumeMounts(t *testing.T) {
+	ok := []VolumeMount{{Name: "a", Target: "/a"}, {Name: "a", Target: "/b"}}
+	if err := validateVolumeMounts(ok); err != nil {
+		t.Fatalf("valid mounts rejected: %v", err)
+	}
+	dup := []VolumeMount{{Name: "a", Target: "/a"}, {Name: "b", Target: "/a"}}
+	if err := validateVolumeMounts(dup); err == nil {
+		t.Fatalf("expected error for duplicate targets")
+	}
+}
+
+func TestVolumeLifecycle(t *testing.T) {
+	tempVolumesDir(t)
+
+	v, err := CreateVolume("data")
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	if _, err := os.Stat(v.Mountpoint); err != nil {
+		t.Fatalf("data dir missing: %v", err)
+	}
+	if _, err := CreateVolume("data"); err == nil {
+		t.Fatalf("expected error creating a duplicate volume")
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	mounts := []VolumeMount{{Name: "data", Target: "/data"}, {Name: "fresh", Target: "/fresh"}}
+	sources, err := acquireVolumes("c1", mounts, uid, gid)
+	if err != nil {
+		t.Fatalf("acquireVolumes failed: %v", err)
+	}
+	if len(sources) != 2 || sources[0] != v.Mountpoint {
+		t.Fatalf("unexpected sources %v", sources)
+	}
+
+	fresh, err := LoadVolume("fresh")
+	if err != nil {
+		t.Fatalf("volume not created on first use: %v", err)
+	}
+	if !fresh.Owned || !reflect.DeepEqual(fresh.Refs, []string{"c1"}) {
+		t.Fatalf("unexpected volume %+v", fresh)
+	}
+
+	// c1 is running, so its volumes cannot go away.
+	if err := saveState(&Container{Id: "c1", Status: Running}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveVolume("data"); err == nil {
+		t.Fatalf("expected error removing a volume in use")
+	}
+
+	releaseVolumes("c1", mounts)
+	if err := RemoveVolume("data"); err != nil {
+		t.Fatalf("RemoveVolume failed: %v", err)
+	}
+	if _, err := LoadVolume("data"); err == nil {
+		t.Fatalf("volume still present after removal")
+	}
+
+	names := []string{}
+	volumes, err := ListVolumes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"fresh"}) {
+		t.Fatalf("ListVolumes() = %v", names)
+	}
+}
+
+func TestRemoveVolumeIgnoresStoppedContainers(t *testing.T) {
+	tempVolumesDir(t)
+
+	if _, err := acquireVolumes("gone", []VolumeMount{{Name: "data", Target: "/data"}}, os.Getuid(), os.Getgid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveState(&Container{Id: "gone", Status: Stopped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveVolume("data"); err != nil {
+		t.Fatalf("a stopped container must not hold its volumes: %v", err)
+	}
+}
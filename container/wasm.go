@@ -0,0 +1,170 @@
+package container
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// A container run with RuntimeWasm executes a WebAssembly module in place
+// of an ELF binary: the child stage sets the container up as ever, with its
+// namespaces, cgroup, rootfs, capabilities and seccomp filter, but rather
+// than executing the process of the spec it runs its module, found like a
+// program on PATH, with the WASI engine of wazero embedded in the runtime.
+// The module gets the args and environment of the process, the stdio of
+// the container and its rootfs as /, and the container exits with its exit
+// code. Images for WebAssembly, of platform wasip1/wasm or wasi/wasm, are
+// pulled for containers run with it unless another platform is asked for.
+// The runtime is experimental: WASI preview 1 has no sockets or processes,
+// and the engine is the Go runtime of the child stage, so the container
+// process is containish, not the module.
+
+// Runtimes executing the container process, see RunOptions.Runtime.
+const (
+	// RuntimeNative executes an ELF binary. It is given as an empty
+	// Runtime.
+	RuntimeNative = "native"
+	// RuntimeWasm runs a WebAssembly module.
+	RuntimeWasm = "wasm"
+)
+
+// wasmArch is the architecture of WebAssembly images, and wasmOS their
+// operating systems.
+const wasmArch = "wasm"
+
+var wasmOS = []string{"wasip1", "wasi"}
+
+// wasmMagic starts WebAssembly modules in the binary format.
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+// ParseRuntime parses a --runtime value, native or wasm, returning the
+// Runtime of RunOptions.
+func ParseRuntime(value string) (string, error) {
+	switch value {
+	case "", RuntimeNative:
+		return "", nil
+	case RuntimeWasm:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown runtime %q: expected %s or %s", value, RuntimeNative, RuntimeWasm)
+}
+
+// validateRuntime checks the runtime of options and that it can run the
+// platform asked for.
+func validateRuntime(options *RunOptions) error {
+	if _, err := ParseRuntime(options.Runtime); err != nil {
+		return err
+	}
+	if options.Platform == wasmArch && options.Runtime != RuntimeWasm {
+		return fmt.Errorf("platform %s requires the %s runtime", wasmArch, RuntimeWasm)
+	}
+	return nil
+}
+
+// imagePlatformOS reports whether goos is that of the images for arch.
+func imagePlatformOS(goos, arch string) bool {
+	if arch == wasmArch {
+		return slices.Contains(wasmOS, goos)
+	}
+	return goos == "linux"
+}
+
+// platformName returns the platform of the images for arch, os/arch.
+func platformName(arch string) string {
+	if arch == wasmArch {
+		return wasmOS[0] + "/" + arch
+	}
+	return "linux/" + arch
+}
+
+// wasmModule returns the path of the WebAssembly module file in root,
+// looked up on path, or the default PATH if empty, as a program would be.
+func wasmModule(root, file, path string) (string, error) {
+	if path == "" {
+		path = defaultExecPath
+	}
+	for _, p := range execCandidates(file, path) {
+		f, err := openInRoot(root, p)
+		if err != nil {
+			continue
+		}
+		magic := make([]byte, len(wasmMagic))
+		_, err = io.ReadFull(f, magic)
+		f.Close()
+		if err != nil || string(magic) != string(wasmMagic) {
+			return "", fmt.Errorf("%s isn't a WebAssembly module", p)
+		}
+		return filepath.Join(root, p), nil
+	}
+	return "", fmt.Errorf("%s: WebAssembly module not found", file)
+}
+
+// runWasm runs the WASI module with argv and env, and root mounted as /,
+// returning its exit code.
+func runWasm(root, module string, argv, env []string) (int, error) {
+	code, err := os.ReadFile(module)
+	if err != nil {
+		return 0, err
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	config := wazero.NewModuleConfig().
+		WithName(filepath.Base(module)).
+		WithArgs(argv...).
+		WithStdin(os.Stdin).
+		WithStdout(os.Stdout).
+		WithStderr(os.Stderr).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithSysNanosleep().
+		WithRandSource(rand.Reader).
+		WithFSConfig(wazero.NewFSConfig().WithDirMount(root, "/"))
+	for _, e := range env {
+		if key, value, ok := strings.Cut(e, "="); ok {
+			config = config.WithEnv(key, value)
+		}
+	}
+	compiled, err := r.CompileModule(ctx, code)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compile %s: %w", module, err)
+	}
+	mod, err := r.InstantiateModule(ctx, compiled, config)
+	var exit *sys.ExitError
+	if errors.As(err, &exit) {
+		return int(exit.ExitCode()), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to run %s: %w", module, err)
+	}
+	mod.Close(ctx)
+	return 0, nil
+}
+
+// execWasm runs the WASI module of argv, looked up in root on the PATH of
+// env, and exits with its exit code, as executing it would.
+func execWasm(root string, argv, env []string) error {
+	module, err := wasmModule(root, argv[0], envValue(env, "PATH"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stageOut, "INIT (child-stage): Running WebAssembly module %s...\n", argv[0])
+	code, err := runWasm(root, module, argv, env)
+	if err != nil {
+		return err
+	}
+	os.Exit(code)
+	return nil
+}
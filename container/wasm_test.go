@@ -0,0 +1,127 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wasmHello is a WASI module writing "hi" to stdout and exiting with 7.
+func wasmHello() []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	name := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	importFunc := func(field string, typ byte) []byte {
+		b := append(name("wasi_snapshot_preview1"), name(field)...)
+		return append(b, 0x00, typ)
+	}
+	var m []byte
+	m = append(m, wasmMagic...)
+	m = append(m, 0x01, 0x00, 0x00, 0x00)
+	// (i32) -> (), () -> () and (i32, i32, i32, i32) -> i32.
+	m = append(m, section(1, 0x03, 0x60, 0x01, 0x7f, 0x00, 0x60, 0x00, 0x00, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x01, 0x7f)...)
+	imports := append([]byte{0x02}, importFunc("fd_write", 2)...)
+	m = append(m, section(2, append(imports, importFunc("proc_exit", 0)...)...)...)
+	m = append(m, section(3, 0x01, 0x01)...)
+	m = append(m, section(5, 0x01, 0x00, 0x01)...)
+	exports := append(append([]byte{0x02}, name("_start")...), 0x00, 0x02)
+	exports = append(append(exports, name("memory")...), 0x02, 0x00)
+	m = append(m, section(7, exports...)...)
+	// fd_write(1, iovs 0, 1 iov, nwritten 16); proc_exit(7)
+	body := []byte{0x00, 0x41, 0x01, 0x41, 0x00, 0x41, 0x01, 0x41, 0x10, 0x10, 0x00, 0x1a, 0x41, 0x07, 0x10, 0x01, 0x0b}
+	m = append(m, section(10, append([]byte{0x01, byte(len(body))}, body...)...)...)
+	// An iov of the 3 bytes at 8, "hi\n".
+	data := []byte{0x01, 0x00, 0x41, 0x00, 0x0b, 0x0b, 0x08, 0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 'h', 'i', '\n'}
+	return append(m, section(11, data...)...)
+}
+
+func TestParseRuntime(t *testing.T) {
+	for value, want := range map[string]string{"": "", "native": "", "wasm": RuntimeWasm} {
+		if got, err := ParseRuntime(value); err != nil || got != want {
+			t.Errorf("ParseRuntime(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := ParseRuntime("gvisor"); err == nil {
+		t.Error("ParseRuntime accepted an unknown runtime")
+	}
+	if err := validateRuntime(&RunOptions{Platform: wasmArch}); err == nil {
+		t.Error("the wasm platform was accepted without the wasm runtime")
+	}
+}
+
+func TestWasmModule(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "bin"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(root, "bin", "hello.wasm"), string(wasmHello()), 0o644)
+	writeFile(t, filepath.Join(root, "bin", "sh"), "#!/bin/sh\n", 0o755)
+
+	if got, err := wasmModule(root, "hello.wasm", "/usr/bin:/bin"); err != nil || got != filepath.Join(root, "bin", "hello.wasm") {
+		t.Errorf("wasmModule(hello.wasm) = %q, %v", got, err)
+	}
+	if _, err := wasmModule(root, "/bin/sh", ""); err == nil || !strings.Contains(err.Error(), "isn't a WebAssembly module") {
+		t.Errorf("wasmModule(/bin/sh) = %v, want it refused", err)
+	}
+	if _, err := wasmModule(root, "missing.wasm", ""); err == nil {
+		t.Error("wasmModule found a missing module")
+	}
+}
+
+func TestRunWasm(t *testing.T) {
+	root := t.TempDir()
+	module := filepath.Join(root, "hello.wasm")
+	writeFile(t, module, string(wasmHello()), 0o644)
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code, err := runWasm(root, module, []string{"hello.wasm"}, nil)
+	os.Stdout = stdout
+	if err != nil || code != 7 {
+		t.Fatalf("runWasm = %d, %v, want exit code 7", code, err)
+	}
+	if data, _ := os.ReadFile(out.Name()); string(data) != "hi\n" {
+		t.Errorf("module wrote %q", data)
+	}
+}
+
+func TestFakeStagesWasm(t *testing.T) {
+	rt, specPath := fakeBundle(t, "/hello.wasm")
+	writeFile(t, filepath.Join(filepath.Dir(specPath), "rootfs", "hello.wasm"), string(wasmHello()), 0o644)
+	ctx := context.Background()
+
+	opts := fakeOptions(WithRuntime(RuntimeWasm), Detached(), WithLogConfig(LogConfig{Driver: LogDriverNone}))
+	if err := rt.Run(ctx, "c1", specPath, opts...); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	st, err := rt.Wait(wctx, "c1", WaitStopped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for st.ExitCode == nil && wctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+		st, _ = rt.State("c1")
+	}
+	if st.ExitCode == nil || *st.ExitCode != 7 {
+		t.Fatalf("stopped container %+v, want exit code 7", st)
+	}
+
+	// A runtime that can't find the module fails the setup.
+	rt, specPath = fakeBundle(t, "sh")
+	_, err = rt.Create(ctx, "c2", specPath, fakeOptions(WithRuntime(RuntimeWasm))...)
+	var se *StageError
+	if !errors.As(err, &se) || se.Step != "exec" || !strings.Contains(se.Message, "WebAssembly") {
+		t.Fatalf("Create = %v, want the module not found", err)
+	}
+}
@@ -0,0 +1,366 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Lifecycle events are POSTed as JSON to the webhook endpoints of the global
+// configuration and of the container's containish.webhook annotation. They
+// are delivered by a webhook process, a re-exec of containish ("init
+// WEBHOOK") reading its job on stdin, so the runtime doesn't wait on slow
+// endpoints. The process started with a container also watches its init
+// process, sending oom when the cgroup's oom_kill count goes up and stop
+// once it has exited.
+
+// webhookStage is the init stage delivering webhooks.
+const webhookStage = "WEBHOOK"
+
+// AnnotationWebhook lists extra webhook endpoints of a container, separated
+// by commas. They receive every event.
+const AnnotationWebhook = "containish.webhook"
+
+// webhookConfigPath is the global webhook configuration. It is a variable so
+// tests can override it.
+var webhookConfigPath = "/etc/containish/webhooks.json"
+
+// webhookLogName records failed deliveries in the state dir.
+const webhookLogName = "webhooks.log"
+
+// Delivery is retried on network errors, 429 and 5xx responses, waiting
+// webhookBackoff before the first retry and twice as long before each next.
+var (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second
+	webhookTimeout  = 10 * time.Second
+)
+
+// EventType is the kind of a lifecycle event.
+type EventType string
+
+const (
+	// EventStart is sent once the container process has been started.
+	EventStart EventType = "start"
+	// EventStop is sent once the container init process has exited.
+	EventStop EventType = "stop"
+	// EventOOM is sent when the kernel kills a container process for
+	// exceeding the memory limit.
+	EventOOM EventType = "oom"
+	// EventHealth is sent when the health of a container with a
+	// HealthCheck changes.
+	EventHealth EventType = "health_status"
+)
+
+// Event is the payload of a webhook.
+type Event struct {
+	Type        EventType         `json:"type"`
+	Id          string            `json:"id"`
+	Time        time.Time         `json:"time"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Health is the health status of an EventHealth.
+	Health string `json:"health,omitempty"`
+}
+
+// WebhookConfig is the global webhook configuration.
+type WebhookConfig struct {
+	// Secret signs payloads with HMAC-SHA256, sent hex encoded in the
+	// X-Containish-Signature header as "sha256=<mac>". Empty leaves them
+	// unsigned.
+	Secret string `json:"secret,omitempty"`
+	// Endpoints receive the events of every container.
+	Endpoints []WebhookEndpoint `json:"endpoints,omitempty"`
+}
+
+// WebhookEndpoint is a URL receiving events.
+type WebhookEndpoint struct {
+	URL string `json:"url"`
+	// Events restricts the events sent. Empty sends all of them.
+	Events []EventType `json:"events,omitempty"`
+}
+
+func (e WebhookEndpoint) wants(t EventType) bool {
+	return len(e.Events) == 0 || slices.Contains(e.Events, t)
+}
+
+// webhookJob is what a webhook process is given on stdin.
+type webhookJob struct {
+	Config WebhookConfig `json:"config"`
+	// Event is delivered right away.
+	Event *Event `json:"event,omitempty"`
+	// Monitor is a container whose init process is watched for OOM kills
+	// and exit.
+	Monitor *Container `json:"monitor,omitempty"`
+}
+
+// loadWebhooks returns the global webhook configuration with the endpoints
+// of annotations added. A missing configuration file configures none.
+func loadWebhooks(annotations map[string]string) (WebhookConfig, error) {
+	var cfg WebhookConfig
+	data, err := os.ReadFile(webhookConfigPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cfg, fmt.Errorf("failed to read webhook config: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("invalid webhook config %s: %w", webhookConfigPath, err)
+		}
+	}
+	if v := annotations[AnnotationWebhook]; v != "" {
+		for _, u := range strings.Split(v, ",") {
+			cfg.Endpoints = append(cfg.Endpoints, WebhookEndpoint{URL: strings.TrimSpace(u)})
+		}
+	}
+	for _, e := range cfg.Endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("invalid webhook endpoint %q: expected an http or https URL", e.URL)
+		}
+		for _, t := range e.Events {
+			if t != EventStart && t != EventStop && t != EventOOM && t != EventHealth {
+				return cfg, fmt.Errorf("unknown webhook event %q for %s", t, e.URL)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+func newEvent(t EventType, c *Container) *Event {
+	ev := &Event{
+		Type:        t,
+		Id:          c.Id,
+		Time:        time.Now().UTC(),
+		Pid:         c.InitProcessPiD,
+		Bundle:      c.Bundle,
+		Annotations: c.Annotations,
+	}
+	if t == EventHealth && c.Health != nil {
+		ev.Health = c.Health.Status
+	}
+	return ev
+}
+
+// startWebhooks starts the webhook process watching c, sending it the start
+// event first if start is set. Nothing is started without endpoints.
+func startWebhooks(c *Container, start bool) error {
+	job := webhookJob{Monitor: c}
+	if start {
+		job.Event = newEvent(EventStart, c)
+	}
+	return startWebhookProcess(c, job)
+}
+
+// sendWebhook delivers one event about c in the background.
+func sendWebhook(t EventType, c *Container) error {
+	return startWebhookProcess(c, webhookJob{Event: newEvent(t, c)})
+}
+
+func startWebhookProcess(c *Container, job webhookJob) error {
+	cfg, err := loadWebhooks(c.Annotations)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Endpoints) == 0 {
+		return nil
+	}
+	job.Config = cfg
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	logFile, err := os.OpenFile(filepath.Join(StateDir(c.Id), webhookLogName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open webhook log: %w", err)
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cmd := exec.Command("/proc/self/exe", "init", webhookStage)
+	cmd.Stdin = r
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start webhook process: %w", err)
+	}
+	_ = cmd.Process.Release()
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to send webhook job: %w", err)
+	}
+	return nil
+}
+
+// runWebhooks runs the job read from stdin.
+func runWebhooks() error {
+	var job webhookJob
+	if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+		return fmt.Errorf("invalid webhook job: %w", err)
+	}
+	if job.Event != nil {
+		deliverEvent(job.Config, job.Event)
+	}
+	if c := job.Monitor; c != nil {
+		watchInit(c, func(t EventType) { deliverEvent(job.Config, newEvent(t, c)) })
+		deliverEvent(job.Config, newEvent(EventStop, c))
+	}
+	return nil
+}
+
+// watchInit waits for the init process of c to exit, calling notify with
+// EventOOM whenever the OOM killer strikes in its cgroup.
+func watchInit(c *Container, notify func(EventType)) {
+	pidfd, err := openInit(c)
+	if err != nil {
+		// The process has already exited.
+		return
+	}
+	defer unix.Close(pidfd)
+
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	var kills int
+	events, err := os.Open(filepath.Join(c.CgroupPath, "memory.events"))
+	if err == nil {
+		defer events.Close()
+		kills = oomKills(events)
+		// cgroup files notify changes with POLLPRI.
+		fds = append(fds, unix.PollFd{Fd: int32(events.Fd()), Events: unix.POLLPRI})
+	}
+
+	for {
+		for i := range fds {
+			fds[i].Revents = 0
+		}
+		if _, err := unix.Poll(fds, -1); err != nil && !errors.Is(err, unix.EINTR) {
+			webhookLogf("failed to watch %s: %v", c.Id, err)
+			return
+		}
+		// An OOM killed init makes both fds ready, so check the count
+		// before reporting the exit.
+		if events != nil {
+			if n := oomKills(events); n > kills {
+				kills = n
+				notify(EventOOM)
+			}
+		}
+		if fds[0].Revents&unix.POLLIN != 0 {
+			return
+		}
+	}
+}
+
+// oomKills returns the oom_kill count of a memory.events file, or 0 if it
+// can't be read.
+func oomKills(f *os.File) int {
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "oom_kill "); ok {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// deliverEvent sends ev to the endpoints wanting it, in parallel. Failures
+// are logged once the retries are exhausted.
+func deliverEvent(cfg WebhookConfig, ev *Event) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		webhookLogf("failed to encode %s event: %v", ev.Type, err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, e := range cfg.Endpoints {
+		if !e.wants(ev.Type) {
+			continue
+		}
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			if err := postWebhook(url, cfg.Secret, ev.Type, body); err != nil {
+				webhookLogf("%s event of %s not delivered to %s: %v", ev.Type, ev.Id, url, err)
+			}
+		}(e.URL)
+	}
+	wg.Wait()
+}
+
+// postWebhook POSTs body to url, retrying with exponential backoff.
+func postWebhook(url, secret string, t EventType, body []byte) error {
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = postOnce(client, url, secret, t, body); err == nil || !retry || attempt == webhookAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// postOnce makes one delivery attempt, reporting whether a failure is
+// worth retrying.
+func postOnce(client *http.Client, url, secret string, t EventType, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "containish")
+	req.Header.Set("X-Containish-Event", string(t))
+	if secret != "" {
+		req.Header.Set("X-Containish-Signature", "sha256="+signPayload(secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("endpoint responded %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookLogf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
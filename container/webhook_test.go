@@ -0,0 +1,168 @@
+package container
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadWebhooks(t *testing.T) {
+	orig := webhookConfigPath
+	webhookConfigPath = filepath.Join(t.TempDir(), "webhooks.json")
+	defer func() { webhookConfigPath = orig }()
+
+	cfg, err := loadWebhooks(nil)
+	if err != nil || len(cfg.Endpoints) != 0 {
+		t.Fatalf("without a config file got %+v, %v", cfg, err)
+	}
+
+	config := `{"secret": "s3cret", "endpoints": [{"url": "https://hooks.example.com/a", "events": ["stop", "oom"]}]}`
+	if err := os.WriteFile(webhookConfigPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = loadWebhooks(map[string]string{AnnotationWebhook: "http://10.0.0.1/b, http://10.0.0.2/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Secret != "s3cret" || len(cfg.Endpoints) != 3 || cfg.Endpoints[2].URL != "http://10.0.0.2/c" {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if cfg.Endpoints[0].wants(EventStart) || !cfg.Endpoints[0].wants(EventOOM) || !cfg.Endpoints[1].wants(EventStart) {
+		t.Fatalf("unexpected event selection in %+v", cfg.Endpoints)
+	}
+
+	for _, bad := range []map[string]string{
+		{AnnotationWebhook: "ftp://example.com"},
+		{AnnotationWebhook: "example.com/hook"},
+	} {
+		if _, err := loadWebhooks(bad); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+	if err := os.WriteFile(webhookConfigPath, []byte(`{"endpoints": [{"url": "http://a/", "events": ["pause"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadWebhooks(nil); err == nil {
+		t.Error("expected error for an unknown event")
+	}
+}
+
+func TestDeliverEvent(t *testing.T) {
+	origBackoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = origBackoff }()
+
+	var mu sync.Mutex
+	var got []*Event
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if sig := r.Header.Get("X-Containish-Signature"); sig != "sha256="+signPayload("s3cret", body) {
+			t.Errorf("bad signature %q", sig)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		if err := json.Unmarshal(body, &ev); err != nil {
+			t.Errorf("bad payload: %v", err)
+		}
+		if r.Header.Get("X-Containish-Event") != string(ev.Type) {
+			t.Errorf("event header %q for a %s event", r.Header.Get("X-Containish-Event"), ev.Type)
+		}
+		got = append(got, &ev)
+	}))
+	defer srv.Close()
+
+	cfg := WebhookConfig{
+		Secret:    "s3cret",
+		Endpoints: []WebhookEndpoint{{URL: srv.URL, Events: []EventType{EventStop}}},
+	}
+	c := &Container{Id: "web", InitProcessPiD: 42, Annotations: map[string]string{"tier": "front"}}
+	deliverEvent(cfg, newEvent(EventStart, c))
+	deliverEvent(cfg, newEvent(EventStop, c))
+
+	if len(got) != 1 || got[0].Type != EventStop || got[0].Id != "web" || got[0].Pid != 42 || got[0].Annotations["tier"] != "front" {
+		t.Fatalf("unexpected deliveries %+v", got)
+	}
+}
+
+func TestPostWebhookGivesUp(t *testing.T) {
+	origBackoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = origBackoff }()
+
+	var mu sync.Mutex
+	requests := 0
+	status := http.StatusBadRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	if err := postWebhook(srv.URL, "", EventStart, []byte("{}")); err == nil || requests != 1 {
+		t.Fatalf("400: got %v after %d requests, want an error after 1", err, requests)
+	}
+	requests, status = 0, http.StatusInternalServerError
+	if err := postWebhook(srv.URL, "", EventStart, []byte("{}")); err == nil || requests != webhookAttempts {
+		t.Fatalf("500: got %v after %d requests, want an error after %d", err, requests, webhookAttempts)
+	}
+}
+
+func TestOOMKills(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memory.events")
+	if err := os.WriteFile(path, []byte("low 0\nhigh 0\nmax 4\noom 2\noom_kill 2\noom_group_kill 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Read twice, as a watcher does.
+	for i := 0; i < 2; i++ {
+		if n := oomKills(f); n != 2 {
+			t.Fatalf("oomKills = %d, want 2", n)
+		}
+	}
+}
+
+func TestWatchInit(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	done := make(chan struct{})
+	go func() {
+		watchInit(&Container{Id: "web", InitProcessPiD: cmd.Process.Pid}, func(t EventType) {})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("watchInit returned while the process runs")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchInit didn't return once the process exited")
+	}
+}
@@ -0,0 +1,126 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"containish/container"
+)
+
+// DefaultBundleRoot is the directory an agent runs the bundles of the
+// coordinator from.
+const DefaultBundleRoot = "/var/lib/containish/bundles"
+
+var (
+	// agentRetryDelay and agentMaxRetryDelay bound the backoff of an agent
+	// that can't reach its coordinator.
+	agentRetryDelay    = time.Second
+	agentMaxRetryDelay = 30 * time.Second
+)
+
+// runAgent polls the coordinator for containers to run as agent name until
+// ctx is cancelled, only running bundles under bundleRoot.
+func runAgent(ctx context.Context, client *ClusterClient, name, bundleRoot string) {
+	fmt.Printf("Contain-ish daemon registering with the coordinator as %s\n", name)
+	delay := agentRetryDelay
+	for ctx.Err() == nil {
+		task, err := client.poll(ctx, AgentStatus{Name: name, Running: runningContainers()})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(2*delay, agentMaxRetryDelay)
+			continue
+		}
+		delay = agentRetryDelay
+		if task == nil {
+			continue
+		}
+
+		runErr := runTask(ctx, task.Run, bundleRoot)
+		if runErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", task.Run.ID, runErr)
+		} else {
+			fmt.Printf("Contain-ish daemon ran %s for the coordinator\n", task.Run.ID)
+		}
+		if err := client.report(ctx, task.ID, runErr); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to report task %s: %v\n", task.ID, err)
+		}
+	}
+}
+
+// runTask runs the container of req detached, as "containish run --detach"
+// would, refusing a bundle outside bundleRoot.
+func runTask(ctx context.Context, req RunRequest, bundleRoot string) error {
+	bundle := "."
+	if req.Bundle != "" {
+		var err error
+		if bundle, err = agentBundle(bundleRoot, req.Bundle); err != nil {
+			return err
+		}
+	}
+	rt, err := container.New()
+	if err != nil {
+		return err
+	}
+	opts := []container.CreateOption{container.Detached(), container.Quiet()}
+	if len(req.Env) > 0 {
+		opts = append(opts, container.WithEnv(req.Env...))
+	}
+	if req.Memory > 0 || req.CPUs > 0 {
+		opts = append(opts, container.WithLimits(req.Memory, req.CPUs))
+	}
+	if req.Image != "" {
+		opts = append(opts, container.WithImage(req.Image))
+	}
+	if req.Force {
+		opts = append(opts, container.WithForce())
+	}
+	return rt.Run(ctx, req.ID, filepath.Join(bundle, "config.json"), opts...)
+}
+
+// agentBundle returns bundle with its symlinks resolved, if it lies under
+// root. The coordinator only tells where the bundle is, so anything else on
+// the host would be run as a container if it could name it.
+func agentBundle(root, bundle string) (string, error) {
+	if !filepath.IsAbs(bundle) {
+		return "", fmt.Errorf("bundle %q must be an absolute path on the host", bundle)
+	}
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("invalid bundle root: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(bundle)
+	if err != nil {
+		return "", fmt.Errorf("invalid bundle: %w", err)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("bundle %s is outside the bundle root %s: %w", bundle, root, container.ErrPermission)
+	}
+	return resolved, nil
+}
+
+// runningContainers counts the containers running on the host, for the
+// coordinator to schedule by.
+func runningContainers() int {
+	rt, err := container.New()
+	if err != nil {
+		return 0
+	}
+	containers, err := rt.Find(container.StateFilter{Status: []container.Status{container.Running, container.Starting}})
+	if err != nil {
+		return 0
+	}
+	return len(containers)
+}
@@ -0,0 +1,42 @@
+package daemon
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"containish/container"
+)
+
+func TestAgentBundle(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "bundles")
+	for _, d := range []string{"bundles/web", "bundlesx", "etc"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "etc"), filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := agentBundle(root, filepath.Join(root, "web")); err != nil || got != filepath.Join(root, "web") {
+		t.Errorf("agentBundle(web) = %q, %v", got, err)
+	}
+	for _, bundle := range []string{
+		filepath.Join(dir, "etc"),
+		filepath.Join(dir, "bundlesx"),
+		filepath.Join(root, "../etc"),
+		filepath.Join(root, "escape"),
+	} {
+		if _, err := agentBundle(root, bundle); !errors.Is(err, container.ErrPermission) {
+			t.Errorf("agentBundle(%s) = %v, want it refused", bundle, err)
+		}
+	}
+	for _, bundle := range []string{"bundles/web", filepath.Join(root, "missing")} {
+		if _, err := agentBundle(root, bundle); err == nil {
+			t.Errorf("agentBundle(%s) succeeded", bundle)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"containish/container"
+)
+
+// The client side of the API, for commands following what the daemon sees
+// rather than reading the state of the containers themselves: the event
+// stream, the list of the containers and the stream of the stats of those
+// running.
+
+// apiGet gets path from the API of the daemon listening on socketPath,
+// returning the response once its status is OK. what names the request in
+// the error of another status the daemon gave no reason for.
+func apiGet(ctx context.Context, socketPath, path, what string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://containish"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := unixClient(socketPath).Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, fmt.Errorf("cannot reach %s, is the daemon running? %w", socketPath, err)
+		}
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var body struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != "" {
+			return nil, errors.New(body.Error)
+		}
+		return nil, fmt.Errorf("%s failed: %s", what, resp.Status)
+	}
+	return resp, nil
+}
+
+// FetchContainers lists every container known to the daemon listening on
+// socketPath.
+func FetchContainers(ctx context.Context, socketPath string) ([]*container.Container, error) {
+	resp, err := apiGet(ctx, socketPath, "/containers", "container list")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var containers []*container.Container
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to read containers: %w", err)
+	}
+	return containers, nil
+}
+
+// StreamStats passes the stats of the running containers of the daemon
+// listening on socketPath to fn every interval, with the time they were
+// sampled, until ctx is done or the daemon stops.
+func StreamStats(ctx context.Context, socketPath string, interval time.Duration, fn func(time.Time, []*container.Stats)) error {
+	q := url.Values{"stream": {"true"}, "interval": {interval.String()}}
+	resp, err := apiGet(ctx, socketPath, "/stats?"+q.Encode(), "stats stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var s aggregateSample
+		if err := dec.Decode(&s); err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read stats: %w", err)
+		}
+		fn(s.Time, s.Containers)
+	}
+}
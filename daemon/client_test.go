@@ -0,0 +1,82 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"containish/container"
+)
+
+// serveUnix serves h on a unix socket for the test and returns its path.
+func serveUnix(t *testing.T, h http.Handler) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "containish.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return socket
+}
+
+func TestFetchContainers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []*container.Container{{Id: "web", Status: container.Running}, {Id: "db", Status: container.Stopped}})
+	})
+	socket := serveUnix(t, mux)
+
+	containers, err := FetchContainers(context.Background(), socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 2 || containers[0].Id != "web" || containers[0].Status != container.Running || containers[1].Status != container.Stopped {
+		t.Fatalf("FetchContainers = %+v", containers)
+	}
+
+	_, err = FetchContainers(context.Background(), filepath.Join(t.TempDir(), "missing.sock"))
+	if err == nil || !strings.Contains(err.Error(), "is the daemon running") {
+		t.Fatalf("FetchContainers without a daemon = %v", err)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	n := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		serveStats(w, r, func() (any, error) {
+			n++
+			if n > 3 {
+				return nil, fmt.Errorf("sampling failed")
+			}
+			return aggregateSample{Time: time.Now(), Containers: []*container.Stats{{Id: "web", CPUUsageUsec: uint64(n)}}}, nil
+		}, nil)
+	})
+	socket := serveUnix(t, mux)
+
+	if err := StreamStats(context.Background(), socket, time.Millisecond, func(time.Time, []*container.Stats) {}); err == nil || !strings.Contains(err.Error(), "below the minimum") {
+		t.Fatalf("StreamStats of a short interval = %v, want the error of the daemon", err)
+	}
+	var usage []uint64
+	err := StreamStats(context.Background(), socket, minStreamInterval, func(at time.Time, stats []*container.Stats) {
+		if at.IsZero() || len(stats) != 1 || stats[0].Id != "web" {
+			t.Errorf("streamed %v %+v", at, stats)
+			return
+		}
+		usage = append(usage, stats[0].CPUUsageUsec)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(usage) != "[1 2 3]" {
+		t.Fatalf("streamed usage %v, want the 3 samples taken before the error", usage)
+	}
+}
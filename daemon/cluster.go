@@ -0,0 +1,295 @@
+package daemon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// A coordinator ("containish coordinator") schedules containers on the
+// daemons of several hosts run as its agents ("containish daemon
+// --coordinator"). Agents register by polling the coordinator for tasks,
+// so the coordinator needs no way in to them, and run the containers they
+// are given as "containish run --detach" would. It is the smallest version
+// of how an orchestrator drives the runtimes of a cluster: the coordinator
+// only keeps its agents and tasks in memory, and a task handed to an agent
+// that goes away is left running. Both speak gRPC over mutual TLS, each
+// side presenting a certificate of the cluster CA, and calls carry a token
+// shared by the cluster. The messages are the JSON of the types below
+// rather than protobuf, which keeps the build free of generated code.
+
+// Files of the cluster credentials.
+const (
+	// DefaultClusterTokenFile holds the token of the cluster.
+	DefaultClusterTokenFile = "/etc/containish/cluster-token"
+	// DefaultClusterCAFile holds the CA the certificates of the cluster
+	// are signed by.
+	DefaultClusterCAFile = "/etc/containish/cluster/ca.pem"
+	// DefaultClusterCertFile and DefaultClusterKeyFile hold the
+	// certificate of the host and its key.
+	DefaultClusterCertFile = "/etc/containish/cluster/cert.pem"
+	DefaultClusterKeyFile  = "/etc/containish/cluster/key.pem"
+)
+
+// RunRequest is a container to run on a host of the cluster.
+type RunRequest struct {
+	// Host is the agent to run the container on. The coordinator picks
+	// the one running the fewest containers if it is empty.
+	Host string `json:"host,omitempty"`
+	ID   string `json:"id"`
+	// Bundle is the bundle directory on the host, which must be absolute
+	// and under the bundle root of its agent. Without one the container is
+	// run from Image.
+	Bundle string   `json:"bundle,omitempty"`
+	Image  string   `json:"image,omitempty"`
+	Env    []string `json:"env,omitempty"`
+	// Memory and CPUs limit the container, see container.WithLimits.
+	Memory int64   `json:"memory,omitempty"`
+	CPUs   float64 `json:"cpus,omitempty"`
+	Force  bool    `json:"force,omitempty"`
+}
+
+// Task states.
+const (
+	TaskPending = "pending"
+	TaskRunning = "running"
+	TaskDone    = "done"
+	TaskFailed  = "failed"
+)
+
+// Task is a RunRequest scheduled on a host.
+type Task struct {
+	ID       string     `json:"id"`
+	Host     string     `json:"host"`
+	Run      RunRequest `json:"run"`
+	Status   string     `json:"status"`
+	Error    string     `json:"error,omitempty"`
+	Created  time.Time  `json:"created"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// AgentStatus is what an agent reports each time it polls.
+type AgentStatus struct {
+	Name string `json:"name"`
+	// Running is how many containers run on the host.
+	Running int `json:"running"`
+}
+
+// Agent is a host registered with the coordinator.
+type Agent struct {
+	AgentStatus
+	LastSeen time.Time `json:"lastSeen"`
+	// Lost reports an agent that hasn't polled for agentTimeout. No
+	// container is scheduled on it until it does again.
+	Lost bool `json:"lost"`
+}
+
+// taskResult is what an agent reports once it has run a task.
+type taskResult struct {
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// runCall schedules Run, waiting up to Wait for it to finish.
+type runCall struct {
+	Run  RunRequest    `json:"run"`
+	Wait time.Duration `json:"wait"`
+}
+
+// taskCall names a task.
+type taskCall struct {
+	ID string `json:"id"`
+}
+
+// pollReply is the task handed to a polling agent, nil if none came.
+type pollReply struct {
+	Task *Task `json:"task,omitempty"`
+}
+
+// agentList lists the agents of the coordinator.
+type agentList struct {
+	Agents []Agent `json:"agents"`
+}
+
+// empty is the message of calls without one.
+type empty struct{}
+
+// jsonCodec carries the messages of the cluster as JSON, as the content
+// subtype "json".
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// ReadClusterToken returns the token in the file at path.
+func ReadClusterToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cluster token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("cluster token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// ClusterTLS are the files of the TLS credentials of a member of the
+// cluster, PEM encoded.
+type ClusterTLS struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// DefaultClusterTLS returns the credentials in their default files.
+func DefaultClusterTLS() ClusterTLS {
+	return ClusterTLS{CAFile: DefaultClusterCAFile, CertFile: DefaultClusterCertFile, KeyFile: DefaultClusterKeyFile}
+}
+
+// config returns the TLS config of a coordinator, or of its clients if
+// client is set. Both require the other side to present a certificate of
+// the CA.
+func (t ClusterTLS) config(client bool) (*tls.Config, error) {
+	if t.CAFile == "" || t.CertFile == "" || t.KeyFile == "" {
+		return nil, fmt.Errorf("the cluster requires a CA, a certificate and its key")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cluster certificate: %w", err)
+	}
+	data, err := os.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate in cluster CA %s", t.CAFile)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13}
+	if client {
+		cfg.RootCAs = pool
+	} else {
+		cfg.ClientCAs, cfg.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// clusterToken sends the token of the cluster with each call.
+type clusterToken string
+
+func (t clusterToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (clusterToken) RequireTransportSecurity() bool { return true }
+
+// ClusterClient talks to a coordinator.
+type ClusterClient struct {
+	conn *grpc.ClientConn
+}
+
+// NewClusterClient returns a client of the coordinator at the TCP address
+// coordinator, such as coordinator:7070, connecting with creds. Nothing is
+// dialed until the first call.
+func NewClusterClient(coordinator, token string, creds ClusterTLS) (*ClusterClient, error) {
+	if _, _, err := net.SplitHostPort(coordinator); err != nil {
+		return nil, fmt.Errorf("invalid coordinator %q: expected host:port", coordinator)
+	}
+	cfg, err := creds.config(true)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := grpc.NewClient(coordinator,
+		grpc.WithTransportCredentials(credentials.NewTLS(cfg)),
+		grpc.WithPerRPCCredentials(clusterToken(token)),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(jsonCodec{}.Name())),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid coordinator %q: %w", coordinator, err)
+	}
+	return &ClusterClient{conn: conn}, nil
+}
+
+// Close closes the connection to the coordinator.
+func (c *ClusterClient) Close() error {
+	return c.conn.Close()
+}
+
+// Run schedules req and waits up to wait for the container to run,
+// returning the task as it then is.
+func (c *ClusterClient) Run(ctx context.Context, req RunRequest, wait time.Duration) (*Task, error) {
+	var task Task
+	if err := c.call(ctx, "Run", runCall{Run: req, Wait: wait}, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Task returns the task with id.
+func (c *ClusterClient) Task(ctx context.Context, id string) (*Task, error) {
+	var task Task
+	if err := c.call(ctx, "Task", taskCall{ID: id}, &task); err != nil {
+		return nil, err
+	}
+	return &task, nil
+}
+
+// Agents lists the agents of the coordinator, by name.
+func (c *ClusterClient) Agents(ctx context.Context) ([]Agent, error) {
+	var list agentList
+	if err := c.call(ctx, "Agents", empty{}, &list); err != nil {
+		return nil, err
+	}
+	return list.Agents, nil
+}
+
+// poll registers status and waits for a task for the agent, returning nil
+// if none came.
+func (c *ClusterClient) poll(ctx context.Context, status AgentStatus) (*Task, error) {
+	var reply pollReply
+	if err := c.call(ctx, "Poll", status, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Task, nil
+}
+
+// report sends the outcome of task id.
+func (c *ClusterClient) report(ctx context.Context, id string, runErr error) error {
+	res := taskResult{ID: id}
+	if runErr != nil {
+		res.Error = runErr.Error()
+	}
+	return c.call(ctx, "Report", res, &empty{})
+}
+
+// call invokes method of the coordinator service with in, decoding the
+// reply into out, and returns the error of a failed call.
+func (c *ClusterClient) call(ctx context.Context, method string, in, out any) error {
+	err := c.conn.Invoke(ctx, "/"+coordinatorService+"/"+method, in, out)
+	if err == nil {
+		return nil
+	}
+	s := status.Convert(err)
+	if s.Code() == codes.Unavailable {
+		return fmt.Errorf("failed to reach coordinator: %s", s.Message())
+	}
+	return fmt.Errorf("coordinator: %s", s.Message())
+}
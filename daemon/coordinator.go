@@ -0,0 +1,364 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"containish/container"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCoordinatorAddress is where the coordinator listens by default,
+// only reachable from its own host.
+const DefaultCoordinatorAddress = "127.0.0.1:7070"
+
+var (
+	// pollTimeout is how long the coordinator holds a poll without a
+	// task before answering it with none.
+	pollTimeout = 25 * time.Second
+	// agentTimeout is how long an agent may go without polling before
+	// it is considered lost.
+	agentTimeout = 90 * time.Second
+	// defaultRunWait is how long a run request waits for the container
+	// to run when it doesn't say.
+	defaultRunWait = time.Minute
+	// taskRetention is how long finished tasks are kept.
+	taskRetention = time.Hour
+)
+
+// coordinator keeps the agents and tasks of a cluster.
+type coordinator struct {
+	token string
+
+	mu     sync.Mutex
+	agents map[string]*Agent
+	tasks  map[string]*Task
+	// queues are the pending tasks of each agent, oldest first.
+	queues map[string][]*Task
+	nextID int
+	// changed is closed, and replaced, whenever a task is added or
+	// finishes, to wake those waiting on one.
+	changed chan struct{}
+}
+
+func newCoordinator(token string) *coordinator {
+	return &coordinator{
+		token:   token,
+		agents:  map[string]*Agent{},
+		tasks:   map[string]*Task{},
+		queues:  map[string][]*Task{},
+		changed: make(chan struct{}),
+	}
+}
+
+// coordinatorService is the gRPC service of the coordinator.
+const coordinatorService = "containish.Coordinator"
+
+// coordinatorDesc describes the coordinator service. Each call is checked
+// for the token of the cluster before it is handled.
+var coordinatorDesc = grpc.ServiceDesc{
+	ServiceName: coordinatorService,
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Agents", Handler: unary((*coordinator).listAgents)},
+		{MethodName: "Poll", Handler: unary((*coordinator).poll)},
+		{MethodName: "Run", Handler: unary((*coordinator).run)},
+		{MethodName: "Task", Handler: unary((*coordinator).task)},
+		{MethodName: "Report", Handler: unary((*coordinator).report)},
+	},
+}
+
+// unary adapts a method of the coordinator to a gRPC handler.
+func unary[In, Out any](method func(*coordinator, context.Context, *In) (*Out, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+		c := srv.(*coordinator)
+		if err := c.authorize(ctx); err != nil {
+			return nil, err
+		}
+		in := new(In)
+		if err := dec(in); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+		}
+		return method(c, ctx, in)
+	}
+}
+
+// RunCoordinator serves the coordinator of a cluster on the TCP address
+// addr until SIGINT or SIGTERM is received. Agents and clients must
+// present a certificate of the CA of creds and send token.
+func RunCoordinator(addr, token string, creds ClusterTLS) error {
+	if token == "" {
+		return fmt.Errorf("the coordinator requires a cluster token")
+	}
+	cfg, err := creds.config(false)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	srv := newCoordinator(token).server(cfg)
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.Serve(l) }()
+	fmt.Printf("Contain-ish coordinator listening on %s\n", l.Addr())
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("coordinator stopped: %w", err)
+	case sig := <-sigs:
+		fmt.Printf("Contain-ish coordinator received %v, shutting down\n", sig)
+	}
+	// Polls and run requests are held open, so they are cut rather than
+	// waited for.
+	srv.Stop()
+	return nil
+}
+
+// server returns a gRPC server of the coordinator over TLS with cfg.
+func (c *coordinator) server(cfg *tls.Config) *grpc.Server {
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
+	srv.RegisterService(&coordinatorDesc, c)
+	return srv
+}
+
+// authorize checks the token of a call.
+func (c *coordinator) authorize(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	got := ""
+	if auth := md.Get("authorization"); len(auth) > 0 {
+		got = auth[0]
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+c.token)) != 1 {
+		return status.Error(codes.Unauthenticated, "invalid cluster token")
+	}
+	return nil
+}
+
+// rpcError maps an error returned by the container package to a gRPC
+// status.
+func rpcError(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, container.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, container.ErrNotRunning):
+		code = codes.FailedPrecondition
+	case errors.Is(err, container.ErrExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, container.ErrPermission):
+		code = codes.PermissionDenied
+	}
+	return status.Error(code, err.Error())
+}
+
+// notify wakes those waiting for a change. c.mu must be held.
+func (c *coordinator) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// lost reports whether a is lost at now.
+func (a *Agent) lost(now time.Time) bool {
+	return now.Sub(a.LastSeen) > agentTimeout
+}
+
+func (c *coordinator) listAgents(ctx context.Context, _ *empty) (*agentList, error) {
+	c.mu.Lock()
+	now := time.Now()
+	agents := []Agent{}
+	for _, a := range c.agents {
+		agent := *a
+		agent.Lost = a.lost(now)
+		agents = append(agents, agent)
+	}
+	c.mu.Unlock()
+	slices.SortFunc(agents, func(a, b Agent) int { return strings.Compare(a.Name, b.Name) })
+	return &agentList{Agents: agents}, nil
+}
+
+// poll registers the agent and hands it its oldest pending task, waiting
+// up to pollTimeout for one.
+func (c *coordinator) poll(ctx context.Context, agent *AgentStatus) (*pollReply, error) {
+	name := agent.Name
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "the agent name is required")
+	}
+
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+	for {
+		c.mu.Lock()
+		a := c.agents[name]
+		if a == nil {
+			a = &Agent{}
+			c.agents[name] = a
+		}
+		a.AgentStatus, a.LastSeen = *agent, time.Now()
+		if queue := c.queues[name]; len(queue) > 0 {
+			task := queue[0]
+			c.queues[name] = queue[1:]
+			task.Status = TaskRunning
+			t := *task
+			c.mu.Unlock()
+			return &pollReply{Task: &t}, nil
+		}
+		changed := c.changed
+		c.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return &pollReply{}, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// run schedules a RunRequest, then waits up to the wait of the call for it
+// to finish.
+func (c *coordinator) run(ctx context.Context, call *runCall) (*Task, error) {
+	req := call.Run
+	if req.ID == "" {
+		return nil, status.Error(codes.InvalidArgument, "the container id is required")
+	}
+	if req.Bundle == "" && req.Image == "" {
+		return nil, status.Error(codes.InvalidArgument, "a bundle or an image is required")
+	}
+	if req.Bundle != "" && !filepath.IsAbs(req.Bundle) {
+		return nil, status.Errorf(codes.InvalidArgument, "bundle %q must be an absolute path on the host", req.Bundle)
+	}
+	if call.Wait < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid wait %v", call.Wait)
+	}
+
+	c.mu.Lock()
+	host, err := c.schedule(req.Host)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, rpcError(err)
+	}
+	c.prune()
+	c.nextID++
+	task := &Task{ID: strconv.Itoa(c.nextID), Host: host, Run: req, Status: TaskPending, Created: time.Now().UTC()}
+	task.Run.Host = host
+	c.tasks[task.ID] = task
+	c.queues[host] = append(c.queues[host], task)
+	c.notify()
+	c.mu.Unlock()
+
+	return c.waitTask(ctx, task.ID, call.Wait)
+}
+
+// schedule returns the agent to run a container on: host if given, or
+// the one running the fewest containers, counting those pending. c.mu must
+// be held.
+func (c *coordinator) schedule(host string) (string, error) {
+	now := time.Now()
+	if host != "" {
+		a := c.agents[host]
+		if a == nil {
+			return "", fmt.Errorf("host %s %w", host, container.ErrNotFound)
+		}
+		if a.lost(now) {
+			return "", fmt.Errorf("host %s is lost: %w", host, container.ErrNotRunning)
+		}
+		return host, nil
+	}
+	best, load := "", 0
+	for name, a := range c.agents {
+		if a.lost(now) {
+			continue
+		}
+		l := a.Running + len(c.queues[name])
+		if best == "" || l < load || l == load && name < best {
+			best, load = name, l
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no host %w", container.ErrNotRunning)
+	}
+	return best, nil
+}
+
+// prune forgets the tasks finished more than taskRetention ago. c.mu must
+// be held.
+func (c *coordinator) prune() {
+	for id, t := range c.tasks {
+		if t.Finished != nil && time.Since(*t.Finished) > taskRetention {
+			delete(c.tasks, id)
+		}
+	}
+}
+
+func (c *coordinator) task(ctx context.Context, call *taskCall) (*Task, error) {
+	return c.waitTask(ctx, call.ID, 0)
+}
+
+// waitTask returns task id once it has finished, or after wait.
+func (c *coordinator) waitTask(ctx context.Context, id string, wait time.Duration) (*Task, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		c.mu.Lock()
+		task := c.tasks[id]
+		if task == nil {
+			c.mu.Unlock()
+			return nil, rpcError(fmt.Errorf("task %s %w", id, container.ErrNotFound))
+		}
+		t := *task
+		changed := c.changed
+		c.mu.Unlock()
+		if t.Finished != nil {
+			return &t, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return &t, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+// report records the outcome an agent reports for a task.
+func (c *coordinator) report(ctx context.Context, res *taskResult) (*empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	task := c.tasks[res.ID]
+	if task == nil {
+		return nil, rpcError(fmt.Errorf("task %s %w", res.ID, container.ErrNotFound))
+	}
+	now := time.Now().UTC()
+	task.Finished = &now
+	task.Status, task.Error = TaskDone, res.Error
+	if res.Error != "" {
+		task.Status = TaskFailed
+	}
+	c.notify()
+	return &empty{}, nil
+}
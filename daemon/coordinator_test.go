@@ -0,0 +1,250 @@
+package daemon
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClusterTLS writes a CA to dir and, for each name, a certificate of
+// it for localhost, returning their credentials.
+func writeClusterTLS(t *testing.T, dir string, names ...string) []ClusterTLS {
+	t.Helper()
+	key := func() *ecdsa.PrivateKey {
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	write := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caKey := key()
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := write("ca.pem", "CERTIFICATE", der)
+
+	var creds []ClusterTLS
+	for i, name := range names {
+		k := key()
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    ca.NotBefore,
+			NotAfter:     ca.NotAfter,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, cert, ca, &k.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		creds = append(creds, ClusterTLS{
+			CAFile:   caFile,
+			CertFile: write(name+".pem", "CERTIFICATE", der),
+			KeyFile:  write(name+"-key.pem", "PRIVATE KEY", keyDER),
+		})
+	}
+	return creds
+}
+
+// serveTestCoordinator serves c over TLS on loopback, returning its
+// address and the credentials of a client.
+func serveTestCoordinator(t *testing.T, c *coordinator) (string, ClusterTLS) {
+	t.Helper()
+	creds := writeClusterTLS(t, t.TempDir(), "coordinator", "client")
+	cfg, err := creds[0].config(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := c.server(cfg)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String(), creds[1]
+}
+
+func newTestCoordinator(t *testing.T) (*coordinator, *ClusterClient) {
+	t.Helper()
+	orig := pollTimeout
+	pollTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { pollTimeout = orig })
+
+	c := newCoordinator("secret")
+	addr, creds := serveTestCoordinator(t, c)
+	client, err := NewClusterClient(addr, "secret", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return c, client
+}
+
+func TestCoordinatorSchedule(t *testing.T) {
+	c, client := newTestCoordinator(t)
+	ctx := context.Background()
+
+	if _, err := client.Run(ctx, RunRequest{ID: "web", Bundle: "/srv/web"}, 0); err == nil {
+		t.Fatal("expected an error with no agent registered")
+	}
+	for _, s := range []AgentStatus{{Name: "a", Running: 3}, {Name: "b", Running: 1}} {
+		if task, err := client.poll(ctx, s); err != nil || task != nil {
+			t.Fatalf("poll(%s) = %v, %v", s.Name, task, err)
+		}
+	}
+
+	// b runs the fewest containers, so it gets web.
+	task, err := client.Run(ctx, RunRequest{ID: "web", Bundle: "/srv/web"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Host != "b" || task.Status != TaskPending {
+		t.Fatalf("got %+v, want web pending on b", task)
+	}
+	// A task pending on b counts towards it.
+	c.mu.Lock()
+	c.agents["b"].Running = 2
+	c.mu.Unlock()
+	if task, err := client.Run(ctx, RunRequest{ID: "db", Bundle: "/srv/db"}, 0); err != nil || task.Host != "a" {
+		t.Fatalf("got %+v, %v, want db on a", task, err)
+	}
+	if task, err := client.Run(ctx, RunRequest{Host: "a", ID: "cache", Image: "redis"}, 0); err != nil || task.Host != "a" {
+		t.Fatalf("got %+v, %v, want cache on a", task, err)
+	}
+
+	for _, req := range []RunRequest{
+		{Host: "c", ID: "web", Bundle: "/srv/web"},
+		{ID: "web", Bundle: "srv/web"},
+		{ID: "web"},
+		{Bundle: "/srv/web"},
+	} {
+		if _, err := client.Run(ctx, req, 0); err == nil {
+			t.Errorf("Run(%+v) succeeded", req)
+		}
+	}
+
+	c.mu.Lock()
+	c.agents["b"].LastSeen = time.Now().Add(-2 * agentTimeout)
+	c.mu.Unlock()
+	if _, err := client.Run(ctx, RunRequest{Host: "b", ID: "web", Bundle: "/srv/web"}, 0); err == nil {
+		t.Error("expected an error scheduling on a lost host")
+	}
+	agents, err := client.Agents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 2 || agents[0].Name != "a" || agents[0].Lost || !agents[1].Lost {
+		t.Errorf("got agents %+v", agents)
+	}
+}
+
+func TestCoordinatorRun(t *testing.T) {
+	_, client := newTestCoordinator(t)
+	ctx := context.Background()
+	if _, err := client.poll(ctx, AgentStatus{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The agent runs each task it is handed, failing db.
+	go func() {
+		for ran := 0; ran < 2; {
+			task, err := client.poll(ctx, AgentStatus{Name: "a"})
+			if err != nil || task == nil {
+				continue
+			}
+			var runErr error
+			if task.Run.ID == "db" {
+				runErr = errors.New("no space left on device")
+			}
+			client.report(ctx, task.ID, runErr)
+			ran++
+		}
+	}()
+
+	task, err := client.Run(ctx, RunRequest{ID: "web", Bundle: "/srv/web", Env: []string{"A=1"}}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != TaskDone || task.Host != "a" || task.Finished == nil || task.Run.Env[0] != "A=1" {
+		t.Errorf("got %+v, want web done on a", task)
+	}
+	task, err = client.Run(ctx, RunRequest{ID: "db", Bundle: "/srv/db"}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Status != TaskFailed || !strings.Contains(task.Error, "no space") {
+		t.Errorf("got %+v, want db failed", task)
+	}
+	if got, err := client.Task(ctx, task.ID); err != nil || got.Status != TaskFailed {
+		t.Errorf("Task(%s) = %+v, %v", task.ID, got, err)
+	}
+}
+
+func TestCoordinatorAuth(t *testing.T) {
+	addr, creds := serveTestCoordinator(t, newCoordinator("secret"))
+	ctx := context.Background()
+
+	client, err := NewClusterClient(addr, "guess", creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Agents(ctx); err == nil || !strings.Contains(err.Error(), "invalid cluster token") {
+		t.Errorf("got %v, want the token to be refused", err)
+	}
+
+	// A certificate of another CA is refused, whatever the token.
+	other := writeClusterTLS(t, t.TempDir(), "other")[0]
+	other.CAFile = creds.CAFile
+	client, err = NewClusterClient(addr, "secret", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Agents(ctx); err == nil {
+		t.Error("expected a certificate of another CA to be refused")
+	}
+
+	if _, err := NewClusterClient(addr, "secret", ClusterTLS{}); err == nil {
+		t.Error("expected an error without TLS credentials")
+	}
+	if _, err := NewClusterClient("http://"+addr, "secret", creds); err == nil {
+		t.Error("expected an error for a URL")
+	}
+}
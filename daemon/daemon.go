@@ -0,0 +1,328 @@
+// Package daemon implements "containish daemon", a long-running process that
+// exposes container state over an HTTP API on a unix socket.
+package daemon
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"containish/container"
+)
+
+// DefaultSocket is where the daemon listens when it isn't socket activated.
+const DefaultSocket = "/run/containish/containish.sock"
+
+// shutdownTimeout bounds how long in-flight requests may take once the
+// daemon has been asked to stop.
+const shutdownTimeout = 10 * time.Second
+
+// Options configures the daemon beyond its sockets.
+type Options struct {
+	// RestoreOnBoot starts again the containers the last shutdown
+	// stopped, see container.Runtime.RestoreAll.
+	RestoreOnBoot bool
+	// ShutdownContainers stops every running container when the daemon
+	// is asked to stop, recording them for RestoreOnBoot, see
+	// container.Runtime.ShutdownAll. StopTimeout is how long each has to
+	// exit before being killed.
+	ShutdownContainers bool
+	StopTimeout        time.Duration
+	// Coordinator, when set, is the address of the coordinator the daemon
+	// runs containers for as agent AgentName, authenticated by
+	// ClusterToken and ClusterTLS. See ClusterClient. Only bundles under
+	// BundleRoot, DefaultBundleRoot if empty, are run.
+	Coordinator  string
+	AgentName    string
+	ClusterToken string
+	ClusterTLS   ClusterTLS
+	BundleRoot   string
+	// HistoryInterval is how often the usage of the running containers is
+	// recorded in their usage history, container.HistoryInterval if zero.
+	// A negative interval records none.
+	HistoryInterval time.Duration
+}
+
+// Run reconciles the state of the containers with the host, see
+// container.Reconcile, then serves the API until SIGINT or SIGTERM is
+// received. When started by systemd socket activation the first passed
+// listener is used instead of socketPath. Readiness and shutdown are
+// reported through sd_notify. Unless debugSocket is empty, the debug
+// endpoints are served on it too.
+func Run(socketPath, debugSocket string, opts Options) error {
+	// Containers may have changed while no daemon was watching.
+	repairs, err := container.Reconcile()
+	for _, r := range repairs {
+		fmt.Printf("Contain-ish daemon repaired %s %s: %s\n", r.Kind, r.Name, r.Action)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	// What the kernel lacks is said once here rather than found out by
+	// each container.
+	for _, missing := range container.Kernel().Missing() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", missing)
+	}
+
+	var cluster *ClusterClient
+	if opts.Coordinator != "" {
+		if opts.AgentName == "" {
+			return fmt.Errorf("an agent name is required to register with the coordinator")
+		}
+		if cluster, err = NewClusterClient(opts.Coordinator, opts.ClusterToken, opts.ClusterTLS); err != nil {
+			return err
+		}
+		defer cluster.Close()
+	}
+
+	l, err := listen(socketPath)
+	if err != nil {
+		return err
+	}
+	// The debug socket is bound before anything is served, so failing to
+	// bind it leaves nothing behind but the API listener to close.
+	var dl net.Listener
+	if debugSocket != "" {
+		if dl, err = listenUnix(debugSocket, 0o600); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	// Cancelling the base context ends stats streams, which would
+	// otherwise hold up the shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := newEventBus()
+	go watchContainers(ctx, events)
+	if opts.HistoryInterval >= 0 {
+		go recordHistory(ctx, cmp.Or(opts.HistoryInterval, container.HistoryInterval))
+	}
+	srv := &http.Server{
+		Handler:     newMux(events),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	serveErr := make(chan error, 2)
+	go func() { serveErr <- srv.Serve(l) }()
+
+	if dl != nil {
+		// Profiles can take a while, so the debug server is closed rather
+		// than shut down.
+		debugSrv := &http.Server{Handler: debugMux()}
+		defer debugSrv.Close()
+		go func() { serveErr <- debugSrv.Serve(dl) }()
+		fmt.Printf("Contain-ish daemon serving debug endpoints on %s\n", dl.Addr())
+	}
+
+	if _, err := container.SdNotify("READY=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	fmt.Printf("Contain-ish daemon listening on %s\n", l.Addr())
+	if opts.RestoreOnBoot {
+		go restoreContainers(ctx)
+	}
+	if cluster != nil {
+		go runAgent(ctx, cluster, opts.AgentName, cmp.Or(opts.BundleRoot, DefaultBundleRoot))
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("daemon stopped: %w", err)
+	case sig := <-sigs:
+		fmt.Printf("Contain-ish daemon received %v, shutting down\n", sig)
+	}
+
+	if _, err := container.SdNotify("STOPPING=1"); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	if opts.ShutdownContainers {
+		shutdownContainers(opts.StopTimeout)
+	}
+	cancel()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down daemon: %w", err)
+	}
+	return nil
+}
+
+// restoreContainers starts again the containers the last shutdown stopped,
+// reporting each.
+func restoreContainers(ctx context.Context) {
+	rt, err := container.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return
+	}
+	results, err := rt.RestoreAll(ctx)
+	reportContainers("restored", results, err)
+}
+
+// shutdownContainers stops every running container, the API still being
+// served meanwhile.
+func shutdownContainers(timeout time.Duration) {
+	rt, err := container.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return
+	}
+	results, err := rt.ShutdownAll(context.Background(), container.WithStopTimeout(timeout))
+	reportContainers("stopped", results, err)
+}
+
+func reportContainers(done string, results []container.ContainerResult, err error) {
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", r.Id, r.Err)
+		} else {
+			fmt.Printf("Contain-ish daemon %s %s\n", done, r.Id)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+}
+
+// listen returns the socket-activated listener if there is one, otherwise a
+// fresh unix socket at path.
+func listen(path string) (net.Listener, error) {
+	if files := container.ListenFds(); len(files) > 0 {
+		l, err := net.FileListener(files[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to use socket-activated listener: %w", err)
+		}
+		for _, f := range files {
+			f.Close()
+		}
+		return l, nil
+	}
+	return listenUnix(path, 0o660)
+}
+
+// listenUnix listens on a fresh unix socket at path with the given mode.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create socket dir: %w", err)
+	}
+	// remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to chmod %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// newMux builds the HTTP API routes, serving the events of events.
+func newMux(events *eventBus) *http.ServeMux {
+	mux := http.NewServeMux()
+	for route, h := range map[string]http.HandlerFunc{
+		"GET /containers":            listContainers,
+		"GET /containers/{id}":       getContainer,
+		"GET /containers/{id}/stats": statsHandler(events),
+		"GET /stats":                 getAllStats,
+		"GET /events":                eventsHandler(events),
+		"GET /metrics":               metricsHandler,
+	} {
+		mux.HandleFunc(route, countRequests(route, h))
+	}
+	return mux
+}
+
+// listContainers lists every container, or with status and annotation
+// query parameters only those with one of the statuses and all of the
+// key=value annotations.
+func listContainers(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	containers, err := container.FindContainers(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if containers == nil {
+		containers = []*container.Container{}
+	}
+	writeJSON(w, http.StatusOK, containers)
+}
+
+func parseFilter(q url.Values) (container.StateFilter, error) {
+	var filter container.StateFilter
+	for _, name := range q["status"] {
+		st, err := container.ParseStatus(name)
+		if err != nil {
+			return filter, err
+		}
+		filter.Status = append(filter.Status, st)
+	}
+	for _, a := range q["annotation"] {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return filter, fmt.Errorf("invalid annotation filter %q, want key=value", a)
+		}
+		if filter.Annotations == nil {
+			filter.Annotations = map[string]string{}
+		}
+		filter.Annotations[k] = v
+	}
+	return filter, nil
+}
+
+func getContainer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	c, err := container.LoadState(id)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// errorStatus maps an error returned by the container package to an HTTP
+// status.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, container.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, container.ErrNotRunning), errors.Is(err, container.ErrExists):
+		return http.StatusConflict
+	case errors.Is(err, container.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
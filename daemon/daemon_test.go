@@ -0,0 +1,29 @@
+package daemon
+
+import (
+	"net/url"
+	"testing"
+
+	"containish/container"
+)
+
+func TestParseFilter(t *testing.T) {
+	q, _ := url.ParseQuery("status=running&status=created&annotation=tier=front&annotation=team=a")
+	filter, err := parseFilter(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filter.Status) != 2 || filter.Status[0] != container.Running || filter.Status[1] != container.Created {
+		t.Fatalf("unexpected statuses %v", filter.Status)
+	}
+	if len(filter.Annotations) != 2 || filter.Annotations["tier"] != "front" || filter.Annotations["team"] != "a" {
+		t.Fatalf("unexpected annotations %v", filter.Annotations)
+	}
+
+	for _, bad := range []string{"status=paused", "annotation=tier"} {
+		q, _ := url.ParseQuery(bad)
+		if _, err := parseFilter(q); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"containish/container"
+)
+
+// With --debug the daemon also serves net/http/pprof, expvar and a dump of
+// its state on a second unix socket, only accessible to root, so the
+// runtime itself can be profiled and inspected while it runs:
+//
+//	/debug/pprof/	profiles, see net/http/pprof
+//	/debug/vars	expvar variables, including those below
+//	/debug/dump	a Dump of the daemon
+//
+// "containish debug-dump" saves the dump.
+
+// DefaultDebugSocket is where the daemon serves its debug endpoints.
+const DefaultDebugSocket = "/run/containish/debug.sock"
+
+var (
+	startTime = time.Now()
+	// apiRequests counts the API requests served, by route.
+	apiRequests = expvar.NewMap("containish.api.requests")
+	// statsStreams is the number of stats streams being served.
+	statsStreams = expvar.NewInt("containish.stats.streams")
+)
+
+func init() {
+	expvar.Publish("containish.uptime.seconds", expvar.Func(func() any {
+		return int64(time.Since(startTime).Seconds())
+	}))
+	expvar.Publish("containish.goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// Dump is a snapshot of the daemon for diagnosing it.
+type Dump struct {
+	Time      time.Time `json:"time"`
+	Pid       int       `json:"pid"`
+	GoVersion string    `json:"goVersion"`
+	StartedAt time.Time `json:"startedAt"`
+	// Vars are the expvar variables, including the memory statistics of
+	// the Go runtime.
+	Vars map[string]json.RawMessage `json:"vars"`
+	// Containers are the containers as saved, or ContainersError when they
+	// can't be listed.
+	Containers      []*container.Container `json:"containers"`
+	ContainersError string                 `json:"containersError,omitempty"`
+	// Goroutines are the stacks of every goroutine, in the format of a
+	// panic.
+	Goroutines string `json:"goroutines"`
+}
+
+// debugMux builds the debug routes.
+func debugMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /debug/dump", dumpHandler)
+	return mux
+}
+
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, takeDump())
+}
+
+// takeDump snapshots the daemon.
+func takeDump() *Dump {
+	d := &Dump{
+		Time:      time.Now().UTC(),
+		Pid:       os.Getpid(),
+		GoVersion: runtime.Version(),
+		StartedAt: startTime.UTC(),
+		Vars:      map[string]json.RawMessage{},
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		d.Vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	containers, err := container.FindContainers(container.StateFilter{})
+	if err != nil {
+		d.ContainersError = err.Error()
+	}
+	d.Containers = containers
+	var stacks bytes.Buffer
+	_ = runtimepprof.Lookup("goroutine").WriteTo(&stacks, 2)
+	d.Goroutines = stacks.String()
+	return d
+}
+
+// countRequests counts the requests h serves under route.
+func countRequests(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiRequests.Add(route, 1)
+		h(w, r)
+	}
+}
+
+// unixClient returns an HTTP client reaching the daemon on socketPath,
+// whatever the host of the URLs.
+func unixClient(socketPath string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}}
+}
+
+// FetchDump copies the dump of the daemon serving its debug endpoints on
+// socketPath to w.
+func FetchDump(ctx context.Context, socketPath string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://containish/debug/dump", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := unixClient(socketPath).Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return fmt.Errorf("cannot reach %s, is the daemon running with --debug? %w", socketPath, err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("debug dump failed: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
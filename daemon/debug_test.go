@@ -0,0 +1,99 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugMux(t *testing.T) {
+	api := httptest.NewServer(newMux(newEventBus()))
+	defer api.Close()
+	count := func() int64 {
+		if v, ok := apiRequests.Get("GET /metrics").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := count()
+	resp, err := http.Get(api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	srv := httptest.NewServer(debugMux())
+	defer srv.Close()
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s: %s", path, resp.Status, body)
+		}
+		return string(body)
+	}
+
+	if body := get("/debug/pprof/"); !strings.Contains(body, "goroutine") {
+		t.Fatalf("unexpected pprof index:\n%s", body)
+	}
+	if body := get("/debug/pprof/goroutine?debug=1"); !strings.Contains(body, "goroutine profile") {
+		t.Fatalf("unexpected goroutine profile:\n%s", body)
+	}
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(get("/debug/vars")), &vars); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"memstats", "containish.api.requests", "containish.stats.streams", "containish.goroutines"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("expvar %s not published", name)
+		}
+	}
+	var counts map[string]int64
+	if err := json.Unmarshal(vars["containish.api.requests"], &counts); err != nil {
+		t.Fatal(err)
+	}
+	if counts["GET /metrics"] != before+1 {
+		t.Fatalf("GET /metrics counted %d times, want %d", counts["GET /metrics"], before+1)
+	}
+}
+
+func TestFetchDump(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "debug.sock")
+	l, err := listenUnix(socket, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: debugMux()}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	if err := FetchDump(context.Background(), socket, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var d Dump
+	if err := json.Unmarshal(buf.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Pid == 0 || d.GoVersion == "" || !strings.Contains(d.Goroutines, "goroutine ") || d.Vars["memstats"] == nil {
+		t.Fatalf("incomplete dump: pid %d, go %q, vars %d", d.Pid, d.GoVersion, len(d.Vars))
+	}
+
+	err = FetchDump(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), &buf)
+	if err == nil || !strings.Contains(err.Error(), "--debug") {
+		t.Fatalf("expected a hint to run the daemon with --debug, got %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"containish/container"
+)
+
+// The daemon publishes what happens to the containers on an event bus,
+// which the event stream of the API, the metrics and the stats streams
+// subscribe to rather than each polling the state of the containers.
+// Containers run without the daemon, so the events are not sent by the
+// runtime but found by a single watcher, comparing the state of the
+// containers every watchInterval and reading the oom_kill count of their
+// cgroups. Webhooks and restarts are still handled by the monitor and
+// webhook process of each container, as they must work without a daemon.
+
+// Events of the bus besides those of webhooks.
+const (
+	// eventCreate is published once a container has been created.
+	eventCreate container.EventType = "create"
+	// eventDelete is published once a container has been deleted.
+	eventDelete container.EventType = "delete"
+)
+
+// eventTypes are the types of the events of the bus.
+var eventTypes = []container.EventType{eventCreate, container.EventStart, container.EventOOM, container.EventHealth, container.EventStop, eventDelete}
+
+// watchInterval is how often the watcher compares the state of the
+// containers. It is a variable so tests can override it.
+var watchInterval = time.Second
+
+// eventBuffer is how many events a subscriber may lag behind before the
+// next ones are dropped for it.
+const eventBuffer = 64
+
+var (
+	// eventCounts counts the events published, by type.
+	eventCounts = expvar.NewMap("containish.events")
+	// droppedEvents counts the events dropped for slow subscribers.
+	droppedEvents = expvar.NewInt("containish.events.dropped")
+)
+
+// eventBus passes events to the subscribers wanting them.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscription]bool
+}
+
+type subscription struct {
+	ch    chan *container.Event
+	match func(*container.Event) bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[*subscription]bool{}}
+}
+
+// subscribe returns a channel receiving the events match accepts, all of
+// them if it is nil, and a function ending the subscription, which closes
+// the channel.
+func (b *eventBus) subscribe(match func(*container.Event) bool) (<-chan *container.Event, func()) {
+	s := &subscription{ch: make(chan *container.Event, eventBuffer), match: match}
+	b.mu.Lock()
+	b.subs[s] = true
+	b.mu.Unlock()
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+			close(s.ch)
+		})
+	}
+}
+
+// publish passes ev to the subscribers wanting it, never waiting on one:
+// a subscriber lagging eventBuffer events behind misses it.
+func (b *eventBus) publish(ev *container.Event) {
+	eventCounts.Add(string(ev.Type), 1)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.match != nil && !s.match(ev) {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+			droppedEvents.Add(1)
+		}
+	}
+}
+
+// watcher finds events by comparing the state of the containers with what
+// it saw last.
+type watcher struct {
+	seen map[string]*container.Container
+	// oomKills are the oom_kill counts of the cgroups of running
+	// containers.
+	oomKills map[string]int
+	// oomKillCount reads the oom_kill count of a cgroup.
+	oomKillCount func(cgroupPath string) (int, error)
+}
+
+func newWatcher() *watcher {
+	return &watcher{oomKills: map[string]int{}, oomKillCount: readOOMKills}
+}
+
+// watchContainers publishes the events of the containers on b until ctx is
+// done. What happened before it started isn't published.
+func watchContainers(ctx context.Context, b *eventBus) {
+	w := newWatcher()
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		containers, err := listContainerStates()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to watch containers: %v\n", err)
+		} else {
+			for _, ev := range w.scan(containers) {
+				b.publish(ev)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// listContainerStates lists every container, refreshing the status of
+// those saved as running, whose process may have exited on its own.
+func listContainerStates() ([]*container.Container, error) {
+	containers, err := container.FindContainers(container.StateFilter{})
+	if err != nil {
+		return nil, err
+	}
+	rt, err := container.New()
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range containers {
+		if !isRunning(c) {
+			continue
+		}
+		if cur, err := rt.State(c.Id); err == nil {
+			containers[i] = cur
+		}
+	}
+	return containers, nil
+}
+
+// scan returns the events that turned the containers seen last into
+// containers, by container, those deleted last. The first scan only
+// records them.
+func (w *watcher) scan(containers []*container.Container) []*container.Event {
+	first := w.seen == nil
+	cur := make(map[string]*container.Container, len(containers))
+	var events []*container.Event
+	for _, c := range containers {
+		cur[c.Id] = c
+		if first {
+			w.checkOOM(c)
+			continue
+		}
+		events = append(events, w.changes(w.seen[c.Id], c)...)
+	}
+	var gone []string
+	for id := range w.seen {
+		if cur[id] == nil {
+			gone = append(gone, id)
+		}
+	}
+	slices.Sort(gone)
+	for _, id := range gone {
+		events = append(events, event(eventDelete, w.seen[id]))
+		delete(w.oomKills, id)
+	}
+	w.seen = cur
+	return events
+}
+
+// changes returns the events that turned prev, nil for a new container,
+// into c.
+func (w *watcher) changes(prev, c *container.Container) []*container.Event {
+	var events []*container.Event
+	// The container may have been deleted and created again in between.
+	if prev != nil && !prev.CreatedAt.Equal(c.CreatedAt) {
+		events = append(events, event(eventDelete, prev))
+		delete(w.oomKills, c.Id)
+		prev = nil
+	}
+	if prev == nil {
+		events = append(events, event(eventCreate, c))
+		prev = &container.Container{Status: container.Created}
+		// The cgroup of a new container has seen no OOM kill yet.
+		w.oomKills[c.Id] = 0
+	}
+	wasRunning := isRunning(prev)
+	// A container restarted in between has another init process.
+	if wasRunning && isRunning(c) && prev.InitProcessPiD != c.InitProcessPiD {
+		events = append(events, event(container.EventStop, prev))
+		delete(w.oomKills, c.Id)
+		wasRunning = false
+	}
+	if !wasRunning && isRunning(c) {
+		events = append(events, event(container.EventStart, c))
+	}
+	if w.checkOOM(c) {
+		events = append(events, event(container.EventOOM, c))
+	}
+	if c.Health != nil && (prev.Health == nil || prev.Health.Status != c.Health.Status) {
+		events = append(events, event(container.EventHealth, c))
+	}
+	if prev.Status != container.Stopped && c.Status == container.Stopped {
+		events = append(events, event(container.EventStop, c))
+		delete(w.oomKills, c.Id)
+	}
+	return events
+}
+
+// checkOOM reports whether the oom_kill count of the cgroup of c went up
+// since it was last read.
+func (w *watcher) checkOOM(c *container.Container) bool {
+	if !isRunning(c) || c.CgroupPath == "" {
+		return false
+	}
+	n, err := w.oomKillCount(c.CgroupPath)
+	if err != nil {
+		return false
+	}
+	last, ok := w.oomKills[c.Id]
+	w.oomKills[c.Id] = n
+	return ok && n > last
+}
+
+// readOOMKills returns the oom_kill count of the memory.events file of the
+// cgroup at path.
+func readOOMKills(path string) (int, error) {
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "oom_kill "); ok {
+			return strconv.Atoi(v)
+		}
+	}
+	return 0, scanner.Err()
+}
+
+func isRunning(c *container.Container) bool {
+	return c.Status == container.Running || c.Status == container.Starting
+}
+
+func event(t container.EventType, c *container.Container) *container.Event {
+	ev := &container.Event{
+		Type:        t,
+		Id:          c.Id,
+		Time:        time.Now().UTC(),
+		Pid:         c.InitProcessPiD,
+		Bundle:      c.Bundle,
+		Annotations: c.Annotations,
+	}
+	if t == container.EventHealth {
+		ev.Health = c.Health.Status
+	}
+	return ev
+}
+
+// eventsHandler streams the events of b as newline delimited JSON until
+// the client goes away, with type and id query parameters only those of
+// one of the types and one of the containers.
+func eventsHandler(b *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		match, err := parseEventFilter(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+			return
+		}
+		events, cancel := b.subscribe(match)
+		defer cancel()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+		enc := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case ev := <-events:
+				if err := enc.Encode(ev); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// StreamEvents passes the events of the daemon listening on socketPath to
+// fn as they happen, only those of one of types and one of ids unless they
+// are empty, until ctx is done or the daemon stops.
+func StreamEvents(ctx context.Context, socketPath string, types []container.EventType, ids []string, fn func(*container.Event)) error {
+	q := url.Values{"id": ids}
+	for _, t := range types {
+		q.Add("type", string(t))
+	}
+	resp, err := apiGet(ctx, socketPath, "/events?"+q.Encode(), "event stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev container.Event
+		if err := dec.Decode(&ev); err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read events: %w", err)
+		}
+		fn(&ev)
+	}
+}
+
+// parseEventFilter parses the type and id query parameters.
+func parseEventFilter(r *http.Request) (func(*container.Event) bool, error) {
+	q := r.URL.Query()
+	var types []container.EventType
+	for _, t := range q["type"] {
+		if !slices.Contains(eventTypes, container.EventType(t)) {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		types = append(types, container.EventType(t))
+	}
+	ids := q["id"]
+	return func(ev *container.Event) bool {
+		return (len(types) == 0 || slices.Contains(types, ev.Type)) &&
+			(len(ids) == 0 || slices.Contains(ids, ev.Id))
+	}, nil
+}
+
+// writeEventMetrics renders the events published as Prometheus counters.
+func writeEventMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP containish_events_total Container events seen by the daemon.\n# TYPE containish_events_total counter\n")
+	for _, t := range eventTypes {
+		var n int64
+		if v, ok := eventCounts.Get(string(t)).(*expvar.Int); ok {
+			n = v.Value()
+		}
+		fmt.Fprintf(w, "containish_events_total{type=%q} %d\n", t, n)
+	}
+}
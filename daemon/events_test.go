@@ -0,0 +1,219 @@
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"containish/container"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+	all, cancelAll := b.subscribe(nil)
+	defer cancelAll()
+	web, cancelWeb := b.subscribe(func(ev *container.Event) bool { return ev.Id == "web" })
+
+	b.publish(&container.Event{Type: container.EventStart, Id: "db"})
+	b.publish(&container.Event{Type: container.EventStart, Id: "web"})
+	if ev := <-all; ev.Id != "db" {
+		t.Fatalf("got %s first, want db", ev.Id)
+	}
+	if ev := <-all; ev.Id != "web" {
+		t.Fatalf("got %s second, want web", ev.Id)
+	}
+	if ev := <-web; ev.Id != "web" {
+		t.Fatalf("filtered subscriber got %s, want web", ev.Id)
+	}
+
+	cancelWeb()
+	cancelWeb()
+	if _, ok := <-web; ok {
+		t.Fatal("expected the channel of a cancelled subscription to be closed")
+	}
+
+	// A subscriber lagging behind misses events rather than blocking.
+	dropped := droppedEvents.Value()
+	for i := 0; i < eventBuffer+3; i++ {
+		b.publish(&container.Event{Type: container.EventOOM, Id: "web"})
+	}
+	if n := droppedEvents.Value() - dropped; n != 3 {
+		t.Fatalf("dropped %d events, want 3", n)
+	}
+}
+
+func TestWatcherScan(t *testing.T) {
+	created := time.Now()
+	ooms := map[string]int{}
+	w := newWatcher()
+	w.oomKillCount = func(path string) (int, error) { return ooms[path], nil }
+	state := func(id string, st container.Status, pid int) *container.Container {
+		return &container.Container{Id: id, Status: st, InitProcessPiD: pid, CreatedAt: created, CgroupPath: id}
+	}
+	healthy := func(id, status string) *container.Container {
+		c := state(id, container.Running, 30)
+		c.Health = &container.Health{Status: status}
+		return c
+	}
+	types := func(events []*container.Event) string {
+		var s []string
+		for _, ev := range events {
+			s = append(s, ev.Id+":"+string(ev.Type))
+		}
+		return strings.Join(s, " ")
+	}
+
+	for _, step := range []struct {
+		containers []*container.Container
+		ooms       map[string]int
+		want       string
+	}{
+		// What is there already isn't reported.
+		{[]*container.Container{state("old", container.Running, 10)}, map[string]int{"old": 2}, ""},
+		{[]*container.Container{state("old", container.Running, 10), state("web", container.Created, 11)}, nil, "web:create"},
+		{[]*container.Container{state("old", container.Running, 10), state("web", container.Running, 11)}, map[string]int{"old": 3}, "old:oom web:start"},
+		// An OOM kill right after the creation is counted from zero.
+		{[]*container.Container{state("old", container.Stopped, 10), state("web", container.Running, 11), state("job", container.Stopped, 12)}, map[string]int{"web": 1}, "old:stop web:oom job:create job:stop"},
+		// Restarted, or deleted and created again, in between.
+		{[]*container.Container{state("web", container.Running, 20), {Id: "job", Status: container.Created, CreatedAt: created.Add(time.Second)}}, nil, "web:stop web:start job:delete job:create old:delete"},
+		{nil, nil, "job:delete web:delete"},
+		// Only changes of the health status are reported.
+		{[]*container.Container{healthy("api", container.HealthStarting)}, nil, "api:create api:start api:health_status"},
+		{[]*container.Container{healthy("api", container.HealthStarting)}, nil, ""},
+		{[]*container.Container{healthy("api", container.HealthUnhealthy)}, nil, "api:health_status"},
+	} {
+		for k, v := range step.ooms {
+			ooms[k] = v
+		}
+		got := types(w.scan(step.containers))
+		if got != step.want {
+			t.Errorf("got %q, want %q", got, step.want)
+		}
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	b := newEventBus()
+	srv := httptest.NewServer(newMux(b))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events?type=bogus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %s for an unknown event type, want 400", resp.Status)
+	}
+
+	resp, err = http.Get(srv.URL + "/events?type=stop&type=oom&id=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	for _, ev := range []*container.Event{
+		{Type: container.EventStart, Id: "web"},
+		{Type: container.EventStop, Id: "db"},
+		{Type: container.EventOOM, Id: "web"},
+		{Type: container.EventStop, Id: "web"},
+	} {
+		b.publish(ev)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	var got []string
+	for len(got) < 2 && scanner.Scan() {
+		var ev container.Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, ev.Id+":"+string(ev.Type))
+	}
+	if fmt.Sprint(got) != "[web:oom web:stop]" {
+		t.Fatalf("streamed %v, want the oom and stop of web", got)
+	}
+}
+
+func TestServeStatsEnded(t *testing.T) {
+	ended := make(chan *container.Event, 1)
+	n := 0
+	sample := func() (any, error) {
+		n++
+		if n == 2 {
+			ended <- &container.Event{Type: container.EventStop, Id: "web"}
+		}
+		return containerSample{Time: time.Now(), Stats: &container.Stats{Id: "web"}}, nil
+	}
+	w := httptest.NewRecorder()
+	serveStats(w, httptest.NewRequest(http.MethodGet, "/containers/web/stats?stream=true&interval=100ms", nil), sample, ended)
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 2 {
+		t.Fatalf("streamed %d samples, want the 2 taken before the stop", lines)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	b := newEventBus()
+	socket := filepath.Join(t.TempDir(), "containish.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: newMux(b)}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := StreamEvents(ctx, socket, []container.EventType{"bogus"}, nil, func(*container.Event) {}); err == nil || !strings.Contains(err.Error(), "unknown event type") {
+		t.Fatalf("StreamEvents of an unknown type = %v, want the error of the daemon", err)
+	}
+
+	got := make(chan string)
+	done := make(chan error)
+	go func() {
+		done <- StreamEvents(ctx, socket, []container.EventType{container.EventStop}, []string{"web"}, func(ev *container.Event) {
+			select {
+			case got <- ev.Id + ":" + string(ev.Type):
+			default:
+			}
+		})
+	}()
+	// Publish until the stream has subscribed.
+	deadline := time.After(5 * time.Second)
+	for {
+		b.publish(&container.Event{Type: container.EventStart, Id: "web"})
+		b.publish(&container.Event{Type: container.EventStop, Id: "db"})
+		b.publish(&container.Event{Type: container.EventStop, Id: "web"})
+		select {
+		case s := <-got:
+			if s != "web:stop" {
+				t.Fatalf("streamed %s, want the stop of web", s)
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatalf("StreamEvents = %v once canceled, want nil", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("no event streamed")
+		}
+	}
+}
+
+func TestStreamEventsNoDaemon(t *testing.T) {
+	err := StreamEvents(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), nil, nil, func(*container.Event) {})
+	if err == nil || !strings.Contains(err.Error(), "is the daemon running") {
+		t.Fatalf("StreamEvents without a daemon = %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"containish/container"
+)
+
+// While it runs the daemon samples the usage of every running container
+// into its usage history, see container.RecordUsage, which stats --history
+// and recommend read. A sample failing, as when the container stopped
+// since it was listed, is skipped; one failing to be recorded is warned
+// about once per container.
+
+// recordHistory samples the running containers every interval until ctx is
+// done.
+func recordHistory(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	warned := map[string]bool{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats, err := runningStats()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			continue
+		}
+		now := time.Now()
+		for _, s := range stats {
+			if err := container.RecordUsage(s, now); err != nil && !warned[s.Id] {
+				warned[s.Id] = true
+				fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"containish/container"
+)
+
+// metricsHandler exports the stats of every running container, and the
+// events of the containers, in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stats, err := runningStats()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w, stats)
+	writeEventMetrics(w)
+}
+
+// runningStats samples every running container.
+func runningStats() ([]*container.Stats, error) {
+	containers, err := container.FindContainers(container.StateFilter{Status: []container.Status{container.Running, container.Starting}})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []*container.Stats{}
+	for _, c := range containers {
+		if c.CgroupPath == "" {
+			continue
+		}
+		s, err := container.GetStats(c.Id)
+		if err != nil {
+			// the container may have stopped since we listed it
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// writeMetrics renders stats as Prometheus metrics.
+func writeMetrics(w io.Writer, stats []*container.Stats) {
+	metric := func(kind, name, help string, value func(*container.Stats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{id=%q} %g\n", name, s.Id, value(s))
+		}
+	}
+	gauge := func(name, help string, value func(*container.Stats) float64) {
+		metric("gauge", name, help, value)
+	}
+	// CPU time only grows, so it is a counter, for rate() to apply.
+	metric("counter", "containish_cpu_usage_seconds_total", "Total CPU time consumed by the container.",
+		func(s *container.Stats) float64 { return float64(s.CPUUsageUsec) / 1e6 })
+	gauge("containish_memory_usage_bytes", "Memory currently used by the container.",
+		func(s *container.Stats) float64 { return float64(s.MemoryCurrent) })
+	gauge("containish_pids", "Number of processes in the container.",
+		func(s *container.Stats) float64 { return float64(s.PidsCurrent) })
+
+	pressure := func(name, help string, value func(*container.PSIStats) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, s := range stats {
+			for _, res := range []struct {
+				name string
+				psi  *container.PSIStats
+			}{
+				{"cpu", s.Pressure.CPU},
+				{"memory", s.Pressure.Memory},
+				{"io", s.Pressure.IO},
+			} {
+				if res.psi == nil {
+					continue
+				}
+				fmt.Fprintf(w, "%s{id=%q,resource=%q} %g\n", name, s.Id, res.name, value(res.psi))
+			}
+		}
+	}
+	pressure("containish_pressure_some_avg10", "Percentage of the last 10s some tasks stalled on the resource.",
+		func(p *container.PSIStats) float64 { return p.Some.Avg10 })
+	pressure("containish_pressure_some_avg60", "Percentage of the last 60s some tasks stalled on the resource.",
+		func(p *container.PSIStats) float64 { return p.Some.Avg60 })
+	pressure("containish_pressure_full_avg10", "Percentage of the last 10s all tasks stalled on the resource.",
+		func(p *container.PSIStats) float64 { return p.Full.Avg10 })
+	pressure("containish_pressure_full_avg60", "Percentage of the last 60s all tasks stalled on the resource.",
+		func(p *container.PSIStats) float64 { return p.Full.Avg60 })
+}
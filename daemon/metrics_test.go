@@ -0,0 +1,39 @@
+package daemon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"containish/container"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	stats := []*container.Stats{{
+		Id:            "web",
+		CPUUsageUsec:  1500000,
+		MemoryCurrent: 4096,
+		Pressure: container.Pressure{
+			Memory: &container.PSIStats{Some: container.PSIData{Avg10: 12.5, Avg60: 3}},
+		},
+	}}
+
+	var buf bytes.Buffer
+	writeMetrics(&buf, stats)
+	out := buf.String()
+
+	for _, want := range []string{
+		"# TYPE containish_cpu_usage_seconds_total counter",
+		`containish_cpu_usage_seconds_total{id="web"} 1.5`,
+		`containish_memory_usage_bytes{id="web"} 4096`,
+		`containish_pressure_some_avg10{id="web",resource="memory"} 12.5`,
+		`containish_pressure_some_avg60{id="web",resource="memory"} 3`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `resource="cpu"`) {
+		t.Errorf("unexpected cpu pressure without PSI data:\n%s", out)
+	}
+}
@@ -0,0 +1,148 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"containish/container"
+)
+
+// Stats are returned as a single sample, or with the stream query parameter
+// set as newline delimited JSON samples, one per interval (1s unless given
+// by the interval parameter), until the client goes away. A container's
+// stream ends once the event bus has it stopped.
+
+const (
+	defaultStreamInterval = time.Second
+	minStreamInterval     = 100 * time.Millisecond
+)
+
+// containerSample is a sample of a container's stats.
+type containerSample struct {
+	Time time.Time `json:"time"`
+	*container.Stats
+}
+
+// aggregateSample is a sample of the stats of every running container.
+type aggregateSample struct {
+	Time       time.Time          `json:"time"`
+	Containers []*container.Stats `json:"containers"`
+}
+
+// statsHandler serves the stats of a container, ending a stream once
+// events has it stopped.
+func statsHandler(events *eventBus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		ended, cancel := events.subscribe(func(ev *container.Event) bool {
+			return ev.Id == id && (ev.Type == container.EventStop || ev.Type == eventDelete)
+		})
+		defer cancel()
+		first := true
+		sample := func() (any, error) {
+			if first {
+				first = false
+				rt, err := container.New()
+				if err != nil {
+					return nil, err
+				}
+				// State notices a container that exited on its own.
+				c, err := rt.State(id)
+				if err != nil {
+					return nil, err
+				}
+				if c.Status == container.Stopped {
+					return nil, fmt.Errorf("container %s is %w", id, container.ErrNotRunning)
+				}
+			}
+			s, err := container.GetStats(id)
+			if err != nil {
+				return nil, err
+			}
+			return containerSample{Time: time.Now().UTC(), Stats: s}, nil
+		}
+		serveStats(w, r, sample, ended)
+	}
+}
+
+func getAllStats(w http.ResponseWriter, r *http.Request) {
+	serveStats(w, r, func() (any, error) {
+		stats, err := runningStats()
+		if err != nil {
+			return nil, err
+		}
+		return aggregateSample{Time: time.Now().UTC(), Containers: stats}, nil
+	}, nil)
+}
+
+// serveStats writes one sample, or streams them if asked to until ended
+// receives. An error before the first sample is reported as such; one
+// later ends the stream.
+func serveStats(w http.ResponseWriter, r *http.Request, sample func() (any, error), ended <-chan *container.Event) {
+	stream, interval, err := streamParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s, err := sample()
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	if !stream {
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	statsStreams.Add(1)
+	defer statsStreams.Add(-1)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := enc.Encode(s); err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ended:
+			return
+		case <-ticker.C:
+		}
+		if s, err = sample(); err != nil {
+			return
+		}
+	}
+}
+
+// streamParams parses the stream and interval query parameters.
+func streamParams(r *http.Request) (stream bool, interval time.Duration, err error) {
+	q := r.URL.Query()
+	if v := q.Get("stream"); v != "" {
+		if stream, err = strconv.ParseBool(v); err != nil {
+			return false, 0, fmt.Errorf("invalid stream %q", v)
+		}
+	}
+	interval = defaultStreamInterval
+	if v := q.Get("interval"); v != "" {
+		if interval, err = time.ParseDuration(v); err != nil {
+			return false, 0, fmt.Errorf("invalid interval %q", v)
+		}
+		if interval < minStreamInterval {
+			return false, 0, fmt.Errorf("interval %s is below the minimum of %s", interval, minStreamInterval)
+		}
+	}
+	return stream, interval, nil
+}
@@ -0,0 +1,86 @@
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"containish/container"
+)
+
+func TestStreamParams(t *testing.T) {
+	for _, tt := range []struct {
+		query    string
+		stream   bool
+		interval time.Duration
+		ok       bool
+	}{
+		{"", false, defaultStreamInterval, true},
+		{"stream=true&interval=250ms", true, 250 * time.Millisecond, true},
+		{"stream=1", true, defaultStreamInterval, true},
+		{"stream=maybe", false, 0, false},
+		{"interval=10ms", false, 0, false},
+		{"interval=soon", false, 0, false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/stats?"+tt.query, nil)
+		stream, interval, err := streamParams(r)
+		if (err == nil) != tt.ok || stream != tt.stream || interval != tt.interval {
+			t.Errorf("%q: got %v, %v, %v", tt.query, stream, interval, err)
+		}
+	}
+}
+
+func TestServeStatsStream(t *testing.T) {
+	n := 0
+	sample := func() (any, error) {
+		n++
+		if n > 3 {
+			return nil, fmt.Errorf("container web is %w", container.ErrNotRunning)
+		}
+		return containerSample{Time: time.Now(), Stats: &container.Stats{Id: "web", PidsCurrent: uint64(n)}}, nil
+	}
+	w := httptest.NewRecorder()
+	serveStats(w, httptest.NewRequest(http.MethodGet, "/containers/web/stats?stream=true&interval=100ms", nil), sample, nil)
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("content type %q", ct)
+	}
+	var pids []uint64
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		var s containerSample
+		if err := json.Unmarshal(sc.Bytes(), &s); err != nil {
+			t.Fatalf("bad sample %q: %v", sc.Text(), err)
+		}
+		if s.Id != "web" || s.Time.IsZero() {
+			t.Fatalf("unexpected sample %q", sc.Text())
+		}
+		pids = append(pids, s.PidsCurrent)
+	}
+	if fmt.Sprint(pids) != "[1 2 3]" {
+		t.Fatalf("streamed %v, want the 3 samples taken before the container stopped", pids)
+	}
+}
+
+func TestServeStatsSingle(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveStats(w, httptest.NewRequest(http.MethodGet, "/stats", nil), func() (any, error) {
+		return aggregateSample{Containers: []*container.Stats{{Id: "web"}}}, nil
+	}, nil)
+	if w.Code != http.StatusOK || strings.Count(w.Body.String(), "\n") != 1 || !strings.Contains(w.Body.String(), `"id":"web"`) {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	serveStats(w, httptest.NewRequest(http.MethodGet, "/containers/web/stats?stream=true", nil), func() (any, error) {
+		return nil, fmt.Errorf("container web %w", container.ErrNotFound)
+	}, nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("got %d for a missing container, want 404", w.Code)
+	}
+}
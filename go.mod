@@ -3,12 +3,21 @@ module containish
 go 1.22
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/opencontainers/runtime-spec v1.2.0
 	github.com/spf13/cobra v1.8.1
+	github.com/tetratelabs/wazero v1.8.2
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/sys v0.29.0
+	google.golang.org/grpc v1.70.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/net v0.32.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20241202173237-19429a94021a // indirect
+	google.golang.org/protobuf v1.35.2 // indirect
 )
@@ -148,3 +148,62 @@ func TestDetachAndStop(t *testing.T) {
 		t.Fatalf("expected status Stopped, got %v", c.Status)
 	}
 }
+
+func TestExecCapabilities(t *testing.T) {
+	if os.Getenv("IN_VM") != "1" {
+		t.Skip("integration test only runs inside the VM")
+	}
+
+	build := exec.Command("go", "build", "-o", "containish")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build containish: %v\n%s", err, string(out))
+	}
+
+	id := "execcaps"
+	stateDir := filepath.Join("/run/miniruntime", id)
+	_ = exec.Command("sudo", "rm", "-rf", stateDir).Run()
+
+	runCmd := exec.Command("bash", "-c", "echo 'sleep 30' | sudo ./containish run -d "+id)
+	runCmd.Dir = ".."
+	if out, err := runCmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to run container: %v\n%s", err, string(out))
+	}
+	defer func() {
+		stop := exec.Command("sudo", "./containish", "stop", id)
+		stop.Dir = ".."
+		_ = stop.Run()
+	}()
+
+	stateBytes, err := exec.Command("sudo", "cat", filepath.Join(stateDir, "state.json")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to read state.json: %v\n%s", err, string(stateBytes))
+	}
+	var c container.Container
+	if err := json.Unmarshal(stateBytes, &c); err != nil {
+		t.Fatalf("failed to decode state.json: %v", err)
+	}
+
+	capEff := func(status []byte) string {
+		for _, line := range strings.Split(string(status), "\n") {
+			if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+				return strings.TrimSpace(v)
+			}
+		}
+		t.Fatalf("no CapEff in:\n%s", status)
+		return ""
+	}
+	initStatus, err := exec.Command("sudo", "cat", fmt.Sprintf("/proc/%d/status", c.InitProcessPiD)).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to read the status of the init process: %v\n%s", err, string(initStatus))
+	}
+	execCmd := exec.Command("sudo", "./containish", "exec", id, "cat", "/proc/self/status")
+	execCmd.Dir = ".."
+	execStatus, err := execCmd.Output()
+	if err != nil {
+		t.Fatalf("failed to exec in the container: %v\n%s", err, string(execStatus))
+	}
+	if got, want := capEff(execStatus), capEff(initStatus); got != want {
+		t.Fatalf("exec'd process has CapEff %s, want %s as the init process", got, want)
+	}
+}
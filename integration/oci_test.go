@@ -0,0 +1,44 @@
+package integration
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestOCIValidation runs the validation suite of opencontainers/runtime-tools
+// against containish. It is opt-in: RUNTIME_TOOLS must point at a checkout
+// of runtime-tools in which `make runtimetest validation-executables` has
+// been run. OCI_VALIDATION_TESTS optionally restricts the run to a space
+// separated list of tests, e.g. "validation/create/create.t".
+func TestOCIValidation(t *testing.T) {
+	if os.Getenv("IN_VM") != "1" {
+		t.Skip("integration test only runs inside the VM")
+	}
+	tools := os.Getenv("RUNTIME_TOOLS")
+	if tools == "" {
+		t.Skip("set RUNTIME_TOOLS to a runtime-tools checkout to run the OCI validation suite")
+	}
+
+	build := exec.Command("go", "build", "-o", "containish")
+	build.Dir = ".."
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build containish: %v\n%s", err, string(out))
+	}
+	runtime, err := filepath.Abs("../containish")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := []string{"make", "-C", tools, "localvalidation", "RUNTIME=" + runtime}
+	if tests := strings.TrimSpace(os.Getenv("OCI_VALIDATION_TESTS")); tests != "" {
+		args = append(args, "VALIDATION_TESTS="+tests)
+	}
+	out, err := exec.Command("sudo", args...).CombinedOutput()
+	t.Logf("%s", out)
+	if err != nil {
+		t.Fatalf("OCI validation failed: %v", err)
+	}
+}
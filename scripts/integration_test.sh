@@ -22,6 +22,6 @@ fi
 
 # Run the Go integration tests inside the VM
 echo "Running Go integration tests inside VM..."
-vagrant ssh -c "cd /vagrant && IN_VM=1 go test ./integration -v"
+vagrant ssh -c "cd /vagrant && IN_VM=1 RUNTIME_TOOLS=${RUNTIME_TOOLS:-} OCI_VALIDATION_TESTS='${OCI_VALIDATION_TESTS:-}' go test ./integration -v"
 
 echo "Integration tests completed"